@@ -11,7 +11,9 @@ import (
 
 	_ "net/http/pprof"
 
+	"github.com/grafana/metrictank/api/middleware"
 	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/idx/catalog"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/stats"
@@ -32,6 +34,18 @@ var (
 
 	// metric api.requests_span.mem is the timerange of requests hitting only the ringbuffer
 	reqSpanMem = stats.NewMeter32("api.requests_span.mem", false)
+
+	// metric api.requests_from_clamped is the number of series fetches of which the from was clamped
+	// because it predates the retention of the archive
+	reqFromClamped = stats.NewCounter32("api.requests_from_clamped")
+
+	// metric api.requests_partial_chunk is the number of series fetches of which the oldest chunk in memory was
+	// the incomplete first chunk of the series, so that its data was merged with the data from the store
+	reqPartialChunk = stats.NewCounter32("api.requests_partial_chunk")
+
+	// metric api.requests_store_unavailable is the number of series fetches that were served without the data from the store,
+	// because its circuit breaker was open
+	reqStoreUnavailable = stats.NewCounter32("api.requests_store_unavailable")
 )
 
 type Server struct {
@@ -39,8 +53,12 @@ type Server struct {
 	SSL             bool
 	certFile        string
 	keyFile         string
-	Macaron         *macaron.Macaron
+	Macaron         *macaron.Macaron // serves queries and cluster traffic
+	Admin           *macaron.Macaron // serves admin endpoints. same as Macaron unless admin-listen is set
+	Ingest          *macaron.Macaron // serves ingest endpoints. same as Macaron unless ingest-listen is set
+	ingestHandlers  []ingestHandler
 	MetricIndex     idx.MetricIndex
+	Catalog         *catalog.Catalog // nil unless the catalog is enabled
 	MemoryStore     mdata.Metrics
 	BackendStore    mdata.Store
 	PromQueryEngine *promql.Engine
@@ -48,11 +66,15 @@ type Server struct {
 	shutdown        chan struct{}
 	Tracer          opentracing.Tracer
 	prioritySetters []PrioritySetter
+	deleteJobs      *deleteJobs
 }
 
 func (s *Server) BindMetricIndex(i idx.MetricIndex) {
 	s.MetricIndex = i
 }
+func (s *Server) BindCatalog(c *catalog.Catalog) {
+	s.Catalog = c
+}
 func (s *Server) BindMemoryStore(store mdata.Metrics) {
 	s.MemoryStore = store
 }
@@ -72,6 +94,18 @@ func (s *Server) BindPromQueryEngine() {
 	s.PromQueryEngine = promql.NewEngine(s, nil)
 }
 
+type ingestHandler struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+// BindIngestHandler registers a handler for an ingest endpoint, such as an input plugin that
+// receives data over http. it will be served by the ingest listener.
+// must be called before Run
+func (s *Server) BindIngestHandler(path string, handler http.HandlerFunc) {
+	s.ingestHandlers = append(s.ingestHandlers, ingestHandler{path, handler})
+}
+
 type PrioritySetter interface {
 	ExplainPriority() interface{}
 }
@@ -80,52 +114,90 @@ func (s *Server) BindPrioritySetter(p PrioritySetter) {
 	s.prioritySetters = append(s.prioritySetters, p)
 }
 
-func NewServer() (*Server, error) {
-
+func newMacaron() *macaron.Macaron {
 	m := macaron.New()
 	m.Use(macaron.Logger())
 	m.Use(macaron.Recovery())
+	return m
+}
+
+func NewServer() (*Server, error) {
+
+	m := newMacaron()
+	admin := m
+	if adminListener.addr != "" {
+		admin = newMacaron()
+	}
+	ingest := m
+	if ingestListener.addr != "" {
+		ingest = newMacaron()
+	}
+
 	// route pprof to where it belongs, except for our own extensions
-	m.Use(func(ctx *macaron.Context) {
+	adminAuth := middleware.BasicAuth(adminListener.auth)
+	admin.Use(func(ctx *macaron.Context) {
 		if strings.HasPrefix(ctx.Req.URL.Path, "/debug/") &&
 			!strings.HasPrefix(ctx.Req.URL.Path, "/debug/pprof/block") &&
 			!strings.HasPrefix(ctx.Req.URL.Path, "/debug/pprof/mutex") {
-			http.DefaultServeMux.ServeHTTP(ctx.Resp, ctx.Req.Request)
+			ctx.Invoke(adminAuth)
+			if !ctx.Resp.Written() {
+				http.DefaultServeMux.ServeHTTP(ctx.Resp, ctx.Req.Request)
+			}
 		}
 	})
 
 	return &Server{
-		Addr:     Addr,
-		SSL:      UseSSL,
-		certFile: certFile,
-		keyFile:  keyFile,
-		shutdown: make(chan struct{}),
-		Macaron:  m,
-		Tracer:   opentracing.NoopTracer{},
+		Addr:       Addr,
+		SSL:        UseSSL,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		shutdown:   make(chan struct{}),
+		Macaron:    m,
+		Admin:      admin,
+		Ingest:     ingest,
+		Tracer:     opentracing.NoopTracer{},
+		deleteJobs: newDeleteJobs(),
 	}, nil
 }
 
 func (s *Server) Run() {
 	s.RegisterRoutes()
+	if s.Admin != s.Macaron {
+		go s.serve(adminListener, s.Admin)
+	}
+	if s.Ingest != s.Macaron {
+		go s.serve(ingestListener, s.Ingest)
+	}
+	s.serve(listener{
+		name:     "main",
+		addr:     s.Addr,
+		ssl:      s.SSL,
+		certFile: s.certFile,
+		keyFile:  s.keyFile,
+	}, s.Macaron)
+}
+
+// serve serves the handler on the listener, until the server is stopped
+func (s *Server) serve(lc listener, handler http.Handler) {
 	proto := "http"
-	if s.SSL {
+	if lc.ssl {
 		proto = "https"
 	}
-	log.Infof("API Listening on: %v://%s/", proto, s.Addr)
+	log.Infof("API Listening on: %v://%s/ (%s)", proto, lc.addr, lc.name)
 
 	// define our own listner so we can call Close on it
-	l, err := net.Listen("tcp", s.Addr)
+	l, err := net.Listen("tcp", lc.addr)
 	if err != nil {
-		log.Fatalf("API failed to listen on %s, %s", s.Addr, err.Error())
+		log.Fatalf("API failed to listen on %s, %s", lc.addr, err.Error())
 	}
 	go s.handleShutdown(l)
 	srv := http.Server{
-		Addr:    s.Addr,
-		Handler: s.Macaron,
+		Addr:    lc.addr,
+		Handler: handler,
 	}
-	if s.SSL {
+	if lc.ssl {
 		var cert tls.Certificate
-		cert, err = tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		cert, err = tls.LoadX509KeyPair(lc.certFile, lc.keyFile)
 		if err != nil {
 			log.Fatalf("API Failed to start server: %v", err)
 		}
@@ -150,7 +222,7 @@ func (s *Server) Stop() {
 
 func (s *Server) handleShutdown(l net.Listener) {
 	<-s.shutdown
-	log.Info("API shutdown started.")
+	log.Infof("API shutdown started. closing %s", l.Addr())
 	l.Close()
 }
 
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsBackfillRollups starts backfilling the rollups of the series matching the query on all instances.
+// it returns the number of series that are being backfilled, summed over all instances.
+func (s *Server) metricsBackfillRollups(ctx *middleware.Context, req models.MetricsBackfillRollups) {
+	series, err := s.backfillRollupsLocal(ctx.OrgId, req.Query)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	data := models.IndexBackfillRollups{
+		OrgId: ctx.OrgId,
+		Query: req.Query,
+	}
+	resps, err := s.peerQuery(ctx.Req.Context(), data, "metricsBackfillRollups", "/index/backfill-rollups", true)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	for _, r := range resps {
+		resp := models.MetricsBackfillRollupsResp{}
+		_, err = resp.UnmarshalMsg(r.buf)
+		if err != nil {
+			log.Errorf("HTTP metricsBackfillRollups error unmarshaling body from %s/index/backfill-rollups: %q", r.peer.GetName(), err.Error())
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		series += resp.Series
+	}
+
+	response.Write(ctx, response.NewJson(http.StatusAccepted, models.MetricsBackfillRollupsResp{Series: series}, ""))
+}
+
+func (s *Server) indexBackfillRollups(ctx *middleware.Context, req models.IndexBackfillRollups) {
+	series, err := s.backfillRollupsLocal(req.OrgId, req.Query)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	resp := models.MetricsBackfillRollupsResp{
+		Series: series,
+	}
+	response.Write(ctx, response.NewMsgp(200, &resp))
+}
+
+// backfillRollupsLocal starts backfilling the rollups of the series matching the query, in the background.
+// only primaries backfill, as they are the ones that save chunks. see mdata.BackfillRollups
+// it returns the number of series that are being backfilled.
+func (s *Server) backfillRollupsLocal(orgId uint32, query string) (int, error) {
+	ms, _ := s.MemoryStore.(*mdata.AggMetrics)
+	if ms == nil || s.BackendStore == nil || !cluster.Manager.IsPrimary() {
+		return 0, nil
+	}
+	nodes, err := s.MetricIndex.Find(orgId, query, 0, 0)
+	if err != nil {
+		// errors can only be caused by bad request.
+		return 0, response.NewError(http.StatusBadRequest, err.Error())
+	}
+	var defs []idx.Archive
+	for _, n := range nodes {
+		defs = append(defs, n.Defs...)
+	}
+	if len(defs) == 0 {
+		return 0, nil
+	}
+
+	log.Infof("HTTP metricsBackfillRollups backfilling the rollups of %d series matching %q of org %d", len(defs), query, orgId)
+	go func() {
+		var saved, failed int
+		for _, def := range defs {
+			n, err := ms.BackfillRollups(context.Background(), def.Id, def.SchemaId, def.AggId)
+			saved += n
+			if err != nil {
+				log.Errorf("HTTP metricsBackfillRollups failed to backfill the rollups of %s: %s", def.Id, err)
+				failed++
+				continue
+			}
+			if n > 0 && s.Cache != nil {
+				// the cache doesn't know about the chunks we saved
+				s.Cache.DelMetric(def.Id)
+			}
+		}
+		log.Infof("HTTP metricsBackfillRollups saved %d chunks for %d series matching %q of org %d. %d series failed", saved, len(defs), query, orgId, failed)
+	}()
+	return len(defs), nil
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestMetricsBackfillRollups(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPriority(0)
+	cluster.Manager.SetReady()
+
+	srv, _ := newSrv(0, 0)
+	for _, name := range []string{"host.web12.cpu", "host.web12.mem", "host.web13.cpu"} {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     name,
+			Interval: 10,
+			Time:     1300,
+		}
+		md.SetId()
+		srv.MetricIndex.AddOrUpdate(test.MustMKeyFromString(md.Id), md, 0)
+	}
+
+	backfill := func() int {
+		req := httptest.NewRequest("POST", "/metrics/backfill-rollups", strings.NewReader(url.Values{"query": {"host.*.cpu"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Org-Id", "1")
+		rec := httptest.NewRecorder()
+		srv.Admin.ServeHTTP(rec, req)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected backfill to be accepted, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp models.MetricsBackfillRollupsResp
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return resp.Series
+	}
+
+	cluster.Manager.SetPrimary(true)
+	if got := backfill(); got != 2 {
+		t.Fatalf("expected the primary to backfill 2 series, got %d", got)
+	}
+	// replicas don't save chunks
+	cluster.Manager.SetPrimary(false)
+	if got := backfill(); got != 0 {
+		t.Fatalf("expected a replica to backfill no series, got %d", got)
+	}
+}
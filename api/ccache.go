@@ -42,7 +42,7 @@ func (s *Server) ccacheDelete(ctx *middleware.Context, req models.CCacheDelete)
 		var toClear []idx.Node
 		if len(req.Patterns) > 0 {
 			for _, pattern := range req.Patterns {
-				nodes, err := s.MetricIndex.Find(req.OrgId, pattern, 0)
+				nodes, err := s.MetricIndex.Find(req.OrgId, pattern, 0, 0)
 				if err != nil {
 					if res.Errors == 0 {
 						res.FirstError = err.Error()
@@ -56,7 +56,7 @@ func (s *Server) ccacheDelete(ctx *middleware.Context, req models.CCacheDelete)
 		}
 
 		if len(req.Expr) > 0 {
-			nodes, err := s.MetricIndex.FindByTag(req.OrgId, req.Expr, 0)
+			nodes, err := s.MetricIndex.FindByTag(req.OrgId, req.Expr, 0, 0)
 			if err != nil {
 				if res.Errors == 0 {
 					res.FirstError = err.Error()
@@ -0,0 +1,102 @@
+// Package client implements a client for the metrictank http api
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/grafana/metrictank/api/models"
+)
+
+type Client struct {
+	addr   string
+	orgId  uint32
+	client *http.Client
+}
+
+// New creates a client for the metrictank instance at addr (e.g. http://localhost:6060)
+// which issues requests for the given org, using the given http client (or http.DefaultClient if nil)
+func New(addr string, orgId uint32, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{
+		addr:   addr,
+		orgId:  orgId,
+		client: client,
+	}
+}
+
+// FindPage returns up to limit nodes matching the query, starting after the given cursor
+// (use "" for the first page), as well as the cursor for the next page, which is "" if there are no more nodes.
+func (c *Client) FindPage(ctx context.Context, query, cursor string, limit int) ([]models.SeriesFindItem, string, error) {
+	var nodes []models.SeriesFindItem
+	next, err := c.findPage(ctx, query, cursor, limit, func(n models.SeriesFindItem) error {
+		nodes = append(nodes, n)
+		return nil
+	})
+	return nodes, next, err
+}
+
+// Find calls fn for all nodes matching the query, by requesting pages of up to pageSize nodes.
+// nodes are decoded as they are streamed in, so they are never all held in memory at once.
+// if fn returns an error, the iteration stops and the error is returned.
+func (c *Client) Find(ctx context.Context, query string, pageSize int, fn func(models.SeriesFindItem) error) error {
+	var cursor string
+	for {
+		next, err := c.findPage(ctx, query, cursor, pageSize, fn)
+		if err != nil || next == "" {
+			return err
+		}
+		cursor = next
+	}
+}
+
+func (c *Client) findPage(ctx context.Context, query, cursor string, limit int, fn func(models.SeriesFindItem) error) (string, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("format", "ndjson")
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	req, err := http.NewRequest("GET", c.addr+"/metrics/find?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Org-Id", strconv.FormatUint(uint64(c.orgId), 10))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("find request failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var n models.SeriesFindItem
+		err := dec.Decode(&n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to decode find response: %s", err)
+		}
+		if err := fn(n); err != nil {
+			return "", err
+		}
+	}
+	return resp.Header.Get("Next-Cursor"), nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+)
+
+func TestFindFollowsCursor(t *testing.T) {
+	pages := map[string]struct {
+		body string
+		next string
+	}{
+		"":   {"{\"path\":\"a.a\",\"leaf\":true}\n{\"path\":\"a.b\",\"leaf\":true}\n", "c1"},
+		"c1": {"{\"path\":\"a.c\",\"leaf\":false,\"hasChildren\":true}\n", ""},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Org-Id") != "12" || r.FormValue("format") != "ndjson" || r.FormValue("limit") != "2" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		page, ok := pages[r.FormValue("cursor")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if page.next != "" {
+			w.Header().Set("Next-Cursor", page.next)
+		}
+		fmt.Fprint(w, page.body)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, 12, nil)
+	var paths []string
+	err := c.Find(context.Background(), "a.*", 2, func(n models.SeriesFindItem) error {
+		paths = append(paths, n.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != "[a.a a.b a.c]" {
+		t.Fatalf("expected paths [a.a a.b a.c], got %v", paths)
+	}
+
+	nodes, next, err := c.FindPage(context.Background(), "a.*", "c1", 2)
+	if err != nil || next != "" || len(nodes) != 1 || !nodes[0].HasChildren {
+		t.Fatalf("expected last page with 1 node and no cursor, got %v %q %v", nodes, next, err)
+	}
+
+	_, _, err = c.FindPage(context.Background(), "a.*", "bogus", 2)
+	if err == nil {
+		t.Fatal("expected error for bad request")
+	}
+}
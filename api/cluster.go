@@ -7,13 +7,17 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/metrictank/api/middleware"
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/input"
+	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
 	log "github.com/sirupsen/logrus"
 	"github.com/tinylib/msgp/msgp"
 )
@@ -40,6 +44,29 @@ func (s *Server) explainPriority(ctx *middleware.Context) {
 	response.Write(ctx, response.NewJson(200, data, ""))
 }
 
+// ingestOffenders reports the series of which points were dropped due to series-rate-limit
+func (s *Server) ingestOffenders(ctx *middleware.Context, req models.IngestOffenders) {
+	offenders := input.SeriesRateOffenders(req.Limit)
+	if offenders == nil {
+		offenders = []input.SeriesRateOffender{}
+	}
+	response.Write(ctx, response.NewJson(200, offenders, ""))
+}
+
+// intervalViolations reports the series of which the observed interval deviates from the interval of their definition
+func (s *Server) intervalViolations(ctx *middleware.Context, req models.IngestOffenders) {
+	violations := input.IntervalViolations(req.Limit)
+	if violations == nil {
+		violations = []input.IntervalViolation{}
+	}
+	response.Write(ctx, response.NewJson(200, violations, ""))
+}
+
+// ingestDropped reports, per org, how many points were accepted by their series in memory, and how many were dropped by reason
+func (s *Server) ingestDropped(ctx *middleware.Context) {
+	response.Write(ctx, response.NewJson(200, mdata.GetDropped(), ""))
+}
+
 func (s *Server) getNodeStatus(ctx *middleware.Context) {
 	response.Write(ctx, response.NewJson(200, cluster.Manager.ThisNode(), ""))
 }
@@ -53,10 +80,100 @@ func (s *Server) setNodeStatus(ctx *middleware.Context, status models.NodeStatus
 		)
 		return
 	}
+	wasPrimary := cluster.Manager.IsPrimary()
 	cluster.Manager.SetPrimary(primary)
+	if wasPrimary && !primary {
+		s.publishUnsavedChunks()
+	}
 	ctx.PlainText(200, []byte("OK"))
 }
 
+// publishUnsavedChunks publishes the chunks we did not save yet, in the background,
+// so that the new primary can save them if it doesn't have the data itself.
+// e.g. when the new primary started after us, it may not have our oldest chunks.
+func (s *Server) publishUnsavedChunks() {
+	ms, ok := s.MemoryStore.(*mdata.AggMetrics)
+	if !ok {
+		return
+	}
+	go func() {
+		log.Info("demoted from primary. publishing unsaved chunks")
+		n := ms.PublishUnsavedChunks()
+		log.Infof("published %d unsaved chunks", n)
+	}()
+}
+
+// reloadRetention re-reads the storage-schemas and storage-aggregation files, and applies the changes
+// that can be applied at runtime. see mdata.ApplyRetention
+func (s *Server) reloadRetention(ctx *middleware.Context) {
+	ms, _ := s.MemoryStore.(*mdata.AggMetrics)
+	updated, err := mdata.ReloadRetention(ms)
+	if err != nil {
+		log.Warnf("HTTP reloadRetention: %s", err)
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	log.Infof("HTTP reloadRetention: reloaded retention settings. updated %d series", updated)
+	response.Write(ctx, response.NewJson(200, struct {
+		Updated int `json:"updated"`
+	}{updated}, ""))
+}
+
+func (s *Server) getSeriesLimits(ctx *middleware.Context) {
+	ms, ok := s.MemoryStore.(*mdata.AggMetrics)
+	if !ok {
+		response.Write(ctx, response.NewJson(200, []mdata.OrgSeries{}, ""))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, ms.SeriesLimits(), ""))
+}
+
+// getUsage returns the data held in memory by this node, in total and per org
+func (s *Server) getUsage(ctx *middleware.Context) {
+	response.Write(ctx, response.NewJson(200, mdata.GetUsage(), ""))
+}
+
+// getStoreStats returns the state of the backend store of this node
+func (s *Server) getStoreStats(ctx *middleware.Context) {
+	if s.BackendStore == nil {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "no backend store"))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, s.BackendStore.Stats(), ""))
+}
+
+// setSeriesLimit overrides the series limit of an org, or removes the override if the limit is negative
+func (s *Server) setSeriesLimit(ctx *middleware.Context, req models.SeriesLimit) {
+	ms, ok := s.MemoryStore.(*mdata.AggMetrics)
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "series limits are not supported by this memory store"))
+		return
+	}
+	ms.SetOrgSeriesLimit(req.OrgId, req.Limit)
+	log.Infof("HTTP setSeriesLimit: set series limit of org %d to %d", req.OrgId, req.Limit)
+	ctx.PlainText(200, []byte("OK"))
+}
+
+// metricInfo returns the in-memory state of a metric: its chunks, aggregators and rollups
+func (s *Server) metricInfo(ctx *middleware.Context, req models.MetricInfo) {
+	key, err := schema.MKeyFromString(req.Key)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid key %q: %s", req.Key, err)))
+		return
+	}
+	m, ok := s.MemoryStore.Get(key)
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "metric not found in memory"))
+		return
+	}
+	am, ok := m.(*mdata.AggMetric)
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "metric info is not supported by this memory store"))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, am.Info(), ""))
+}
+
 func (s *Server) appStatus(ctx *middleware.Context) {
 	if cluster.Manager.IsReady() {
 		ctx.PlainText(200, []byte("OK"))
@@ -115,7 +232,7 @@ func (s *Server) indexFind(ctx *middleware.Context, req models.IndexFind) {
 	resp := models.NewIndexFindResp()
 
 	for _, pattern := range req.Patterns {
-		nodes, err := s.MetricIndex.Find(req.OrgId, pattern, req.From)
+		nodes, err := s.MetricIndex.Find(req.OrgId, pattern, req.From, req.To)
 		if err != nil {
 			response.Write(ctx, response.WrapError(err))
 			return
@@ -175,7 +292,7 @@ func (s *Server) indexTagDelSeries(ctx *middleware.Context, request models.Index
 }
 
 func (s *Server) indexFindByTag(ctx *middleware.Context, req models.IndexFindByTag) {
-	metrics, err := s.MetricIndex.FindByTag(req.OrgId, req.Expr, req.From)
+	metrics, err := s.MetricIndex.FindByTag(req.OrgId, req.Expr, req.From, req.To)
 	if err != nil {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
 		return
@@ -206,15 +323,15 @@ func (s *Server) indexList(ctx *middleware.Context, req models.IndexList) {
 }
 
 func (s *Server) getData(ctx *middleware.Context, request models.GetData) {
-	series, err := s.getTargetsLocal(ctx.Req.Context(), request.Requests)
+	reqCtx, storeUnavailable := withStoreUnavailable(ctx.Req.Context())
+	series, err := s.getTargetsLocal(reqCtx, request.Requests)
 	if err != nil {
-		// the only errors returned are from us catching panics, so we should treat them
-		// all as internalServerErrors
+		// errors that don't specify a status code (e.g. caught panics) are treated as internalServerErrors
 		log.Errorf("HTTP getData() %s", err.Error())
 		response.Write(ctx, response.WrapError(err))
 		return
 	}
-	response.Write(ctx, response.NewMsgp(200, &models.GetDataResp{Series: series}))
+	response.Write(ctx, response.NewMsgp(200, &models.GetDataResp{Series: series, StoreUnavailable: atomic.LoadUint32(storeUnavailable) == 1}))
 }
 
 func (s *Server) indexDelete(ctx *middleware.Context, req models.IndexDelete) {
@@ -224,6 +341,12 @@ func (s *Server) indexDelete(ctx *middleware.Context, req models.IndexDelete) {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
 		return
 	}
+	if req.Purge {
+		if err := s.purgeSeries(ctx.Req.Context(), defs); err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+	}
 
 	resp := models.MetricsDeleteResp{
 		DeletedDefs: len(defs),
@@ -231,6 +354,20 @@ func (s *Server) indexDelete(ctx *middleware.Context, req models.IndexDelete) {
 	response.Write(ctx, response.NewMsgp(200, &resp))
 }
 
+func (s *Server) indexDeletePreview(ctx *middleware.Context, req models.IndexDelete) {
+	defs, err := s.MetricIndex.DeletePreview(req.OrgId, req.Query)
+	if err != nil {
+		// errors can only be caused by bad request.
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	resp := make([]msgp.Marshaler, len(defs))
+	for i := range defs {
+		resp[i] = &defs[i]
+	}
+	response.Write(ctx, response.NewMsgpArray(200, resp))
+}
+
 type PeerResponse struct {
 	peer cluster.Node
 	buf  []byte
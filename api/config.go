@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/api/models"
 	"github.com/raintank/dur"
 	log "github.com/sirupsen/logrus"
 )
@@ -32,8 +33,14 @@ var (
 	tagdbDefaultLimit     uint
 	speculationThreshold  float64
 
+	deleteConfirmThreshold int
+	infPolicy              string
+
 	graphiteProxy *httputil.ReverseProxy
 	timeZone      *time.Location
+
+	adminListener  = listener{name: "admin"}
+	ingestListener = listener{name: "ingest"}
 )
 
 func ConfigSetup() {
@@ -54,17 +61,37 @@ func ConfigSetup() {
 	apiCfg.IntVar(&getTargetsConcurrency, "get-targets-concurrency", 20, "maximum number of concurrent threads for fetching data on the local node. Each thread handles a single series.")
 	apiCfg.UintVar(&tagdbDefaultLimit, "tagdb-default-limit", 100, "default limit for tagdb query results, can be overridden with query parameter \"limit\"")
 	apiCfg.Float64Var(&speculationThreshold, "speculation-threshold", 1, "ratio of peer responses after which speculation is used. Set to 1 to disable.")
+	apiCfg.IntVar(&deleteConfirmThreshold, "delete-confirm-threshold", 0, "deletes that affect more series than this require the confirmation token of a dry run. (0 disables)")
+	apiCfg.StringVar(&infPolicy, "inf-policy", "value", "how render responses return infinite values: as null, or as-is. json can't represent them, so json responses always return them as null. (null|value)")
+	adminListener.registerFlags(apiCfg)
+	ingestListener.registerFlags(apiCfg)
 	globalconf.Register("http", apiCfg, flag.ExitOnError)
 }
 
 func ConfigProcess() {
 	logMinDur = dur.MustParseDuration("log-min-dur", logMinDurStr)
+	if deleteConfirmThreshold < 0 {
+		log.Fatal("API delete-confirm-threshold must not be negative")
+	}
+	switch infPolicy {
+	case "null":
+		models.InfAsNull = true
+	case "value":
+		models.InfAsNull = false
+	default:
+		log.Fatalf("API invalid inf-policy %q. must be null or value", infPolicy)
+	}
 
 	//validate the addr
 	_, err := net.ResolveTCPAddr("tcp", Addr)
 	if err != nil {
 		log.Fatal("API listen address is not a valid TCP address.")
 	}
+	for _, l := range []*listener{&adminListener, &ingestListener} {
+		if err := l.validate(); err != nil {
+			log.Fatalf("API %s", err.Error())
+		}
+	}
 
 	u, err := url.Parse(fallbackGraphite)
 	if err != nil {
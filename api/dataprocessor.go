@@ -2,15 +2,17 @@ package api
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"math"
 	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/chunk/tsz"
 	"github.com/grafana/metrictank/tracing"
@@ -22,23 +24,45 @@ import (
 )
 
 // doRecover is the handler that turns panics into returns from the top level of getTarget.
+// getTarget runs in its own goroutine, so letting a panic through would take down the node.
+// runtime errors are bugs, so we log their stack trace.
 func doRecover(errp *error) {
 	e := recover()
 	if e != nil {
-		if _, ok := e.(runtime.Error); ok {
-			panic(e)
+		if err, ok := e.(runtime.Error); ok {
+			log.Errorf("DP getTarget: recovered from %s. stack trace: %s", err, debug.Stack())
+			*errp = errors.NewInternal(err.Error())
+			return
 		}
 		if err, ok := e.(error); ok {
 			*errp = err
 		} else if errStr, ok := e.(string); ok {
-			*errp = errors.New(errStr)
+			*errp = errors.NewInternal(errStr)
 		} else {
-			*errp = fmt.Errorf("%v", e)
+			*errp = errors.NewInternal(fmt.Sprintf("%v", e))
 		}
 	}
 	return
 }
 
+// storeUnavailableKey is the context key of the flag that records whether series of a request
+// were served without the data from the store. see withStoreUnavailable
+type storeUnavailableKey struct{}
+
+// withStoreUnavailable returns a context in which fetches of series record whether they had to do without the store,
+// and the flag they record it in
+func withStoreUnavailable(ctx context.Context) (context.Context, *uint32) {
+	flag := new(uint32)
+	return context.WithValue(ctx, storeUnavailableKey{}, flag), flag
+}
+
+// markStoreUnavailable records that series of the request of the context were served without the data from the store
+func markStoreUnavailable(ctx context.Context) {
+	if flag, ok := ctx.Value(storeUnavailableKey{}).(*uint32); ok {
+		atomic.StoreUint32(flag, 1)
+	}
+}
+
 type getTargetsResp struct {
 	series []models.Series
 	err    error
@@ -129,6 +153,26 @@ func divide(pointsA, pointsB []schema.Point) []schema.Point {
 	return pointsA
 }
 
+func subtractContext(ctx context.Context, pointsA, pointsB []schema.Point) []schema.Point {
+	select {
+	case <-ctx.Done():
+		//request canceled
+		return nil
+	default:
+	}
+	return subtract(pointsA, pointsB)
+}
+
+func subtract(pointsA, pointsB []schema.Point) []schema.Point {
+	if len(pointsA) != len(pointsB) {
+		panic(fmt.Errorf("subtract of a series with len %d from a series with len %d", len(pointsB), len(pointsA)))
+	}
+	for i := range pointsA {
+		pointsA[i].Val -= pointsB[i].Val
+	}
+	return pointsA
+}
+
 func (s *Server) getTargets(ctx context.Context, reqs []models.Req) ([]models.Series, error) {
 	// split reqs into local and remote.
 	localReqs := make([]models.Req, 0)
@@ -217,6 +261,9 @@ func (s *Server) getTargetsRemote(ctx context.Context, remoteReqs map[string][]m
 				return
 			}
 			log.Debugf("DP getTargetsRemote: %s returned %d series", node.GetName(), len(resp.Series))
+			if resp.StoreUnavailable {
+				markStoreUnavailable(ctx)
+			}
 			responses <- getTargetsResp{resp.Series, nil}
 		}(nodeReqs)
 	}
@@ -277,6 +324,7 @@ LOOP:
 					QueryTo:      req.To,
 					QueryCons:    req.ConsReq,
 					Consolidator: req.Consolidator,
+					RawInterval:  req.RawInterval,
 				}}, nil}
 			}
 			wg.Done()
@@ -338,6 +386,21 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 				sumFixed,
 				cntFixed,
 			), req.OutInterval, nil
+		} else if req.Consolidator == consolidation.Range {
+			// there is no range archive: it is the max minus the min
+			maxFixed, err := s.getSeriesFixed(ctx, req, consolidation.Max)
+			if err != nil {
+				return nil, req.OutInterval, err
+			}
+			minFixed, err := s.getSeriesFixed(ctx, req, consolidation.Min)
+			if err != nil {
+				return nil, req.OutInterval, err
+			}
+			return subtractContext(
+				ctx,
+				maxFixed,
+				minFixed,
+			), req.OutInterval, nil
 		} else {
 			fixed, err := s.getSeriesFixed(ctx, req, req.Consolidator)
 			return fixed, req.OutInterval, err
@@ -358,6 +421,20 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 				consolidation.Consolidate(sumFixed, req.AggNum, consolidation.Sum),
 				consolidation.Consolidate(cntFixed, req.AggNum, consolidation.Sum),
 			), req.OutInterval, nil
+		} else if req.Consolidator == consolidation.Range {
+			maxFixed, err := s.getSeriesFixed(ctx, req, consolidation.Max)
+			if err != nil {
+				return nil, req.OutInterval, err
+			}
+			minFixed, err := s.getSeriesFixed(ctx, req, consolidation.Min)
+			if err != nil {
+				return nil, req.OutInterval, err
+			}
+			return subtractContext(
+				ctx,
+				consolidation.Consolidate(maxFixed, req.AggNum, consolidation.Max),
+				consolidation.Consolidate(minFixed, req.AggNum, consolidation.Min),
+			), req.OutInterval, nil
 		} else {
 			fixed, err := s.getSeriesFixed(ctx, req, req.Consolidator)
 			if err != nil {
@@ -387,6 +464,19 @@ func (s *Server) getSeriesFixed(ctx context.Context, req models.Req, consolidato
 	if rctx.From == rctx.To {
 		return nil, nil
 	}
+	// any data older than the TTL of the archive has expired, so don't bother looking for it.
+	// the output still covers the entire requested range, Fix() will pad it with nulls.
+	if minTs := retainedSince(uint32(time.Now().Unix()), req.TTL); rctx.From < minTs {
+		reqFromClamped.Inc()
+		if minTs >= rctx.To {
+			return Fix(nil, req.From, req.To, req.ArchInterval), nil
+		}
+		if consolidator == consolidation.None {
+			rctx.From = prevBoundary(minTs, req.ArchInterval) + 1
+		} else {
+			rctx.From = minTs
+		}
+	}
 	res, err := s.getSeries(rctx)
 	if err != nil {
 		return nil, err
@@ -416,9 +506,10 @@ func (s *Server) getSeries(ctx *requestContext) (mdata.Result, error) {
 	default:
 	}
 
-	log.Debugf("oldest from aggmetrics is %d", res.Oldest)
+	log.Debugf("oldest from aggmetrics is %d (partial: %t)", res.Oldest, res.Partial)
 	span := opentracing.SpanFromContext(ctx.ctx)
 	span.SetTag("oldest_in_ring", res.Oldest)
+	span.SetTag("partial_in_ring", res.Partial)
 
 	if res.Oldest <= ctx.From {
 		reqSpanMem.ValueUint32(ctx.To - ctx.From)
@@ -433,11 +524,18 @@ func (s *Server) getSeries(ctx *requestContext) (mdata.Result, error) {
 	if err != nil {
 		return res, err
 	}
+	if res.Partial {
+		// our oldest chunk only has the data from res.Oldest on. rather than leaving a gap before it,
+		// we use the data from the store, preferring it where both have data. see itersToPoints
+		reqPartialChunk.Inc()
+	}
 	res.Iters = append(fromCache, res.Iters...)
 	return res, nil
 }
 
 // itersToPoints converts the iters to points if they are within the from/to range
+// points that are not newer than the previous point are skipped: iters may overlap when the store
+// has the complete version of a partial chunk in memory (see mdata.Result.Partial)
 // TODO: just work on the result directly
 func (s *Server) itersToPoints(ctx *requestContext, iters []tsz.Iter) []schema.Point {
 	pre := time.Now()
@@ -449,12 +547,13 @@ func (s *Server) itersToPoints(ctx *requestContext, iters []tsz.Iter) []schema.P
 		for iter.Next() {
 			total += 1
 			ts, val := iter.Values()
-			if ts >= ctx.From && ts < ctx.To {
+			if ts >= ctx.From && ts < ctx.To && (len(points) == 0 || ts > points[len(points)-1].Ts) {
 				good += 1
 				points = append(points, schema.Point{Val: val, Ts: ts})
 			}
 		}
 		log.Debugf("DP getSeries: iter values good/total %d/%d", good, total)
+		tsz.ReleaseIter(iter)
 	}
 	itersToPointsDuration.Value(time.Now().Sub(pre))
 	return points
@@ -531,6 +630,13 @@ func (s *Server) getSeriesCachedStore(ctx *requestContext, until uint32) ([]tsz.
 	if !cacheRes.Complete {
 		if cacheRes.From != cacheRes.Until {
 			storeIterGens, err := s.BackendStore.Search(ctx.ctx, ctx.AMKey, ctx.Req.TTL, cacheRes.From, cacheRes.Until)
+			if err == mdata.ErrStoreUnavailable {
+				// serve what we have in memory and in the cache. the response says it's partial
+				reqStoreUnavailable.Inc()
+				markStoreUnavailable(ctx.ctx)
+				tracing.Errorf(span, "store unavailable")
+				return iters, nil
+			}
 			if err != nil {
 				return iters, err
 			}
@@ -606,11 +712,15 @@ func mergeSeries(in []models.Series) []models.Series {
 			// point and if it is null, we then check the other series for a non null
 			// value to use instead.
 			log.Debugf("DP mergeSeries: %s has multiple series.", series[0].Target)
-			for i := range series[0].Datapoints {
-				for j := 0; j < len(series); j++ {
-					if !math.IsNaN(series[j].Datapoints[i].Val) {
-						series[0].Datapoints[i].Val = series[j].Datapoints[i].Val
-						break
+			if series[0].Consolidator == consolidation.Avg {
+				mergeAvg(series)
+			} else {
+				for i := range series[0].Datapoints {
+					for j := 0; j < len(series); j++ {
+						if !math.IsNaN(series[j].Datapoints[i].Val) {
+							series[0].Datapoints[i].Val = series[j].Datapoints[i].Val
+							break
+						}
 					}
 				}
 			}
@@ -621,6 +731,38 @@ func mergeSeries(in []models.Series) []models.Series {
 	return merged
 }
 
+// mergeAvg merges averaged series of the same target into the first one.
+// where several of them have a value, e.g. around an interval change, taking
+// the first value would make the average step at the seam. Instead we weight
+// each value by the number of raw points it represents, i.e. by its interval.
+func mergeAvg(series []models.Series) {
+	for i := range series[0].Datapoints {
+		var sum, weight float64
+		var val float64
+		var n int
+		for _, serie := range series {
+			v := serie.Datapoints[i].Val
+			if math.IsNaN(v) {
+				continue
+			}
+			w := 1.0
+			if serie.RawInterval != 0 {
+				w = float64(serie.Interval) / float64(serie.RawInterval)
+			}
+			sum += v * w
+			weight += w
+			val = v
+			n++
+		}
+		if n > 1 {
+			val = sum / weight
+		}
+		if n > 0 {
+			series[0].Datapoints[i].Val = val
+		}
+	}
+}
+
 // requestContext is a more concrete specification to load data based on a models.Req
 type requestContext struct {
 	ctx context.Context
@@ -635,6 +777,15 @@ type requestContext struct {
 	AMKey schema.AMKey               // set by combining Req's key, consolidator and archive info
 }
 
+// retainedSince returns the oldest timestamp for which data with the given ttl may still be retained
+// ttl 0 means unknown, in which case it returns 0
+func retainedSince(now, ttl uint32) uint32 {
+	if ttl == 0 || ttl >= now {
+		return 0
+	}
+	return now - ttl
+}
+
 func prevBoundary(ts uint32, span uint32) uint32 {
 	return ts - ((ts-1)%span + 1)
 }
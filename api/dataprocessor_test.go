@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"math"
+	"net/http"
 	"reflect"
 	"testing"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/mdata/cache/accnt"
@@ -23,6 +25,31 @@ func init() {
 	cluster.Init("default", "test", time.Now(), "http", 6060)
 }
 
+func TestDoRecover(t *testing.T) {
+	cases := []struct {
+		fn      func()
+		expCode int
+	}{
+		{func() { panic(errors.NewBadRequest("bad")) }, http.StatusBadRequest},
+		{func() { panic("oops") }, http.StatusInternalServerError},
+		{func() {
+			var s []int
+			_ = s[1]
+		}, http.StatusInternalServerError},
+	}
+	for i, c := range cases {
+		err := func() (err error) {
+			defer doRecover(&err)
+			c.fn()
+			return nil
+		}()
+		codeErr, ok := err.(interface{ Code() int })
+		if !ok || codeErr.Code() != c.expCode {
+			t.Fatalf("case %d: expected error with code %d, got %v", i, c.expCode, err)
+		}
+	}
+}
+
 func TestDivide(t *testing.T) {
 	cases := []struct {
 		a   []schema.Point
@@ -84,6 +111,15 @@ func TestDivide(t *testing.T) {
 	}
 }
 
+func TestSubtract(t *testing.T) {
+	a := []schema.Point{{Val: 5, Ts: 10}, {Val: 8, Ts: 20}, {Val: math.NaN(), Ts: 30}}
+	b := []schema.Point{{Val: 2, Ts: 10}, {Val: 8, Ts: 20}, {Val: 1, Ts: 30}}
+	got := subtract(a, b)
+	if len(got) != 3 || got[0].Val != 3 || got[1].Val != 0 || !math.IsNaN(got[2].Val) {
+		t.Fatalf("expected [3 0 NaN], got %v", got)
+	}
+}
+
 type fixc struct {
 	in       []schema.Point
 	from     uint32
@@ -346,7 +382,7 @@ func TestGetSeriesFixed(t *testing.T) {
 	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
 	mdata.SetSingleSchema(conf.NewRetentionMT(10, 100, 600, 10, 0))
 
-	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0)
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 1, 0, 0, 0)
 	srv, _ := NewServer()
 	srv.BindBackendStore(store)
 	srv.BindMemoryStore(metrics)
@@ -364,7 +400,7 @@ func TestGetSeriesFixed(t *testing.T) {
 				num += 1
 				id := test.GetMKey(num)
 
-				metric := metrics.GetOrCreate(id, 0, 0)
+				metric, _ := metrics.GetOrCreate(id, 0, 0)
 				metric.Add(offset, 10)    // this point will always be quantized to 10
 				metric.Add(10+offset, 20) // this point will always be quantized to 20, so it should be selected
 				metric.Add(20+offset, 30) // this point will always be quantized to 30, so it should be selected
@@ -384,6 +420,49 @@ func TestGetSeriesFixed(t *testing.T) {
 	}
 }
 
+func TestGetSeriesFixedPartialFirstChunk(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	store := mdata.NewMockStore()
+	mdata.SetSingleAgg(conf.Avg)
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 10, 0))
+
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 1, 0, 0, 0)
+	srv, _ := NewServer()
+	srv.BindBackendStore(store)
+	srv.BindMemoryStore(metrics)
+	srv.BindCache(cache.NewCCache())
+
+	id := test.GetMKey(1)
+	// the primary saved the complete chunk 600
+	c := chunk.New(600)
+	for ts := uint32(600); ts < 1200; ts += 10 {
+		c.Push(ts, float64(ts))
+	}
+	c.Finish()
+	cwr := mdata.NewChunkWriteRequest(nil, schema.AMKey{MKey: id}, c, 0, 600, time.Now())
+	store.Add(&cwr)
+
+	// whereas we only received the data from 900 on
+	metric, _ := metrics.GetOrCreate(id, 0, 0)
+	for ts := uint32(900); ts < 1500; ts += 10 {
+		metric.Add(ts, float64(ts))
+	}
+
+	req := reqRaw(id, 600, 1500, 1000, 10, consolidation.None, 0, 0)
+	req.ArchInterval = 10
+	points, err := srv.getSeriesFixed(test.NewContext(), req, consolidation.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []schema.Point
+	for ts := uint32(600); ts < 1500; ts += 10 {
+		expected = append(expected, schema.Point{Val: float64(ts), Ts: ts})
+	}
+	if !reflect.DeepEqual(expected, points) {
+		t.Fatalf("expected the points of both the store and memory, once: exp %v - got %v", expected, points)
+	}
+}
+
 func reqRaw(key schema.MKey, from, to, maxPoints, rawInterval uint32, consolidator consolidation.Consolidator, schemaId, aggId uint16) models.Req {
 	req := models.NewReq(key, "", "", from, to, maxPoints, rawInterval, consolidator, 0, cluster.Manager.ThisNode(), schemaId, aggId)
 	return req
@@ -442,6 +521,48 @@ func TestMergeSeries(t *testing.T) {
 	}
 }
 
+func TestMergeSeriesAvg(t *testing.T) {
+	// the interval of the series changed from 10s to 60s. both are normalized to 60s,
+	// and around the change both have a point in the same bucket
+	in := []models.Series{
+		{
+			Target: "some.series.foo",
+			Datapoints: []schema.Point{
+				{Val: 1, Ts: 60},
+				{Val: 2, Ts: 120},
+				{Val: math.NaN(), Ts: 180},
+			},
+			Interval:     60,
+			Consolidator: consolidation.Avg,
+			RawInterval:  10,
+		},
+		{
+			Target: "some.series.foo",
+			Datapoints: []schema.Point{
+				{Val: math.NaN(), Ts: 60},
+				{Val: 9, Ts: 120},
+				{Val: 3, Ts: 180},
+			},
+			Interval:     60,
+			Consolidator: consolidation.Avg,
+			RawInterval:  60,
+		},
+	}
+	merged := mergeSeries(in)
+	if len(merged) != 1 {
+		t.Fatalf("expected data to be merged down to 1 series. got %d instead", len(merged))
+	}
+	// the 10s series represents 6 points per bucket, the 60s series 1
+	exp := []schema.Point{
+		{Val: 1, Ts: 60},
+		{Val: 3, Ts: 120},
+		{Val: 3, Ts: 180},
+	}
+	if !reflect.DeepEqual(exp, merged[0].Datapoints) {
+		t.Fatalf("expected %v, got %v", exp, merged[0].Datapoints)
+	}
+}
+
 // generates and returns a slice of chunks according to specified specs
 func generateChunks(span uint32, start uint32, end uint32) []chunk.Chunk {
 	var chunks []chunk.Chunk
@@ -501,7 +622,7 @@ func TestGetSeriesCachedStore(t *testing.T) {
 	store := mdata.NewMockStore()
 	srv.BindBackendStore(store)
 
-	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0)
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 1, 0, 0, 0)
 	srv.BindMemoryStore(metrics)
 	metric := test.GetAMKey(1)
 
@@ -686,7 +807,7 @@ func TestGetSeriesAggMetrics(t *testing.T) {
 	cluster.Init("default", "test", time.Now(), "http", 6060)
 	store := mdata.NewMockStore()
 
-	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0)
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 1, 0, 0, 0)
 	srv, _ := NewServer()
 	srv.BindBackendStore(store)
 	srv.BindMemoryStore(metrics)
@@ -698,7 +819,7 @@ func TestGetSeriesAggMetrics(t *testing.T) {
 	req.ArchInterval = archInterval
 	ctx := newRequestContext(test.NewContext(), &req, consolidation.None)
 
-	metric := metrics.GetOrCreate(metricKey, 0, 0)
+	metric, _ := metrics.GetOrCreate(metricKey, 0, 0)
 	for i := uint32(50); i < 3000; i++ {
 		metric.Add(i, float64(i^2))
 	}
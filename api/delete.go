@@ -0,0 +1,210 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsDeletePreview returns the series that deleting the query would delete, across all instances.
+// they are deduplicated (replicas have the same series) and sorted by name and id.
+func (s *Server) metricsDeletePreview(ctx context.Context, orgId uint32, query string) ([]idx.Archive, error) {
+	defs, err := s.MetricIndex.DeletePreview(orgId, query)
+	if err != nil {
+		// errors can only be caused by bad request.
+		return nil, response.NewError(http.StatusBadRequest, err.Error())
+	}
+	data := models.IndexDelete{
+		Query: query,
+		OrgId: orgId,
+	}
+	resps, err := s.peerQuery(ctx, data, "metricsDeletePreview", "/index/delete_preview", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resps {
+		buf := r.buf
+		for len(buf) != 0 {
+			var def idx.Archive
+			buf, err = def.UnmarshalMsg(buf)
+			if err != nil {
+				log.Errorf("HTTP metricsDelete error unmarshaling body from %s/index/delete_preview: %q", r.peer.GetName(), err.Error())
+				return nil, err
+			}
+			defs = append(defs, def)
+		}
+	}
+
+	seen := make(map[schema.MKey]struct{})
+	unique := defs[:0]
+	for _, def := range defs {
+		if _, ok := seen[def.Id]; ok {
+			continue
+		}
+		seen[def.Id] = struct{}{}
+		unique = append(unique, def)
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		if unique[i].Name != unique[j].Name {
+			return unique[i].Name < unique[j].Name
+		}
+		return unique[i].Id.String() < unique[j].Id.String()
+	})
+	return unique, nil
+}
+
+// deleteToken returns the token that confirms deleting the given (sorted) series.
+// it changes whenever the series that the query matches do, so that a delete only
+// goes ahead if it deletes what was reviewed in the dry run.
+func deleteToken(orgId uint32, query string, defs []idx.Archive) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n", orgId, query)
+	for _, def := range defs {
+		fmt.Fprintf(h, "%s\n", def.Id)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// writeDeleteDryRun writes the series that would be deleted as a csv download,
+// with the confirmation token in the Confirmation-Token header.
+func writeDeleteDryRun(ctx *middleware.Context, defs []idx.Archive, token string) {
+	ctx.Resp.Header().Set("Content-Type", "text/csv")
+	ctx.Resp.Header().Set("Content-Disposition", `attachment; filename="metrics-delete-dry-run.csv"`)
+	ctx.Resp.Header().Set("Confirmation-Token", token)
+	ctx.Resp.WriteHeader(200)
+
+	w := csv.NewWriter(ctx.Resp)
+	w.Write([]string{"id", "org_id", "name", "interval", "partition", "last_update", "first_seen"})
+	for _, def := range defs {
+		w.Write([]string{
+			def.Id.String(),
+			strconv.FormatUint(uint64(def.OrgId), 10),
+			def.NameWithTags(),
+			strconv.Itoa(def.Interval),
+			strconv.Itoa(int(def.Partition)),
+			strconv.FormatInt(def.LastUpdate, 10),
+			strconv.FormatInt(def.FirstSeen, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		// client went away
+		log.Debugf("HTTP metricsDelete failed to write dry run response: %s", err)
+	}
+}
+
+// purgeSeries deletes the data of the given (deleted) series from memory, the chunk cache and the store.
+// replicas purge the same series from the store, which is harmless.
+func (s *Server) purgeSeries(ctx context.Context, defs []idx.Archive) error {
+	ms, _ := s.MemoryStore.(*mdata.AggMetrics)
+	for _, def := range defs {
+		if ms != nil {
+			ms.Delete(def.Id)
+		}
+		if s.Cache != nil {
+			s.Cache.DelMetric(def.Id)
+		}
+		if s.BackendStore == nil {
+			continue
+		}
+		err := mdata.DeleteFromStore(ctx, s.BackendStore, def.Id, def.SchemaId, def.AggId)
+		if err == mdata.ErrDeleteUnsupported {
+			return response.NewError(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			log.Errorf("HTTP metricsDelete failed to delete %s from the store: %s", def.Id, err)
+			return response.NewError(http.StatusInternalServerError, fmt.Sprintf("failed to delete %s from the store: %s", def.Id, err))
+		}
+	}
+	return nil
+}
+
+// maxDeleteJobs is how many finished delete jobs we keep the status of
+const maxDeleteJobs = 100
+
+type deleteJob struct {
+	orgId uint32
+	job   models.MetricsDeleteJob
+}
+
+// deleteJobs tracks the deletes that run in the background, and the most recently finished ones
+type deleteJobs struct {
+	sync.Mutex
+	jobs     map[string]*deleteJob
+	finished []string // ids of finished jobs, oldest first
+}
+
+func newDeleteJobs() *deleteJobs {
+	return &deleteJobs{
+		jobs: make(map[string]*deleteJob),
+	}
+}
+
+// start registers a new running job, and returns it
+func (d *deleteJobs) start(orgId uint32, query string, purge bool) models.MetricsDeleteJob {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	j := &deleteJob{
+		orgId: orgId,
+		job: models.MetricsDeleteJob{
+			Id:      hex.EncodeToString(buf),
+			Query:   query,
+			Purge:   purge,
+			State:   "running",
+			Started: time.Now().Unix(),
+		},
+	}
+	d.Lock()
+	d.jobs[j.job.Id] = j
+	d.Unlock()
+	return j.job
+}
+
+// finish records the result of the job, and forgets the oldest finished jobs in excess of maxDeleteJobs
+func (d *deleteJobs) finish(id string, deleted int, err error) {
+	d.Lock()
+	defer d.Unlock()
+	j, ok := d.jobs[id]
+	if !ok {
+		return
+	}
+	j.job.DeletedDefs = deleted
+	j.job.State = "done"
+	if err != nil {
+		j.job.State = "failed"
+		j.job.Error = err.Error()
+	}
+	j.job.Finished = time.Now().Unix()
+	d.finished = append(d.finished, id)
+	for len(d.finished) > maxDeleteJobs {
+		delete(d.jobs, d.finished[0])
+		d.finished = d.finished[1:]
+	}
+}
+
+// get returns the job with the given id, if it belongs to the org
+func (d *deleteJobs) get(orgId uint32, id string) (models.MetricsDeleteJob, bool) {
+	d.Lock()
+	defer d.Unlock()
+	j, ok := d.jobs[id]
+	if !ok || j.orgId != orgId {
+		return models.MetricsDeleteJob{}, false
+	}
+	return j.job, true
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestMetricsDeleteDryRun(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPriority(0)
+	cluster.Manager.SetReady()
+	defer func(orig int) { deleteConfirmThreshold = orig }(deleteConfirmThreshold)
+	deleteConfirmThreshold = 1
+
+	srv, _ := newSrv(0, 0)
+	add := func(name string) {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     name,
+			Interval: 10,
+			Time:     100,
+		}
+		md.SetId()
+		srv.MetricIndex.AddOrUpdate(test.MustMKeyFromString(md.Id), md, 0)
+	}
+	add("test.a")
+	add("test.b.c")
+	add("other")
+
+	post := func(params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics/delete", strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Org-Id", "1")
+		rec := httptest.NewRecorder()
+		srv.Admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// above the threshold, deletes need a token
+	rec := post(url.Values{"query": {"test.*"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected delete without token to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = post(url.Values{"query": {"test.*"}, "dryRun": {"true"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected dry run to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	token := rec.Header().Get("Confirmation-Token")
+	if token == "" {
+		t.Fatalf("expected a confirmation token")
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read csv: %s", err)
+	}
+	if len(records) != 3 || records[1][2] != "test.a" || records[2][2] != "test.b.c" {
+		t.Fatalf("expected header and the 2 series under test in the csv, got %v", records)
+	}
+	if len(srv.MetricIndex.List(1)) != 3 {
+		t.Fatalf("expected the dry run not to delete anything")
+	}
+
+	// once the matching series change, the token no longer applies
+	add("test.d")
+	rec = post(url.Values{"query": {"test.*"}, "token": {token}})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected delete with stale token to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = post(url.Values{"query": {"test.*"}, "dryRun": {"true"}})
+	token = rec.Header().Get("Confirmation-Token")
+	rec = post(url.Values{"query": {"test.*"}, "token": {token}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected delete with token to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if defs := srv.MetricIndex.List(1); len(defs) != 1 || defs[0].Name != "other" {
+		t.Fatalf("expected only the series outside the query to remain, got %v", defs)
+	}
+
+	// below the threshold, no token is needed
+	rec = post(url.Values{"query": {"other"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected delete below the threshold to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMetricsDeleteAsyncPurge(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPriority(0)
+	cluster.Manager.SetReady()
+
+	srv, cache := newSrv(0, 0)
+	ms := srv.MemoryStore.(*mdata.AggMetrics)
+	add := func(name string) schema.MKey {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     name,
+			Interval: 10,
+			Time:     100,
+		}
+		md.SetId()
+		mkey := test.MustMKeyFromString(md.Id)
+		srv.MetricIndex.AddOrUpdate(mkey, md, 0)
+		m, _ := ms.GetOrCreate(mkey, 0, 0)
+		m.Add(100, 1)
+		return mkey
+	}
+	del := add("host.web12.cpu")
+	keep := add("host.web13.cpu")
+
+	do := func(path string, params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Org-Id", "1")
+		rec := httptest.NewRecorder()
+		srv.Admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("/metrics/delete", url.Values{"query": {"host.web12.*"}, "purge": {"true"}, "async": {"true"}})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected the job to be started, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job models.MetricsDeleteJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatalf("failed to decode job: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.State == "running" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rec = do("/metrics/delete/status", url.Values{"job": {job.Id}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected the job status, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+			t.Fatalf("failed to decode job: %s", err)
+		}
+	}
+	if job.State != "done" || job.DeletedDefs != 1 {
+		t.Fatalf("expected the job to have deleted 1 series, got %+v", job)
+	}
+
+	if _, ok := ms.Get(del); ok {
+		t.Fatalf("expected the deleted series to be removed from memory")
+	}
+	if len(cache.DelMetricKeys) != 1 || cache.DelMetricKeys[0] != del {
+		t.Fatalf("expected the deleted series to be removed from the cache, got %v", cache.DelMetricKeys)
+	}
+	if _, ok := ms.Get(keep); !ok {
+		t.Fatalf("expected the other series to remain in memory")
+	}
+	if defs := srv.MetricIndex.List(1); len(defs) != 1 || defs[0].Name != "host.web13.cpu" {
+		t.Fatalf("expected only the other series to remain in the index, got %v", defs)
+	}
+
+	if rec = do("/metrics/delete/status", url.Values{"job": {"unknown"}}); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown job not to be found, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/mdata"
+	log "github.com/sirupsen/logrus"
+)
+
+var errExportStoreUnavailable = response.NewError(http.StatusServiceUnavailable, "the store is unavailable: can't export the data of the series")
+
+// metricsExport returns the points of the series matching the query within the time range, as they are stored:
+// from the highest resolution archive that has data for the whole range, without consolidation or null padding.
+func (s *Server) metricsExport(ctx *middleware.Context, request models.MetricsExport) {
+	now := time.Now()
+	defaultFrom := uint32(now.Add(-time.Duration(24) * time.Hour).Unix())
+	defaultTo := uint32(now.Unix())
+	fromUnix, toUnix, err := getFromTo(request.FromTo, now, defaultFrom, defaultTo)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if fromUnix >= toUnix {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, InvalidTimeRangeErr.Error()))
+		return
+	}
+	// like the render api: from exclusive, to inclusive
+	fromUnix += 1
+	toUnix += 1
+
+	reqCtx := ctx.Req.Context()
+	series, err := s.findSeries(reqCtx, ctx.OrgId, []string{request.Query}, int64(fromUnix), 0)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	reqs := exportReqs(series, request.Query, fromUnix, toUnix)
+	if maxSeriesPerReq > 0 && len(reqs) > maxSeriesPerReq {
+		response.Write(ctx, response.NewError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request exceeds max-series-per-req limit (%d). Reduce the number of targets or ask your admin to increase the limit.", maxSeriesPerReq)))
+		return
+	}
+	reqs, err = planExport(uint32(now.Unix()), reqs)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	var out []models.Series
+	if len(reqs) > 0 {
+		getCtx, storeUnavailable := withStoreUnavailable(reqCtx)
+		out, err = s.getTargets(getCtx, reqs)
+		if err != nil {
+			log.Errorf("HTTP metricsExport %s", err.Error())
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		if atomic.LoadUint32(storeUnavailable) == 1 {
+			// an export with holes would easily go unnoticed
+			response.Write(ctx, errExportStoreUnavailable)
+			return
+		}
+	}
+
+	ctx.Resp.Header().Set("Content-Type", "text/csv")
+	ctx.Resp.Header().Set("Content-Disposition", `attachment; filename="metrics-export.csv"`)
+	ctx.Resp.WriteHeader(200)
+	if err := writeExportCSV(ctx.Resp, out); err != nil {
+		// client went away
+		log.Debugf("HTTP metricsExport failed to write response: %s", err)
+	}
+}
+
+// exportReqs returns a request for each of the series, to be executed by the node the series was found on
+func exportReqs(series []Series, query string, from, to uint32) []models.Req {
+	var reqs []models.Req
+	for _, r := range series {
+		for _, metric := range r.Series {
+			for _, archive := range metric.Defs {
+				reqs = append(reqs, models.NewReq(
+					archive.Id, archive.NameWithTags(), query, from, to, 0, uint32(archive.Interval), defaultConsolidator(archive), 0, r.Node, archive.SchemaId, archive.AggId))
+			}
+		}
+	}
+	return reqs
+}
+
+// planExport sets up the requests to read the highest resolution archive of each series that retains all the
+// requested data, or the lowest resolution one if none does, without runtime consolidation.
+// it returns errMaxPointsPerReq if the requests would return more points than allowed.
+func planExport(now uint32, reqs []models.Req) ([]models.Req, error) {
+	var points uint32
+	for i := range reqs {
+		req := &reqs[i]
+		req.Archive = -1
+		minTTL := now - req.From
+		schema := mdata.GetSchema(req.SchemaId)
+		for j, ret := range schema.Retentions {
+			if ret.Ready > req.From {
+				continue
+			}
+			// the raw data of rollup-only series is not saved, so it can't be read from
+			if j == 0 && schema.RollupOnly {
+				continue
+			}
+			req.Archive = j
+			req.TTL = uint32(ret.MaxRetention())
+			if j == 0 {
+				req.ArchInterval = req.RawInterval
+			} else {
+				req.ArchInterval = uint32(ret.SecondsPerPoint)
+			}
+			if req.TTL >= minTTL {
+				break
+			}
+		}
+		if req.Archive == -1 {
+			return nil, errUnSatisfiable
+		}
+		req.OutInterval = req.ArchInterval
+		req.AggNum = 1
+		points += (req.To - req.From) / req.ArchInterval
+	}
+	if maxPointsPerReqHard > 0 && points > uint32(maxPointsPerReqHard) {
+		return nil, errMaxPointsPerReq
+	}
+	return reqs, nil
+}
+
+// writeExportCSV writes a name,timestamp,value line for each non-null point of the series, ordered by name
+func writeExportCSV(w io.Writer, series []models.Series) error {
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].Target < series[j].Target
+	})
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "timestamp", "value"})
+	for _, serie := range series {
+		for _, p := range serie.Datapoints {
+			if math.IsNaN(p.Val) {
+				continue
+			}
+			cw.Write([]string{
+				serie.Target,
+				strconv.FormatUint(uint64(p.Ts), 10),
+				strconv.FormatFloat(p.Val, 'f', -1, 64),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestPlanExport(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern: regexp.MustCompile(".*"),
+			Retentions: conf.Retentions{
+				conf.NewRetentionMT(10, 1200, 600, 0, 0),
+				conf.NewRetentionMT(60, 7200, 3600, 0, 0),
+			},
+		},
+	})
+
+	// the raw data is still retained
+	reqs, err := planExport(1200, []models.Req{reqRaw(test.GetMKey(1), 600, 1200, 0, 10, consolidation.Avg, 0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := reqOut(test.GetMKey(1), 600, 1200, 0, 10, consolidation.Avg, 0, 0, 0, 10, 1200, 10, 1)
+	if !exp.Equals(reqs[0]) {
+		t.Fatalf("expected %s, got %s", exp.DebugString(), reqs[0].DebugString())
+	}
+
+	// the raw data has expired: read the rollup, without consolidating it any further
+	reqs, err = planExport(3000, []models.Req{reqRaw(test.GetMKey(1), 600, 1200, 0, 10, consolidation.Avg, 0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = reqOut(test.GetMKey(1), 600, 1200, 0, 10, consolidation.Avg, 0, 0, 1, 60, 7200, 60, 1)
+	if !exp.Equals(reqs[0]) {
+		t.Fatalf("expected %s, got %s", exp.DebugString(), reqs[0].DebugString())
+	}
+
+	ori := maxPointsPerReqHard
+	defer func() { maxPointsPerReqHard = ori }()
+	maxPointsPerReqHard = 50
+	_, err = planExport(1200, []models.Req{reqRaw(test.GetMKey(1), 600, 1200, 0, 10, consolidation.Avg, 0, 0)})
+	if err != errMaxPointsPerReq {
+		t.Fatalf("expected errMaxPointsPerReq, got %v", err)
+	}
+}
+
+func TestWriteExportCSV(t *testing.T) {
+	series := []models.Series{
+		{
+			Target:     "b",
+			Datapoints: []schema.Point{{Val: 1.5, Ts: 10}, {Val: math.NaN(), Ts: 20}, {Val: 3, Ts: 30}},
+		},
+		{
+			Target:     "a",
+			Datapoints: []schema.Point{{Val: -2, Ts: 10}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeExportCSV(&buf, series); err != nil {
+		t.Fatal(err)
+	}
+	exp := "name,timestamp,value\na,10,-2\nb,10,1.5\nb,30,3\n"
+	if buf.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, buf.String())
+	}
+}
+
+// exportNode is a remote node that answers /getdata with a point per requested series, with the value of the node's id.
+// it records the series it was asked for.
+type exportNode struct {
+	sync.Mutex
+	name   string
+	val    float64
+	series []string
+}
+
+func (n *exportNode) IsLocal() bool          { return false }
+func (n *exportNode) IsReady() bool          { return true }
+func (n *exportNode) GetPartitions() []int32 { return nil }
+func (n *exportNode) GetPriority() int       { return 0 }
+func (n *exportNode) GetName() string        { return n.name }
+
+func (n *exportNode) Post(ctx context.Context, name, path string, body cluster.Traceable) ([]byte, error) {
+	var resp models.GetDataResp
+	for _, req := range body.(models.GetData).Requests {
+		n.Lock()
+		n.series = append(n.series, req.Target)
+		n.Unlock()
+		resp.Series = append(resp.Series, models.Series{
+			Target:     req.Target,
+			Datapoints: []schema.Point{{Val: n.val, Ts: req.From}},
+		})
+	}
+	return resp.MarshalMsg(nil)
+}
+
+// TestExportAcrossNodes checks that the data of each series is requested from the node it was found on
+func TestExportAcrossNodes(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.Retentions{conf.NewRetentionMT(10, 3600, 600, 0, 0)},
+		},
+	})
+	mdata.SetSingleAgg(conf.Avg)
+	nodeA := &exportNode{name: "a", val: 1}
+	nodeB := &exportNode{name: "b", val: 2}
+	def := func(i int, name string) idx.Archive {
+		return idx.Archive{MetricDefinition: schema.MetricDefinition{Id: test.GetMKey(i), OrgId: 1, Name: name, Interval: 10}}
+	}
+	series := []Series{
+		{Pattern: "foo.*", Node: nodeA, Series: []idx.Node{
+			{Path: "foo.a1", Leaf: true, Defs: []idx.Archive{def(1, "foo.a1")}},
+			{Path: "foo.a2", Leaf: true, Defs: []idx.Archive{def(2, "foo.a2")}},
+		}},
+		{Pattern: "foo.*", Node: nodeB, Series: []idx.Node{
+			{Path: "foo.b1", Leaf: true, Defs: []idx.Archive{def(3, "foo.b1")}},
+		}},
+	}
+
+	reqs, err := planExport(1200, exportReqs(series, "foo.*", 600, 1200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	out, err := s.getTargets(context.Background(), reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(nodeA.series)
+	if len(nodeA.series) != 2 || nodeA.series[0] != "foo.a1" || nodeA.series[1] != "foo.a2" {
+		t.Fatalf("expected node a to be asked for its 2 series, got %v", nodeA.series)
+	}
+	if len(nodeB.series) != 1 || nodeB.series[0] != "foo.b1" {
+		t.Fatalf("expected node b to be asked for its series, got %v", nodeB.series)
+	}
+
+	var buf bytes.Buffer
+	if err := writeExportCSV(&buf, out); err != nil {
+		t.Fatal(err)
+	}
+	exp := "name,timestamp,value\nfoo.a1,600,1\nfoo.a2,600,1\nfoo.b1,600,2\n"
+	if buf.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, buf.String())
+	}
+}
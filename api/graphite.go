@@ -1,14 +1,19 @@
 package api
 
 import (
+	"bufio"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/raintank/schema"
@@ -18,6 +23,7 @@ import (
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/expr"
 	"github.com/grafana/metrictank/idx"
@@ -55,11 +61,14 @@ type Series struct {
 	Node    cluster.Node
 }
 
-func (s *Server) findSeries(ctx context.Context, orgId uint32, patterns []string, seenAfter int64) ([]Series, error) {
+// findSeries finds the series matching the patterns across the cluster.
+// series not seen since seenAfter, or first seen at or after firstSeenBefore, are excluded. 0 disables either filter.
+func (s *Server) findSeries(ctx context.Context, orgId uint32, patterns []string, seenAfter, firstSeenBefore int64) ([]Series, error) {
 	data := models.IndexFind{
 		Patterns: patterns,
 		OrgId:    orgId,
 		From:     seenAfter,
+		To:       firstSeenBefore,
 	}
 
 	resps, err := s.peerQuerySpeculative(ctx, data, "findSeriesRemote", "/index/find")
@@ -184,7 +193,7 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 	newctx, span := tracing.NewSpan(ctx.Req.Context(), s.Tracer, "executePlan")
 	defer span.Finish()
 	ctx.Req = macaron.Request{ctx.Req.WithContext(newctx)}
-	out, err := s.executePlan(ctx.Req.Context(), ctx.OrgId, plan)
+	out, meta, err := s.executePlan(ctx.Req.Context(), ctx.OrgId, plan, request.OpenChunks == "exclude")
 	if err != nil {
 		err := response.WrapError(err)
 		if err.Code() != http.StatusBadRequest {
@@ -214,6 +223,13 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		span.SetTag("nodatapoints", true)
 	}
 
+	for _, w := range meta.Warnings {
+		ctx.Resp.Header().Add("Warning", `199 metrictank "`+w+`"`)
+	}
+	if meta.OpenChunksFrom != 0 {
+		ctx.Resp.Header().Set("Open-Chunks-From", strconv.FormatUint(uint64(meta.OpenChunksFrom), 10))
+	}
+
 	switch request.Format {
 	case "msgp":
 		response.Write(ctx, response.NewMsgp(200, models.SeriesByTarget(out)))
@@ -222,7 +238,11 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 	case "pickle":
 		response.Write(ctx, response.NewPickle(200, models.SeriesByTarget(out)))
 	default:
-		response.Write(ctx, response.NewFastJson(200, models.SeriesByTarget(out)))
+		if request.Meta {
+			response.Write(ctx, response.NewFastJson(200, models.ResponseWithMeta{Meta: meta, Series: models.SeriesByTarget(out)}))
+		} else {
+			response.Write(ctx, response.NewFastJson(200, models.SeriesByTarget(out)))
+		}
 	}
 	plan.Clean()
 }
@@ -237,7 +257,7 @@ func (s *Server) metricsFind(ctx *middleware.Context, request models.GraphiteFin
 	}
 	nodes := make([]idx.Node, 0)
 	reqCtx := ctx.Req.Context()
-	series, err := s.findSeries(reqCtx, ctx.OrgId, []string{request.Query}, int64(fromUnix))
+	series, err := s.findSeries(reqCtx, ctx.OrgId, []string{request.Query}, int64(fromUnix), int64(toUnix))
 	if err != nil {
 		response.Write(ctx, response.WrapError(err))
 		return
@@ -276,6 +296,13 @@ func (s *Server) metricsFind(ctx *middleware.Context, request models.GraphiteFin
 		response.Write(ctx, response.NewMsgpack(200, findPickle(nodes, request, fromUnix, toUnix)))
 	case "pickle":
 		response.Write(ctx, response.NewPickle(200, findPickle(nodes, request, fromUnix, toUnix)))
+	case "ndjson":
+		after, err := decodeFindCursor(request.Cursor)
+		if err != nil {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		findNdjson(ctx.Resp, nodes, after, request.Limit)
 	}
 }
 
@@ -421,6 +448,62 @@ func findPickle(nodes []idx.Node, request models.GraphiteFind, fromUnix, toUnix
 	return result
 }
 
+// findNdjson streams the nodes sorted by path, as newline delimited json, rather than building
+// one (potentially huge) response in memory. Only nodes after the path `after` are included,
+// and no more than limit (if non-zero). When nodes remain, the cursor to resume from is set in the Next-Cursor header.
+func findNdjson(w http.ResponseWriter, nodes []idx.Node, after string, limit int) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+	nodes = nodes[sort.Search(len(nodes), func(i int) bool { return nodes[i].Path > after }):]
+	if limit > 0 && len(nodes) > limit {
+		nodes = nodes[:limit]
+		w.Header().Set("Next-Cursor", encodeFindCursor(nodes[limit-1].Path))
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+
+	// once the buffer fills up, its data is sent to the client as a chunk
+	buf := bufio.NewWriterSize(w, 32*1024)
+	enc := json.NewEncoder(buf)
+	for _, n := range nodes {
+		err := enc.Encode(models.SeriesFindItem{
+			Path:        n.Path,
+			Leaf:        n.Leaf,
+			HasChildren: n.HasChildren,
+			FirstSeen:   firstSeen(n.Defs),
+		})
+		if err != nil {
+			// client went away
+			log.Debugf("HTTP metricsFind() failed to write ndjson response: %s", err)
+			return
+		}
+	}
+	buf.Flush()
+}
+
+// firstSeen returns the oldest known first seen timestamp of the given defs, or 0 if unknown
+func firstSeen(defs []idx.Archive) int64 {
+	var oldest int64
+	for _, def := range defs {
+		if def.FirstSeen != 0 && (oldest == 0 || def.FirstSeen < oldest) {
+			oldest = def.FirstSeen
+		}
+	}
+	return oldest
+}
+
+// the cursor is the last path returned. we encode it so that clients treat it as opaque
+func encodeFindCursor(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
+
+func decodeFindCursor(cursor string) (string, error) {
+	path, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return string(path), nil
+}
+
 var treejsonContext = make(map[string]int)
 
 func findTreejson(query string, nodes []idx.Node) models.SeriesTree {
@@ -466,11 +549,75 @@ func findTreejson(query string, nodes []idx.Node) models.SeriesTree {
 }
 
 func (s *Server) metricsDelete(ctx *middleware.Context, req models.MetricsDelete) {
+	if req.DryRun || req.Token != "" || deleteConfirmThreshold > 0 {
+		defs, err := s.metricsDeletePreview(ctx.Req.Context(), ctx.OrgId, req.Query)
+		if err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		token := deleteToken(ctx.OrgId, req.Query, defs)
+		if req.DryRun {
+			writeDeleteDryRun(ctx, defs, token)
+			return
+		}
+		if req.Token != "" && req.Token != token {
+			response.Write(ctx, response.NewError(http.StatusConflict, "the series matching the query changed since the dry run, or the token is invalid. do a new dry run"))
+			return
+		}
+		if req.Token == "" && len(defs) > deleteConfirmThreshold {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("query matches %d series, more than delete-confirm-threshold. do a dry run and pass its token to confirm", len(defs))))
+			return
+		}
+	}
+
+	if req.Async {
+		job := s.deleteJobs.start(ctx.OrgId, req.Query, req.Purge)
+		log.Infof("HTTP metricsDelete started job %s to delete %q of org %d (purge=%t)", job.Id, req.Query, ctx.OrgId, req.Purge)
+		go func() {
+			deleted, err := s.metricsDeleteCluster(context.Background(), ctx.OrgId, req.Query, req.Purge)
+			s.deleteJobs.finish(job.Id, deleted, err)
+			if err != nil {
+				log.Warnf("HTTP metricsDelete job %s failed: %s", job.Id, err)
+				return
+			}
+			log.Infof("HTTP metricsDelete job %s deleted %d series", job.Id, deleted)
+		}()
+		response.Write(ctx, response.NewJson(http.StatusAccepted, job, ""))
+		return
+	}
+
+	deleted, err := s.metricsDeleteCluster(ctx.Req.Context(), ctx.OrgId, req.Query, req.Purge)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	resp := models.MetricsDeleteResp{
+		DeletedDefs: deleted,
+	}
+
+	response.Write(ctx, response.NewJson(200, resp, ""))
+}
+
+// metricsDeleteStatus returns the status of a delete job of the org
+func (s *Server) metricsDeleteStatus(ctx *middleware.Context, req models.MetricsDeleteStatus) {
+	job, ok := s.deleteJobs.get(ctx.OrgId, req.Job)
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "job not found"))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, job, ""))
+}
+
+// metricsDeleteCluster deletes the series matching the query from the index of all instances,
+// and if purge is set, their data from memory, the chunk cache and the store.
+// it returns the number of deleted definitions, summed over all instances.
+func (s *Server) metricsDeleteCluster(ctx context.Context, orgId uint32, query string, purge bool) (int, error) {
 	peers := cluster.Manager.MemberList()
 	peers = append(peers, cluster.Manager.ThisNode())
-	log.Debugf("HTTP metricsDelete for %v across %d instances", req.Query, len(peers))
+	log.Debugf("HTTP metricsDelete for %v across %d instances", query, len(peers))
 
-	reqCtx, cancel := context.WithCancel(ctx.Req.Context())
+	reqCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	deleted := 0
 	responses := make(chan struct {
@@ -483,7 +630,7 @@ func (s *Server) metricsDelete(ctx *middleware.Context, req models.MetricsDelete
 		wg.Add(1)
 		if peer.IsLocal() {
 			go func() {
-				result, err := s.metricsDeleteLocal(ctx.OrgId, req.Query)
+				result, err := s.metricsDeleteLocal(reqCtx, orgId, query, purge)
 				var e error
 				if err != nil {
 					cancel()
@@ -501,7 +648,7 @@ func (s *Server) metricsDelete(ctx *middleware.Context, req models.MetricsDelete
 			}()
 		} else {
 			go func(peer cluster.Node) {
-				result, err := s.metricsDeleteRemote(reqCtx, ctx.OrgId, req.Query, peer)
+				result, err := s.metricsDeleteRemote(reqCtx, orgId, query, purge, peer)
 				if err != nil {
 					cancel()
 				}
@@ -520,41 +667,43 @@ func (s *Server) metricsDelete(ctx *middleware.Context, req models.MetricsDelete
 		close(responses)
 	}()
 
+	var err error
 	for resp := range responses {
-		if resp.err != nil {
-			response.Write(ctx, response.WrapError(resp.err))
-			return
+		if resp.err != nil && err == nil {
+			err = resp.err
 		}
 		deleted += resp.deleted
 	}
+	if err != nil {
+		return 0, err
+	}
 
 	// check to see if the request has been canceled, if so abort now.
 	select {
 	case <-reqCtx.Done():
 		//request canceled
-		response.Write(ctx, response.RequestCanceledErr)
-		return
+		return 0, response.RequestCanceledErr
 	default:
 	}
 
-	resp := models.MetricsDeleteResp{
-		DeletedDefs: deleted,
-	}
-
-	response.Write(ctx, response.NewJson(200, resp, ""))
+	return deleted, nil
 }
 
-func (s *Server) metricsDeleteLocal(orgId uint32, query string) (int, error) {
+func (s *Server) metricsDeleteLocal(ctx context.Context, orgId uint32, query string, purge bool) (int, error) {
 	defs, err := s.MetricIndex.Delete(orgId, query)
-	return len(defs), err
+	if err != nil || !purge {
+		return len(defs), err
+	}
+	return len(defs), s.purgeSeries(ctx, defs)
 }
 
-func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query string, peer cluster.Node) (int, error) {
+func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query string, purge bool, peer cluster.Node) (int, error) {
 	log.Debugf("HTTP metricDelete calling %s/index/delete for %d:%q", peer.GetName(), orgId, query)
 
 	body := models.IndexDelete{
 		Query: query,
 		OrgId: orgId,
+		Purge: purge,
 	}
 	buf, err := peer.Post(ctx, "metricsDeleteRemote", "/index/delete", body)
 	if err != nil {
@@ -579,10 +728,30 @@ func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query st
 	return resp.DeletedDefs, nil
 }
 
+// defaultConsolidator returns the consolidator for the series, for queries that don't specify one via consolidateBy:
+// max for counters, so that their (ever increasing) values aren't averaged, unless they have rollups but no max rollup.
+// otherwise, the primary aggregationMethod of their storage-aggregation rule.
+func defaultConsolidator(archive idx.Archive) consolidation.Consolidator {
+	methods := mdata.GetAgg(archive.AggId).AggregationMethod
+	if archive.Mtype == "counter" {
+		if len(mdata.GetSchema(archive.SchemaId).Retentions) == 1 {
+			return consolidation.Max
+		}
+		for _, method := range methods {
+			if method == conf.Max {
+				return consolidation.Max
+			}
+		}
+	}
+	return consolidation.Consolidator(methods[0]) // we use the same number assignments so we can cast them
+}
+
 // executePlan looks up the needed data, retrieves it, and then invokes the processing
 // note if you do something like sum(foo.*) and all of those metrics happen to be on another node,
 // we will collect all the indidividual series from the peer, and then sum here. that could be optimized
-func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan) ([]models.Series, error) {
+// if excludeOpen is set, data from chunks that are still being written to is replaced with nulls.
+func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan, excludeOpen bool) ([]models.Series, models.RenderMeta, error) {
+	var meta models.RenderMeta
 
 	minFrom := uint32(math.MaxUint32)
 	var maxTo uint32
@@ -595,7 +764,7 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 		select {
 		case <-ctx.Done():
 			//request canceled
-			return nil, nil
+			return nil, meta, nil
 		default:
 		}
 		var err error
@@ -608,12 +777,12 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 			for i, e := range exprs {
 				exprs[i] = strings.Trim(e, " '\"")
 			}
-			series, err = s.clusterFindByTag(ctx, orgId, exprs, int64(r.From), maxSeriesPerReq-len(reqs))
+			series, err = s.clusterFindByTag(ctx, orgId, exprs, int64(r.From), 0, maxSeriesPerReq-len(reqs))
 		} else {
-			series, err = s.findSeries(ctx, orgId, []string{r.Query}, int64(r.From))
+			series, err = s.findSeries(ctx, orgId, []string{r.Query}, int64(r.From), 0)
 		}
 		if err != nil {
-			return nil, err
+			return nil, meta, err
 		}
 
 		minFrom = util.Min(minFrom, r.From)
@@ -631,8 +800,7 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 						// * we can't just let the expr library take care of normalization, as we may have to fetch targets
 						//   from cluster peers; it's more efficient to have them normalize the data at the source.
 						// * a pattern may expand to multiple series, each of which can have their own aggregation method.
-						fn := mdata.Aggregations.Get(archive.AggId).AggregationMethod[0]
-						cons = consolidation.Consolidator(fn) // we use the same number assignments so we can cast them
+						cons = defaultConsolidator(archive)
 					}
 
 					newReq := models.NewReq(
@@ -646,21 +814,25 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 	select {
 	case <-ctx.Done():
 		//request canceled
-		return nil, nil
+		return nil, meta, nil
 	default:
 	}
 
 	reqRenderSeriesCount.Value(len(reqs))
 	if len(reqs) == 0 {
-		return nil, nil
+		return nil, meta, nil
 	}
 
 	// note: if 1 series has a movingAvg that requires a long time range extension, it may push other reqs into another archive. can be optimized later
-	reqs, pointsFetch, pointsReturn, err := alignRequests(uint32(time.Now().Unix()), minFrom, maxTo, reqs)
+	now := uint32(time.Now().Unix())
+	reqs, pointsFetch, pointsReturn, err := alignRequests(now, minFrom, maxTo, reqs)
 	if err != nil {
 		log.Errorf("HTTP Render alignReq error: %s", err.Error())
-		return nil, err
+		return nil, meta, err
 	}
+	meta.Warnings = retentionWarnings(now, reqs)
+	meta.OpenChunksFrom = openChunksFrom(now, reqs)
+	meta.Archives = archiveChoices(reqs)
 	span := opentracing.SpanFromContext(ctx)
 	span.SetTag("num_reqs", len(reqs))
 	span.SetTag("points_fetch", pointsFetch)
@@ -670,10 +842,18 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 		log.Debugf("HTTP Render %s - arch:%d archI:%d outI:%d aggN: %d from %s", req, req.Archive, req.ArchInterval, req.OutInterval, req.AggNum, req.Node.GetName())
 	}
 
+	ctx, storeUnavailable := withStoreUnavailable(ctx)
 	out, err := s.getTargets(ctx, reqs)
 	if err != nil {
 		log.Errorf("HTTP Render %s", err.Error())
-		return nil, err
+		return nil, meta, err
+	}
+	if atomic.LoadUint32(storeUnavailable) == 1 {
+		meta.Warnings = append(meta.Warnings, "the store is unavailable: the results only include the data in memory and in the chunk cache, older data may be missing")
+	}
+
+	if excludeOpen {
+		excludeOpenChunks(out, meta.OpenChunksFrom)
 	}
 
 	out = mergeSeries(out)
@@ -695,7 +875,7 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 	preRun := time.Now()
 	out, err = plan.Run(data)
 	planRunDuration.Value(time.Since(preRun))
-	return out, err
+	return out, meta, err
 }
 
 func getFromTo(ft models.FromTo, now time.Time, defaultFrom, defaultTo uint32) (uint32, uint32, error) {
@@ -799,7 +979,7 @@ func (s *Server) clusterTagDetails(ctx context.Context, orgId uint32, tag, filte
 
 func (s *Server) graphiteTagFindSeries(ctx *middleware.Context, request models.GraphiteTagFindSeries) {
 	reqCtx := ctx.Req.Context()
-	series, err := s.clusterFindByTag(reqCtx, ctx.OrgId, request.Expr, request.From, maxSeriesPerReq)
+	series, err := s.clusterFindByTag(reqCtx, ctx.OrgId, request.Expr, request.From, request.To, maxSeriesPerReq)
 	if err != nil {
 		response.Write(ctx, response.WrapError(err))
 		return
@@ -819,8 +999,15 @@ func (s *Server) graphiteTagFindSeries(ctx *middleware.Context, request models.G
 	response.Write(ctx, response.NewJson(200, seriesNames, ""))
 }
 
-func (s *Server) clusterFindByTag(ctx context.Context, orgId uint32, expressions []string, from int64, maxSeries int) ([]Series, error) {
-	data := models.IndexFindByTag{OrgId: orgId, Expr: expressions, From: from}
+func (s *Server) clusterFindByTag(ctx context.Context, orgId uint32, expressions []string, from, to int64, maxSeries int) ([]Series, error) {
+	if s.Catalog != nil {
+		var ok bool
+		expressions, ok = s.Catalog.Rewrite(expressions)
+		if !ok {
+			return nil, nil
+		}
+	}
+	data := models.IndexFindByTag{OrgId: orgId, Expr: expressions, From: from, To: to}
 	newCtx, cancel := context.WithCancel(ctx)
 	responseChan, errorChan := s.peerQuerySpeculativeChan(newCtx, data, "clusterFindByTag", "/index/find_by_tag")
 
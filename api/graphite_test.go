@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/raintank/schema"
+)
+
+func TestFindNdjsonCursor(t *testing.T) {
+	nodes := []idx.Node{
+		{Path: "a.c", Leaf: true},
+		{Path: "a.a", HasChildren: true},
+		{Path: "b", Leaf: true},
+		{Path: "a.b", Leaf: true},
+		{Path: "c", Leaf: true},
+	}
+	var paths []string
+	var after string
+	for pages := 0; ; pages++ {
+		if pages == len(nodes) {
+			t.Fatalf("expected to have paged through all nodes by now. got %v", paths)
+		}
+		rec := httptest.NewRecorder()
+		findNdjson(rec, nodes, after, 2)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Fatalf("expected ndjson content type, got %q", ct)
+		}
+		scanner := bufio.NewScanner(rec.Body)
+		var lines int
+		for scanner.Scan() {
+			var item models.SeriesFindItem
+			if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+				t.Fatalf("failed to decode line %q: %s", scanner.Text(), err)
+			}
+			paths = append(paths, item.Path)
+			lines++
+		}
+		if lines > 2 {
+			t.Fatalf("expected at most 2 nodes per page, got %d", lines)
+		}
+		cursor := rec.Header().Get("Next-Cursor")
+		if cursor == "" {
+			break
+		}
+		var err error
+		after, err = decodeFindCursor(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := []string{"a.a", "a.b", "a.c", "b", "c"}
+	if len(paths) != len(exp) {
+		t.Fatalf("expected paths %v, got %v", exp, paths)
+	}
+	for i := range exp {
+		if paths[i] != exp[i] {
+			t.Fatalf("expected paths %v, got %v", exp, paths)
+		}
+	}
+}
+
+func TestFirstSeen(t *testing.T) {
+	cases := []struct {
+		firstSeen []int64
+		exp       int64
+	}{
+		{nil, 0},
+		{[]int64{0}, 0},
+		{[]int64{20, 10, 30}, 10},
+		{[]int64{0, 20, 0, 15}, 15},
+	}
+	for i, c := range cases {
+		var defs []idx.Archive
+		for _, ts := range c.firstSeen {
+			defs = append(defs, idx.Archive{FirstSeen: ts})
+		}
+		if got := firstSeen(defs); got != c.exp {
+			t.Fatalf("case %d: expected %d, got %d", i, c.exp, got)
+		}
+	}
+}
+
+func TestDefaultConsolidator(t *testing.T) {
+	defer mdata.SetSingleSchema(conf.NewRetentionMT(10, 100, 600, 10, 0))
+	cases := []struct {
+		rets  []conf.Retention
+		aggs  []conf.Method
+		mtype string
+		exp   consolidation.Consolidator
+	}{
+		{[]conf.Retention{conf.NewRetentionMT(10, 3600, 600, 2, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}, []conf.Method{conf.Avg, conf.Max}, "gauge", consolidation.Avg},
+		{[]conf.Retention{conf.NewRetentionMT(10, 3600, 600, 2, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}, []conf.Method{conf.Avg, conf.Max}, "counter", consolidation.Max},
+		{[]conf.Retention{conf.NewRetentionMT(10, 3600, 600, 2, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}, []conf.Method{conf.Sum}, "counter", consolidation.Sum},
+		{[]conf.Retention{conf.NewRetentionMT(10, 3600, 600, 2, 0)}, []conf.Method{conf.Avg}, "counter", consolidation.Max},
+	}
+	for i, c := range cases {
+		mdata.SetSingleSchema(c.rets...)
+		mdata.SetSingleAgg(c.aggs...)
+		if got := defaultConsolidator(idx.Archive{MetricDefinition: schema.MetricDefinition{Mtype: c.mtype}}); got != c.exp {
+			t.Errorf("case %d: expected %s, got %s", i, c.exp, got)
+		}
+	}
+}
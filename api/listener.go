@@ -0,0 +1,44 @@
+package api
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"strings"
+)
+
+// listener describes the configuration of one of the http listeners
+// the API can be split over: the main one for queries and cluster traffic,
+// and optionally separate ones for the admin and ingest endpoints.
+type listener struct {
+	name     string
+	addr     string // empty means the endpoints are served by the main listener
+	ssl      bool
+	certFile string
+	keyFile  string
+	auth     string // user:password for HTTP basic auth. empty means no authentication
+}
+
+func (l *listener) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&l.addr, l.name+"-listen", "", "http listener address for the "+l.name+" endpoints. empty to serve them on the main listener")
+	fs.BoolVar(&l.ssl, l.name+"-ssl", false, "use HTTPS for the "+l.name+" listener")
+	fs.StringVar(&l.certFile, l.name+"-cert-file", "", "SSL certificate file for the "+l.name+" listener")
+	fs.StringVar(&l.keyFile, l.name+"-key-file", "", "SSL key file for the "+l.name+" listener")
+	fs.StringVar(&l.auth, l.name+"-auth", "", "require HTTP basic auth with these credentials (user:password) for the "+l.name+" endpoints. empty to disable")
+}
+
+func (l *listener) validate() error {
+	if l.auth != "" && !strings.Contains(l.auth, ":") {
+		return errors.New(l.name + "-auth must be formatted as user:password")
+	}
+	if l.addr == "" {
+		return nil
+	}
+	if _, err := net.ResolveTCPAddr("tcp", l.addr); err != nil {
+		return errors.New(l.name + "-listen is not a valid TCP address")
+	}
+	if l.ssl && (l.certFile == "" || l.keyFile == "") {
+		return errors.New(l.name + "-ssl requires " + l.name + "-cert-file and " + l.name + "-key-file")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	macaron "gopkg.in/macaron.v1"
+)
+
+// BasicAuth requires requests to authenticate with the given credentials,
+// formatted as user:password. empty credentials disable authentication.
+func BasicAuth(credentials string) macaron.Handler {
+	if credentials == "" {
+		return func() {}
+	}
+	parts := strings.SplitN(credentials, ":", 2)
+	wantUser, wantPass := []byte(parts[0]), []byte(parts[1])
+	return func(c *macaron.Context) {
+		user, pass, ok := c.Req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), wantUser) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), wantPass) != 1 {
+			c.Resp.Header().Set("WWW-Authenticate", `Basic realm="metrictank"`)
+			// don't rely on the renderer, as we may run before it is set up
+			c.Resp.WriteHeader(http.StatusUnauthorized)
+			c.Resp.Write([]byte("unauthorized"))
+		}
+	}
+}
@@ -21,13 +21,26 @@ func NewIndexFindResp() *IndexFindResp {
 
 //go:generate msgp
 type GetDataResp struct {
-	Series []Series
+	Series           []Series
+	StoreUnavailable bool // some series were served without the data from the store
 }
 
 type MetricsDeleteResp struct {
 	DeletedDefs int `json:"deletedDefs"`
 }
 
+type MetricsRenameResp struct {
+	RenamedDefs int `json:"renamedDefs"`
+}
+
+type MetricsBackfillRollupsResp struct {
+	Series int `json:"series"`
+}
+
+type MetricsUpdateTTLResp struct {
+	Series int `json:"series"`
+}
+
 //go:generate msgp
 type IndexTagsResp struct {
 	Tags []string `json:"tags"`
@@ -13,6 +13,7 @@ import (
 )
 
 //go:generate msgp
+//msgp:ignore ArchiveChoice
 //msgp:ignore FromTo
 //msgp:ignore GraphiteAutoCompleteTags
 //msgp:ignore GraphiteAutoCompleteTagValues
@@ -28,9 +29,18 @@ import (
 //msgp:ignore GraphiteTags
 //msgp:ignore GraphiteTagsResp
 //msgp:ignore MetricNames
+//msgp:ignore MetricsBackfillRollups
 //msgp:ignore MetricsDelete
+//msgp:ignore MetricsDeleteJob
+//msgp:ignore MetricsDeleteStatus
+//msgp:ignore MetricsExport
+//msgp:ignore MetricsRename
+//msgp:ignore MetricsUpdateTTL
+//msgp:ignore RenderMeta
+//msgp:ignore ResponseWithMeta
 //msgp:ignore SeriesCompleter
 //msgp:ignore SeriesCompleterItem
+//msgp:ignore SeriesFindItem
 //msgp:ignore SeriesTree
 //msgp:ignore SeriesTreeItem
 
@@ -49,6 +59,9 @@ type GraphiteRender struct {
 	Format        string   `json:"format" form:"format" binding:"In(,json,msgp,msgpack,pickle)"`
 	NoProxy       bool     `json:"local" form:"local"` //this is set to true by graphite-web when it passes request to cluster servers
 	Process       string   `json:"process" form:"process" binding:"In(,none,stable,any);Default(stable)"`
+	Meta          bool     `json:"meta" form:"meta"` // include metadata in the response. only supported for json format
+	// whether to return data from chunks that are still being written to
+	OpenChunks string `json:"openChunks" form:"openChunks" binding:"In(,include,exclude);Default(include)"`
 }
 
 func (gr GraphiteRender) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
@@ -75,6 +88,71 @@ func (gr GraphiteRender) Validate(ctx *macaron.Context, errs binding.Errors) bin
 	return errs
 }
 
+// RenderMeta is metadata about how a render request was served
+type RenderMeta struct {
+	Warnings []string
+	// OpenChunksFrom is the timestamp from which onwards data is served from chunks that are
+	// still being written to. such data may still be incomplete, e.g. due to ingestion delays.
+	OpenChunksFrom uint32
+	// Archives are the archives the series were served from, sorted by target
+	Archives []ArchiveChoice
+}
+
+// ArchiveChoice describes the archive a series was served from
+type ArchiveChoice struct {
+	Target       string
+	Archive      int    // 0 means raw data, 1 means first rollup, etc.
+	Interval     uint32 // interval of the archive
+	OutInterval  uint32 // interval of the returned points, after runtime consolidation
+	Consolidator string // which rollup was read, and how the points were consolidated at runtime
+}
+
+// ResponseWithMeta is the render response in case metadata was requested
+type ResponseWithMeta struct {
+	Meta   RenderMeta
+	Series SeriesByTarget
+}
+
+func (r ResponseWithMeta) MarshalJSONFast(b []byte) ([]byte, error) {
+	b = append(b, `{"meta":{"warnings":[`...)
+	for i, w := range r.Meta.Warnings {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuoteToASCII(b, w)
+	}
+	b = append(b, `],"openChunksFrom":`...)
+	b = strconv.AppendUint(b, uint64(r.Meta.OpenChunksFrom), 10)
+	b = append(b, `,"archives":[`...)
+	for i, a := range r.Meta.Archives {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, `{"target":`...)
+		b = strconv.AppendQuoteToASCII(b, a.Target)
+		b = append(b, `,"archive":`...)
+		b = strconv.AppendInt(b, int64(a.Archive), 10)
+		b = append(b, `,"interval":`...)
+		b = strconv.AppendUint(b, uint64(a.Interval), 10)
+		b = append(b, `,"outInterval":`...)
+		b = strconv.AppendUint(b, uint64(a.OutInterval), 10)
+		b = append(b, `,"consolidator":`...)
+		b = strconv.AppendQuoteToASCII(b, a.Consolidator)
+		b = append(b, '}')
+	}
+	b = append(b, `]},"series":`...)
+	b, err := r.Series.MarshalJSONFast(b)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '}')
+	return b, nil
+}
+
+func (r ResponseWithMeta) MarshalJSON() ([]byte, error) {
+	return r.MarshalJSONFast(nil)
+}
+
 type GraphiteTags struct {
 	Filter string `json:"filter" form:"filter"`
 	From   int64  `json:"from" form:"from"`
@@ -120,6 +198,7 @@ type GraphiteTagDetailsValueResp struct {
 type GraphiteTagFindSeries struct {
 	Expr []string `json:"expr" form:"expr"`
 	From int64    `json:"from" form:"from"`
+	To   int64    `json:"to" form:"to"` // exclude series first seen at or after this timestamp. 0 to disable
 }
 
 type GraphiteTagFindSeriesResp struct {
@@ -147,14 +226,75 @@ type GraphiteTagDelSeriesResp struct {
 type GraphiteFind struct {
 	FromTo
 	Query  string `json:"query" form:"query" binding:"Required"`
-	Format string `json:"format" form:"format" binding:"In(,completer,json,treejson,msgpack,pickle)"`
+	Format string `json:"format" form:"format" binding:"In(,completer,json,treejson,msgpack,pickle,ndjson)"`
 	Jsonp  string `json:"jsonp" form:"jsonp"`
+	Limit  int    `json:"limit" form:"limit"`   // max number of nodes to return. only supported for ndjson format. 0 means no limit
+	Cursor string `json:"cursor" form:"cursor"` // resume after the nodes of a previous ndjson response. only supported for ndjson format
+}
+
+func (gf GraphiteFind) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	if gf.Limit < 0 {
+		errs = append(errs, binding.Error{
+			FieldNames:     []string{"limit"},
+			Classification: "RangeError",
+			Message:        "must not be negative",
+		})
+	}
+	if gf.Format != "ndjson" && (gf.Limit != 0 || gf.Cursor != "") {
+		errs = append(errs, binding.Error{
+			FieldNames:     []string{"limit", "cursor"},
+			Classification: "UnsupportedError",
+			Message:        "only supported for ndjson format",
+		})
+	}
+	return errs
 }
 
 type MetricsDelete struct {
+	Query  string `json:"query" form:"query" binding:"Required"`
+	DryRun bool   `json:"dryRun" form:"dryRun"` // report the series that would be deleted as csv, along with a confirmation token
+	Token  string `json:"token" form:"token"`   // confirmation token of a dry run. the delete is refused if the series to delete changed since
+	Purge  bool   `json:"purge" form:"purge"`   // also delete the data of the series from memory, the chunk cache and the store
+	Async  bool   `json:"async" form:"async"`   // run the delete in the background, and return its job. see MetricsDeleteStatus
+}
+
+type MetricsExport struct {
+	FromTo
+	Query  string `json:"query" form:"query" binding:"Required"`
+	Format string `json:"format" form:"format" binding:"In(,csv)"`
+}
+
+type MetricsBackfillRollups struct {
 	Query string `json:"query" form:"query" binding:"Required"`
 }
 
+type MetricsUpdateTTL struct {
+	Query   string `json:"query" form:"query" binding:"Required"`
+	FromTTL string `json:"fromTTL" form:"fromTTL" binding:"Required"` // the ttl the chunks were saved with, like 30d
+	Rate    int    `json:"rate" form:"rate"`                          // max number of chunks per second each instance saves. 0 for the default
+}
+
+type MetricsRename struct {
+	From string `json:"from" form:"from" binding:"Required"` // name of the series, or of the branch of which to rename all series
+	To   string `json:"to" form:"to" binding:"Required"`
+}
+
+type MetricsDeleteStatus struct {
+	Job string `json:"job" form:"job" binding:"Required"`
+}
+
+// MetricsDeleteJob describes a delete that runs in the background
+type MetricsDeleteJob struct {
+	Id          string `json:"id"`
+	Query       string `json:"query"`
+	Purge       bool   `json:"purge"`
+	State       string `json:"state"` // running, done or failed
+	DeletedDefs int    `json:"deletedDefs"`
+	Error       string `json:"error,omitempty"`
+	Started     int64  `json:"started"`            // unix timestamp
+	Finished    int64  `json:"finished,omitempty"` // unix timestamp. 0 while running
+}
+
 type MetricNames []idx.Archive
 
 func (defs MetricNames) MarshalJSONFast(b []byte) ([]byte, error) {
@@ -202,6 +342,14 @@ type SeriesCompleterItem struct {
 	IsLeaf string `json:"is_leaf"`
 }
 
+// SeriesFindItem is a node in the ndjson find response. each is encoded on its own line
+type SeriesFindItem struct {
+	Path        string `json:"path"`
+	Leaf        bool   `json:"leaf"`
+	HasChildren bool   `json:"hasChildren"`
+	FirstSeen   int64  `json:"firstSeen,omitempty"` // oldest first seen timestamp of the series of a leaf. omitted if unknown
+}
+
 type SeriesPickle []SeriesPickleItem
 
 func (s SeriesPickle) Pickle(buf []byte) ([]byte, error) {
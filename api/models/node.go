@@ -25,6 +25,19 @@ type ClusterMembersResp struct {
 	MembersAdded int    `json:"membersAdded"`
 }
 
+type IngestOffenders struct {
+	Limit int `json:"limit" form:"limit" binding:"Default(100)"`
+}
+
+type SeriesLimit struct {
+	OrgId uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	Limit int    `json:"limit" form:"limit"`
+}
+
+type MetricInfo struct {
+	Key string `json:"key" form:"key" binding:"Required"`
+}
+
 type IndexList struct {
 	OrgId uint32 `json:"orgId" form:"orgId" binding:"Required"`
 }
@@ -40,12 +53,14 @@ type IndexFindByTag struct {
 	OrgId uint32   `json:"orgId" binding:"Required"`
 	Expr  []string `json:"expressions"`
 	From  int64    `json:"from"`
+	To    int64    `json:"to"`
 }
 
 func (t IndexFindByTag) Trace(span opentracing.Span) {
 	span.SetTag("org", t.OrgId)
 	span.SetTag("expressions", t.Expr)
 	span.SetTag("from", t.From)
+	span.SetTag("to", t.To)
 }
 
 func (i IndexFindByTag) TraceDebug(span opentracing.Span) {
@@ -144,12 +159,14 @@ type IndexFind struct {
 	Patterns []string `json:"patterns" form:"patterns" binding:"Required"`
 	OrgId    uint32   `json:"orgId" form:"orgId" binding:"Required"`
 	From     int64    `json:"from" form:"from"`
+	To       int64    `json:"to" form:"to"`
 }
 
 func (i IndexFind) Trace(span opentracing.Span) {
 	span.SetTag("q", i.Patterns)
 	span.SetTag("org", i.OrgId)
 	span.SetTag("from", i.From)
+	span.SetTag("to", i.To)
 }
 
 func (i IndexFind) TraceDebug(span opentracing.Span) {
@@ -178,12 +195,58 @@ func (g GetData) TraceDebug(span opentracing.Span) {
 type IndexDelete struct {
 	Query string `json:"query" form:"query" binding:"Required"`
 	OrgId uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	Purge bool   `json:"purge" form:"purge"` // also delete the data of the deleted series from memory, the chunk cache and the store
 }
 
 func (i IndexDelete) Trace(span opentracing.Span) {
 	span.SetTag("q", i.Query)
 	span.SetTag("org", i.OrgId)
+	span.SetTag("purge", i.Purge)
 }
 
 func (i IndexDelete) TraceDebug(span opentracing.Span) {
 }
+
+type IndexBackfillRollups struct {
+	OrgId uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	Query string `json:"query" form:"query" binding:"Required"`
+}
+
+func (i IndexBackfillRollups) Trace(span opentracing.Span) {
+	span.SetTag("org", i.OrgId)
+	span.SetTag("q", i.Query)
+}
+
+func (i IndexBackfillRollups) TraceDebug(span opentracing.Span) {
+}
+
+type IndexUpdateTTL struct {
+	OrgId   uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	Query   string `json:"query" form:"query" binding:"Required"`
+	FromTTL uint32 `json:"fromTTL" form:"fromTTL" binding:"Required"`
+	Rate    int    `json:"rate" form:"rate" binding:"Required"`
+}
+
+func (i IndexUpdateTTL) Trace(span opentracing.Span) {
+	span.SetTag("org", i.OrgId)
+	span.SetTag("q", i.Query)
+	span.SetTag("fromTTL", i.FromTTL)
+}
+
+func (i IndexUpdateTTL) TraceDebug(span opentracing.Span) {
+}
+
+type IndexRename struct {
+	OrgId uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	From  string `json:"from" form:"from" binding:"Required"`
+	To    string `json:"to" form:"to" binding:"Required"`
+}
+
+func (i IndexRename) Trace(span opentracing.Span) {
+	span.SetTag("org", i.OrgId)
+	span.SetTag("from", i.From)
+	span.SetTag("to", i.To)
+}
+
+func (i IndexRename) TraceDebug(span opentracing.Span) {
+}
@@ -13,6 +13,15 @@ import (
 
 //go:generate msgp
 
+// InfAsNull makes pickle and msgpack render responses return infinite values as null, like NaN.
+// json can't represent infinite values, so json responses always return them as null.
+var InfAsNull bool
+
+// isNull returns whether the value is returned as null in pickle and msgpack render responses
+func isNull(val float64) bool {
+	return math.IsNaN(val) || InfAsNull && math.IsInf(val, 0)
+}
+
 type Series struct {
 	Target       string // for fetched data, set from models.Req.Target, i.e. the metric graphite key. for function output, whatever should be shown as target string (legend)
 	Datapoints   []schema.Point
@@ -23,6 +32,7 @@ type Series struct {
 	QueryTo      uint32                     // to tie series back to request it came from
 	QueryCons    consolidation.Consolidator // to tie series back to request it came from (may be 0 to mean use configured default)
 	Consolidator consolidation.Consolidator // consolidator to actually use (for fetched series this may not be 0, default must be resolved. if series created by function, may be 0)
+	RawInterval  uint32                     // for fetched series, the interval of the raw data. used to weight its points when merging it with series of the same target (e.g. after an interval change)
 }
 
 func (s *Series) SetTags() {
@@ -89,7 +99,7 @@ func (series SeriesByTarget) MarshalJSONFast(b []byte) ([]byte, error) {
 		b = append(b, `,"datapoints":[`...)
 		for _, p := range s.Datapoints {
 			b = append(b, '[')
-			if math.IsNaN(p.Val) {
+			if math.IsNaN(p.Val) || math.IsInf(p.Val, 0) {
 				b = append(b, `null,`...)
 			} else {
 				b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
@@ -123,7 +133,7 @@ func (series SeriesByTarget) ForGraphite(format string) SeriesListForPickle {
 	for i, s := range series {
 		datapoints := make([]interface{}, len(s.Datapoints))
 		for j, p := range s.Datapoints {
-			if math.IsNaN(p.Val) {
+			if isNull(p.Val) {
 				datapoints[j] = none
 			} else {
 				datapoints[j] = p.Val
@@ -8,7 +8,6 @@ import (
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/consolidation"
-	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/util"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -64,7 +63,7 @@ func (q *querier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error)
 		}
 	}
 
-	series, err := q.clusterFindByTag(q.ctx, q.OrgID, expressions, 0, maxSeriesPerReq)
+	series, err := q.clusterFindByTag(q.ctx, q.OrgID, expressions, 0, 0, maxSeriesPerReq)
 	if err != nil {
 		return nil, err
 	}
@@ -79,8 +78,7 @@ func (q *querier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error)
 		for _, metric := range s.Series {
 			for _, archive := range metric.Defs {
 				consReq := consolidation.None
-				fn := mdata.Aggregations.Get(archive.AggId).AggregationMethod[0]
-				cons := consolidation.Consolidator(fn)
+				cons := defaultConsolidator(archive)
 
 				newReq := models.NewReq(archive.Id, archive.NameWithTags(), target, q.from, q.to, math.MaxUint32, uint32(archive.Interval), cons, consReq, s.Node, archive.SchemaId, archive.AggId)
 				reqs = append(reqs, newReq)
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"fmt"
 	"math"
+	"sort"
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/api/response"
@@ -60,12 +62,16 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 	// fallback to lowest res option (which *should* have the longest TTL)
 	for i := range reqs {
 		req := &reqs[i]
-		retentions := mdata.Schemas.Get(req.SchemaId).Retentions
-		for i, ret := range retentions {
+		schema := mdata.GetSchema(req.SchemaId)
+		for i, ret := range schema.Retentions {
 			// skip non-ready option.
 			if ret.Ready > from {
 				continue
 			}
+			// the raw data of rollup-only series is not saved, so it can't be read from
+			if i == 0 && schema.RollupOnly {
+				continue
+			}
 			req.Archive = i
 			req.TTL = uint32(ret.MaxRetention())
 			if i == 0 {
@@ -116,7 +122,7 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 			// we have to deliver an interval higher than what we originally came up with
 
 			// let's see first if we can deliver it via lower-res rollup archives, if we have any
-			retentions := mdata.Schemas.Get(req.SchemaId).Retentions
+			retentions := mdata.GetSchema(req.SchemaId).Retentions
 			for i, ret := range retentions[req.Archive+1:] {
 				archInterval := uint32(ret.SecondsPerPoint)
 				if interval == archInterval && ret.Ready <= from {
@@ -156,3 +162,75 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 
 	return reqs, pointsFetch, pointsReturn, nil
 }
+
+// retentionWarnings returns warnings about requests with a from that predates the retention of the archive chosen to serve them.
+// data that old has expired, so fetching is clamped to what may still be retained. (see getSeriesFixed)
+// requests are grouped by their ttl, to keep the number of warnings low
+func retentionWarnings(now uint32, reqs []models.Req) []string {
+	clamped := make(map[uint32]int) // ttl -> count
+	for _, req := range reqs {
+		if req.From < retainedSince(now, req.TTL) {
+			clamped[req.TTL]++
+		}
+	}
+	if len(clamped) == 0 {
+		return nil
+	}
+	ttls := make([]uint32, 0, len(clamped))
+	for ttl := range clamped {
+		ttls = append(ttls, ttl)
+	}
+	sort.Slice(ttls, func(i, j int) bool { return ttls[i] < ttls[j] })
+	warnings := make([]string, 0, len(ttls))
+	for _, ttl := range ttls {
+		warnings = append(warnings, fmt.Sprintf("from predates the retention of %ds of the archive for %d series. data was only fetched from %d onwards", ttl, clamped[ttl], now-ttl))
+	}
+	return warnings
+}
+
+// openChunksFrom returns the timestamp from which onwards data for the requests is served from chunks
+// that are still being written to, and hence may be incomplete: the t0 of the oldest open chunk
+// amongst the archives the requests are served from.
+func openChunksFrom(now uint32, reqs []models.Req) uint32 {
+	from := now
+	for _, req := range reqs {
+		span := mdata.GetSchema(req.SchemaId).Retentions[req.Archive].ChunkSpan
+		t0 := now - now%span
+		if t0 < from {
+			from = t0
+		}
+	}
+	return from
+}
+
+// archiveChoices returns, for each request, which archive alignRequests chose to serve it from, sorted by target.
+func archiveChoices(reqs []models.Req) []models.ArchiveChoice {
+	choices := make([]models.ArchiveChoice, 0, len(reqs))
+	for _, req := range reqs {
+		choices = append(choices, models.ArchiveChoice{
+			Target:       req.Target,
+			Archive:      req.Archive,
+			Interval:     req.ArchInterval,
+			OutInterval:  req.OutInterval,
+			Consolidator: req.Consolidator.String(),
+		})
+	}
+	sort.SliceStable(choices, func(i, j int) bool {
+		if choices[i].Target != choices[j].Target {
+			return choices[i].Target < choices[j].Target
+		}
+		return choices[i].Archive < choices[j].Archive
+	})
+	return choices
+}
+
+// excludeOpenChunks replaces all points from the given timestamp onwards with nulls.
+func excludeOpenChunks(series []models.Series, from uint32) {
+	for _, serie := range series {
+		for i := range serie.Datapoints {
+			if serie.Datapoints[i].Ts >= from {
+				serie.Datapoints[i].Val = math.NaN()
+			}
+		}
+	}
+}
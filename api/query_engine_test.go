@@ -2,6 +2,7 @@ package api
 
 import (
 	"math"
+	"reflect"
 	"regexp"
 	"testing"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
 )
 
 // testAlign verifies the aligment of the given requests, given the retentions (one or more patterns, one or more retentions each)
@@ -258,6 +260,32 @@ func TestAlignRequestsDiffGoodRollup(t *testing.T) {
 	)
 }
 
+// raw data would do, but it's not saved for rollup-only series, so the rollup is used instead
+func TestAlignRequestsRollupOnly(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern: regexp.MustCompile(".*"),
+			Retentions: conf.Retentions(
+				[]conf.Retention{
+					conf.NewRetentionMT(10, 1200, 0, 0, 0),
+					conf.NewRetentionMT(60, 1200, 0, 0, 0),
+				}),
+			RollupOnly: true,
+		},
+	})
+	reqs := []models.Req{
+		reqRaw(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0),
+	}
+	out, _, _, err := alignRequests(1200, 0, 30, reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := reqOut(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0, 1, 60, 1200, 60, 1)
+	if !exp.Equals(out[0]) {
+		t.Fatalf("expected: %v\n     got: %v", exp.DebugString(), out[0].DebugString())
+	}
+}
+
 // now raw is short and we have a rollup we can use instead, at same interval as one of the raws
 func TestAlignRequestsWeird(t *testing.T) {
 	testAlign([]models.Req{
@@ -504,6 +532,91 @@ func TestMaxPointsPerReqHardLimit(t *testing.T) {
 	}
 }
 
+func TestRetentionWarnings(t *testing.T) {
+	reqs := []models.Req{
+		// within retention
+		reqOut(test.GetMKey(1), 29*day, 30*day, 800, 60, consolidation.Avg, 0, 0, 0, 60, 2*day, 60, 1),
+		// ttl unknown
+		reqOut(test.GetMKey(2), 0, 30*day, 800, 60, consolidation.Avg, 0, 0, 0, 60, 0, 60, 1),
+		// predating retention
+		reqOut(test.GetMKey(3), 20*day, 30*day, 800, 60, consolidation.Avg, 0, 0, 0, 60, 2*day, 60, 1),
+		reqOut(test.GetMKey(4), 20*day, 30*day, 800, 60, consolidation.Avg, 0, 0, 0, 60, 2*day, 60, 1),
+		reqOut(test.GetMKey(5), 20*day, 30*day, 800, 600, consolidation.Avg, 0, 0, 1, 600, 5*day, 600, 1),
+	}
+	warnings := retentionWarnings(30*day, reqs)
+	if len(warnings) != 2 {
+		t.Fatalf("expected 2 warnings, got %d: %v", len(warnings), warnings)
+	}
+	exp := []string{
+		"from predates the retention of 172800s of the archive for 2 series. data was only fetched from 2419200 onwards",
+		"from predates the retention of 432000s of the archive for 1 series. data was only fetched from 2160000 onwards",
+	}
+	for i := range exp {
+		if warnings[i] != exp[i] {
+			t.Fatalf("warning %d: expected %q, got %q", i, exp[i], warnings[i])
+		}
+	}
+	if warnings := retentionWarnings(30*day, reqs[:2]); warnings != nil {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+}
+
+func TestOpenChunksFrom(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{
+		{
+			Pattern: regexp.MustCompile(".*"),
+			Retentions: conf.Retentions(
+				[]conf.Retention{
+					conf.NewRetentionMT(10, 35*24*3600, 600, 0, 0),
+					conf.NewRetentionMT(600, 60*24*3600, 7200, 0, 0),
+				}),
+		},
+	})
+	reqs := []models.Req{
+		reqOut(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0, 0, 10, 35*24*3600, 10, 1),
+		reqOut(test.GetMKey(2), 0, 30, 800, 10, consolidation.Avg, 0, 0, 1, 600, 60*24*3600, 600, 1),
+	}
+	now := uint32(10000)
+	if from := openChunksFrom(now, reqs[:1]); from != 9600 {
+		t.Fatalf("expected open chunks from 9600, got %d", from)
+	}
+	if from := openChunksFrom(now, reqs); from != 7200 {
+		t.Fatalf("expected open chunks from 7200, got %d", from)
+	}
+
+	series := []models.Series{
+		{
+			Datapoints: []schema.Point{{Val: 1, Ts: 7190}, {Val: 2, Ts: 7200}, {Val: 3, Ts: 7210}},
+		},
+	}
+	excludeOpenChunks(series, 7200)
+	if series[0].Datapoints[0].Val != 1 {
+		t.Fatalf("expected point before open chunks to be kept, got %v", series[0].Datapoints[0])
+	}
+	for _, p := range series[0].Datapoints[1:] {
+		if !math.IsNaN(p.Val) {
+			t.Fatalf("expected point from open chunks to be null, got %v", p)
+		}
+	}
+}
+
+func TestArchiveChoices(t *testing.T) {
+	reqs := []models.Req{
+		reqOut(test.GetMKey(1), 0, 30, 800, 10, consolidation.Max, 0, 0, 1, 600, 60*24*3600, 1200, 2),
+		reqOut(test.GetMKey(2), 0, 30, 800, 10, consolidation.Avg, 0, 0, 0, 10, 35*24*3600, 10, 1),
+	}
+	reqs[0].Target = "b"
+	reqs[1].Target = "a"
+	exp := []models.ArchiveChoice{
+		{Target: "a", Archive: 0, Interval: 10, OutInterval: 10, Consolidator: "AverageConsolidator"},
+		{Target: "b", Archive: 1, Interval: 600, OutInterval: 1200, Consolidator: "MaximumConsolidator"},
+	}
+	got := archiveChoices(reqs)
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+}
+
 var result []models.Req
 
 func BenchmarkAlignRequests(b *testing.B) {
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// validateRename returns an error if the series named from, or under it, can't be renamed to to
+func validateRename(from, to string) error {
+	for _, name := range []string{from, to} {
+		if strings.ContainsAny(name, "*{}[]?") {
+			return response.NewError(http.StatusBadRequest, fmt.Sprintf("%q: patterns are not supported", name))
+		}
+	}
+	if from == to || strings.HasPrefix(to, from+".") || strings.HasPrefix(from, to+".") {
+		return response.NewError(http.StatusBadRequest, "from and to must not be the same, nor contain each other")
+	}
+	return nil
+}
+
+// renamedMetricData returns the MetricData for the definition, renamed from from to to.
+// the name is either from itself, or a name under it.
+func renamedMetricData(def idx.Archive, from, to string) *schema.MetricData {
+	md := &schema.MetricData{
+		OrgId:    int(def.OrgId),
+		Name:     to + strings.TrimPrefix(def.Name, from),
+		Interval: def.Interval,
+		Unit:     def.Unit,
+		Mtype:    def.Mtype,
+		Tags:     def.Tags,
+		Time:     def.LastUpdate,
+	}
+	md.SetId()
+	return md
+}
+
+func (s *Server) metricsRename(ctx *middleware.Context, req models.MetricsRename) {
+	if err := validateRename(req.From, req.To); err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	renamed, err := s.metricsRenameLocal(ctx.Req.Context(), ctx.OrgId, req.From, req.To)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	data := models.IndexRename{
+		OrgId: ctx.OrgId,
+		From:  req.From,
+		To:    req.To,
+	}
+	resps, err := s.peerQuery(ctx.Req.Context(), data, "metricsRename", "/index/rename", true)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	for _, r := range resps {
+		resp := models.MetricsRenameResp{}
+		_, err = resp.UnmarshalMsg(r.buf)
+		if err != nil {
+			log.Errorf("HTTP metricsRename error unmarshaling body from %s/index/rename: %q", r.peer.GetName(), err.Error())
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		renamed += resp.RenamedDefs
+	}
+
+	log.Infof("HTTP metricsRename renamed %d series from %q to %q for org %d", renamed, req.From, req.To, ctx.OrgId)
+	response.Write(ctx, response.NewJson(200, models.MetricsRenameResp{RenamedDefs: renamed}, ""))
+}
+
+func (s *Server) indexRename(ctx *middleware.Context, req models.IndexRename) {
+	if err := validateRename(req.From, req.To); err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	renamed, err := s.metricsRenameLocal(ctx.Req.Context(), req.OrgId, req.From, req.To)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	resp := models.MetricsRenameResp{
+		RenamedDefs: renamed,
+	}
+	response.Write(ctx, response.NewMsgp(200, &resp))
+}
+
+// metricsRenameLocal renames the series named from, or under it, to to in the index of this instance.
+// primaries copy the data of the series to the new series (see mdata.CopySeries) before the old definitions
+// are deleted, so that a failed rename can simply be retried.
+// it returns the number of renamed definitions.
+func (s *Server) metricsRenameLocal(ctx context.Context, orgId uint32, from, to string) (int, error) {
+	defs, err := s.MetricIndex.DeletePreview(orgId, from)
+	if err != nil {
+		// errors can only be caused by bad request.
+		return 0, response.NewError(http.StatusBadRequest, err.Error())
+	}
+	if len(defs) == 0 {
+		return 0, nil
+	}
+
+	ms, _ := s.MemoryStore.(*mdata.AggMetrics)
+	for _, def := range defs {
+		md := renamedMetricData(def, from, to)
+		mkey, err := schema.MKeyFromString(md.Id)
+		if err != nil {
+			return 0, err
+		}
+		newDef, _, _ := s.MetricIndex.AddOrUpdate(mkey, md, def.Partition)
+		if ms != nil && cluster.Manager.IsPrimary() {
+			copied, err := ms.CopySeries(ctx, def.Id, mkey, def.SchemaId, def.AggId, newDef.SchemaId, newDef.AggId)
+			if err != nil {
+				log.Errorf("HTTP metricsRename failed to copy the data of %s to %s: %s", def.Id, mkey, err)
+				return 0, response.NewError(http.StatusInternalServerError, fmt.Sprintf("failed to copy the data of %s: %s", def.Id, err))
+			}
+			log.Debugf("HTTP metricsRename copied %d chunks of %s to %s", copied, def.Id, mkey)
+		}
+		if s.Cache != nil {
+			// the new series may have cached chunks, which don't include the copied data
+			s.Cache.DelMetric(mkey)
+		}
+	}
+
+	deleted, err := s.MetricIndex.Delete(orgId, from)
+	if err != nil {
+		return 0, response.NewError(http.StatusBadRequest, err.Error())
+	}
+	for _, def := range deleted {
+		if ms != nil {
+			ms.Delete(def.Id)
+		}
+		if s.Cache != nil {
+			s.Cache.DelMetric(def.Id)
+		}
+	}
+	return len(defs), nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestValidateRename(t *testing.T) {
+	cases := []struct {
+		from, to string
+		ok       bool
+	}{
+		{"host.web12", "host.web99", true},
+		{"host.web12.cpu", "host.web12.load", true},
+		{"host.web1", "host.web12", true},
+		{"host.web12", "host.web12", false},
+		{"host.web12", "host.web12.old", false},
+		{"host.web12.old", "host.web12", false},
+		{"host.web*", "host.web99", false},
+		{"host.web12", "host.{a,b}", false},
+	}
+	for _, c := range cases {
+		if err := validateRename(c.from, c.to); (err == nil) != c.ok {
+			t.Errorf("rename %q to %q: expected ok %t, got error %v", c.from, c.to, c.ok, err)
+		}
+	}
+}
+
+func TestMetricsRename(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	cluster.Manager.SetPriority(0)
+	cluster.Manager.SetReady()
+
+	srv, _ := newSrv(0, 0)
+	store := srv.BackendStore.(*mdata.MockStore)
+	store.Drop = false
+	ms := srv.MemoryStore.(*mdata.AggMetrics)
+	add := func(name string) schema.MKey {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     name,
+			Interval: 10,
+			Time:     1300,
+		}
+		md.SetId()
+		mkey := test.MustMKeyFromString(md.Id)
+		srv.MetricIndex.AddOrUpdate(mkey, md, 0)
+		m, _ := ms.GetOrCreate(mkey, 0, 0)
+		for ts := uint32(10); ts <= 1300; ts += 10 {
+			m.Add(ts, float64(ts))
+		}
+		return mkey
+	}
+	cpu := add("host.web12.cpu")
+	add("host.web12.mem")
+	add("host.web13.cpu")
+
+	req := httptest.NewRequest("POST", "/metrics/rename", strings.NewReader(url.Values{"from": {"host.web12"}, "to": {"host.web99"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Org-Id", "1")
+	rec := httptest.NewRecorder()
+	srv.Admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected rename to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	names := make(map[string]schema.MKey)
+	for _, def := range srv.MetricIndex.List(1) {
+		names[def.Name] = def.Id
+	}
+	for _, name := range []string{"host.web99.cpu", "host.web99.mem", "host.web13.cpu"} {
+		if _, ok := names[name]; !ok {
+			t.Fatalf("expected %s in the index, got %v", name, names)
+		}
+	}
+	if len(names) != 3 {
+		t.Fatalf("expected the old series to be removed from the index, got %v", names)
+	}
+	if _, ok := ms.Get(cpu); ok {
+		t.Fatalf("expected the old series to be removed from memory")
+	}
+
+	// the chunks in the store and the ones in memory, including the current one, have been copied
+	itgens, err := store.Search(test.NewContext(), schema.AMKey{MKey: names["host.web99.cpu"]}, 0, 0, 2000)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var points int
+	for _, itgen := range itgens {
+		it, err := itgen.Get()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for it.Next() {
+			points++
+		}
+	}
+	if len(itgens) != 3 || points != 130 {
+		t.Fatalf("expected 3 chunks with 130 points to be copied, got %d chunks with %d points", len(itgens), points)
+	}
+}
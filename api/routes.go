@@ -9,16 +9,29 @@ import (
 	"gopkg.in/macaron.v1"
 )
 
+func (s *Server) useMiddleware(m *macaron.Macaron) {
+	if useGzip {
+		m.Use(gziper.Gziper())
+	}
+	m.Use(middleware.RequestStats())
+	m.Use(middleware.Tracer(s.Tracer))
+	m.Use(macaron.Renderer())
+	m.Use(middleware.OrgMiddleware(multiTenant))
+	m.Use(middleware.CorsHandler())
+}
+
 func (s *Server) RegisterRoutes() {
 	r := s.Macaron
-	if useGzip {
-		r.Use(gziper.Gziper())
+	s.useMiddleware(r)
+	if s.Admin != r {
+		s.useMiddleware(s.Admin)
 	}
-	r.Use(middleware.RequestStats())
-	r.Use(middleware.Tracer(s.Tracer))
-	r.Use(macaron.Renderer())
-	r.Use(middleware.OrgMiddleware(multiTenant))
-	r.Use(middleware.CorsHandler())
+	if s.Ingest != r {
+		s.useMiddleware(s.Ingest)
+	}
+	s.registerAdminRoutes()
+	s.registerIngestRoutes()
+
 	form := binding.Form
 	bind := binding.Bind
 	withOrg := middleware.RequireOrg()
@@ -28,19 +41,16 @@ func (s *Server) RegisterRoutes() {
 
 	r.Get("/", noTrace, s.appStatus)
 	r.Get("/node", noTrace, s.getNodeStatus)
-	r.Post("/node", bind(models.NodeStatus{}), s.setNodeStatus)
-	r.Get("/priority", s.explainPriority)
-	r.Get("/debug/pprof/block", blockHandler)
-	r.Get("/debug/pprof/mutex", mutexHandler)
-
-	r.Get("/cluster", s.getClusterStatus)
-	r.Post("/cluster", bind(models.ClusterMembers{}), s.postClusterMembers)
 
 	r.Combo("/getdata", ready, bind(models.GetData{})).Get(s.getData).Post(s.getData)
 
 	r.Combo("/index/find", ready, bind(models.IndexFind{})).Get(s.indexFind).Post(s.indexFind)
 	r.Combo("/index/list", ready, bind(models.IndexList{})).Get(s.indexList).Post(s.indexList)
 	r.Combo("/index/delete", ready, bind(models.IndexDelete{})).Get(s.indexDelete).Post(s.indexDelete)
+	r.Combo("/index/delete_preview", ready, bind(models.IndexDelete{})).Get(s.indexDeletePreview).Post(s.indexDeletePreview)
+	r.Combo("/index/rename", ready, bind(models.IndexRename{})).Get(s.indexRename).Post(s.indexRename)
+	r.Combo("/index/backfill-rollups", ready, bind(models.IndexBackfillRollups{})).Get(s.indexBackfillRollups).Post(s.indexBackfillRollups)
+	r.Combo("/index/update-ttl", ready, bind(models.IndexUpdateTTL{})).Get(s.indexUpdateTTL).Post(s.indexUpdateTTL)
 	r.Combo("/index/get", ready, bind(models.IndexGet{})).Get(s.indexGet).Post(s.indexGet)
 	r.Combo("/index/tags", ready, bind(models.IndexTags{})).Get(s.indexTags).Post(s.indexTags)
 	r.Combo("/index/find_by_tag", ready, bind(models.IndexFindByTag{})).Get(s.indexFindByTag).Post(s.indexFindByTag)
@@ -61,13 +71,12 @@ func (s *Server) RegisterRoutes() {
 	r.Combo("/render", cBody, withOrg, ready, bind(models.GraphiteRender{})).Get(s.renderMetrics).Post(s.renderMetrics)
 	r.Combo("/metrics/find", withOrg, ready, bind(models.GraphiteFind{})).Get(s.metricsFind).Post(s.metricsFind)
 	r.Get("/metrics/index.json", withOrg, ready, s.metricsIndex)
-	r.Post("/metrics/delete", withOrg, ready, bind(models.MetricsDelete{}), s.metricsDelete)
+	r.Combo("/metrics/export", cBody, withOrg, ready, bind(models.MetricsExport{})).Get(s.metricsExport).Post(s.metricsExport)
 	r.Combo("/tags", withOrg, ready, bind(models.GraphiteTags{})).Get(s.graphiteTags).Post(s.graphiteTags)
 	r.Combo("/tags/:tag([0-9a-zA-Z]+)", withOrg, ready, bind(models.GraphiteTagDetails{})).Get(s.graphiteTagDetails).Post(s.graphiteTagDetails)
 	r.Combo("/tags/findSeries", withOrg, ready, bind(models.GraphiteTagFindSeries{})).Get(s.graphiteTagFindSeries).Post(s.graphiteTagFindSeries)
 	r.Combo("/tags/autoComplete/tags", withOrg, ready, bind(models.GraphiteAutoCompleteTags{})).Get(s.graphiteAutoCompleteTags).Post(s.graphiteAutoCompleteTags)
 	r.Combo("/tags/autoComplete/values", withOrg, ready, bind(models.GraphiteAutoCompleteTagValues{})).Get(s.graphiteAutoCompleteTagValues).Post(s.graphiteAutoCompleteTagValues)
-	r.Post("/tags/delSeries", withOrg, ready, bind(models.GraphiteTagDelSeries{}), s.graphiteTagDelSeries)
 	r.Combo("/functions", withOrg, ready).Get(s.graphiteFunctions).Post(s.graphiteFunctions)
 	r.Combo("/functions/:func(.+)", withOrg, ready).Get(s.graphiteFunctions).Post(s.graphiteFunctions)
 
@@ -76,5 +85,49 @@ func (s *Server) RegisterRoutes() {
 	r.Combo("/prometheus/api/v1/query", cBody, withOrg, ready, form(models.PrometheusQueryInstant{})).Get(s.prometheusQueryInstant).Post(s.prometheusQueryInstant)
 	r.Combo("/prometheus/api/v1/series", cBody, withOrg, ready, form(models.PrometheusSeriesQuery{})).Get(s.prometheusQuerySeries).Post(s.prometheusQuerySeries)
 	r.Get("/prometheus/api/v1/label/:name/values", cBody, withOrg, ready, s.prometheusLabelValues)
-	r.Get("/prometheus/metrics", promhttp.Handler())
+}
+
+// registerAdminRoutes registers the endpoints that change the state of the node or cluster,
+// or expose internals. these are served by the admin listener.
+func (s *Server) registerAdminRoutes() {
+	r := s.Admin
+	bind := binding.Bind
+	withOrg := middleware.RequireOrg()
+	ready := middleware.NodeReady()
+	auth := middleware.BasicAuth(adminListener.auth)
+
+	r.Post("/node", auth, bind(models.NodeStatus{}), s.setNodeStatus)
+	r.Get("/priority", auth, s.explainPriority)
+	r.Get("/ingest/offenders", auth, bind(models.IngestOffenders{}), s.ingestOffenders)
+	r.Get("/ingest/interval-violations", auth, bind(models.IngestOffenders{}), s.intervalViolations)
+	r.Get("/ingest/dropped", auth, s.ingestDropped)
+	r.Get("/debug/pprof/block", auth, blockHandler)
+	r.Get("/debug/pprof/mutex", auth, mutexHandler)
+
+	r.Get("/cluster", auth, s.getClusterStatus)
+	r.Post("/cluster", auth, bind(models.ClusterMembers{}), s.postClusterMembers)
+	r.Post("/retention/reload", auth, s.reloadRetention)
+	r.Get("/series-limits", auth, s.getSeriesLimits)
+	r.Post("/series-limits", auth, bind(models.SeriesLimit{}), s.setSeriesLimit)
+	r.Get("/usage", auth, s.getUsage)
+	r.Get("/store", auth, s.getStoreStats)
+	r.Get("/metrics/info", auth, bind(models.MetricInfo{}), s.metricInfo)
+
+	r.Post("/metrics/delete", auth, withOrg, ready, bind(models.MetricsDelete{}), s.metricsDelete)
+	r.Post("/metrics/rename", auth, withOrg, ready, bind(models.MetricsRename{}), s.metricsRename)
+	r.Post("/metrics/backfill-rollups", auth, withOrg, ready, bind(models.MetricsBackfillRollups{}), s.metricsBackfillRollups)
+	r.Post("/metrics/update-ttl", auth, withOrg, ready, bind(models.MetricsUpdateTTL{}), s.metricsUpdateTTL)
+	r.Combo("/metrics/delete/status", auth, withOrg, bind(models.MetricsDeleteStatus{})).Get(s.metricsDeleteStatus).Post(s.metricsDeleteStatus)
+	r.Post("/tags/delSeries", auth, withOrg, ready, bind(models.GraphiteTagDelSeries{}), s.graphiteTagDelSeries)
+
+	r.Get("/prometheus/metrics", auth, promhttp.Handler())
+}
+
+// registerIngestRoutes registers the endpoints of input plugins that receive data over http.
+// these are served by the ingest listener.
+func (s *Server) registerIngestRoutes() {
+	auth := middleware.BasicAuth(ingestListener.auth)
+	for _, h := range s.ingestHandlers {
+		s.Ingest.Post(h.path, auth, h.handler)
+	}
 }
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSeparateListeners(t *testing.T) {
+	defer func(admin, ingest listener) {
+		adminListener, ingestListener = admin, ingest
+	}(adminListener, ingestListener)
+	adminListener.addr = "localhost:0"
+	adminListener.auth = "admin:secret"
+	ingestListener.addr = "localhost:0"
+
+	srv, _ := NewServer()
+	if srv.Admin == srv.Macaron || srv.Ingest == srv.Macaron {
+		t.Fatal("expected separate handlers for admin and ingest endpoints")
+	}
+	srv.BindIngestHandler("/write", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	srv.RegisterRoutes()
+
+	cases := []struct {
+		handler  http.Handler
+		method   string
+		path     string
+		user     string
+		pass     string
+		expCode  int
+		scenario string
+	}{
+		{srv.Macaron, "GET", "/priority", "", "", http.StatusNotFound, "admin endpoint on main listener"},
+		{srv.Admin, "GET", "/priority", "", "", http.StatusUnauthorized, "admin endpoint without credentials"},
+		{srv.Admin, "GET", "/priority", "admin", "wrong", http.StatusUnauthorized, "admin endpoint with wrong credentials"},
+		{srv.Admin, "GET", "/priority", "admin", "secret", http.StatusOK, "admin endpoint with credentials"},
+		{srv.Admin, "GET", "/debug/pprof/cmdline", "", "", http.StatusUnauthorized, "pprof without credentials"},
+		{srv.Macaron, "POST", "/write", "", "", http.StatusNotFound, "ingest endpoint on main listener"},
+		{srv.Ingest, "POST", "/write", "", "", http.StatusOK, "ingest endpoint"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		rec := httptest.NewRecorder()
+		c.handler.ServeHTTP(rec, req)
+		if rec.Code != c.expCode {
+			t.Fatalf("%s: expected status %d, got %d", c.scenario, c.expCode, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/raintank/dur"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultUpdateTTLRate is how many chunks per second each instance saves when updating ttls, unless the request says otherwise
+const defaultUpdateTTLRate = 100
+
+// metricsUpdateTTL starts saving the chunks of the series matching the query that were saved with the given ttl again,
+// with the ttl of their archives, on all instances.
+// it returns the number of series that are being updated, summed over all instances.
+func (s *Server) metricsUpdateTTL(ctx *middleware.Context, req models.MetricsUpdateTTL) {
+	fromTTL, err := dur.ParseNDuration(req.FromTTL)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid fromTTL: "+err.Error()))
+		return
+	}
+	if req.Rate < 0 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "rate must not be negative"))
+		return
+	}
+	if req.Rate == 0 {
+		req.Rate = defaultUpdateTTLRate
+	}
+	if err := mdata.CheckUpdateTTL(fromTTL); err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	series, err := s.updateTTLLocal(ctx.OrgId, req.Query, fromTTL, req.Rate)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	data := models.IndexUpdateTTL{
+		OrgId:   ctx.OrgId,
+		Query:   req.Query,
+		FromTTL: fromTTL,
+		Rate:    req.Rate,
+	}
+	resps, err := s.peerQuery(ctx.Req.Context(), data, "metricsUpdateTTL", "/index/update-ttl", true)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	for _, r := range resps {
+		resp := models.MetricsUpdateTTLResp{}
+		_, err = resp.UnmarshalMsg(r.buf)
+		if err != nil {
+			log.Errorf("HTTP metricsUpdateTTL error unmarshaling body from %s/index/update-ttl: %q", r.peer.GetName(), err.Error())
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		series += resp.Series
+	}
+
+	response.Write(ctx, response.NewJson(http.StatusAccepted, models.MetricsUpdateTTLResp{Series: series}, ""))
+}
+
+func (s *Server) indexUpdateTTL(ctx *middleware.Context, req models.IndexUpdateTTL) {
+	if err := mdata.CheckUpdateTTL(req.FromTTL); err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	series, err := s.updateTTLLocal(req.OrgId, req.Query, req.FromTTL, req.Rate)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	resp := models.MetricsUpdateTTLResp{
+		Series: series,
+	}
+	response.Write(ctx, response.NewMsgp(200, &resp))
+}
+
+// updateTTLLocal starts saving the chunks of the series matching the query that were saved with fromTTL again,
+// with the ttl of their archives, in the background, saving up to rate chunks per second.
+// only primaries update, as they are the ones that save chunks. see mdata.UpdateTTL
+// it returns the number of series that are being updated.
+func (s *Server) updateTTLLocal(orgId uint32, query string, fromTTL uint32, rate int) (int, error) {
+	ms, _ := s.MemoryStore.(*mdata.AggMetrics)
+	if ms == nil || s.BackendStore == nil || !cluster.Manager.IsPrimary() {
+		return 0, nil
+	}
+	nodes, err := s.MetricIndex.Find(orgId, query, 0, 0)
+	if err != nil {
+		// errors can only be caused by bad request.
+		return 0, response.NewError(http.StatusBadRequest, err.Error())
+	}
+	var defs []idx.Archive
+	for _, n := range nodes {
+		defs = append(defs, n.Defs...)
+	}
+	if len(defs) == 0 {
+		return 0, nil
+	}
+
+	log.Infof("HTTP metricsUpdateTTL updating the chunks with ttl %d of %d series matching %q of org %d, at %d chunks per second", fromTTL, len(defs), query, orgId, rate)
+	go func() {
+		throttle := time.NewTicker(time.Second / time.Duration(rate))
+		defer throttle.Stop()
+		var saved, failed int
+		for _, def := range defs {
+			n, err := ms.UpdateTTL(context.Background(), def.Id, def.SchemaId, def.AggId, fromTTL, throttle.C)
+			saved += n
+			if err != nil {
+				log.Errorf("HTTP metricsUpdateTTL failed to update the chunks of %s: %s", def.Id, err)
+				failed++
+				continue
+			}
+			if n > 0 && s.Cache != nil {
+				// the cache doesn't know about the chunks we saved
+				s.Cache.DelMetric(def.Id)
+			}
+		}
+		log.Infof("HTTP metricsUpdateTTL saved %d chunks with ttl %d of %d series matching %q of org %d. %d series failed", saved, fromTTL, len(defs), query, orgId, failed)
+	}()
+	return len(defs), nil
+}
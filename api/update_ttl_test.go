@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+)
+
+func TestMetricsUpdateTTLInvalid(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPriority(0)
+	cluster.Manager.SetReady()
+	cluster.Manager.SetPrimary(true)
+
+	srv, _ := newSrv(0, 0)
+	cases := []url.Values{
+		{"query": {"host.*.cpu"}, "fromTTL": {"30x"}},
+		{"query": {"host.*.cpu"}, "fromTTL": {"30d"}, "rate": {"-1"}},
+		// the store has no table for it
+		{"query": {"host.*.cpu"}, "fromTTL": {"30d"}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/metrics/update-ttl", strings.NewReader(c.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Org-Id", "1")
+		rec := httptest.NewRecorder()
+		srv.Admin.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected %d, got %d: %s", c, http.StatusBadRequest, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package bus provides an abstraction over the message buses metrictank uses to
+// consume metrics from and to exchange messages between instances,
+// such as the cluster notifications about saved chunks.
+// Implementations live in subpackages, so that core logic doesn't depend on any particular bus.
+package bus
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+// special offsets, to be passed to Bus.Offset and Bus.Consume
+const (
+	OffsetNewest int64 = -1 // the offset of the next message that will be published
+	OffsetOldest int64 = -2 // the offset of the oldest message still available
+)
+
+// PartitionAuto can be used as the partition of a published message,
+// to have the bus pick the partition based on the message key
+const PartitionAuto int32 = -1
+
+var ErrUnknownTopic = errors.New("unknown topic")
+var ErrUnknownPartition = errors.New("unknown partition")
+
+// Message is a message published to, or consumed from a bus
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64 // set when consuming. ignored when publishing
+	Key       []byte
+	Value     []byte
+	Headers   map[string][]byte // may be dropped by buses that don't support headers
+}
+
+// PartitionForKey returns the partition for the given key, out of numPartitions partitions.
+// buses use this to resolve PartitionAuto.
+func PartitionForKey(key []byte, numPartitions int) int32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return int32(h.Sum32() % uint32(numPartitions))
+}
+
+// Bus is a partitioned, persistent message bus.
+// messages are published to, and consumed from, a partition of a topic.
+// within a partition messages are ordered and identified by their offset.
+type Bus interface {
+	// Partitions returns the partitions of the topic
+	Partitions(topic string) ([]int32, error)
+
+	// Offset returns the offset of the first message in the partition published at, or after,
+	// the given time in milliseconds since the epoch.
+	// OffsetNewest and OffsetOldest may also be given, to get the newest and oldest offsets.
+	Offset(topic string, partition int32, ms int64) (int64, error)
+
+	// Publish publishes the messages to their partitions (see PartitionAuto).
+	// it blocks until all messages have been acknowledged or an error occurred.
+	Publish(msgs []*Message) error
+
+	// Consume starts consuming the partition at the given offset,
+	// which may also be OffsetNewest or OffsetOldest.
+	Consume(topic string, partition int32, offset int64) (Consumer, error)
+
+	// Close releases all resources of the bus.
+	// all consumers must have been closed before.
+	Close() error
+}
+
+// Consumer consumes a single partition of a topic
+type Consumer interface {
+	// Messages returns the channel on which consumed messages are delivered
+	Messages() <-chan *Message
+	// Close stops the consumer
+	Close() error
+}
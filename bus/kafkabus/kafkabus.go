@@ -0,0 +1,154 @@
+// Package kafkabus implements bus.Bus on top of kafka
+package kafkabus
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/grafana/metrictank/bus"
+)
+
+type KafkaBus struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	producer sarama.SyncProducer
+	headers  bool // whether the kafka version supports message headers
+}
+
+// New creates a bus connected to the given brokers.
+// for messages to be published to the partition they specify, the config
+// must use sarama.NewManualPartitioner, and Producer.Return.Successes must be enabled.
+// message headers are only published if the configured kafka version is 0.11 or newer.
+func New(brokers []string, config *sarama.Config) (*KafkaBus, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		consumer.Close()
+		client.Close()
+		return nil, err
+	}
+	return &KafkaBus{
+		client:   client,
+		consumer: consumer,
+		producer: producer,
+		headers:  config.Version.IsAtLeast(sarama.V0_11_0_0),
+	}, nil
+}
+
+func (k *KafkaBus) Partitions(topic string) ([]int32, error) {
+	return k.client.Partitions(topic)
+}
+
+// Offset returns the requested offset. OffsetNewest and OffsetOldest correspond to their sarama equivalents.
+func (k *KafkaBus) Offset(topic string, partition int32, ms int64) (int64, error) {
+	return k.client.GetOffset(topic, partition, ms)
+}
+
+func (k *KafkaBus) Publish(msgs []*bus.Message) error {
+	payload := make([]*sarama.ProducerMessage, len(msgs))
+	for i, msg := range msgs {
+		partition := msg.Partition
+		if partition == bus.PartitionAuto {
+			partitions, err := k.client.Partitions(msg.Topic)
+			if err != nil {
+				return err
+			}
+			partition = bus.PartitionForKey(msg.Key, len(partitions))
+		}
+		payload[i] = &sarama.ProducerMessage{
+			Topic:     msg.Topic,
+			Partition: partition,
+			Value:     sarama.ByteEncoder(msg.Value),
+		}
+		if msg.Key != nil {
+			payload[i].Key = sarama.ByteEncoder(msg.Key)
+		}
+		if k.headers {
+			for key, val := range msg.Headers {
+				payload[i].Headers = append(payload[i].Headers, sarama.RecordHeader{Key: []byte(key), Value: val})
+			}
+		}
+	}
+	return k.producer.SendMessages(payload)
+}
+
+func (k *KafkaBus) Consume(topic string, partition int32, offset int64) (bus.Consumer, error) {
+	pc, err := k.consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+	c := &consumer{
+		pc:   pc,
+		out:  make(chan *bus.Message),
+		done: make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (k *KafkaBus) Close() error {
+	k.producer.Close()
+	k.consumer.Close()
+	return k.client.Close()
+}
+
+// consumer relays messages from a sarama PartitionConsumer
+type consumer struct {
+	pc        sarama.PartitionConsumer
+	out       chan *bus.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *consumer) run() {
+	defer close(c.out)
+	for {
+		select {
+		case m, ok := <-c.pc.Messages():
+			if !ok {
+				return
+			}
+			msg := &bus.Message{
+				Topic:     m.Topic,
+				Partition: m.Partition,
+				Offset:    m.Offset,
+				Key:       m.Key,
+				Value:     m.Value,
+			}
+			if len(m.Headers) > 0 {
+				msg.Headers = make(map[string][]byte, len(m.Headers))
+				for _, h := range m.Headers {
+					msg.Headers[string(h.Key)] = h.Value
+				}
+			}
+			select {
+			case c.out <- msg:
+			case <-c.done:
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *consumer) Messages() <-chan *bus.Message {
+	return c.out
+}
+
+func (c *consumer) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.pc.Close()
+	})
+	return err
+}
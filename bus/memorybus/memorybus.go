@@ -0,0 +1,186 @@
+// Package memorybus implements bus.Bus in memory.
+// it is useful for tests, and for single instance setups that don't need a real bus.
+package memorybus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/bus"
+)
+
+type MemoryBus struct {
+	sync.Mutex
+	topics map[string][]*partition
+}
+
+type partition struct {
+	msgs   []bus.Message
+	times  []int64       // publish time in ms of each message
+	notify chan struct{} // closed (and replaced) whenever messages are added
+}
+
+// New creates a bus with the given topics, mapped to their number of partitions
+func New(topics map[string]int32) *MemoryBus {
+	m := &MemoryBus{
+		topics: make(map[string][]*partition),
+	}
+	for topic, num := range topics {
+		parts := make([]*partition, num)
+		for i := range parts {
+			parts[i] = &partition{
+				notify: make(chan struct{}),
+			}
+		}
+		m.topics[topic] = parts
+	}
+	return m
+}
+
+// get returns the requested partition. caller must hold the lock
+func (m *MemoryBus) get(topic string, part int32) (*partition, error) {
+	parts, ok := m.topics[topic]
+	if !ok {
+		return nil, bus.ErrUnknownTopic
+	}
+	if part < 0 || int(part) >= len(parts) {
+		return nil, bus.ErrUnknownPartition
+	}
+	return parts[part], nil
+}
+
+func (m *MemoryBus) Partitions(topic string) ([]int32, error) {
+	m.Lock()
+	defer m.Unlock()
+	parts, ok := m.topics[topic]
+	if !ok {
+		return nil, bus.ErrUnknownTopic
+	}
+	ids := make([]int32, len(parts))
+	for i := range parts {
+		ids[i] = int32(i)
+	}
+	return ids, nil
+}
+
+func (m *MemoryBus) Offset(topic string, part int32, ms int64) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	p, err := m.get(topic, part)
+	if err != nil {
+		return 0, err
+	}
+	return p.offset(ms), nil
+}
+
+// offset resolves the offset for the given time or special offset. caller must hold the lock
+func (p *partition) offset(ms int64) int64 {
+	switch ms {
+	case bus.OffsetNewest:
+		return int64(len(p.msgs))
+	case bus.OffsetOldest:
+		return 0
+	}
+	for i, t := range p.times {
+		if t >= ms {
+			return int64(i)
+		}
+	}
+	return int64(len(p.msgs))
+}
+
+func (m *MemoryBus) Publish(msgs []*bus.Message) error {
+	m.Lock()
+	defer m.Unlock()
+	// resolve and validate all partitions first, so we don't publish partial batches
+	parts := make([]int32, len(msgs))
+	for i, msg := range msgs {
+		parts[i] = msg.Partition
+		if parts[i] == bus.PartitionAuto && len(m.topics[msg.Topic]) > 0 {
+			parts[i] = bus.PartitionForKey(msg.Key, len(m.topics[msg.Topic]))
+		}
+		if _, err := m.get(msg.Topic, parts[i]); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	notify := make(map[*partition]struct{})
+	for i, msg := range msgs {
+		p, _ := m.get(msg.Topic, parts[i])
+		stored := *msg
+		stored.Partition = parts[i]
+		stored.Offset = int64(len(p.msgs))
+		p.msgs = append(p.msgs, stored)
+		p.times = append(p.times, now)
+		notify[p] = struct{}{}
+	}
+	for p := range notify {
+		close(p.notify)
+		p.notify = make(chan struct{})
+	}
+	return nil
+}
+
+func (m *MemoryBus) Consume(topic string, part int32, offset int64) (bus.Consumer, error) {
+	m.Lock()
+	p, err := m.get(topic, part)
+	if err == nil && offset < 0 {
+		offset = p.offset(offset)
+	}
+	m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c := &consumer{
+		out:  make(chan *bus.Message),
+		done: make(chan struct{}),
+	}
+	go c.run(m, p, offset)
+	return c, nil
+}
+
+func (m *MemoryBus) Close() error {
+	return nil
+}
+
+type consumer struct {
+	out       chan *bus.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *consumer) run(m *MemoryBus, p *partition, offset int64) {
+	defer close(c.out)
+	for {
+		m.Lock()
+		if offset < int64(len(p.msgs)) {
+			msg := p.msgs[offset]
+			m.Unlock()
+			select {
+			case c.out <- &msg:
+				offset++
+			case <-c.done:
+				return
+			}
+			continue
+		}
+		notify := p.notify
+		m.Unlock()
+		select {
+		case <-notify:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *consumer) Messages() <-chan *bus.Message {
+	return c.out
+}
+
+func (c *consumer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
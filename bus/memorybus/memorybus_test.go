@@ -0,0 +1,72 @@
+package memorybus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/bus"
+)
+
+func TestPublishConsume(t *testing.T) {
+	b := New(map[string]int32{"test": 2})
+
+	parts, err := b.Partitions("test")
+	if err != nil || len(parts) != 2 {
+		t.Fatalf("expected 2 partitions, got %v (err: %v)", parts, err)
+	}
+	if _, err := b.Partitions("unknown"); err != bus.ErrUnknownTopic {
+		t.Fatalf("expected ErrUnknownTopic, got %v", err)
+	}
+
+	err = b.Publish([]*bus.Message{
+		{Topic: "test", Partition: 1, Value: []byte("a")},
+		{Topic: "test", Partition: 1, Value: []byte("b")},
+		{Topic: "test", Partition: 0, Value: []byte("c")},
+	})
+	if err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+	if err := b.Publish([]*bus.Message{{Topic: "test", Partition: 2}}); err != bus.ErrUnknownPartition {
+		t.Fatalf("expected ErrUnknownPartition, got %v", err)
+	}
+
+	if newest, _ := b.Offset("test", 1, bus.OffsetNewest); newest != 2 {
+		t.Fatalf("expected newest offset 2, got %d", newest)
+	}
+
+	c, err := b.Consume("test", 1, bus.OffsetOldest)
+	if err != nil {
+		t.Fatalf("failed to consume: %s", err)
+	}
+	defer c.Close()
+
+	// messages published after the consumer started must be delivered too
+	go b.Publish([]*bus.Message{{Topic: "test", Partition: 1, Value: []byte("d")}})
+
+	for i, exp := range []string{"a", "b", "d"} {
+		select {
+		case msg := <-c.Messages():
+			if string(msg.Value) != exp || msg.Offset != int64(i) {
+				t.Fatalf("expected message %q at offset %d, got %q at offset %d", exp, i, msg.Value, msg.Offset)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %q", exp)
+		}
+	}
+}
+
+func TestPublishPartitionAuto(t *testing.T) {
+	b := New(map[string]int32{"test": 4})
+	msgs := []*bus.Message{
+		{Topic: "test", Partition: bus.PartitionAuto, Key: []byte("foo"), Value: []byte("1")},
+		{Topic: "test", Partition: bus.PartitionAuto, Key: []byte("foo"), Value: []byte("2")},
+	}
+	if err := b.Publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+	part := bus.PartitionForKey([]byte("foo"), 4)
+	offset, err := b.Offset("test", part, bus.OffsetNewest)
+	if err != nil || offset != 2 {
+		t.Fatalf("expected both messages on partition %d, got offset %d (err: %v)", part, offset, err)
+	}
+}
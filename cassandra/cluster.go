@@ -0,0 +1,67 @@
+package cassandra
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/hailocab/go-hostpool"
+)
+
+// HostSelectionPolicies are the supported names of host selection policies
+const HostSelectionPolicies = "roundrobin|hostpool-simple|hostpool-epsilon-greedy|dcaware|tokenaware,roundrobin|tokenaware,hostpool-simple|tokenaware,hostpool-epsilon-greedy|tokenaware,dcaware"
+
+// HostSelectionPolicy returns the host selection policy with the given name.
+// the tokenaware policies prefer the hosts that have the data of the query, and fall back to the named policy.
+// the dcaware policies only use the hosts of localDC, unless none of them are up.
+func HostSelectionPolicy(name, localDC string) (gocql.HostSelectionPolicy, error) {
+	if strings.HasSuffix(name, "dcaware") && localDC == "" {
+		return nil, fmt.Errorf("HostSelectionPolicy '%s' needs a local dc", name)
+	}
+	switch name {
+	case "roundrobin":
+		return gocql.RoundRobinHostPolicy(), nil
+	case "hostpool-simple":
+		return gocql.HostPoolHostPolicy(hostpool.New(nil)), nil
+	case "hostpool-epsilon-greedy":
+		return gocql.HostPoolHostPolicy(
+			hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
+		), nil
+	case "dcaware":
+		return gocql.DCAwareRoundRobinPolicy(localDC), nil
+	case "tokenaware,roundrobin":
+		return gocql.TokenAwareHostPolicy(
+			gocql.RoundRobinHostPolicy(),
+		), nil
+	case "tokenaware,hostpool-simple":
+		return gocql.TokenAwareHostPolicy(
+			gocql.HostPoolHostPolicy(hostpool.New(nil)),
+		), nil
+	case "tokenaware,hostpool-epsilon-greedy":
+		return gocql.TokenAwareHostPolicy(
+			gocql.HostPoolHostPolicy(
+				hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
+			),
+		), nil
+	case "tokenaware,dcaware":
+		return gocql.TokenAwareHostPolicy(
+			gocql.DCAwareRoundRobinPolicy(localDC),
+		), nil
+	}
+	return nil, fmt.Errorf("unknown HostSelectionPolicy '%q'", name)
+}
+
+// SslOptions returns the options for a SSL connection to cassandra.
+// certPath and keyPath are the client certificate and its key, for clusters that require client authentication.
+// they must be both set, or both empty to not use a client certificate.
+func SslOptions(caPath, certPath, keyPath string, hostVerification bool) (*gocql.SslOptions, error) {
+	if (certPath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("a client certificate needs both a cert path and a key path")
+	}
+	return &gocql.SslOptions{
+		CaPath:                 caPath,
+		CertPath:               certPath,
+		KeyPath:                keyPath,
+		EnableHostVerification: hostVerification,
+	}, nil
+}
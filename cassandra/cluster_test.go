@@ -0,0 +1,43 @@
+package cassandra
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostSelectionPolicy(t *testing.T) {
+	for _, name := range strings.Split(HostSelectionPolicies, "|") {
+		if _, err := HostSelectionPolicy(name, "dc1"); err != nil {
+			t.Errorf("expected policy %q to be supported, got %v", name, err)
+		}
+	}
+	if _, err := HostSelectionPolicy("tokenaware", "dc1"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+	if _, err := HostSelectionPolicy("tokenaware,dcaware", ""); err == nil {
+		t.Error("expected an error for a dcaware policy without a local dc")
+	}
+}
+
+func TestSslOptions(t *testing.T) {
+	cases := []struct {
+		certPath string
+		keyPath  string
+		expErr   bool
+	}{
+		{"", "", false},
+		{"/etc/metrictank/client.pem", "/etc/metrictank/client.key", false},
+		{"/etc/metrictank/client.pem", "", true},
+		{"", "/etc/metrictank/client.key", true},
+	}
+	for _, c := range cases {
+		opts, err := SslOptions("/etc/metrictank/ca.pem", c.certPath, c.keyPath, true)
+		if (err != nil) != c.expErr {
+			t.Errorf("cert path %q, key path %q: expected error %t, got %v", c.certPath, c.keyPath, c.expErr, err)
+			continue
+		}
+		if err == nil && (opts.CertPath != c.certPath || opts.KeyPath != c.keyPath || !opts.EnableHostVerification) {
+			t.Errorf("cert path %q, key path %q: unexpected options %+v", c.certPath, c.keyPath, opts)
+		}
+	}
+}
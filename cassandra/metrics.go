@@ -1,6 +1,7 @@
 package cassandra
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -15,6 +16,8 @@ type ErrMetrics struct {
 	cassErrNoConns                  *stats.Counter32
 	cassErrUnavailable              *stats.Counter32
 	cassErrCannotAchieveConsistency *stats.Counter32
+	cassErrInvalid                  *stats.Counter32
+	cassErrMisconfigured            *stats.Counter32
 	cassErrOther                    *stats.Counter32
 }
 
@@ -51,6 +54,16 @@ func NewErrMetrics(component string) ErrMetrics {
 		// metric store.cassandra.error.cannot-achieve-consistency is a counter of the cassandra store not being able to achieve consistency for a given query
 		cassErrCannotAchieveConsistency: stats.NewCounter32(fmt.Sprintf("%s.error.cannot-achieve-consistency", component)),
 
+		// metric idx.cassandra.error.invalid is a counter of queries rejected by cassandra as invalid or syntactically wrong. retrying them won't help
+
+		// metric store.cassandra.error.invalid is a counter of queries rejected by cassandra as invalid or syntactically wrong. chunk writes failing this way are dropped
+		cassErrInvalid: stats.NewCounter32(fmt.Sprintf("%s.error.invalid", component)),
+
+		// metric idx.cassandra.error.misconfigured is a counter of queries failing because of bad credentials, missing permissions or a protocol or configuration problem, which need fixing by an operator
+
+		// metric store.cassandra.error.misconfigured is a counter of queries failing because of bad credentials, missing permissions or a protocol or configuration problem. chunk writes failing this way are retried until it is fixed
+		cassErrMisconfigured: stats.NewCounter32(fmt.Sprintf("%s.error.misconfigured", component)),
+
 		// metric idx.cassandra.error.other is a counter of other errors talking to the cassandra idx
 
 		// metric store.cassandra.error.other is a counter of other errors talking to the cassandra store
@@ -59,7 +72,11 @@ func NewErrMetrics(component string) ErrMetrics {
 }
 
 func (m *ErrMetrics) Inc(err error) {
-	if err == gocql.ErrTimeoutNoResponse {
+	code := -1
+	if reqErr, ok := err.(gocql.RequestError); ok {
+		code = reqErr.Code()
+	}
+	if err == gocql.ErrTimeoutNoResponse || err == context.DeadlineExceeded || code == errWriteTimeout || code == errReadTimeout {
 		m.cassErrTimeout.Inc()
 	} else if err == gocql.ErrTooManyTimeouts {
 		m.cassErrTooManyTimeouts.Inc()
@@ -67,11 +84,65 @@ func (m *ErrMetrics) Inc(err error) {
 		m.cassErrConnClosed.Inc()
 	} else if err == gocql.ErrNoConnections {
 		m.cassErrNoConns.Inc()
-	} else if err == gocql.ErrUnavailable {
+	} else if err == gocql.ErrUnavailable || code == errUnavailable {
 		m.cassErrUnavailable.Inc()
 	} else if strings.HasPrefix(err.Error(), "Cannot achieve consistency level") {
 		m.cassErrCannotAchieveConsistency.Inc()
+	} else if !Retryable(err) {
+		m.cassErrInvalid.Inc()
+	} else if Misconfigured(err) {
+		m.cassErrMisconfigured.Inc()
 	} else {
 		m.cassErrOther.Inc()
 	}
 }
+
+// error codes of the cassandra protocol. see gocql's errors.go
+const (
+	errProtocol     = 0x000A
+	errCredentials  = 0x0100
+	errUnavailable  = 0x1000
+	errWriteTimeout = 0x1100
+	errReadTimeout  = 0x1200
+	errSyntax       = 0x2000
+	errUnauthorized = 0x2100
+	errInvalid      = 0x2200
+	errConfig       = 0x2300
+)
+
+// Retryable returns whether a query that failed with the given error may succeed when retried.
+// that's the case for all errors except the ones about the query itself: cassandra rejecting it
+// as syntactically wrong or invalid, e.g. because a value is too large, which fails the same way every time.
+// note that errors about the setup (see Misconfigured) are retryable: they go away once it is fixed.
+func Retryable(err error) bool {
+	reqErr, ok := err.(gocql.RequestError)
+	if !ok {
+		return true
+	}
+	switch reqErr.Code() {
+	case errSyntax, errInvalid:
+		return false
+	}
+	return true
+}
+
+// Misconfigured returns whether the query failed because of a problem with the setup rather than with the query:
+// bad credentials, missing permissions, a protocol mismatch or a configuration problem.
+// any query will keep failing until an operator fixes it.
+func Misconfigured(err error) bool {
+	reqErr, ok := err.(gocql.RequestError)
+	if !ok {
+		return false
+	}
+	switch reqErr.Code() {
+	case errProtocol, errCredentials, errUnauthorized, errConfig:
+		return true
+	}
+	return false
+}
+
+// Unavailable returns whether the query failed because not enough replicas were alive to achieve its consistency level
+func Unavailable(err error) bool {
+	reqErr, ok := err.(gocql.RequestError)
+	return ok && reqErr.Code() == errUnavailable
+}
@@ -0,0 +1,75 @@
+package cassandra
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+type requestError struct {
+	code int
+}
+
+func (e requestError) Code() int       { return e.code }
+func (e requestError) Message() string { return "test" }
+func (e requestError) Error() string   { return "test" }
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		err error
+		exp bool
+	}{
+		{gocql.ErrTimeoutNoResponse, true},
+		{gocql.ErrNoConnections, true},
+		{context.DeadlineExceeded, true},
+		{errors.New("something else"), true},
+		{requestError{errUnavailable}, true},
+		{requestError{errWriteTimeout}, true},
+		{requestError{0x1001}, true}, // overloaded
+		{requestError{errCredentials}, true},
+		{requestError{errUnauthorized}, true},
+		{requestError{errConfig}, true},
+		{requestError{errInvalid}, false},
+		{requestError{errSyntax}, false},
+	}
+	for _, c := range cases {
+		if got := Retryable(c.err); got != c.exp {
+			t.Errorf("error %v (%T): expected retryable %t, got %t", c.err, c.err, c.exp, got)
+		}
+	}
+}
+
+func TestMisconfigured(t *testing.T) {
+	cases := []struct {
+		err error
+		exp bool
+	}{
+		{requestError{errProtocol}, true},
+		{requestError{errCredentials}, true},
+		{requestError{errUnauthorized}, true},
+		{requestError{errConfig}, true},
+		{requestError{errInvalid}, false},
+		{requestError{errSyntax}, false},
+		{requestError{errUnavailable}, false},
+		{gocql.ErrNoConnections, false},
+		{errors.New("something else"), false},
+	}
+	for _, c := range cases {
+		if got := Misconfigured(c.err); got != c.exp {
+			t.Errorf("error %v (%T): expected misconfigured %t, got %t", c.err, c.err, c.exp, got)
+		}
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	if !Unavailable(requestError{errUnavailable}) {
+		t.Error("expected an unavailable error to be unavailable")
+	}
+	for _, err := range []error{requestError{errReadTimeout}, gocql.ErrNoConnections, errors.New("unavailable")} {
+		if Unavailable(err) {
+			t.Errorf("expected error %v (%T) not to be unavailable", err, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+	log "github.com/sirupsen/logrus"
+)
+
+// the table that tracks which migrations have been applied to which table of the keyspace
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS %s.schema_version (
+    table_name text,
+    version int,
+    description text,
+    applied timestamp,
+    PRIMARY KEY (table_name, version)
+)`
+
+// Migration is a versioned change to the schema of a table.
+// migrations must be idempotent: tables created from the schema file already have the latest schema,
+// tables created before migrations were tracked may or may not have had them applied by hand,
+// and a migration may be interrupted before it's recorded.
+type Migration struct {
+	Version     int
+	Description string
+	// Apply changes the given table. nil for migrations that only record a version, such as the initial schema
+	Apply func(session *gocql.Session, keyspace, table string) error
+}
+
+// Migrate applies the migrations that haven't been applied to the given table yet, in order of their version,
+// and records them in the schema_version table of the keyspace, which it creates if needed.
+func Migrate(session *gocql.Session, keyspace, table string, migrations []Migration) error {
+	err := session.Query(fmt.Sprintf(schemaVersionTable, keyspace)).Exec()
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %s", err)
+	}
+
+	applied := make(map[int]bool)
+	iter := session.Query(fmt.Sprintf("SELECT version FROM %s.schema_version WHERE table_name = ?", keyspace), table).Iter()
+	var version int
+	for iter.Scan(&version) {
+		applied[version] = true
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("failed to read schema versions of table %s: %s", table, err)
+	}
+
+	for _, m := range pendingMigrations(migrations, applied) {
+		log.Infof("cassandra: applying migration %d to table %s.%s: %s", m.Version, keyspace, table, m.Description)
+		if m.Apply != nil {
+			if err := m.Apply(session, keyspace, table); err != nil {
+				return fmt.Errorf("migration %d of table %s failed: %s", m.Version, table, err)
+			}
+		}
+		err := session.Query(fmt.Sprintf("INSERT INTO %s.schema_version (table_name, version, description, applied) VALUES (?, ?, ?, ?)", keyspace),
+			table, m.Version, m.Description, time.Now()).Exec()
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d of table %s: %s", m.Version, table, err)
+		}
+	}
+	return nil
+}
+
+// pendingMigrations returns the migrations that haven't been applied, in order of their version
+func pendingMigrations(migrations []Migration, applied map[int]bool) []Migration {
+	var pending []Migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Version < pending[j].Version
+	})
+	return pending
+}
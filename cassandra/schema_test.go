@@ -0,0 +1,32 @@
+package cassandra
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Description: "initial schema"},
+		{Version: 3, Description: "third"},
+		{Version: 2, Description: "second"},
+	}
+	cases := []struct {
+		applied map[int]bool
+		exp     []int
+	}{
+		{nil, []int{1, 2, 3}},
+		{map[int]bool{1: true}, []int{2, 3}},
+		{map[int]bool{1: true, 3: true}, []int{2}},
+		{map[int]bool{1: true, 2: true, 3: true}, nil},
+	}
+	for _, c := range cases {
+		var got []int
+		for _, m := range pendingMigrations(migrations, c.applied) {
+			got = append(got, m.Version)
+		}
+		if !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("applied %v: expected pending migrations %v, got %v", c.applied, c.exp, got)
+		}
+	}
+}
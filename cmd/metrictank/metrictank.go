@@ -24,19 +24,26 @@ import (
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/idx/bigtable"
 	"github.com/grafana/metrictank/idx/cassandra"
+	"github.com/grafana/metrictank/idx/catalog"
 	"github.com/grafana/metrictank/idx/memory"
 	"github.com/grafana/metrictank/input"
+	inAmqp "github.com/grafana/metrictank/input/amqp"
 	inCarbon "github.com/grafana/metrictank/input/carbon"
 	inKafkaMdm "github.com/grafana/metrictank/input/kafkamdm"
+	inMqtt "github.com/grafana/metrictank/input/mqtt"
 	inPrometheus "github.com/grafana/metrictank/input/prometheus"
+	inPubsub "github.com/grafana/metrictank/input/pubsub"
 	"github.com/grafana/metrictank/logger"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/mdata/notifierKafka"
+	"github.com/grafana/metrictank/mdata/wal"
 	"github.com/grafana/metrictank/stats"
 	statsConfig "github.com/grafana/metrictank/stats/config"
-	bigtableStore "github.com/grafana/metrictank/store/bigtable"
-	cassandraStore "github.com/grafana/metrictank/store/cassandra"
+	_ "github.com/grafana/metrictank/store/bigtable"
+	_ "github.com/grafana/metrictank/store/cassandra"
+	_ "github.com/grafana/metrictank/store/disk"
+	_ "github.com/grafana/metrictank/store/s3"
 	"github.com/raintank/dur"
 	log "github.com/sirupsen/logrus"
 )
@@ -60,8 +67,17 @@ var (
 	// Data:
 	dropFirstChunk    = flag.Bool("drop-first-chunk", false, "forego persisting of first received (and typically incomplete) chunk")
 	chunkMaxStaleStr  = flag.String("chunk-max-stale", "1h", "max age for a chunk before to be considered stale and to be persisted to Cassandra.")
+	metricShards      = flag.Int("metric-shards", 32, "number of shards of the in-memory store of metrics. metrics in different shards don't contend on the same lock")
 	metricMaxStaleStr = flag.String("metric-max-stale", "3h", "max age for a metric before to be considered stale and to be purged from memory.")
 	gcIntervalStr     = flag.String("gc-interval", "1h", "Interval to run garbage collection job.")
+	gcOffsetStr       = flag.String("gc-offset", "1min", "how long after each multiple of gc-interval to run the garbage collection job.")
+	gcConcurrency     = flag.Int("gc-concurrency", 1, "number of metric shards the garbage collection job scans concurrently.")
+	gcMaxSeries       = flag.Int("gc-max-series", 0, "max number of series the garbage collection job scans per run. the next run resumes where it stopped. 0 to disable")
+	gcMaxPoints       = flag.Int("gc-max-points", 0, "max number of points of stale chunks the garbage collection job closes per run. the next run resumes where it stopped. 0 to disable")
+	idleMaxAgeStr     = flag.String("idle-series-max-age", "0", "the garbage collection job removes the older raw chunks of series that have not been queried for this long from memory, once they are saved. queries for their data are served by the rollups and the store. 0 to disable")
+	idleChunks        = flag.Int("idle-series-raw-chunks", 1, "number of raw chunks to keep in memory for series that are idle as per idle-series-max-age")
+	orgSeriesLimit    = flag.Int("org-series-limit", 0, "max number of series each org may have in memory. points of new series beyond it are rejected. can be overridden per org via the admin api. 0 to disable")
+	memoryBudget      = flag.Uint64("memory-budget", 0, "max size of the heap in bytes. when exceeded, the metrics that were written to least recently are evicted from memory, after saving their unsaved chunks. 0 to disable")
 	warmUpPeriodStr   = flag.String("warm-up-period", "1h", "duration before secondary nodes start serving requests")
 	publicOrg         = flag.Int("public-org", 0, "org Id for publically (any org) accessible data. leave 0 to disable")
 
@@ -106,14 +122,19 @@ func main() {
 		os.Exit(1)
 	}
 	// load config for metric ingestors
+	input.ConfigSetup()
 	inCarbon.ConfigSetup()
 	inKafkaMdm.ConfigSetup()
 	inPrometheus.ConfigSetup()
+	inAmqp.ConfigSetup()
+	inPubsub.ConfigSetup()
+	inMqtt.ConfigSetup()
 
 	// load config for metricIndexers
 	memory.ConfigSetup()
 	cassandra.ConfigSetup()
 	bigtable.ConfigSetup()
+	catalog.ConfigSetup()
 
 	// load config for API
 	api.ConfigSetup()
@@ -127,11 +148,11 @@ func main() {
 	// storage-schemas, storage-aggregation files
 	mdata.ConfigSetup()
 
-	// cassandra Store
-	cassandraStore.ConfigSetup()
+	// write-ahead log
+	wal.ConfigSetup()
 
-	// bigtable store
-	bigtableStore.ConfigSetup()
+	// backend stores
+	mdata.ConfigSetupStores()
 
 	config.ParseAll()
 
@@ -175,19 +196,27 @@ func main() {
 	/***********************************
 		Validate remaining settings
 	***********************************/
+	input.ConfigProcess()
 	inCarbon.ConfigProcess()
 	inKafkaMdm.ConfigProcess(*instance)
 	memory.ConfigProcess()
 	inPrometheus.ConfigProcess()
+	inAmqp.ConfigProcess(*instance)
+	inPubsub.ConfigProcess()
+	inMqtt.ConfigProcess(*instance)
 	notifierKafka.ConfigProcess(*instance)
 	statsConfig.ConfigProcess(*instance)
 	mdata.ConfigProcess()
+	wal.ConfigProcess()
 	memory.ConfigProcess()
 	cassandra.ConfigProcess()
 	bigtable.ConfigProcess()
-	bigtableStore.ConfigProcess(mdata.MaxChunkSpan())
+	catalog.ConfigProcess()
+	if err := mdata.ConfigProcessStores(); err != nil {
+		log.Fatal(err)
+	}
 
-	if !inCarbon.Enabled && !inKafkaMdm.Enabled && !inPrometheus.Enabled {
+	if !inCarbon.Enabled && !inKafkaMdm.Enabled && !inPrometheus.Enabled && !inAmqp.Enabled && !inPubsub.Enabled && !inMqtt.Enabled {
 		log.Fatal("you should enable at least 1 input plugin")
 	}
 
@@ -197,6 +226,17 @@ func main() {
 	chunkMaxStale := dur.MustParseNDuration("chunk-max-stale", *chunkMaxStaleStr)
 	metricMaxStale := dur.MustParseNDuration("metric-max-stale", *metricMaxStaleStr)
 	gcInterval := time.Duration(dur.MustParseNDuration("gc-interval", *gcIntervalStr)) * time.Second
+	gcOffset := time.Duration(dur.MustParseDuration("gc-offset", *gcOffsetStr)) * time.Second
+	if *gcConcurrency < 1 {
+		log.Fatal("gc-concurrency must be at least 1")
+	}
+	idleMaxAge := dur.MustParseDuration("idle-series-max-age", *idleMaxAgeStr)
+	if *idleChunks < 1 {
+		log.Fatal("idle-series-raw-chunks must be at least 1")
+	}
+	if *metricShards < 1 {
+		log.Fatal("metric-shards must be at least 1")
+	}
 
 	proftrigFreq := dur.MustParseDuration("proftrigger-freq", *proftrigFreqStr)
 	proftrigMinDiff := int(dur.MustParseNDuration("proftrigger-min-diff", *proftrigMinDiffStr))
@@ -261,24 +301,9 @@ func main() {
 	/***********************************
 		Initialize our backendStore
 	***********************************/
-	if cassandraStore.CliConfig.Enabled && bigtableStore.CliConfig.Enabled {
-		log.Fatal("only 1 backend store plugin can be enabled at once.")
-	}
-	if !cassandraStore.CliConfig.Enabled && !bigtableStore.CliConfig.Enabled {
-		log.Fatal("at least 1 backend store plugin needs to be enabled.")
-	}
-	if bigtableStore.CliConfig.Enabled {
-		schemaMaxChunkSpan := mdata.MaxChunkSpan()
-		store, err = bigtableStore.NewStore(bigtableStore.CliConfig, mdata.TTLs(), schemaMaxChunkSpan)
-		if err != nil {
-			log.Fatalf("failed to initialize bigtable backend store. %s", err)
-		}
-	}
-	if cassandraStore.CliConfig.Enabled {
-		store, err = cassandraStore.NewCassandraStore(cassandraStore.CliConfig, mdata.TTLs())
-		if err != nil {
-			log.Fatalf("failed to initialize cassandra backend store. %s", err)
-		}
+	store, err = mdata.NewStore()
+	if err != nil {
+		log.Fatal(err)
 	}
 	store.SetTracer(tracer)
 
@@ -291,7 +316,27 @@ func main() {
 	/***********************************
 		Initialize our MemoryStore
 	***********************************/
-	metrics = mdata.NewAggMetrics(store, ccache, *dropFirstChunk, chunkMaxStale, metricMaxStale, gcInterval)
+	mdata.SetGCConfig(mdata.GCConfig{
+		Offset:      gcOffset,
+		Concurrency: *gcConcurrency,
+		MaxSeries:   *gcMaxSeries,
+		MaxPoints:   *gcMaxPoints,
+		IdleMaxAge:  idleMaxAge,
+		IdleChunks:  *idleChunks,
+	})
+	metrics = mdata.NewAggMetrics(store, ccache, *dropFirstChunk, *metricShards, chunkMaxStale, metricMaxStale, gcInterval)
+	preSnapshot := time.Now()
+	restored, err := metrics.LoadSnapshot()
+	if err != nil {
+		log.Fatalf("failed to load snapshot of in-memory chunks: %s", err.Error())
+	}
+	if restored > 0 {
+		log.Infof("restored %d series from snapshot in %s", restored, time.Now().Sub(preSnapshot))
+	}
+	metrics.SetSeriesLimit(*orgSeriesLimit)
+	if *memoryBudget > 0 {
+		metrics.EnforceMemoryBudget(*memoryBudget)
+	}
 
 	/***********************************
 		Initialize our Inputs
@@ -305,9 +350,26 @@ func main() {
 		inputs = append(inputs, inPrometheus.New())
 	}
 
+	if inAmqp.Enabled {
+		inputs = append(inputs, inAmqp.New())
+	}
+	if inPubsub.Enabled {
+		inputs = append(inputs, inPubsub.New())
+	}
+	if inMqtt.Enabled {
+		inputs = append(inputs, inMqtt.New())
+	}
+
 	if inKafkaMdm.Enabled {
 		sarama.Logger = l.New(os.Stdout, "[Sarama] ", l.LstdFlags)
-		inputs = append(inputs, inKafkaMdm.New())
+		kafkaMdm := inKafkaMdm.New()
+		kafkaMdm.TrackUnsaved(metrics.OldestUnsaved)
+		// if we resume consuming where the unsaved chunks start, the chunks that were saved since must not be saved again
+		if ts := kafkaMdm.ReplayStart(); ts > 0 {
+			mdata.SetReplayStart(ts)
+			notifierKafka.SetReplayStart(time.Unix(int64(ts), 0))
+		}
+		inputs = append(inputs, kafkaMdm)
 	}
 
 	if cluster.Mode == cluster.ModeMulti && len(inputs) > 1 {
@@ -362,11 +424,23 @@ func main() {
 	}
 
 	apiServer.BindMetricIndex(metricIndex)
+	if catalog.Enabled {
+		cat := catalog.New()
+		cat.Start()
+		apiServer.BindCatalog(cat)
+	}
 	apiServer.BindMemoryStore(metrics)
 	apiServer.BindBackendStore(store)
 	apiServer.BindCache(ccache)
 	apiServer.BindTracer(tracer)
 	apiServer.BindPromQueryEngine()
+	for _, plugin := range inputs {
+		if p, ok := plugin.(input.IngestPlugin); ok {
+			if path, handler, ok := p.IngestHandler(); ok {
+				apiServer.BindIngestHandler(path, handler)
+			}
+		}
+	}
 	cluster.Tracer = tracer
 	go apiServer.Run()
 
@@ -379,6 +453,31 @@ func main() {
 	}
 	log.Infof("metricIndex initialized in %s. starting data consumption", time.Now().Sub(pre))
 
+	/***********************************
+		Warm up the chunk cache
+	***********************************/
+	if mdata.WarmUpEnabled() && ccache != nil {
+		go func() {
+			pre := time.Now()
+			n := mdata.WarmUp(context.Background(), store, ccache, metricIndex)
+			log.Infof("cache warm-up loaded %d series in %s", n, time.Now().Sub(pre))
+		}()
+	}
+
+	/***********************************
+		Verify rollups in the background
+	***********************************/
+	if mdata.RollupVerifyEnabled() {
+		go metrics.VerifyRollups(context.Background())
+	}
+
+	/***********************************
+		Compact old chunks in the background
+	***********************************/
+	if mdata.ChunkCompactionEnabled() {
+		go metrics.CompactChunks(context.Background())
+	}
+
 	/***********************************
 		Initialize MetricPersist notifiers
 	***********************************/
@@ -391,6 +490,16 @@ func main() {
 
 	mdata.InitPersistNotifier(notifiers...)
 
+	/***********************************
+		Replay the write-ahead log
+	***********************************/
+	if wal.Enabled {
+		err = wal.Start(metrics, metricIndex)
+		if err != nil {
+			log.Fatalf("failed to start write-ahead log: %s", err.Error())
+		}
+	}
+
 	/***********************************
 		Start our inputs
 	***********************************/
@@ -399,6 +508,9 @@ func main() {
 		if carbonPlugin, ok := plugin.(*inCarbon.Carbon); ok {
 			carbonPlugin.IntervalGetter(inCarbon.NewIndexIntervalGetter(metricIndex))
 		}
+		if mqttPlugin, ok := plugin.(*inMqtt.Mqtt); ok {
+			mqttPlugin.IntervalGetter(inCarbon.NewIndexIntervalGetter(metricIndex))
+		}
 		err = plugin.Start(input.NewDefaultHandler(metrics, metricIndex, plugin.Name()), cancel)
 		if err != nil {
 			shutdown()
@@ -470,6 +582,16 @@ func shutdown() {
 		timer.Stop()
 	}
 
+	wal.Stop()
+
+	pre := time.Now()
+	saved, err := metrics.SaveSnapshot()
+	if err != nil {
+		log.Errorf("failed to save snapshot of in-memory chunks: %s", err.Error())
+	} else if saved > 0 {
+		log.Infof("saved %d series to snapshot in %s", saved, time.Now().Sub(pre))
+	}
+
 	log.Info("closing store")
 	store.Stop()
 	metricIndex.Stop()
@@ -16,6 +16,7 @@ var (
 	gitHash     = "(none)"
 	showVersion = flag.Bool("version", false, "print version string")
 	metric      = flag.String("metric", "", "specify a metric name to see which aggregation rule it matches")
+	org         = flag.Int("org", 1, "specify the org of the metric, for rules that only apply to some orgs")
 )
 
 func init() {
@@ -57,8 +58,8 @@ func main() {
 	}
 
 	if *metric != "" {
-		aggI, agg := aggs.Match(*metric)
-		fmt.Printf("metric %q gets aggI %d\n", *metric, aggI)
+		aggI, agg := aggs.Match(uint32(*org), *metric)
+		fmt.Printf("metric %q of org %d gets aggI %d\n", *metric, *org, aggI)
 		show(agg)
 		fmt.Println()
 		fmt.Println()
@@ -77,6 +78,7 @@ func main() {
 func show(agg conf.Aggregation) {
 	fmt.Println("#", agg.Name)
 	fmt.Printf("pattern:   %10s\n", agg.Pattern)
+	fmt.Printf("orgs:      %10s\n", agg.Orgs)
 	fmt.Printf("priority:  %10f\n", agg.XFilesFactor)
 	fmt.Printf("methods:\n")
 	for i, method := range agg.AggregationMethod {
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/store/cassandra"
+	"github.com/grafana/metrictank/store/s3"
+	"github.com/raintank/dur"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	orgId      int
+	startTs    int
+	endTs      int
+	numThreads int
+	idxTable   string
+	verbose    bool
+
+	doneDefs      uint64
+	doneChunks    uint64
+	skippedChunks uint64
+	failedChunks  uint64
+)
+
+func init() {
+	formatter := &logger.TextFormatter{}
+	formatter.TimestampFormat = "2006-01-02 15:04:05.000"
+	log.SetFormatter(formatter)
+	log.SetLevel(log.InfoLevel)
+}
+
+func main() {
+	cfg := cassandra.CliConfig
+	flag.StringVar(&cfg.Addrs, "cassandra-addrs", cfg.Addrs, "cassandra host (may be given multiple times as comma-separated list)")
+	flag.StringVar(&cfg.Keyspace, "cassandra-keyspace", cfg.Keyspace, "cassandra keyspace to use for storing the metric data table")
+	flag.StringVar(&cfg.Consistency, "cassandra-consistency", cfg.Consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	flag.StringVar(&cfg.HostSelectionPolicy, "host-selection-policy", cfg.HostSelectionPolicy, "")
+	flag.StringVar(&cfg.LocalDC, "cassandra-local-dc", cfg.LocalDC, "datacenter of this node, for the dcaware host selection policies")
+	flag.StringVar(&cfg.Timeout, "cassandra-timeout", cfg.Timeout, "cassandra timeout")
+	flag.IntVar(&cfg.WriteConcurrency, "cassandra-concurrency", 20, "number of concurrent connections to cassandra.")
+	flag.IntVar(&cfg.Retries, "cassandra-retries", cfg.Retries, "how many times to retry a query before failing it")
+	flag.IntVar(&cfg.WindowFactor, "window-factor", cfg.WindowFactor, "size of compaction window relative to TTL")
+	flag.IntVar(&cfg.CqlProtocolVersion, "cql-protocol-version", cfg.CqlProtocolVersion, "cql protocol version to use")
+	flag.BoolVar(&cfg.CreateKeyspace, "create-keyspace", cfg.CreateKeyspace, "enable the creation of the keyspace and tables")
+	flag.BoolVar(&cfg.SSL, "cassandra-ssl", cfg.SSL, "enable SSL connection to cassandra")
+	flag.StringVar(&cfg.CaPath, "cassandra-ca-path", cfg.CaPath, "cassandra CA certificate path when using SSL")
+	flag.StringVar(&cfg.CertPath, "cassandra-cert-path", cfg.CertPath, "client certificate path when using SSL. empty to not use a client certificate")
+	flag.StringVar(&cfg.KeyPath, "cassandra-key-path", cfg.KeyPath, "client certificate key path when using SSL")
+	flag.BoolVar(&cfg.HostVerification, "cassandra-host-verification", cfg.HostVerification, "host (hostname and server cert) verification when using SSL")
+	flag.BoolVar(&cfg.Auth, "cassandra-auth", cfg.Auth, "enable cassandra authentication")
+	flag.StringVar(&cfg.Username, "cassandra-username", cfg.Username, "username for authentication")
+	flag.StringVar(&cfg.Password, "cassandra-password", cfg.Password, "password for authentication")
+	flag.StringVar(&cfg.SchemaFile, "schema-file", cfg.SchemaFile, "File containing the needed schemas in case database needs initializing")
+	flag.BoolVar(&cfg.DisableInitialHostLookup, "cassandra-disable-initial-host-lookup", cfg.DisableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
+
+	cfg.ReadConcurrency = 0
+	cfg.ReadQueueSize = 0
+	cfg.WriteQueueSize = 0
+
+	s3Cfg := s3.NewStoreConfig()
+	s3Cfg.Prefix = "backup/"
+	s3Cfg.WriteConcurrency = 1
+	flag.StringVar(&s3Cfg.Endpoint, "s3-endpoint", s3Cfg.Endpoint, "url of the S3 compatible api")
+	flag.StringVar(&s3Cfg.Bucket, "s3-bucket", s3Cfg.Bucket, "bucket to save the backup in")
+	flag.StringVar(&s3Cfg.Region, "s3-region", s3Cfg.Region, "region of the bucket")
+	flag.StringVar(&s3Cfg.Prefix, "s3-prefix", s3Cfg.Prefix, "prefix of the keys of the objects of the backup")
+	flag.BoolVar(&s3Cfg.PathStyle, "s3-path-style", s3Cfg.PathStyle, "address the bucket in the path of the urls rather than in the host name, as needed by some S3 compatible stores")
+	flag.StringVar(&s3Cfg.AccessKey, "s3-access-key", s3Cfg.AccessKey, "access key. leave empty for anonymous access")
+	flag.StringVar(&s3Cfg.SecretKey, "s3-secret-key", s3Cfg.SecretKey, "secret key")
+	flag.DurationVar(&s3Cfg.Timeout, "s3-timeout", s3Cfg.Timeout, "timeout of requests to S3")
+
+	flag.IntVar(&orgId, "org-id", 0, "only back up or restore the data of this org. 0 for all orgs")
+	flag.IntVar(&startTs, "start-timestamp", 0, "only back up or restore chunks that start at or after this timestamp, and index entries updated after it")
+	flag.IntVar(&endTs, "end-timestamp", math.MaxInt32, "only back up or restore chunks that start before this timestamp")
+	flag.IntVar(&numThreads, "threads", 10, "number of workers to use to process data")
+	flag.StringVar(&idxTable, "idx-table", "metric_idx", "idx table in cassandra")
+	flag.BoolVar(&verbose, "verbose", false, "show every chunk being processed")
+
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "mt-backup [flags] backup|restore ttl [ttl...]")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Backs up the chunks with the given ttls and the index entries in Cassandra to S3 compatible object storage, or restores them.")
+		fmt.Fprintln(os.Stderr, "Chunks are saved like the s3 store saves them, under <s3-prefix><ttl>/<archive key>/<t0>, and index entries under <s3-prefix>index/<org>/<id>.")
+		fmt.Fprintln(os.Stderr, "backup only uploads the chunks that are not in the backup yet, so it can be run periodically to update the backup, and resumed by running it again.")
+		fmt.Fprintln(os.Stderr, "restore saves the chunks with the remaining ttl of their data, counting from the end of each chunk. chunks that have expired are skipped.")
+		fmt.Fprintln(os.Stderr, "Unless you disable create-keyspace, tables are created as needed")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+		os.Exit(-1)
+	}
+	flag.Parse()
+
+	stats.NewDevnull() // make sure metrics don't pile up without getting discarded
+
+	if flag.NArg() < 2 || (flag.Arg(0) != "backup" && flag.Arg(0) != "restore") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var ttls []uint32
+	for _, arg := range flag.Args()[1:] {
+		ttls = append(ttls, dur.MustParseNDuration("ttl", arg))
+	}
+
+	store, err := cassandra.NewCassandraStore(cfg, ttls)
+	if err != nil {
+		log.Fatalf("Failed to instantiate cassandra: %s", err)
+	}
+	bak, err := s3.NewStore(s3Cfg, 0)
+	if err != nil {
+		log.Fatalf("Failed to instantiate s3: %s", err)
+	}
+
+	ctx := context.Background()
+	pre := time.Now()
+	if flag.Arg(0) == "backup" {
+		backupIndex(ctx, store, bak)
+		for _, ttl := range ttls {
+			backupChunks(ctx, store, bak, ttl)
+		}
+	} else {
+		restoreIndex(ctx, store, bak)
+		for _, ttl := range ttls {
+			restoreChunks(ctx, store, bak, ttl)
+		}
+	}
+	log.Infof("DONE. %s %d index entries and %d chunks in %s. skipped %d chunks, %d chunks failed", flag.Arg(0), doneDefs, doneChunks, time.Since(pre), skippedChunks, failedChunks)
+	if failedChunks > 0 {
+		os.Exit(2)
+	}
+}
+
+// chunkRange returns the range of t0's within the given range that should be processed
+func chunkRange(start, end uint32) (uint32, uint32) {
+	if uint32(startTs) > start {
+		start = uint32(startTs)
+	}
+	if uint32(endTs) < end {
+		end = uint32(endTs)
+	}
+	return start, end
+}
+
+// parseRowKey returns the archive and the month number of the row key of a chunk table.
+// row keys look like <org>.<id>_[rolluptype_rollupspan_]<epoch_month>
+func parseRowKey(rowKey string) (schema.AMKey, uint32, error) {
+	i := strings.LastIndex(rowKey, "_")
+	if i < 0 {
+		return schema.AMKey{}, 0, fmt.Errorf("invalid row key %q", rowKey)
+	}
+	month, err := strconv.ParseUint(rowKey[i+1:], 10, 32)
+	if err != nil {
+		// e.g. the row keys of the copies in the dual write format
+		return schema.AMKey{}, 0, fmt.Errorf("invalid row key %q", rowKey)
+	}
+	key, err := schema.AMKeyFromString(rowKey[:i])
+	return key, uint32(month), err
+}
+
+func backupIndex(ctx context.Context, store *cassandra.CassandraStore, bak *s3.Store) {
+	iter := store.Session.Query(fmt.Sprintf("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate FROM %s", idxTable)).Iter()
+	var id, name, unit, mtype string
+	var org, interval int
+	var partition int32
+	var lastupdate int64
+	var tags []string
+	for iter.Scan(&id, &org, &partition, &name, &interval, &unit, &mtype, &tags, &lastupdate) {
+		if (orgId != 0 && org != orgId) || lastupdate < int64(startTs) {
+			continue
+		}
+		mkey, err := schema.MKeyFromString(id)
+		if err != nil {
+			log.Errorf("could not parse ID %q: %s -> skipping", id, err)
+			continue
+		}
+		def := schema.MetricDefinition{
+			Id:         mkey,
+			OrgId:      uint32(org),
+			Partition:  partition,
+			Name:       name,
+			Interval:   interval,
+			Unit:       unit,
+			Mtype:      mtype,
+			Tags:       tags,
+			LastUpdate: lastupdate,
+		}
+		buf, err := def.MarshalMsg(nil)
+		if err == nil {
+			err = bak.PutObject(ctx, fmt.Sprintf("index/%d/%s", def.OrgId, def.Id), buf)
+		}
+		if err != nil {
+			log.Fatalf("failed to back up index entry %s: %s", def.Id, err)
+		}
+		doneDefs++
+	}
+	if err := iter.Close(); err != nil {
+		log.Fatalf("failed querying %s: %s", idxTable, err)
+	}
+	log.Infof("backed up %d index entries", doneDefs)
+}
+
+func restoreIndex(ctx context.Context, store *cassandra.CassandraStore, bak *s3.Store) {
+	prefix := "index/"
+	if orgId != 0 {
+		prefix = fmt.Sprintf("index/%d/", orgId)
+	}
+	var names []string
+	err := bak.ListObjects(ctx, prefix, func(name string) bool {
+		names = append(names, name)
+		return true
+	})
+	if err != nil {
+		log.Fatalf("failed to list the index entries in the backup: %s", err)
+	}
+	qry := fmt.Sprintf("INSERT INTO %s (id, orgid, partition, name, interval, unit, mtype, tags, lastupdate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", idxTable)
+	for _, name := range names {
+		buf, err := bak.GetObject(ctx, name)
+		if err != nil {
+			log.Fatalf("failed to read index entry %s: %s", name, err)
+		}
+		var def schema.MetricDefinition
+		if _, err := def.UnmarshalMsg(buf); err != nil {
+			log.Errorf("could not decode index entry %s: %s -> skipping", name, err)
+			continue
+		}
+		if def.LastUpdate < int64(startTs) {
+			continue
+		}
+		err = store.Session.Query(qry, def.Id.String(), def.OrgId, def.Partition, def.Name, def.Interval, def.Unit, def.Mtype, def.Tags, def.LastUpdate).Exec()
+		if err != nil {
+			log.Fatalf("failed to restore index entry %s: %s", def.Id, err)
+		}
+		doneDefs++
+	}
+	log.Infof("restored %d index entries", doneDefs)
+}
+
+// backupChunks uploads the chunks of the table of the ttl that are not in the backup yet
+func backupChunks(ctx context.Context, store *cassandra.CassandraStore, bak *s3.Store, ttl uint32) {
+	table := store.TTLTables[ttl].Name
+	jobs := make(chan string, 100)
+	var wg sync.WaitGroup
+	wg.Add(numThreads)
+	for i := 0; i < numThreads; i++ {
+		go func() {
+			defer wg.Done()
+			for rowKey := range jobs {
+				backupRow(ctx, store, bak, ttl, table, rowKey)
+			}
+		}()
+	}
+
+	keyItr := store.Session.Query(fmt.Sprintf("SELECT distinct key FROM %s", table)).Iter()
+	var rowKey string
+	for keyItr.Scan(&rowKey) {
+		jobs <- rowKey
+	}
+	close(jobs)
+	err := keyItr.Close()
+	wg.Wait()
+	if err != nil {
+		log.Fatalf("failed querying %s: %s. uploaded %d chunks", table, err, atomic.LoadUint64(&doneChunks))
+	}
+	log.Infof("backed up the chunks of table %s. uploaded %d chunks so far", table, atomic.LoadUint64(&doneChunks))
+}
+
+func backupRow(ctx context.Context, store *cassandra.CassandraStore, bak *s3.Store, ttl uint32, table, rowKey string) {
+	key, month, err := parseRowKey(rowKey)
+	if err != nil {
+		if verbose {
+			log.Infof("skipping row %s: %s", rowKey, err)
+		}
+		return
+	}
+	if orgId != 0 && key.MKey.Org != uint32(orgId) {
+		return
+	}
+	start, end := chunkRange(month*cassandra.Month_sec, (month+1)*cassandra.Month_sec)
+	if start >= end {
+		return
+	}
+	existing := make(map[uint32]struct{})
+	t0s, err := bak.ChunkT0s(ctx, key, ttl, start, end)
+	if err != nil {
+		log.Errorf("failed to list the chunks of %s in the backup: %s", key, err)
+		atomic.AddUint64(&failedChunks, 1)
+		return
+	}
+	for _, t0 := range t0s {
+		existing[t0] = struct{}{}
+	}
+
+	iter := store.Session.Query(fmt.Sprintf("SELECT ts, data FROM %s WHERE key = ? AND ts >= ? AND ts < ?", table), rowKey, start, end).Iter()
+	var ts int
+	var data []byte
+	for iter.Scan(&ts, &data) {
+		if _, ok := existing[uint32(ts)]; ok {
+			atomic.AddUint64(&skippedChunks, 1)
+			continue
+		}
+		if verbose {
+			log.Infof("uploading chunk %s:%d with ttl %d", key, ts, ttl)
+		}
+		if err := bak.PutChunk(ctx, key, ttl, uint32(ts), data); err != nil {
+			log.Errorf("failed to upload chunk %s:%d: %s", key, ts, err)
+			atomic.AddUint64(&failedChunks, 1)
+			continue
+		}
+		atomic.AddUint64(&doneChunks, 1)
+	}
+	if err := iter.Close(); err != nil {
+		log.Errorf("failed querying %s for row %s: %s", table, rowKey, err)
+		atomic.AddUint64(&failedChunks, 1)
+	}
+}
+
+type restoreJob struct {
+	key schema.AMKey
+	t0  uint32
+}
+
+// restoreChunks saves the chunks in the backup with the ttl in the table of the ttl
+func restoreChunks(ctx context.Context, store *cassandra.CassandraStore, bak *s3.Store, ttl uint32) {
+	table := store.TTLTables[ttl]
+	jobs := make(chan restoreJob, 100)
+	var wg sync.WaitGroup
+	wg.Add(numThreads)
+	for i := 0; i < numThreads; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				restoreChunk(ctx, store, bak, ttl, table, job)
+			}
+		}()
+	}
+
+	err := bak.Chunks(ctx, ttl, func(key schema.AMKey, t0 uint32) bool {
+		if orgId != 0 && key.MKey.Org != uint32(orgId) {
+			return true
+		}
+		if start, end := chunkRange(t0, t0+1); start >= end {
+			return true
+		}
+		jobs <- restoreJob{key, t0}
+		return true
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		log.Fatalf("failed to list the chunks with ttl %d in the backup: %s. restored %d chunks", ttl, err, atomic.LoadUint64(&doneChunks))
+	}
+	log.Infof("restored the chunks of table %s. restored %d chunks so far", table.Name, atomic.LoadUint64(&doneChunks))
+}
+
+func restoreChunk(ctx context.Context, store *cassandra.CassandraStore, bak *s3.Store, ttl uint32, table cassandra.Table, job restoreJob) {
+	itgen, err := bak.GetChunk(ctx, job.key, ttl, job.t0)
+	if err != nil {
+		log.Errorf("failed to read chunk %s:%d from the backup: %s", job.key, job.t0, err)
+		atomic.AddUint64(&failedChunks, 1)
+		return
+	}
+	// the ttl counts from the end of the chunk, like it did when the chunk was saved
+	now := uint32(time.Now().Unix())
+	end := job.t0 + itgen.Span()
+	if end+ttl <= now {
+		atomic.AddUint64(&skippedChunks, 1)
+		return
+	}
+	if verbose {
+		log.Infof("restoring chunk %s:%d with ttl %d", job.key, job.t0, end+ttl-now)
+	}
+	rowKey := fmt.Sprintf("%s_%d", job.key, job.t0/cassandra.Month_sec)
+	err = store.Session.Query(table.QueryWrite, rowKey, job.t0, itgen.B, end+ttl-now).Exec()
+	if err != nil {
+		log.Errorf("failed to restore chunk %s:%d: %s", job.key, job.t0, err)
+		atomic.AddUint64(&failedChunks, 1)
+		return
+	}
+	atomic.AddUint64(&doneChunks, 1)
+}
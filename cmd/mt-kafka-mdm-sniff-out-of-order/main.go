@@ -69,17 +69,17 @@ func newInputOOOFinder(format string) *inputOOOFinder {
 	}
 }
 
-func (ip *inputOOOFinder) ProcessMetricData(metric *schema.MetricData, partition int32) {
+func (ip *inputOOOFinder) ProcessMetricData(metric *schema.MetricData, partition int32) error {
 	if *prefix != "" && !strings.HasPrefix(metric.Name, *prefix) {
-		return
+		return nil
 	}
 	if *substr != "" && !strings.Contains(metric.Name, *substr) {
-		return
+		return nil
 	}
 	mkey, err := schema.MKeyFromString(metric.Id)
 	if err != nil {
 		log.Errorf("could not parse id %q: %s", metric.Id, err.Error())
-		return
+		return nil
 	}
 
 	now := Msg{
@@ -112,9 +112,10 @@ func (ip *inputOOOFinder) ProcessMetricData(metric *schema.MetricData, partition
 		}
 	}
 	ip.lock.Unlock()
+	return nil
 }
 
-func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.Format, partition int32) {
+func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.Format, partition int32) error {
 	now := Msg{
 		Part: partition,
 		Seen: time.Now(),
@@ -124,7 +125,7 @@ func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.F
 	tracker, ok := ip.data[mp.MKey]
 	if !ok {
 		if !*doUnknownMP {
-			return
+			return nil
 		}
 		ip.data[mp.MKey] = Tracker{
 			Head: now,
@@ -148,6 +149,7 @@ func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.F
 		}
 	}
 	ip.lock.Unlock()
+	return nil
 }
 
 func main() {
@@ -73,17 +73,17 @@ func newInputPrinter(formatMd, formatP string) inputPrinter {
 	}
 }
 
-func (ip inputPrinter) ProcessMetricData(metric *schema.MetricData, partition int32) {
+func (ip inputPrinter) ProcessMetricData(metric *schema.MetricData, partition int32) error {
 	if *prefix != "" && !strings.HasPrefix(metric.Name, *prefix) {
-		return
+		return nil
 	}
 	if *substr != "" && !strings.Contains(metric.Name, *substr) {
-		return
+		return nil
 	}
 	if *invalid {
 		err := metric.Validate()
 		if err == nil && metric.Time != 0 {
-			return
+			return nil
 		}
 	}
 	stdoutLock.Lock()
@@ -96,12 +96,13 @@ func (ip inputPrinter) ProcessMetricData(metric *schema.MetricData, partition in
 	if err != nil {
 		log.Errorf("executing template: %s", err.Error())
 	}
+	return nil
 }
 
-func (ip inputPrinter) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) {
+func (ip inputPrinter) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
 
 	if *invalid && point.Valid() {
-		return
+		return nil
 	}
 
 	stdoutLock.Lock()
@@ -113,6 +114,7 @@ func (ip inputPrinter) ProcessMetricPoint(point schema.MetricPoint, format msg.F
 	if err != nil {
 		log.Errorf("executing template: %s", err.Error())
 	}
+	return nil
 }
 
 func main() {
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 
 	"github.com/grafana/metrictank/mdata"
@@ -20,19 +19,12 @@ func (dn PrintNotifierHandler) PartitionOf(key schema.MKey) (int32, bool) {
 }
 
 func (dn PrintNotifierHandler) Handle(data []byte) {
-	version := uint8(data[0])
-	if version == uint8(mdata.PersistMessageBatchV1) {
-		batch := mdata.PersistMessageBatch{}
-		err := json.Unmarshal(data[1:], &batch)
-		if err != nil {
-			log.Errorf("failed to unmarsh batch message: %s -- skipping", err)
-			return
-		}
-		for _, c := range batch.SavedChunks {
-			fmt.Printf("%s %d %s\n", batch.Instance, c.T0, c.Key)
-		}
-	} else {
-		log.Errorf("unknown message version %d", version)
+	batch, err := mdata.DecodePersistMessageBatch(data)
+	if err != nil {
+		log.Errorf("failed to decode batch message: %s -- skipping", err)
+		return
+	}
+	for _, c := range batch.SavedChunks {
+		fmt.Printf("%s %d %s\n", batch.Instance, c.T0, c.Key)
 	}
-	return
 }
@@ -19,6 +19,7 @@ var (
 	windowFactor = flag.Int("window-factor", 20, "size of compaction window relative to TTL")
 	metric       = flag.String("metric", "", "specify a metric name to see which schema it matches")
 	interval     = flag.Int("int", 0, "specify an interval to apply interval-based matching in addition to metric matching (e.g. to simulate kafka-mdm input)")
+	org          = flag.Int("org", 1, "specify the org of the metric, for rules that only apply to some orgs")
 )
 
 func init() {
@@ -60,8 +61,8 @@ func main() {
 	}
 
 	if *metric != "" {
-		schemaI, s := schemas.Match(*metric, *interval)
-		fmt.Printf("metric %q with interval %d gets schemaI %d\n", *metric, *interval, schemaI)
+		schemaI, s := schemas.Match(uint32(*org), *metric, *interval)
+		fmt.Printf("metric %q of org %d with interval %d gets schemaI %d\n", *metric, *org, *interval, schemaI)
 		fmt.Printf("## [%q] pattern=%q prio=%d retentions=%v\n", s.Name, s.Pattern, s.Priority, s.Retentions)
 		fmt.Println()
 	}
@@ -77,6 +78,7 @@ func main() {
 func display(schema conf.Schema) {
 	fmt.Println("#", schema.Name)
 	fmt.Printf("pattern:   %10s\n", schema.Pattern)
+	fmt.Printf("orgs:      %10s\n", schema.Orgs)
 	fmt.Printf("priority:  %10d\n", schema.Priority)
 	fmt.Printf("retentions:%10s %10s %10s %10s %10s %15s %10s\n", "interval", "retention", "chunkspan", "numchunks", "ready", "tablename", "windowsize")
 	for _, ret := range schema.Retentions {
@@ -12,9 +12,9 @@ import (
 	"time"
 
 	"github.com/gocql/gocql"
+	cass "github.com/grafana/metrictank/cassandra"
 	"github.com/grafana/metrictank/logger"
 	"github.com/grafana/metrictank/store/cassandra"
-	hostpool "github.com/hailocab/go-hostpool"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -27,6 +27,7 @@ var (
 	cassandraKeyspace            = flag.String("cassandra-keyspace", "metrictank", "cassandra keyspace to use for storing the metric data table")
 	cassandraConsistency         = flag.String("cassandra-consistency", "one", "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
 	cassandraHostSelectionPolicy = flag.String("cassandra-host-selection-policy", "tokenaware,hostpool-epsilon-greedy", "")
+	cassandraLocalDC             = flag.String("cassandra-local-dc", "", "datacenter of this node, for the dcaware host selection policies")
 	cassandraTimeout             = flag.String("cassandra-timeout", "1s", "cassandra timeout")
 	cassandraConcurrency         = flag.Int("cassandra-concurrency", 20, "max number of concurrent reads to cassandra.")
 	cassandraRetries             = flag.Int("cassandra-retries", 0, "how many times to retry a query before failing it")
@@ -35,6 +36,8 @@ var (
 
 	cassandraSSL              = flag.Bool("cassandra-ssl", false, "enable SSL connection to cassandra")
 	cassandraCaPath           = flag.String("cassandra-ca-path", "/etc/metrictank/ca.pem", "cassandra CA certificate path when using SSL")
+	cassandraCertPath         = flag.String("cassandra-cert-path", "", "client certificate path when using SSL. empty to not use a client certificate")
+	cassandraKeyPath          = flag.String("cassandra-key-path", "", "client certificate key path when using SSL")
 	cassandraHostVerification = flag.Bool("cassandra-host-verification", true, "host (hostname and server cert) verification when using SSL")
 
 	cassandraAuth     = flag.Bool("cassandra-auth", false, "enable cassandra authentication")
@@ -114,10 +117,11 @@ func main() {
 
 func NewCassandraStore(cassandraAddrs *string) (*gocql.Session, error) {
 	cluster := gocql.NewCluster(strings.Split(*cassandraAddrs, ",")...)
+	var err error
 	if *cassandraSSL {
-		cluster.SslOpts = &gocql.SslOptions{
-			CaPath:                 *cassandraCaPath,
-			EnableHostVerification: *cassandraHostVerification,
+		cluster.SslOpts, err = cass.SslOptions(*cassandraCaPath, *cassandraCertPath, *cassandraKeyPath, *cassandraHostVerification)
+		if err != nil {
+			return nil, err
 		}
 	}
 	if *cassandraAuth {
@@ -134,31 +138,9 @@ func NewCassandraStore(cassandraAddrs *string) (*gocql.Session, error) {
 	cluster.Keyspace = *cassandraKeyspace
 	cluster.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: *cassandraRetries}
 
-	switch *cassandraHostSelectionPolicy {
-	case "roundrobin":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.RoundRobinHostPolicy()
-	case "hostpool-simple":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.HostPoolHostPolicy(hostpool.New(nil))
-	case "hostpool-epsilon-greedy":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.HostPoolHostPolicy(
-			hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
-		)
-	case "tokenaware,roundrobin":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
-			gocql.RoundRobinHostPolicy(),
-		)
-	case "tokenaware,hostpool-simple":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
-			gocql.HostPoolHostPolicy(hostpool.New(nil)),
-		)
-	case "tokenaware,hostpool-epsilon-greedy":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
-			gocql.HostPoolHostPolicy(
-				hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
-			),
-		)
-	default:
-		return nil, fmt.Errorf("unknown HostSelectionPolicy '%q'", *cassandraHostSelectionPolicy)
+	cluster.PoolConfig.HostSelectionPolicy, err = cass.HostSelectionPolicy(*cassandraHostSelectionPolicy, *cassandraLocalDC)
+	if err != nil {
+		return nil, err
 	}
 
 	return cluster.CreateSession()
@@ -293,7 +293,7 @@ func getMetric(w *whisper.Whisper, file, name string) (archive.Metric, error) {
 		OrgId:    *orgId,
 	}
 	md.SetId()
-	_, schem := schemas.Match(md.Name, int(w.Header.Archives[0].SecondsPerPoint))
+	_, schem := schemas.Match(uint32(md.OrgId), md.Name, int(w.Header.Archives[0].SecondsPerPoint))
 
 	points := make(map[int][]whisper.Point)
 	for i := range w.Header.Archives {
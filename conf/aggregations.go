@@ -2,6 +2,7 @@ package conf
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,6 +19,7 @@ type Aggregations struct {
 type Aggregation struct {
 	Name              string
 	Pattern           *regexp.Regexp
+	Orgs              Orgs // the orgs the rule applies to. empty means all orgs
 	XFilesFactor      float64
 	AggregationMethod []Method
 }
@@ -61,6 +63,11 @@ func ReadAggregations(file string) (Aggregations, error) {
 			return Aggregations{}, fmt.Errorf("[%s]: failed to parse pattern %q: %s", item.Name, s.ValueOf("pattern"), err.Error())
 		}
 
+		item.Orgs, err = ParseOrgs(s.ValueOf("orgs"))
+		if err != nil {
+			return Aggregations{}, fmt.Errorf("[%s]: failed to parse orgs %q: %s", item.Name, s.ValueOf("orgs"), err.Error())
+		}
+
 		item.XFilesFactor, err = strconv.ParseFloat(s.ValueOf("xFilesFactor"), 64)
 		if err != nil {
 			return Aggregations{}, fmt.Errorf("[%s]: failed to parse xFilesFactor %q: %s", item.Name, s.ValueOf("xFilesFactor"), err.Error())
@@ -91,12 +98,12 @@ func ReadAggregations(file string) (Aggregations, error) {
 	return result, nil
 }
 
-// Match returns the correct aggregation setting for the given metric
+// Match returns the correct aggregation setting for the given metric of the given org
 // it can always find a valid setting, because there's a default catch all
 // also returns the index of the setting, to efficiently reference it
-func (a Aggregations) Match(metric string) (uint16, Aggregation) {
+func (a Aggregations) Match(org uint32, metric string) (uint16, Aggregation) {
 	for i, s := range a.Data {
-		if s.Pattern.MatchString(metric) {
+		if s.Orgs.Match(org) && s.Pattern.MatchString(metric) {
 			return uint16(i), s
 		}
 	}
@@ -110,3 +117,26 @@ func (a Aggregations) Get(i uint16) Aggregation {
 	}
 	return a.Data[i]
 }
+
+// CheckReload returns an error if next can't replace a at runtime.
+// series reference their aggregation by its position, and their rollups are created
+// with the aggregation methods, so only the xFilesFactor may change.
+func (a Aggregations) CheckReload(next Aggregations) error {
+	if len(a.Data) != len(next.Data) {
+		return fmt.Errorf("the number of rules changed from %d to %d", len(a.Data), len(next.Data))
+	}
+	cur := append(append([]Aggregation{}, a.Data...), a.DefaultAggregation)
+	nxt := append(append([]Aggregation{}, next.Data...), next.DefaultAggregation)
+	for i := range cur {
+		if cur[i].Name != nxt[i].Name || cur[i].Pattern.String() != nxt[i].Pattern.String() {
+			return fmt.Errorf("rule [%s] with pattern %q was replaced by [%s] with pattern %q", cur[i].Name, cur[i].Pattern, nxt[i].Name, nxt[i].Pattern)
+		}
+		if cur[i].Orgs.String() != nxt[i].Orgs.String() {
+			return fmt.Errorf("[%s]: the orgs changed from %s to %s", cur[i].Name, cur[i].Orgs, nxt[i].Orgs)
+		}
+		if !reflect.DeepEqual(cur[i].AggregationMethod, nxt[i].AggregationMethod) {
+			return fmt.Errorf("[%s]: the aggregation methods changed", cur[i].Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package conf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Orgs restricts a storage-schemas or storage-aggregation rule to the series of the given orgs.
+// empty means the rule applies to all orgs.
+type Orgs []uint32
+
+// ParseOrgs parses the orgs setting of a rule: a comma separated list of org ids
+func ParseOrgs(s string) (Orgs, error) {
+	var orgs Orgs
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		org, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org id %q", str)
+		}
+		orgs = append(orgs, uint32(org))
+	}
+	return orgs, nil
+}
+
+// Match returns whether the rule applies to the series of the given org
+func (o Orgs) Match(org uint32) bool {
+	if len(o) == 0 {
+		return true
+	}
+	for _, id := range o {
+		if id == org {
+			return true
+		}
+	}
+	return false
+}
+
+func (o Orgs) String() string {
+	if len(o) == 0 {
+		return "all"
+	}
+	strs := make([]string, len(o))
+	for i, id := range o {
+		strs[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(strs, ",")
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/alyu/configparser"
 	"github.com/grafana/metrictank/util"
+	"github.com/raintank/dur"
 )
 
 // Schemas contains schema settings
@@ -28,9 +29,54 @@ func (s SchemaSlice) Less(i, j int) bool { return s[i].Priority >= s[j].Priority
 type Schema struct {
 	Name          string
 	Pattern       *regexp.Regexp
+	Orgs          Orgs // the orgs the rule applies to. empty means all orgs
 	Retentions    Retentions
 	Priority      int64
 	ReorderWindow uint32
+	Float32       bool // store values with float32 precision, which compresses better
+	DupPolicy     DupPolicy
+	RollupOnly    bool // the raw data only feeds the rollups: it is not saved, nor read from
+}
+
+// DupPolicy is what to do with a point that has the same timestamp as the last point of its series
+type DupPolicy uint8
+
+const (
+	// DupDefault keeps the last point within the reorder buffer, and the first one otherwise
+	DupDefault DupPolicy = iota
+	DupKeepFirst
+	DupKeepLast
+	DupKeepMax
+	DupSum
+)
+
+// ParseDupPolicy parses the duplicatePolicy setting of a storage schema
+func ParseDupPolicy(s string) (DupPolicy, error) {
+	switch s {
+	case "keep-first":
+		return DupKeepFirst, nil
+	case "keep-last":
+		return DupKeepLast, nil
+	case "keep-max":
+		return DupKeepMax, nil
+	case "sum":
+		return DupSum, nil
+	}
+	return DupDefault, fmt.Errorf("unknown duplicate policy %q, expected keep-first, keep-last, keep-max or sum", s)
+}
+
+func (p DupPolicy) String() string {
+	switch p {
+	case DupKeepFirst:
+		return "keep-first"
+	case DupKeepLast:
+		return "keep-last"
+	case DupKeepMax:
+		return "keep-max"
+	case DupSum:
+		return "sum"
+	}
+	return "default"
 }
 
 func NewSchemas(schemas []Schema) Schemas {
@@ -57,9 +103,14 @@ func (s *Schemas) BuildIndex() {
 			s.index = append(s.index, Schema{
 				Name:          schema.Name,
 				Pattern:       schema.Pattern,
+				Orgs:          schema.Orgs,
 				Retentions:    schema.Retentions[pos:],
 				Priority:      schema.Priority,
 				ReorderWindow: schema.ReorderWindow,
+				Float32:       schema.Float32,
+				DupPolicy:     schema.DupPolicy,
+				// series with a coarser raw interval have no finer data to roll up, so their raw data is kept
+				RollupOnly: schema.RollupOnly && pos == 0,
 			})
 		}
 	}
@@ -104,6 +155,11 @@ func ReadSchemas(file string) (Schemas, error) {
 			return Schemas{}, fmt.Errorf("[%s]: failed to parse pattern %q: %s", schema.Name, sec.ValueOf("pattern"), err.Error())
 		}
 
+		schema.Orgs, err = ParseOrgs(sec.ValueOf("orgs"))
+		if err != nil {
+			return Schemas{}, fmt.Errorf("[%s]: failed to parse orgs %q: %s", schema.Name, sec.ValueOf("orgs"), err.Error())
+		}
+
 		schema.Retentions, err = ParseRetentions(sec.ValueOf("retentions"))
 		if err != nil {
 			return Schemas{}, fmt.Errorf("[%s]: failed to parse retentions %q: %s", schema.Name, sec.ValueOf("retentions"), err.Error())
@@ -120,14 +176,38 @@ func ReadSchemas(file string) (Schemas, error) {
 
 		reorderBufferStr := sec.ValueOf("reorderBuffer")
 		if len(reorderBufferStr) > 0 {
-			reorderWindow, err := strconv.ParseUint(reorderBufferStr, 10, 32)
+			reorderWindow, err := parseReorderBuffer(reorderBufferStr, schema.Retentions[0].SecondsPerPoint)
 			if err != nil {
-				return Schemas{}, fmt.Errorf("[%s]: Failed to parse reorder buffer conf, expected a number: %s", schema.Name, reorderBufferStr)
+				return Schemas{}, fmt.Errorf("[%s]: Failed to parse reorder buffer conf, expected a number of points or a duration: %s", schema.Name, reorderBufferStr)
 			}
 
 			// if reorderWindow == 0 we just disable the buffer
 			if reorderWindow > 0 {
-				schema.ReorderWindow = uint32(reorderWindow)
+				schema.ReorderWindow = reorderWindow
+			}
+		}
+
+		if float32Str := sec.ValueOf("float32"); float32Str != "" {
+			schema.Float32, err = strconv.ParseBool(float32Str)
+			if err != nil {
+				return Schemas{}, fmt.Errorf("[%s]: Failed to parse float32 %q, expected a boolean: %s", schema.Name, float32Str, err)
+			}
+		}
+
+		if dupPolicyStr := sec.ValueOf("duplicatePolicy"); dupPolicyStr != "" {
+			schema.DupPolicy, err = ParseDupPolicy(dupPolicyStr)
+			if err != nil {
+				return Schemas{}, fmt.Errorf("[%s]: Failed to parse duplicatePolicy: %s", schema.Name, err)
+			}
+		}
+
+		if rollupOnlyStr := sec.ValueOf("rollupOnly"); rollupOnlyStr != "" {
+			schema.RollupOnly, err = strconv.ParseBool(rollupOnlyStr)
+			if err != nil {
+				return Schemas{}, fmt.Errorf("[%s]: Failed to parse rollupOnly %q, expected a boolean: %s", schema.Name, rollupOnlyStr, err)
+			}
+			if schema.RollupOnly && len(schema.Retentions) < 2 {
+				return Schemas{}, fmt.Errorf("[%s]: rollupOnly requires at least one rollup retention", schema.Name)
 			}
 		}
 
@@ -139,7 +219,22 @@ func ReadSchemas(file string) (Schemas, error) {
 	return NewSchemas(schemas), nil
 }
 
-// Match returns the correct schema setting for the given metric
+// parseReorderBuffer parses the reorderBuffer setting into a number of points.
+// it is either a number of points, or a duration with a unit (e.g. 60s or 5min),
+// in which case it is the number of points of the raw interval needed to cover the duration.
+func parseReorderBuffer(s string, rawInterval int) (uint32, error) {
+	points, err := strconv.ParseUint(s, 10, 32)
+	if err == nil {
+		return uint32(points), nil
+	}
+	window, err := dur.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return (window + uint32(rawInterval) - 1) / uint32(rawInterval), nil
+}
+
+// Match returns the correct schema setting for the given metric of the given org
 // it can always find a valid setting, because there's a default catch all
 // also returns the index of the setting, to efficiently reference it.
 //
@@ -159,7 +254,7 @@ func ReadSchemas(file string) (Schemas, error) {
 // |---------------------------------------------------------------------|
 //
 // When evaluating a match we start with the first schema in the index and
-// compare the regex pattern.
+// compare the regex pattern (and orgs, if the schema is restricted to some orgs).
 // - If it matches we then just find the retention set with the best fit. The
 //   best fit is when the interval is >= the rawInterval (first retention) and
 //   less then the interval of the next rollup.
@@ -169,11 +264,11 @@ func ReadSchemas(file string) (Schemas, error) {
 //     (pattern1), if it doesnt match we will then compare the pattern of
 //     schema2 (pattern2) and if that doesnt match we would try schema5
 //     (pattern3).
-func (s Schemas) Match(metric string, interval int) (uint16, Schema) {
+func (s Schemas) Match(org uint32, metric string, interval int) (uint16, Schema) {
 	i := 0
 	for i < len(s.index) {
 		schema := s.index[i]
-		if schema.Pattern.MatchString(metric) {
+		if schema.Orgs.Match(org) && schema.Pattern.MatchString(metric) {
 			// no interval passed,use the raw retentions.
 			// This is primarily used by the carbon input plugin.
 			if interval == 0 {
@@ -219,6 +314,34 @@ func (s Schemas) Get(i uint16) Schema {
 	return s.index[i]
 }
 
+// CheckReload returns an error if next can't replace s at runtime.
+// series reference their schema by its position in the index, so the rules must stay
+// the same and keep their order, as must the intervals of their retentions.
+// the other settings of the retentions (ttl, chunkspan, numchunks, ready) and the reorder buffer may change.
+func (s Schemas) CheckReload(next Schemas) error {
+	if len(s.index) != len(next.index) {
+		return fmt.Errorf("the rules or their number of retentions changed")
+	}
+	for i, cur := range s.index {
+		n := next.index[i]
+		if cur.Name != n.Name || cur.Pattern.String() != n.Pattern.String() {
+			return fmt.Errorf("rule [%s] with pattern %q was replaced by [%s] with pattern %q", cur.Name, cur.Pattern, n.Name, n.Pattern)
+		}
+		if cur.Orgs.String() != n.Orgs.String() {
+			return fmt.Errorf("[%s]: the orgs changed from %s to %s", cur.Name, cur.Orgs, n.Orgs)
+		}
+		if len(cur.Retentions) != len(n.Retentions) {
+			return fmt.Errorf("[%s]: the number of retentions changed", cur.Name)
+		}
+		for j := range cur.Retentions {
+			if cur.Retentions[j].SecondsPerPoint != n.Retentions[j].SecondsPerPoint {
+				return fmt.Errorf("[%s]: the interval of retention %d changed from %d to %d", cur.Name, j, cur.Retentions[j].SecondsPerPoint, n.Retentions[j].SecondsPerPoint)
+			}
+		}
+	}
+	return nil
+}
+
 // TTLs returns a slice of all TTL's seen amongst all archives of all schemas
 func (schemas Schemas) TTLs() []uint32 {
 	ttls := make(map[uint32]struct{})
@@ -1,9 +1,12 @@
 package conf
 
 import (
-	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
 	"regexp"
 	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
 )
 
 func schemasForTest() Schemas {
@@ -42,25 +45,25 @@ func TestMatch(t *testing.T) {
 	schemas := schemasForTest()
 	Convey("When matching against first schema", t, func() {
 		Convey("When metric has 1s raw interval", func() {
-			id, schema := schemas.Match("a.foo", 1)
+			id, schema := schemas.Match(1, "a.foo", 1)
 			So(id, ShouldEqual, 0)
 			So(schema.Name, ShouldEqual, "a")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 10)
 		})
 		Convey("When metric has 10s raw interval", func() {
-			id, schema := schemas.Match("a.foo", 10)
+			id, schema := schemas.Match(1, "a.foo", 10)
 			So(id, ShouldEqual, 0)
 			So(schema.Name, ShouldEqual, "a")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 10)
 		})
 		Convey("When metric has 30s raw interval", func() {
-			id, schema := schemas.Match("a.foo", 30)
+			id, schema := schemas.Match(1, "a.foo", 30)
 			So(id, ShouldEqual, 0)
 			So(schema.Name, ShouldEqual, "a")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 10)
 		})
 		Convey("When metric has 2h raw interval", func() {
-			id, schema := schemas.Match("a.foo", 7200)
+			id, schema := schemas.Match(1, "a.foo", 7200)
 			So(id, ShouldEqual, 1)
 			So(schema.Name, ShouldEqual, "a")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 3600)
@@ -68,25 +71,25 @@ func TestMatch(t *testing.T) {
 	})
 	Convey("When matching against second schema", t, func() {
 		Convey("When metric has 1s raw interval", func() {
-			id, schema := schemas.Match("b.foo", 1)
+			id, schema := schemas.Match(1, "b.foo", 1)
 			So(id, ShouldEqual, 2)
 			So(schema.Name, ShouldEqual, "b")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 1)
 		})
 		Convey("When metric has 10s raw interval", func() {
-			id, schema := schemas.Match("b.foo", 10)
+			id, schema := schemas.Match(1, "b.foo", 10)
 			So(id, ShouldEqual, 2)
 			So(schema.Name, ShouldEqual, "b")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 1)
 		})
 		Convey("When metric has 30s raw interval", func() {
-			id, schema := schemas.Match("b.foo", 30)
+			id, schema := schemas.Match(1, "b.foo", 30)
 			So(id, ShouldEqual, 3)
 			So(schema.Name, ShouldEqual, "b")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 30)
 		})
 		Convey("When metric has 2h raw interval", func() {
-			id, schema := schemas.Match("b.foo", 7200)
+			id, schema := schemas.Match(1, "b.foo", 7200)
 			So(id, ShouldEqual, 4)
 			So(schema.Name, ShouldEqual, "b")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 600)
@@ -94,25 +97,25 @@ func TestMatch(t *testing.T) {
 	})
 	Convey("When matching against default schema", t, func() {
 		Convey("When metric has 1s raw interval", func() {
-			id, schema := schemas.Match("c.foo", 1)
+			id, schema := schemas.Match(1, "c.foo", 1)
 			So(id, ShouldEqual, 5)
 			So(schema.Name, ShouldEqual, "default")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 1)
 		})
 		Convey("When metric has 10s raw interval", func() {
-			id, schema := schemas.Match("c.foo", 10)
+			id, schema := schemas.Match(1, "c.foo", 10)
 			So(id, ShouldEqual, 5)
 			So(schema.Name, ShouldEqual, "default")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 1)
 		})
 		Convey("When metric has 30s raw interval", func() {
-			id, schema := schemas.Match("c.foo", 60)
+			id, schema := schemas.Match(1, "c.foo", 60)
 			So(id, ShouldEqual, 6)
 			So(schema.Name, ShouldEqual, "default")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 60)
 		})
 		Convey("When metric has 2h raw interval", func() {
-			id, schema := schemas.Match("c.foo", 7200)
+			id, schema := schemas.Match(1, "c.foo", 7200)
 			So(id, ShouldEqual, 8)
 			So(schema.Name, ShouldEqual, "default")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 3600)
@@ -134,7 +137,7 @@ func TestDefaultSchema(t *testing.T) {
 
 	Convey("When matching against first schema", t, func() {
 		Convey("When metric has 1s raw interval", func() {
-			id, schema := schemas.Match("a.foo", 1)
+			id, schema := schemas.Match(1, "a.foo", 1)
 			So(id, ShouldEqual, 0)
 			So(schema.Name, ShouldEqual, "a")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 10)
@@ -142,7 +145,7 @@ func TestDefaultSchema(t *testing.T) {
 	})
 	Convey("When series doesnt match any schema", t, func() {
 		Convey("When metric has 10s raw interval", func() {
-			id, schema := schemas.Match("d.foo", 10)
+			id, schema := schemas.Match(1, "d.foo", 10)
 			So(id, ShouldEqual, 2)
 			So(schema.Name, ShouldEqual, "default")
 			So(schema.Retentions[0].SecondsPerPoint, ShouldEqual, 1)
@@ -164,3 +167,235 @@ func TestMaxChunkSpan(t *testing.T) {
 		So(max, ShouldEqual, 60*60*6)
 	})
 }
+
+func TestParseReorderBuffer(t *testing.T) {
+	cases := []struct {
+		in          string
+		rawInterval int
+		expErr      bool
+		exp         uint32
+	}{
+		{"20", 10, false, 20},
+		{"0", 10, false, 0},
+		{"60s", 10, false, 6},
+		{"65s", 10, false, 7},
+		{"5min", 1, false, 300},
+		{"1m30s", 60, false, 2},
+		{"-5", 10, true, 0},
+		{"abc", 10, true, 0},
+	}
+	for _, c := range cases {
+		got, err := parseReorderBuffer(c.in, c.rawInterval)
+		if c.expErr {
+			if err == nil {
+				t.Fatalf("%q: expected error, got %d", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: expected no error, got %s", c.in, err)
+		}
+		if got != c.exp {
+			t.Fatalf("%q: expected %d points, got %d", c.in, c.exp, got)
+		}
+	}
+}
+
+func TestSchemasCheckReload(t *testing.T) {
+	cur := schemasForTest()
+
+	next := schemasForTest()
+	next.raw[0].Retentions[0] = NewRetentionMT(10, 7200, 60*20, 5, 0)
+	next.BuildIndex()
+	if err := cur.CheckReload(next); err != nil {
+		t.Fatalf("expected changing ttl, chunkspan and numchunks to be allowed, got %s", err)
+	}
+
+	next = schemasForTest()
+	next.raw[0].Retentions[0] = NewRetentionMT(20, 3600, 60*10, 0, 0)
+	next.BuildIndex()
+	if err := cur.CheckReload(next); err == nil {
+		t.Fatalf("expected changing the interval to be refused")
+	}
+
+	next = schemasForTest()
+	next.raw[1].Pattern = regexp.MustCompile("^c\\..*")
+	next.BuildIndex()
+	if err := cur.CheckReload(next); err == nil {
+		t.Fatalf("expected changing a pattern to be refused")
+	}
+
+	next = schemasForTest()
+	next.raw[1].Orgs = Orgs{5}
+	next.BuildIndex()
+	if err := cur.CheckReload(next); err == nil {
+		t.Fatalf("expected changing the orgs to be refused")
+	}
+
+	next = NewSchemas(schemasForTest().raw[1:])
+	if err := cur.CheckReload(next); err == nil {
+		t.Fatalf("expected removing a rule to be refused")
+	}
+}
+
+func TestReadSchemasFloat32(t *testing.T) {
+	cases := []struct {
+		in     string
+		expErr bool
+		exp    bool
+	}{
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\n", false, false},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nfloat32 = true\n", false, true},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nfloat32 = false\n", false, false},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nfloat32 = half\n", true, false},
+	}
+	for i, c := range cases {
+		tmpfile, err := ioutil.TempFile("", "schemas-test-float32")
+		if err != nil {
+			panic(err)
+		}
+		if _, err := tmpfile.Write([]byte(c.in)); err != nil {
+			panic(err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			panic(err)
+		}
+
+		schemas, err := ReadSchemas(tmpfile.Name())
+		os.Remove(tmpfile.Name())
+		if (err != nil) != c.expErr {
+			t.Fatalf("case %d, exp err %t, got err %v", i, c.expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		// the setting must apply to all retentions of the rule, but not to the default
+		for _, interval := range []int{1, 60} {
+			if _, schema := schemas.Match(1, "a.b", interval); schema.Float32 != c.exp {
+				t.Fatalf("case %d, interval %d: exp float32 %t, got %t", i, interval, c.exp, schema.Float32)
+			}
+		}
+		if _, schema := schemas.Match(1, "b", 1); schema.Float32 {
+			t.Fatalf("case %d, exp default schema not to use float32", i)
+		}
+	}
+}
+
+func TestReadSchemasDupPolicy(t *testing.T) {
+	cases := []struct {
+		in     string
+		expErr bool
+		exp    DupPolicy
+	}{
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\n", false, DupDefault},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nduplicatePolicy = keep-first\n", false, DupKeepFirst},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nduplicatePolicy = keep-last\n", false, DupKeepLast},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nduplicatePolicy = keep-max\n", false, DupKeepMax},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nduplicatePolicy = sum\n", false, DupSum},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nduplicatePolicy = avg\n", true, DupDefault},
+	}
+	for i, c := range cases {
+		tmpfile, err := ioutil.TempFile("", "schemas-test-duppolicy")
+		if err != nil {
+			panic(err)
+		}
+		if _, err := tmpfile.Write([]byte(c.in)); err != nil {
+			panic(err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			panic(err)
+		}
+
+		schemas, err := ReadSchemas(tmpfile.Name())
+		os.Remove(tmpfile.Name())
+		if (err != nil) != c.expErr {
+			t.Fatalf("case %d, exp err %t, got err %v", i, c.expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		for _, interval := range []int{1, 60} {
+			if _, schema := schemas.Match(1, "a.b", interval); schema.DupPolicy != c.exp {
+				t.Fatalf("case %d, interval %d: exp duplicate policy %s, got %s", i, interval, c.exp, schema.DupPolicy)
+			}
+		}
+	}
+}
+
+func TestReadSchemasRollupOnly(t *testing.T) {
+	cases := []struct {
+		in     string
+		expErr bool
+		exp    bool
+	}{
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\n", false, false},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nrollupOnly = true\n", false, true},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nrollupOnly = false\n", false, false},
+		{"[a]\npattern = ^a\nretentions = 1s:1d,1m:7d\nrollupOnly = sometimes\n", true, false},
+		{"[a]\npattern = ^a\nretentions = 1s:1d\nrollupOnly = true\n", true, false},
+	}
+	for i, c := range cases {
+		tmpfile, err := ioutil.TempFile("", "schemas-test-rolluponly")
+		if err != nil {
+			panic(err)
+		}
+		if _, err := tmpfile.Write([]byte(c.in)); err != nil {
+			panic(err)
+		}
+		if err := tmpfile.Close(); err != nil {
+			panic(err)
+		}
+
+		schemas, err := ReadSchemas(tmpfile.Name())
+		os.Remove(tmpfile.Name())
+		if (err != nil) != c.expErr {
+			t.Fatalf("case %d, exp err %t, got err %v", i, c.expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if _, schema := schemas.Match(1, "a.b", 1); schema.RollupOnly != c.exp {
+			t.Fatalf("case %d: exp rollupOnly %t, got %t", i, c.exp, schema.RollupOnly)
+		}
+		// series with the interval of the rollup have no finer data, so they keep their raw data
+		if _, schema := schemas.Match(1, "a.b", 60); schema.RollupOnly {
+			t.Fatalf("case %d: exp series with an interval of 60 not to be rollup-only", i)
+		}
+	}
+}
+
+func TestReadSchemasOrgs(t *testing.T) {
+	in := "[org5]\npattern = .*\norgs = 5, 6\nretentions = 10s:1d,1m:7d\n[default]\npattern = .*\nretentions = 1s:1d\n"
+	tmpfile, err := ioutil.TempFile("", "schemas-test-orgs")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := tmpfile.Write([]byte(in)); err != nil {
+		panic(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		panic(err)
+	}
+	schemas, err := ReadSchemas(tmpfile.Name())
+	os.Remove(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		org     uint32
+		expName string
+	}{
+		{5, "org5"},
+		{6, "org5"},
+		{1, "default"},
+	}
+	for _, c := range cases {
+		if _, schema := schemas.Match(c.org, "a.b", 0); schema.Name != c.expName {
+			t.Fatalf("org %d: expected schema %q, got %q", c.org, c.expName, schema.Name)
+		}
+	}
+
+	if _, err := ParseOrgs("5,x"); err == nil {
+		t.Fatalf("expected an error for an invalid org id")
+	}
+}
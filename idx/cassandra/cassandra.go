@@ -49,8 +49,9 @@ var (
 )
 
 type writeReq struct {
-	def      *schema.MetricDefinition
-	recvTime time.Time
+	def       *schema.MetricDefinition
+	firstSeen int64
+	recvTime  time.Time
 }
 
 // CasIdx implements the the "MetricIndex" interface
@@ -62,6 +63,7 @@ type CasIdx struct {
 	writeQueue       chan writeReq
 	wg               sync.WaitGroup
 	updateInterval32 uint32
+	firstSeenColumn  bool // whether the table has the firstseen column. tables created by older versions don't
 }
 
 type cqlIterator interface {
@@ -80,11 +82,10 @@ func New(cfg *IdxConfig) *CasIdx {
 	cluster.NumConns = cfg.numConns
 	cluster.ProtoVersion = cfg.protoVer
 	cluster.DisableInitialHostLookup = cfg.disableInitialHostLookup
+	// both are checked by cfg.Validate
+	cluster.PoolConfig.HostSelectionPolicy, _ = cassandra.HostSelectionPolicy(cfg.hostSelectionPolicy, cfg.localDC)
 	if cfg.ssl {
-		cluster.SslOpts = &gocql.SslOptions{
-			CaPath:                 cfg.capath,
-			EnableHostVerification: cfg.hostverification,
-		}
+		cluster.SslOpts, _ = cassandra.SslOptions(cfg.capath, cfg.certPath, cfg.keyPath, cfg.hostverification)
 	}
 	if cfg.auth {
 		cluster.Authenticator = gocql.PasswordAuthenticator{
@@ -130,6 +131,10 @@ func (c *CasIdx) InitBare() error {
 		if err != nil {
 			return fmt.Errorf("failed to initialize cassandra table: %s", err)
 		}
+		err = cassandra.Migrate(tmpSession, c.cfg.keyspace, "metric_idx", migrations)
+		if err != nil {
+			return fmt.Errorf("failed to migrate cassandra table: %s", err)
+		}
 	} else {
 		var keyspaceMetadata *gocql.KeyspaceMetadata
 		for attempt := 1; attempt > 0; attempt++ {
@@ -155,6 +160,11 @@ func (c *CasIdx) InitBare() error {
 
 	}
 
+	err = c.checkFirstSeenColumn(tmpSession)
+	if err != nil {
+		return err
+	}
+
 	tmpSession.Close()
 	c.cluster.Keyspace = c.cfg.keyspace
 	session, err := c.cluster.CreateSession()
@@ -167,6 +177,54 @@ func (c *CasIdx) InitBare() error {
 	return nil
 }
 
+// migrations of the metric_idx table, see cassandra.Migrate.
+// the table is created from schema_table in the schema file: when changing it, add a migration
+// that brings existing tables up to date.
+var migrations = []cassandra.Migration{
+	{Version: 1, Description: "initial schema"},
+	{Version: 2, Description: "add the firstseen column", Apply: addFirstSeenColumn},
+}
+
+// addFirstSeenColumn adds the firstseen column to tables created by older versions
+func addFirstSeenColumn(session *gocql.Session, keyspace, table string) error {
+	keyspaceMetadata, err := session.KeyspaceMetadata(keyspace)
+	if err != nil {
+		return fmt.Errorf("failed to read cassandra keyspace metadata: %s", err)
+	}
+	tableMetadata, ok := keyspaceMetadata.Tables[table]
+	if !ok {
+		return fmt.Errorf("cassandra table not found")
+	}
+	if _, ok := tableMetadata.Columns["firstseen"]; ok {
+		return nil
+	}
+	return session.Query(fmt.Sprintf("ALTER TABLE %s.%s ADD firstseen int", keyspace, table)).Exec()
+}
+
+// checkFirstSeenColumn checks whether the metric_idx table has the firstseen column.
+// when we're allowed to create the schema, the migrations have added it.
+// without it, first seen timestamps are not persisted.
+func (c *CasIdx) checkFirstSeenColumn(session *gocql.Session) error {
+	if c.cfg.createKeyspace {
+		c.firstSeenColumn = true
+		return nil
+	}
+	keyspaceMetadata, err := session.KeyspaceMetadata(c.cfg.keyspace)
+	if err != nil {
+		return fmt.Errorf("failed to read cassandra keyspace metadata: %s", err)
+	}
+	table, ok := keyspaceMetadata.Tables["metric_idx"]
+	if !ok {
+		return fmt.Errorf("cassandra table not found")
+	}
+	if _, ok := table.Columns["firstseen"]; ok {
+		c.firstSeenColumn = true
+		return nil
+	}
+	log.Warnf("cassandra-idx: table metric_idx has no firstseen column. first seen timestamps will not be persisted. enable create-keyspace on one instance to add it, or add it with: ALTER TABLE %s.metric_idx ADD firstseen int", c.cfg.keyspace)
+	return nil
+}
+
 // Init makes sure the needed keyspace, table, index in cassandra exists, creates the session,
 // rebuilds the in-memory index, sets up write queues, metrics and pruning routines
 func (c *CasIdx) Init() error {
@@ -280,7 +338,7 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 	// then perform a blocking save.
 	if archive.LastSave < (now - c.updateInterval32 - c.updateInterval32/2) {
 		log.Debugf("cassandra-idx: updating def %s in index.", archive.MetricDefinition.Id)
-		c.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition}
+		c.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition, firstSeen: archive.FirstSeen}
 		archive.LastSave = now
 		c.MemoryIdx.UpdateArchive(archive)
 	} else {
@@ -291,7 +349,7 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 		// lastSave timestamp become more then 1.5 x UpdateInterval, in which case we will
 		// do a blocking write to the queue.
 		select {
-		case c.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition}:
+		case c.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition, firstSeen: archive.FirstSeen}:
 			archive.LastSave = now
 			c.MemoryIdx.UpdateArchive(archive)
 		default:
@@ -306,34 +364,57 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 func (c *CasIdx) rebuildIndex() {
 	log.Info("cassandra-idx: Rebuilding Memory Index from metricDefinitions in Cassandra")
 	pre := time.Now()
-	defs := c.LoadPartitions(cluster.Manager.GetPartitions(), nil, pre)
+	var firstSeen map[schema.MKey]int64
+	if c.firstSeenColumn {
+		firstSeen = make(map[schema.MKey]int64)
+	}
+	defs := c.loadPartitions(cluster.Manager.GetPartitions(), nil, firstSeen, pre)
 	num := c.MemoryIdx.Load(defs)
+	c.MemoryIdx.LoadFirstSeen(firstSeen)
 	log.Infof("cassandra-idx: Rebuilding Memory Index Complete. Imported %d. Took %s", num, time.Since(pre))
 }
 
 func (c *CasIdx) Load(defs []schema.MetricDefinition, now time.Time) []schema.MetricDefinition {
 	iter := c.session.Query("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from metric_idx").Iter()
-	return c.load(defs, iter, now)
+	return c.load(defs, nil, iter, now)
 }
 
 func (c *CasIdx) LoadPartitions(partitions []int32, defs []schema.MetricDefinition, now time.Time) []schema.MetricDefinition {
+	return c.loadPartitions(partitions, defs, nil, now)
+}
+
+// loadPartitions is like LoadPartitions, but if firstSeen is not nil, it also reads
+// the first seen timestamps of the loaded defs into it. (requires the firstseen column)
+func (c *CasIdx) loadPartitions(partitions []int32, defs []schema.MetricDefinition, firstSeen map[schema.MKey]int64, now time.Time) []schema.MetricDefinition {
 	placeholders := make([]string, len(partitions))
 	for i, p := range partitions {
 		placeholders[i] = strconv.Itoa(int(p))
 	}
-	q := fmt.Sprintf("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from metric_idx where partition in (%s)", strings.Join(placeholders, ","))
+	columns := "id, orgid, partition, name, interval, unit, mtype, tags, lastupdate"
+	if firstSeen != nil {
+		columns += ", firstseen"
+	}
+	q := fmt.Sprintf("SELECT %s from metric_idx where partition in (%s)", columns, strings.Join(placeholders, ","))
 	iter := c.session.Query(q).Iter()
-	return c.load(defs, iter, now)
+	return c.load(defs, firstSeen, iter, now)
 }
 
-func (c *CasIdx) load(defs []schema.MetricDefinition, iter cqlIterator, now time.Time) []schema.MetricDefinition {
+// load reads the defs from the iterator, and appends those that are not stale to defs.
+// if firstSeen is not nil, the iterator must also have the firstseen column, and the
+// first seen timestamps of the returned defs are added to it. (if known)
+func (c *CasIdx) load(defs []schema.MetricDefinition, firstSeen map[schema.MKey]int64, iter cqlIterator, now time.Time) []schema.MetricDefinition {
 	defsByNames := make(map[string][]*schema.MetricDefinition)
+	firstSeenById := make(map[schema.MKey]int64)
 	var id, name, unit, mtype string
 	var orgId, interval int
 	var partition int32
-	var lastupdate int64
+	var lastupdate, firstseen int64
 	var tags []string
-	for iter.Scan(&id, &orgId, &partition, &name, &interval, &unit, &mtype, &tags, &lastupdate) {
+	dest := []interface{}{&id, &orgId, &partition, &name, &interval, &unit, &mtype, &tags, &lastupdate}
+	if firstSeen != nil {
+		dest = append(dest, &firstseen)
+	}
+	for iter.Scan(dest...) {
 		mkey, err := schema.MKeyFromString(id)
 		if err != nil {
 			log.Errorf("cassandra-idx: load() could not parse ID %q: %s -> skipping", id, err)
@@ -356,6 +437,10 @@ func (c *CasIdx) load(defs []schema.MetricDefinition, iter cqlIterator, now time
 		}
 		nameWithTags := mdef.NameWithTags()
 		defsByNames[nameWithTags] = append(defsByNames[nameWithTags], mdef)
+		// the column is null (scanned as 0) for defs saved before it existed
+		if firstSeen != nil && firstseen != 0 {
+			firstSeenById[mkey] = firstseen
+		}
 	}
 	if err := iter.Close(); err != nil {
 		log.Fatalf("Could not close iterator: %s", err.Error())
@@ -374,6 +459,9 @@ NAMES:
 				// all the defs for that nameWithTags.
 				for _, defToAdd := range defsByNames[nameWithTags] {
 					defs = append(defs, *defToAdd)
+					if ts, ok := firstSeenById[defToAdd.Id]; ok {
+						firstSeen[defToAdd.Id] = ts
+					}
 				}
 				continue NAMES
 			}
@@ -389,6 +477,10 @@ func (c *CasIdx) processWriteQueue() {
 	var err error
 	var req writeReq
 	qry := `INSERT INTO metric_idx (id, orgid, partition, name, interval, unit, mtype, tags, lastupdate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if c.firstSeenColumn {
+		// a first seen of 0 (unknown) is saved as is, and treated as unknown again when loading
+		qry = `INSERT INTO metric_idx (id, orgid, partition, name, interval, unit, mtype, tags, lastupdate, firstseen) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	}
 	for req = range c.writeQueue {
 		if err != nil {
 			log.Errorf("Failed to marshal metricDef: %s. value was: %+v", err, *req.def)
@@ -399,18 +491,23 @@ func (c *CasIdx) processWriteQueue() {
 		success = false
 		attempts = 0
 
+		values := []interface{}{
+			req.def.Id.String(),
+			req.def.OrgId,
+			req.def.Partition,
+			req.def.Name,
+			req.def.Interval,
+			req.def.Unit,
+			req.def.Mtype,
+			req.def.Tags,
+			req.def.LastUpdate,
+		}
+		if c.firstSeenColumn {
+			values = append(values, req.firstSeen)
+		}
+
 		for !success {
-			if err := c.session.Query(
-				qry,
-				req.def.Id.String(),
-				req.def.OrgId,
-				req.def.Partition,
-				req.def.Name,
-				req.def.Interval,
-				req.def.Unit,
-				req.def.Mtype,
-				req.def.Tags,
-				req.def.LastUpdate).Exec(); err != nil {
+			if err := c.session.Query(qry, values...).Exec(); err != nil {
 
 				statQueryInsertFail.Inc()
 				errmetrics.Inc(err)
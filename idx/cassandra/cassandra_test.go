@@ -34,6 +34,7 @@ type cassRow struct {
 	mtype      string
 	tags       []string
 	lastUpdate int64
+	firstSeen  int64
 }
 
 func (i *testIterator) Scan(dest ...interface{}) bool {
@@ -55,6 +56,9 @@ func (i *testIterator) Scan(dest ...interface{}) bool {
 	*(dest[6].(*string)) = row.mtype
 	*(dest[7].(*[]string)) = row.tags
 	*(dest[8].(*int64)) = row.lastUpdate
+	if len(dest) > 9 {
+		*(dest[9].(*int64)) = row.firstSeen
+	}
 
 	i.rows = i.rows[1:]
 
@@ -340,7 +344,7 @@ func TestFind(t *testing.T) {
 
 	Convey("When listing root nodes", t, func() {
 		Convey("root nodes for orgId 1", func() {
-			nodes, err := ix.Find(1, "*", 0)
+			nodes, err := ix.Find(1, "*", 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 2)
 			So(nodes[0].Path, ShouldBeIn, "metric", "foo")
@@ -348,7 +352,7 @@ func TestFind(t *testing.T) {
 			So(nodes[0].Leaf, ShouldBeFalse)
 		})
 		Convey("root nodes for orgId 2", func() {
-			nodes, err := ix.Find(2, "*", 0)
+			nodes, err := ix.Find(2, "*", 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 1)
 			So(nodes[0].Path, ShouldEqual, "metric")
@@ -357,7 +361,7 @@ func TestFind(t *testing.T) {
 	})
 
 	Convey("When searching with GLOB", t, func() {
-		nodes, err := ix.Find(2, "metric.{f*,demo}.*", 0)
+		nodes, err := ix.Find(2, "metric.{f*,demo}.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 10)
 		for _, n := range nodes {
@@ -366,7 +370,7 @@ func TestFind(t *testing.T) {
 	})
 
 	Convey("When searching with multiple wildcards", t, func() {
-		nodes, err := ix.Find(1, "*.*", 0)
+		nodes, err := ix.Find(1, "*.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 2)
 		for _, n := range nodes {
@@ -375,24 +379,24 @@ func TestFind(t *testing.T) {
 	})
 
 	Convey("When searching nodes not in public series", t, func() {
-		nodes, err := ix.Find(1, "foo.demo.*", 0)
+		nodes, err := ix.Find(1, "foo.demo.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 5)
 		Convey("When searching for specific series", func() {
-			found, err := ix.Find(1, nodes[0].Path, 0)
+			found, err := ix.Find(1, nodes[0].Path, 0, 0)
 			So(err, ShouldBeNil)
 			So(found, ShouldHaveLength, 1)
 			So(found[0].Path, ShouldEqual, nodes[0].Path)
 		})
 		Convey("When searching nodes that are children of a leaf", func() {
-			found, err := ix.Find(1, nodes[0].Path+".*", 0)
+			found, err := ix.Find(1, nodes[0].Path+".*", 0, 0)
 			So(err, ShouldBeNil)
 			So(found, ShouldHaveLength, 0)
 		})
 	})
 
 	Convey("When searching with multiple wildcards mixed leaf/branch", t, func() {
-		nodes, err := ix.Find(1, "*.demo.*", 0)
+		nodes, err := ix.Find(1, "*.demo.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 15)
 		for _, n := range nodes {
@@ -405,13 +409,13 @@ func TestFind(t *testing.T) {
 		}
 	})
 	Convey("When searching nodes for unknown orgId", t, func() {
-		nodes, err := ix.Find(4, "foo.demo.*", 0)
+		nodes, err := ix.Find(4, "foo.demo.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 0)
 	})
 
 	Convey("When searching nodes that don't exist", t, func() {
-		nodes, err := ix.Find(1, "foo.demo.blah.*", 0)
+		nodes, err := ix.Find(1, "foo.demo.blah.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 0)
 	})
@@ -614,7 +618,7 @@ func TestPruneStaleOnLoad(t *testing.T) {
 	})
 
 	idx := &CasIdx{}
-	defs := idx.load(nil, &iter, now)
+	defs := idx.load(nil, nil, &iter, now)
 
 	exp := []schema.MKey{
 		test.GetMKey(1),
@@ -695,7 +699,7 @@ func TestPruneStaleOnLoadWithTags(t *testing.T) {
 	})
 
 	idx := &CasIdx{}
-	defs := idx.load(nil, &iter, now)
+	defs := idx.load(nil, nil, &iter, now)
 	exp := []schema.MKey{
 		test.GetMKey(1),
 		test.GetMKey(2),
@@ -711,6 +715,62 @@ func TestPruneStaleOnLoadWithTags(t *testing.T) {
 	}
 }
 
+func TestFirstSeenOnLoad(t *testing.T) {
+	now := time.Now()
+	memory.IndexRules = conf.IndexRules{
+		Default: conf.IndexRule{
+			Name:     "default",
+			Pattern:  regexp.MustCompile(""),
+			MaxStale: time.Duration(24*7) * time.Hour,
+		},
+	}
+
+	iter := testIterator{}
+	iter.rows = append(iter.rows, cassRow{
+		id:         test.GetMKey(1).String(),
+		name:       "known",
+		interval:   1,
+		lastUpdate: now.Unix(),
+		firstSeen:  now.Add(-24 * time.Hour).Unix(),
+	})
+	// saved before the firstseen column existed
+	iter.rows = append(iter.rows, cassRow{
+		id:         test.GetMKey(2).String(),
+		name:       "unknown",
+		interval:   1,
+		lastUpdate: now.Unix(),
+	})
+	iter.rows = append(iter.rows, cassRow{
+		id:         test.GetMKey(3).String(),
+		name:       "stale",
+		interval:   1,
+		lastUpdate: now.Add(-30 * 24 * time.Hour).Unix(),
+		firstSeen:  now.Add(-60 * 24 * time.Hour).Unix(),
+	})
+
+	firstSeen := make(map[schema.MKey]int64)
+	ix := &CasIdx{MemoryIdx: *memory.New()}
+	defs := ix.load(nil, firstSeen, &iter, now)
+	if len(defs) != 2 {
+		t.Fatalf("expected 2 defs, got %d", len(defs))
+	}
+	exp := map[schema.MKey]int64{
+		test.GetMKey(1): now.Add(-24 * time.Hour).Unix(),
+	}
+	if !reflect.DeepEqual(firstSeen, exp) {
+		t.Fatalf("expected first seen %v, got %v", exp, firstSeen)
+	}
+
+	ix.MemoryIdx.Load(defs)
+	ix.MemoryIdx.LoadFirstSeen(firstSeen)
+	for _, def := range defs {
+		archive, _ := ix.Get(def.Id)
+		if archive.FirstSeen != exp[def.Id] {
+			t.Fatalf("expected first seen of %s to be %d, got %d", def.Name, exp[def.Id], archive.FirstSeen)
+		}
+	}
+}
+
 type MKeyAsc []schema.MKey
 
 func (m MKeyAsc) Len() int      { return len(m) }
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/cassandra"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,6 +33,10 @@ type IdxConfig struct {
 	keyspace                 string
 	hosts                    string
 	capath                   string
+	certPath                 string
+	keyPath                  string
+	hostSelectionPolicy      string
+	localDC                  string
 	username                 string
 	password                 string
 	consistency              string
@@ -60,6 +65,10 @@ func NewIdxConfig() *IdxConfig {
 		disableInitialHostLookup: false,
 		ssl:                      false,
 		capath:                   "/etc/metrictank/ca.pem",
+		certPath:                 "",
+		keyPath:                  "",
+		hostSelectionPolicy:      "tokenaware,hostpool-epsilon-greedy",
+		localDC:                  "",
 		hostverification:         true,
 		auth:                     false,
 		username:                 "cassandra",
@@ -75,6 +84,12 @@ func (cfg *IdxConfig) Validate() error {
 	if cfg.timeout == 0 {
 		return errors.New("timeout must be greater than 0. " + timeUnits)
 	}
+	if (cfg.certPath == "") != (cfg.keyPath == "") {
+		return errors.New("cert-path and key-path must be both set or both empty")
+	}
+	if _, err := cassandra.HostSelectionPolicy(cfg.hostSelectionPolicy, cfg.localDC); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -86,6 +101,8 @@ func ConfigSetup() *flag.FlagSet {
 	casIdx.StringVar(&CliConfig.hosts, "hosts", CliConfig.hosts, "comma separated list of cassandra addresses in host:port form")
 	casIdx.StringVar(&CliConfig.keyspace, "keyspace", CliConfig.keyspace, "Cassandra keyspace to store metricDefinitions in.")
 	casIdx.StringVar(&CliConfig.consistency, "consistency", CliConfig.consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	casIdx.StringVar(&CliConfig.hostSelectionPolicy, "host-selection-policy", CliConfig.hostSelectionPolicy, "how the driver picks the host for each query ("+cassandra.HostSelectionPolicies+")")
+	casIdx.StringVar(&CliConfig.localDC, "local-dc", CliConfig.localDC, "datacenter of this node, for the dcaware host selection policies")
 	casIdx.DurationVar(&CliConfig.timeout, "timeout", CliConfig.timeout, "cassandra request timeout")
 	casIdx.IntVar(&CliConfig.numConns, "num-conns", CliConfig.numConns, "number of concurrent connections to cassandra")
 	casIdx.IntVar(&CliConfig.writeQueueSize, "write-queue-size", CliConfig.writeQueueSize, "Max number of metricDefs allowed to be unwritten to cassandra")
@@ -98,6 +115,8 @@ func ConfigSetup() *flag.FlagSet {
 	casIdx.BoolVar(&CliConfig.disableInitialHostLookup, "disable-initial-host-lookup", CliConfig.disableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
 	casIdx.BoolVar(&CliConfig.ssl, "ssl", CliConfig.ssl, "enable SSL connection to cassandra")
 	casIdx.StringVar(&CliConfig.capath, "ca-path", CliConfig.capath, "cassandra CA certficate path when using SSL")
+	casIdx.StringVar(&CliConfig.certPath, "cert-path", CliConfig.certPath, "client certificate path when using SSL, for clusters that require client authentication. empty to not use a client certificate")
+	casIdx.StringVar(&CliConfig.keyPath, "key-path", CliConfig.keyPath, "client certificate key path when using SSL")
 	casIdx.BoolVar(&CliConfig.hostverification, "host-verification", CliConfig.hostverification, "host (hostname and server cert) verification when using SSL")
 
 	casIdx.BoolVar(&CliConfig.auth, "auth", CliConfig.auth, "enable cassandra user authentication")
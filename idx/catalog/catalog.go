@@ -0,0 +1,220 @@
+// Package catalog syncs host metadata from an external service catalog,
+// so that series can be queried by the catalog tags of the host they belong to.
+//
+// tags are part of the identity of a series, so we can't add catalog tags to the
+// MetricDefinitions themselves. Instead, tag expressions on catalog tags are
+// translated into expressions on the host tag of the series.
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// metric idx.catalog.sync.ok is how many times the catalog was synced successfully
+	syncOk = stats.NewCounter32("idx.catalog.sync.ok")
+	// metric idx.catalog.sync.fail is how many times syncing the catalog failed
+	syncFail = stats.NewCounter32("idx.catalog.sync.fail")
+	// metric idx.catalog.hosts is the number of hosts in the catalog, as of the last successful sync
+	hostsGauge = stats.NewGauge32("idx.catalog.hosts")
+)
+
+// Entry describes a host in the catalog.
+// the catalog is expected to be a json array of entries, like
+// [{"name": "web-01", "tags": {"datacenter": "us-east", "team": "frontend"}}]
+type Entry struct {
+	Name string            `json:"name"`
+	Tags map[string]string `json:"tags"`
+}
+
+// Catalog periodically fetches the catalog and keeps an index of
+// tag -> value -> hosts, for the configured tags
+type Catalog struct {
+	sync.RWMutex
+	url      string
+	hostTag  string
+	tags     map[string]struct{}
+	interval time.Duration
+	client   *http.Client
+
+	hosts    map[string]map[string][]string // tag -> value -> sorted host names
+	shutdown chan struct{}
+}
+
+// New creates a Catalog based on the configuration
+func New() *Catalog {
+	return NewCatalog(url, hostTag, tags, interval, timeout)
+}
+
+func NewCatalog(url, hostTag string, tags []string, interval, timeout time.Duration) *Catalog {
+	c := &Catalog{
+		url:      url,
+		hostTag:  hostTag,
+		tags:     make(map[string]struct{}),
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+		hosts:    make(map[string]map[string][]string),
+		shutdown: make(chan struct{}),
+	}
+	for _, t := range tags {
+		c.tags[t] = struct{}{}
+	}
+	return c
+}
+
+// Start does an initial sync and then keeps syncing in the background.
+// a failed initial sync is not fatal: queries on catalog tags simply won't match until the catalog could be fetched.
+func (c *Catalog) Start() {
+	if err := c.sync(); err != nil {
+		log.Errorf("catalog: initial sync failed: %s", err)
+	}
+	go c.run()
+}
+
+func (c *Catalog) Stop() {
+	close(c.shutdown)
+}
+
+func (c *Catalog) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case <-ticker.C:
+			if err := c.sync(); err != nil {
+				log.Errorf("catalog: sync failed: %s", err)
+			}
+		}
+	}
+}
+
+func (c *Catalog) sync() error {
+	entries, err := c.fetch()
+	if err != nil {
+		syncFail.Inc()
+		return err
+	}
+	c.Load(entries)
+	syncOk.Inc()
+	hostsGauge.Set(len(entries))
+	log.Debugf("catalog: synced %d hosts", len(entries))
+	return nil
+}
+
+func (c *Catalog) fetch() ([]Entry, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned status %d", c.url, resp.StatusCode)
+	}
+	var entries []Entry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode catalog: %s", err)
+	}
+	return entries, nil
+}
+
+// Load replaces the contents of the catalog with the given entries
+func (c *Catalog) Load(entries []Entry) {
+	hosts := make(map[string]map[string][]string)
+	for _, e := range entries {
+		if e.Name == "" {
+			continue
+		}
+		for tag, val := range e.Tags {
+			if _, ok := c.tags[tag]; !ok {
+				continue
+			}
+			if hosts[tag] == nil {
+				hosts[tag] = make(map[string][]string)
+			}
+			hosts[tag][val] = append(hosts[tag][val], e.Name)
+		}
+	}
+	for _, vals := range hosts {
+		for _, names := range vals {
+			sort.Strings(names)
+		}
+	}
+	c.Lock()
+	c.hosts = hosts
+	c.Unlock()
+}
+
+// Rewrite translates tag expressions on catalog tags (using the = or != operator)
+// into expressions on the host tag. Other expressions are returned as-is.
+// ok is false if the expressions can't match any series, because
+// no host in the catalog has the requested tag value.
+func (c *Catalog) Rewrite(expressions []string) (out []string, ok bool) {
+	out = make([]string, 0, len(expressions))
+	c.RLock()
+	defer c.RUnlock()
+	for _, expr := range expressions {
+		tag, val, negate, isCatalog := c.parse(expr)
+		if !isCatalog {
+			out = append(out, expr)
+			continue
+		}
+		names := c.hosts[tag][val]
+		if len(names) == 0 {
+			if negate {
+				// no host has the value, so no series is excluded
+				continue
+			}
+			return nil, false
+		}
+		op := "=~"
+		if negate {
+			op = "!=~"
+		}
+		out = append(out, c.hostTag+op+hostsPattern(names))
+	}
+	return out, true
+}
+
+// parse returns the tag, value and whether the expression is negated, if the expression is an
+// equality expression on a catalog tag.
+func (c *Catalog) parse(expr string) (tag, val string, negate, ok bool) {
+	pos := strings.Index(expr, "=")
+	if pos < 1 {
+		return "", "", false, false
+	}
+	tag = expr[:pos]
+	val = expr[pos+1:]
+	if strings.HasSuffix(tag, "!") {
+		tag = tag[:len(tag)-1]
+		negate = true
+	}
+	// other operators like =~ and ^= are not supported on catalog tags
+	if strings.HasPrefix(val, "~") || strings.HasSuffix(tag, "^") {
+		return "", "", false, false
+	}
+	if _, ok := c.tags[tag]; !ok {
+		return "", "", false, false
+	}
+	return tag, val, negate, true
+}
+
+func hostsPattern(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = regexp.QuoteMeta(n)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
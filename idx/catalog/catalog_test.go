@@ -0,0 +1,64 @@
+package catalog
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRewrite(t *testing.T) {
+	c := NewCatalog("", "host", []string{"team", "dc"}, time.Minute, time.Second)
+	c.Load([]Entry{
+		{Name: "web-02", Tags: map[string]string{"team": "frontend", "dc": "east"}},
+		{Name: "web-01", Tags: map[string]string{"team": "frontend", "dc": "west"}},
+		{Name: "db.01", Tags: map[string]string{"team": "storage", "dc": "east", "rack": "12"}},
+	})
+	cases := []struct {
+		in  []string
+		out []string
+		ok  bool
+	}{
+		{[]string{"name=cpu"}, []string{"name=cpu"}, true},
+		{[]string{"team=frontend", "name=cpu"}, []string{"host=~^(web-01|web-02)$", "name=cpu"}, true},
+		{[]string{"name=cpu", "dc!=east"}, []string{"name=cpu", "host!=~^(db\\.01|web-02)$"}, true},
+		{[]string{"name=cpu", "team=nobody"}, nil, false},
+		{[]string{"name=cpu", "team!=nobody"}, []string{"name=cpu"}, true},
+		// unsupported operators and tags which are not configured are left alone
+		{[]string{"team=~front.*", "rack=12"}, []string{"team=~front.*", "rack=12"}, true},
+	}
+	for i, c2 := range cases {
+		out, ok := c.Rewrite(c2.in)
+		if ok != c2.ok || (ok && !reflect.DeepEqual(out, c2.out)) {
+			t.Fatalf("case %d: expected %v %t, got %v %t", i, c2.out, c2.ok, out, ok)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"name": "web-01", "tags": {"team": "frontend"}}]`)
+	}))
+	defer server.Close()
+
+	c := NewCatalog(server.URL, "host", []string{"team"}, time.Minute, time.Second)
+	if err := c.sync(); err != nil {
+		t.Fatal(err)
+	}
+	out, ok := c.Rewrite([]string{"team=frontend"})
+	if !ok || !reflect.DeepEqual(out, []string{"host=~^(web-01)$"}) {
+		t.Fatalf("unexpected rewrite after sync: %v %t", out, ok)
+	}
+
+	c.url = server.URL + "/nonexistent"
+	server.Config.Handler = http.NotFoundHandler()
+	if err := c.sync(); err == nil {
+		t.Fatal("expected sync to fail")
+	}
+	// a failed sync keeps the previous state
+	if _, ok := c.Rewrite([]string{"team=frontend"}); !ok {
+		t.Fatal("expected catalog to be retained after failed sync")
+	}
+}
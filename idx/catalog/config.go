@@ -0,0 +1,59 @@
+package catalog
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/grafana/globalconf"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	Enabled  bool
+	url      string
+	interval time.Duration
+	timeout  time.Duration
+	hostTag  string
+	tagsStr  string
+	tags     []string
+)
+
+func ConfigSetup() {
+	cat := flag.NewFlagSet("catalog", flag.ExitOnError)
+	cat.BoolVar(&Enabled, "enabled", false, "enable syncing of tags from an external service catalog")
+	cat.StringVar(&url, "url", "", "http url of the json document describing the hosts in the catalog")
+	cat.DurationVar(&interval, "interval", 5*time.Minute, "how often to sync the catalog")
+	cat.DurationVar(&timeout, "timeout", 10*time.Second, "timeout for fetching the catalog")
+	cat.StringVar(&hostTag, "host-tag", "host", "tag of the series that holds the name of the host as known in the catalog")
+	cat.StringVar(&tagsStr, "tags", "datacenter,team,environment", "comma separated list of catalog tags to attach to the series of the hosts")
+	globalconf.Register("catalog", cat, flag.ExitOnError)
+}
+
+func ConfigProcess() {
+	if !Enabled {
+		return
+	}
+	if url == "" {
+		log.Fatal("catalog: url must be set")
+	}
+	if interval <= 0 || timeout <= 0 {
+		log.Fatal("catalog: interval and timeout must be greater than 0")
+	}
+	if hostTag == "" {
+		log.Fatal("catalog: host-tag must be set")
+	}
+	for _, t := range strings.Split(tagsStr, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if t == hostTag {
+			log.Fatal("catalog: tags must not include host-tag")
+		}
+		tags = append(tags, t)
+	}
+	if len(tags) == 0 {
+		log.Fatal("catalog: tags must not be empty")
+	}
+}
@@ -24,6 +24,9 @@ type Archive struct {
 	AggId    uint16 // index in mdata.aggregations (not persisted)
 	IrId     uint16 // index in mdata.indexrules (not persisted)
 	LastSave uint32 // last time the metricDefinition was saved to a backend store (cassandra)
+	// timestamp of the oldest point seen for the series. persisted by the cassandra index only.
+	// 0 if unknown, e.g. for series loaded from a backend store that doesn't persist it
+	FirstSeen int64
 }
 
 // used primarily by tests, for convenience
@@ -73,15 +76,24 @@ type MetricIndex interface {
 	// It returns a copy of all of the Archives deleted.
 	Delete(orgId uint32, pattern string) ([]Archive, error)
 
+	// DeletePreview returns a copy of all of the Archives that Delete would delete
+	// for the given pattern, without deleting them.
+	DeletePreview(orgId uint32, pattern string) ([]Archive, error)
+
 	// Find searches the index for matching nodes.
 	// * orgId describes the org to search in (public data in orgIdPublic is automatically included)
 	// * pattern is handled like graphite does. see https://graphite.readthedocs.io/en/latest/render_api.html#paths-and-wildcards
 	// * from is a unix timestamp. series not updated since then are excluded.
-	Find(orgId uint32, pattern string, from int64) ([]Node, error)
+	// * to is a unix timestamp. series first seen at or after it are excluded. 0 to disable.
+	//   series of which we don't know when they were first seen are never excluded.
+	Find(orgId uint32, pattern string, from, to int64) ([]Node, error)
 
 	// List returns all Archives for the passed OrgId and the public orgId
 	List(orgId uint32) []Archive
 
+	// ListAll returns all Archives, of all orgs
+	ListAll() []Archive
+
 	// Prune deletes all metrics that haven't been seen since the given timestamp.
 	// It returns all Archives deleted and any error encountered.
 	Prune(oldest time.Time) ([]Archive, error)
@@ -92,9 +104,11 @@ type MetricIndex interface {
 	// conditions are logically AND-ed.
 	// If the third argument is > 0 then the results will be filtered and only those
 	// where the LastUpdate time is >= from will be returned as results.
+	// If the fourth argument is > 0 then series first seen at or after it are excluded,
+	// like with Find.
 	// The returned results are not deduplicated and in certain cases it is possible
 	// that duplicate entries will be returned.
-	FindByTag(orgId uint32, expressions []string, from int64) ([]Node, error)
+	FindByTag(orgId uint32, expressions []string, from, to int64) ([]Node, error)
 
 	// Tags returns a list of all tag keys associated with the metrics of a given
 	// organization. The return values are filtered by the regex in the second parameter.
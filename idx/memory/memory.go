@@ -248,6 +248,17 @@ func bumpLastUpdate(loc *int64, newVal int64) {
 	}
 }
 
+// lowerFirstSeen lowers the FirstSeen timestamp at loc to newVal, for points that are older than
+// the oldest one seen so far. a FirstSeen of 0 means unknown, and is left alone.
+func lowerFirstSeen(loc *int64, newVal int64) {
+	for {
+		prev := atomic.LoadInt64(loc)
+		if prev == 0 || prev <= newVal || atomic.CompareAndSwapInt64(loc, prev, newVal) {
+			return
+		}
+	}
+}
+
 // Update updates an existing archive, if found.
 // It returns whether it was found, and - if so - the (updated) existing archive and its old partition
 func (m *MemoryIdx) Update(point schema.MetricPoint, partition int32) (idx.Archive, int32, bool) {
@@ -261,6 +272,7 @@ func (m *MemoryIdx) Update(point schema.MetricPoint, partition int32) (idx.Archi
 		log.Debugf("memory-idx: metricDef with id %v already in index", point.MKey)
 
 		bumpLastUpdate(&existing.LastUpdate, int64(point.Time))
+		lowerFirstSeen(&existing.FirstSeen, int64(point.Time))
 
 		oldPart := atomic.SwapInt32(&existing.Partition, partition)
 		statUpdate.Inc()
@@ -284,6 +296,7 @@ func (m *MemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, parti
 	if ok {
 		log.Debugf("memory-idx: metricDef with id %s already in index.", mkey)
 		bumpLastUpdate(&existing.LastUpdate, data.Time)
+		lowerFirstSeen(&existing.FirstSeen, data.Time)
 		oldPart := atomic.SwapInt32(&existing.Partition, partition)
 		statUpdate.Inc()
 		statUpdateDuration.Value(time.Since(pre))
@@ -298,6 +311,8 @@ func (m *MemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, parti
 	def := schema.MetricDefinitionFromMetricData(data)
 	def.Partition = partition
 	archive := m.add(def)
+	m.defById[def.Id].FirstSeen = data.Time
+	archive.FirstSeen = data.Time
 	statMetricsActive.Inc()
 	statAddDuration.Value(time.Since(pre))
 
@@ -312,10 +327,15 @@ func (m *MemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, parti
 func (m *MemoryIdx) UpdateArchive(archive idx.Archive) {
 	m.Lock()
 	defer m.Unlock()
-	if _, ok := m.defById[archive.Id]; !ok {
+	existing, ok := m.defById[archive.Id]
+	if !ok {
 		return
 	}
-	*(m.defById[archive.Id]) = archive
+	// the first seen timestamp may have been lowered since the archive was read
+	if archive.FirstSeen == 0 || (existing.FirstSeen != 0 && existing.FirstSeen < archive.FirstSeen) {
+		archive.FirstSeen = existing.FirstSeen
+	}
+	*existing = archive
 }
 
 // indexTags reads the tags of a given metric definition and creates the
@@ -407,11 +427,27 @@ func (m *MemoryIdx) Load(defs []schema.MetricDefinition) int {
 	return num
 }
 
+// LoadFirstSeen sets the first seen timestamps, as loaded from a persistent store, of the given series.
+// series that are not in the index are ignored, and timestamps that are not older than the known one are too.
+func (m *MemoryIdx) LoadFirstSeen(firstSeen map[schema.MKey]int64) {
+	m.RLock()
+	defer m.RUnlock()
+	for id, ts := range firstSeen {
+		existing, ok := m.defById[id]
+		if !ok {
+			continue
+		}
+		if !atomic.CompareAndSwapInt64(&existing.FirstSeen, 0, ts) {
+			lowerFirstSeen(&existing.FirstSeen, ts)
+		}
+	}
+}
+
 func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 	path := def.NameWithTags()
 
-	schemaId, _ := mdata.MatchSchema(path, def.Interval)
-	aggId, _ := mdata.MatchAgg(path)
+	schemaId, _ := mdata.MatchSchema(def.OrgId, path, def.Interval)
+	aggId, _ := mdata.MatchAgg(def.OrgId, path)
 	irId, _ := IndexRules.Match(path)
 	sort.Strings(def.Tags)
 	archive := &idx.Archive{
@@ -863,7 +899,7 @@ func (m *MemoryIdx) hasOneMetricFrom(tags TagIndex, tag string, from int64) bool
 	return false
 }
 
-func (m *MemoryIdx) FindByTag(orgId uint32, expressions []string, from int64) ([]idx.Node, error) {
+func (m *MemoryIdx) FindByTag(orgId uint32, expressions []string, from, to int64) ([]idx.Node, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -873,6 +909,7 @@ func (m *MemoryIdx) FindByTag(orgId uint32, expressions []string, from int64) ([
 	if err != nil {
 		return nil, err
 	}
+	query.to = to
 
 	m.RLock()
 	defer m.RUnlock()
@@ -918,7 +955,7 @@ func (m *MemoryIdx) idsByTagQuery(orgId uint32, query TagQuery) IdSet {
 	return query.Run(tags, m.defById)
 }
 
-func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node, error) {
+func (m *MemoryIdx) Find(orgId uint32, pattern string, from, to int64) ([]idx.Node, error) {
 	pre := time.Now()
 	m.RLock()
 	defer m.RUnlock()
@@ -956,6 +993,11 @@ func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node,
 						log.Debugf("memory-idx: from is %d, so skipping %s which has LastUpdate %d", from, def.Id, atomic.LoadInt64(&def.LastUpdate))
 						continue
 					}
+					if firstSeen := atomic.LoadInt64(&def.FirstSeen); to != 0 && firstSeen >= to {
+						statFiltered.Inc()
+						log.Debugf("memory-idx: to is %d, so skipping %s which was first seen at %d", to, def.Id, firstSeen)
+						continue
+					}
 					log.Debugf("memory-idx: Find: adding to path %s archive id=%s name=%s int=%d schemaId=%d aggId=%d irId=%d lastSave=%d", n.Path, def.Id, def.Name, def.Interval, def.SchemaId, def.AggId, def.IrId, def.LastSave)
 					idxNode.Defs = append(idxNode.Defs, *def)
 				}
@@ -1084,6 +1126,17 @@ func (m *MemoryIdx) List(orgId uint32) []idx.Archive {
 	return defs
 }
 
+func (m *MemoryIdx) ListAll() []idx.Archive {
+	m.RLock()
+	defer m.RUnlock()
+
+	defs := make([]idx.Archive, 0, len(m.defById))
+	for _, def := range m.defById {
+		defs = append(defs, *def)
+	}
+	return defs
+}
+
 func (m *MemoryIdx) DeleteTagged(orgId uint32, paths []string) ([]idx.Archive, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
@@ -1173,6 +1226,40 @@ func (m *MemoryIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error)
 	return deletedDefs, nil
 }
 
+func (m *MemoryIdx) DeletePreview(orgId uint32, pattern string) ([]idx.Archive, error) {
+	m.RLock()
+	defer m.RUnlock()
+	found, err := m.find(orgId, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var defs []idx.Archive
+	for _, f := range found {
+		defs = m.collectDefs(orgId, f, defs)
+	}
+	return defs, nil
+}
+
+// collectDefs appends the archives of the node and all nodes under it, i.e. those
+// that delete() would delete, to defs. It assumes a lock is already held.
+func (m *MemoryIdx) collectDefs(orgId uint32, n *Node, defs []idx.Archive) []idx.Archive {
+	tree := m.tree[orgId]
+	for _, child := range n.Children {
+		node, ok := tree.Items[n.Path+"."+child]
+		if !ok {
+			corruptIndex.Inc()
+			log.Errorf("memory-idx: node %q missing. Index is corrupt.", n.Path+"."+child)
+			continue
+		}
+		defs = m.collectDefs(orgId, node, defs)
+	}
+	for _, id := range n.Defs {
+		defs = append(defs, *m.defById[id])
+	}
+	return defs
+}
+
 func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChildren bool) []idx.Archive {
 	tree := m.tree[orgId]
 	deletedDefs := make([]idx.Archive, 0)
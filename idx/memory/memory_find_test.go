@@ -411,7 +411,7 @@ func TestTagSorting(t *testing.T) {
 	md1.Tags = []string{"d=a", "b=a", "c=a", "a=a", "e=a"}
 	index.AddOrUpdate(mkey, md1, 1)
 
-	res, err := index.FindByTag(1, []string{"b=a"}, 0)
+	res, err := index.FindByTag(1, []string{"b=a"}, 0, 0)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -439,7 +439,7 @@ func TestTagSorting(t *testing.T) {
 	md2[0].Tags = []string{"5=a", "1=a", "2=a", "4=a", "3=a"}
 	index.Load(md2)
 
-	res, err = index.FindByTag(1, []string{"3=a"}, 0)
+	res, err = index.FindByTag(1, []string{"3=a"}, 0, 0)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -688,7 +688,7 @@ func BenchmarkTagsWithoutFromNorFilter(b *testing.B) {
 
 func ixFind(b *testing.B, org uint32, q int) {
 	b.Helper()
-	nodes, err := ix.Find(org, queries[q].Pattern, 0)
+	nodes, err := ix.Find(org, queries[q].Pattern, 0, 0)
 	if err != nil {
 		panic(err)
 	}
@@ -762,7 +762,7 @@ func BenchmarkConcurrent8Find(b *testing.B) {
 }
 
 func ixFindByTag(b *testing.B, org uint32, q int) {
-	series, err := ix.FindByTag(org, tagQueries[q].Expressions, 0)
+	series, err := ix.FindByTag(org, tagQueries[q].Expressions, 0, 0)
 	if err != nil {
 		panic(err)
 	}
@@ -863,7 +863,7 @@ func BenchmarkTagQueryFilterAndIntersect(b *testing.B) {
 
 	for n := 0; n < b.N; n++ {
 		q := queries[n%len(queries)]
-		series, err := ix.FindByTag(1, q.Expressions, 150000)
+		series, err := ix.FindByTag(1, q.Expressions, 150000, 0)
 		if err != nil {
 			b.Fatalf(err.Error())
 		}
@@ -889,7 +889,7 @@ func BenchmarkTagQueryFilterAndIntersectOnlyRegex(b *testing.B) {
 
 	for n := 0; n < b.N; n++ {
 		q := queries[n%len(queries)]
-		series, err := ix.FindByTag(1, q.Expressions, 0)
+		series, err := ix.FindByTag(1, q.Expressions, 0, 0)
 		if err != nil {
 			b.Fatalf(err.Error())
 		}
@@ -3,7 +3,9 @@ package memory
 import (
 	"crypto/rand"
 	"fmt"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -130,7 +132,7 @@ func testGetAddKey(t *testing.T) {
 	if TagSupport {
 		Convey("When adding metricDefs with the same series name as existing metricDefs (tagged)", t, func() {
 			Convey("then findByTag", func() {
-				nodes, err := ix.FindByTag(1, []string{"name!="}, 0)
+				nodes, err := ix.FindByTag(1, []string{"name!="}, 0, 0)
 				So(err, ShouldBeNil)
 				defs := make([]idx.Archive, 0, len(nodes))
 				for i := range nodes {
@@ -196,7 +198,7 @@ func testFind(t *testing.T) {
 
 	Convey("When listing root nodes", t, func() {
 		Convey("root nodes for orgId 1", func() {
-			nodes, err := ix.Find(1, "*", 0)
+			nodes, err := ix.Find(1, "*", 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 2)
 			So(nodes[0].Path, ShouldBeIn, "metric", "foo")
@@ -204,7 +206,7 @@ func testFind(t *testing.T) {
 			So(nodes[0].Leaf, ShouldBeFalse)
 		})
 		Convey("root nodes for orgId 2", func() {
-			nodes, err := ix.Find(2, "*", 0)
+			nodes, err := ix.Find(2, "*", 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 1)
 			So(nodes[0].Path, ShouldEqual, "metric")
@@ -213,7 +215,7 @@ func testFind(t *testing.T) {
 	})
 
 	Convey("When searching with GLOB", t, func() {
-		nodes, err := ix.Find(2, "metric.{f*,demo}.*", 0)
+		nodes, err := ix.Find(2, "metric.{f*,demo}.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 10)
 		for _, n := range nodes {
@@ -222,7 +224,7 @@ func testFind(t *testing.T) {
 	})
 
 	Convey("When searching with multiple wildcards", t, func() {
-		nodes, err := ix.Find(1, "*.*", 0)
+		nodes, err := ix.Find(1, "*.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 2)
 		for _, n := range nodes {
@@ -231,24 +233,24 @@ func testFind(t *testing.T) {
 	})
 
 	Convey("When searching nodes not in public series", t, func() {
-		nodes, err := ix.Find(1, "foo.demo.*", 0)
+		nodes, err := ix.Find(1, "foo.demo.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 5)
 		Convey("When searching for specific series", func() {
-			found, err := ix.Find(1, nodes[0].Path, 0)
+			found, err := ix.Find(1, nodes[0].Path, 0, 0)
 			So(err, ShouldBeNil)
 			So(found, ShouldHaveLength, 1)
 			So(found[0].Path, ShouldEqual, nodes[0].Path)
 		})
 		Convey("When searching nodes that are children of a leaf", func() {
-			found, err := ix.Find(1, nodes[0].Path+".*", 0)
+			found, err := ix.Find(1, nodes[0].Path+".*", 0, 0)
 			So(err, ShouldBeNil)
 			So(found, ShouldHaveLength, 0)
 		})
 	})
 
 	Convey("When searching with multiple wildcards mixed leaf/branch", t, func() {
-		nodes, err := ix.Find(1, "*.demo.*", 0)
+		nodes, err := ix.Find(1, "*.demo.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 15)
 		for _, n := range nodes {
@@ -261,26 +263,26 @@ func testFind(t *testing.T) {
 		}
 	})
 	Convey("When searching nodes for unknown orgId", t, func() {
-		nodes, err := ix.Find(4, "foo.demo.*", 0)
+		nodes, err := ix.Find(4, "foo.demo.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 0)
 	})
 
 	Convey("When searching nodes that don't exist", t, func() {
-		nodes, err := ix.Find(1, "foo.demo.blah.*", 0)
+		nodes, err := ix.Find(1, "foo.demo.blah.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 0)
 	})
 
 	Convey("When searching with from timestamp", t, func() {
-		nodes, err := ix.Find(1, "*.demo.*", 4*86400)
+		nodes, err := ix.Find(1, "*.demo.*", 4*86400, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 10)
 		for _, n := range nodes {
 			So(n.Path, ShouldNotContainSubstring, "foo.demo")
 		}
 		Convey("When searching with from timestamp on series with multiple defs.", func() {
-			nodes, err := ix.Find(1, "*.demo.*", 2*86400)
+			nodes, err := ix.Find(1, "*.demo.*", 2*86400, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 15)
 			for _, n := range nodes {
@@ -293,6 +295,76 @@ func testFind(t *testing.T) {
 
 }
 
+func TestFindFirstSeen(t *testing.T) {
+	_tagSupport := TagSupport
+	defer func() { TagSupport = _tagSupport }()
+	TagSupport = true
+
+	ix := New()
+	ix.Init()
+	add := func(name string, ts int64) {
+		data := &schema.MetricData{
+			Name:     name,
+			Interval: 10,
+			OrgId:    1,
+			Time:     ts,
+		}
+		data.SetId()
+		mkey, err := schema.MKeyFromString(data.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, data, 1)
+	}
+	add("a.old", 100)
+	add("a.old", 200)
+	// an older point lowers the first seen timestamp
+	add("a.backfilled", 120)
+	add("a.backfilled", 80)
+	add("a.new", 300)
+	// series loaded from a backend store have an unknown first seen timestamp, and are never excluded
+	loaded := schema.MetricDefinition{Name: "a.loaded", Interval: 10, OrgId: 1, LastUpdate: 300}
+	loaded.SetId()
+	ix.Load([]schema.MetricDefinition{loaded})
+
+	cases := []struct {
+		to  int64
+		exp []string
+	}{
+		{0, []string{"a.backfilled", "a.loaded", "a.new", "a.old"}},
+		{300, []string{"a.backfilled", "a.loaded", "a.old"}},
+		{100, []string{"a.backfilled", "a.loaded"}},
+		{80, []string{"a.loaded"}},
+	}
+	for i, c := range cases {
+		nodes, err := ix.Find(1, "a.*", 0, c.to)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %s", i, err)
+		}
+		var paths []string
+		for _, n := range nodes {
+			paths = append(paths, n.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.exp) {
+			t.Fatalf("case %d: Find with to %d: expected %v, got %v", i, c.to, c.exp, paths)
+		}
+
+		nodes, err = ix.FindByTag(1, []string{"name=~a\\..*"}, 0, c.to)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %s", i, err)
+		}
+		paths = paths[:0]
+		for _, n := range nodes {
+			paths = append(paths, n.Path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.exp) {
+			t.Fatalf("case %d: FindByTag with to %d: expected %v, got %v", i, c.to, c.exp, paths)
+		}
+	}
+}
+
 func TestDelete(t *testing.T) {
 	testWithAndWithoutTagSupport(t, testDelete)
 }
@@ -355,11 +427,11 @@ func TestDeleteTagged(t *testing.T) {
 		So(ids, ShouldHaveLength, 1)
 		So(ids[0].Id.String(), ShouldEqual, org1Series[3].Id)
 		Convey("series should not be present in the metricDef index", func() {
-			nodes, err := ix.FindByTag(1, []string{"series_id=3"}, 0)
+			nodes, err := ix.FindByTag(1, []string{"series_id=3"}, 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 0)
 			Convey("but others should still be present", func() {
-				nodes, err := ix.FindByTag(1, []string{"series_id=~[0-9]"}, 0)
+				nodes, err := ix.FindByTag(1, []string{"series_id=~[0-9]"}, 0, 0)
 				So(err, ShouldBeNil)
 				So(nodes, ShouldHaveLength, 4)
 			})
@@ -536,10 +608,10 @@ func testMixedBranchLeafDelete(t *testing.T) {
 			_, ok := ix.Get(mkeys[0])
 			So(ok, ShouldEqual, false)
 			Convey("series should not be present in searches", func() {
-				found, err := ix.Find(1, "a.b.c", 0)
+				found, err := ix.Find(1, "a.b.c", 0, 0)
 				So(err, ShouldBeNil)
 				So(found, ShouldHaveLength, 0)
-				found, err = ix.Find(1, "a.b.c.d", 0)
+				found, err = ix.Find(1, "a.b.c.d", 0, 0)
 				So(err, ShouldBeNil)
 				So(found, ShouldHaveLength, 0)
 			})
@@ -557,10 +629,10 @@ func testMixedBranchLeafDelete(t *testing.T) {
 			_, ok := ix.Get(mkeys[3])
 			So(ok, ShouldEqual, false)
 			Convey("deleted series should not be present in searches", func() {
-				found, err := ix.Find(1, "a.b.c2.*", 0)
+				found, err := ix.Find(1, "a.b.c2.*", 0, 0)
 				So(err, ShouldBeNil)
 				So(found, ShouldHaveLength, 1)
-				found, err = ix.Find(1, "a.b.c2.d", 0)
+				found, err = ix.Find(1, "a.b.c2.d", 0, 0)
 				So(err, ShouldBeNil)
 				So(found, ShouldHaveLength, 0)
 			})
@@ -568,6 +640,57 @@ func testMixedBranchLeafDelete(t *testing.T) {
 	})
 }
 
+func TestDeletePreview(t *testing.T) {
+	ix := New()
+	ix.Init()
+	for _, name := range []string{"a.b.c", "a.b.c.d", "a.b.c2", "a.b.c2.d.e", "a.b2"} {
+		data := &schema.MetricData{
+			Name:     name,
+			Interval: 10,
+			OrgId:    1,
+		}
+		data.SetId()
+		ix.AddOrUpdate(test.MustMKeyFromString(data.Id), data, 1)
+	}
+	names := func(defs []idx.Archive) []string {
+		var names []string
+		for _, d := range defs {
+			names = append(names, d.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, pattern := range []string{"a.b.c", "a.b.c2", "a.*.c*", "foo"} {
+		preview, err := ix.DeletePreview(1, pattern)
+		if err != nil {
+			t.Fatalf("pattern %q: unexpected error: %s", pattern, err)
+		}
+		// the preview must not delete anything
+		if len(ix.List(1)) != 5 {
+			t.Fatalf("pattern %q: expected preview to leave the index alone", pattern)
+		}
+		c := New()
+		c.Init()
+		c.Load(exportDefs(ix.List(1)))
+		deleted, err := c.Delete(1, pattern)
+		if err != nil {
+			t.Fatalf("pattern %q: unexpected error: %s", pattern, err)
+		}
+		if !reflect.DeepEqual(names(preview), names(deleted)) {
+			t.Fatalf("pattern %q: preview %v does not match deleted %v", pattern, names(preview), names(deleted))
+		}
+	}
+}
+
+func exportDefs(archives []idx.Archive) []schema.MetricDefinition {
+	defs := make([]schema.MetricDefinition, len(archives))
+	for i, a := range archives {
+		defs[i] = a.MetricDefinition
+	}
+	return defs
+}
+
 func TestPruneTaggedSeries(t *testing.T) {
 
 	IndexRules = conf.IndexRules{
@@ -630,13 +753,13 @@ func TestPruneTaggedSeries(t *testing.T) {
 		pruned, err := ix.Prune(time.Unix(100, 0)) // old series should be gone
 		So(err, ShouldBeNil)
 		So(pruned, ShouldHaveLength, 5)
-		nodes, err := ix.FindByTag(1, []string{"name=~longterm\\.old.*", "series_id=~[0-4]"}, 0)
+		nodes, err := ix.FindByTag(1, []string{"name=~longterm\\.old.*", "series_id=~[0-4]"}, 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 0)
-		nodes, err = ix.FindByTag(1, []string{"name=~longterm.*", "series_id=~[0-4]"}, 0)
+		nodes, err = ix.FindByTag(1, []string{"name=~longterm.*", "series_id=~[0-4]"}, 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 5)
-		nodes, err = ix.FindByTag(1, []string{"name=~metric\\.never\\.exp.*", "series_id=~[0-4]"}, 0)
+		nodes, err = ix.FindByTag(1, []string{"name=~metric\\.never\\.exp.*", "series_id=~[0-4]"}, 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 5)
 	})
@@ -670,10 +793,10 @@ func TestPruneTaggedSeries(t *testing.T) {
 			pruned, err := ix.Prune(time.Unix(120, 0))
 			So(err, ShouldBeNil)
 			So(pruned, ShouldHaveLength, 4)
-			nodes, err := ix.FindByTag(1, []string{"name=~longterm", "series_id=~[0-4]"}, 0)
+			nodes, err := ix.FindByTag(1, []string{"name=~longterm", "series_id=~[0-4]"}, 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 1)
-			nodes, err = ix.FindByTag(1, []string{"name=~metric\\.never.*", "series_id=~[0-4]"}, 0)
+			nodes, err = ix.FindByTag(1, []string{"name=~metric\\.never.*", "series_id=~[0-4]"}, 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 5)
 		})
@@ -734,7 +857,7 @@ func TestPruneTaggedSeriesWithCollidingTagSets(t *testing.T) {
 	})
 
 	Convey("After pruning", t, func() {
-		nodes, err := ix.FindByTag(1, findExpressions, 0)
+		nodes, err := ix.FindByTag(1, findExpressions, 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 1)
 		defs := make([]idx.Archive, 0, len(nodes))
@@ -751,7 +874,7 @@ func TestPruneTaggedSeriesWithCollidingTagSets(t *testing.T) {
 	})
 
 	Convey("After pruning", t, func() {
-		nodes, err := ix.FindByTag(1, findExpressions, 0)
+		nodes, err := ix.FindByTag(1, findExpressions, 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 0)
 	})
@@ -811,10 +934,10 @@ func testPrune(t *testing.T) {
 		pruned, err := ix.Prune(time.Unix(11, 0))
 		So(err, ShouldBeNil)
 		So(pruned, ShouldHaveLength, 5)
-		nodes, err := ix.Find(1, "metric.bah.*", 0)
+		nodes, err := ix.Find(1, "metric.bah.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 0)
-		nodes, err = ix.Find(1, "metric.foo.*", 0)
+		nodes, err = ix.Find(1, "metric.foo.*", 0, 0)
 		So(err, ShouldBeNil)
 		So(nodes, ShouldHaveLength, 5)
 
@@ -839,7 +962,7 @@ func testPrune(t *testing.T) {
 			pruned, err := ix.Prune(time.Unix(12, 0))
 			So(err, ShouldBeNil)
 			So(pruned, ShouldHaveLength, 4)
-			nodes, err := ix.Find(1, "metric.foo.*", 0)
+			nodes, err := ix.Find(1, "metric.foo.*", 0, 0)
 			So(err, ShouldBeNil)
 			So(nodes, ShouldHaveLength, 1)
 		})
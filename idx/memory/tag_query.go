@@ -83,6 +83,8 @@ func (a KvReByCost) Less(i, j int) bool { return a[i].cost < a[j].cost }
 type TagQuery struct {
 	// clause that operates on LastUpdate field
 	from int64
+	// clause that operates on FirstSeen field. 0 means disabled
+	to int64
 
 	// clauses that operate on values. from expressions like tag<operator>value
 	equal    []kv   // EQUAL
@@ -655,9 +657,17 @@ func (q *TagQuery) testByTagMatch(def *idx.Archive) bool {
 	return false
 }
 
-// testByFrom filters a given metric by its LastUpdate time
+// testByFrom filters a given metric by its LastUpdate time,
+// and if to is set, by its FirstSeen time
 func (q *TagQuery) testByFrom(def *idx.Archive) bool {
-	return q.from <= atomic.LoadInt64(&def.LastUpdate)
+	if q.from > atomic.LoadInt64(&def.LastUpdate) {
+		return false
+	}
+	if q.to == 0 {
+		return true
+	}
+	firstSeen := atomic.LoadInt64(&def.FirstSeen)
+	return firstSeen == 0 || firstSeen < q.to
 }
 
 // testByPrefix filters a given metric by matching prefixes against the values
@@ -0,0 +1,85 @@
+package amqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/grafana/metrictank/input"
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+	streadway "github.com/streadway/amqp"
+)
+
+type mockHandler struct {
+	err error
+	mds []*schema.MetricData
+}
+
+func (m *mockHandler) ProcessMetricData(md *schema.MetricData, partition int32) error {
+	m.mds = append(m.mds, md)
+	return m.err
+}
+
+func (m *mockHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
+	return m.err
+}
+
+// mockAcknowledger records the acks and nacks of deliveries
+type mockAcknowledger struct {
+	acks  int
+	nacks int
+}
+
+func (m *mockAcknowledger) Ack(tag uint64, multiple bool) error {
+	m.acks++
+	return nil
+}
+
+func (m *mockAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		return errors.New("unexpected requeue")
+	}
+	m.nacks++
+	return nil
+}
+
+func (m *mockAcknowledger) Reject(tag uint64, requeue bool) error {
+	return errors.New("unexpected reject")
+}
+
+func TestHandleDelivery(t *testing.T) {
+	md := schema.MetricData{
+		OrgId:    1,
+		Name:     "some.metric",
+		Interval: 10,
+		Value:    1,
+		Time:     10,
+		Mtype:    "gauge",
+	}
+	md.SetId()
+	valid, err := md.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &mockHandler{}
+	a := &Amqp{Handler: handler}
+	ack := &mockAcknowledger{}
+
+	a.handleDelivery(streadway.Delivery{Acknowledger: ack, Body: valid})
+	if ack.acks != 1 || ack.nacks != 0 || len(handler.mds) != 1 || handler.mds[0].Id != md.Id {
+		t.Fatalf("expected valid message to be processed and acked. acks %d, nacks %d, processed %v", ack.acks, ack.nacks, handler.mds)
+	}
+
+	decodeErrs := rejected[input.ReasonDecode].Peek()
+	a.handleDelivery(streadway.Delivery{Acknowledger: ack, Body: []byte("garbage")})
+	if ack.acks != 1 || ack.nacks != 1 || rejected[input.ReasonDecode].Peek() != decodeErrs+1 {
+		t.Fatalf("expected undecodable message to be nacked. acks %d, nacks %d", ack.acks, ack.nacks)
+	}
+
+	handler.err = input.RejectError{Reason: input.ReasonTimeTooOld, Err: errors.New("too old")}
+	a.handleDelivery(streadway.Delivery{Acknowledger: ack, Body: valid})
+	if ack.acks != 1 || ack.nacks != 2 || rejected[input.ReasonTimeTooOld].Peek() != 1 {
+		t.Fatalf("expected rejected message to be nacked. acks %d, nacks %d", ack.acks, ack.nacks)
+	}
+}
@@ -1,10 +1,15 @@
 // package carbon provides a traditional carbon input for metrictank
-// note: it does not support the "carbon2.0" protocol that serializes metrics2.0 into a plaintext carbon-like protocol
+// it supports graphite-style tags ("some.name;tag=value") and optionally metrics 2.0 keys
+// in the carbon format (e.g. "unit=B.mtype=gauge.what=disk_used.host=web1"), where the
+// intrinsic tags form the identity of the series.
+// note: it does not support meta tags of the "carbon2.0" protocol
 package carbon
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"io"
 	"net"
@@ -26,11 +31,19 @@ var metricsPerMessage = stats.NewMeter32("input.carbon.metrics_per_message", fal
 // metric input.carbon.metrics_decode_err is a count of times an input message (MetricData, MetricDataArray or carbon line) failed to parse
 var metricsDecodeErr = stats.NewCounterRate32("input.carbon.metrics_decode_err")
 
+// metric input.carbon.udp.datagrams is a count of udp datagrams received
+var udpDatagrams = stats.NewCounterRate32("input.carbon.udp.datagrams")
+
+// metric input.carbon.udp.oversized is a count of udp datagrams dropped because they exceeded udp-max-datagram-size
+var udpOversized = stats.NewCounterRate32("input.carbon.udp.oversized")
+
 type Carbon struct {
 	input.Handler
 	addrStr          string
 	addr             *net.TCPAddr
 	listener         *net.TCPListener
+	udpAddr          *net.UDPAddr // nil if the udp listener is disabled
+	udpConn          *net.UDPConn
 	handlerWaitGroup sync.WaitGroup
 	quit             chan struct{}
 	connTrack        *ConnTrack
@@ -74,13 +87,22 @@ func (c *Carbon) Name() string {
 
 var Enabled bool
 var addr string
+var udpAddr string
+var udpMaxDatagramSize int
 var partitionId int
+var metrics20 bool
+
+var errM20NoWhat = errors.New("metrics 2.0 key has no what tag")
+var errM20NotKV = errors.New("metrics 2.0 key has a node that is not a tag=value pair")
 
 func ConfigSetup() {
 	inCarbon := flag.NewFlagSet("carbon-in", flag.ExitOnError)
 	inCarbon.BoolVar(&Enabled, "enabled", false, "")
 	inCarbon.StringVar(&addr, "addr", ":2003", "tcp listen address")
+	inCarbon.StringVar(&udpAddr, "udp-addr", "", "udp listen address. each datagram holds one or more newline separated lines. empty to disable")
+	inCarbon.IntVar(&udpMaxDatagramSize, "udp-max-datagram-size", 8192, "max size of udp datagrams in bytes. larger datagrams are dropped")
 	inCarbon.IntVar(&partitionId, "partition", 0, "partition Id.")
+	inCarbon.BoolVar(&metrics20, "metrics20", false, "interpret metrics 2.0 keys (e.g. unit=B.mtype=gauge.what=disk_used.host=web1) as tagged series. the what tag becomes the name, intrinsic tags form the series identity")
 	globalconf.Register("carbon-in", inCarbon, flag.ExitOnError)
 }
 
@@ -88,6 +110,9 @@ func ConfigProcess() {
 	if !Enabled {
 		return
 	}
+	if udpMaxDatagramSize < 1 {
+		log.Fatal("carbon-in: udp-max-datagram-size must be positive")
+	}
 	cluster.Manager.SetPartitions([]int32{int32(partitionId)})
 }
 
@@ -96,11 +121,18 @@ func New() *Carbon {
 	if err != nil {
 		log.Fatalf("carbon-in: %s", err.Error())
 	}
-	return &Carbon{
+	c := &Carbon{
 		addrStr:   addr,
 		addr:      addrT,
 		connTrack: NewConnTrack(),
 	}
+	if udpAddr != "" {
+		c.udpAddr, err = net.ResolveUDPAddr("udp", udpAddr)
+		if err != nil {
+			log.Fatalf("carbon-in: %s", err.Error())
+		}
+	}
+	return c
 }
 
 func (c *Carbon) IntervalGetter(i IntervalGetter) {
@@ -117,6 +149,17 @@ func (c *Carbon) Start(handler input.Handler, cancel context.CancelFunc) error {
 	c.listener = l
 	log.Infof("carbon-in: listening on %v/tcp", c.addr)
 	c.quit = make(chan struct{})
+	if c.udpAddr != nil {
+		c.udpConn, err = net.ListenUDP("udp", c.udpAddr)
+		if err != nil {
+			log.Errorf("carbon-in: %s", err.Error())
+			l.Close()
+			return err
+		}
+		log.Infof("carbon-in: listening on %v/udp", c.udpAddr)
+		c.handlerWaitGroup.Add(1)
+		go c.handleUDP()
+	}
 	go c.accept()
 	return nil
 }
@@ -154,6 +197,9 @@ func (c *Carbon) Stop() {
 	log.Infof("carbon-in: shutting down.")
 	close(c.quit)
 	c.listener.Close()
+	if c.udpConn != nil {
+		c.udpConn.Close()
+	}
 	c.connTrack.CloseAll()
 	c.handlerWaitGroup.Wait()
 }
@@ -182,27 +228,131 @@ func (c *Carbon) handle(conn net.Conn) {
 			break
 		}
 
-		// no validation for m2.0 to provide a grace period in adopting new clients
-		key, val, ts, err := carbon20.ValidatePacket(buf, carbon20.MediumLegacy, carbon20.NoneM20)
+		c.processLine(buf)
+	}
+	c.handlerWaitGroup.Done()
+}
+
+// handleUDP reads datagrams, each of which holds one or more newline separated lines.
+// as udp is fire-and-forget, the senders don't learn about datagrams we drop.
+func (c *Carbon) handleUDP() {
+	defer c.handlerWaitGroup.Done()
+	// one more byte than the max size, so we can tell oversized datagrams from those that exactly fit
+	buf := make([]byte, udpMaxDatagramSize+1)
+	for {
+		n, _, err := c.udpConn.ReadFromUDP(buf)
 		if err != nil {
-			metricsDecodeErr.Inc()
-			log.Errorf("carbon-in: invalid metric: %s", err.Error())
+			select {
+			case <-c.quit:
+				// we are shutting down.
+				return
+			default:
+			}
+			log.Errorf("carbon-in: udp recv error: %s", err.Error())
+			continue
+		}
+		udpDatagrams.Inc()
+		if n > udpMaxDatagramSize {
+			udpOversized.Inc()
+			log.Debugf("carbon-in: dropping udp datagram exceeding udp-max-datagram-size %d", udpMaxDatagramSize)
 			continue
 		}
+		c.processDatagram(buf[:n])
+	}
+}
+
+// processDatagram processes all newline separated lines in the datagram
+func (c *Carbon) processDatagram(data []byte) {
+	for len(data) > 0 {
+		var line []byte
+		pos := bytes.IndexByte(data, '\n')
+		if pos == -1 {
+			line, data = data, nil
+		} else {
+			line, data = data[:pos], data[pos+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+		c.processLine(line)
+	}
+}
+
+// processLine parses a carbon line and hands the metric to the handler
+func (c *Carbon) processLine(buf []byte) {
+	// no validation for m2.0 to provide a grace period in adopting new clients
+	key, val, ts, err := carbon20.ValidatePacket(buf, carbon20.MediumLegacy, carbon20.NoneM20)
+	if err != nil {
+		metricsDecodeErr.Inc()
+		log.Errorf("carbon-in: invalid metric: %s", err.Error())
+		return
+	}
+	md, err := c.newMetricData(key, val, ts)
+	if err != nil {
+		metricsDecodeErr.Inc()
+		log.Errorf("carbon-in: invalid metric %q: %s", key, err.Error())
+		return
+	}
+	metricsPerMessage.ValueUint32(1)
+	c.Handler.ProcessMetricData(md, int32(partitionId))
+}
+
+// newMetricData creates a MetricData out of the given (validated) carbon key, value and timestamp
+func (c *Carbon) newMetricData(key []byte, val float64, ts uint32) (*schema.MetricData, error) {
+	var md *schema.MetricData
+	// graphite style tags take precedence: "foo=bar;baz=qux" is a graphite name with a tag, not a metrics 2.0 key
+	if metrics20 && bytes.IndexByte(key, ';') == -1 && carbon20.GetVersionB(key) == carbon20.M20 {
+		err := carbon20.ValidateKeyM20B(key, carbon20.MediumM20)
+		if err != nil {
+			return nil, err
+		}
+		md, err = parseMetrics20(string(key))
+		if err != nil {
+			return nil, err
+		}
+	} else {
 		nameSplits := strings.Split(string(key), ";")
-		md := &schema.MetricData{
-			Name:     nameSplits[0],
-			Interval: c.intervalGetter.GetInterval(nameSplits[0]),
-			Value:    val,
-			Unit:     "unknown",
-			Time:     int64(ts),
-			Mtype:    "gauge",
-			Tags:     nameSplits[1:],
-			OrgId:    1, // admin org
+		md = &schema.MetricData{
+			Name:  nameSplits[0],
+			Unit:  "unknown",
+			Mtype: "gauge",
+			Tags:  nameSplits[1:],
 		}
-		md.SetId()
-		metricsPerMessage.ValueUint32(1)
-		c.Handler.ProcessMetricData(md, int32(partitionId))
 	}
-	c.handlerWaitGroup.Done()
+	md.Interval = c.intervalGetter.GetInterval(md.Name)
+	md.Value = val
+	md.Time = int64(ts)
+	md.OrgId = 1 // admin org
+	md.SetId()
+	return md, nil
+}
+
+// parseMetrics20 parses a metrics 2.0 key such as unit=B.mtype=gauge.what=disk_used.host=web1
+// into a MetricData without data, interval or org.
+// the unit and mtype tags populate the respective fields, the what tag becomes the name
+// and all other tags are stored as tags.
+func parseMetrics20(key string) (*schema.MetricData, error) {
+	md := &schema.MetricData{}
+	for _, node := range strings.Split(key, ".") {
+		pos := strings.Index(node, "=")
+		if pos < 1 || pos == len(node)-1 {
+			return nil, errM20NotKV
+		}
+		tag, val := node[:pos], node[pos+1:]
+		switch tag {
+		case "unit":
+			md.Unit = val
+		case "mtype":
+			md.Mtype = val
+		case "what":
+			md.Name = val
+		default:
+			md.Tags = append(md.Tags, node)
+		}
+	}
+	if md.Name == "" {
+		return nil, errM20NoWhat
+	}
+	return md, nil
 }
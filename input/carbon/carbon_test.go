@@ -0,0 +1,137 @@
+package carbon
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+type fixedIntervalGetter int
+
+func (f fixedIntervalGetter) GetInterval(name string) int {
+	return int(f)
+}
+
+func TestNewMetricData(t *testing.T) {
+	c := &Carbon{intervalGetter: fixedIntervalGetter(10)}
+	defer func(orig bool) { metrics20 = orig }(metrics20)
+
+	cases := []struct {
+		metrics20 bool
+		key       string
+		expErr    bool
+		expName   string
+		expUnit   string
+		expMtype  string
+		expTags   []string
+	}{
+		{false, "some.legacy.metric", false, "some.legacy.metric", "unknown", "gauge", []string{}},
+		{false, "some.metric;host=a;dc=b", false, "some.metric", "unknown", "gauge", []string{"dc=b", "host=a"}},
+		// when metrics20 is disabled, metrics 2.0 keys are treated as graphite names
+		{false, "unit=B.mtype=gauge.what=disk_used", false, "unit=B.mtype=gauge.what=disk_used", "unknown", "gauge", []string{}},
+		{true, "some.metric;host=a", false, "some.metric", "unknown", "gauge", []string{"host=a"}},
+		{true, "foo=bar;host=a", false, "foo=bar", "unknown", "gauge", []string{"host=a"}},
+		{true, "unit=B.mtype=gauge.what=disk_used.host=web1", false, "disk_used", "B", "gauge", []string{"host=web1"}},
+		{true, "host=web1.what=disk_used.mtype=rate.unit=B.dc=east", false, "disk_used", "B", "rate", []string{"dc=east", "host=web1"}},
+		{true, "unit=B.mtype=gauge.host=web1", true, "", "", "", nil},
+		{true, "unit=B.what=disk_used.host=web1", true, "", "", "", nil},
+		{true, "unit=B.mtype=gauge.what=disk_used.web1", true, "", "", "", nil},
+		{true, "unit=B.mtype=gauge.what=disk_used.host=", true, "", "", "", nil},
+	}
+	for i, c2 := range cases {
+		metrics20 = c2.metrics20
+		md, err := c.newMetricData([]byte(c2.key), 1.5, 1520000000)
+		if c2.expErr {
+			if err == nil {
+				t.Fatalf("case %d: expected error, got none. md: %v", i, md)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: expected no error, got %s", i, err)
+		}
+		if md.Name != c2.expName || md.Unit != c2.expUnit || md.Mtype != c2.expMtype || !reflect.DeepEqual(md.Tags, c2.expTags) {
+			t.Fatalf("case %d: expected name %q unit %q mtype %q tags %v, got %q %q %q %v", i, c2.expName, c2.expUnit, c2.expMtype, c2.expTags, md.Name, md.Unit, md.Mtype, md.Tags)
+		}
+		if md.Interval != 10 || md.Value != 1.5 || md.Time != 1520000000 || md.OrgId != 1 {
+			t.Fatalf("case %d: unexpected md %v", i, md)
+		}
+		if err := md.Validate(); err != nil {
+			t.Fatalf("case %d: md should be valid, got %s", i, err)
+		}
+	}
+}
+
+// the intrinsic tags form the identity, regardless of their order
+func TestMetrics20Identity(t *testing.T) {
+	c := &Carbon{intervalGetter: fixedIntervalGetter(10)}
+	defer func(orig bool) { metrics20 = orig }(metrics20)
+	metrics20 = true
+
+	ids := make(map[string]string)
+	for _, key := range []string{
+		"unit=B.mtype=gauge.what=disk_used.host=web1",
+		"host=web1.what=disk_used.unit=B.mtype=gauge",
+	} {
+		md, err := c.newMetricData([]byte(key), 1, 1520000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[md.Id] = key
+	}
+	if len(ids) != 1 {
+		t.Fatalf("expected same id for both keys, got %v", ids)
+	}
+	md, err := c.newMetricData([]byte("unit=B.mtype=gauge.what=disk_used.host=web2"), 1, 1520000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ids[md.Id]; ok {
+		t.Fatalf("expected different id for different tags")
+	}
+}
+
+type recordingHandler struct {
+	mds []*schema.MetricData
+}
+
+func (r *recordingHandler) ProcessMetricData(md *schema.MetricData, partition int32) error {
+	r.mds = append(r.mds, md)
+	return nil
+}
+
+func (r *recordingHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
+	return nil
+}
+
+func TestProcessDatagram(t *testing.T) {
+	h := &recordingHandler{}
+	c := &Carbon{Handler: h, intervalGetter: fixedIntervalGetter(10)}
+
+	decodeErrs := metricsDecodeErr.Peek()
+	c.processDatagram([]byte("a.b 1 1520000000\r\nnot a valid line\n\nc.d;host=a 2.5 1520000010\ne.f 3 1520000020"))
+
+	if len(h.mds) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(h.mds))
+	}
+	exp := []struct {
+		name string
+		val  float64
+		ts   int64
+	}{
+		{"a.b", 1, 1520000000},
+		{"c.d", 2.5, 1520000010},
+		{"e.f", 3, 1520000020},
+	}
+	for i, e := range exp {
+		md := h.mds[i]
+		if md.Name != e.name || md.Value != e.val || md.Time != e.ts {
+			t.Fatalf("metric %d: expected %s %f %d, got %s %f %d", i, e.name, e.val, e.ts, md.Name, md.Value, md.Time)
+		}
+	}
+	if got := metricsDecodeErr.Peek() - decodeErrs; got != 1 {
+		t.Fatalf("expected 1 decode error, got %d", got)
+	}
+}
@@ -0,0 +1,143 @@
+package input
+
+import (
+	"flag"
+	"time"
+
+	"github.com/grafana/globalconf"
+	"github.com/raintank/dur"
+	log "github.com/sirupsen/logrus"
+)
+
+// settings that apply to all input plugins
+var minEpoch int64
+var maxAgeStr string
+var maxAge int64 // in seconds. 0 means disabled
+var maxFutureStr string
+var maxFuture int64 // in seconds. 0 means disabled
+var rejectBeyondTTL bool
+var timePolicy string
+var clampTime bool
+var orgRateLimit float64
+var orgRateBurst int
+var orgLimit *orgLimiter // nil if disabled
+var seriesRateLimit float64
+var seriesRateBurst int
+var seriesRatePolicy string
+var seriesLimit *seriesLimiter // nil if disabled
+var dedupWindowStr string
+var dedup *dedupWindow // nil if disabled
+var nanPolicy string
+var intervalCheck bool
+var intervals *intervalTracker // nil if disabled
+
+// values of nan-policy
+const (
+	nanPolicyDrop  = "drop"
+	nanPolicyNull  = "null"
+	nanPolicyStore = "store"
+)
+
+func ConfigSetup() {
+	in := flag.NewFlagSet("input", flag.ExitOnError)
+	in.Int64Var(&minEpoch, "min-epoch", 0, "reject points with a timestamp before this unix timestamp. 0 to disable")
+	in.StringVar(&maxAgeStr, "max-age", "0", "reject points with a timestamp older than this duration, relative to the wall clock. 0 to disable")
+	in.StringVar(&maxFutureStr, "max-future", "0", "reject points with a timestamp further than this duration in the future, relative to the wall clock. 0 to disable")
+	in.BoolVar(&rejectBeyondTTL, "reject-beyond-ttl", false, "reject points with a timestamp older than the ttl of the raw archive of their storage schema")
+	in.StringVar(&timePolicy, "time-policy", "reject", "what to do with points violating max-age, max-future or reject-beyond-ttl: reject them, or clamp their timestamp to the nearest acceptable one. (reject|clamp)")
+	in.Float64Var(&orgRateLimit, "org-rate-limit", 0, "max number of points per second each org may ingest, across all inputs. points exceeding it are rejected. 0 to disable")
+	in.IntVar(&orgRateBurst, "org-rate-burst", 0, "max number of points each org may ingest at once, before being held to org-rate-limit. 0 means the same as org-rate-limit")
+	in.Float64Var(&seriesRateLimit, "series-rate-limit", 0, "max number of points per second each series may ingest. 0 to disable")
+	in.IntVar(&seriesRateBurst, "series-rate-burst", 0, "max number of points each series may ingest at once, before being held to series-rate-limit. 0 means the same as series-rate-limit")
+	in.StringVar(&seriesRatePolicy, "series-rate-policy", "drop", "what to do with points of series exceeding series-rate-limit: drop them, or downsample the series to its interval. (drop|downsample)")
+	in.StringVar(&dedupWindowStr, "dedup-window", "0", "drop points of which a point with the same series and timestamp was ingested in the same partition within this duration, e.g. after a consumer restart. points are remembered for between 1 and 2 times this duration. 0 to disable")
+	in.StringVar(&nanPolicy, "nan-policy", nanPolicyStore, "what to do with points with a NaN or infinite value: reject them, store them as null, or store NaN as null and infinite values as-is. nulls are left out of rollups. (drop|null|store)")
+	in.BoolVar(&intervalCheck, "interval-check", false, "track the interval at which the points of each series arrive, and report series of which it deviates from the interval of their definition via /ingest/interval-violations")
+	globalconf.Register("input", in, flag.ExitOnError)
+}
+
+func ConfigProcess() {
+	if minEpoch < 0 {
+		log.Fatal("input: min-epoch must not be negative")
+	}
+	maxAge = int64(dur.MustParseDuration("max-age", maxAgeStr))
+	maxFuture = int64(dur.MustParseDuration("max-future", maxFutureStr))
+	switch timePolicy {
+	case "reject":
+		clampTime = false
+	case "clamp":
+		clampTime = true
+	default:
+		log.Fatalf("input: invalid time-policy %q. must be reject or clamp", timePolicy)
+	}
+	if orgRateLimit < 0 || orgRateBurst < 0 {
+		log.Fatal("input: org-rate-limit and org-rate-burst must not be negative")
+	}
+	if orgRateLimit > 0 {
+		burst := orgRateBurst
+		if burst == 0 {
+			burst = int(orgRateLimit)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		orgLimit = newOrgLimiter(orgRateLimit, burst)
+	}
+	if seriesRateLimit < 0 || seriesRateBurst < 0 {
+		log.Fatal("input: series-rate-limit and series-rate-burst must not be negative")
+	}
+	if seriesRatePolicy != "drop" && seriesRatePolicy != "downsample" {
+		log.Fatalf("input: invalid series-rate-policy %q. must be drop or downsample", seriesRatePolicy)
+	}
+	if seriesRateLimit > 0 {
+		burst := seriesRateBurst
+		if burst == 0 {
+			burst = int(seriesRateLimit)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		seriesLimit = newSeriesLimiter(seriesRateLimit, burst, seriesRatePolicy == "downsample")
+		go pruneSeriesLimit()
+	}
+	if nanPolicy != nanPolicyDrop && nanPolicy != nanPolicyNull && nanPolicy != nanPolicyStore {
+		log.Fatalf("input: invalid nan-policy %q. must be drop, null or store", nanPolicy)
+	}
+	if intervalCheck {
+		intervals = newIntervalTracker()
+		go rotateIntervals()
+	}
+	window := dur.MustParseDuration("dedup-window", dedupWindowStr)
+	if window > 0 {
+		dedup = newDedupWindow()
+		go rotateDedup(time.Duration(window) * time.Second)
+	}
+}
+
+// rotateDedup periodically forgets the points ingested more than a window ago
+func rotateDedup(window time.Duration) {
+	ticker := time.NewTicker(window)
+	for range ticker.C {
+		tracked := dedup.rotate()
+		log.Debugf("input: tracking %d points for deduplication", tracked)
+	}
+}
+
+// rotateIntervals periodically starts a new observation period for the interval check
+func rotateIntervals() {
+	ticker := time.NewTicker(time.Hour)
+	for now := range ticker.C {
+		violating := intervals.rotate(now.Add(-time.Hour))
+		intervalViolations.Set(violating)
+	}
+}
+
+// pruneSeriesLimit periodically drops the rate limiting state of series that are well-behaved.
+// series that were throttled are kept around for an hour, so they show up in the offenders report.
+func pruneSeriesLimit() {
+	ticker := time.NewTicker(time.Minute)
+	for now := range ticker.C {
+		pruned := seriesLimit.prune(now.Add(-time.Hour), now)
+		log.Debugf("input: pruned rate limiting state of %d series", pruned)
+	}
+}
@@ -0,0 +1,97 @@
+package input
+
+import (
+	"sync"
+
+	"github.com/raintank/schema"
+)
+
+// dedupKey identifies a point
+type dedupKey struct {
+	key schema.MKey
+	ts  uint32
+}
+
+// partitionDedup tracks the points of a partition that were recently ingested.
+// rather than tracking when each point was seen, points are kept in two generations:
+// new points go into cur, and on every rotation cur becomes prev and prev is dropped.
+// so a point is remembered for at least one and at most two rotation periods.
+type partitionDedup struct {
+	sync.Mutex
+	cur  map[dedupKey]struct{}
+	prev map[dedupKey]struct{}
+}
+
+// dedupWindow drops points that were already ingested recently, such as those
+// redelivered by the message bus after a consumer restart.
+type dedupWindow struct {
+	sync.RWMutex
+	partitions map[int32]*partitionDedup
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{
+		partitions: make(map[int32]*partitionDedup),
+	}
+}
+
+func (d *dedupWindow) get(partition int32) *partitionDedup {
+	d.RLock()
+	p, ok := d.partitions[partition]
+	d.RUnlock()
+	if ok {
+		return p
+	}
+	d.Lock()
+	p, ok = d.partitions[partition]
+	if !ok {
+		p = &partitionDedup{
+			cur:  make(map[dedupKey]struct{}),
+			prev: make(map[dedupKey]struct{}),
+		}
+		d.partitions[partition] = p
+	}
+	d.Unlock()
+	return p
+}
+
+// seen returns whether the point was already ingested in the partition, as marked by add.
+// concurrency-safe.
+func (d *dedupWindow) seen(partition int32, key schema.MKey, ts uint32) bool {
+	p := d.get(partition)
+	k := dedupKey{key, ts}
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.cur[k]; ok {
+		return true
+	}
+	_, ok := p.prev[k]
+	return ok
+}
+
+// add marks the point as ingested in the partition.
+// it should only be called once the point was accepted, so that a redelivery of a rejected point is not dropped.
+// concurrency-safe.
+func (d *dedupWindow) add(partition int32, key schema.MKey, ts uint32) {
+	p := d.get(partition)
+	p.Lock()
+	p.cur[dedupKey{key, ts}] = struct{}{}
+	p.Unlock()
+}
+
+// rotate forgets the points that were ingested before the previous rotation.
+// it returns how many points are tracked afterwards.
+// concurrency-safe.
+func (d *dedupWindow) rotate() int {
+	var tracked int
+	d.RLock()
+	for _, p := range d.partitions {
+		p.Lock()
+		p.prev = p.cur
+		p.cur = make(map[dedupKey]struct{}, len(p.prev))
+		tracked += len(p.prev)
+		p.Unlock()
+	}
+	d.RUnlock()
+	return tracked
+}
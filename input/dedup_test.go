@@ -0,0 +1,44 @@
+package input
+
+import (
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestDedupWindow(t *testing.T) {
+	key1 := schema.MKey{Key: [16]byte{1}, Org: 1}
+	key2 := schema.MKey{Key: [16]byte{2}, Org: 1}
+	d := newDedupWindow()
+
+	if d.seen(0, key1, 10) {
+		t.Fatalf("expected the first point not to be a duplicate")
+	}
+	if d.seen(0, key1, 10) {
+		t.Fatalf("expected a point that was not added not to be a duplicate")
+	}
+	d.add(0, key1, 10)
+	if !d.seen(0, key1, 10) {
+		t.Fatalf("expected the same point to be a duplicate")
+	}
+	if d.seen(0, key1, 20) || d.seen(0, key2, 10) || d.seen(1, key1, 10) {
+		t.Fatalf("expected points with a different timestamp, series or partition not to be duplicates")
+	}
+	d.add(0, key1, 20)
+	d.add(0, key2, 10)
+	d.add(1, key1, 10)
+
+	// points are remembered until the second rotation after they were added
+	if tracked := d.rotate(); tracked != 4 {
+		t.Fatalf("expected 4 points to be tracked after the first rotation, got %d", tracked)
+	}
+	if !d.seen(0, key1, 10) {
+		t.Fatalf("expected the point to be a duplicate after the first rotation")
+	}
+	if tracked := d.rotate(); tracked != 0 {
+		t.Fatalf("expected no points to be tracked after the second rotation, got %d", tracked)
+	}
+	if d.seen(0, key1, 10) {
+		t.Fatalf("expected the point to be forgotten after the second rotation")
+	}
+}
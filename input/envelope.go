@@ -0,0 +1,164 @@
+package input
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+// messages on the bus may be wrapped in an envelope that identifies the format of the payload:
+//
+//	byte 0: envelopeMagic
+//	byte 1: envelope version
+//	byte 2: format of the payload (EnvelopeFormat)
+//	rest:   the payload
+//
+// this allows changing the formats without upgrading all producers and consumers at once:
+// consumers are upgraded to understand a new format first, and then producers can start sending it.
+// messages without envelope (legacy) are still supported: they are recognized by their first byte,
+// which for msgp encoded MetricData is a map header and for points the msg.Format, never envelopeMagic.
+const (
+	envelopeMagic         = 0xfe
+	envelopeVersion       = 1
+	envelopeHeaderSize    = 3
+	errFmtUnknownFormat   = "unknown envelope format %d"
+	errFmtUnknownEnvelope = "unsupported envelope version %d"
+	errFmtPointSize       = "point payload must be %d bytes, got %d"
+)
+
+// EnvelopeFormat identifies the format of the payload of an envelope
+type EnvelopeFormat uint8
+
+// formats of payloads. new formats must get a new id: ids must never be reused.
+const (
+	EnvelopeMetricData            EnvelopeFormat = 1 // msgp encoded schema.MetricData
+	EnvelopeMetricPoint           EnvelopeFormat = 2 // schema.MetricPoint, as per MetricPoint.Marshal32
+	EnvelopeMetricPointWithoutOrg EnvelopeFormat = 3 // schema.MetricPoint without org, as per MetricPoint.MarshalWithoutOrg28
+	EnvelopeMetricDataProto       EnvelopeFormat = 4 // protobuf encoded schema.MetricData, as per MarshalMetricDataProto
+	EnvelopeMetricPointProto      EnvelopeFormat = 5 // protobuf encoded schema.MetricPoint, as per MarshalMetricPointProto
+)
+
+var errEmptyMessage = errors.New("empty message")
+
+// Decoded is a decoded message: either a MetricData or a MetricPoint
+type Decoded struct {
+	MetricData  *schema.MetricData // nil for points
+	Point       schema.MetricPoint
+	PointFormat msg.Format // format of the point, as reported to Handler.ProcessMetricPoint
+}
+
+// Process passes the decoded metric to the handler
+func (d Decoded) Process(h Handler, partition int32) error {
+	if d.MetricData != nil {
+		return h.ProcessMetricData(d.MetricData, partition)
+	}
+	return h.ProcessMetricPoint(d.Point, d.PointFormat, partition)
+}
+
+// Decoder decodes the payload of an envelope.
+// defaultOrg is the org to assume for formats that don't include it.
+type Decoder func(payload []byte, defaultOrg uint32) (Decoded, error)
+
+var decodersLock sync.RWMutex
+var decoders = map[EnvelopeFormat]Decoder{
+	EnvelopeMetricData:            decodeMetricData,
+	EnvelopeMetricPoint:           decodeMetricPoint,
+	EnvelopeMetricPointWithoutOrg: decodeMetricPointWithoutOrg,
+	EnvelopeMetricDataProto:       decodeMetricDataProto,
+	EnvelopeMetricPointProto:      decodeMetricPointProto,
+}
+
+// RegisterDecoder registers the decoder for the given format.
+// it panics if the format already has a decoder.
+func RegisterDecoder(format EnvelopeFormat, d Decoder) {
+	decodersLock.Lock()
+	defer decodersLock.Unlock()
+	if _, ok := decoders[format]; ok {
+		panic(fmt.Sprintf("envelope format %d already has a decoder", format))
+	}
+	decoders[format] = d
+}
+
+// EnvelopeFormats returns the formats we can decode, in ascending order
+func EnvelopeFormats() []EnvelopeFormat {
+	decodersLock.RLock()
+	formats := make([]EnvelopeFormat, 0, len(decoders))
+	for f := range decoders {
+		formats = append(formats, f)
+	}
+	decodersLock.RUnlock()
+	sort.Slice(formats, func(i, j int) bool { return formats[i] < formats[j] })
+	return formats
+}
+
+// NewEnvelope wraps the payload in an envelope of the given format
+func NewEnvelope(format EnvelopeFormat, payload []byte) []byte {
+	out := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(payload))
+	out[0] = envelopeMagic
+	out[1] = envelopeVersion
+	out[2] = byte(format)
+	return append(out, payload...)
+}
+
+// Decode decodes a message from the bus, which may or may not be wrapped in an envelope.
+// defaultOrg is the org to assume for points without org.
+func Decode(data []byte, defaultOrg uint32) (Decoded, error) {
+	if len(data) == 0 {
+		return Decoded{}, errEmptyMessage
+	}
+	if data[0] != envelopeMagic {
+		return decodeLegacy(data, defaultOrg)
+	}
+	if len(data) < envelopeHeaderSize {
+		return Decoded{}, errors.New("truncated envelope")
+	}
+	if data[1] != envelopeVersion {
+		return Decoded{}, fmt.Errorf(errFmtUnknownEnvelope, data[1])
+	}
+	decodersLock.RLock()
+	decoder, ok := decoders[EnvelopeFormat(data[2])]
+	decodersLock.RUnlock()
+	if !ok {
+		return Decoded{}, fmt.Errorf(errFmtUnknownFormat, data[2])
+	}
+	return decoder(data[envelopeHeaderSize:], defaultOrg)
+}
+
+// decodeLegacy decodes a message without envelope
+func decodeLegacy(data []byte, defaultOrg uint32) (Decoded, error) {
+	format, isPointMsg := msg.IsPointMsg(data)
+	if isPointMsg {
+		_, point, err := msg.ReadPointMsg(data, defaultOrg)
+		return Decoded{Point: point, PointFormat: format}, err
+	}
+	return decodeMetricData(data, defaultOrg)
+}
+
+func decodeMetricData(payload []byte, defaultOrg uint32) (Decoded, error) {
+	md := &schema.MetricData{}
+	_, err := md.UnmarshalMsg(payload)
+	return Decoded{MetricData: md}, err
+}
+
+func decodeMetricPoint(payload []byte, defaultOrg uint32) (Decoded, error) {
+	var point schema.MetricPoint
+	if len(payload) != 32 {
+		return Decoded{}, fmt.Errorf(errFmtPointSize, 32, len(payload))
+	}
+	_, err := point.Unmarshal(payload)
+	return Decoded{Point: point, PointFormat: msg.FormatMetricPoint}, err
+}
+
+func decodeMetricPointWithoutOrg(payload []byte, defaultOrg uint32) (Decoded, error) {
+	var point schema.MetricPoint
+	if len(payload) != 28 {
+		return Decoded{}, fmt.Errorf(errFmtPointSize, 28, len(payload))
+	}
+	_, err := point.UnmarshalWithoutOrg(payload)
+	point.MKey.Org = defaultOrg
+	return Decoded{Point: point, PointFormat: msg.FormatMetricPointWithoutOrg}, err
+}
@@ -0,0 +1,178 @@
+package input
+
+import (
+	"fmt"
+
+	"github.com/grafana/metrictank/protowire"
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+// this file implements the protocol buffers encodings of the payloads of the
+// EnvelopeMetricDataProto and EnvelopeMetricPointProto formats, see protowire.
+// the equivalent definitions are:
+//
+// message MetricData {
+//   string id = 1;
+//   int64 org_id = 2;
+//   string name = 3;
+//   int64 interval = 4;
+//   double value = 5;
+//   string unit = 6;
+//   int64 time = 7;
+//   string mtype = 8;
+//   repeated string tags = 9;
+// }
+//
+// message MetricPoint {
+//   uint32 org = 1; // if not set, the org configured for the input is assumed
+//   bytes key = 2;  // the 16 bytes of the key of the MKey
+//   double value = 3;
+//   uint32 time = 4;
+// }
+
+const errFmtPointKeySize = "point key must be %d bytes, got %d"
+
+// MarshalMetricDataProto appends the protobuf encoding of the MetricData to b and returns the extended buffer
+func MarshalMetricDataProto(b []byte, md *schema.MetricData) []byte {
+	if md.Id != "" {
+		b = protowire.AppendString(b, 1, md.Id)
+	}
+	if md.OrgId != 0 {
+		b = protowire.AppendVarintField(b, 2, uint64(md.OrgId))
+	}
+	if md.Name != "" {
+		b = protowire.AppendString(b, 3, md.Name)
+	}
+	if md.Interval != 0 {
+		b = protowire.AppendVarintField(b, 4, uint64(md.Interval))
+	}
+	if md.Value != 0 {
+		b = protowire.AppendDoubleField(b, 5, md.Value)
+	}
+	if md.Unit != "" {
+		b = protowire.AppendString(b, 6, md.Unit)
+	}
+	if md.Time != 0 {
+		b = protowire.AppendVarintField(b, 7, uint64(md.Time))
+	}
+	if md.Mtype != "" {
+		b = protowire.AppendString(b, 8, md.Mtype)
+	}
+	for _, tag := range md.Tags {
+		b = protowire.AppendString(b, 9, tag)
+	}
+	return b
+}
+
+// MarshalMetricPointProto appends the protobuf encoding of the point to b and returns the extended buffer.
+// if withOrg is false, the org is left out, like for msg.FormatMetricPointWithoutOrg.
+func MarshalMetricPointProto(b []byte, point schema.MetricPoint, withOrg bool) []byte {
+	if withOrg && point.MKey.Org != 0 {
+		b = protowire.AppendVarintField(b, 1, uint64(point.MKey.Org))
+	}
+	b = protowire.AppendBytes(b, 2, point.MKey.Key[:])
+	if point.Value != 0 {
+		b = protowire.AppendDoubleField(b, 3, point.Value)
+	}
+	if point.Time != 0 {
+		b = protowire.AppendVarintField(b, 4, uint64(point.Time))
+	}
+	return b
+}
+
+// decodeMetricDataProto decodes the protobuf encoded MetricData. unknown fields are skipped.
+// all strings reference one copy of the payload, which saves an allocation per string.
+func decodeMetricDataProto(payload []byte, defaultOrg uint32) (Decoded, error) {
+	md := &schema.MetricData{}
+	str := string(payload)
+	// substr returns the string of the length-delimited value val, which ends where rest starts
+	substr := func(val, rest []byte) string {
+		end := len(str) - len(rest)
+		return str[end-len(val) : end]
+	}
+	data := payload
+	for len(data) > 0 {
+		field, wireType, val, rest, err := protowire.ReadField(data)
+		if err != nil {
+			return Decoded{}, err
+		}
+		data = rest
+		switch {
+		case field == 1 && wireType == protowire.Bytes:
+			md.Id = substr(val, rest)
+		case field == 2 && wireType == protowire.Varint:
+			md.OrgId = int(int64(protowire.Uvarint(val)))
+		case field == 3 && wireType == protowire.Bytes:
+			md.Name = substr(val, rest)
+		case field == 4 && wireType == protowire.Varint:
+			md.Interval = int(int64(protowire.Uvarint(val)))
+		case field == 5 && wireType == protowire.Fixed64:
+			md.Value = protowire.Double(val)
+		case field == 6 && wireType == protowire.Bytes:
+			md.Unit = substr(val, rest)
+		case field == 7 && wireType == protowire.Varint:
+			md.Time = int64(protowire.Uvarint(val))
+		case field == 8 && wireType == protowire.Bytes:
+			md.Mtype = substr(val, rest)
+		case field == 9 && wireType == protowire.Bytes:
+			if md.Tags == nil {
+				md.Tags = make([]string, 0, countFields(data, 9)+1)
+			}
+			md.Tags = append(md.Tags, substr(val, rest))
+		}
+	}
+	return Decoded{MetricData: md}, nil
+}
+
+// countFields returns how many of the fields in data are the given field, so repeated fields can be allocated at once
+func countFields(data []byte, field uint64) int {
+	var n int
+	for len(data) > 0 {
+		f, _, _, rest, err := protowire.ReadField(data)
+		if err != nil {
+			return n
+		}
+		if f == field {
+			n++
+		}
+		data = rest
+	}
+	return n
+}
+
+// decodeMetricPointProto decodes the protobuf encoded MetricPoint. unknown fields are skipped.
+// points without org get defaultOrg, and are reported as msg.FormatMetricPointWithoutOrg.
+func decodeMetricPointProto(payload []byte, defaultOrg uint32) (Decoded, error) {
+	var point schema.MetricPoint
+	var hasKey bool
+	for len(payload) > 0 {
+		field, wireType, val, rest, err := protowire.ReadField(payload)
+		if err != nil {
+			return Decoded{}, err
+		}
+		payload = rest
+		switch {
+		case field == 1 && wireType == protowire.Varint:
+			point.MKey.Org = uint32(protowire.Uvarint(val))
+		case field == 2 && wireType == protowire.Bytes:
+			if len(val) != len(point.MKey.Key) {
+				return Decoded{}, fmt.Errorf(errFmtPointKeySize, len(point.MKey.Key), len(val))
+			}
+			copy(point.MKey.Key[:], val)
+			hasKey = true
+		case field == 3 && wireType == protowire.Fixed64:
+			point.Value = protowire.Double(val)
+		case field == 4 && wireType == protowire.Varint:
+			point.Time = uint32(protowire.Uvarint(val))
+		}
+	}
+	if !hasKey {
+		return Decoded{}, fmt.Errorf(errFmtPointKeySize, len(point.MKey.Key), 0)
+	}
+	if point.MKey.Org == 0 {
+		point.MKey.Org = defaultOrg
+		return Decoded{Point: point, PointFormat: msg.FormatMetricPointWithoutOrg}, nil
+	}
+	return Decoded{Point: point, PointFormat: msg.FormatMetricPoint}, nil
+}
@@ -0,0 +1,132 @@
+package input
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/protowire"
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+func TestDecode(t *testing.T) {
+	md := schema.MetricData{OrgId: 1, Name: "a.b", Interval: 10, Value: 1.5, Time: 100, Mtype: "gauge", Tags: []string{"foo=bar"}}
+	md.SetId()
+	mdData, err := md.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkey, _ := schema.MKeyFromString(md.Id)
+	point := schema.MetricPoint{MKey: mkey, Value: 1.5, Time: 100}
+	pointData, err := point.Marshal32(make([]byte, 0, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointNoOrgData, err := point.MarshalWithoutOrg28(make([]byte, 0, 28))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyPoint, err := msg.WritePointMsg(point, make([]byte, 0, 33), msg.FormatMetricPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointNoOrg := point
+	pointNoOrg.MKey.Org = 5
+
+	cases := []struct {
+		name   string
+		data   []byte
+		expErr bool
+		exp    Decoded
+	}{
+		{"legacy metricdata", mdData, false, Decoded{MetricData: &md}},
+		{"legacy point", legacyPoint, false, Decoded{Point: point, PointFormat: msg.FormatMetricPoint}},
+		{"metricdata", NewEnvelope(EnvelopeMetricData, mdData), false, Decoded{MetricData: &md}},
+		{"point", NewEnvelope(EnvelopeMetricPoint, pointData), false, Decoded{Point: point, PointFormat: msg.FormatMetricPoint}},
+		{"point without org", NewEnvelope(EnvelopeMetricPointWithoutOrg, pointNoOrgData), false, Decoded{Point: pointNoOrg, PointFormat: msg.FormatMetricPointWithoutOrg}},
+		{"protobuf metricdata", NewEnvelope(EnvelopeMetricDataProto, MarshalMetricDataProto(nil, &md)), false, Decoded{MetricData: &md}},
+		{"protobuf point", NewEnvelope(EnvelopeMetricPointProto, MarshalMetricPointProto(nil, point, true)), false, Decoded{Point: point, PointFormat: msg.FormatMetricPoint}},
+		{"protobuf point without org", NewEnvelope(EnvelopeMetricPointProto, MarshalMetricPointProto(nil, point, false)), false, Decoded{Point: pointNoOrg, PointFormat: msg.FormatMetricPointWithoutOrg}},
+		{"truncated protobuf metricdata", NewEnvelope(EnvelopeMetricDataProto, MarshalMetricDataProto(nil, &md)[:10]), true, Decoded{}},
+		{"protobuf point without key", NewEnvelope(EnvelopeMetricPointProto, []byte{}), true, Decoded{}},
+		{"protobuf point with short key", NewEnvelope(EnvelopeMetricPointProto, protowire.AppendBytes(nil, 2, mkey.Key[:8])), true, Decoded{}},
+		{"empty", nil, true, Decoded{}},
+		{"truncated envelope", []byte{envelopeMagic, envelopeVersion}, true, Decoded{}},
+		{"truncated point", NewEnvelope(EnvelopeMetricPoint, pointData[:20]), true, Decoded{}},
+		{"unknown format", NewEnvelope(EnvelopeFormat(200), mdData), true, Decoded{}},
+		{"unknown version", append([]byte{envelopeMagic, envelopeVersion + 1, byte(EnvelopeMetricData)}, mdData...), true, Decoded{}},
+	}
+	for _, c := range cases {
+		decoded, err := Decode(c.data, 5)
+		if c.expErr {
+			if err == nil {
+				t.Fatalf("%s: expected error, got %v", c.name, decoded)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %s", c.name, err)
+		}
+		if !reflect.DeepEqual(decoded, c.exp) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.exp, decoded)
+		}
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	format := EnvelopeFormat(100)
+	defer func() {
+		decodersLock.Lock()
+		delete(decoders, format)
+		decodersLock.Unlock()
+	}()
+	var got []byte
+	RegisterDecoder(format, func(payload []byte, defaultOrg uint32) (Decoded, error) {
+		got = payload
+		return Decoded{}, nil
+	})
+	if _, err := Decode(NewEnvelope(format, []byte("payload")), 1); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !bytes.Equal(got, []byte("payload")) {
+		t.Fatalf("expected the registered decoder to get the payload, got %q", got)
+	}
+	formats := EnvelopeFormats()
+	if formats[len(formats)-1] != format {
+		t.Fatalf("expected the registered format to be listed, got %v", formats)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a format twice to panic")
+		}
+	}()
+	RegisterDecoder(format, nil)
+}
+
+func BenchmarkDecodeMetricData(b *testing.B) {
+	md := schema.MetricData{OrgId: 1, Name: "some.host.cpu.usage", Interval: 10, Value: 1.5, Time: 1540000000, Mtype: "gauge", Unit: "percent", Tags: []string{"dc=east", "role=web"}}
+	md.SetId()
+	msgpData, err := md.MarshalMsg(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	formats := []struct {
+		name string
+		data []byte
+	}{
+		{"msgp", NewEnvelope(EnvelopeMetricData, msgpData)},
+		{"protobuf", NewEnvelope(EnvelopeMetricDataProto, MarshalMetricDataProto(nil, &md))},
+	}
+	for _, f := range formats {
+		b.Run(f.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(f.data, 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -5,37 +5,132 @@ package input
 import (
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/raintank/schema"
 	"github.com/raintank/schema/msg"
 
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/wal"
 	"github.com/grafana/metrictank/stats"
 	log "github.com/sirupsen/logrus"
 )
 
+// Handler processes decoded metrics.
+// if a metric is rejected, a RejectError is returned which describes why.
 type Handler interface {
-	ProcessMetricData(md *schema.MetricData, partition int32)
-	ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32)
+	ProcessMetricData(md *schema.MetricData, partition int32) error
+	ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error
+}
+
+// BatchHandler is implemented by handlers that can efficiently process several points of the same series at once.
+// for each point that is rejected, the returned slice holds a RejectError at the point's index. it is nil if all points were accepted.
+type BatchHandler interface {
+	Handler
+	ProcessMetricDataBatch(mds []*schema.MetricData, partition int32) []error
+}
+
+// classes of reasons why a message may be rejected at ingest
+const (
+	ReasonDecode             = "decode"
+	ReasonInvalid            = "invalid"
+	ReasonTimeZero           = "time_zero"
+	ReasonTimeNegative       = "time_negative"
+	ReasonTimeBeforeMinEpoch = "time_before_min_epoch"
+	ReasonTimeTooOld         = "time_too_old"
+	ReasonTimeInFuture       = "time_in_future"
+	ReasonTimeBeyondTTL      = "time_beyond_ttl"
+	ReasonTimeOutOfRange     = "time_out_of_range"
+	ReasonIntervalOutOfRange = "interval_out_of_range"
+	ReasonInvalidId          = "invalid_id"
+	ReasonInvalidValue       = "invalid_value"
+	ReasonRateLimited        = "rate_limited"
+	ReasonSeriesRateLimited  = "series_rate_limited"
+	ReasonSeriesLimited      = "series_limited"
+	ReasonOutOfOrder         = "out_of_order"
+	ReasonChunkSaved         = "chunk_saved"
+)
+
+// Reasons lists all classes of reasons why a message may be rejected
+var Reasons = []string{
+	ReasonDecode,
+	ReasonInvalid,
+	ReasonTimeZero,
+	ReasonTimeNegative,
+	ReasonTimeBeforeMinEpoch,
+	ReasonTimeTooOld,
+	ReasonTimeInFuture,
+	ReasonTimeBeyondTTL,
+	ReasonTimeOutOfRange,
+	ReasonIntervalOutOfRange,
+	ReasonInvalidId,
+	ReasonInvalidValue,
+	ReasonRateLimited,
+	ReasonSeriesRateLimited,
+	ReasonSeriesLimited,
+	ReasonOutOfOrder,
+	ReasonChunkSaved,
+}
+
+// RejectError describes why a message was rejected
+type RejectError struct {
+	Reason string // one of the Reason* classes
+	Err    error
+}
+
+func (r RejectError) Error() string {
+	return r.Reason + ": " + r.Err.Error()
+}
+
+func reject(reason string, err error) error {
+	return RejectError{Reason: reason, Err: err}
+}
+
+// dropped returns a RejectError if the series dropped the point at ts, as per the result of adding it
+func dropped(result mdata.AddResult, ts uint32) error {
+	switch result {
+	case mdata.AddTooOld:
+		return reject(ReasonOutOfOrder, fmt.Errorf("point at %d is older than the data of its series in memory, beyond the reorder window", ts))
+	case mdata.AddChunkSaved:
+		return reject(ReasonChunkSaved, fmt.Errorf("point at %d is for a chunk that was closed already", ts))
+	}
+	return nil
 }
 
 // TODO: clever way to document all metrics for all different inputs
 
 // Default is a base handler for a metrics packet, aimed to be embedded by concrete implementations
 type DefaultHandler struct {
-	receivedMD   *stats.Counter32
-	receivedMP   *stats.Counter32
-	receivedMPNO *stats.Counter32
-	invalidMD    *stats.CounterRate32
-	invalidMP    *stats.CounterRate32
-	unknownMP    *stats.Counter32
+	receivedMD        *stats.Counter32
+	receivedMP        *stats.Counter32
+	receivedMPNO      *stats.Counter32
+	invalidMD         *stats.CounterRate32
+	invalidMP         *stats.CounterRate32
+	unknownMP         *stats.Counter32
+	invalidTime       map[string]*stats.Counter32
+	clampedTime       map[string]*stats.Counter32
+	rateLimited       *stats.Counter32
+	seriesRateLimited *stats.Counter32
+	seriesLimited     *stats.Counter32
+	duplicates        *stats.Counter32
+	nonFinite         *stats.Counter32
 
 	metrics     mdata.Metrics
 	metricIndex idx.MetricIndex
 }
 
 func NewDefaultHandler(metrics mdata.Metrics, metricIndex idx.MetricIndex, input string) DefaultHandler {
+	invalidTime := make(map[string]*stats.Counter32)
+	for _, reason := range timeReasons {
+		// metric input.%s.invalid_time.%s is a count of points rejected due to their timestamp, by input plugin and reason (see docs/inputs.md)
+		invalidTime[reason] = stats.NewCounter32(fmt.Sprintf("input.%s.invalid_time.%s", input, reason))
+	}
+	clampedTime := make(map[string]*stats.Counter32)
+	for _, reason := range clampReasons {
+		// metric input.%s.clamped_time.%s is a count of points of which the timestamp was clamped, by input plugin and reason (time_too_old, time_in_future, time_beyond_ttl)
+		clampedTime[reason] = stats.NewCounter32(fmt.Sprintf("input.%s.clamped_time.%s", input, reason))
+	}
 	return DefaultHandler{
 		// metric input.%s.metricdata.received is the count of metricdata datapoints received by input plugin
 		receivedMD: stats.NewCounter32(fmt.Sprintf("input.%s.metricdata.received", input)),
@@ -49,6 +144,18 @@ func NewDefaultHandler(metrics mdata.Metrics, metricIndex idx.MetricIndex, input
 		invalidMP: stats.NewCounterRate32(fmt.Sprintf("input.%s.metricpoint.invalid", input)),
 		// metric input.%s.metricpoint.unknown is the count of times the ID of a received metricpoint was not in the index, by input plugin
 		unknownMP: stats.NewCounter32(fmt.Sprintf("input.%s.metricpoint.unknown", input)),
+		// metric input.%s.rate_limited is a count of points rejected by input plugin, because their org exceeded org-rate-limit
+		rateLimited: stats.NewCounter32(fmt.Sprintf("input.%s.rate_limited", input)),
+		// metric input.%s.series_rate_limited is a count of points dropped by input plugin, because their series exceeded series-rate-limit
+		seriesRateLimited: stats.NewCounter32(fmt.Sprintf("input.%s.series_rate_limited", input)),
+		// metric input.%s.series_limited is a count of points rejected by input plugin, because they are of a new series and their org reached its series limit
+		seriesLimited: stats.NewCounter32(fmt.Sprintf("input.%s.series_limited", input)),
+		// metric input.%s.duplicates is a count of points dropped by input plugin, because the same point was ingested within dedup-window
+		duplicates: stats.NewCounter32(fmt.Sprintf("input.%s.duplicates", input)),
+		// metric input.%s.non_finite is a count of points with a NaN or infinite value by input plugin, which are handled as per nan-policy
+		nonFinite:   stats.NewCounter32(fmt.Sprintf("input.%s.non_finite", input)),
+		invalidTime: invalidTime,
+		clampedTime: clampedTime,
 
 		metrics:     metrics,
 		metricIndex: metricIndex,
@@ -57,62 +164,311 @@ func NewDefaultHandler(metrics mdata.Metrics, metricIndex idx.MetricIndex, input
 
 // ProcessMetricPoint updates the index if possible, and stores the data if we have an index entry
 // concurrency-safe.
-func (in DefaultHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) {
+func (in DefaultHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
 	if format == msg.FormatMetricPoint {
 		in.receivedMP.Inc()
 	} else {
 		in.receivedMPNO.Inc()
 	}
-	// in cassandra we store timestamps as 32bit signed integers.
-	// math.MaxInt32 = Jan 19 03:14:07 UTC 2038
-	if !point.Valid() || point.Time >= math.MaxInt32 {
+	if err := in.checkRateLimit(point.MKey.Org); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	ts, err := in.validateTime(int64(point.Time), now)
+	if err != nil {
+		in.invalidMP.Inc()
+		log.Debugf("in: Invalid metric %v: %s", point, err)
+		return err
+	}
+	point.Time = uint32(ts)
+	point.Value, err = in.validateValue(point.Value)
+	if err != nil {
 		in.invalidMP.Inc()
-		log.Debugf("in: Invalid metric %v", point)
-		return
+		log.Debugf("in: Invalid metric %v: %s", point, err)
+		return err
 	}
 
 	archive, _, ok := in.metricIndex.Update(point, partition)
 
 	if !ok {
 		in.unknownMP.Inc()
-		return
+		return nil
 	}
 
-	m := in.metrics.GetOrCreate(point.MKey, archive.SchemaId, archive.AggId)
-	m.Add(point.Time, point.Value)
+	ts, err = in.validateTimeTTL(ts, now, archive.SchemaId)
+	if err != nil {
+		in.invalidMP.Inc()
+		log.Debugf("in: Invalid metric %v: %s", point, err)
+		return err
+	}
+	point.Time = uint32(ts)
+
+	if in.isDuplicate(partition, point.MKey, point.Time) {
+		return nil
+	}
+
+	m, err := in.getOrCreate(point.MKey, archive.SchemaId, archive.AggId)
+	if err != nil {
+		return err
+	}
+
+	if err := in.checkSeriesRateLimit(point.MKey, point.Time, uint32(archive.Interval)); err != nil {
+		return err
+	}
+	in.trackInterval(point.MKey, point.Time, uint32(archive.Interval))
+
+	wal.Append(point.MKey, archive.SchemaId, archive.AggId, point.Time, point.Value)
+	err = dropped(m.Add(point.Time, point.Value), point.Time)
+	if err == nil {
+		in.markIngested(partition, point.MKey, point.Time)
+	}
+	return err
 }
 
 // ProcessMetricData assures the data is stored and the metadata is in the index
 // concurrency-safe.
-func (in DefaultHandler) ProcessMetricData(md *schema.MetricData, partition int32) {
+func (in DefaultHandler) ProcessMetricData(md *schema.MetricData, partition int32) error {
 	in.receivedMD.Inc()
+	now := time.Now().Unix()
+	mkey, err := in.validateMetricData(md, now)
+	if err != nil {
+		return err
+	}
+
+	m, err := in.getOrCreateUnindexed(mkey, md)
+	if err != nil {
+		return err
+	}
+	archive, _, _ := in.metricIndex.AddOrUpdate(mkey, md, partition)
+
+	md.Time, err = in.validateTimeTTL(md.Time, now, archive.SchemaId)
+	if err != nil {
+		in.invalidMD.Inc()
+		log.Warnf("in: invalid metric %q: %s", md.Id, err)
+		return err
+	}
+
+	if in.isDuplicate(partition, mkey, uint32(md.Time)) {
+		return nil
+	}
+
+	if err := in.checkSeriesRateLimit(mkey, uint32(md.Time), uint32(md.Interval)); err != nil {
+		return err
+	}
+	in.trackInterval(mkey, uint32(md.Time), uint32(md.Interval))
+
+	wal.Append(mkey, archive.SchemaId, archive.AggId, uint32(md.Time), md.Value)
+	err = dropped(m.Add(uint32(md.Time), md.Value), uint32(md.Time))
+	if err == nil {
+		in.markIngested(partition, mkey, uint32(md.Time))
+	}
+	return err
+}
+
+// ProcessMetricDataBatch is like ProcessMetricData, for several points of the same series.
+// it only updates the index once, and adds all accepted points to the series at once.
+// the returned slice holds the error for each point that was rejected (at the same index), and is nil if all were accepted.
+// concurrency-safe.
+func (in DefaultHandler) ProcessMetricDataBatch(mds []*schema.MetricData, partition int32) []error {
+	var errs []error
+	fail := func(i int, err error) {
+		if errs == nil {
+			errs = make([]error, len(mds))
+		}
+		errs[i] = err
+	}
+
+	now := time.Now().Unix()
+	var mkey schema.MKey
+	var newest *schema.MetricData
+	accepted := make([]int, 0, len(mds))
+	for i, md := range mds {
+		in.receivedMD.Inc()
+		key, err := in.validateMetricData(md, now)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		if newest == nil {
+			mkey = key
+		} else if key != mkey {
+			in.invalidMD.Inc()
+			fail(i, reject(ReasonInvalidId, fmt.Errorf("id %s does not match the batch's series %s", md.Id, newest.Id)))
+			continue
+		}
+		if newest == nil || md.Time > newest.Time {
+			newest = md
+		}
+		accepted = append(accepted, i)
+	}
+	if newest == nil {
+		return errs
+	}
+
+	m, err := in.getOrCreateUnindexed(mkey, newest)
+	if err != nil {
+		// getOrCreateUnindexed counted one of the points
+		in.seriesLimited.Add(len(accepted) - 1)
+		for _, i := range accepted {
+			fail(i, err)
+		}
+		return errs
+	}
+	archive, _, _ := in.metricIndex.AddOrUpdate(mkey, newest, partition)
+
+	points := make([]schema.Point, 0, len(accepted))
+	pointIdx := make([]int, 0, len(accepted)) // index in mds of each point
+	var batched map[uint32]struct{}           // timestamps of the points, to drop duplicates within the batch
+	if dedup != nil {
+		batched = make(map[uint32]struct{}, len(accepted))
+	}
+	for _, i := range accepted {
+		md := mds[i]
+		ts, err := in.validateTimeTTL(md.Time, now, archive.SchemaId)
+		if err != nil {
+			in.invalidMD.Inc()
+			log.Warnf("in: invalid metric %q: %s", md.Id, err)
+			fail(i, err)
+			continue
+		}
+		md.Time = ts
+		if in.isDuplicate(partition, mkey, uint32(md.Time)) {
+			continue
+		}
+		if batched != nil {
+			if _, ok := batched[uint32(md.Time)]; ok {
+				in.duplicates.Inc()
+				continue
+			}
+			batched[uint32(md.Time)] = struct{}{}
+		}
+		if err := in.checkSeriesRateLimit(mkey, uint32(md.Time), uint32(md.Interval)); err != nil {
+			fail(i, err)
+			continue
+		}
+		in.trackInterval(mkey, uint32(md.Time), uint32(md.Interval))
+		points = append(points, schema.Point{Val: md.Value, Ts: uint32(md.Time)})
+		pointIdx = append(pointIdx, i)
+	}
+
+	for _, p := range points {
+		wal.Append(mkey, archive.SchemaId, archive.AggId, p.Ts, p.Val)
+	}
+	for j, result := range m.AddMany(points) {
+		if err := dropped(result, points[j].Ts); err != nil {
+			fail(pointIdx[j], err)
+			continue
+		}
+		in.markIngested(partition, mkey, points[j].Ts)
+	}
+	return errs
+}
+
+// validateMetricData checks whether the metricdata is acceptable, and returns its key.
+// its timestamp may be updated, as per time-policy, and its value as per nan-policy
+func (in DefaultHandler) validateMetricData(md *schema.MetricData, now int64) (schema.MKey, error) {
 	err := md.Validate()
 	if err != nil {
 		in.invalidMD.Inc()
 		log.Debugf("in: Invalid metric %v: %s", md, err)
-		return
+		return schema.MKey{}, reject(ReasonInvalid, err)
 	}
-	// in cassandra we store timestamps and interval as 32bit signed integers.
-	// math.MaxInt32 = Jan 19 03:14:07 UTC 2038
-	if md.Time <= 0 || md.Time >= math.MaxInt32 {
+	if err := in.checkRateLimit(uint32(md.OrgId)); err != nil {
+		return schema.MKey{}, err
+	}
+	md.Time, err = in.validateTime(md.Time, now)
+	if err != nil {
 		in.invalidMD.Inc()
-		log.Warnf("in: invalid metric %q: .Time %d out of range", md.Id, md.Time)
-		return
+		log.Warnf("in: invalid metric %q: %s", md.Id, err)
+		return schema.MKey{}, err
 	}
+	md.Value, err = in.validateValue(md.Value)
+	if err != nil {
+		in.invalidMD.Inc()
+		log.Debugf("in: invalid metric %q: %s", md.Id, err)
+		return schema.MKey{}, err
+	}
+	// in cassandra we store interval as 32bit signed integers.
+	// math.MaxInt32 = Jan 19 03:14:07 UTC 2038
 	if md.Interval <= 0 || md.Interval >= math.MaxInt32 {
 		in.invalidMD.Inc()
 		log.Warnf("in: invalid metric %q. .Interval %d out of range", md.Id, md.Interval)
-		return
+		return schema.MKey{}, reject(ReasonIntervalOutOfRange, fmt.Errorf(".Interval %d out of range", md.Interval))
 	}
 
 	mkey, err := schema.MKeyFromString(md.Id)
 	if err != nil {
 		log.Errorf("in: Invalid metric %v: could not parse ID: %s", md, err)
-		return
+		return schema.MKey{}, reject(ReasonInvalidId, err)
 	}
+	return mkey, nil
+}
 
-	archive, _, _ := in.metricIndex.AddOrUpdate(mkey, md, partition)
+// isDuplicate returns whether the point was already ingested in the partition within dedup-window.
+// duplicates are dropped without being rejected: they were processed already.
+func (in DefaultHandler) isDuplicate(partition int32, key schema.MKey, ts uint32) bool {
+	if dedup == nil || !dedup.seen(partition, key, ts) {
+		return false
+	}
+	in.duplicates.Inc()
+	return true
+}
+
+// markIngested records the point for dedup-window, once the series accepted it
+func (in DefaultHandler) markIngested(partition int32, key schema.MKey, ts uint32) {
+	if dedup != nil {
+		dedup.add(partition, key, ts)
+	}
+}
+
+// checkSeriesRateLimit rejects the point if its series exceeded series-rate-limit
+func (in DefaultHandler) checkSeriesRateLimit(key schema.MKey, ts, interval uint32) error {
+	if seriesLimit == nil || seriesLimit.allow(key, ts, interval, time.Now()) {
+		return nil
+	}
+	in.seriesRateLimited.Inc()
+	return reject(ReasonSeriesRateLimited, fmt.Errorf("series %s exceeded the ingest rate limit of %g points/s", key, seriesRateLimit))
+}
 
-	m := in.metrics.GetOrCreate(mkey, archive.SchemaId, archive.AggId)
-	m.Add(uint32(md.Time), md.Value)
+// trackInterval records the point for the interval check, if enabled
+func (in DefaultHandler) trackInterval(key schema.MKey, ts, interval uint32) {
+	if intervals != nil {
+		intervals.add(key, ts, interval, time.Now())
+	}
+}
+
+// getOrCreate returns the series of the point, or rejects the point if it is of a new series, and its org reached its series limit
+func (in DefaultHandler) getOrCreate(key schema.MKey, schemaId, aggId uint16) (mdata.Metric, error) {
+	m, err := in.metrics.GetOrCreate(key, schemaId, aggId)
+	if err != nil {
+		in.seriesLimited.Inc()
+		return nil, reject(ReasonSeriesLimited, err)
+	}
+	return m, nil
+}
+
+// getOrCreateUnindexed is like getOrCreate, for series that may not be in the index yet.
+// new series are created before they are added to the index, so that series that their org has no room for are not indexed.
+func (in DefaultHandler) getOrCreateUnindexed(key schema.MKey, md *schema.MetricData) (mdata.Metric, error) {
+	if m, ok := in.metrics.Get(key); ok {
+		return m, nil
+	}
+	if archive, ok := in.metricIndex.Get(key); ok {
+		return in.getOrCreate(key, archive.SchemaId, archive.AggId)
+	}
+	// the schema and aggregation the index will assign to the series
+	def := schema.MetricDefinitionFromMetricData(md)
+	path := def.NameWithTags()
+	schemaId, _ := mdata.MatchSchema(def.OrgId, path, def.Interval)
+	aggId, _ := mdata.MatchAgg(def.OrgId, path)
+	return in.getOrCreate(key, schemaId, aggId)
+}
+
+// checkRateLimit rejects the point if its org exceeded org-rate-limit
+func (in DefaultHandler) checkRateLimit(org uint32) error {
+	if orgLimit == nil || orgLimit.allow(org, time.Now()) {
+		return nil
+	}
+	in.rateLimited.Inc()
+	return reject(ReasonRateLimited, fmt.Errorf("org %d exceeded the ingest rate limit of %g points/s", org, orgRateLimit))
 }
@@ -2,6 +2,7 @@ package input
 
 import (
 	"fmt"
+	"math"
 	"testing"
 	"time"
 
@@ -14,6 +15,348 @@ import (
 	"github.com/raintank/schema"
 )
 
+func TestProcessMetricDataReject(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, 0))
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+
+	aggmetrics := mdata.NewAggMetrics(backendStore.NewDevnullStore(), &cache.MockCache{}, false, 1, 800, 8000, 0)
+	metricIndex := memory.New()
+	metricIndex.Init()
+	in := NewDefaultHandler(aggmetrics, metricIndex, "TestProcessMetricDataReject")
+
+	newMd := func(time, interval int64) *schema.MetricData {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     "some.metric",
+			Interval: int(interval),
+			Value:    1,
+			Time:     time,
+			Mtype:    "gauge",
+		}
+		md.SetId()
+		return md
+	}
+
+	cases := []struct {
+		md     *schema.MetricData
+		reason string
+	}{
+		{newMd(10, 10), ""},
+		{newMd(-10, 10), ReasonTimeNegative},
+		{newMd(0, 10), ReasonTimeZero},
+		{newMd(math.MaxInt32, 10), ReasonTimeOutOfRange},
+		{newMd(10, -10), ReasonIntervalOutOfRange},
+		{newMd(10, 0), ReasonInvalid},
+		{&schema.MetricData{OrgId: 1, Name: "some.metric", Interval: 10, Time: 10, Mtype: "gauge"}, ReasonInvalidId},
+	}
+	for i, c := range cases {
+		err := in.ProcessMetricData(c.md, 1)
+		if c.reason == "" {
+			if err != nil {
+				t.Fatalf("case %d: expected no error, got %s", i, err)
+			}
+			continue
+		}
+		rejectErr, ok := err.(RejectError)
+		if !ok {
+			t.Fatalf("case %d: expected RejectError, got %v", i, err)
+		}
+		if rejectErr.Reason != c.reason {
+			t.Fatalf("case %d: expected reason %q, got %q", i, c.reason, rejectErr.Reason)
+		}
+	}
+}
+
+func TestProcessMetricDataSeriesLimit(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, 0))
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+
+	aggmetrics := mdata.NewAggMetrics(backendStore.NewDevnullStore(), &cache.MockCache{}, false, 1, 800, 8000, 0)
+	aggmetrics.SetSeriesLimit(1)
+	metricIndex := memory.New()
+	metricIndex.Init()
+	in := NewDefaultHandler(aggmetrics, metricIndex, "TestProcessMetricDataSeriesLimit")
+
+	newMd := func(name string, ts int64) *schema.MetricData {
+		md := &schema.MetricData{OrgId: 1, Name: name, Interval: 10, Value: 1, Time: ts, Mtype: "gauge"}
+		md.SetId()
+		return md
+	}
+	if err := in.ProcessMetricData(newMd("a", 10), 1); err != nil {
+		t.Fatalf("expected first series to be accepted, got %s", err)
+	}
+	// existing series are still accepted
+	if err := in.ProcessMetricData(newMd("a", 20), 1); err != nil {
+		t.Fatalf("expected point of existing series to be accepted, got %s", err)
+	}
+	md := newMd("b", 10)
+	err := in.ProcessMetricData(md, 1)
+	if rejectErr, ok := err.(RejectError); !ok || rejectErr.Reason != ReasonSeriesLimited {
+		t.Fatalf("expected second series to be rejected with reason %q, got %v", ReasonSeriesLimited, err)
+	}
+	mkey, _ := schema.MKeyFromString(md.Id)
+	if _, ok := metricIndex.Get(mkey); ok {
+		t.Fatalf("expected rejected series not to be added to the index")
+	}
+	aggmetrics.SetOrgSeriesLimit(1, 2)
+	if err := in.ProcessMetricData(md, 1); err != nil {
+		t.Fatalf("expected second series to be accepted after raising the limit, got %s", err)
+	}
+}
+
+func TestProcessMetricDataBatch(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, 0))
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+
+	aggmetrics := mdata.NewAggMetrics(backendStore.NewDevnullStore(), &cache.MockCache{}, false, 1, 800, 8000, 0)
+	metricIndex := memory.New()
+	metricIndex.Init()
+	in := NewDefaultHandler(aggmetrics, metricIndex, "TestProcessMetricDataBatch")
+
+	newMd := func(name string, time int64) *schema.MetricData {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     name,
+			Interval: 10,
+			Value:    float64(time),
+			Time:     time,
+			Mtype:    "gauge",
+		}
+		md.SetId()
+		return md
+	}
+	mds := []*schema.MetricData{
+		newMd("some.metric", 10),
+		newMd("some.metric", 20),
+		newMd("some.metric", -10),
+		newMd("other.metric", 30),
+		newMd("some.metric", 30),
+	}
+	errs := in.ProcessMetricDataBatch(mds, 1)
+	if len(errs) != len(mds) {
+		t.Fatalf("expected %d errors, got %v", len(mds), errs)
+	}
+	expReasons := []string{"", "", ReasonTimeNegative, ReasonInvalidId, ""}
+	for i, exp := range expReasons {
+		if exp == "" {
+			if errs[i] != nil {
+				t.Fatalf("point %d: expected no error, got %s", i, errs[i])
+			}
+			continue
+		}
+		rejectErr, ok := errs[i].(RejectError)
+		if !ok || rejectErr.Reason != exp {
+			t.Fatalf("point %d: expected reason %q, got %v", i, exp, errs[i])
+		}
+	}
+
+	mkey, _ := schema.MKeyFromString(mds[0].Id)
+	defs := metricIndex.List(1)
+	if len(defs) != 1 || defs[0].Id != mkey || defs[0].LastUpdate != 30 {
+		t.Fatalf("expected 1 index entry for %s with lastUpdate 30, got %v", mkey, defs)
+	}
+	m, ok := aggmetrics.Get(mkey)
+	if !ok {
+		t.Fatalf("expected series %s to exist", mkey)
+	}
+	res, err := m.Get(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var points []schema.Point
+	for _, iter := range res.Iters {
+		for iter.Next() {
+			ts, val := iter.Values()
+			points = append(points, schema.Point{Val: val, Ts: ts})
+		}
+	}
+	expPoints := []schema.Point{{Val: 10, Ts: 10}, {Val: 20, Ts: 20}, {Val: 30, Ts: 30}}
+	if len(points) != len(expPoints) {
+		t.Fatalf("expected points %v, got %v", expPoints, points)
+	}
+	for i := range expPoints {
+		if points[i] != expPoints[i] {
+			t.Fatalf("expected points %v, got %v", expPoints, points)
+		}
+	}
+}
+
+func TestProcessMetricDataDuplicates(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	defer func(orig *dedupWindow) { dedup = orig }(dedup)
+	dedup = newDedupWindow()
+
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, 0))
+	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
+
+	aggmetrics := mdata.NewAggMetrics(backendStore.NewDevnullStore(), &cache.MockCache{}, false, 1, 800, 8000, 0)
+	metricIndex := memory.New()
+	metricIndex.Init()
+	in := NewDefaultHandler(aggmetrics, metricIndex, "TestProcessMetricDataDuplicates")
+
+	newMd := func(time int64) *schema.MetricData {
+		md := &schema.MetricData{
+			OrgId:    1,
+			Name:     "some.metric",
+			Interval: 10,
+			Value:    float64(time),
+			Time:     time,
+			Mtype:    "gauge",
+		}
+		md.SetId()
+		return md
+	}
+
+	for _, ts := range []int64{10, 20, 10} {
+		if err := in.ProcessMetricData(newMd(ts), 1); err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+	}
+	// the redelivered points are dropped, also within a batch
+	errs := in.ProcessMetricDataBatch([]*schema.MetricData{newMd(20), newMd(30), newMd(30)}, 1)
+	if errs != nil {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+	// points in other partitions are tracked separately. the series drops this one, because it's out of order
+	if err, ok := in.ProcessMetricData(newMd(10), 2).(RejectError); !ok || err.Reason != ReasonOutOfOrder {
+		t.Fatalf("expected the point to be rejected as out of order, got %v", err)
+	}
+	if dups := in.duplicates.Peek(); dups != 3 {
+		t.Fatalf("expected 3 duplicates, got %d", dups)
+	}
+
+	// points the series rejected are not remembered, so their redelivery is processed again
+	for i := 0; i < 2; i++ {
+		if err, ok := in.ProcessMetricData(newMd(5), 1).(RejectError); !ok || err.Reason != ReasonOutOfOrder {
+			t.Fatalf("expected the point to be rejected as out of order, got %v", err)
+		}
+	}
+	if dups := in.duplicates.Peek(); dups != 3 {
+		t.Fatalf("expected 3 duplicates, got %d", dups)
+	}
+}
+
+func TestValidateTime(t *testing.T) {
+	defer func(e, a, f int64, c bool) {
+		minEpoch, maxAge, maxFuture, clampTime = e, a, f, c
+	}(minEpoch, maxAge, maxFuture, clampTime)
+
+	in := NewDefaultHandler(nil, nil, "TestValidateTime")
+	now := int64(1500000000)
+	cases := []struct {
+		minEpoch  int64
+		maxAge    int64
+		maxFuture int64
+		clamp     bool
+		ts        int64
+		expTs     int64
+		reason    string
+	}{
+		{0, 0, 0, false, 1, 1, ""},
+		{0, 0, 0, false, 0, 0, ReasonTimeZero},
+		{0, 0, 0, true, 0, 0, ReasonTimeZero},
+		{0, 0, 0, false, -1, -1, ReasonTimeNegative},
+		{0, 0, 0, false, math.MaxInt32, math.MaxInt32, ReasonTimeOutOfRange},
+		{1000, 0, 0, false, 999, 999, ReasonTimeBeforeMinEpoch},
+		{1000, 0, 0, false, 1000, 1000, ""},
+		{0, 3600, 0, false, now - 7200, now - 7200, ReasonTimeTooOld},
+		{0, 3600, 0, true, now - 7200, now - 3600, ""},
+		{0, 3600, 0, false, now - 60, now - 60, ""},
+		{0, 0, 60, false, now + 120, now + 120, ReasonTimeInFuture},
+		{0, 0, 60, true, now + 120, now + 60, ""},
+		{0, 0, 60, false, now + 30, now + 30, ""},
+	}
+	for i, c := range cases {
+		minEpoch, maxAge, maxFuture, clampTime = c.minEpoch, c.maxAge, c.maxFuture, c.clamp
+		ts, err := in.validateTime(c.ts, now)
+		if ts != c.expTs {
+			t.Fatalf("case %d: expected ts %d, got %d", i, c.expTs, ts)
+		}
+		if c.reason == "" {
+			if err != nil {
+				t.Fatalf("case %d: expected no error, got %s", i, err)
+			}
+			continue
+		}
+		if err == nil || err.(RejectError).Reason != c.reason {
+			t.Fatalf("case %d: expected reason %q, got %v", i, c.reason, err)
+		}
+	}
+}
+
+func TestValidateTimeTTL(t *testing.T) {
+	defer func(r, c bool) {
+		rejectBeyondTTL, clampTime = r, c
+	}(rejectBeyondTTL, clampTime)
+
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 10, 0))
+	in := NewDefaultHandler(nil, nil, "TestValidateTimeTTL")
+	now := int64(1500000000)
+
+	rejectBeyondTTL, clampTime = false, false
+	if ts, err := in.validateTimeTTL(now-7200, now, 0); ts != now-7200 || err != nil {
+		t.Fatalf("expected point to be accepted when reject-beyond-ttl is disabled. got %d, %v", ts, err)
+	}
+	rejectBeyondTTL = true
+	if ts, err := in.validateTimeTTL(now-1800, now, 0); ts != now-1800 || err != nil {
+		t.Fatalf("expected point within ttl to be accepted. got %d, %v", ts, err)
+	}
+	if _, err := in.validateTimeTTL(now-7200, now, 0); err == nil || err.(RejectError).Reason != ReasonTimeBeyondTTL {
+		t.Fatalf("expected point beyond ttl to be rejected. got %v", err)
+	}
+	clampTime = true
+	if ts, err := in.validateTimeTTL(now-7200, now, 0); ts != now-3600 || err != nil {
+		t.Fatalf("expected point beyond ttl to be clamped to %d. got %d, %v", now-3600, ts, err)
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	defer func(p string) { nanPolicy = p }(nanPolicy)
+	in := NewDefaultHandler(nil, nil, "TestValidateValue")
+
+	cases := []struct {
+		policy string
+		val    float64
+		exp    float64
+		reject bool
+	}{
+		{nanPolicyStore, 1.5, 1.5, false},
+		{nanPolicyStore, math.NaN(), math.NaN(), false},
+		{nanPolicyStore, math.Inf(1), math.Inf(1), false},
+		{nanPolicyNull, 1.5, 1.5, false},
+		{nanPolicyNull, math.NaN(), math.NaN(), false},
+		{nanPolicyNull, math.Inf(-1), math.NaN(), false},
+		{nanPolicyDrop, 1.5, 1.5, false},
+		{nanPolicyDrop, math.NaN(), 0, true},
+		{nanPolicyDrop, math.Inf(1), 0, true},
+	}
+	for i, c := range cases {
+		nanPolicy = c.policy
+		val, err := in.validateValue(c.val)
+		if c.reject {
+			if err == nil || err.(RejectError).Reason != ReasonInvalidValue {
+				t.Fatalf("case %d: expected value %f to be rejected with reason %q, got %v", i, c.val, ReasonInvalidValue, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: expected value %f to be accepted, got %s", i, c.val, err)
+		}
+		if math.Float64bits(val) != math.Float64bits(c.exp) && !(math.IsNaN(val) && math.IsNaN(c.exp)) {
+			t.Fatalf("case %d: expected value %f to be stored as %f, got %f", i, c.val, c.exp, val)
+		}
+	}
+	if in.nonFinite.Peek() != 6 {
+		t.Fatalf("expected 6 non-finite values to be counted, got %d", in.nonFinite.Peek())
+	}
+}
+
 func BenchmarkProcessMetricDataUniqueMetrics(b *testing.B) {
 	cluster.Init("default", "test", time.Now(), "http", 6060)
 
@@ -22,7 +365,7 @@ func BenchmarkProcessMetricDataUniqueMetrics(b *testing.B) {
 	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, 0))
 	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
 
-	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 800, 8000, 0)
+	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 1, 800, 8000, 0)
 	metricIndex := memory.New()
 	metricIndex.Init()
 	in := NewDefaultHandler(aggmetrics, metricIndex, "BenchmarkProcess")
@@ -59,7 +402,7 @@ func BenchmarkProcessMetricDataSameMetric(b *testing.B) {
 	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, 0))
 	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
 
-	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 800, 8000, 0)
+	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 1, 800, 8000, 0)
 	metricIndex := memory.New()
 	metricIndex.Init()
 	in := NewDefaultHandler(aggmetrics, metricIndex, "BenchmarkProcess")
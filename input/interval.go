@@ -0,0 +1,164 @@
+package input
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+)
+
+var (
+	// metric input.interval_violations is the number of series of which the observed interval deviates from the interval of their definition (see interval-check), measured every hour
+	intervalViolations = stats.NewGauge32("input.interval_violations")
+)
+
+const (
+	// how many intervals between consecutive points we need to see, before we judge the interval of a series
+	minIntervalSamples = 5
+	// how much the observed interval may deviate from the interval of the definition, as a fraction of the latter.
+	// this tolerates jitter in the timestamps
+	intervalTolerance = 0.25
+)
+
+// IntervalViolation describes a series of which the observed interval deviates from the interval of its definition
+type IntervalViolation struct {
+	MKey     string `json:"id"`
+	Interval uint32 `json:"interval"` // interval of the definition
+	Observed uint32 `json:"observed"` // smallest interval between consecutive points, in the current or previous hour
+	Samples  uint32 `json:"samples"`  // number of intervals between consecutive points the observed interval is based on
+	LastSeen int64  `json:"lastSeen"` // unix timestamp of when the last point was received
+}
+
+type seriesInterval struct {
+	interval uint32    // interval of the definition
+	lastTs   uint32    // timestamp of the last point
+	lastSeen time.Time // when the last point was received
+
+	// observations of the current and the previous period. see intervalTracker.rotate
+	cur, prev observation
+}
+
+type observation struct {
+	minDelta uint32 // smallest interval between consecutive points. 0 if none seen
+	samples  uint32 // number of intervals between consecutive points
+}
+
+// observed returns the observation to judge the series by: the current one once it has enough samples,
+// the previous one otherwise. ok is false if neither has enough samples.
+func (s *seriesInterval) observed() (observation, bool) {
+	if s.cur.samples >= minIntervalSamples {
+		return s.cur, true
+	}
+	return s.prev, s.prev.samples >= minIntervalSamples
+}
+
+// violates returns whether the observed interval deviates from the interval of the definition.
+// we use the smallest interval between consecutive points: missing points result in larger intervals,
+// which are legitimate, whereas a series that is consistently sparser than its interval never shows it.
+func (s *seriesInterval) violates() bool {
+	o, ok := s.observed()
+	if !ok {
+		return false
+	}
+	diff := float64(o.minDelta) - float64(s.interval)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff > intervalTolerance*float64(s.interval)
+}
+
+// intervalTracker tracks the interval at which the points of each series arrive,
+// to detect series of which the definition has a wrong interval, which breaks consolidation and nulls handling.
+type intervalTracker struct {
+	sync.Mutex
+	series map[schema.MKey]*seriesInterval
+}
+
+func newIntervalTracker() *intervalTracker {
+	return &intervalTracker{
+		series: make(map[schema.MKey]*seriesInterval),
+	}
+}
+
+// add records the point of the series with the given interval.
+// points that are not newer than the previous point of the series are ignored.
+// concurrency-safe.
+func (t *intervalTracker) add(key schema.MKey, ts, interval uint32, now time.Time) {
+	t.Lock()
+	s, ok := t.series[key]
+	if !ok || s.interval != interval {
+		// new series, or the definition changed: start over
+		t.series[key] = &seriesInterval{interval: interval, lastTs: ts, lastSeen: now}
+		t.Unlock()
+		return
+	}
+	if ts > s.lastTs {
+		delta := ts - s.lastTs
+		if s.cur.minDelta == 0 || delta < s.cur.minDelta {
+			s.cur.minDelta = delta
+		}
+		s.cur.samples++
+		s.lastTs = ts
+	}
+	s.lastSeen = now
+	t.Unlock()
+}
+
+// rotate forgets series that were not seen since the given time, and starts a new observation period for all others,
+// so that series that were fixed stop being reported after two periods. it returns the number of series that violate their interval.
+// concurrency-safe.
+func (t *intervalTracker) rotate(seenBefore time.Time) int {
+	var violating int
+	t.Lock()
+	for key, s := range t.series {
+		if s.lastSeen.Before(seenBefore) {
+			delete(t.series, key)
+			continue
+		}
+		if s.violates() {
+			violating++
+		}
+		s.prev = s.cur
+		s.cur = observation{}
+	}
+	t.Unlock()
+	return violating
+}
+
+// violations returns the series that violate their interval, sorted by id.
+// concurrency-safe.
+func (t *intervalTracker) violations(limit int) []IntervalViolation {
+	var out []IntervalViolation
+	t.Lock()
+	for key, s := range t.series {
+		if s.violates() {
+			o, _ := s.observed()
+			out = append(out, IntervalViolation{
+				MKey:     key.String(),
+				Interval: s.interval,
+				Observed: o.minDelta,
+				Samples:  o.samples,
+				LastSeen: s.lastSeen.Unix(),
+			})
+		}
+	}
+	t.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].MKey < out[j].MKey
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// IntervalViolations returns up to limit series of which the observed interval deviates from the interval of their definition.
+// limit 0 means no limit. it returns nil if interval-check is disabled.
+func IntervalViolations(limit int) []IntervalViolation {
+	if intervals == nil {
+		return nil
+	}
+	return intervals.violations(limit)
+}
@@ -0,0 +1,60 @@
+package input
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+func TestIntervalTracker(t *testing.T) {
+	good := schema.MKey{Key: [16]byte{1}, Org: 1}   // 10s, with jitter and missing points
+	sparse := schema.MKey{Key: [16]byte{2}, Org: 1} // claims 10s, but sends every 60s
+	dense := schema.MKey{Key: [16]byte{3}, Org: 1}  // claims 60s, but sends every 10s
+	tr := newIntervalTracker()
+	now := time.Unix(1500000000, 0)
+
+	for i := uint32(1); i <= 10; i++ {
+		if i != 5 {
+			tr.add(good, 1000+i*10+i%2, 10, now)
+		}
+		tr.add(sparse, 1000+i*60, 10, now)
+		tr.add(dense, 1000+i*10, 60, now)
+		// old and duplicate points are ignored
+		tr.add(dense, 1000, 60, now)
+	}
+
+	exp := []IntervalViolation{
+		{MKey: sparse.String(), Interval: 10, Observed: 60, Samples: 9, LastSeen: now.Unix()},
+		{MKey: dense.String(), Interval: 60, Observed: 10, Samples: 9, LastSeen: now.Unix()},
+	}
+	got := tr.violations(0)
+	if len(got) != len(exp) {
+		t.Fatalf("expected violations %v, got %v", exp, got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("expected violation %d to be %v, got %v", i, exp[i], got[i])
+		}
+	}
+	if got := tr.violations(1); len(got) != 1 {
+		t.Fatalf("expected the limit to apply, got %v", got)
+	}
+
+	// the observations of the previous period are used until the current one has enough samples
+	if violating := tr.rotate(now.Add(-time.Hour)); violating != 2 {
+		t.Fatalf("expected 2 violating series, got %d", violating)
+	}
+	for i := uint32(1); i <= 5; i++ {
+		tr.add(sparse, 1600+i*10, 10, now.Add(time.Hour))
+	}
+	if got := tr.violations(0); len(got) != 1 || got[0].MKey != dense.String() {
+		t.Fatalf("expected only the dense series to violate its interval once the sparse one is fixed, got %v", got)
+	}
+
+	// series that were not seen for a period are forgotten
+	tr.rotate(now.Add(time.Minute))
+	if len(tr.series) != 1 {
+		t.Fatalf("expected only the fixed series to be tracked, got %d series", len(tr.series))
+	}
+}
@@ -11,12 +11,12 @@ import (
 
 	"github.com/Shopify/sarama"
 	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/bus"
+	"github.com/grafana/metrictank/bus/kafkabus"
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/input"
 	"github.com/grafana/metrictank/kafka"
 	"github.com/grafana/metrictank/stats"
-	"github.com/raintank/schema"
-	"github.com/raintank/schema/msg"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,12 +26,32 @@ var metricsPerMessage = stats.NewMeter32("input.kafka-mdm.metrics_per_message",
 // metric input.kafka-mdm.metrics_decode_err is a count of times an input message failed to parse
 var metricsDecodeErr = stats.NewCounterRate32("input.kafka-mdm.metrics_decode_err")
 
+// metric input.kafka-mdm.rejected.%s is a count of messages rejected, per reason (see docs/inputs.md)
+var rejected = newRejectedCounters()
+
+// metric input.kafka-mdm.dead_letter.published is a count of rejected messages published to the dead-letter topic
+var deadLetterPublished = stats.NewCounter32("input.kafka-mdm.dead_letter.published")
+
+// metric input.kafka-mdm.dead_letter.errors is a count of rejected messages that could not be published to the dead-letter topic
+var deadLetterErrors = stats.NewCounter32("input.kafka-mdm.dead_letter.errors")
+
+func newRejectedCounters() map[string]*stats.Counter32 {
+	counters := make(map[string]*stats.Counter32)
+	for _, reason := range input.Reasons {
+		counters[reason] = stats.NewCounter32("input.kafka-mdm.rejected." + reason)
+	}
+	return counters
+}
+
 type KafkaMdm struct {
 	input.Handler
-	consumer   sarama.Consumer
-	client     sarama.Client
-	lagMonitor *LagMonitor
-	wg         sync.WaitGroup
+	bus            bus.Bus
+	deadLetter     chan *bus.Message // nil if no dead-letter topic is configured
+	deadLetterDone chan struct{}
+	lagMonitor     *LagMonitor
+	wg             sync.WaitGroup
+	resume         resumeState   // as recorded before the restart
+	oldestUnsaved  func() uint32 // nil if we don't record where to resume
 
 	// signal to PartitionConsumers to shutdown
 	stopConsuming chan struct{}
@@ -53,6 +73,9 @@ var topics []string
 var partitionStr string
 var partitions []int32
 var offsetStr string
+var deadLetterTopic string
+var resumeFile string
+var resumeInterval = time.Minute
 var config *sarama.Config
 var channelBufferSize int
 var consumerFetchMin int
@@ -60,7 +83,7 @@ var consumerFetchDefault int
 var consumerMaxWaitTime time.Duration
 var consumerMaxProcessingTime time.Duration
 var netMaxOpenRequests int
-var offsetDuration time.Duration
+var offsetPolicy kafka.OffsetPolicy
 var partitionOffset map[int32]*stats.Gauge64
 var partitionLogSize map[int32]*stats.Gauge64
 var partitionLag map[int32]*stats.Gauge64
@@ -72,7 +95,9 @@ func ConfigSetup() {
 	inKafkaMdm.StringVar(&brokerStr, "brokers", "kafka:9092", "tcp address for kafka (may be be given multiple times as a comma-separated list)")
 	inKafkaMdm.StringVar(&kafkaVersionStr, "kafka-version", "0.10.0.0", "Kafka version in semver format. All brokers must be this version or newer.")
 	inKafkaMdm.StringVar(&topicStr, "topics", "mdm", "kafka topic (may be given multiple times as a comma-separated list)")
-	inKafkaMdm.StringVar(&offsetStr, "offset", "newest", "Set the offset to start consuming from. Can be oldest, newest or a time duration")
+	inKafkaMdm.StringVar(&offsetStr, "offset", "newest", "Set the offset to start consuming from. Can be oldest, newest or a duration (e.g. 7h or 2d)")
+	inKafkaMdm.StringVar(&resumeFile, "resume-file", "", "file to periodically record the offsets of the data of the chunks that were not saved yet in, so that after a restart we resume consuming from there, rather than from offset. empty to disable")
+	inKafkaMdm.StringVar(&deadLetterTopic, "dead-letter-topic", "", "kafka topic to publish messages to that failed decoding or validation, keyed by the reason. empty to disable")
 	inKafkaMdm.StringVar(&partitionStr, "partitions", "*", "kafka partitions to consume. use '*' or a comma separated list of id's")
 	inKafkaMdm.IntVar(&channelBufferSize, "channel-buffer-size", 1000, "The number of metrics to buffer in internal and external channels")
 	inKafkaMdm.IntVar(&consumerFetchMin, "consumer-fetch-min", 1, "The minimum number of message bytes to fetch in a request")
@@ -100,14 +125,9 @@ func ConfigProcess(instance string) {
 		log.Fatal("kafkamdm: consumer-max-processing-time must be greater then 0")
 	}
 
-	switch offsetStr {
-	case "oldest":
-	case "newest":
-	default:
-		offsetDuration, err = time.ParseDuration(offsetStr)
-		if err != nil {
-			log.Fatalf("kafkamdm: invalid offest format. %s", err)
-		}
+	offsetPolicy, err = kafka.ParseOffsetPolicy(offsetStr)
+	if err != nil {
+		log.Fatalf("kafkamdm: %s", err)
 	}
 
 	brokers = strings.Split(brokerStr, ",")
@@ -123,6 +143,11 @@ func ConfigProcess(instance string) {
 	config.Consumer.MaxProcessingTime = consumerMaxProcessingTime
 	config.Net.MaxOpenRequests = netMaxOpenRequests
 	config.Version = kafkaVersion
+	// only used for the dead-letter topic, if enabled
+	config.Producer.RequiredAcks = sarama.WaitForLocal
+	config.Producer.Compression = sarama.CompressionSnappy
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = sarama.NewManualPartitioner
 	err = config.Validate()
 	if err != nil {
 		log.Fatalf("kafkamdm: invalid config: %s", err)
@@ -161,7 +186,11 @@ func ConfigProcess(instance string) {
 		cluster.Manager.SetPartitions(partitions)
 	}
 
-	// initialize our offset metrics
+	initPartitionMetrics()
+}
+
+// initPartitionMetrics initializes the offset metrics of our partitions
+func initPartitionMetrics() {
 	partitionOffset = make(map[int32]*stats.Gauge64)
 	partitionLogSize = make(map[int32]*stats.Gauge64)
 	partitionLag = make(map[int32]*stats.Gauge64)
@@ -176,48 +205,66 @@ func ConfigProcess(instance string) {
 }
 
 func New() *KafkaMdm {
-	client, err := sarama.NewClient(brokers, config)
+	b, err := kafkabus.New(brokers, config)
 	if err != nil {
-		log.Fatalf("kafkamdm: failed to create client. %s", err)
-	}
-	consumer, err := sarama.NewConsumerFromClient(client)
-	if err != nil {
-		log.Fatalf("kafkamdm: failed to create consumer: %s", err)
+		log.Fatalf("kafkamdm: failed to create kafka bus: %s", err)
 	}
 	log.Info("kafkamdm: consumer created without error")
+	return NewWithBus(b)
+}
+
+// NewWithBus creates an input that consumes the configured topics and partitions
+// from the given bus, rather than from the kafka cluster from the kafka-mdm-in configuration.
+func NewWithBus(b bus.Bus) *KafkaMdm {
 	k := KafkaMdm{
-		consumer:      consumer,
-		client:        client,
+		bus:           b,
 		lagMonitor:    NewLagMonitor(10, partitions),
 		stopConsuming: make(chan struct{}),
 	}
 
+	if resumeFile != "" {
+		resume, err := readResumeState(resumeFile)
+		if err != nil {
+			log.Errorf("kafkamdm: failed to read %s: %s. will use offset %s", resumeFile, err, offsetPolicy)
+		}
+		k.resume = resume
+	}
+
+	if deadLetterTopic != "" {
+		k.deadLetter = make(chan *bus.Message, channelBufferSize)
+		k.deadLetterDone = make(chan struct{})
+		go k.produceDeadLetters()
+		log.Infof("kafkamdm: publishing rejected messages to dead-letter topic %s", deadLetterTopic)
+	}
+
 	return &k
 }
 
 func (k *KafkaMdm) Start(handler input.Handler, cancel context.CancelFunc) error {
 	k.Handler = handler
 	k.cancel = cancel
-	var err error
+	// all partitions start consuming from the same point in time
+	now := time.Now()
 	for _, topic := range topics {
 		for _, partition := range partitions {
-			var offset int64
-			switch offsetStr {
-			case "oldest":
-				offset = sarama.OffsetOldest
-			case "newest":
-				offset = sarama.OffsetNewest
-			default:
-				offset, err = k.client.GetOffset(topic, partition, time.Now().Add(-1*offsetDuration).UnixNano()/int64(time.Millisecond))
-				if err != nil {
-					offset = sarama.OffsetOldest
-					log.Warnf("kafkamdm: failed to get offset %s: %s -> will use oldest instead", offsetDuration, err)
-				}
+			offset, err := offsetPolicy.Offset(now, func(ms int64) (int64, error) {
+				return k.bus.Offset(topic, partition, ms)
+			})
+			if err != nil {
+				log.Warnf("kafkamdm: failed to get offset %s for %s:%d: %s -> will use oldest instead", offsetPolicy, topic, partition, err)
+			}
+			if resumeOffset, ok := k.resume.offset(topic, partition); ok {
+				log.Infof("kafkamdm: resuming %s:%d from offset %d, to replay the data since %d", topic, partition, resumeOffset, k.resume.Unsaved)
+				offset = resumeOffset
 			}
 			k.wg.Add(1)
 			go k.consumePartition(topic, partition, offset)
 		}
 	}
+	if resumeFile != "" && k.oldestUnsaved != nil {
+		k.wg.Add(1)
+		go k.recordResumeState()
+	}
 	return nil
 }
 
@@ -230,9 +277,9 @@ func (k *KafkaMdm) tryGetOffset(topic string, partition int32, offset int64, att
 	var offsetStr string
 
 	switch offset {
-	case sarama.OffsetNewest:
+	case bus.OffsetNewest:
 		offsetStr = "newest"
-	case sarama.OffsetOldest:
+	case bus.OffsetOldest:
 		offsetStr = "oldest"
 	default:
 		offsetStr = strconv.FormatInt(offset, 10)
@@ -240,7 +287,7 @@ func (k *KafkaMdm) tryGetOffset(topic string, partition int32, offset int64, att
 
 	attempt := 1
 	for {
-		val, err = k.client.GetOffset(topic, partition, offset)
+		val, err = k.bus.Offset(topic, partition, offset)
 		if err == nil {
 			break
 		}
@@ -265,16 +312,16 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset
 	partitionLagMetric := partitionLag[partition]
 
 	// determine the pos of the topic and the initial offset of our consumer
-	newest, err := k.tryGetOffset(topic, partition, sarama.OffsetNewest, 7, time.Second*10)
+	newest, err := k.tryGetOffset(topic, partition, bus.OffsetNewest, 7, time.Second*10)
 	if err != nil {
 		log.Errorf("kafkamdm: %s", err.Error())
 		k.cancel()
 		return
 	}
-	if currentOffset == sarama.OffsetNewest {
+	if currentOffset == bus.OffsetNewest {
 		currentOffset = newest
-	} else if currentOffset == sarama.OffsetOldest {
-		currentOffset, err = k.tryGetOffset(topic, partition, sarama.OffsetOldest, 7, time.Second*10)
+	} else if currentOffset == bus.OffsetOldest {
+		currentOffset, err = k.tryGetOffset(topic, partition, bus.OffsetOldest, 7, time.Second*10)
 		if err != nil {
 			log.Errorf("kafkamdm: %s", err.Error())
 			k.cancel()
@@ -287,7 +334,7 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset
 	partitionLagMetric.Set(int(newest - currentOffset))
 
 	log.Infof("kafkamdm: consuming from %s:%d from offset %d", topic, partition, currentOffset)
-	pc, err := k.consumer.ConsumePartition(topic, partition, currentOffset)
+	pc, err := k.bus.Consume(topic, partition, currentOffset)
 	if err != nil {
 		log.Errorf("kafkamdm: failed to start partitionConsumer for %s:%d. %s", topic, partition, err)
 		k.cancel()
@@ -309,7 +356,7 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset
 			currentOffset = msg.Offset
 		case ts := <-ticker.C:
 			k.lagMonitor.StoreOffset(partition, currentOffset, ts)
-			newest, err := k.tryGetOffset(topic, partition, sarama.OffsetNewest, 1, 0)
+			newest, err := k.tryGetOffset(topic, partition, bus.OffsetNewest, 1, 0)
 			if err != nil {
 				log.Errorf("kafkamdm: %s", err.Error())
 			} else {
@@ -331,27 +378,79 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset
 }
 
 func (k *KafkaMdm) handleMsg(data []byte, partition int32) {
-	format, isPointMsg := msg.IsPointMsg(data)
-	if isPointMsg {
-		_, point, err := msg.ReadPointMsg(data, uint32(orgId))
-		if err != nil {
-			metricsDecodeErr.Inc()
-			log.Errorf("kafkamdm: decode error, skipping message. %s", err)
-			return
-		}
-		k.Handler.ProcessMetricPoint(point, format, partition)
+	err := k.processMsg(data, partition)
+	if err == nil {
 		return
 	}
+	reason := input.ReasonInvalid
+	if rejectErr, ok := err.(input.RejectError); ok {
+		reason = rejectErr.Reason
+	}
+	if counter, ok := rejected[reason]; ok {
+		counter.Inc()
+	}
+	k.publishDeadLetter(data, partition, reason, err)
+}
 
-	md := schema.MetricData{}
-	_, err := md.UnmarshalMsg(data)
+func (k *KafkaMdm) processMsg(data []byte, partition int32) error {
+	decoded, err := input.Decode(data, uint32(orgId))
 	if err != nil {
 		metricsDecodeErr.Inc()
 		log.Errorf("kafkamdm: decode error, skipping message. %s", err)
+		return input.RejectError{Reason: input.ReasonDecode, Err: err}
+	}
+	if decoded.MetricData != nil {
+		metricsPerMessage.ValueUint32(1)
+	}
+	return decoded.Process(k.Handler, partition)
+}
+
+// publishDeadLetter publishes the rejected message to the dead-letter topic, if enabled.
+// the message key is the reason of the rejection, which also determines the partition.
+// if the bus supports headers (for kafka: 0.11+), we include the full error and the partition
+// the message was consumed from.
+func (k *KafkaMdm) publishDeadLetter(data []byte, partition int32, reason string, err error) {
+	if k.deadLetter == nil {
 		return
 	}
-	metricsPerMessage.ValueUint32(1)
-	k.Handler.ProcessMetricData(&md, partition)
+	k.deadLetter <- &bus.Message{
+		Topic:     deadLetterTopic,
+		Partition: bus.PartitionAuto,
+		Key:       []byte(reason),
+		Value:     data,
+		Headers: map[string][]byte{
+			"error":     []byte(err.Error()),
+			"partition": []byte(strconv.Itoa(int(partition))),
+		},
+	}
+}
+
+// produceDeadLetters publishes the messages for the dead-letter topic, in batches of whatever is
+// pending, so that consumption is not held up by publishing, until the buffer fills up.
+func (k *KafkaMdm) produceDeadLetters() {
+	defer close(k.deadLetterDone)
+	for m := range k.deadLetter {
+		batch := []*bus.Message{m}
+	Batch:
+		for len(batch) < channelBufferSize {
+			select {
+			case m, ok := <-k.deadLetter:
+				if !ok {
+					break Batch
+				}
+				batch = append(batch, m)
+			default:
+				break Batch
+			}
+		}
+		err := k.bus.Publish(batch)
+		if err != nil {
+			deadLetterErrors.Add(len(batch))
+			log.Errorf("kafkamdm: failed to publish %d messages to dead-letter topic %s: %s", len(batch), deadLetterTopic, err)
+			continue
+		}
+		deadLetterPublished.Add(len(batch))
+	}
 }
 
 // Stop will initiate a graceful stop of the Consumer (permanent)
@@ -360,7 +459,11 @@ func (k *KafkaMdm) Stop() {
 	// closes notifications and messages channels, amongst others
 	close(k.stopConsuming)
 	k.wg.Wait()
-	k.client.Close()
+	if k.deadLetter != nil {
+		close(k.deadLetter)
+		<-k.deadLetterDone
+	}
+	k.bus.Close()
 }
 
 func (k *KafkaMdm) MaintainPriority() {
@@ -0,0 +1,174 @@
+package kafkamdm
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/bus"
+	"github.com/grafana/metrictank/bus/memorybus"
+	"github.com/grafana/metrictank/input"
+	"github.com/grafana/metrictank/kafka"
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+type mockHandler struct {
+	data chan *schema.MetricData
+}
+
+func (m mockHandler) ProcessMetricData(md *schema.MetricData, partition int32) error {
+	if md.Value < 0 {
+		return input.RejectError{Reason: input.ReasonInvalid, Err: errors.New("negative value")}
+	}
+	m.data <- md
+	return nil
+}
+
+func (m mockHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
+	return nil
+}
+
+func TestConsumeFromBus(t *testing.T) {
+	topics = []string{"mdm"}
+	partitions = []int32{0, 1}
+	offsetPolicy = kafka.OffsetPolicy{Str: "oldest"}
+	deadLetterTopic = "mdm-rejected"
+	channelBufferSize = 10
+	initPartitionMetrics()
+	defer func() { deadLetterTopic = "" }()
+
+	b := memorybus.New(map[string]int32{"mdm": 2, "mdm-rejected": 3})
+	var msgs []*bus.Message
+	for i, val := range []float64{1, -1, 2, 4} {
+		md := schema.MetricData{OrgId: 1, Name: "a", Interval: 1, Value: val, Time: int64(i + 1), Mtype: "gauge"}
+		md.SetId()
+		data, err := md.MarshalMsg(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// producers may or may not wrap messages in an envelope, and may use any of its formats
+		switch i {
+		case 2:
+			data = input.NewEnvelope(input.EnvelopeMetricData, data)
+		case 3:
+			data = input.NewEnvelope(input.EnvelopeMetricDataProto, input.MarshalMetricDataProto(nil, &md))
+		}
+		msgs = append(msgs, &bus.Message{Topic: "mdm", Partition: int32(i % 2), Value: data})
+	}
+	if err := b.Publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	k := NewWithBus(b)
+	handler := mockHandler{data: make(chan *schema.MetricData, 4)}
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := k.Start(handler, cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	var sum float64
+	for i := 0; i < 3; i++ {
+		select {
+		case md := <-handler.data:
+			sum += md.Value
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for metric %d", i)
+		}
+	}
+	if sum != 7 {
+		t.Fatalf("expected the 3 valid metrics to be processed, got sum %f", sum)
+	}
+
+	// the rejected message must end up in the dead-letter topic, on the partition of its reason
+	part := bus.PartitionForKey([]byte(input.ReasonInvalid), 3)
+	c, err := b.Consume("mdm-rejected", part, bus.OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-c.Messages():
+		if string(m.Key) != input.ReasonInvalid || string(m.Headers["partition"]) != "1" || string(m.Headers["error"]) != "invalid: negative value" {
+			t.Fatalf("unexpected dead-letter message: key %q, headers %q", m.Key, m.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for dead-letter message")
+	}
+	c.Close()
+	k.Stop()
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkamdm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	topics = []string{"mdm"}
+	partitions = []int32{0}
+	offsetPolicy = kafka.OffsetPolicy{Str: "newest"}
+	channelBufferSize = 10
+	initPartitionMetrics()
+	resumeFile = filepath.Join(dir, "resume.json")
+	defer func() { resumeFile = "" }()
+
+	b := memorybus.New(map[string]int32{"mdm": 1})
+	var msgs []*bus.Message
+	for i := 1; i <= 3; i++ {
+		md := schema.MetricData{OrgId: 1, Name: "a", Interval: 1, Value: float64(i), Time: int64(i), Mtype: "gauge"}
+		md.SetId()
+		data, err := md.MarshalMsg(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, &bus.Message{Topic: "mdm", Partition: 0, Value: data})
+	}
+	if err := b.Publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+	err = writeResumeState(resumeFile, resumeState{
+		Unsaved: 100,
+		Offsets: map[string]map[int32]int64{"mdm": {0: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := NewWithBus(b)
+	if k.ReplayStart() != 100 {
+		t.Fatalf("expected replay start 100, got %d", k.ReplayStart())
+	}
+	k.TrackUnsaved(func() uint32 { return 1 })
+	handler := mockHandler{data: make(chan *schema.MetricData, 3)}
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := k.Start(handler, cancel); err != nil {
+		t.Fatal(err)
+	}
+	// we resume from offset 1, rather than from the newest offset
+	for _, exp := range []float64{2, 3} {
+		select {
+		case md := <-handler.data:
+			if md.Value != exp {
+				t.Fatalf("expected metric with value %f, got %f", exp, md.Value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for metric %f", exp)
+		}
+	}
+	k.Stop()
+
+	// upon shutdown, the offset of the oldest unsaved data is recorded
+	s, err := readResumeState(resumeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, ok := s.offset("mdm", 0); s.Unsaved != 1 || !ok || offset != 0 {
+		t.Fatalf("expected to resume from offset 0 for unsaved data at 1, got %+v", s)
+	}
+}
@@ -0,0 +1,116 @@
+package kafkamdm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resumeState is recorded in the resume-file, so that after a restart we can resume consuming
+// where the data of the chunks that were not saved yet starts, and replay it into the in-memory chunks.
+type resumeState struct {
+	Unsaved uint32                     // T0 of the oldest chunk that was not saved yet, across all series
+	Offsets map[string]map[int32]int64 // per topic and partition, the offset of the first message published at or after Unsaved
+}
+
+// offset returns the recorded offset for the given topic and partition, if any
+func (s resumeState) offset(topic string, partition int32) (int64, bool) {
+	offset, ok := s.Offsets[topic][partition]
+	return offset, ok
+}
+
+// readResumeState reads the state from the given file. if the file doesn't exist, the state is empty.
+func readResumeState(path string) (resumeState, error) {
+	var s resumeState
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// writeResumeState writes the state to the given file. it writes to a temporary file first,
+// so that a crash while writing doesn't leave a partial state behind.
+func writeResumeState(path string, s resumeState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// TrackUnsaved makes the input record where to resume consuming after a restart in the resume-file, if configured,
+// based on the T0 of the oldest chunk that was not saved yet, as returned by oldestUnsaved.
+// it must be called before Start.
+func (k *KafkaMdm) TrackUnsaved(oldestUnsaved func() uint32) {
+	k.oldestUnsaved = oldestUnsaved
+}
+
+// ReplayStart returns the T0 of the oldest chunk that was not saved before the restart,
+// if we resume consuming from there. 0 otherwise.
+func (k *KafkaMdm) ReplayStart() uint32 {
+	for _, topic := range topics {
+		for _, partition := range partitions {
+			if _, ok := k.resume.offset(topic, partition); ok {
+				return k.resume.Unsaved
+			}
+		}
+	}
+	return 0
+}
+
+// recordResumeState records the resume state every resumeInterval, and once more upon shutdown.
+func (k *KafkaMdm) recordResumeState() {
+	defer k.wg.Done()
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			k.saveResumeState()
+		case <-k.stopConsuming:
+			k.saveResumeState()
+			return
+		}
+	}
+}
+
+func (k *KafkaMdm) saveResumeState() {
+	s := resumeState{
+		Unsaved: k.oldestUnsaved(),
+		Offsets: make(map[string]map[int32]int64),
+	}
+	if s.Unsaved == 0 {
+		// we don't have any data. there's nothing to resume.
+		return
+	}
+	for _, topic := range topics {
+		s.Offsets[topic] = make(map[int32]int64)
+		for _, partition := range partitions {
+			offset, err := k.bus.Offset(topic, partition, int64(s.Unsaved)*1000)
+			if err == nil && offset < 0 {
+				err = fmt.Errorf("no message at or after %d", s.Unsaved)
+			}
+			if err != nil {
+				// keep the previous state. it resumes from further back, which is safe.
+				log.Warnf("kafkamdm: failed to get offset of %s:%d to resume from: %s. not updating %s", topic, partition, err, resumeFile)
+				return
+			}
+			s.Offsets[topic][partition] = offset
+		}
+	}
+	if err := writeResumeState(resumeFile, s); err != nil {
+		log.Errorf("kafkamdm: failed to write %s: %s", resumeFile, err)
+	}
+}
@@ -0,0 +1,261 @@
+// package mqtt provides an input that subscribes to topics of an MQTT broker, for metrics from IoT gateways and devices.
+// each message holds a single value, optionally followed by a timestamp. the metric name is derived from the topic.
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/input"
+	"github.com/grafana/metrictank/input/carbon"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// metric input.mqtt.metrics_per_message is how many metrics per message were seen. in mqtt's case this is always 1.
+var metricsPerMessage = stats.NewMeter32("input.mqtt.metrics_per_message", false)
+
+// metric input.mqtt.metrics_decode_err is a count of times an input message failed to parse
+var metricsDecodeErr = stats.NewCounterRate32("input.mqtt.metrics_decode_err")
+
+// metric input.mqtt.rejected.%s is a count of messages rejected, per reason (see docs/inputs.md)
+var rejected = newRejectedCounters()
+
+// metric input.mqtt.reconnects is a count of times we reconnected to the broker after losing the connection
+var reconnects = stats.NewCounter32("input.mqtt.reconnects")
+
+func newRejectedCounters() map[string]*stats.Counter32 {
+	counters := make(map[string]*stats.Counter32)
+	for _, reason := range input.Reasons {
+		counters[reason] = stats.NewCounter32("input.mqtt.rejected." + reason)
+	}
+	return counters
+}
+
+var Enabled bool
+var broker string
+var clientId string
+var username string
+var password string
+var topicsStr string
+var topics []string
+var qos int
+var cleanSession bool
+var nameTemplateStr string
+var nameTmpl nameTemplate
+var orgId int
+var partitionId int
+
+func ConfigSetup() {
+	inMqtt := flag.NewFlagSet("mqtt-in", flag.ExitOnError)
+	inMqtt.BoolVar(&Enabled, "enabled", false, "")
+	inMqtt.StringVar(&broker, "broker", "tcp://localhost:1883", "url of the broker. scheme is tcp, ssl or ws")
+	inMqtt.StringVar(&clientId, "client-id", "", "client id to connect with. empty to use metrictank-<instance>")
+	inMqtt.StringVar(&username, "username", "", "username to connect with. empty to connect anonymously")
+	inMqtt.StringVar(&password, "password", "", "password to connect with")
+	inMqtt.StringVar(&topicsStr, "topics", "metrics/#", "comma separated list of topic filters to subscribe to. (may contain + and # wildcards)")
+	inMqtt.IntVar(&qos, "qos", 1, "qos level to subscribe with (0, 1 or 2)")
+	inMqtt.BoolVar(&cleanSession, "clean-session", true, "start a new session when connecting. if false, the broker keeps queueing messages for us while we are disconnected")
+	inMqtt.StringVar(&nameTemplateStr, "name-template", "", "how to derive metric names from topics. $N is replaced by the Nth level of the topic, e.g. \"iot.$2.$3;site=$1\". empty to join all non-empty levels with dots")
+	inMqtt.IntVar(&orgId, "org-id", 1, "org to store the metrics under")
+	inMqtt.IntVar(&partitionId, "partition", 0, "partition Id.")
+	globalconf.Register("mqtt-in", inMqtt, flag.ExitOnError)
+}
+
+func ConfigProcess(instance string) {
+	if !Enabled {
+		return
+	}
+	for _, t := range strings.Split(topicsStr, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			topics = append(topics, t)
+		}
+	}
+	if len(topics) == 0 {
+		log.Fatal("mqtt-in: topics must be set")
+	}
+	if qos < 0 || qos > 2 {
+		log.Fatal("mqtt-in: qos must be 0, 1 or 2")
+	}
+	if orgId < 1 {
+		log.Fatal("mqtt-in: org-id must be positive")
+	}
+	var err error
+	nameTmpl, err = parseNameTemplate(nameTemplateStr)
+	if err != nil {
+		log.Fatalf("mqtt-in: invalid name-template: %s", err)
+	}
+	if clientId == "" {
+		clientId = "metrictank-" + instance
+	}
+	cluster.Manager.SetPartitions([]int32{int32(partitionId)})
+}
+
+type Mqtt struct {
+	input.Handler
+	client         paho.Client
+	connects       int32 // number of times we connected to the broker
+	intervalGetter carbon.IntervalGetter
+}
+
+func New() *Mqtt {
+	return &Mqtt{}
+}
+
+func (m *Mqtt) Name() string {
+	return "mqtt"
+}
+
+func (m *Mqtt) IntervalGetter(i carbon.IntervalGetter) {
+	m.intervalGetter = i
+}
+
+// Start connects to the broker and subscribes to the topics.
+// if the broker can't be reached at startup, we return the error.
+// afterwards, the client keeps reconnecting if we lose the connection.
+func (m *Mqtt) Start(handler input.Handler, cancel context.CancelFunc) error {
+	m.Handler = handler
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientId).
+		SetUsername(username).
+		SetPassword(password).
+		SetCleanSession(cleanSession).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(c paho.Client, err error) {
+			log.Warnf("mqtt-in: lost connection to the broker. reconnecting. %s", err)
+		})
+	m.client = paho.NewClient(opts)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		log.Errorf("mqtt-in: failed to connect to %s: %s", broker, token.Error())
+		return token.Error()
+	}
+	if err := m.subscribe(); err != nil {
+		log.Errorf("mqtt-in: %s", err)
+		m.client.Disconnect(0)
+		return err
+	}
+	log.Infof("mqtt-in: subscribed to %s", strings.Join(topics, ", "))
+	return nil
+}
+
+// onConnect resubscribes after reconnecting: with a clean session, the broker forgot our subscriptions.
+// the initial subscription is done by Start.
+func (m *Mqtt) onConnect(c paho.Client) {
+	if atomic.AddInt32(&m.connects, 1) == 1 {
+		return
+	}
+	reconnects.Inc()
+	if err := m.subscribe(); err != nil {
+		log.Errorf("mqtt-in: %s", err)
+	}
+}
+
+func (m *Mqtt) subscribe() error {
+	filters := make(map[string]byte)
+	for _, t := range topics {
+		filters[t] = byte(qos)
+	}
+	if token := m.client.SubscribeMultiple(filters, m.handleMessage); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to subscribe: %s", token.Error())
+	}
+	return nil
+}
+
+// handleMessage processes the message. the client acknowledges it once we return.
+// messages that can't be processed are not redelivered, as they would fail again.
+func (m *Mqtt) handleMessage(c paho.Client, msg paho.Message) {
+	err := m.processMsg(msg.Topic(), msg.Payload())
+	if err == nil {
+		return
+	}
+	reason := input.ReasonInvalid
+	if rejectErr, ok := err.(input.RejectError); ok {
+		reason = rejectErr.Reason
+	}
+	if counter, ok := rejected[reason]; ok {
+		counter.Inc()
+	}
+}
+
+func (m *Mqtt) processMsg(topic string, payload []byte) error {
+	md, err := m.newMetricData(topic, payload)
+	if err != nil {
+		metricsDecodeErr.Inc()
+		log.Errorf("mqtt-in: invalid message on topic %q: %s", topic, err)
+		return input.RejectError{Reason: input.ReasonDecode, Err: err}
+	}
+	metricsPerMessage.ValueUint32(1)
+	return m.Handler.ProcessMetricData(md, int32(partitionId))
+}
+
+// MaintainPriority is very simplistic for mqtt: the broker doesn't tell us
+// how far behind we are, so mark as ready immediately.
+func (m *Mqtt) MaintainPriority() {
+	cluster.Manager.SetPriority(0)
+}
+
+func (m *Mqtt) ExplainPriority() interface{} {
+	return "mqtt-in: priority=0 (always in sync)"
+}
+
+// Stop disconnects from the broker, after waiting briefly for the message being processed.
+func (m *Mqtt) Stop() {
+	log.Info("mqtt-in: shutting down")
+	m.client.Disconnect(250)
+}
+
+var errEmptyPayload = errors.New("empty payload")
+
+// newMetricData creates a MetricData out of a message. the payload is the value,
+// optionally followed by whitespace and a unix timestamp. without timestamp, the current time is used.
+func (m *Mqtt) newMetricData(topic string, payload []byte) (*schema.MetricData, error) {
+	fields := strings.Fields(string(bytes.TrimSpace(payload)))
+	if len(fields) == 0 {
+		return nil, errEmptyPayload
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("payload has %d fields. expected a value and optionally a timestamp", len(fields))
+	}
+	val, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[0])
+	}
+	ts := time.Now().Unix()
+	if len(fields) == 2 {
+		ts, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+	}
+	key, err := nameTmpl.execute(strings.Split(topic, "/"))
+	if err != nil {
+		return nil, err
+	}
+	nameSplits := strings.Split(key, ";")
+	md := &schema.MetricData{
+		Name:  nameSplits[0],
+		Tags:  nameSplits[1:],
+		Unit:  "unknown",
+		Mtype: "gauge",
+		Value: val,
+		Time:  ts,
+		OrgId: orgId,
+	}
+	md.Interval = m.intervalGetter.GetInterval(md.Name)
+	md.SetId()
+	return md, nil
+}
@@ -0,0 +1,165 @@
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/input"
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+type fixedIntervalGetter int
+
+func (f fixedIntervalGetter) GetInterval(name string) int {
+	return int(f)
+}
+
+type mockHandler struct {
+	err error
+	mds []*schema.MetricData
+}
+
+func (m *mockHandler) ProcessMetricData(md *schema.MetricData, partition int32) error {
+	m.mds = append(m.mds, md)
+	return m.err
+}
+
+func (m *mockHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
+	return m.err
+}
+
+func TestNameTemplate(t *testing.T) {
+	cases := []struct {
+		tmpl    string
+		topic   string
+		expErr  bool
+		expName string
+	}{
+		{"", "sensors/building1/temp", false, "sensors.building1.temp"},
+		{"", "/sensors//temp/", false, "sensors.temp"},
+		{"", "sensors/room 1.a/temp", false, "sensors.room_1_a.temp"},
+		{"", "/", true, ""},
+		{"iot.$2.$3;site=$1", "dc1/gw7/temp", false, "iot.gw7.temp;site=dc1"},
+		{"iot.$2.$3;site=$1", "dc1/gw7", true, ""},
+		{"$10", "1/2/3/4/5/6/7/8/9/10", false, "10"},
+		{"$2;a=$1", "x=y;z/temp", false, "temp;a=x_y_z"},
+		{"fixed", "any/topic", false, "fixed"},
+	}
+	for i, c := range cases {
+		tmpl, err := parseNameTemplate(c.tmpl)
+		if err != nil {
+			t.Fatalf("case %d: failed to parse template %q: %s", i, c.tmpl, err)
+		}
+		name, err := tmpl.execute(strings.Split(c.topic, "/"))
+		if c.expErr {
+			if err == nil {
+				t.Fatalf("case %d: expected error, got name %q", i, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: expected no error, got %s", i, err)
+		}
+		if name != c.expName {
+			t.Fatalf("case %d: expected name %q, got %q", i, c.expName, name)
+		}
+	}
+}
+
+func TestParseNameTemplateInvalid(t *testing.T) {
+	for _, tmpl := range []string{"iot.$", "iot.$a", "$0.foo"} {
+		if _, err := parseNameTemplate(tmpl); err == nil {
+			t.Fatalf("expected error for template %q", tmpl)
+		}
+	}
+}
+
+func TestNewMetricData(t *testing.T) {
+	defer func(orig nameTemplate) { nameTmpl = orig }(nameTmpl)
+	defer func(orig int) { orgId = orig }(orgId)
+	nameTmpl, _ = parseNameTemplate("iot.$3;gateway=$2")
+	orgId = 3
+	m := &Mqtt{intervalGetter: fixedIntervalGetter(10)}
+
+	cases := []struct {
+		payload string
+		expErr  bool
+		expVal  float64
+		expTime int64 // 0 means now
+	}{
+		{"1.5", false, 1.5, 0},
+		{" 42 1520000000\n", false, 42, 1520000000},
+		{"-3e2\t1520000000", false, -300, 1520000000},
+		{"", true, 0, 0},
+		{"abc", true, 0, 0},
+		{"1.5 abc", true, 0, 0},
+		{"1.5 1520000000 extra", true, 0, 0},
+	}
+	for i, c := range cases {
+		pre := time.Now().Unix()
+		md, err := m.newMetricData("site/gw1/temperature", []byte(c.payload))
+		if c.expErr {
+			if err == nil {
+				t.Fatalf("case %d: expected error, got none. md: %v", i, md)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: expected no error, got %s", i, err)
+		}
+		if md.Name != "iot.temperature" || !reflect.DeepEqual(md.Tags, []string{"gateway=gw1"}) {
+			t.Fatalf("case %d: unexpected name %q and tags %v", i, md.Name, md.Tags)
+		}
+		if md.Interval != 10 || md.Value != c.expVal || md.OrgId != 3 || md.Unit != "unknown" || md.Mtype != "gauge" {
+			t.Fatalf("case %d: unexpected md %v", i, md)
+		}
+		if c.expTime == 0 {
+			if md.Time < pre || md.Time > time.Now().Unix() {
+				t.Fatalf("case %d: expected the current time, got %d", i, md.Time)
+			}
+		} else if md.Time != c.expTime {
+			t.Fatalf("case %d: expected time %d, got %d", i, c.expTime, md.Time)
+		}
+		if err := md.Validate(); err != nil {
+			t.Fatalf("case %d: expected valid md, got %s", i, err)
+		}
+	}
+}
+
+func TestProcessMsgRejected(t *testing.T) {
+	defer func(orig nameTemplate) { nameTmpl = orig }(nameTmpl)
+	nameTmpl = nil
+	handler := &mockHandler{err: input.RejectError{Reason: input.ReasonTimeTooOld, Err: errors.New("too old")}}
+	m := &Mqtt{Handler: handler, intervalGetter: fixedIntervalGetter(10)}
+
+	decodeErrs := rejected[input.ReasonDecode].Peek()
+	tooOld := rejected[input.ReasonTimeTooOld].Peek()
+	m.handleMessage(nil, &mockMessage{topic: "a/b", payload: []byte("garbage")})
+	m.handleMessage(nil, &mockMessage{topic: "a/b", payload: []byte("1 1")})
+	if rejected[input.ReasonDecode].Peek() != decodeErrs+1 {
+		t.Fatalf("expected the undecodable message to be rejected")
+	}
+	if rejected[input.ReasonTimeTooOld].Peek() != tooOld+1 {
+		t.Fatalf("expected the message rejected by the handler to be counted")
+	}
+	if len(handler.mds) != 1 || handler.mds[0].Name != "a.b" {
+		t.Fatalf("expected only the valid message to be handled, got %v", handler.mds)
+	}
+}
+
+type mockMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *mockMessage) Duplicate() bool   { return false }
+func (m *mockMessage) Qos() byte         { return 1 }
+func (m *mockMessage) Retained() bool    { return false }
+func (m *mockMessage) Topic() string     { return m.topic }
+func (m *mockMessage) MessageID() uint16 { return 0 }
+func (m *mockMessage) Payload() []byte   { return m.payload }
+func (m *mockMessage) Ack()              {}
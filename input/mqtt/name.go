@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nameTemplate maps the levels of a topic into a metric name.
+// an empty template joins all non-empty levels with dots.
+type nameTemplate []templatePart
+
+// templatePart is a literal, followed by the given topic level (if non-zero)
+type templatePart struct {
+	literal string
+	level   int // 1-based
+}
+
+var errTemplateDollar = errors.New("$ must be followed by a topic level number")
+
+// parseNameTemplate parses a template such as "iot.$2.$3;site=$1", where $N refers to the Nth topic level
+func parseNameTemplate(s string) (nameTemplate, error) {
+	var tmpl nameTemplate
+	for s != "" {
+		pos := strings.IndexByte(s, '$')
+		if pos == -1 {
+			tmpl = append(tmpl, templatePart{literal: s})
+			break
+		}
+		literal := s[:pos]
+		s = s[pos+1:]
+		end := 0
+		for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			return nil, errTemplateDollar
+		}
+		level, err := strconv.Atoi(s[:end])
+		if err != nil || level == 0 {
+			return nil, fmt.Errorf("invalid topic level %q. levels start at 1", s[:end])
+		}
+		tmpl = append(tmpl, templatePart{literal: literal, level: level})
+		s = s[end:]
+	}
+	return tmpl, nil
+}
+
+// execute returns the name for the given topic levels
+func (t nameTemplate) execute(levels []string) (string, error) {
+	if len(t) == 0 {
+		var nodes []string
+		for _, l := range levels {
+			if l != "" {
+				nodes = append(nodes, sanitizeLevel(l))
+			}
+		}
+		if len(nodes) == 0 {
+			return "", errors.New("topic has no non-empty levels")
+		}
+		return strings.Join(nodes, "."), nil
+	}
+	var b strings.Builder
+	for _, p := range t {
+		b.WriteString(p.literal)
+		if p.level == 0 {
+			continue
+		}
+		if p.level > len(levels) {
+			return "", fmt.Errorf("topic has no level %d", p.level)
+		}
+		b.WriteString(sanitizeLevel(levels[p.level-1]))
+	}
+	return b.String(), nil
+}
+
+// sanitizeLevel replaces the characters of a topic level that have a special meaning in metric names
+func sanitizeLevel(level string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ';', '=', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, level)
+}
@@ -1,6 +1,9 @@
 package input
 
-import "context"
+import (
+	"context"
+	"net/http"
+)
 
 type Plugin interface {
 	Name() string
@@ -14,3 +17,11 @@ type Plugin interface {
 	ExplainPriority() interface{}
 	Stop() // Should block until shutdown is complete.
 }
+
+// IngestPlugin is implemented by plugins that can receive data over http
+// via the ingest listener of the API, rather than running their own listener.
+type IngestPlugin interface {
+	// IngestHandler returns the path and handler to serve on the ingest listener.
+	// ok is false if the plugin runs its own listener.
+	IngestHandler() (path string, handler http.HandlerFunc, ok bool)
+}
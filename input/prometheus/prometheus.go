@@ -40,6 +40,11 @@ func (p *prometheusWriteHandler) Start(handler input.Handler, cancel context.Can
 	p.Handler = handler
 	ConfigSetup()
 
+	if addr == "" {
+		// served by the ingest listener of the API
+		return nil
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/write", p.handle)
 	server := http.Server{
@@ -50,6 +55,10 @@ func (p *prometheusWriteHandler) Start(handler input.Handler, cancel context.Can
 	return nil
 }
 
+func (p *prometheusWriteHandler) IngestHandler() (string, http.HandlerFunc, bool) {
+	return "/prometheus/write", p.handle, addr == ""
+}
+
 func (p *prometheusWriteHandler) MaintainPriority() {
 	cluster.Manager.SetPriority(0)
 }
@@ -63,6 +72,11 @@ func (p *prometheusWriteHandler) Stop() {
 }
 
 func (p *prometheusWriteHandler) handle(w http.ResponseWriter, req *http.Request) {
+	if p.Handler == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready"))
+		return
+	}
 	if req.Body != nil {
 		defer req.Body.Close()
 		compressed, err := ioutil.ReadAll(req.Body)
@@ -89,6 +103,7 @@ func (p *prometheusWriteHandler) handle(w http.ResponseWriter, req *http.Request
 			return
 		}
 
+		var throttled int
 		for _, ts := range req.Timeseries {
 			var name string
 			var tagSet []string
@@ -101,6 +116,7 @@ func (p *prometheusWriteHandler) handle(w http.ResponseWriter, req *http.Request
 				}
 			}
 			if name != "" {
+				mds := make([]*schema.MetricData, 0, len(ts.Samples))
 				for _, sample := range ts.Samples {
 					md := &schema.MetricData{
 						Name:     name,
@@ -113,7 +129,12 @@ func (p *prometheusWriteHandler) handle(w http.ResponseWriter, req *http.Request
 						OrgId:    1,
 					}
 					md.SetId()
-					p.ProcessMetricData(md, int32(partitionID))
+					mds = append(mds, md)
+				}
+				for _, err := range p.process(mds) {
+					if rejectErr, ok := err.(input.RejectError); ok && (rejectErr.Reason == input.ReasonRateLimited || rejectErr.Reason == input.ReasonSeriesRateLimited) {
+						throttled++
+					}
 				}
 			} else {
 				w.WriteHeader(400)
@@ -127,6 +148,11 @@ func (p *prometheusWriteHandler) handle(w http.ResponseWriter, req *http.Request
 			w.Write([]byte(err.Error()))
 			return
 		}
+		if throttled > 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("%d samples rejected: ingest rate limit exceeded", throttled)))
+			return
+		}
 		w.Write([]byte("ok"))
 		return
 	}
@@ -134,10 +160,25 @@ func (p *prometheusWriteHandler) handle(w http.ResponseWriter, req *http.Request
 	w.Write([]byte("no data"))
 }
 
+// process processes the points of a single series, in one go if the handler supports it.
+// it returns the errors for the rejected points.
+func (p *prometheusWriteHandler) process(mds []*schema.MetricData) []error {
+	if bh, ok := p.Handler.(input.BatchHandler); ok {
+		return bh.ProcessMetricDataBatch(mds, int32(partitionID))
+	}
+	var errs []error
+	for _, md := range mds {
+		if err := p.ProcessMetricData(md, int32(partitionID)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
 func ConfigSetup() {
 	inPrometheus := flag.NewFlagSet("prometheus-in", flag.ExitOnError)
 	inPrometheus.BoolVar(&Enabled, "enabled", false, "")
-	inPrometheus.StringVar(&addr, "addr", ":8000", "http listen address")
+	inPrometheus.StringVar(&addr, "addr", ":8000", "http listen address. empty to receive data at /prometheus/write on the ingest listener of the http api instead")
 	inPrometheus.IntVar(&partitionID, "partition", 0, "partition Id.")
 	globalconf.Register("prometheus-in", inPrometheus, flag.ExitOnError)
 }
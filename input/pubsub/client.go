@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// client talks to the Pub/Sub REST api (https://cloud.google.com/pubsub/docs/reference/rest)
+type client struct {
+	http *http.Client
+	url  string // url of the subscription
+}
+
+func newClient(httpClient *http.Client, endpoint, project, subscription string) *client {
+	return &client{
+		http: httpClient,
+		url:  fmt.Sprintf("%s/v1/projects/%s/subscriptions/%s", endpoint, project, subscription),
+	}
+}
+
+type receivedMessage struct {
+	AckId   string `json:"ackId"`
+	Message struct {
+		// encoding/json decodes the base64 encoded data for us
+		Data []byte `json:"data"`
+	} `json:"message"`
+}
+
+// pull returns up to maxMessages messages. it waits for messages to be available,
+// but may return no messages at all.
+func (c *client) pull(ctx context.Context, maxMessages int) ([]receivedMessage, error) {
+	var resp struct {
+		ReceivedMessages []receivedMessage `json:"receivedMessages"`
+	}
+	err := c.do(ctx, "pull", map[string]interface{}{"maxMessages": maxMessages}, &resp)
+	return resp.ReceivedMessages, err
+}
+
+func (c *client) acknowledge(ctx context.Context, ackIds []string) error {
+	return c.do(ctx, "acknowledge", map[string]interface{}{"ackIds": ackIds}, nil)
+}
+
+func (c *client) modifyAckDeadline(ctx context.Context, ackIds []string, deadline time.Duration) error {
+	req := map[string]interface{}{
+		"ackIds":             ackIds,
+		"ackDeadlineSeconds": int(deadline / time.Second),
+	}
+	return c.do(ctx, "modifyAckDeadline", req, nil)
+}
+
+func (c *client) do(ctx context.Context, method string, body interface{}, out interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.url+":"+method, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %s", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s request failed with status %d: %s", method, resp.StatusCode, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %s", method, err)
+	}
+	return nil
+}
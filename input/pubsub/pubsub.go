@@ -0,0 +1,258 @@
+// package pubsub provides an input that consumes metrics from a Google Cloud Pub/Sub subscription.
+// it accepts the same message formats as the kafka-mdm input: MetricData, and MetricPoint with or without org.
+package pubsub
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/input"
+	"github.com/grafana/metrictank/stats"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+)
+
+// metric input.pubsub.metrics_per_message is how many metrics per message were seen.
+var metricsPerMessage = stats.NewMeter32("input.pubsub.metrics_per_message", false)
+
+// metric input.pubsub.metrics_decode_err is a count of times an input message failed to parse
+var metricsDecodeErr = stats.NewCounterRate32("input.pubsub.metrics_decode_err")
+
+// metric input.pubsub.rejected.%s is a count of messages rejected, per reason (see docs/inputs.md)
+var rejected = newRejectedCounters()
+
+// metric input.pubsub.pull_err is a count of failed requests to Pub/Sub to pull, acknowledge or extend the deadline of messages
+var pullErr = stats.NewCounter32("input.pubsub.pull_err")
+
+// metric input.pubsub.deadline_extensions is a count of times the ack deadline of a batch of messages was extended
+var deadlineExtensions = stats.NewCounter32("input.pubsub.deadline_extensions")
+
+func newRejectedCounters() map[string]*stats.Counter32 {
+	counters := make(map[string]*stats.Counter32)
+	for _, reason := range input.Reasons {
+		counters[reason] = stats.NewCounter32("input.pubsub.rejected." + reason)
+	}
+	return counters
+}
+
+var Enabled bool
+var project string
+var subscription string
+var endpoint string
+var maxOutstandingMessages int
+var pullers int
+var ackDeadline time.Duration
+var maxExtension time.Duration
+var orgId uint
+var partitionId int
+
+func ConfigSetup() {
+	inPubsub := flag.NewFlagSet("pubsub-in", flag.ExitOnError)
+	inPubsub.BoolVar(&Enabled, "enabled", false, "")
+	inPubsub.StringVar(&project, "project", "", "Google Cloud project of the subscription")
+	inPubsub.StringVar(&subscription, "subscription", "metrictank", "subscription to consume from. must already exist")
+	inPubsub.StringVar(&endpoint, "endpoint", "https://pubsub.googleapis.com", "Pub/Sub api endpoint. plain http endpoints (such as the emulator) are used without authentication")
+	inPubsub.IntVar(&maxOutstandingMessages, "max-outstanding-messages", 1000, "max number of messages pulled but not yet acknowledged, across all pullers")
+	inPubsub.IntVar(&pullers, "pullers", 1, "number of concurrent pull requests")
+	inPubsub.DurationVar(&ackDeadline, "ack-deadline", 10*time.Second, "ack deadline of the subscription. while pulled messages are being processed, their deadline is extended by this much, before it expires")
+	inPubsub.DurationVar(&maxExtension, "max-extension", 10*time.Minute, "max duration to keep extending the ack deadline of pulled messages. afterwards Pub/Sub redelivers them. 0 to not extend")
+	inPubsub.UintVar(&orgId, "org-id", 0, "For incoming MetricPoint messages without org-id, assume this org id")
+	inPubsub.IntVar(&partitionId, "partition", 0, "partition Id.")
+	globalconf.Register("pubsub-in", inPubsub, flag.ExitOnError)
+}
+
+func ConfigProcess() {
+	if !Enabled {
+		return
+	}
+	if project == "" || subscription == "" {
+		log.Fatal("pubsub-in: project and subscription must be set")
+	}
+	if pullers < 1 {
+		log.Fatal("pubsub-in: pullers must be positive")
+	}
+	if maxOutstandingMessages < pullers {
+		log.Fatal("pubsub-in: max-outstanding-messages must be at least pullers")
+	}
+	// Pub/Sub accepts ack deadlines between 10s and 600s
+	if ackDeadline < 10*time.Second || ackDeadline > 600*time.Second {
+		log.Fatal("pubsub-in: ack-deadline must be between 10s and 600s")
+	}
+	if maxExtension < 0 {
+		log.Fatal("pubsub-in: max-extension must not be negative")
+	}
+	cluster.Manager.SetPartitions([]int32{int32(partitionId)})
+}
+
+type Pubsub struct {
+	input.Handler
+	client   *client
+	wg       sync.WaitGroup
+	ctx      context.Context
+	shutdown context.CancelFunc
+}
+
+func New() *Pubsub {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pubsub{
+		ctx:      ctx,
+		shutdown: cancel,
+	}
+}
+
+func (p *Pubsub) Name() string {
+	return "pubsub"
+}
+
+// Start sets up the api client and starts the pullers.
+// failures to pull are retried, so that we keep going through Pub/Sub outages.
+func (p *Pubsub) Start(handler input.Handler, cancel context.CancelFunc) error {
+	p.Handler = handler
+	httpClient := http.DefaultClient
+	if !strings.HasPrefix(endpoint, "http://") {
+		var err error
+		httpClient, err = google.DefaultClient(p.ctx, "https://www.googleapis.com/auth/pubsub")
+		if err != nil {
+			log.Errorf("pubsub-in: failed to get credentials: %s", err)
+			return err
+		}
+	}
+	p.client = newClient(httpClient, endpoint, project, subscription)
+	log.Infof("pubsub-in: consuming from subscription %s of project %s", subscription, project)
+	for i := 0; i < pullers; i++ {
+		p.wg.Add(1)
+		go p.pull(maxOutstandingMessages / pullers)
+	}
+	return nil
+}
+
+func (p *Pubsub) pull(maxMessages int) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		default:
+		}
+		if err := p.pullOnce(maxMessages); err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			pullErr.Inc()
+			log.Errorf("pubsub-in: %s", err)
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// pullOnce pulls a batch of messages, processes and acknowledges them.
+// while the batch is being processed, its ack deadline is kept extended.
+func (p *Pubsub) pullOnce(maxMessages int) error {
+	msgs, err := p.client.pull(p.ctx, maxMessages)
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+	ackIds := make([]string, len(msgs))
+	for i, m := range msgs {
+		ackIds[i] = m.AckId
+	}
+
+	done := make(chan struct{})
+	var extender sync.WaitGroup
+	extender.Add(1)
+	go func() {
+		defer extender.Done()
+		p.extendDeadlines(ackIds, done)
+	}()
+
+	for _, m := range msgs {
+		p.handleMessage(m.Message.Data)
+	}
+	close(done)
+	extender.Wait()
+
+	// messages that were rejected are acknowledged too: they would fail again
+	return p.client.acknowledge(p.ctx, ackIds)
+}
+
+// extendDeadlines keeps extending the ack deadline of the given messages until done is closed,
+// or until we've extended them for maxExtension.
+func (p *Pubsub) extendDeadlines(ackIds []string, done chan struct{}) {
+	if maxExtension == 0 {
+		return
+	}
+	// extend before the deadline expires, leaving room for the request itself
+	ticker := time.NewTicker(ackDeadline * 3 / 4)
+	defer ticker.Stop()
+	giveUp := time.After(maxExtension)
+	for {
+		select {
+		case <-done:
+			return
+		case <-giveUp:
+			log.Warnf("pubsub-in: processing %d messages took longer than max-extension. they will be redelivered", len(ackIds))
+			return
+		case <-ticker.C:
+			if err := p.client.modifyAckDeadline(p.ctx, ackIds, ackDeadline); err != nil {
+				pullErr.Inc()
+				log.Errorf("pubsub-in: %s", err)
+				continue
+			}
+			deadlineExtensions.Inc()
+		}
+	}
+}
+
+func (p *Pubsub) handleMessage(data []byte) {
+	err := p.processMsg(data)
+	if err == nil {
+		return
+	}
+	reason := input.ReasonInvalid
+	if rejectErr, ok := err.(input.RejectError); ok {
+		reason = rejectErr.Reason
+	}
+	if counter, ok := rejected[reason]; ok {
+		counter.Inc()
+	}
+}
+
+func (p *Pubsub) processMsg(data []byte) error {
+	decoded, err := input.Decode(data, uint32(orgId))
+	if err != nil {
+		metricsDecodeErr.Inc()
+		log.Errorf("pubsub-in: decode error, skipping message. %s", err)
+		return input.RejectError{Reason: input.ReasonDecode, Err: err}
+	}
+	if decoded.MetricData != nil {
+		metricsPerMessage.ValueUint32(1)
+	}
+	return decoded.Process(p.Handler, int32(partitionId))
+}
+
+// MaintainPriority is very simplistic for pubsub: we can't tell
+// how far behind we are, so mark as ready immediately.
+func (p *Pubsub) MaintainPriority() {
+	cluster.Manager.SetPriority(0)
+}
+
+func (p *Pubsub) ExplainPriority() interface{} {
+	return "pubsub-in: priority=0 (always in sync)"
+}
+
+// Stop aborts outstanding requests. messages that were not acknowledged yet are redelivered by Pub/Sub.
+func (p *Pubsub) Stop() {
+	log.Info("pubsub-in: shutting down")
+	p.shutdown()
+	p.wg.Wait()
+}
@@ -0,0 +1,128 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/grafana/metrictank/input"
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+)
+
+type mockHandler struct {
+	err error
+	mds []*schema.MetricData
+}
+
+func (m *mockHandler) ProcessMetricData(md *schema.MetricData, partition int32) error {
+	m.mds = append(m.mds, md)
+	return m.err
+}
+
+func (m *mockHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
+	return m.err
+}
+
+// mockServer serves the given messages on the first pull, and records acknowledged ackIds
+func mockServer(t *testing.T, msgs [][]byte, acked *[]string) *httptest.Server {
+	pulled := false
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/p/subscriptions/s:pull":
+			var resp struct {
+				ReceivedMessages []map[string]interface{} `json:"receivedMessages"`
+			}
+			if !pulled {
+				for i, m := range msgs {
+					resp.ReceivedMessages = append(resp.ReceivedMessages, map[string]interface{}{
+						"ackId":   strconv.Itoa(i),
+						"message": map[string]interface{}{"data": m},
+					})
+				}
+				pulled = true
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v1/projects/p/subscriptions/s:acknowledge":
+			var req struct {
+				AckIds []string `json:"ackIds"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("failed to decode acknowledge request: %s", err)
+			}
+			*acked = append(*acked, req.AckIds...)
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+		}
+	}))
+}
+
+func TestPullOnce(t *testing.T) {
+	md := schema.MetricData{
+		OrgId:    1,
+		Name:     "some.metric",
+		Interval: 10,
+		Value:    1,
+		Time:     10,
+		Mtype:    "gauge",
+	}
+	md.SetId()
+	valid, err := md.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var acked []string
+	server := mockServer(t, [][]byte{valid, []byte("garbage")}, &acked)
+	defer server.Close()
+
+	handler := &mockHandler{}
+	p := New()
+	p.Handler = handler
+	p.client = newClient(http.DefaultClient, server.URL, "p", "s")
+
+	decodeErrs := rejected[input.ReasonDecode].Peek()
+	if err := p.pullOnce(100); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(handler.mds) != 1 || handler.mds[0].Id != md.Id {
+		t.Fatalf("expected the valid message to be processed, got %v", handler.mds)
+	}
+	if rejected[input.ReasonDecode].Peek() != decodeErrs+1 {
+		t.Fatalf("expected the undecodable message to be rejected")
+	}
+	if !reflect.DeepEqual(acked, []string{"0", "1"}) {
+		t.Fatalf("expected both messages to be acknowledged, got %v", acked)
+	}
+
+	// nothing left to pull
+	if err := p.pullOnce(100); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(acked) != 2 {
+		t.Fatalf("expected no more acknowledgements, got %v", acked)
+	}
+}
+
+func TestPullOnceError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	p := New()
+	p.Handler = &mockHandler{err: errors.New("should not be called")}
+	p.client = newClient(http.DefaultClient, server.URL, "p", "s")
+	if err := p.pullOnce(100); err == nil {
+		t.Fatalf("expected error for failed pull")
+	}
+	p.shutdown()
+	if _, err := p.client.pull(p.ctx, 100); err == nil || p.ctx.Err() != context.Canceled {
+		t.Fatalf("expected pull to fail after shutdown")
+	}
+}
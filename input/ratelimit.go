@@ -0,0 +1,206 @@
+package input
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+// bucket is a token bucket: it holds up to burst tokens and is refilled at rate tokens per second.
+type bucket struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// orgLimiter limits the rate of points ingested, using a token bucket per org
+type orgLimiter struct {
+	sync.RWMutex
+	rate    float64 // tokens added per second
+	burst   float64 // max tokens
+	buckets map[uint32]*bucket
+}
+
+func newOrgLimiter(rate float64, burst int) *orgLimiter {
+	return &orgLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[uint32]*bucket),
+	}
+}
+
+// get returns the bucket of the org, creating a full one if needed
+func (l *orgLimiter) get(org uint32, now time.Time) *bucket {
+	l.RLock()
+	b, ok := l.buckets[org]
+	l.RUnlock()
+	if ok {
+		return b
+	}
+	l.Lock()
+	b, ok = l.buckets[org]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[org] = b
+	}
+	l.Unlock()
+	return b
+}
+
+// allow returns whether the org may ingest a point at the given time, in which case it takes a token.
+// concurrency-safe.
+func (l *orgLimiter) allow(org uint32, now time.Time) bool {
+	b := l.get(org, now)
+	b.Lock()
+	defer b.Unlock()
+	return b.take(now, l.rate, l.burst)
+}
+
+// take refills the bucket based on the time passed, and takes a token if there is one.
+// caller must hold the lock
+func (b *bucket) take(now time.Time, rate, burst float64) bool {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// seriesBucket is the token bucket of a series, along with the state needed for
+// downsampling and reporting the series while it is being throttled.
+type seriesBucket struct {
+	bucket
+	lastTs        uint32    // ts of the last accepted point
+	dropped       uint64    // points dropped due to the limit
+	lastThrottled time.Time // last time the series exceeded the limit
+}
+
+// SeriesRateOffender describes a series that exceeded series-rate-limit
+type SeriesRateOffender struct {
+	MKey          string `json:"id"`
+	Dropped       uint64 `json:"dropped"`       // number of points dropped since metrictank started tracking the series
+	LastThrottled int64  `json:"lastThrottled"` // unix timestamp of the last time the series exceeded the limit
+}
+
+// seriesLimiter limits the rate of points ingested, using a token bucket per series.
+// while a series is over its limit, its points are either dropped,
+// or - if downsample is set - only accepted if they are at least an interval apart.
+type seriesLimiter struct {
+	sync.RWMutex
+	rate       float64
+	burst      float64
+	downsample bool
+	buckets    map[schema.MKey]*seriesBucket
+}
+
+func newSeriesLimiter(rate float64, burst int, downsample bool) *seriesLimiter {
+	return &seriesLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		downsample: downsample,
+		buckets:    make(map[schema.MKey]*seriesBucket),
+	}
+}
+
+func (l *seriesLimiter) get(key schema.MKey, now time.Time) *seriesBucket {
+	l.RLock()
+	b, ok := l.buckets[key]
+	l.RUnlock()
+	if ok {
+		return b
+	}
+	l.Lock()
+	b, ok = l.buckets[key]
+	if !ok {
+		b = &seriesBucket{bucket: bucket{tokens: l.burst, last: now}}
+		l.buckets[key] = b
+	}
+	l.Unlock()
+	return b
+}
+
+// allow returns whether the series may ingest the point with the given timestamp at the given time.
+// interval is the interval of the series, used for downsampling.
+// concurrency-safe.
+func (l *seriesLimiter) allow(key schema.MKey, ts, interval uint32, now time.Time) bool {
+	b := l.get(key, now)
+	b.Lock()
+	defer b.Unlock()
+	if b.take(now, l.rate, l.burst) {
+		b.lastTs = ts
+		return true
+	}
+	b.lastThrottled = now
+	if l.downsample && (b.lastTs == 0 || ts >= b.lastTs+interval) {
+		b.lastTs = ts
+		return true
+	}
+	b.dropped++
+	return false
+}
+
+// prune removes the state of series that have not been throttled since the given time,
+// and of which the bucket has been refilled completely, meaning it is no different from a new one.
+// concurrency-safe.
+func (l *seriesLimiter) prune(throttledBefore, now time.Time) int {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	var pruned int
+	l.Lock()
+	for key, b := range l.buckets {
+		b.Lock()
+		if b.lastThrottled.Before(throttledBefore) && now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+			pruned++
+		}
+		b.Unlock()
+	}
+	l.Unlock()
+	return pruned
+}
+
+// offenders returns the series that dropped points, sorted by the number of dropped points, the worst offender first.
+// concurrency-safe.
+func (l *seriesLimiter) offenders(limit int) []SeriesRateOffender {
+	var out []SeriesRateOffender
+	l.RLock()
+	for key, b := range l.buckets {
+		b.Lock()
+		if b.dropped > 0 {
+			out = append(out, SeriesRateOffender{
+				MKey:          key.String(),
+				Dropped:       b.dropped,
+				LastThrottled: b.lastThrottled.Unix(),
+			})
+		}
+		b.Unlock()
+	}
+	l.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Dropped == out[j].Dropped {
+			return out[i].MKey < out[j].MKey
+		}
+		return out[i].Dropped > out[j].Dropped
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// SeriesRateOffenders returns up to limit series that had points dropped due to series-rate-limit,
+// the worst offender first. limit 0 means no limit.
+func SeriesRateOffenders(limit int) []SeriesRateOffender {
+	if seriesLimit == nil {
+		return nil
+	}
+	return seriesLimit.offenders(limit)
+}
@@ -0,0 +1,99 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/raintank/schema"
+)
+
+func TestOrgLimiter(t *testing.T) {
+	l := newOrgLimiter(10, 5)
+	now := time.Unix(1000, 0)
+
+	allowed := func(org uint32, n int, now time.Time) int {
+		var ok int
+		for i := 0; i < n; i++ {
+			if l.allow(org, now) {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	// a new org starts with a full bucket
+	if got := allowed(1, 10, now); got != 5 {
+		t.Fatalf("expected burst of 5 points to be allowed, got %d", got)
+	}
+	// other orgs are not affected
+	if got := allowed(2, 3, now); got != 3 {
+		t.Fatalf("expected 3 points of org 2 to be allowed, got %d", got)
+	}
+	// after 300ms, 3 tokens have been added
+	now = now.Add(300 * time.Millisecond)
+	if got := allowed(1, 10, now); got != 3 {
+		t.Fatalf("expected 3 points to be allowed after 300ms, got %d", got)
+	}
+	// the bucket never holds more than the burst
+	now = now.Add(time.Hour)
+	if got := allowed(1, 10, now); got != 5 {
+		t.Fatalf("expected burst of 5 points to be allowed after an hour, got %d", got)
+	}
+	// time going backwards doesn't add tokens
+	if got := allowed(1, 1, now.Add(-time.Minute)); got != 0 {
+		t.Fatalf("expected no points to be allowed, got %d", got)
+	}
+}
+
+func TestSeriesLimiter(t *testing.T) {
+	key1 := schema.MKey{Key: [16]byte{1}, Org: 1}
+	key2 := schema.MKey{Key: [16]byte{2}, Org: 1}
+	now := time.Unix(1000, 0)
+
+	// with the drop policy, all points beyond the burst are dropped
+	l := newSeriesLimiter(1, 2, false)
+	var allowed int
+	for ts := uint32(1000); ts < 1010; ts++ {
+		if l.allow(key1, ts, 1, now) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("expected 2 points to be allowed, got %d", allowed)
+	}
+	if !l.allow(key2, 1000, 1, now) {
+		t.Fatal("expected other series not to be affected")
+	}
+
+	// with the downsample policy, points are still accepted if they are an interval apart
+	l = newSeriesLimiter(1, 2, true)
+	var accepted []uint32
+	for ts := uint32(1000); ts < 1040; ts++ {
+		if l.allow(key1, ts, 10, now) {
+			accepted = append(accepted, ts)
+		}
+	}
+	exp := []uint32{1000, 1001, 1011, 1021, 1031}
+	if !reflect.DeepEqual(accepted, exp) {
+		t.Fatalf("expected points %v to be accepted, got %v", exp, accepted)
+	}
+
+	offenders := l.offenders(0)
+	if len(offenders) != 1 || offenders[0].MKey != key1.String() || offenders[0].Dropped != 35 || offenders[0].LastThrottled != now.Unix() {
+		t.Fatalf("unexpected offenders %v", offenders)
+	}
+
+	// recently throttled series are kept, so they can be reported
+	l.allow(key2, 1000, 10, now)
+	later := now.Add(time.Minute)
+	if pruned := l.prune(now.Add(-time.Hour), later); pruned != 1 {
+		t.Fatalf("expected 1 series to be pruned, got %d", pruned)
+	}
+	if pruned := l.prune(later, later); pruned != 1 {
+		t.Fatalf("expected 1 series to be pruned, got %d", pruned)
+	}
+	if offenders := l.offenders(0); len(offenders) != 0 {
+		t.Fatalf("expected no offenders after pruning, got %v", offenders)
+	}
+}
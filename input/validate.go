@@ -0,0 +1,93 @@
+package input
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/grafana/metrictank/mdata"
+)
+
+// timeReasons are the reasons why a point may be rejected due to its timestamp
+var timeReasons = []string{
+	ReasonTimeZero,
+	ReasonTimeNegative,
+	ReasonTimeBeforeMinEpoch,
+	ReasonTimeTooOld,
+	ReasonTimeInFuture,
+	ReasonTimeBeyondTTL,
+	ReasonTimeOutOfRange,
+}
+
+// clampReasons are the reasons why a point may have its timestamp clamped, if time-policy is clamp
+var clampReasons = []string{
+	ReasonTimeTooOld,
+	ReasonTimeInFuture,
+	ReasonTimeBeyondTTL,
+}
+
+// validateTime checks whether the timestamp is acceptable, and returns the timestamp to use.
+// note that a timestamp of 0 is never valid, as AggMetric uses it to mark uninitialized state.
+// in cassandra we store timestamps as 32bit signed integers, so we can't accept
+// anything from math.MaxInt32 (Jan 19 03:14:07 UTC 2038) onwards either.
+// timestamps violating max-age or max-future are rejected, or moved to the nearest
+// acceptable timestamp if time-policy is clamp.
+func (in DefaultHandler) validateTime(ts, now int64) (int64, error) {
+	var err error
+	switch {
+	case ts == 0:
+		err = reject(ReasonTimeZero, fmt.Errorf(".Time %d is zero", ts))
+	case ts < 0:
+		err = reject(ReasonTimeNegative, fmt.Errorf(".Time %d is negative", ts))
+	case ts >= math.MaxInt32:
+		err = reject(ReasonTimeOutOfRange, fmt.Errorf(".Time %d out of range", ts))
+	case ts < minEpoch:
+		err = reject(ReasonTimeBeforeMinEpoch, fmt.Errorf(".Time %d is before min-epoch %d", ts, minEpoch))
+	case maxAge > 0 && ts < now-maxAge:
+		return in.clampOrReject(ts, now-maxAge, ReasonTimeTooOld, "older than max-age")
+	case maxFuture > 0 && ts > now+maxFuture:
+		return in.clampOrReject(ts, now+maxFuture, ReasonTimeInFuture, "further in the future than max-future")
+	}
+	if err != nil {
+		in.invalidTime[err.(RejectError).Reason].Inc()
+	}
+	return ts, err
+}
+
+// validateTimeTTL checks whether the timestamp falls within the TTL of the raw archive
+// of the given storage schema, if enabled via reject-beyond-ttl.
+// this check can only be done after we know which schema the series belongs to.
+func (in DefaultHandler) validateTimeTTL(ts, now int64, schemaId uint16) (int64, error) {
+	if !rejectBeyondTTL {
+		return ts, nil
+	}
+	ttl := int64(mdata.GetSchema(schemaId).Retentions[0].MaxRetention())
+	if ts >= now-ttl {
+		return ts, nil
+	}
+	return in.clampOrReject(ts, now-ttl, ReasonTimeBeyondTTL, "older than the ttl of the raw archive")
+}
+
+// clampOrReject either returns the nearest acceptable timestamp, or an error, based on the time-policy
+func (in DefaultHandler) clampOrReject(ts, nearest int64, reason, desc string) (int64, error) {
+	if clampTime {
+		in.clampedTime[reason].Inc()
+		return nearest, nil
+	}
+	in.invalidTime[reason].Inc()
+	return ts, reject(reason, fmt.Errorf(".Time %d is %s (%d)", ts, desc, nearest))
+}
+
+// validateValue applies the nan-policy to points with a NaN or infinite value, and returns the value to store.
+func (in DefaultHandler) validateValue(val float64) (float64, error) {
+	if !math.IsNaN(val) && !math.IsInf(val, 0) {
+		return val, nil
+	}
+	in.nonFinite.Inc()
+	switch nanPolicy {
+	case nanPolicyDrop:
+		return val, reject(ReasonInvalidValue, fmt.Errorf(".Value %f is not a finite number", val))
+	case nanPolicyNull:
+		return math.NaN(), nil
+	}
+	return val, nil
+}
@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/raintank/dur"
+)
+
+// OffsetPolicy describes from which offset to start consuming partitions:
+// the oldest or newest available offset, or the offset from a given duration ago
+type OffsetPolicy struct {
+	Str      string        // the policy as configured
+	Duration time.Duration // only set for duration based policies
+}
+
+// ParseOffsetPolicy parses oldest, newest or a duration.
+// durations can be specified as Go durations (e.g. "7h" or "90m")
+// or using the units supported elsewhere in the config (e.g. "2d")
+func ParseOffsetPolicy(s string) (OffsetPolicy, error) {
+	switch s {
+	case "oldest", "newest":
+		return OffsetPolicy{Str: s}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, err2 := dur.ParseNDuration(s)
+		if err2 != nil {
+			return OffsetPolicy{}, fmt.Errorf("invalid offset %q: must be oldest, newest or a duration", s)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return OffsetPolicy{}, fmt.Errorf("invalid offset %q: duration must be positive", s)
+	}
+	return OffsetPolicy{Str: s, Duration: d}, nil
+}
+
+func (p OffsetPolicy) String() string {
+	return p.Str
+}
+
+// Offset returns the offset to start consuming from: sarama.OffsetOldest, sarama.OffsetNewest
+// or, for duration based policies, the result of getOffset for the time (in ms) Duration before now.
+// callers should use the same now for all partitions, so that they all start from the same point in time.
+// if the offset can't be looked up (e.g. Kafka doesn't have data that far back), we fall back to oldest,
+// and return the error for the caller to report.
+func (p OffsetPolicy) Offset(now time.Time, getOffset func(ms int64) (int64, error)) (int64, error) {
+	switch p.Str {
+	case "oldest":
+		return sarama.OffsetOldest, nil
+	case "newest":
+		return sarama.OffsetNewest, nil
+	}
+	offset, err := getOffset(now.Add(-1*p.Duration).UnixNano() / int64(time.Millisecond))
+	if err != nil {
+		return sarama.OffsetOldest, err
+	}
+	return offset, nil
+}
@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestParseOffsetPolicy(t *testing.T) {
+	cases := []struct {
+		in       string
+		duration time.Duration
+		err      bool
+	}{
+		{"oldest", 0, false},
+		{"newest", 0, false},
+		{"7h", 7 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"2d", 48 * time.Hour, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"", 0, true},
+		{"latest", 0, true},
+		{"-1h", 0, true},
+		{"0s", 0, true},
+	}
+	for _, c := range cases {
+		p, err := ParseOffsetPolicy(c.in)
+		if (err != nil) != c.err {
+			t.Fatalf("%q: expected error %t, got %v", c.in, c.err, err)
+		}
+		if err == nil && p.Duration != c.duration {
+			t.Fatalf("%q: expected duration %s, got %s", c.in, c.duration, p.Duration)
+		}
+	}
+}
+
+func TestOffsetPolicyOffset(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var requested int64
+	getOffset := func(ms int64) (int64, error) {
+		requested = ms
+		return 42, nil
+	}
+	failOffset := func(ms int64) (int64, error) {
+		return 0, errors.New("no such offset")
+	}
+
+	cases := []struct {
+		policy    string
+		getOffset func(ms int64) (int64, error)
+		exp       int64
+		expErr    bool
+	}{
+		{"oldest", failOffset, sarama.OffsetOldest, false},
+		{"newest", failOffset, sarama.OffsetNewest, false},
+		{"10m", getOffset, 42, false},
+		{"10m", failOffset, sarama.OffsetOldest, true},
+	}
+	for i, c := range cases {
+		p, err := ParseOffsetPolicy(c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, err := p.Offset(now, c.getOffset)
+		if (err != nil) != c.expErr {
+			t.Fatalf("case %d: expected error %t, got %v", i, c.expErr, err)
+		}
+		if offset != c.exp {
+			t.Fatalf("case %d: expected offset %d, got %d", i, c.exp, offset)
+		}
+	}
+	if requested != 400*1000 {
+		t.Fatalf("expected offset lookup for ts 400000 ms, got %d", requested)
+	}
+}
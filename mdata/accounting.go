@@ -0,0 +1,176 @@
+package mdata
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+)
+
+// MemoryUsage describes data held in memory
+type MemoryUsage struct {
+	Series int64 `json:"series"` // excl rollup series
+	Chunks int64 `json:"chunks"`
+	Points int64 `json:"points"`
+	Bytes  int64 `json:"bytes"` // size of the closed chunks. current chunks grow with every point and are not included
+}
+
+// OrgUsage describes the data of an org held in memory
+type OrgUsage struct {
+	OrgId uint32 `json:"orgId"`
+	MemoryUsage
+}
+
+// Usage describes the data held in memory, in total and per org
+type Usage struct {
+	Total MemoryUsage `json:"total"`
+	Orgs  []OrgUsage  `json:"orgs"`
+}
+
+// usage is the accounting of the data of one org. its fields are updated atomically,
+// so AggMetrics can update it without any other locking.
+type usage struct {
+	series int64
+	chunks int64
+	points int64
+	bytes  int64
+
+	results [numAddResults]uint64 // points added to the raw series, by result. see GetDropped
+}
+
+func (u *usage) addSeries(delta int64) {
+	atomic.AddInt64(&u.series, delta)
+}
+
+// addChunk accounts a chunk that was added to memory, along with its points and, if it is closed, its size.
+func (u *usage) addChunk(c *chunk.Chunk) {
+	atomic.AddInt64(&u.chunks, 1)
+	totalChunks.Inc()
+	u.addPoints(int64(c.NumPoints))
+	if c.Series.Finished {
+		u.addBytes(int64(len(c.Series.Bytes())))
+	}
+}
+
+// clearChunk accounts a chunk that was removed from memory. it is the opposite of addChunk.
+func (u *usage) clearChunk(c *chunk.Chunk) {
+	atomic.AddInt64(&u.chunks, -1)
+	totalChunks.Dec()
+	u.addPoints(-int64(c.NumPoints))
+	if c.Series.Finished {
+		u.addBytes(-int64(len(c.Series.Bytes())))
+	}
+}
+
+// closeChunk finishes the chunk, if it isn't finished already, and accounts its size.
+func (u *usage) closeChunk(c *chunk.Chunk) {
+	if c.Series.Finished {
+		return
+	}
+	c.Finish()
+	u.addBytes(int64(len(c.Series.Bytes())))
+}
+
+func (u *usage) addPoints(delta int64) {
+	atomic.AddInt64(&u.points, delta)
+	totalPoints.Add(int(delta))
+}
+
+func (u *usage) addBytes(delta int64) {
+	atomic.AddInt64(&u.bytes, delta)
+	totalChunkBytes.Add(int(delta))
+}
+
+func (u *usage) get() MemoryUsage {
+	return MemoryUsage{
+		Series: atomic.LoadInt64(&u.series),
+		Chunks: atomic.LoadInt64(&u.chunks),
+		Points: atomic.LoadInt64(&u.points),
+		Bytes:  atomic.LoadInt64(&u.bytes),
+	}
+}
+
+// accounting tracks the data held in memory per org.
+// it covers all AggMetrics, including the ones of rollups.
+type accounting struct {
+	sync.RWMutex
+	orgs map[uint32]*usage
+}
+
+func newAccounting() *accounting {
+	return &accounting{
+		orgs: make(map[uint32]*usage),
+	}
+}
+
+// org returns the usage of the org, which AggMetrics of the org keep a reference to
+func (ac *accounting) org(org uint32) *usage {
+	ac.RLock()
+	u, ok := ac.orgs[org]
+	ac.RUnlock()
+	if ok {
+		return u
+	}
+	ac.Lock()
+	u, ok = ac.orgs[org]
+	if !ok {
+		u = &usage{}
+		ac.orgs[org] = u
+	}
+	ac.Unlock()
+	return u
+}
+
+// GetUsage returns the data held in memory, in total and for each org that has data in memory, sorted by org.
+func GetUsage() Usage {
+	var out Usage
+	accnt.RLock()
+	for org, u := range accnt.orgs {
+		mu := u.get()
+		if mu == (MemoryUsage{}) {
+			continue
+		}
+		out.Orgs = append(out.Orgs, OrgUsage{
+			OrgId:       org,
+			MemoryUsage: mu,
+		})
+		out.Total.Series += mu.Series
+		out.Total.Chunks += mu.Chunks
+		out.Total.Points += mu.Points
+		out.Total.Bytes += mu.Bytes
+	}
+	accnt.RUnlock()
+	sort.Slice(out.Orgs, func(i, j int) bool {
+		return out.Orgs[i].OrgId < out.Orgs[j].OrgId
+	})
+	if out.Orgs == nil {
+		out.Orgs = []OrgUsage{}
+	}
+	return out
+}
+
+// clearChunks removes all chunks from memory.
+// caller must hold write lock
+func (a *AggMetric) clearChunks() {
+	for _, c := range a.Chunks {
+		if c != nil {
+			a.usage.clearChunk(c)
+		}
+	}
+	a.Chunks = a.Chunks[:0]
+}
+
+// release removes the chunks of the metric and its rollups from the accounting,
+// when the metric is removed from memory.
+func (a *AggMetric) release() {
+	for _, am := range a.archiveMetrics() {
+		am.RLock()
+		for _, c := range am.Chunks {
+			if c != nil {
+				am.usage.clearChunk(c)
+			}
+		}
+		am.RUnlock()
+	}
+}
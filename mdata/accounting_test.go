@@ -0,0 +1,106 @@
+package mdata
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/raintank/schema"
+)
+
+func orgUsage(org uint32) (MemoryUsage, bool) {
+	for _, u := range GetUsage().Orgs {
+		if u.OrgId == org {
+			return u.MemoryUsage, true
+		}
+	}
+	return MemoryUsage{}, false
+}
+
+func TestAccounting(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	SetSingleSchema(conf.NewRetentionMT(1, 3600, 10, 2, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 0, 0, 0, 0)
+
+	// the accounting is global, so use an org that no other test uses
+	key := schema.MKey{Key: schema.Key{1}, Org: 1000}
+	m := getOrCreate(ms, key)
+	for ts := uint32(10); ts < 20; ts++ {
+		m.Add(ts, float64(ts))
+	}
+	exp := MemoryUsage{Series: 1, Chunks: 1, Points: 10}
+	if got, _ := orgUsage(1000); got != exp {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+
+	// closes chunk 10, which accounts its size
+	m.Add(20, 20)
+	m.Add(21, 21)
+	size10 := int64(len(m.Chunks[0].Series.Bytes()))
+	exp = MemoryUsage{Series: 1, Chunks: 2, Points: 12, Bytes: size10}
+	if got, _ := orgUsage(1000); got != exp {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+
+	// chunk 30 replaces chunk 10
+	m.Add(30, 30)
+	size20 := int64(len(m.Chunks[1].Series.Bytes()))
+	exp = MemoryUsage{Series: 1, Chunks: 2, Points: 3, Bytes: size20}
+	if got, _ := orgUsage(1000); got != exp {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+
+	ms.Delete(key)
+	if got, ok := orgUsage(1000); ok {
+		t.Fatalf("expected no usage after the series was removed, got %+v", got)
+	}
+}
+
+func TestDropped(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	SetSingleSchema(conf.NewRetentionMT(1, 3600, 10, 2, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 0, 0, 0, 0)
+
+	// the accounting is global, so use an org that no other test uses
+	key := schema.MKey{Key: schema.Key{2}, Org: 1001}
+	m := getOrCreate(ms, key)
+	type add struct {
+		ts  uint32
+		exp AddResult
+	}
+	for _, a := range []add{
+		{10, AddAccepted},
+		{11, AddAccepted},
+		{11, AddDuplicate},
+		{9, AddTooOld},
+		{20, AddAccepted},
+		{12, AddTooOld},
+	} {
+		if got := m.Add(a.ts, float64(a.ts)); got != a.exp {
+			t.Fatalf("adding point %d: expected %s, got %s", a.ts, a.exp, got)
+		}
+	}
+
+	var got map[string]uint64
+	for _, od := range GetDropped() {
+		if od.OrgId == 1001 {
+			got = od.Points
+		}
+	}
+	exp := map[string]uint64{
+		"accepted":     3,
+		"too_old":      2,
+		"chunk_saved":  0,
+		"duplicate":    1,
+	}
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+}
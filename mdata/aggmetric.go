@@ -1,36 +1,47 @@
 package mdata
 
 import (
-	"errors"
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/errors"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/mdata/chunk/tsz"
 	"github.com/raintank/schema"
 	log "github.com/sirupsen/logrus"
 )
 
-var ErrInvalidRange = errors.New("AggMetric: invalid range: from must be less than to")
-var ErrNilChunk = errors.New("AggMetric: unexpected nil chunk")
+// the errors of the read path carry the http status code they correspond to,
+// so that a bad query results in an error response, rather than taking down the node.
+var ErrInvalidRange = errors.NewBadRequest("AggMetric: invalid range: from must be less than to")
+var ErrNilChunk = errors.NewInternal("AggMetric: unexpected nil chunk")
 
 // AggMetric takes in new values, updates the in-memory data and streams the points to aggregators
 // it uses a circular buffer of chunks
 // each chunk starts at their respective t0
-// a t0 is a timestamp divisible by chunkSpan without a remainder (e.g. 2 hour boundaries)
+// a t0 is a timestamp divisible by chunkSpan without a remainder (e.g. 2 hour boundaries),
+// except for chunks that follow a chunk that was rolled over because it reached max-points-per-chunk:
+// those start at their first point, and end where the chunkspan ends, or where they were rolled over themselves.
 // firstT0's data is held at index 0, indexes go up and wrap around from numChunks-1 to 0
 // in addition, keep in mind that the last chunk is always a work in progress and not useable for aggregation
-// AggMetric is concurrency-safe
+// AggMetric is concurrency-safe. writes take the lock, whereas reads of metrics without a reorder buffer
+// work off the chunkView, so that reads of hot series don't contend with their writes.
 type AggMetric struct {
 	store       Store
 	cachePusher cache.CachePusher
 	sync.RWMutex
 	Key             schema.AMKey
+	schemaId        uint16 // set by AggMetrics, to apply reloaded retentions and for snapshots
+	aggId           uint16 // set by AggMetrics, for snapshots
+	float32         bool   // round values to float32 precision before adding them to chunks. see setFloat32
+	rollupOnly      bool   // the chunks only feed the aggregators, they are not saved. see setRollupOnly
 	rob             *ReorderBuffer
 	CurrentChunkPos int    // element in []Chunks that is active. All others are either finished or nil.
 	NumChunks       uint32 // max size of the circular buffer
@@ -42,7 +53,59 @@ type AggMetric struct {
 	lastSaveStart   uint32 // last chunk T0 that was added to the write Queue.
 	lastSaveFinish  uint32 // last chunk T0 successfully written to Cassandra.
 	lastWrite       uint32 // wall clock time of when last point was successfully added (possibly to the ROB)
+	lastRead        uint32 // wall clock time of when the data was last read. updated atomically, see dropIdleChunks
 	firstTs         uint32 // timestamp of first point seen
+	usage           *usage // accounting of the org of the metric
+
+	// the chunks as seen by readers. replaced (under the write lock) whenever the set of chunks changes. see publish
+	view atomic.Value // *chunkView
+}
+
+// chunkView is an immutable view of the chunks of an AggMetric.
+// the closed chunks are immutable, and the current chunk synchronizes reads and writes of its data itself,
+// so the view can be read without taking the lock of the AggMetric.
+type chunkView struct {
+	chunks  []*chunk.Chunk // oldest first. the last one is the current chunk
+	ends    []uint32       // the end of each chunk (exclusive), see chunkEnd
+	firstTs uint32
+}
+
+// publish makes a new view of the chunks available to readers.
+// it must be called after any change of the ring buffer, the current chunk position or firstTs.
+// caller must hold write lock
+func (a *AggMetric) publish() {
+	v := &chunkView{
+		chunks:  make([]*chunk.Chunk, 0, len(a.Chunks)),
+		ends:    make([]uint32, 0, len(a.Chunks)),
+		firstTs: a.firstTs,
+	}
+	// the oldest chunk is the one after the current one, unless the buffer hasn't wrapped around yet.
+	if len(a.Chunks) > 0 {
+		v.chunks = append(v.chunks, a.Chunks[a.CurrentChunkPos+1:]...)
+		v.chunks = append(v.chunks, a.Chunks[:a.CurrentChunkPos+1]...)
+	}
+	// the end of a chunk changes when it is rolled over, so readers get it from the view, rather than from the chunk
+	for _, c := range v.chunks {
+		v.ends = append(v.ends, a.chunkEnd(c))
+	}
+	a.view.Store(v)
+}
+
+// chunkEnd returns the end (exclusive) of the timeframe of the chunk: the end of its chunkspan,
+// unless it was rolled over before that, in which case the next chunk starts there.
+// caller must hold lock
+func (a *AggMetric) chunkEnd(c *chunk.Chunk) uint32 {
+	if c.End != 0 {
+		return c.End
+	}
+	return c.Series.T0 - c.Series.T0%a.ChunkSpan + a.ChunkSpan
+}
+
+// spanOf returns the span of the timeframe of the chunk, which is what it is saved with.
+// this is the chunkspan, except for chunks that start or end within their chunkspan because of a rollover.
+// caller must hold lock
+func (a *AggMetric) spanOf(c *chunk.Chunk) uint32 {
+	return a.chunkEnd(c) - c.Series.T0
 }
 
 // NewAggMetric creates a metric with given key, it retains the given number of chunks each chunkSpan seconds long
@@ -62,24 +125,36 @@ func NewAggMetric(store Store, cachePusher cache.CachePusher, key schema.AMKey,
 		NumChunks:      ret.NumChunks,
 		Chunks:         make([]*chunk.Chunk, 0, ret.NumChunks),
 		dropFirstChunk: dropFirstChunk,
+		usage:          accnt.org(key.MKey.Org),
 		ttl:            uint32(ret.MaxRetention()),
 		// we set LastWrite here to make sure a new Chunk doesn't get immediately
 		// garbage collected right after creating it, before we can push to it.
 		lastWrite: uint32(time.Now().Unix()),
+		lastRead:  uint32(time.Now().Unix()),
 	}
 	if reorderWindow != 0 {
 		m.rob = NewReorderBuffer(reorderWindow, ret.SecondsPerPoint)
 	}
+	m.publish()
 
 	for _, ret := range retentions[1:] {
-		m.aggregators = append(m.aggregators, NewAggregator(store, cachePusher, key, ret, *agg, dropFirstChunk))
+		aggregator := NewAggregator(store, cachePusher, key, ret, *agg, dropFirstChunk)
+		aggregator.setXFilesFactor(agg.XFilesFactor, retentions[0].SecondsPerPoint)
+		if chainRollups && len(m.aggregators) > 0 {
+			m.aggregators[len(m.aggregators)-1].chain(aggregator)
+		}
+		m.aggregators = append(m.aggregators, aggregator)
 	}
 
 	return &m
 }
 
 // Sync the saved state of a chunk by its T0.
+// a may be nil, for chunks that are not saved on behalf of a metric in memory. see CopySeries
 func (a *AggMetric) SyncChunkSaveState(ts uint32) {
+	if a == nil {
+		return
+	}
 	a.Lock()
 	defer a.Unlock()
 	if ts > a.lastSaveFinish {
@@ -133,6 +208,266 @@ func (a *AggMetric) SyncAggregatedChunkSaveState(ts uint32, consolidator consoli
 	}
 }
 
+// archiveMetric returns the AggMetric that holds the chunks for the given archive,
+// or nil if we don't have such an archive.
+func (a *AggMetric) archiveMetric(archive schema.Archive) *AggMetric {
+	if archive == 0 {
+		return a
+	}
+	// no lock needed cause aggregators don't change at runtime
+	for _, agg := range a.aggregators {
+		if agg.span != archive.Span() {
+			continue
+		}
+		switch consolidation.FromArchive(archive.Method()) {
+		case consolidation.Cnt:
+			return agg.cntMetric
+		case consolidation.Lst:
+			return agg.lstMetric
+		case consolidation.Min:
+			return agg.minMetric
+		case consolidation.Max:
+			return agg.maxMetric
+		case consolidation.Sum:
+			return agg.sumMetric
+		}
+	}
+	return nil
+}
+
+// archiveMetrics returns the AggMetrics of all our archives: ourself, followed by those of the aggregators
+func (a *AggMetric) archiveMetrics() []*AggMetric {
+	out := []*AggMetric{a}
+	// no lock needed cause aggregators don't change at runtime
+	for _, agg := range a.aggregators {
+		out = append(out, agg.archives()...)
+	}
+	return out
+}
+
+// setFloat32 makes the metric and its rollups store values with float32 precision.
+// the chunk format stays the same, but the 29 least significant bits of the mantissas are zero,
+// which the XOR compression of the chunks turns into about half the bits per point.
+// the aggregators still compute the rollups from the values with full precision.
+// it must be called before any data is added.
+func (a *AggMetric) setFloat32(float32 bool) {
+	for _, m := range a.archiveMetrics() {
+		m.float32 = float32
+	}
+}
+
+// setRollupOnly makes the metric only keep its raw chunks in memory to feed the aggregators:
+// closed chunks count as saved straight away, rather than being added to the write queue.
+// its rollups are saved as usual.
+// it must be called before any data is added.
+func (a *AggMetric) setRollupOnly(rollupOnly bool) {
+	a.rollupOnly = rollupOnly
+}
+
+// setDupPolicy sets how points with the same timestamp as the last point are resolved.
+// that requires holding points back until the next point arrives, so unless the metric has a reorder buffer,
+// it gets one of 1 point. like any reorder buffer, it aligns the timestamps to the interval.
+// without a reorder buffer, the first point is kept, so the default and keep-first policies don't need one.
+// it must be called before any data is added.
+func (a *AggMetric) setDupPolicy(policy conf.DupPolicy, interval int) {
+	if a.rob == nil {
+		if policy == conf.DupDefault || policy == conf.DupKeepFirst {
+			return
+		}
+		a.rob = NewReorderBuffer(1, interval)
+	}
+	a.rob.dupPolicy = policy
+}
+
+// SetRetentions applies the number of chunks and the ttl of the given retentions to the metric and its rollups.
+// the chunkspan is not changed, because all chunks in the buffer must have the same span.
+// retentions must have the same intervals as those the metric was created with.
+func (a *AggMetric) SetRetentions(retentions conf.Retentions) {
+	a.setRetention(retentions[0])
+	// no lock needed cause aggregators don't change at runtime
+	for i, agg := range a.aggregators {
+		for _, m := range agg.archives() {
+			m.setRetention(retentions[i+1])
+		}
+	}
+}
+
+// SetXFilesFactor updates the xFilesFactor of the aggregators. see Aggregator.setXFilesFactor
+func (a *AggMetric) SetXFilesFactor(xff float64, rawInterval int) {
+	// aggregators are updated under our lock, like when we add points to them
+	a.Lock()
+	defer a.Unlock()
+	for _, agg := range a.aggregators {
+		agg.setXFilesFactor(xff, rawInterval)
+	}
+}
+
+func (a *AggMetric) setRetention(ret conf.Retention) {
+	a.Lock()
+	defer a.Unlock()
+	a.ttl = uint32(ret.MaxRetention())
+	if ret.NumChunks > a.NumChunks {
+		a.growNumChunks(ret.NumChunks)
+	} else if ret.NumChunks < a.NumChunks {
+		a.shrinkNumChunks(ret.NumChunks)
+	}
+}
+
+// GrowNumChunks increases the size of the circular buffer of chunks of the metric (not of its rollups).
+// it is a no-op if the buffer is at least numChunks long already.
+func (a *AggMetric) GrowNumChunks(numChunks uint32) {
+	a.Lock()
+	defer a.Unlock()
+	if numChunks > a.NumChunks {
+		a.growNumChunks(numChunks)
+	}
+}
+
+// ShrinkNumChunks decreases the size of the circular buffer of chunks of the metric (not of its rollups).
+// the oldest chunks that no longer fit are persisted first, if we're primary and they have not been saved yet,
+// so that no data is lost. it is a no-op if the buffer is at most numChunks long already.
+func (a *AggMetric) ShrinkNumChunks(numChunks uint32) {
+	a.Lock()
+	defer a.Unlock()
+	if numChunks < a.NumChunks {
+		a.shrinkNumChunks(numChunks)
+	}
+}
+
+// caller must hold write lock
+func (a *AggMetric) growNumChunks(numChunks uint32) {
+	a.resize(numChunks)
+}
+
+// caller must hold write lock
+func (a *AggMetric) shrinkNumChunks(numChunks uint32) {
+	if numChunks == 0 {
+		numChunks = 1
+	}
+	drop := len(a.Chunks) - int(numChunks)
+	if drop > 0 && cluster.Manager.IsPrimary() {
+		// the chunks to drop are the oldest ones, which come right after the current one (or start at 0 if the
+		// buffer hasn't wrapped around yet). they are all finished, because the current chunk is always kept.
+		// persisting the newest of them also persists any older ones that were not saved yet.
+		newestDropped := (a.CurrentChunkPos + drop) % len(a.Chunks)
+		log.Debugf("AM: %s shrinking to %d chunks. persisting chunks up to T0 %d before dropping them", a.Key, numChunks, a.Chunks[newestDropped].Series.T0)
+		a.persist(newestDropped)
+	}
+	a.resize(numChunks)
+}
+
+// resize changes the size of the circular buffer of chunks.
+// the chunks are reordered from oldest to newest, and when shrinking, the oldest ones are dropped.
+// use shrinkNumChunks to make sure they are persisted first. the current chunk is always kept.
+// caller must hold write lock
+func (a *AggMetric) resize(numChunks uint32) {
+	if numChunks == 0 {
+		numChunks = 1
+	}
+	a.NumChunks = numChunks
+	if len(a.Chunks) == 0 {
+		return
+	}
+	chunks := make([]*chunk.Chunk, 0, numChunks)
+	// the oldest chunk is the one after the current one. if the buffer hasn't wrapped around yet, there is none
+	// and this is a no-op.
+	chunks = append(chunks, a.Chunks[a.CurrentChunkPos+1:]...)
+	chunks = append(chunks, a.Chunks[:a.CurrentChunkPos+1]...)
+	if drop := len(chunks) - int(numChunks); drop > 0 {
+		for _, c := range chunks[:drop] {
+			chunkClear.Inc()
+			a.usage.clearChunk(c)
+		}
+		chunks = append(chunks[:0], chunks[drop:]...)
+	}
+	a.Chunks = chunks
+	a.CurrentChunkPos = len(chunks) - 1
+	a.publish()
+}
+
+// unsavedChunks returns the finished chunks that have not been saved (or added to the write queue) yet,
+// neither by us, nor by any other node that notified us about it.
+func (a *AggMetric) unsavedChunks() []UnsavedChunk {
+	a.RLock()
+	defer a.RUnlock()
+	var out []UnsavedChunk
+	for _, c := range a.Chunks {
+		if c == nil || !c.Series.Finished || c.Series.T0 <= a.lastSaveStart {
+			continue
+		}
+		// finished chunks are not modified anymore, so we can hand out their data without copying it
+		out = append(out, UnsavedChunk{Key: a.Key.String(), T0: c.Series.T0, Span: a.spanOf(c), Data: c.Series.Bytes()})
+	}
+	return out
+}
+
+// oldestUnsaved returns the T0 of the oldest chunk that was not saved yet,
+// including the chunk that the points in the reorder buffer will go into.
+// 0 if there is none.
+func (a *AggMetric) oldestUnsaved() uint32 {
+	a.RLock()
+	defer a.RUnlock()
+	var oldest uint32
+	for _, c := range a.Chunks {
+		if c == nil || c.Series.T0 <= a.lastSaveFinish || a.rollupOnly {
+			continue
+		}
+		if oldest == 0 || c.Series.T0 < oldest {
+			oldest = c.Series.T0
+		}
+	}
+	if a.rob != nil {
+		for _, p := range a.rob.Get() {
+			t0 := p.Ts - (p.Ts % a.ChunkSpan)
+			if t0 > a.lastSaveFinish && (oldest == 0 || t0 < oldest) {
+				oldest = t0
+			}
+		}
+	}
+	return oldest
+}
+
+// reconcileChunk saves the chunk with the given T0, span and data, published by a demoted node,
+// unless it has been saved already, or we have data for that timeframe ourselves
+// (in which case persist() takes care of it). a span of 0 means the chunkspan.
+// It returns whether the chunk was added to the write queue.
+func (a *AggMetric) reconcileChunk(t0, span uint32, data []byte) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+	if t0 <= a.lastSaveStart {
+		return false, nil
+	}
+	for _, c := range a.Chunks {
+		if c != nil && c.Series.T0 <= t0 {
+			return false, nil
+		}
+	}
+
+	iter, err := tsz.NewIteratorLong(t0, data)
+	if err != nil {
+		return false, err
+	}
+	c := chunk.New(t0)
+	for iter.Next() {
+		ts, val := iter.Values()
+		if err := c.Push(ts, val); err != nil {
+			return false, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return false, err
+	}
+	c.Finish()
+
+	if span == 0 {
+		span = a.ChunkSpan
+	}
+	cwr := NewChunkWriteRequest(a, a.Key, c, a.ttl, span, time.Now())
+	a.lastSaveStart = t0
+	a.store.Add(&cwr)
+	return true, nil
+}
+
 func (a *AggMetric) getChunk(pos int) *chunk.Chunk {
 	if pos < 0 || pos >= len(a.Chunks) {
 		panic(fmt.Sprintf("aggmetric %s queried for chunk %d out of %d chunks", a.Key, pos, len(a.Chunks)))
@@ -140,22 +475,102 @@ func (a *AggMetric) getChunk(pos int) *chunk.Chunk {
 	return a.Chunks[pos]
 }
 
+// GetAggregated returns the data of the rollup for the given consolidator and span, from (inclusive) to (exclusive).
+// with open-rollups, it includes a point for the window that is still being aggregated.
 func (a *AggMetric) GetAggregated(consolidator consolidation.Consolidator, aggSpan, from, to uint32) (Result, error) {
+	if !openRollups {
+		return a.getAggregated(consolidator, aggSpan, from, to)
+	}
+	// the aggregators flush under the write lock, so this makes sure the open window
+	// is not also returned as a flushed point, or missed altogether
+	a.RLock()
+	defer a.RUnlock()
+	res, err := a.getAggregated(consolidator, aggSpan, from, to)
+	if err != nil {
+		return res, err
+	}
+	if p, ok := a.openRollup(consolidator, aggSpan); ok && p.Ts >= from && p.Ts < to {
+		res.Points = append(res.Points, p)
+	}
+	return res, nil
+}
+
+// openRollup returns the point of the rollup for the window that the aggregator with the given span is still aggregating,
+// computed from the points seen so far, and whether there is such a window.
+// caller must hold the lock
+func (a *AggMetric) openRollup(consolidator consolidation.Consolidator, aggSpan uint32) (schema.Point, bool) {
+	for _, agg := range a.aggregators {
+		if agg.span != aggSpan {
+			continue
+		}
+		cur := agg.agg
+		if cur.Cnt == 0 {
+			return schema.Point{}, false
+		}
+		p := schema.Point{Ts: agg.currentBoundary}
+		switch consolidator {
+		case consolidation.Avg:
+			p.Val = cur.Sum / cur.Cnt
+		case consolidation.Range:
+			p.Val = cur.Max - cur.Min
+		case consolidation.Cnt:
+			p.Val = cur.Cnt
+		case consolidation.Lst:
+			p.Val = cur.Lst
+		case consolidation.Min:
+			p.Val = cur.Min
+		case consolidation.Max:
+			p.Val = cur.Max
+		case consolidation.Sum:
+			p.Val = cur.Sum
+		default:
+			return schema.Point{}, false
+		}
+		return p, true
+	}
+	return schema.Point{}, false
+}
+
+// getAggregated returns the data of the rollup for the given consolidator and span. see GetAggregated
+func (a *AggMetric) getAggregated(consolidator consolidation.Consolidator, aggSpan, from, to uint32) (Result, error) {
 	// no lock needed cause aggregators don't change at runtime
 	for _, a := range a.aggregators {
 		if a.span == aggSpan {
 			var agg *AggMetric
 			switch consolidator {
 			case consolidation.None:
-				err := errors.New("internal error: AggMetric.GetAggregated(): cannot get an archive for no consolidation")
+				err := errors.NewInternal("internal error: AggMetric.GetAggregated(): cannot get an archive for no consolidation")
 				log.Errorf("AM: %s", err.Error())
 				badConsolidator.Inc()
 				return Result{}, err
 			case consolidation.Avg:
-				err := errors.New("internal error: AggMetric.GetAggregated(): avg consolidator has no matching Archive(). you need sum and cnt")
-				log.Errorf("AM: %s", err.Error())
-				badConsolidator.Inc()
-				return Result{}, err
+				// there is no avg archive: we combine the sum and cnt archives
+				if a.sumMetric == nil || a.cntMetric == nil {
+					return Result{}, errors.NewBadRequest(fmt.Sprintf("Consolidator %q not configured", consolidator))
+				}
+				sum, err := a.sumMetric.Get(from, to)
+				if err != nil {
+					return Result{}, err
+				}
+				cnt, err := a.cntMetric.Get(from, to)
+				if err != nil {
+					return Result{}, err
+				}
+				return combineResults(sum, cnt, func(sum, cnt float64) float64 { return sum / cnt }), nil
+			case consolidation.Range:
+				// likewise, the range is the max minus the min
+				if a.maxMetric == nil || a.minMetric == nil {
+					return Result{}, errors.NewBadRequest(fmt.Sprintf("Consolidator %q not configured", consolidator))
+				}
+				max, err := a.maxMetric.Get(from, to)
+				if err != nil {
+					return Result{}, err
+				}
+				min, err := a.minMetric.Get(from, to)
+				if err != nil {
+					return Result{}, err
+				}
+				return combineResults(max, min, func(max, min float64) float64 { return max - min }), nil
 			case consolidation.Cnt:
 				agg = a.cntMetric
 			case consolidation.Lst:
@@ -167,18 +582,19 @@ func (a *AggMetric) GetAggregated(consolidator consolidation.Consolidator, aggSp
 			case consolidation.Sum:
 				agg = a.sumMetric
 			default:
-				err := fmt.Errorf("internal error: AggMetric.GetAggregated(): unknown consolidator %q", consolidator)
+				// note: we can't use the consolidator's String(), it panics for unknown consolidators
+				err := errors.NewBadRequest(fmt.Sprintf("AggMetric.GetAggregated(): unknown consolidator %d", consolidator))
 				log.Errorf("AM: %s", err.Error())
 				badConsolidator.Inc()
 				return Result{}, err
 			}
 			if agg == nil {
-				return Result{}, fmt.Errorf("Consolidator %q not configured", consolidator)
+				return Result{}, errors.NewBadRequest(fmt.Sprintf("Consolidator %q not configured", consolidator))
 			}
 			return agg.Get(from, to)
 		}
 	}
-	err := fmt.Errorf("internal error: AggMetric.GetAggregated(): unknown aggSpan %d", aggSpan)
+	err := errors.NewBadRequest(fmt.Sprintf("AggMetric.GetAggregated(): unknown aggSpan %d", aggSpan))
 	log.Errorf("AM: %s", err.Error())
 	badAggSpan.Inc()
 	return Result{}, err
@@ -196,14 +612,16 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 	if from >= to {
 		return Result{}, ErrInvalidRange
 	}
-	a.RLock()
-	defer a.RUnlock()
+	atomic.StoreUint32(&a.lastRead, uint32(pre.Unix()))
 
 	result := Result{
 		Oldest: math.MaxInt32,
 	}
 
 	if a.rob != nil {
+		// points move from the reorder buffer into the chunks, so we need a consistent view of both
+		a.RLock()
+		defer a.RUnlock()
 		result.Points = a.rob.Get()
 		if len(result.Points) > 0 {
 			result.Oldest = result.Points[0].Ts
@@ -213,15 +631,16 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 		}
 	}
 
-	if len(a.Chunks) == 0 {
+	v := a.view.Load().(*chunkView)
+	chunks := v.chunks
+
+	if len(chunks) == 0 {
 		// we dont have any data yet.
 		log.Debugf("AM: %s Get(): no data for requested range.", a.Key)
 		return result, nil
 	}
 
-	newestChunk := a.getChunk(a.CurrentChunkPos)
-
-	if from >= newestChunk.Series.T0+a.ChunkSpan {
+	if from >= v.ends[len(chunks)-1] {
 		// request falls entirely ahead of the data we have
 		// this can happen in a few cases:
 		// * queries for the most recent data, but our ingestion has fallen behind.
@@ -238,33 +657,13 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 		return result, nil
 	}
 
-	// get the oldest chunk we have.
-	// eg if we have 5 chunks, N is the current chunk and n-4 is the oldest chunk.
-	// -----------------------------
-	// | n-4 | n-3 | n-2 | n-1 | n |  CurrentChunkPos = 4
-	// -----------------------------
-	// -----------------------------
-	// | n | n-4 | n-3 | n-2 | n-1 |  CurrentChunkPos = 0
-	// -----------------------------
-	// -----------------------------
-	// | n-2 | n-1 | n | n-4 | n-3 |  CurrentChunkPos = 2
-	// -----------------------------
-	oldestPos := a.CurrentChunkPos + 1
-	if oldestPos >= len(a.Chunks) {
-		oldestPos = 0
-	}
-
-	oldestChunk := a.getChunk(oldestPos)
-	if oldestChunk == nil {
-		log.Error(ErrNilChunk.Error())
-		return result, ErrNilChunk
-	}
+	oldestChunk := chunks[0]
 
 	if to <= oldestChunk.Series.T0 {
 		// the requested time range ends before any data we have.
 		log.Debugf("AM: %s Get(): no data for requested range", a.Key)
 		if oldestChunk.First {
-			result.Oldest = a.firstTs
+			result.Oldest = v.firstTs
 		} else {
 			result.Oldest = oldestChunk.Series.T0
 		}
@@ -273,17 +672,10 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 
 	// Find the oldest Chunk that the "from" ts falls in.  If from extends before the oldest
 	// chunk, then we just use the oldest chunk.
-	for from >= oldestChunk.Series.T0+a.ChunkSpan {
+	// this stops at the newest chunk at the latest, because we checked that from falls before its end.
+	oldestPos := 0
+	for from >= v.ends[oldestPos] {
 		oldestPos++
-		if oldestPos >= len(a.Chunks) {
-			oldestPos = 0
-		}
-		oldestChunk = a.getChunk(oldestPos)
-		if oldestChunk == nil {
-			result.Oldest = to
-			log.Error(ErrNilChunk.Error())
-			return result, ErrNilChunk
-		}
 	}
 
 	// find the newest Chunk that "to" falls in.  If "to" extends to after the newest data
@@ -292,37 +684,20 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 	// for a to of 121 -> data up to (incl) 120 -> stay at this chunk, it has a point we need
 	// for a to of 120 -> data up to (incl) 119 -> use older chunk
 	// for a to of 119 -> data up to (incl) 118 -> use older chunk
-	newestPos := a.CurrentChunkPos
-	for to <= newestChunk.Series.T0 {
+	// this stops at the oldest chunk at the latest, because we checked that to falls after its start.
+	newestPos := len(chunks) - 1
+	for to <= chunks[newestPos].Series.T0 {
 		newestPos--
-		if newestPos < 0 {
-			newestPos += len(a.Chunks)
-		}
-		newestChunk = a.getChunk(newestPos)
-		if newestChunk == nil {
-			result.Oldest = to
-			log.Error(ErrNilChunk.Error())
-			return result, ErrNilChunk
-		}
 	}
 
-	// now just start at oldestPos and move through the Chunks circular Buffer to newestPos
-	for {
-		c := a.getChunk(oldestPos)
+	for _, c := range chunks[oldestPos : newestPos+1] {
 		result.Iters = append(result.Iters, c.Series.Iter())
-
-		if oldestPos == newestPos {
-			break
-		}
-
-		oldestPos++
-		if oldestPos >= len(a.Chunks) {
-			oldestPos = 0
-		}
 	}
 
+	oldestChunk = chunks[oldestPos]
 	if oldestChunk.First {
-		result.Oldest = a.firstTs
+		result.Oldest = v.firstTs
+		result.Partial = v.firstTs > oldestChunk.Series.T0
 	} else {
 		result.Oldest = oldestChunk.Series.T0
 	}
@@ -334,6 +709,10 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 // caller must hold lock
 func (a *AggMetric) addAggregators(ts uint32, val float64) {
 	for _, agg := range a.aggregators {
+		if agg.chained {
+			// it gets the aggregations of the aggregator before it
+			continue
+		}
 		log.Debugf("AM: %s pushing %d,%f to aggregator %d", a.Key, ts, val, agg.span)
 		agg.Add(ts, val)
 	}
@@ -348,7 +727,7 @@ func (a *AggMetric) pushToCache(c *chunk.Chunk) {
 	// push into cache
 	intervalHint := a.Key.Archive.Span()
 
-	itergen, err := chunk.NewIterGen(c.Series.T0, intervalHint, c.Encode(a.ChunkSpan))
+	itergen, err := chunk.NewIterGen(c.Series.T0, intervalHint, c.Encode(a.spanOf(c)))
 	if err != nil {
 		log.Errorf("AM: %s failed to generate IterGen. this should never happen: %s", a.Key, err)
 	}
@@ -373,10 +752,17 @@ func (a *AggMetric) persist(pos int) {
 		return
 	}
 
+	if a.rollupOnly {
+		// there is nothing to save: the data lives on in the rollups
+		a.lastSaveStart = chunk.Series.T0
+		a.lastSaveFinish = chunk.Series.T0
+		return
+	}
+
 	// create an array of chunks that need to be sent to the writeQueue.
 	pending := make([]*ChunkWriteRequest, 1)
 	// add the current chunk to the list of chunks to send to the writeQueue
-	cwr := NewChunkWriteRequest(a, a.Key, chunk, a.ttl, a.ChunkSpan, time.Now())
+	cwr := NewChunkWriteRequest(a, a.Key, chunk, a.ttl, a.spanOf(chunk), time.Now())
 	pending[0] = &cwr
 
 	// if we recently became the primary, there may be older chunks
@@ -389,7 +775,7 @@ func (a *AggMetric) persist(pos int) {
 	previousChunk := a.Chunks[previousPos]
 	for (previousChunk.Series.T0 < chunk.Series.T0) && (a.lastSaveStart < previousChunk.Series.T0) {
 		log.Debugf("AM: persist(): old chunk needs saving. Adding %s:%d to writeQueue", a.Key, previousChunk.Series.T0)
-		cwr := NewChunkWriteRequest(a, a.Key, previousChunk, a.ttl, a.ChunkSpan, time.Now())
+		cwr := NewChunkWriteRequest(a, a.Key, previousChunk, a.ttl, a.spanOf(previousChunk), time.Now())
 		pending = append(pending, &cwr)
 		previousPos--
 		if previousPos < 0 {
@@ -421,32 +807,74 @@ func (a *AggMetric) persist(pos int) {
 	return
 }
 
+// Add adds the point, and returns what became of it.
+// points that are accepted into the reorder buffer may still be dropped when they are flushed from it,
+// which is only reflected in the stats (see GetDropped).
 // don't ever call with a ts of 0, cause we use 0 to mean not initialized!
-func (a *AggMetric) Add(ts uint32, val float64) {
+func (a *AggMetric) Add(ts uint32, val float64) AddResult {
+	a.Lock()
+	defer a.Unlock()
+	return a.addThroughRob(ts, val)
+}
+
+// AddMany adds the given points, in order, while only acquiring the lock once.
+// it returns what became of each point, like Add.
+func (a *AggMetric) AddMany(points []schema.Point) []AddResult {
 	a.Lock()
 	defer a.Unlock()
+	results := make([]AddResult, len(points))
+	for i, p := range points {
+		results[i] = a.addThroughRob(p.Ts, p.Val)
+	}
+	return results
+}
 
+// addThroughRob adds the point, via the reorder buffer if enabled
+// caller must hold write lock
+func (a *AggMetric) addThroughRob(ts uint32, val float64) AddResult {
 	if a.rob == nil {
 		// write directly
-		a.add(ts, val)
-	} else {
-		// write through reorder buffer
-		res, accepted := a.rob.Add(ts, val)
+		return a.addCounted(ts, val)
+	}
+	// write through reorder buffer
+	res, result := a.rob.add(ts, val)
 
-		if len(res) == 0 && accepted {
-			a.lastWrite = uint32(time.Now().Unix())
-		}
+	if len(res) == 0 && result != AddTooOld {
+		a.lastWrite = uint32(time.Now().Unix())
+	}
+	if result != AddAccepted {
+		// points of which we keep a value are counted when they are flushed
+		return a.count(result)
+	}
 
-		for _, p := range res {
-			a.add(p.Ts, p.Val)
-		}
+	for _, p := range res {
+		a.addCounted(p.Ts, p.Val)
+	}
+	return AddAccepted
+}
+
+// count counts the result of adding a point in the stats of the org, if we are a raw series
+func (a *AggMetric) count(result AddResult) AddResult {
+	if a.Key.Archive == 0 {
+		a.usage.added(result)
 	}
+	return result
+}
+
+// addCounted adds the point to the chunks, and counts the result. see add
+// caller must hold write lock
+func (a *AggMetric) addCounted(ts uint32, val float64) AddResult {
+	return a.count(a.add(ts, val))
 }
 
+// add adds the point to the chunks, and returns what became of it.
 // don't ever call with a ts of 0, cause we use 0 to mean not initialized!
 // caller must hold write lock
-func (a *AggMetric) add(ts uint32, val float64) {
+func (a *AggMetric) add(ts uint32, val float64) AddResult {
 	t0 := ts - (ts % a.ChunkSpan)
+	if a.float32 {
+		val = float64(float32(val))
+	}
 
 	if len(a.Chunks) == 0 {
 		chunkCreate.Inc()
@@ -454,88 +882,198 @@ func (a *AggMetric) add(ts uint32, val float64) {
 		// note that we may not be aware of prior data that belongs into this chunk
 		// so we should track this cutoff point
 		a.Chunks = append(a.Chunks, chunk.NewFirst(t0))
+		a.usage.addChunk(a.Chunks[0])
 		a.firstTs = ts
 
 		if err := a.Chunks[0].Push(ts, val); err != nil {
 			panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos 0 failed: %q", ts, val, err))
 		}
-		totalPoints.Inc()
+		a.publish()
+		a.usage.addPoints(1)
 
 		log.Debugf("AM: %s Add(): created first chunk with first point: %v", a.Key, a.Chunks[0])
 		a.lastWrite = uint32(time.Now().Unix())
-		if a.dropFirstChunk {
+		// when replaying data after a restart, chunks that start before the replay only get part of their data,
+		// and the complete chunks have been saved already.
+		if a.dropFirstChunk || t0 < replayStart {
 			a.lastSaveStart = t0
 			a.lastSaveFinish = t0
 		}
 		a.addAggregators(ts, val)
-		return
+		return AddAccepted
 	}
 
 	currentChunk := a.getChunk(a.CurrentChunkPos)
 
-	if t0 == currentChunk.Series.T0 {
+	if ts >= currentChunk.Series.T0 && ts < a.chunkEnd(currentChunk) {
 		// last prior data was in same chunk as new point
 		if currentChunk.Series.Finished {
+			if reopenChunks {
+				return a.reopen(a.CurrentChunkPos, ts, val)
+			}
 			// if we've already 'finished' the chunk, it means it has the end-of-stream marker and any new points behind it wouldn't be read by an iterator
 			// you should monitor this metric closely, it indicates that maybe your GC settings don't match how you actually send data (too late)
 			addToClosedChunk.Inc()
-			return
+			return AddChunkSaved
+		}
+
+		if maxPointsPerChunk > 0 && uint(currentChunk.NumPoints) >= maxPointsPerChunk && ts > currentChunk.Series.T {
+			// roll over: the chunk ends here, and the point starts a new chunk within the same chunkspan
+			log.Debugf("AM: %s chunk %d reached max-points-per-chunk (%d). rolling over to a new chunk at %d", a.Key, currentChunk.Series.T0, maxPointsPerChunk, ts)
+			chunkRollover.Inc()
+			currentChunk.End = ts
+			a.addToNewChunk(ts, ts, val)
+			a.addAggregators(ts, val)
+			return AddAccepted
 		}
 
 		if err := currentChunk.Push(ts, val); err != nil {
+			if reopenChunks {
+				return a.reopen(a.CurrentChunkPos, ts, val)
+			}
 			log.Debugf("AM: failed to add metric to chunk for %s. %s", a.Key, err)
 			metricsTooOld.Inc()
-			return
+			if ts == currentChunk.Series.T {
+				return AddDuplicate
+			}
+			return AddTooOld
 		}
-		totalPoints.Inc()
+		a.usage.addPoints(1)
 		a.lastWrite = uint32(time.Now().Unix())
 		log.Debugf("AM: %s Add(): pushed new value to last chunk: %v", a.Key, a.Chunks[0])
-	} else if t0 < currentChunk.Series.T0 {
+	} else if ts < currentChunk.Series.T0 {
 		log.Debugf("AM: Point at %d has t0 %d, goes back into previous chunk. CurrentChunk t0: %d, LastTs: %d", ts, t0, currentChunk.Series.T0, currentChunk.Series.T)
+		if reopenChunks {
+			for pos, c := range a.Chunks {
+				if ts >= c.Series.T0 && ts < a.chunkEnd(c) {
+					return a.reopen(pos, ts, val)
+				}
+			}
+		}
 		metricsTooOld.Inc()
-		return
+		return AddTooOld
 	} else {
 		// Data belongs in a new chunk.
+		a.addToNewChunk(t0, ts, val)
+	}
+	a.addAggregators(ts, val)
+	return AddAccepted
+}
 
-		// If it isn't finished already, add the end-of-stream marker and flag the chunk as "closed"
-		currentChunk.Finish()
+// addToNewChunk closes the current chunk, persists it if we are primary,
+// and adds the point to a new current chunk starting at t0.
+// caller must hold write lock
+func (a *AggMetric) addToNewChunk(t0, ts uint32, val float64) {
+	currentChunk := a.getChunk(a.CurrentChunkPos)
 
-		a.pushToCache(currentChunk)
-		// If we are a primary node, then add the chunk to the write queue to be saved to Cassandra
-		if cluster.Manager.IsPrimary() {
-			log.Debugf("AM: persist(): node is primary, saving chunk. %s T0: %d", a.Key, currentChunk.Series.T0)
-			// persist the chunk. If the writeQueue is full, then this will block.
-			a.persist(a.CurrentChunkPos)
-		}
+	// If it isn't finished already, add the end-of-stream marker and flag the chunk as "closed"
+	a.usage.closeChunk(currentChunk)
 
-		a.CurrentChunkPos++
-		if a.CurrentChunkPos >= int(a.NumChunks) {
-			a.CurrentChunkPos = 0
+	a.pushToCache(currentChunk)
+	// If we are a primary node, then add the chunk to the write queue to be saved to Cassandra
+	if cluster.Manager.IsPrimary() {
+		log.Debugf("AM: persist(): node is primary, saving chunk. %s T0: %d", a.Key, currentChunk.Series.T0)
+		// persist the chunk. If the writeQueue is full, then this will block.
+		a.persist(a.CurrentChunkPos)
+	}
+
+	a.CurrentChunkPos++
+	if a.CurrentChunkPos >= int(a.NumChunks) {
+		a.CurrentChunkPos = 0
+	}
+
+	chunkCreate.Inc()
+	if len(a.Chunks) < int(a.NumChunks) {
+		a.Chunks = append(a.Chunks, chunk.New(t0))
+		a.usage.addChunk(a.Chunks[a.CurrentChunkPos])
+		if err := a.Chunks[a.CurrentChunkPos].Push(ts, val); err != nil {
+			panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos %d failed: %q", ts, val, a.CurrentChunkPos, err))
 		}
+		a.usage.addPoints(1)
+		log.Debugf("AM: %s Add(): added new chunk to buffer. now %d chunks. and added the new point: %s", a.Key, a.CurrentChunkPos+1, a.Chunks[a.CurrentChunkPos])
+	} else {
+		chunkClear.Inc()
+		a.usage.clearChunk(a.Chunks[a.CurrentChunkPos])
 
-		chunkCreate.Inc()
-		if len(a.Chunks) < int(a.NumChunks) {
-			a.Chunks = append(a.Chunks, chunk.New(t0))
-			if err := a.Chunks[a.CurrentChunkPos].Push(ts, val); err != nil {
-				panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos %d failed: %q", ts, val, a.CurrentChunkPos, err))
-			}
-			totalPoints.Inc()
-			log.Debugf("AM: %s Add(): added new chunk to buffer. now %d chunks. and added the new point: %s", a.Key, a.CurrentChunkPos+1, a.Chunks[a.CurrentChunkPos])
-		} else {
-			chunkClear.Inc()
-			totalPoints.DecUint64(uint64(a.Chunks[a.CurrentChunkPos].NumPoints))
+		a.Chunks[a.CurrentChunkPos] = chunk.New(t0)
+		a.usage.addChunk(a.Chunks[a.CurrentChunkPos])
+		if err := a.Chunks[a.CurrentChunkPos].Push(ts, val); err != nil {
+			panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos %d failed: %q", ts, val, a.CurrentChunkPos, err))
+		}
+		a.usage.addPoints(1)
+		log.Debugf("AM: %s Add(): cleared chunk at %d of %d and replaced with new. and added the new point: %s", a.Key, a.CurrentChunkPos, len(a.Chunks), a.Chunks[a.CurrentChunkPos])
+	}
+	a.publish()
+	a.lastWrite = uint32(time.Now().Unix())
+}
 
-			a.Chunks[a.CurrentChunkPos] = chunk.New(t0)
-			if err := a.Chunks[a.CurrentChunkPos].Push(ts, val); err != nil {
-				panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos %d failed: %q", ts, val, a.CurrentChunkPos, err))
+// reopen adds a point that arrived late to the chunk at pos, by rewriting the chunk with the point inserted.
+// the chunk is replaced rather than modified, so chunks that are being saved are not affected.
+// if the chunk was saved (or added to the write queue) already, and we are primary, the new chunk is saved as well.
+// note that late points are not added to the aggregators: they only support points in order.
+// it returns what became of the point.
+// caller must hold write lock
+func (a *AggMetric) reopen(pos int, ts uint32, val float64) AddResult {
+	old := a.Chunks[pos]
+	c := chunk.New(old.Series.T0)
+	c.First = old.First
+	c.End = old.End
+	added := false
+	iter := old.Series.Iter()
+	for iter.Next() {
+		t, v := iter.Values()
+		if !added && ts <= t {
+			if ts == t {
+				log.Debugf("AM: %s already has a point at %d, dropping late point", a.Key, ts)
+				metricsTooOld.Inc()
+				return AddDuplicate
 			}
-			totalPoints.Inc()
-			log.Debugf("AM: %s Add(): cleared chunk at %d of %d and replaced with new. and added the new point: %s", a.Key, a.CurrentChunkPos, len(a.Chunks), a.Chunks[a.CurrentChunkPos])
+			c.Push(ts, val)
+			added = true
 		}
-		a.lastWrite = uint32(time.Now().Unix())
+		c.Push(t, v)
+	}
+	if err := iter.Err(); err != nil {
+		log.Errorf("AM: %s failed to read chunk %d to add late point at %d: %s", a.Key, old.Series.T0, ts, err)
+		metricsTooOld.Inc()
+		return AddTooOld
+	}
+	if !added {
+		c.Push(ts, val)
+	}
 
+	a.usage.clearChunk(old)
+	a.Chunks[pos] = c
+	a.usage.addChunk(c)
+	a.publish()
+	chunkReopen.Inc()
+	a.lastWrite = uint32(time.Now().Unix())
+	log.Debugf("AM: %s reopened chunk %d to add late point at %d", a.Key, c.Series.T0, ts)
+
+	if !old.Series.Finished {
+		return AddAccepted
 	}
-	a.addAggregators(ts, val)
+	a.usage.closeChunk(c)
+	a.replaceInCache(c)
+	if c.Series.T0 <= a.lastSaveStart && cluster.Manager.IsPrimary() {
+		cwr := NewChunkWriteRequest(a, a.Key, c, a.ttl, a.spanOf(c), time.Now())
+		a.store.Add(&cwr)
+	}
+	return AddAccepted
+}
+
+// replaceInCache replaces the cached version of the chunk, if any
+// caller must hold lock
+func (a *AggMetric) replaceInCache(c *chunk.Chunk) {
+	if a.cachePusher == nil {
+		return
+	}
+	itergen, err := chunk.NewIterGen(c.Series.T0, a.Key.Archive.Span(), c.Encode(a.spanOf(c)))
+	if err != nil {
+		log.Errorf("AM: %s failed to generate IterGen. this should never happen: %s", a.Key, err)
+		return
+	}
+	go a.cachePusher.ReplaceIfCached(a.Key, itergen)
 }
 
 // collectable returns whether the AggMetric is garbage collectable
@@ -559,19 +1097,32 @@ func (a *AggMetric) collectable(now, chunkMinTs uint32) bool {
 	}
 
 	currentChunk := a.getChunk(a.CurrentChunkPos)
-	return a.lastWrite < chunkMinTs && currentChunk.Series.T0+a.ChunkSpan+15*60 < now
+	return a.lastWrite < chunkMinTs && a.chunkEnd(currentChunk)+15*60 < now
 }
 
-// GC returns whether or not this AggMetric is stale and can be removed
+// gcStats describes the chunks a GC of a metric closed
+type gcStats struct {
+	points    uint32 // number of points in the closed chunks
+	persisted uint32 // number of closed chunks that were persisted (only as primary)
+}
+
+func (s *gcStats) add(o gcStats) {
+	s.points += o.points
+	s.persisted += o.persisted
+}
+
+// GC returns whether or not this AggMetric is stale and can be removed, and which chunks it closed
 // chunkMinTs -> min timestamp of a chunk before to be considered stale and to be persisted to Cassandra
 // metricMinTs -> min timestamp for a metric before to be considered stale and to be purged from the tank
-func (a *AggMetric) GC(now, chunkMinTs, metricMinTs uint32) bool {
+func (a *AggMetric) GC(now, chunkMinTs, metricMinTs uint32) (bool, gcStats) {
 	a.Lock()
 	defer a.Unlock()
 
+	var stats gcStats
+
 	// unless it looks like the AggMetric is collectable, abort and mark as not stale
 	if !a.collectable(now, chunkMinTs) {
-		return false
+		return false, stats
 	}
 
 	// make sure any points in the reorderBuffer are moved into our chunks so we can save the data
@@ -579,7 +1130,7 @@ func (a *AggMetric) GC(now, chunkMinTs, metricMinTs uint32) bool {
 		tmpLastWrite := a.lastWrite
 		pts := a.rob.Flush()
 		for _, p := range pts {
-			a.add(p.Ts, p.Val)
+			a.addCounted(p.Ts, p.Val)
 		}
 
 		// adding points will cause our lastWrite to be updated, but we want to keep the old value
@@ -588,12 +1139,12 @@ func (a *AggMetric) GC(now, chunkMinTs, metricMinTs uint32) bool {
 
 	// this aggMetric has never had metrics written to it.
 	if len(a.Chunks) == 0 {
-		return a.gcAggregators(now, chunkMinTs, metricMinTs)
+		return a.gcAggregators(now, chunkMinTs, metricMinTs, &stats), stats
 	}
 
 	currentChunk := a.getChunk(a.CurrentChunkPos)
 	if currentChunk == nil {
-		return false
+		return false, stats
 	}
 
 	// we must check collectable again. Imagine this scenario:
@@ -601,29 +1152,77 @@ func (a *AggMetric) GC(now, chunkMinTs, metricMinTs uint32) bool {
 	// * data from the ROB is flushed and moved into a new chunk
 	// * this new chunk is active so we're not collectable, even though earlier we thought we were.
 	if !a.collectable(now, chunkMinTs) {
-		return false
+		return false, stats
 	}
 
 	if !currentChunk.Series.Finished {
 		// chunk hasn't been written to in a while, and is not yet closed.
 		// Let's close it and persist it if we are a primary
 		log.Debugf("AM: Found stale Chunk, adding end-of-stream bytes. key: %v T0: %d", a.Key, currentChunk.Series.T0)
-		currentChunk.Finish()
+		a.usage.closeChunk(currentChunk)
 		a.pushToCache(currentChunk)
+		stats.points += currentChunk.NumPoints
 		if cluster.Manager.IsPrimary() {
 			log.Debugf("AM: persist(): node is primary, saving chunk. %v T0: %d", a.Key, currentChunk.Series.T0)
 			// persist the chunk. If the writeQueue is full, then this will block.
 			a.persist(a.CurrentChunkPos)
+			stats.persisted++
 		}
 	}
-	return a.gcAggregators(now, chunkMinTs, metricMinTs) && a.lastWrite < metricMinTs
+	return a.gcAggregators(now, chunkMinTs, metricMinTs, &stats) && a.lastWrite < metricMinTs, stats
+}
+
+// dropIdleChunks removes the oldest chunks from memory if the metric has not been read since minTs,
+// keeping the newest keep chunks (at least the current one). only chunks that have been saved are removed,
+// so queries for their data are served by the store, or by the rollups, which are not affected.
+// it returns the number of removed chunks.
+func (a *AggMetric) dropIdleChunks(minTs uint32, keep int) int {
+	if atomic.LoadUint32(&a.lastRead) >= minTs {
+		return 0
+	}
+	a.Lock()
+	defer a.Unlock()
+	if keep < 1 {
+		keep = 1
+	}
+	if len(a.Chunks) <= keep {
+		return 0
+	}
+	chunks := make([]*chunk.Chunk, 0, len(a.Chunks))
+	chunks = append(chunks, a.Chunks[a.CurrentChunkPos+1:]...)
+	chunks = append(chunks, a.Chunks[:a.CurrentChunkPos+1]...)
+	drop := 0
+	for drop < len(chunks)-keep && chunks[drop].Series.Finished && (a.rollupOnly || chunks[drop].Series.T0 <= a.lastSaveFinish) {
+		a.usage.clearChunk(chunks[drop])
+		drop++
+	}
+	if drop == 0 {
+		return 0
+	}
+	log.Debugf("AM: %s has not been read since %d. removed %d saved chunks from memory", a.Key, minTs, drop)
+	// like resize, the ring buffer grows back to NumChunks as new chunks are added
+	a.Chunks = append(chunks[:0], chunks[drop:]...)
+	a.CurrentChunkPos = len(a.Chunks) - 1
+	a.publish()
+	return drop
+}
+
+// evict closes the current chunks of the metric and its rollups, flushes the aggregators,
+// and, if we're primary, saves the chunks that were not saved yet, so that the metric can be removed from memory.
+// it is like GC, except that it doesn't wait for the metric to become stale:
+// as of the maximum timestamp, everything is stale.
+func (a *AggMetric) evict() {
+	a.GC(math.MaxUint32, math.MaxUint32, math.MaxUint32)
 }
 
 // gcAggregators returns whether all aggregators are stale and can be removed
-func (a *AggMetric) gcAggregators(now, chunkMinTs, metricMinTs uint32) bool {
+// the chunks closed by the aggregators are added to stats.
+func (a *AggMetric) gcAggregators(now, chunkMinTs, metricMinTs uint32, stats *gcStats) bool {
 	ret := true
 	for _, agg := range a.aggregators {
-		ret = agg.GC(now, chunkMinTs, metricMinTs, a.lastWrite) && ret
+		stale, aggStats := agg.GC(now, chunkMinTs, metricMinTs, a.lastWrite)
+		stats.add(aggStats)
+		ret = stale && ret
 	}
 	return ret
 }
@@ -1,7 +1,11 @@
 package mdata
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"net/http"
+	"reflect"
 	"regexp"
 	"sort"
 	"testing"
@@ -9,8 +13,10 @@ import (
 
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
 )
 
 var mockstore = NewMockStore()
@@ -275,6 +281,33 @@ func TestAggMetricWithReorderBuffer(t *testing.T) {
 	}
 }
 
+func TestAggMetricAddMany(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+
+	agg := conf.Aggregation{
+		Name:              "Default",
+		Pattern:           regexp.MustCompile(".*"),
+		XFilesFactor:      0.5,
+		AggregationMethod: []conf.Method{conf.Avg},
+	}
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 120, 5, 0)}
+	c := NewChecker(t, NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 10, &agg, false))
+
+	// a batch with some points out of order, which the reorder buffer should take care of
+	points := []schema.Point{
+		{Val: 121, Ts: 121},
+		{Val: 125, Ts: 125},
+		{Val: 123, Ts: 123},
+		{Val: 129, Ts: 129},
+		{Val: 240, Ts: 240},
+	}
+	c.agg.AddMany(points)
+	for _, p := range points {
+		c.points = append(c.points, point{p.Ts, p.Val})
+	}
+	c.Verify(true, 120, 480, 121, 240)
+}
+
 func TestAggMetricDropFirstChunk(t *testing.T) {
 	cluster.Init("default", "test", time.Now(), "http", 6060)
 	cluster.Manager.SetPrimary(true)
@@ -302,6 +335,479 @@ func TestAggMetricDropFirstChunk(t *testing.T) {
 	}
 }
 
+func TestAggMetricShrinkNumChunks(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	defer cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	ret := []conf.Retention{conf.NewRetentionMT(1, 3600, 10, 5, 0)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+	t0s := func() []uint32 {
+		var out []uint32
+		for i := 1; i <= len(m.Chunks); i++ {
+			out = append(out, m.Chunks[(m.CurrentChunkPos+i)%len(m.Chunks)].Series.T0)
+		}
+		return out
+	}
+
+	// as secondary, we don't save any chunks
+	for ts := uint32(10); ts < 60; ts += 5 {
+		m.Add(ts, float64(ts))
+	}
+	if mockstore.Items() != 0 {
+		t.Fatalf("expected no chunks to be saved as secondary, got %d", mockstore.Items())
+	}
+
+	// after a promotion, the chunks that fall out of the buffer must be saved before they're dropped
+	cluster.Manager.SetPrimary(true)
+	m.ShrinkNumChunks(2)
+	if got := t0s(); m.NumChunks != 2 || len(got) != 2 || got[0] != 40 || got[1] != 50 {
+		t.Fatalf("expected chunks 40 and 50 to remain, got %v", got)
+	}
+	itgens, err := mockstore.Search(test.NewContext(), test.GetAMKey(42), 0, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itgens) != 3 || itgens[0].T0 != 10 || itgens[2].T0 != 30 {
+		t.Fatalf("expected chunks 10 through 30 to be saved, got %v", itgens)
+	}
+
+	// the current chunk is always kept, and saved chunks are not saved again
+	m.ShrinkNumChunks(0)
+	if got := t0s(); len(got) != 1 || got[0] != 50 {
+		t.Fatalf("expected only chunk 50 to remain, got %v", got)
+	}
+	if mockstore.Items() != 4 {
+		t.Fatalf("expected chunks 10 through 40 to be saved, got %d chunks", mockstore.Items())
+	}
+
+	// shrinking to a larger size is a no-op, growing keeps the chunks
+	m.ShrinkNumChunks(3)
+	m.GrowNumChunks(3)
+	m.Add(60, 60)
+	if got := t0s(); m.NumChunks != 3 || len(got) != 2 || got[0] != 50 || got[1] != 60 {
+		t.Fatalf("expected 3 chunks with chunks 50 and 60, got %d with %v", m.NumChunks, got)
+	}
+}
+
+func TestAggMetricFloat32(t *testing.T) {
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 600, 2, 0)}
+	m64 := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, nil, false)
+	m32 := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(2), ret, 0, nil, false)
+	m32.setFloat32(true)
+	for ts := uint32(600); ts < 1200; ts++ {
+		val := 1000 + float64(ts%7)/3
+		m64.Add(ts, val)
+		m32.Add(ts, val)
+	}
+
+	res, err := m32.Get(600, 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := res.Iters[0]
+	for iter.Next() {
+		ts, val := iter.Values()
+		if exp := float64(float32(1000 + float64(ts%7)/3)); val != exp {
+			t.Fatalf("expected value %f at %d, got %f", exp, ts, val)
+		}
+	}
+	size64 := len(m64.Chunks[0].Series.Bytes())
+	size32 := len(m32.Chunks[0].Series.Bytes())
+	if size32 > size64*2/3 {
+		t.Fatalf("expected float32 chunk to be much smaller than %d bytes, got %d bytes", size64, size32)
+	}
+}
+
+func TestAggMetricDupPolicy(t *testing.T) {
+	ret := conf.Retentions{conf.NewRetentionMT(10, 3600, 600, 2, 0)}
+	cases := []struct {
+		policy conf.DupPolicy
+		exp    float64
+	}{
+		{conf.DupDefault, 1},
+		{conf.DupKeepFirst, 1},
+		{conf.DupKeepLast, 2},
+		{conf.DupKeepMax, 3},
+		{conf.DupSum, 6},
+	}
+	for i, c := range cases {
+		m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(i), ret, 0, nil, false)
+		m.setDupPolicy(c.policy, 10)
+		m.Add(10, 1)
+		m.Add(10, 3)
+		m.Add(10, 2)
+		m.Add(20, 5)
+		m.Add(30, 1)
+
+		res, err := m.Get(0, 100)
+		if err != nil {
+			t.Fatalf("%s: %s", c.policy, err)
+		}
+		var got []schema.Point
+		for _, iter := range res.Iters {
+			for iter.Next() {
+				ts, val := iter.Values()
+				got = append(got, schema.Point{Val: val, Ts: ts})
+			}
+		}
+		got = append(got, res.Points...)
+		exp := []schema.Point{{Val: c.exp, Ts: 10}, {Val: 5, Ts: 20}, {Val: 1, Ts: 30}}
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%s: expected %v, got %v", c.policy, exp, got)
+		}
+	}
+}
+
+// invalid queries must result in errors with the right status code, not in panics
+func TestAggMetricGetErrors(t *testing.T) {
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 120, 3, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}
+	agg := conf.Aggregation{AggregationMethod: []conf.Method{conf.Min}}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &agg, false)
+	m.Add(120, 1)
+
+	cases := []struct {
+		get     func() (Result, error)
+		expCode int
+	}{
+		{func() (Result, error) { return m.Get(200, 100) }, http.StatusBadRequest},
+		{func() (Result, error) { return m.GetAggregated(consolidation.Min, 60, 200, 100) }, http.StatusBadRequest},
+		{func() (Result, error) { return m.GetAggregated(consolidation.Min, 300, 0, 1000) }, http.StatusBadRequest},
+		{func() (Result, error) { return m.GetAggregated(consolidation.Max, 60, 0, 1000) }, http.StatusBadRequest},
+		{func() (Result, error) { return m.GetAggregated(consolidation.Consolidator(255), 60, 0, 1000) }, http.StatusBadRequest},
+		{func() (Result, error) { return m.GetAggregated(consolidation.None, 60, 0, 1000) }, http.StatusInternalServerError},
+		{func() (Result, error) { return m.GetAggregated(consolidation.Avg, 60, 0, 1000) }, http.StatusBadRequest},
+	}
+	for i, c := range cases {
+		_, err := c.get()
+		codeErr, ok := err.(interface{ Code() int })
+		if !ok || codeErr.Code() != c.expCode {
+			t.Fatalf("case %d: expected error with code %d, got %v", i, c.expCode, err)
+		}
+	}
+	if _, err := m.GetAggregated(consolidation.Min, 60, 0, 1000); err != nil {
+		t.Fatalf("expected valid query to succeed, got %s", err)
+	}
+}
+
+// the averages are the sums divided by the counts of the rollup
+func TestAggMetricGetAggregatedAvg(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 120, 5, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}
+	agg := conf.Aggregation{AggregationMethod: []conf.Method{conf.Avg}}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &agg, false)
+	for ts := uint32(100); ts < 400; ts += 10 {
+		m.Add(ts, float64(ts))
+	}
+
+	res, err := m.GetAggregated(consolidation.Avg, 60, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []schema.Point
+	for _, iter := range res.Iters {
+		for iter.Next() {
+			ts, val := iter.Values()
+			got = append(got, schema.Point{Val: val, Ts: ts})
+		}
+	}
+	// the aggregation of the last minute is still in progress
+	exp := []schema.Point{{Val: 110, Ts: 120}, {Val: 155, Ts: 180}, {Val: 215, Ts: 240}, {Val: 275, Ts: 300}, {Val: 335, Ts: 360}}
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+}
+
+func TestAggMetricGetAggregatedOpen(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	openRollups = true
+	defer func() { openRollups = false }()
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 120, 5, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}
+	agg := conf.Aggregation{AggregationMethod: []conf.Method{conf.Avg, conf.Max}}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &agg, false)
+	for ts := uint32(100); ts < 400; ts += 10 {
+		m.Add(ts, float64(ts))
+	}
+
+	// the window ending at 420 has points 370, 380 and 390 so far
+	cases := []struct {
+		cons consolidation.Consolidator
+		to   uint32
+		exp  []schema.Point
+	}{
+		{consolidation.Avg, 1000, []schema.Point{{Val: 380, Ts: 420}}},
+		{consolidation.Max, 1000, []schema.Point{{Val: 390, Ts: 420}}},
+		{consolidation.Avg, 420, nil},
+	}
+	for i, c := range cases {
+		res, err := m.GetAggregated(c.cons, 60, 0, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.exp, res.Points) {
+			t.Fatalf("case %d: expected open window points %v, got %v", i, c.exp, res.Points)
+		}
+	}
+}
+
+// the ranges are the maxes minus the mins of the rollup
+func TestAggMetricGetAggregatedRange(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 120, 5, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}
+	agg := conf.Aggregation{AggregationMethod: []conf.Method{conf.Max, conf.Min}}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &agg, false)
+	for ts := uint32(100); ts < 400; ts += 10 {
+		m.Add(ts, float64(ts%60))
+	}
+
+	res, err := m.GetAggregated(consolidation.Range, 60, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []schema.Point
+	for _, iter := range res.Iters {
+		for iter.Next() {
+			ts, val := iter.Values()
+			got = append(got, schema.Point{Val: val, Ts: ts})
+		}
+	}
+	exp := []schema.Point{{Val: 50, Ts: 120}, {Val: 50, Ts: 180}, {Val: 50, Ts: 240}, {Val: 50, Ts: 300}, {Val: 50, Ts: 360}}
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+
+	m = NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(2), ret, 0, &conf.Aggregation{AggregationMethod: []conf.Method{conf.Max}}, false)
+	if _, err := m.GetAggregated(consolidation.Range, 60, 0, 1000); err == nil {
+		t.Fatal("expected an error for a series without a min rollup")
+	}
+}
+
+// when GC closes the chunk of a metric that stopped reporting, the aggregation in progress is flushed,
+// and the chunks of the rollups are closed and saved along with the raw chunk
+func TestAggMetricGCFlushesAggregators(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 600, 2, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}
+	agg := conf.Aggregation{AggregationMethod: []conf.Method{conf.Max}}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &agg, false)
+	for ts := uint32(601); ts <= 690; ts++ {
+		m.Add(ts, float64(ts))
+	}
+
+	now := uint32(time.Now().Unix()) + 7200
+	m.GC(now, now-3600, now-3600)
+
+	res, err := m.GetAggregated(consolidation.Max, 60, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []schema.Point
+	for _, iter := range res.Iters {
+		for iter.Next() {
+			ts, val := iter.Values()
+			got = append(got, schema.Point{Val: val, Ts: ts})
+		}
+	}
+	exp := []schema.Point{{Val: 660, Ts: 660}, {Val: 690, Ts: 720}}
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	// the raw chunk and the one of the rollup
+	if mockstore.Items() != 2 {
+		t.Fatalf("expected 2 saved chunks, got %d", mockstore.Items())
+	}
+}
+
+func TestAggMetricRollupOnly(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 600, 2, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}
+	agg := conf.Aggregation{AggregationMethod: []conf.Method{conf.Max}}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &agg, false)
+	m.setRollupOnly(true)
+	// closes raw chunk 600 and rollup chunk 600
+	for ts := uint32(601); ts <= 1201; ts++ {
+		m.Add(ts, float64(ts))
+	}
+
+	itgens, err := mockstore.Search(test.NewContext(), test.GetAMKey(1), 0, 0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itgens) != 0 {
+		t.Fatalf("expected no raw chunks to be saved, got %d", len(itgens))
+	}
+	if mockstore.Items() != 1 {
+		t.Fatalf("expected the rollup chunk to be saved, got %d saved chunks", mockstore.Items())
+	}
+	// raw chunks count as saved, including the current one: the rollups keep track of what is unsaved
+	if got := m.oldestUnsaved(); got != 0 {
+		t.Fatalf("expected no unsaved raw chunks, got %d", got)
+	}
+}
+
+func TestAggMetricReplayStart(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	SetReplayStart(20)
+	defer SetReplayStart(0)
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 5, 0)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+
+	// the replay starts in the middle of chunk 10, which was saved before the restart
+	for _, ts := range []uint32{15, 16, 20, 21, 30} {
+		m.Add(ts, float64(ts))
+	}
+	if got := m.oldestUnsaved(); got != 20 {
+		t.Fatalf("expected the oldest unsaved chunk to be 20, got %d", got)
+	}
+	itgens, err := mockstore.Search(test.NewContext(), test.GetAMKey(42), 0, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itgens) != 1 || itgens[0].T0 != 20 {
+		t.Fatalf("expected only chunk 20 to be saved, got %v", itgens)
+	}
+	m.SyncChunkSaveState(20)
+	if got := m.oldestUnsaved(); got != 30 {
+		t.Fatalf("expected the oldest unsaved chunk to be 30, got %d", got)
+	}
+}
+
+func TestAggMetricReconcileUnsavedChunks(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 5, 0)}
+
+	// the demoted node has finished chunks 10 and 20, of which only 10 was saved by someone.
+	old := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+	for _, ts := range []uint32{10, 11, 20, 21, 30} {
+		old.Add(ts, float64(ts))
+	}
+	if unsaved := old.unsavedChunks(); len(unsaved) != 2 {
+		t.Fatalf("expected 2 unsaved chunks, got %d", len(unsaved))
+	}
+	old.SyncChunkSaveState(10)
+	unsaved := old.unsavedChunks()
+	if len(unsaved) != 1 || unsaved[0].T0 != 20 {
+		t.Fatalf("expected only chunk 20 to be unsaved, got %v", unsaved)
+	}
+
+	// the new primary started later, and only holds data from 30 onwards
+	cur := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+	cur.Add(30, 30)
+	saved, err := cur.reconcileChunk(unsaved[0].T0, unsaved[0].Span, unsaved[0].Data)
+	if err != nil || !saved {
+		t.Fatalf("expected chunk 20 to be saved, got saved=%t, err=%v", saved, err)
+	}
+	itgens, err := mockstore.Search(test.NewContext(), test.GetAMKey(42), 0, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itgens) != 1 || itgens[0].T0 != 20 {
+		t.Fatalf("expected chunk 20 in the store, got %v", itgens)
+	}
+	iter, err := itgens[0].Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var points []uint32
+	for iter.Next() {
+		ts, _ := iter.Values()
+		points = append(points, ts)
+	}
+	if len(points) != 2 || points[0] != 20 || points[1] != 21 {
+		t.Fatalf("expected points 20 and 21, got %v", points)
+	}
+
+	// chunks that were already saved, or that we hold ourselves, must not be saved again
+	for _, t0 := range []uint32{20, 30, 40} {
+		saved, err := cur.reconcileChunk(t0, 0, unsaved[0].Data)
+		if err != nil || saved {
+			t.Fatalf("expected chunk %d to be skipped, got saved=%t, err=%v", t0, saved, err)
+		}
+	}
+	if mockstore.Items() != 1 {
+		t.Fatalf("expected 1 chunk in the store, got %d", mockstore.Items())
+	}
+}
+
+func TestAggMetricReopenChunks(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	reopenChunks = true
+	defer func() { reopenChunks = false }()
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 5, 0)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+
+	for _, ts := range []uint32{10, 12, 20, 22} {
+		m.Add(ts, float64(ts))
+	}
+	if mockstore.Items() != 1 {
+		t.Fatalf("expected chunk 10 to be saved, got %d chunks in the store", mockstore.Items())
+	}
+
+	m.Add(11, 11) // late for the saved chunk 10
+	m.Add(19, 19) // late for the saved chunk 10, after its last point
+	m.Add(21, 21) // late for the current chunk
+	m.Add(20, 99) // duplicate, dropped
+	m.Add(5, 5)   // chunk 0 is not in memory, dropped
+
+	res, err := m.Get(0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for _, iter := range res.Iters {
+		for iter.Next() {
+			ts, val := iter.Values()
+			if val != float64(ts) {
+				t.Fatalf("expected value %d at %d, got %f", ts, ts, val)
+			}
+			got = append(got, ts)
+		}
+	}
+	exp := []uint32{10, 11, 12, 19, 20, 21, 22}
+	if fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Fatalf("expected points %v, got %v", exp, got)
+	}
+
+	// chunk 10 is saved again after each late point
+	itgens, err := mockstore.Search(test.NewContext(), test.GetAMKey(42), 0, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itgens) != 3 {
+		t.Fatalf("expected chunk 10 to be saved 3 times, got %d chunks in the store", len(itgens))
+	}
+	iter, err := itgens[2].Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for iter.Next() {
+		ts, _ := iter.Values()
+		got = append(got, ts)
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]uint32{10, 11, 12, 19}) {
+		t.Fatalf("expected the last saved chunk 10 to have all its points, got %v", got)
+	}
+}
+
 func BenchmarkAggMetricAdd(b *testing.B) {
 	mockstore.Reset()
 	mockstore.Drop = true
@@ -328,3 +834,186 @@ func BenchmarkAggMetricAdd(b *testing.B) {
 		metric.Add(t, float64(t))
 	}
 }
+
+func TestAggMetricMaxPointsPerChunk(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	maxPointsPerChunk = 3
+	defer func() { maxPointsPerChunk = 0 }()
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 10, 0)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+
+	// chunkspan 10 gets more points than a chunk may hold: it is rolled over into chunks 10, 13, 16 and 19
+	for ts := uint32(10); ts < 22; ts++ {
+		if res := m.Add(ts, float64(ts)); res != AddAccepted {
+			t.Fatalf("expected point %d to be accepted, got %s", ts, res)
+		}
+	}
+
+	getPoints := func(from, to uint32) []uint32 {
+		res, err := m.Get(from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint32
+		for _, iter := range res.Iters {
+			for iter.Next() {
+				ts, _ := iter.Values()
+				got = append(got, ts)
+			}
+		}
+		return got
+	}
+	exp := []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21}
+	if got := getPoints(0, 30); fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Fatalf("expected points %v, got %v", exp, got)
+	}
+	// reads only get the chunks that cover the requested range
+	exp = []uint32{13, 14, 15, 16, 17, 18}
+	if got := getPoints(14, 17); fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Fatalf("expected points %v, got %v", exp, got)
+	}
+
+	// the rolled over chunks, and the last chunk of the chunkspan, were saved with the span they cover
+	itgens, err := mockstore.Search(context.Background(), test.GetAMKey(42), 0, 0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spans []string
+	for _, itgen := range itgens {
+		spans = append(spans, fmt.Sprintf("%d:%d", itgen.T0, itgen.Span()))
+	}
+	expSpans := []string{"10:3", "13:3", "16:3", "19:1"}
+	if fmt.Sprint(spans) != fmt.Sprint(expSpans) {
+		t.Fatalf("expected saved chunks (t0:span) %v, got %v", expSpans, spans)
+	}
+	var saved []uint32
+	for _, itgen := range itgens {
+		iter, err := itgen.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for iter.Next() {
+			ts, _ := iter.Values()
+			saved = append(saved, ts)
+		}
+	}
+	exp = []uint32{10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	if fmt.Sprint(saved) != fmt.Sprint(exp) {
+		t.Fatalf("expected saved points %v, got %v", exp, saved)
+	}
+}
+
+func TestAggMetricGetDuringAdd(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 5, 0)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ts := uint32(1); ts <= 1000; ts++ {
+			m.Add(ts, float64(ts))
+		}
+	}()
+
+	// readers must always see a consecutive range of points, without taking the lock
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		res, err := m.Get(1, 2000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var prev uint32
+		for _, iter := range res.Iters {
+			for iter.Next() {
+				ts, val := iter.Values()
+				if prev != 0 && ts != prev+1 {
+					t.Fatalf("expected point %d after %d, got %d", prev+1, prev, ts)
+				}
+				if val != float64(ts) {
+					t.Fatalf("expected value %d for point %d, got %f", ts, ts, val)
+				}
+				prev = ts
+			}
+		}
+	}
+
+	res, err := m.Get(1, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last 5 chunks: 960 through 1000
+	if len(res.Iters) != 5 || res.Oldest != 960 {
+		t.Fatalf("expected 5 chunks starting at 960, got %d starting at %d", len(res.Iters), res.Oldest)
+	}
+}
+
+func TestAggMetricDropIdleChunks(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 5, 0)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+	for ts := uint32(10); ts < 60; ts++ {
+		m.Add(ts, float64(ts))
+	}
+	// the primary saved the chunks up to 30
+	m.SyncChunkSaveState(30)
+
+	if _, err := m.Get(10, 60); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := m.dropIdleChunks(uint32(time.Now().Unix())-60, 1); dropped != 0 {
+		t.Fatalf("expected no chunks of a recently read series to be removed, got %d", dropped)
+	}
+	// chunk 40 is not saved yet, so it must stay, and so must the ones after it
+	if dropped := m.dropIdleChunks(math.MaxUint32, 1); dropped != 3 {
+		t.Fatalf("expected 3 chunks to be removed, got %d", dropped)
+	}
+	res, err := m.Get(10, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Iters) != 2 || res.Oldest != 40 {
+		t.Fatalf("expected 2 chunks starting at 40, got %d starting at %d", len(res.Iters), res.Oldest)
+	}
+
+	// the ring buffer grows back as new chunks are added
+	m.Add(60, 60)
+	m.Add(70, 70)
+	if len(m.Chunks) != 4 || m.CurrentChunkPos != 3 || m.Chunks[3].Series.T0 != 70 {
+		t.Fatalf("expected chunk 70 to be added as the 4th chunk, got %v at %d", m.Chunks, m.CurrentChunkPos)
+	}
+}
+
+func TestAggMetricPartialFirstChunk(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 5, 0)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+	for ts := uint32(15); ts < 30; ts++ {
+		m.Add(ts, float64(ts))
+	}
+
+	res, err := m.Get(10, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Partial || res.Oldest != 15 {
+		t.Fatalf("expected a partial first chunk with data from 15, got partial %t from %d", res.Partial, res.Oldest)
+	}
+	res, err = m.Get(20, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Partial || res.Oldest != 20 {
+		t.Fatalf("expected a complete chunk with data from 20, got partial %t from %d", res.Partial, res.Oldest)
+	}
+}
@@ -1,39 +1,88 @@
 package mdata
 
 import (
+	"encoding/binary"
+	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/stats"
 	"github.com/raintank/schema"
 	log "github.com/sirupsen/logrus"
 )
 
+// orgMetrics holds all AggMetric objects of a single org.
+// in addition to the map, it maintains a copy-on-write snapshot of the keys,
+// so that iterating over all series only requires a brief lock to obtain the snapshot.
+// a snapshot is never modified once it has been handed out. Any insert or delete
+// invalidates it, and it gets rebuilt lazily upon the next request.
+type orgMetrics struct {
+	metrics map[schema.Key]*AggMetric
+	keys    []schema.Key // nil if needs to be rebuilt
+}
+
+func newOrgMetrics() *orgMetrics {
+	return &orgMetrics{
+		metrics: make(map[schema.Key]*AggMetric),
+	}
+}
+
+// aggMetricsShard holds the AggMetric objects of the series that hash to it, by org.
+type aggMetricsShard struct {
+	sync.RWMutex
+	metrics map[uint32]*orgMetrics
+	orgs    []uint32 // copy-on-write snapshot of the keys of metrics. nil if needs to be rebuilt
+	active  *stats.Gauge32
+	limits  *seriesLimits // shared by all shards
+}
+
+func newAggMetricsShard(i int, limits *seriesLimits) *aggMetricsShard {
+	return &aggMetricsShard{
+		metrics: make(map[uint32]*orgMetrics),
+		limits:  limits,
+		// metric tank.shard.%d.metrics_active is the number of currently known metrics (excl rollup series) in the given shard of the in-memory store
+		active: stats.NewGauge32(fmt.Sprintf("tank.shard.%d.metrics_active", i)),
+	}
+}
+
 // AggMetrics is an in-memory store of AggMetric objects
 // note: they are keyed by MKey here because each
 // AggMetric manages access to, and references of,
 // their rollup archives themselves
+// the metrics are spread over shards, each with their own lock, so that
+// accessing different metrics doesn't contend on a single lock.
 type AggMetrics struct {
 	store          Store
 	cachePusher    cache.CachePusher
 	dropFirstChunk bool
-	sync.RWMutex
-	Metrics        map[uint32]map[schema.Key]*AggMetric
+	shards         []*aggMetricsShard
 	chunkMaxStale  uint32
 	metricMaxStale uint32
 	gcInterval     time.Duration
+	gcNext         int // shard to start the next GC run at
+	limits         *seriesLimits
 }
 
-func NewAggMetrics(store Store, cachePusher cache.CachePusher, dropFirstChunk bool, chunkMaxStale, metricMaxStale uint32, gcInterval time.Duration) *AggMetrics {
+// NewAggMetrics creates an in-memory store with the given number of shards. (at least 1)
+func NewAggMetrics(store Store, cachePusher cache.CachePusher, dropFirstChunk bool, shards int, chunkMaxStale, metricMaxStale uint32, gcInterval time.Duration) *AggMetrics {
+	if shards < 1 {
+		shards = 1
+	}
 	ms := AggMetrics{
 		store:          store,
 		cachePusher:    cachePusher,
 		dropFirstChunk: dropFirstChunk,
-		Metrics:        make(map[uint32]map[schema.Key]*AggMetric),
+		shards:         make([]*aggMetricsShard, shards),
 		chunkMaxStale:  chunkMaxStale,
 		metricMaxStale: metricMaxStale,
 		gcInterval:     gcInterval,
+		limits:         newSeriesLimits(),
+	}
+	for i := range ms.shards {
+		ms.shards[i] = newAggMetricsShard(i, ms.limits)
 	}
 
 	// gcInterval = 0 can be useful in tests
@@ -43,124 +92,370 @@ func NewAggMetrics(store Store, cachePusher cache.CachePusher, dropFirstChunk bo
 	return &ms
 }
 
+// shard returns the shard that holds the given metric.
+// keys are hashes, so any of their bytes are distributed evenly.
+func (ms *AggMetrics) shard(key schema.MKey) *aggMetricsShard {
+	return ms.shards[binary.BigEndian.Uint32(key.Key[12:])%uint32(len(ms.shards))]
+}
+
+// snapshotOrgs returns the list of orgs that have metrics in the shard.
+// the returned slice is shared and must not be modified.
+func (sh *aggMetricsShard) snapshotOrgs() []uint32 {
+	sh.RLock()
+	orgs := sh.orgs
+	sh.RUnlock()
+	if orgs != nil {
+		return orgs
+	}
+	sh.Lock()
+	if sh.orgs == nil {
+		sh.orgs = make([]uint32, 0, len(sh.metrics))
+		for o := range sh.metrics {
+			sh.orgs = append(sh.orgs, o)
+		}
+	}
+	orgs = sh.orgs
+	sh.Unlock()
+	return orgs
+}
+
+// snapshotKeys returns the list of keys in the shard for the given org.
+// the returned slice is shared and must not be modified.
+// note that by the time the caller looks up a key, the metric may have been deleted.
+func (sh *aggMetricsShard) snapshotKeys(org uint32) []schema.Key {
+	sh.RLock()
+	om, ok := sh.metrics[org]
+	var keys []schema.Key
+	if ok {
+		keys = om.keys
+	}
+	sh.RUnlock()
+	if !ok || keys != nil {
+		return keys
+	}
+	sh.Lock()
+	om, ok = sh.metrics[org]
+	if ok {
+		if om.keys == nil {
+			om.keys = make([]schema.Key, 0, len(om.metrics))
+			for k := range om.metrics {
+				om.keys = append(om.keys, k)
+			}
+		}
+		keys = om.keys
+	}
+	sh.Unlock()
+	return keys
+}
+
+// get returns the AggMetric for the given key, if it exists
+func (sh *aggMetricsShard) get(key schema.MKey) (*AggMetric, bool) {
+	var m *AggMetric
+	sh.RLock()
+	om, ok := sh.metrics[key.Org]
+	if ok {
+		m, ok = om.metrics[key.Key]
+	}
+	sh.RUnlock()
+	return m, ok
+}
+
+// ForEach calls fn for every AggMetric, working off a snapshot of the keys
+// so that writers are only blocked for very short amounts of time.
+// metrics added during the iteration may or may not be visited.
+// if fn returns false, the iteration stops.
+func (ms *AggMetrics) ForEach(fn func(key schema.MKey, m *AggMetric) bool) {
+	for _, sh := range ms.shards {
+		for _, org := range sh.snapshotOrgs() {
+			for _, key := range sh.snapshotKeys(org) {
+				mkey := schema.MKey{Key: key, Org: org}
+				m, ok := sh.get(mkey)
+				if !ok {
+					continue
+				}
+				if !fn(mkey, m) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// PublishUnsavedChunks publishes all finished chunks, across all series and archives,
+// that have not been saved yet. this is used when we get demoted from primary,
+// so that the new primary can save any data that it may not have itself.
+// it returns the number of chunks published.
+func (ms *AggMetrics) PublishUnsavedChunks() int {
+	var published int
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		for _, am := range m.archiveMetrics() {
+			for _, uc := range am.unsavedChunks() {
+				SendUnsavedChunk(uc)
+				published++
+			}
+		}
+		return true
+	})
+	return published
+}
+
+// OldestUnsaved returns the T0 of the oldest chunk that was not saved yet, across all series and archives.
+// all data before it has been saved, so that after a restart, replaying the data from there
+// restores the in-memory chunks. 0 if there are no unsaved chunks.
+func (ms *AggMetrics) OldestUnsaved() uint32 {
+	var oldest uint32
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		for _, am := range m.archiveMetrics() {
+			t0 := am.oldestUnsaved()
+			if t0 != 0 && (oldest == 0 || t0 < oldest) {
+				oldest = t0
+			}
+		}
+		return true
+	})
+	return oldest
+}
+
+// SetReplayStart marks that the data is replayed from the given time (the OldestUnsaved before the restart) at startup.
+// chunks that start before it only get part of their data, so they are marked as saved rather than saved:
+// the complete chunks have been saved already.
+// it must be called before any data is added.
+func SetReplayStart(ts uint32) {
+	replayStart = ts
+}
+
+// GCConfig tunes the periodic scan for stale chunks and metrics
+type GCConfig struct {
+	Offset      time.Duration // how long after each multiple of the gc interval to start a run
+	Concurrency int           // number of shards to scan concurrently
+	MaxSeries   int           // max number of series to scan per run. 0 means no limit
+	MaxPoints   int           // max number of points of stale chunks to close per run. 0 means no limit
+	IdleMaxAge  uint32        // how long a raw series must not have been read for its older saved chunks to be removed from memory. 0 means never
+	IdleChunks  int           // number of raw chunks to keep in memory of series that are idle as per IdleMaxAge
+}
+
+var gcConfig = GCConfig{
+	Offset:      time.Minute,
+	Concurrency: 1,
+}
+
+// SetGCConfig configures the GC. it must be called before any AggMetrics is created.
+func SetGCConfig(c GCConfig) {
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	gcConfig = c
+}
+
+// gcBudget tracks how much work a GC run did, so that it can stop once it did as much as it's allowed to.
+// it is shared by the workers of the run.
+type gcBudget struct {
+	maxSeries int64
+	maxPoints int64
+	series    int64
+	points    int64
+}
+
+func (b *gcBudget) exhausted() bool {
+	return (b.maxSeries > 0 && atomic.LoadInt64(&b.series) >= b.maxSeries) ||
+		(b.maxPoints > 0 && atomic.LoadInt64(&b.points) >= b.maxPoints)
+}
+
+func (b *gcBudget) add(points uint32) {
+	atomic.AddInt64(&b.series, 1)
+	atomic.AddInt64(&b.points, int64(points))
+}
+
 // periodically scan chunks and close any that have not received data in a while
 func (ms *AggMetrics) GC() {
 	for {
 		unix := time.Duration(time.Now().UnixNano())
 		diff := ms.gcInterval - (unix % ms.gcInterval)
-		time.Sleep(diff + time.Minute)
-		log.Info("checking for stale chunks that need persisting.")
-		now := uint32(time.Now().Unix())
-		chunkMinTs := now - uint32(ms.chunkMaxStale)
-		metricMinTs := now - uint32(ms.metricMaxStale)
-
-		// as this is the only goroutine that can delete from ms.Metrics
-		// we only need to lock long enough to get the list of orgs, then for each org
-		// get the list of active metrics.
-		// It doesn't matter if new orgs or metrics are added while we iterate these lists.
-		ms.RLock()
-		orgs := make([]uint32, 0, len(ms.Metrics))
-		for o := range ms.Metrics {
-			orgs = append(orgs, o)
+		time.Sleep(diff + gcConfig.Offset)
+		ms.gcRun(uint32(time.Now().Unix()))
+	}
+}
+
+// gcRun scans the shards for stale chunks and metrics, using gcConfig.Concurrency workers.
+// it starts with the shard at which the previous run ran out of budget, if any,
+// so that under a budget all shards still get scanned in turn.
+func (ms *AggMetrics) gcRun(now uint32) {
+	log.Info("checking for stale chunks that need persisting.")
+	pre := time.Now()
+	chunkMinTs := now - uint32(ms.chunkMaxStale)
+	metricMinTs := now - uint32(ms.metricMaxStale)
+	budget := &gcBudget{
+		maxSeries: int64(gcConfig.MaxSeries),
+		maxPoints: int64(gcConfig.MaxPoints),
+	}
+
+	// done[j] is whether the j'th shard of this run, counting from ms.gcNext, was scanned completely
+	done := make([]bool, len(ms.shards))
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < gcConfig.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			for j := range todo {
+				sh := ms.shards[(ms.gcNext+j)%len(ms.shards)]
+				done[j] = sh.gc(now, chunkMinTs, metricMinTs, budget)
+			}
+			wg.Done()
+		}()
+	}
+	for j := range ms.shards {
+		if budget.exhausted() {
+			break
+		}
+		todo <- j
+	}
+	close(todo)
+	wg.Wait()
+
+	for j := range done {
+		if !done[j] {
+			gcBudgetExhausted.Inc()
+			log.Infof("GC: budget exhausted after scanning %d series and closing chunks with %d points. resuming at the next run", budget.series, budget.points)
+			ms.gcNext = (ms.gcNext + j) % len(ms.shards)
+			break
 		}
-		ms.RUnlock()
-		for _, org := range orgs {
-			orgActiveMetrics := promActiveMetrics.WithLabelValues(strconv.Itoa(int(org)))
-			keys := make([]schema.Key, 0, len(ms.Metrics[org]))
-			ms.RLock()
-			for k := range ms.Metrics[org] {
-				keys = append(keys, k)
+	}
+
+	// Get the totalActive across all shards.
+	totalActive := 0
+	for _, sh := range ms.shards {
+		totalActive += sh.count()
+	}
+	metricsActive.Set(totalActive)
+	gcDuration.Value(time.Since(pre))
+}
+
+// gc purges the stale metrics of the shard, and returns whether it scanned all of them before the budget was exhausted.
+func (sh *aggMetricsShard) gc(now, chunkMinTs, metricMinTs uint32, budget *gcBudget) bool {
+	// we work off snapshots of the list of orgs and, for each org, the list of active metrics.
+	// It doesn't matter if new orgs or metrics are added (or evicted) while we iterate these lists.
+	for _, org := range sh.snapshotOrgs() {
+		for _, key := range sh.snapshotKeys(org) {
+			if budget.exhausted() {
+				return false
 			}
-			ms.RUnlock()
-			for _, key := range keys {
-				gcMetric.Inc()
-				ms.RLock()
-				a := ms.Metrics[org][key]
-				ms.RUnlock()
-				if a.GC(now, chunkMinTs, metricMinTs) {
-					log.Debugf("metric %s is stale. Purging data from memory.", key)
-					ms.Lock()
-					delete(ms.Metrics[org], key)
-					orgActiveMetrics.Set(float64(len(ms.Metrics[org])))
-					ms.Unlock()
-				}
+			gcMetric.Inc()
+			mkey := schema.MKey{Key: key, Org: org}
+			a, ok := sh.get(mkey)
+			if !ok {
+				continue
 			}
-			ms.RLock()
-			orgActive := len(ms.Metrics[org])
-			orgActiveMetrics.Set(float64(orgActive))
-			ms.RUnlock()
-
-			// If this org has no keys, then delete the org from the map
-			if orgActive == 0 {
-				// To prevent races, we need to check that there are still no metrics for the org while holding a write lock
-				ms.Lock()
-				orgActive = len(ms.Metrics[org])
-				if orgActive == 0 {
-					delete(ms.Metrics, org)
-				}
-				ms.Unlock()
+			stale, stats := a.GC(now, chunkMinTs, metricMinTs)
+			budget.add(stats.points)
+			gcChunksPersisted.Add(int(stats.persisted))
+			if stale {
+				log.Debugf("metric %s is stale. Purging data from memory.", key)
+				sh.remove(mkey)
+				gcSeriesDropped.Inc()
+				continue
+			}
+			if gcConfig.IdleMaxAge > 0 && now > gcConfig.IdleMaxAge {
+				gcIdleChunksDropped.Add(a.dropIdleChunks(now-gcConfig.IdleMaxAge, gcConfig.IdleChunks))
 			}
 		}
+	}
+	return true
+}
 
-		// Get the totalActive across all orgs.
-		totalActive := 0
-		ms.RLock()
-		for o := range ms.Metrics {
-			totalActive += len(ms.Metrics[o])
-		}
-		ms.RUnlock()
-		metricsActive.Set(totalActive)
+// count updates the metrics_active gauge of the shard, and returns how many metrics it holds.
+func (sh *aggMetricsShard) count() int {
+	active := 0
+	sh.RLock()
+	for _, om := range sh.metrics {
+		active += len(om.metrics)
 	}
+	sh.RUnlock()
+	sh.active.Set(active)
+	return active
 }
 
-func (ms *AggMetrics) Get(key schema.MKey) (Metric, bool) {
+// remove removes the metric from the shard, and the org if it has no metrics left.
+func (sh *aggMetricsShard) remove(key schema.MKey) {
+	sh.Lock()
+	om, ok := sh.metrics[key.Org]
 	var m *AggMetric
-	ms.RLock()
-	_, ok := ms.Metrics[key.Org]
 	if ok {
-		m, ok = ms.Metrics[key.Org][key.Key]
+		m, ok = om.metrics[key.Key]
 	}
-	ms.RUnlock()
+	if !ok {
+		sh.Unlock()
+		return
+	}
+	delete(om.metrics, key.Key)
+	om.keys = nil
+	if len(om.metrics) == 0 {
+		delete(sh.metrics, key.Org)
+		sh.orgs = nil
+	}
+	sh.Unlock()
+	sh.active.Dec()
+	metricsActive.Dec()
+	sh.limits.add(key.Org, -1)
+	m.usage.addSeries(-1)
+	m.release()
+	promActiveMetrics.WithLabelValues(strconv.Itoa(int(key.Org))).Dec()
+}
+
+func (ms *AggMetrics) Get(key schema.MKey) (Metric, bool) {
+	m, ok := ms.shard(key).get(key)
 	return m, ok
 }
 
-func (ms *AggMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16) Metric {
-	var m *AggMetric
+// GetOrCreate returns the series, creating it if it doesn't exist yet.
+// it returns a SeriesLimitError if the series may not be created because its org reached its series limit.
+// the limit is checked and the series counted while creating it, so concurrent creations can't exceed the limit.
+func (ms *AggMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16) (Metric, error) {
 	// in the most common case, it's already there and an Rlock is all we need
-	ms.RLock()
-	_, ok := ms.Metrics[key.Org]
+	sh := ms.shard(key)
+	m, ok := sh.get(key)
 	if ok {
-		m, ok = ms.Metrics[key.Org][key.Key]
-	}
-	ms.RUnlock()
-	if ok {
-		return m
+		return m, nil
 	}
 
 	k := schema.AMKey{
 		MKey: key,
 	}
 
-	agg := Aggregations.Get(aggId)
-	confSchema := Schemas.Get(schemaId)
+	agg := GetAgg(aggId)
+	confSchema := GetSchema(schemaId)
 
 	// if it wasn't there, get the write lock and prepare to add it
 	// but first we need to check again if someone has added it in
 	// the meantime (quite rare, but anyway)
-	ms.Lock()
-	if _, ok := ms.Metrics[key.Org]; !ok {
-		ms.Metrics[key.Org] = make(map[schema.Key]*AggMetric)
-	}
-	m, ok = ms.Metrics[key.Org][key.Key]
+	sh.Lock()
+	om, ok := sh.metrics[key.Org]
 	if ok {
-		ms.Unlock()
-		return m
+		if m, ok := om.metrics[key.Key]; ok {
+			sh.Unlock()
+			return m, nil
+		}
+	}
+	if err := sh.limits.reserve(key.Org); err != nil {
+		sh.Unlock()
+		return nil, err
+	}
+	if !ok {
+		om = newOrgMetrics()
+		sh.metrics[key.Org] = om
+		sh.orgs = nil
 	}
 	m = NewAggMetric(ms.store, ms.cachePusher, k, confSchema.Retentions, confSchema.ReorderWindow, &agg, ms.dropFirstChunk)
-	ms.Metrics[key.Org][key.Key] = m
-	active := len(ms.Metrics[key.Org])
-	ms.Unlock()
+	m.schemaId = schemaId
+	m.aggId = aggId
+	m.setFloat32(confSchema.Float32)
+	m.setDupPolicy(confSchema.DupPolicy, confSchema.Retentions[0].SecondsPerPoint)
+	m.setRollupOnly(confSchema.RollupOnly)
+	om.metrics[key.Key] = m
+	om.keys = nil
+	sh.Unlock()
+	sh.active.Inc()
 	metricsActive.Inc()
-	promActiveMetrics.WithLabelValues(strconv.Itoa(int(key.Org))).Set(float64(active))
-	return m
+	m.usage.addSeries(1)
+	promActiveMetrics.WithLabelValues(strconv.Itoa(int(key.Org))).Inc()
+	return m, nil
 }
@@ -0,0 +1,248 @@
+package mdata
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+// getOrCreate returns the series with schema and agg id 0, creating it if needed, for tests that don't set series limits
+func getOrCreate(ms *AggMetrics, key schema.MKey) *AggMetric {
+	m, err := ms.GetOrCreate(key, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+	return m.(*AggMetric)
+}
+
+func TestAggMetricsKeySnapshot(t *testing.T) {
+	SetSingleSchema(conf.NewRetentionMT(1, 1, 120, 5, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+
+	for i := 0; i < 3; i++ {
+		getOrCreate(ms, test.GetMKey(i))
+	}
+	snap := ms.shards[0].snapshotKeys(0)
+	if len(snap) != 3 {
+		t.Fatalf("expected snapshot of 3 keys, got %d", len(snap))
+	}
+
+	// a subsequent request without modifications must return the same snapshot
+	snap2 := ms.shards[0].snapshotKeys(0)
+	if &snap[0] != &snap2[0] {
+		t.Fatalf("expected snapshot to be reused")
+	}
+
+	// adding a metric must not affect snapshots handed out already
+	getOrCreate(ms, test.GetMKey(3))
+	if len(snap) != 3 {
+		t.Fatalf("expected previously obtained snapshot to remain unchanged, got %d keys", len(snap))
+	}
+	if got := len(ms.shards[0].snapshotKeys(0)); got != 4 {
+		t.Fatalf("expected new snapshot of 4 keys, got %d", got)
+	}
+
+	seen := make(map[schema.MKey]bool)
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		seen[key] = true
+		return true
+	})
+	for i := 0; i < 4; i++ {
+		if !seen[test.GetMKey(i)] {
+			t.Fatalf("ForEach did not visit metric %d", i)
+		}
+	}
+
+	if keys := ms.shards[0].snapshotKeys(1); keys != nil {
+		t.Fatalf("expected no keys for unknown org, got %v", keys)
+	}
+}
+
+type recordingNotifier struct {
+	unsaved map[string]int
+}
+
+func (n *recordingNotifier) Send(sc SavedChunk) {}
+func (n *recordingNotifier) SendUnsaved(uc UnsavedChunk) {
+	n.unsaved[uc.Key]++
+}
+
+// TestAggMetricsCoverAllArchives checks that the operations that walk the archives of a series
+// (snapshots, publishing unsaved chunks and copying a series) visit every archive it has
+func TestAggMetricsCoverAllArchives(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	SetSingleSchema(
+		conf.NewRetentionMT(10, 3600, 60, 5, 0),
+		conf.NewRetentionMT(60, 7200, 300, 5, 0),
+		conf.NewRetentionMT(300, 86400, 900, 5, 0),
+	)
+	SetSingleAgg(conf.Avg, conf.Min, conf.Max, conf.Sum, conf.Lst)
+	store := NewMockStore()
+	ms := NewAggMetrics(store, &cache.MockCache{}, false, 1, 0, 0, 0)
+
+	key := test.GetMKey(1)
+	m := getOrCreate(ms, key)
+	for ts := uint32(1000); ts < 4000; ts += 10 {
+		m.Add(ts, float64(ts))
+	}
+
+	expected := make(map[schema.Archive]bool)
+	for _, a := range seriesArchives(key, 0, 0) {
+		expected[a.key.Archive] = true
+	}
+	if len(expected) != 11 {
+		t.Fatalf("expected 11 archives (raw + 5 per rollup), got %d", len(expected))
+	}
+
+	// every rollup the aggregators keep must be in the shared list
+	for _, agg := range m.aggregators {
+		listed := make(map[uintptr]bool)
+		for _, am := range agg.archives() {
+			listed[reflect.ValueOf(am).Pointer()] = true
+		}
+		v := reflect.ValueOf(agg).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if f.Type() == reflect.TypeOf(m) && !f.IsNil() && !listed[f.Pointer()] {
+				t.Fatalf("aggregator field %s is missing from Aggregator.archives()", v.Type().Field(i).Name)
+			}
+		}
+	}
+
+	check := func(op string, got map[schema.Archive]bool) {
+		t.Helper()
+		for archive := range expected {
+			if !got[archive] {
+				t.Fatalf("%s: archive %s not covered", op, archive)
+			}
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("%s: expected %d archives, got %d", op, len(expected), len(got))
+		}
+	}
+
+	got := make(map[schema.Archive]bool)
+	for _, a := range m.snapshot(key).Archives {
+		got[a.Archive] = true
+	}
+	check("snapshot", got)
+
+	n := &recordingNotifier{unsaved: make(map[string]int)}
+	InitPersistNotifier(n)
+	defer InitPersistNotifier()
+	ms.PublishUnsavedChunks()
+	got = make(map[schema.Archive]bool)
+	for archive := range expected {
+		if n.unsaved[schema.AMKey{MKey: key, Archive: archive}.String()] > 0 {
+			got[archive] = true
+		}
+	}
+	check("publish", got)
+
+	to := test.GetMKey(2)
+	if _, err := ms.CopySeries(context.Background(), key, to, 0, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	got = make(map[schema.Archive]bool)
+	for amkey := range store.results {
+		if amkey.MKey == to {
+			got[amkey.Archive] = true
+		}
+	}
+	check("rename", got)
+}
+
+func TestAggMetricsShards(t *testing.T) {
+	SetSingleSchema(conf.NewRetentionMT(1, 1, 120, 5, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 4, 0, 0, 0)
+
+	keys := make([]schema.MKey, 100)
+	for i := range keys {
+		keys[i] = test.GetMKey(i)
+		getOrCreate(ms, keys[i])
+	}
+	var total int
+	for i, sh := range ms.shards {
+		n := len(sh.snapshotKeys(0))
+		if n == 0 {
+			t.Fatalf("expected metrics to be spread over all shards, but shard %d is empty", i)
+		}
+		total += n
+	}
+	if total != len(keys) {
+		t.Fatalf("expected %d metrics across the shards, got %d", len(keys), total)
+	}
+	for _, key := range keys {
+		m, ok := ms.Get(key)
+		if !ok || m != getOrCreate(ms, key) {
+			t.Fatalf("expected to find metric %s", key)
+		}
+	}
+	var visited int
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		visited++
+		return true
+	})
+	if visited != len(keys) {
+		t.Fatalf("expected ForEach to visit %d metrics, got %d", len(keys), visited)
+	}
+}
+
+func TestAggMetricsGCBudget(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	defer SetGCConfig(gcConfig)
+	SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 5, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 4, 60, 60, 0)
+
+	for i := 0; i < 40; i++ {
+		getOrCreate(ms, test.GetMKey(i)).Add(1000, 1)
+	}
+	count := func() int {
+		var n int
+		ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	// an hour from now, every metric is stale, so every metric scanned gets its chunk persisted and is dropped
+	now := uint32(time.Now().Unix()) + 3600
+	SetGCConfig(GCConfig{Concurrency: 1, MaxSeries: 15})
+	ms.gcRun(now)
+	if n := count(); n != 25 {
+		t.Fatalf("expected 25 metrics left after a run limited to 15 series, got %d", n)
+	}
+	if ms.gcNext == 0 {
+		t.Fatalf("expected the next run to resume past the first shard")
+	}
+
+	SetGCConfig(GCConfig{Concurrency: 1, MaxPoints: 10})
+	ms.gcRun(now)
+	if n := count(); n != 15 {
+		t.Fatalf("expected 15 metrics left after a run limited to 10 points, got %d", n)
+	}
+
+	SetGCConfig(GCConfig{Concurrency: 4})
+	ms.gcRun(now)
+	if n := count(); n != 0 {
+		t.Fatalf("expected all metrics to be dropped after an unlimited run, got %d", n)
+	}
+	if mockstore.Items() != 40 {
+		t.Fatalf("expected 40 chunks to be saved, got %d", mockstore.Items())
+	}
+}
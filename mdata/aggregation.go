@@ -27,6 +27,16 @@ func (a *Aggregation) Add(val float64) {
 	a.Lst = val
 }
 
+// AddAggregation adds the values that o summarizes, as if they were added one by one.
+// o must cover the values that come after the ones added so far.
+func (a *Aggregation) AddAggregation(o *Aggregation) {
+	a.Min = math.Min(o.Min, a.Min)
+	a.Max = math.Max(o.Max, a.Max)
+	a.Sum += o.Sum
+	a.Cnt += o.Cnt
+	a.Lst = o.Lst
+}
+
 func (a *Aggregation) Reset() {
 	a.Min = math.MaxFloat64
 	a.Max = -math.MaxFloat64
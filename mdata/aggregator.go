@@ -1,6 +1,8 @@
 package mdata
 
 import (
+	"math"
+
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/raintank/schema"
@@ -27,6 +29,14 @@ type Aggregator struct {
 	sumMetric       *AggMetric
 	cntMetric       *AggMetric
 	lstMetric       *AggMetric
+
+	// windows with fewer points than this (xFilesFactor of the points the raw interval allows for) result in no points
+	minPoints float64
+
+	// with chain-rollups, next is the aggregator of the next larger span, which is fed our aggregations rather than raw points.
+	// chained is set on the aggregator that is fed this way.
+	next    *Aggregator
+	chained bool
 }
 
 func NewAggregator(store Store, cachePusher cache.CachePusher, key schema.AMKey, ret conf.Retention, agg conf.Aggregation, dropFirstChunk bool) *Aggregator {
@@ -74,8 +84,34 @@ func NewAggregator(store Store, cachePusher cache.CachePusher, key schema.AMKey,
 	return aggregator
 }
 
+// setXFilesFactor sets the fraction of the points that a window must have, given the raw interval of the series,
+// to result in points for the rollups. like whisper, a window with fewer points results in a null (no point) instead.
+func (agg *Aggregator) setXFilesFactor(xff float64, rawInterval int) {
+	agg.minPoints = xff * float64(agg.span) / float64(rawInterval)
+}
+
+// chain makes next, the aggregator of a larger span, aggregate our aggregations rather than raw points.
+// it returns whether it did: only if the span of next is a multiple of ours, so that our windows fall within its windows.
+func (agg *Aggregator) chain(next *Aggregator) bool {
+	if next.span%agg.span != 0 {
+		return false
+	}
+	agg.next = next
+	next.chained = true
+	return true
+}
+
 // flush adds points to the aggregation-series and resets aggregation state
 func (agg *Aggregator) flush() {
+	if agg.next != nil {
+		// the next aggregator needs the points of windows below the xFilesFactor too, like if it aggregated the raw points
+		agg.next.addAggregation(agg.currentBoundary, agg.agg)
+	}
+	if agg.agg.Cnt < agg.minPoints {
+		rollupsBelowXFF.Inc()
+		agg.agg.Reset()
+		return
+	}
 	if agg.minMetric != nil {
 		agg.minMetric.Add(agg.currentBoundary, agg.agg.Min)
 	}
@@ -95,12 +131,18 @@ func (agg *Aggregator) flush() {
 	agg.agg.Reset()
 }
 
+// Add adds the point to the aggregation of its window.
+// NaN values are nulls: they don't contribute to the aggregation, just like points that were never sent.
+// a window with only nulls results in no points for the rollups.
 func (agg *Aggregator) Add(ts uint32, val float64) {
 	boundary := AggBoundary(ts, agg.span)
+	null := math.IsNaN(val)
 
 	if boundary == agg.currentBoundary {
-		agg.agg.Add(val)
-		if ts == boundary {
+		if !null {
+			agg.agg.Add(val)
+		}
+		if ts == boundary && agg.agg.Cnt != 0 {
 			agg.flush()
 		}
 	} else if boundary > agg.currentBoundary {
@@ -110,19 +152,59 @@ func (agg *Aggregator) Add(ts uint32, val float64) {
 			agg.flush()
 		}
 		agg.currentBoundary = boundary
-		agg.agg.Add(val)
+		if !null {
+			agg.agg.Add(val)
+		}
 	} else {
 		panic("aggregator: boundary < agg.currentBoundary. ts > lastSeen should already have been asserted")
 	}
 }
 
-// GC returns whether all of the associated series are stale and can be removed
-func (agg *Aggregator) GC(now, chunkMinTs, metricMinTs, lastWriteTime uint32) bool {
+// addAggregation adds the aggregation of a window of a chained aggregator, which ends at ts, to the aggregation of our window.
+// it works like Add, but for a window of points at once.
+func (agg *Aggregator) addAggregation(ts uint32, o *Aggregation) {
+	boundary := AggBoundary(ts, agg.span)
+
+	if boundary == agg.currentBoundary {
+		agg.agg.AddAggregation(o)
+		if ts == boundary {
+			agg.flush()
+		}
+	} else if boundary > agg.currentBoundary {
+		if agg.agg.Cnt != 0 {
+			agg.flush()
+		}
+		agg.currentBoundary = boundary
+		agg.agg.AddAggregation(o)
+		if ts == boundary {
+			agg.flush()
+		}
+	} else {
+		panic("aggregator: boundary < agg.currentBoundary. the chained aggregator should only flush windows in order")
+	}
+}
+
+// archives returns the AggMetrics of the rollup archives the aggregator keeps, one per enabled method.
+// anything that needs to visit every archive of a series (snapshots, renames, gc, ...) goes through here,
+// so a new rollup archive only has to be added in this one place.
+func (agg *Aggregator) archives() []*AggMetric {
+	out := make([]*AggMetric, 0, 5)
+	for _, m := range []*AggMetric{agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric, agg.lstMetric} {
+		if m != nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// GC returns whether all of the associated series are stale and can be removed, and which chunks they closed
+func (agg *Aggregator) GC(now, chunkMinTs, metricMinTs, lastWriteTime uint32) (bool, gcStats) {
 	ret := true
+	var stats gcStats
 
 	if lastWriteTime+agg.span > chunkMinTs {
 		// Last datapoint was less than one aggregation window before chunkMinTs, hold out for more data
-		return false
+		return false, stats
 	}
 
 	// Haven't seen datapoints in an entire aggregation window before chunkMinTs, time to flush
@@ -130,21 +212,11 @@ func (agg *Aggregator) GC(now, chunkMinTs, metricMinTs, lastWriteTime uint32) bo
 		agg.flush()
 	}
 
-	if agg.minMetric != nil {
-		ret = agg.minMetric.GC(now, chunkMinTs, metricMinTs) && ret
-	}
-	if agg.maxMetric != nil {
-		ret = agg.maxMetric.GC(now, chunkMinTs, metricMinTs) && ret
-	}
-	if agg.sumMetric != nil {
-		ret = agg.sumMetric.GC(now, chunkMinTs, metricMinTs) && ret
-	}
-	if agg.cntMetric != nil {
-		ret = agg.cntMetric.GC(now, chunkMinTs, metricMinTs) && ret
-	}
-	if agg.lstMetric != nil {
-		ret = agg.lstMetric.GC(now, chunkMinTs, metricMinTs) && ret
+	for _, m := range agg.archives() {
+		stale, mStats := m.GC(now, chunkMinTs, metricMinTs)
+		stats.add(mStats)
+		ret = stale && ret
 	}
 
-	return ret
+	return ret, stats
 }
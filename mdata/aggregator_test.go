@@ -1,11 +1,14 @@
 package mdata
 
 import (
+	"math"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/test"
 	"github.com/raintank/schema"
@@ -139,4 +142,109 @@ func TestAggregator(t *testing.T) {
 		{Val: 2451.123 + 1451.123 + 978894.445, Ts: 240},
 	})
 
+	// nulls don't contribute to rollups, and a window of only nulls has no rollup point
+	agg = NewAggregator(mockstore, &cache.MockCache{}, test.GetAMKey(5), ret, aggs, false)
+	agg.Add(100, 123.4)
+	agg.Add(110, math.NaN())
+	agg.Add(120, 5)
+	agg.Add(130, math.NaN())
+	agg.Add(240, math.NaN())
+	agg.Add(250, 1)
+	agg.Add(260, math.NaN())
+	agg.Add(300, math.NaN())
+	compare("nulls-min", agg.minMetric, []schema.Point{
+		{Val: 5, Ts: 120},
+		{Val: 1, Ts: 300},
+	})
+	compare("nulls-cnt", agg.cntMetric, []schema.Point{
+		{Val: 2, Ts: 120},
+		{Val: 1, Ts: 300},
+	})
+	compare("nulls-sum", agg.sumMetric, []schema.Point{
+		{Val: 128.4, Ts: 120},
+		{Val: 1, Ts: 300},
+	})
+
+	// with a raw interval of 10, windows need 3 points for an xFilesFactor of 0.5
+	agg = NewAggregator(mockstore, &cache.MockCache{}, test.GetAMKey(6), ret, aggs, false)
+	agg.setXFilesFactor(0.5, 10)
+	agg.Add(100, 123.4)
+	agg.Add(110, 5)
+	agg.Add(150, 3)
+	agg.Add(160, math.NaN())
+	agg.Add(170, 4)
+	agg.Add(180, 2)
+	agg.Add(190, 1)
+	compare("xff-min", agg.minMetric, []schema.Point{
+		{Val: 2, Ts: 180},
+	})
+	compare("xff-cnt", agg.cntMetric, []schema.Point{
+		{Val: 3, Ts: 180},
+	})
+}
+
+// rollups computed from the rollup before them are the same as the ones computed from the raw points
+func TestAggregatorChained(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	ret := conf.Retentions{
+		conf.NewRetentionMT(10, 86400, 600, 5, 0),
+		conf.NewRetentionMT(60, 86400, 3600, 2, 0),
+		conf.NewRetentionMT(300, 86400, 3600, 2, 0),
+		conf.NewRetentionMT(900, 86400, 3600, 2, 0),
+	}
+	aggs := conf.Aggregation{AggregationMethod: []conf.Method{conf.Avg, conf.Min, conf.Max, conf.Lst}}
+	raw := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &aggs, false)
+	chainRollups = true
+	chained := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(2), ret, 0, &aggs, false)
+	chainRollups = false
+	if !chained.aggregators[1].chained || !chained.aggregators[2].chained || raw.aggregators[1].chained {
+		t.Fatalf("expected the rollups after the first one to be chained, only when enabled")
+	}
+
+	for ts := uint32(10); ts < 3000; ts += 10 {
+		val := float64(ts%70) - 20
+		if ts%130 == 0 || (ts > 1200 && ts < 1400) {
+			val = math.NaN()
+		}
+		raw.Add(ts, val)
+		chained.Add(ts, val)
+	}
+
+	points := func(m *AggMetric, cons consolidation.Consolidator, span uint32) []schema.Point {
+		res, err := m.GetAggregated(cons, span, 0, 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []schema.Point
+		for _, iter := range res.Iters {
+			for iter.Next() {
+				ts, val := iter.Values()
+				out = append(out, schema.Point{Val: val, Ts: ts})
+			}
+		}
+		return out
+	}
+	for _, span := range []uint32{60, 300, 900} {
+		for _, cons := range []consolidation.Consolidator{consolidation.Sum, consolidation.Cnt, consolidation.Min, consolidation.Max, consolidation.Lst} {
+			exp := points(raw, cons, span)
+			got := points(chained, cons, span)
+			if len(exp) == 0 || !reflect.DeepEqual(exp, got) {
+				t.Fatalf("%s of span %d: expected %v, got %v", cons, span, exp, got)
+			}
+		}
+	}
+}
+
+func TestAggregatorChainSpans(t *testing.T) {
+	aggs := conf.Aggregation{AggregationMethod: []conf.Method{conf.Max}}
+	a60 := NewAggregator(mockstore, &cache.MockCache{}, test.GetAMKey(1), conf.NewRetentionMT(60, 86400, 3600, 2, 0), aggs, false)
+	a90 := NewAggregator(mockstore, &cache.MockCache{}, test.GetAMKey(1), conf.NewRetentionMT(90, 86400, 3600, 2, 0), aggs, false)
+	a300 := NewAggregator(mockstore, &cache.MockCache{}, test.GetAMKey(1), conf.NewRetentionMT(300, 86400, 3600, 2, 0), aggs, false)
+	if a60.chain(a90) || a90.chained {
+		t.Fatalf("expected a span of 90 not to be chained to a span of 60")
+	}
+	if !a60.chain(a300) || !a300.chained {
+		t.Fatalf("expected a span of 300 to be chained to a span of 60")
+	}
 }
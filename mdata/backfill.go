@@ -0,0 +1,172 @@
+package mdata
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/mdata/chunk/tsz"
+	"github.com/raintank/schema"
+)
+
+// rollupWindows aggregates points into the windows of a span, like an Aggregator, and calls flush for each window.
+// windows that end before start may be incomplete, so they are not flushed. neither is the last window:
+// the rest of its data may be yet to come.
+type rollupWindows struct {
+	span     uint32
+	boundary uint32
+	agg      *Aggregation
+	flush    func(boundary uint32, agg *Aggregation) error
+}
+
+// add adds the point to the aggregation of its window. points must be added in order.
+func (r *rollupWindows) add(ts uint32, val float64, start uint32) error {
+	boundary := AggBoundary(ts, r.span)
+	if boundary != r.boundary {
+		if r.agg.Cnt != 0 && r.boundary+1 >= start+r.span {
+			if err := r.flush(r.boundary, r.agg); err != nil {
+				return err
+			}
+		}
+		r.agg.Reset()
+		r.boundary = boundary
+	}
+	if !math.IsNaN(val) {
+		r.agg.Add(val)
+	}
+	return nil
+}
+
+// aggValue returns the value of the aggregation for the rollup archive of the given method
+func aggValue(agg *Aggregation, method schema.Method) float64 {
+	switch method {
+	case schema.Sum:
+		return agg.Sum
+	case schema.Cnt:
+		return agg.Cnt
+	case schema.Lst:
+		return agg.Lst
+	case schema.Max:
+		return agg.Max
+	case schema.Min:
+		return agg.Min
+	}
+	return 0
+}
+
+// rollupBackfill generates the chunks of the rollup archives of one span
+type rollupBackfill struct {
+	windows  rollupWindows
+	archives []archiveTTL
+	existing []map[uint32]struct{}     // per archive: t0's of the chunks it has already
+	chunks   []map[uint32]*chunk.Chunk // per archive: the generated chunks, by t0
+}
+
+// flush adds the aggregation of the window to the chunks of the archives that don't have it yet
+func (r *rollupBackfill) flush(boundary uint32, agg *Aggregation) error {
+	for i, a := range r.archives {
+		t0 := boundary - (boundary % a.span)
+		if _, ok := r.existing[i][t0]; ok {
+			continue
+		}
+		c, ok := r.chunks[i][t0]
+		if !ok {
+			c = chunk.New(t0)
+			r.chunks[i][t0] = c
+		}
+		if err := c.Push(boundary, aggValue(agg, a.key.Archive.Method())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillRollups generates the chunks of the rollup archives of the series from its raw data in the store,
+// and saves them. chunks that the store or memory have already are left alone, so that it only generates the
+// rollups that are missing, e.g. after they were added to the storage-aggregation rule of the series.
+// it returns the number of saved chunks.
+func (ms *AggMetrics) BackfillRollups(ctx context.Context, key schema.MKey, schemaId, aggId uint16) (int, error) {
+	return ms.backfillRollups(ctx, key, schemaId, aggId, uint32(time.Now().Unix()))
+}
+
+func (ms *AggMetrics) backfillRollups(ctx context.Context, key schema.MKey, schemaId, aggId uint16, now uint32) (int, error) {
+	archives := seriesArchives(key, schemaId, aggId)
+	raw := archives[0]
+	if len(archives) == 1 {
+		return 0, nil
+	}
+
+	var backfills []*rollupBackfill
+	bySpan := make(map[uint32]*rollupBackfill)
+	for _, a := range archives[1:] {
+		existing, err := ms.chunkT0s(ctx, a, now)
+		if err != nil {
+			return 0, err
+		}
+		span := a.key.Archive.Span()
+		r, ok := bySpan[span]
+		if !ok {
+			r = &rollupBackfill{}
+			r.windows = rollupWindows{
+				span:  span,
+				agg:   NewAggregation(),
+				flush: r.flush,
+			}
+			bySpan[span] = r
+			backfills = append(backfills, r)
+		}
+		r.archives = append(r.archives, a)
+		r.existing = append(r.existing, existing)
+		r.chunks = append(r.chunks, make(map[uint32]*chunk.Chunk))
+	}
+
+	itgens, err := ms.searchTTL(ctx, raw, now)
+	if err != nil {
+		return 0, err
+	}
+	if len(itgens) == 0 {
+		return 0, nil
+	}
+	// the windows before the oldest raw chunk may have data we don't have anymore
+	start := itgens[0].T0
+	var last uint32
+	for _, itgen := range itgens {
+		it, err := itgen.Get()
+		if err != nil {
+			return 0, err
+		}
+		for it.Next() {
+			ts, val := it.Values()
+			if ts <= last {
+				continue
+			}
+			last = ts
+			for _, r := range backfills {
+				if err := r.windows.add(ts, val, start); err != nil {
+					tsz.ReleaseIter(it)
+					return 0, err
+				}
+			}
+		}
+		err = it.Err()
+		tsz.ReleaseIter(it)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// the last window is not flushed: the rest of its data may not be saved yet
+
+	var saved int
+	for _, r := range backfills {
+		for i, a := range r.archives {
+			for _, c := range r.chunks[i] {
+				c.Finish()
+				cwr := NewChunkWriteRequest(nil, a.key, c, a.ttl, a.span, time.Now())
+				ms.store.Add(&cwr)
+				saved++
+			}
+		}
+	}
+	return saved, nil
+}
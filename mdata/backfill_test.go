@@ -0,0 +1,94 @@
+package mdata
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestBackfillRollups(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 5, 0), conf.NewRetentionMT(600, 86400, 3600, 2, 0))
+	SetSingleAgg(conf.Avg, conf.Max)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+
+	key := test.GetMKey(1)
+	save := func(key schema.AMKey, t0, span, step uint32, val func(ts uint32) float64) {
+		c := chunk.New(t0)
+		for ts := t0; ts < t0+span; ts += step {
+			c.Push(ts, val(ts))
+		}
+		c.Finish()
+		cwr := NewChunkWriteRequest(nil, key, c, 86400, span, time.Now())
+		mockstore.Add(&cwr)
+	}
+	// raw data from 0 to 7190
+	for t0 := uint32(0); t0 < 7200; t0 += 600 {
+		save(schema.AMKey{MKey: key}, t0, 600, 10, func(ts uint32) float64 { return float64(ts) })
+	}
+	// the max rollup has its second chunk already
+	maxKey := schema.AMKey{MKey: key, Archive: schema.NewArchive(schema.Max, 600)}
+	save(maxKey, 3600, 3600, 600, func(ts uint32) float64 { return -1 })
+
+	saved, err := ms.backfillRollups(test.NewContext(), key, 0, 0, 7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both chunks of sum and cnt, and the first one of max
+	if saved != 5 {
+		t.Fatalf("expected 5 saved chunks, got %d", saved)
+	}
+
+	points := func(key schema.AMKey) []schema.Point {
+		var out []schema.Point
+		itgens, _ := mockstore.Search(test.NewContext(), key, 86400, 0, 7200)
+		sort.Slice(itgens, func(i, j int) bool { return itgens[i].T0 < itgens[j].T0 })
+		for _, itgen := range itgens {
+			it, err := itgen.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for it.Next() {
+				ts, val := it.Values()
+				out = append(out, schema.Point{Val: val, Ts: ts})
+			}
+		}
+		return out
+	}
+	// the window that ends at 0 may be incomplete, and so may the one that ends at 7200
+	var expMax []schema.Point
+	for ts := uint32(600); ts < 3600; ts += 600 {
+		expMax = append(expMax, schema.Point{Val: float64(ts), Ts: ts})
+	}
+	for ts := uint32(3600); ts < 7200; ts += 600 {
+		expMax = append(expMax, schema.Point{Val: -1, Ts: ts})
+	}
+	if got := points(maxKey); !reflect.DeepEqual(expMax, got) {
+		t.Fatalf("max: expected %v, got %v", expMax, got)
+	}
+	cnt := points(schema.AMKey{MKey: key, Archive: schema.NewArchive(schema.Cnt, 600)})
+	if len(cnt) != 11 || cnt[0] != (schema.Point{Val: 60, Ts: 600}) || cnt[10] != (schema.Point{Val: 60, Ts: 6600}) {
+		t.Fatalf("cnt: expected 11 points with a count of 60 from 600 to 6600, got %v", cnt)
+	}
+	sum := points(schema.AMKey{MKey: key, Archive: schema.NewArchive(schema.Sum, 600)})
+	if len(sum) != 11 || sum[0] != (schema.Point{Val: 18300, Ts: 600}) {
+		t.Fatalf("sum: expected 11 points, the first one 18300 at 600, got %v", sum)
+	}
+
+	// it only fills in what is missing
+	saved, err = ms.backfillRollups(test.NewContext(), key, 0, 0, 7200)
+	if err != nil || saved != 0 {
+		t.Fatalf("expected nothing to backfill the second time, got %d, %v", saved, err)
+	}
+}
@@ -0,0 +1,149 @@
+package mdata
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrStoreUnavailable is returned by reads of the store while its circuit breaker is open
+var ErrStoreUnavailable = errors.New("the store is unavailable")
+
+var (
+	// metric store.breaker.state is the state of the circuit breaker of the store: 0 closed, 1 open, 2 half-open (probing)
+	breakerState = stats.NewGauge32("store.breaker.state")
+	// metric store.breaker.trips is counter of how many times the circuit breaker of the store opened
+	breakerTrips = stats.NewCounter32("store.breaker.trips")
+	// metric store.breaker.rejected is counter of store reads rejected because the circuit breaker was open
+	breakerRejected = stats.NewCounter32("store.breaker.rejected")
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerStore is a Store that stops reading from the store it wraps once reads fail,
+// or are slow, too many times in a row, so that queries don't pile up on a sick store.
+// while open, reads fail fast with ErrStoreUnavailable. after openDuration, one read
+// is let through as a probe: if it succeeds, the breaker closes again.
+// writes are not affected: they are queued, and retried by the store itself.
+type breakerStore struct {
+	Store
+	failures     int           // consecutive failed reads that open the breaker
+	slow         time.Duration // reads that take longer count as failed. 0 disables
+	openDuration time.Duration
+
+	sync.Mutex
+	state    int
+	failed   int // consecutive failed reads while closed
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreakerStore wraps the store with a circuit breaker
+func NewBreakerStore(store Store, failures int, slow, openDuration time.Duration) Store {
+	breakerState.Set(breakerClosed)
+	return &breakerStore{
+		Store:        store,
+		failures:     failures,
+		slow:         slow,
+		openDuration: openDuration,
+	}
+}
+
+// allow returns whether a read may go to the store
+func (b *breakerStore) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.openDuration {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// done records the outcome of a read that was allowed.
+// canceled reads tell us nothing about the store: they don't count either way
+func (b *breakerStore) done(err error, duration time.Duration, now time.Time) {
+	canceled := err == context.Canceled || err == context.DeadlineExceeded
+	failed := err != nil || (b.slow > 0 && duration > b.slow)
+	b.Lock()
+	defer b.Unlock()
+	if canceled {
+		b.probing = false
+		return
+	}
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			log.Warnf("store breaker: probe of the store failed, keeping it open for another %s. err: %v", b.openDuration, err)
+			b.openedAt = now
+			b.setState(breakerOpen)
+		} else {
+			log.Info("store breaker: probe of the store succeeded, closing the breaker")
+			b.failed = 0
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	if !failed {
+		b.failed = 0
+		return
+	}
+	b.failed++
+	if b.state == breakerClosed && b.failed >= b.failures {
+		log.Warnf("store breaker: %d reads of the store in a row failed or were too slow, opening the breaker for %s. last err: %v", b.failed, b.openDuration, err)
+		breakerTrips.Inc()
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+// setState sets the state. the lock must be held
+func (b *breakerStore) setState(state int) {
+	b.state = state
+	breakerState.Set(state)
+}
+
+func (b *breakerStore) Search(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
+	if !b.allow(time.Now()) {
+		breakerRejected.Inc()
+		return nil, ErrStoreUnavailable
+	}
+	pre := time.Now()
+	itgens, err := b.Store.Search(ctx, key, ttl, start, end)
+	b.done(err, time.Since(pre), time.Now())
+	return itgens, err
+}
+
+func (b *breakerStore) Stats() StoreStats {
+	stats := b.Store.Stats()
+	b.Lock()
+	switch b.state {
+	case breakerClosed:
+		stats.Breaker = "closed"
+	case breakerOpen:
+		stats.Breaker = "open"
+	case breakerHalfOpen:
+		stats.Breaker = "half-open"
+	}
+	b.Unlock()
+	return stats
+}
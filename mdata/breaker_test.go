@@ -0,0 +1,88 @@
+package mdata
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/raintank/schema"
+)
+
+// flakyStore is a store of which reads fail while err is set
+type flakyStore struct {
+	*MockStore
+	err   error
+	reads int
+}
+
+func (f *flakyStore) Search(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
+	f.reads++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.MockStore.Search(ctx, key, ttl, start, end)
+}
+
+func TestBreakerStore(t *testing.T) {
+	flaky := &flakyStore{MockStore: NewMockStore()}
+	b := NewBreakerStore(flaky, 3, 0, time.Minute).(*breakerStore)
+	key := schema.AMKey{}
+	now := time.Now()
+	search := func(now time.Time) error {
+		if !b.allow(now) {
+			return ErrStoreUnavailable
+		}
+		_, err := flaky.Search(context.Background(), key, 0, 0, 1)
+		b.done(err, 0, now)
+		return err
+	}
+
+	flaky.err = errors.New("timeout")
+	for i := 0; i < 3; i++ {
+		if err := search(now); err != flaky.err {
+			t.Fatalf("read %d: expected the error of the store, got %v", i, err)
+		}
+	}
+	if err := search(now); err != ErrStoreUnavailable || flaky.reads != 3 {
+		t.Fatalf("expected the breaker to be open after 3 failed reads, got %v and %d reads", err, flaky.reads)
+	}
+	if got := b.Stats().Breaker; got != "open" {
+		t.Fatalf("expected the breaker state to be open, got %q", got)
+	}
+
+	// after the open duration, one read probes the store. it fails, so the breaker stays open
+	now = now.Add(time.Minute)
+	if err := search(now); err != flaky.err {
+		t.Fatalf("expected the probe to reach the store, got %v", err)
+	}
+	if err := search(now); err != ErrStoreUnavailable {
+		t.Fatalf("expected the breaker to open again after a failed probe, got %v", err)
+	}
+
+	// the next probe succeeds, and closes the breaker
+	flaky.err = nil
+	now = now.Add(time.Minute)
+	if !b.allow(now) {
+		t.Fatal("expected a probe to be allowed")
+	}
+	if b.allow(now) {
+		t.Fatal("expected only 1 probe at a time")
+	}
+	b.done(nil, 0, now)
+	if err := search(now); err != nil {
+		t.Fatalf("expected the breaker to be closed after a successful probe, got %v", err)
+	}
+
+	// slow reads count as failed, canceled reads don't
+	b.slow = time.Second
+	for i := 0; i < 2; i++ {
+		b.done(nil, 2*time.Second, now)
+	}
+	b.done(context.Canceled, 0, now)
+	b.done(nil, 2*time.Second, now)
+	if got := b.Stats().Breaker; got != "open" {
+		t.Fatalf("expected 3 slow reads to open the breaker, got %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+package mdata
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// metric tank.evictions is the number of times metrics were evicted from memory because the memory budget was exceeded
+	evictions = stats.NewCounter32("tank.evictions")
+
+	// metric tank.evicted_metrics is the number of metrics (series) that were evicted from memory because the memory budget was exceeded
+	evictedMetrics = stats.NewCounter32("tank.evicted_metrics")
+)
+
+const (
+	// how often to compare the heap size to the memory budget
+	budgetCheckInterval = 10 * time.Second
+
+	// when evicting, we aim to get back to this fraction of the budget, so that we don't have to evict again right away
+	budgetTarget = 0.9
+)
+
+// EnforceMemoryBudget periodically checks the size of the heap, and when it exceeds budget (in bytes),
+// evicts the metrics that were written to least recently, after saving their unsaved chunks.
+func (ms *AggMetrics) EnforceMemoryBudget(budget uint64) {
+	go func() {
+		ticker := time.NewTicker(budgetCheckInterval)
+		for range ticker.C {
+			ms.checkMemoryBudget(budget)
+		}
+	}()
+}
+
+func (ms *AggMetrics) checkMemoryBudget(budget uint64) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	if memStats.HeapAlloc <= budget {
+		return
+	}
+	// part of the heap may be garbage. only evict if we're still over budget once it's collected.
+	runtime.GC()
+	runtime.ReadMemStats(&memStats)
+	if memStats.HeapAlloc <= budget {
+		return
+	}
+	// we don't know how much memory each metric takes, so assume they all take the same.
+	heap := float64(memStats.HeapAlloc)
+	fraction := (heap - budgetTarget*float64(budget)) / heap
+	pre := time.Now()
+	n := ms.evictColdest(fraction)
+	log.Warnf("heap size %d exceeds memory budget %d. evicted %d metrics in %s", memStats.HeapAlloc, budget, n, time.Since(pre))
+}
+
+// evictColdest evicts the given fraction of the metrics, those that were written to least recently first,
+// and returns how many were evicted.
+func (ms *AggMetrics) evictColdest(fraction float64) int {
+	type candidate struct {
+		key       schema.MKey
+		m         *AggMetric
+		lastWrite uint32
+	}
+	var candidates []candidate
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		m.RLock()
+		candidates = append(candidates, candidate{key, m, m.lastWrite})
+		m.RUnlock()
+		return true
+	})
+	n := int(math.Ceil(float64(len(candidates)) * fraction))
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastWrite < candidates[j].lastWrite
+	})
+	for _, c := range candidates[:n] {
+		c.m.evict()
+		ms.shard(c.key).remove(c.key)
+	}
+	evictions.Inc()
+	evictedMetrics.Add(n)
+	return n
+}
@@ -0,0 +1,52 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestEvictColdest(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 5, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 4, 0, 0, 0)
+
+	for i := 0; i < 4; i++ {
+		m := getOrCreate(ms, test.GetMKey(i))
+		m.Add(1000, 1)
+		// metrics 0 and 2 are the coldest
+		m.lastWrite = uint32(100 + (i%2)*100 + i)
+	}
+
+	if n := ms.evictColdest(0.5); n != 2 {
+		t.Fatalf("expected 2 metrics to be evicted, got %d", n)
+	}
+	for i := 0; i < 4; i++ {
+		_, ok := ms.Get(test.GetMKey(i))
+		if ok != (i%2 == 1) {
+			t.Fatalf("metric %d: expected to be in memory %t, got %t", i, i%2 == 1, ok)
+		}
+	}
+	// the current chunks of the evicted metrics must have been saved
+	for _, i := range []int{0, 2} {
+		itgens, err := mockstore.Search(test.NewContext(), schema.AMKey{MKey: test.GetMKey(i)}, 0, 0, 2000)
+		if err != nil {
+			t.Fatalf("metric %d: %s", i, err)
+		}
+		if len(itgens) != 1 || itgens[0].T0 != 600 {
+			t.Fatalf("metric %d: expected chunk 600 to be saved, got %v", i, itgens)
+		}
+	}
+	if mockstore.Items() != 2 {
+		t.Fatalf("expected 2 chunks to be saved, got %d", mockstore.Items())
+	}
+}
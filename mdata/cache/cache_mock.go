@@ -13,6 +13,7 @@ type MockCache struct {
 	AddCount          int
 	AddIfHotCount     int
 	AddIfHotCb        func()
+	ReplaceCount      int
 	StopCount         int
 	SearchCount       int
 	DelMetricArchives int
@@ -46,6 +47,12 @@ func (mc *MockCache) AddIfHot(metric schema.AMKey, prev uint32, itergen chunk.It
 	}
 }
 
+func (mc *MockCache) ReplaceIfCached(metric schema.AMKey, itergen chunk.IterGen) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.ReplaceCount++
+}
+
 func (mc *MockCache) Stop() {
 	mc.Lock()
 	defer mc.Unlock()
@@ -145,6 +145,20 @@ func (c *CCache) AddIfHot(metric schema.AMKey, prev uint32, itergen chunk.IterGe
 	met.Add(prev, itergen)
 }
 
+// ReplaceIfCached replaces the cached chunk with the same T0 as the given chunk, if any.
+// the accounting keeps the size of the original chunk.
+func (c *CCache) ReplaceIfCached(metric schema.AMKey, itergen chunk.IterGen) {
+	if c == nil {
+		return
+	}
+	c.RLock()
+	met, ok := c.metricCache[metric]
+	c.RUnlock()
+	if ok {
+		met.Replace(itergen)
+	}
+}
+
 func (c *CCache) Add(metric schema.AMKey, prev uint32, itergen chunk.IterGen) {
 	if c == nil {
 		return
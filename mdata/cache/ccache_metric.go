@@ -190,6 +190,15 @@ func (mc *CCacheMetric) AddRange(prev uint32, itergens []chunk.IterGen) {
 	return
 }
 
+// Replace replaces the chunk with the same T0 as the given chunk, if present
+func (mc *CCacheMetric) Replace(itergen chunk.IterGen) {
+	mc.Lock()
+	defer mc.Unlock()
+	if c, ok := mc.chunks[itergen.T0]; ok {
+		c.Itgen = itergen
+	}
+}
+
 // Add adds a chunk to the cache
 func (mc *CCacheMetric) Add(prev uint32, itergen chunk.IterGen) {
 	ts := itergen.T0
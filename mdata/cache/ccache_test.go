@@ -95,6 +95,32 @@ func TestAddIfHotWithoutPrevTsOnHotMetric(t *testing.T) {
 	}
 }
 
+// test that ReplaceIfCached replaces cached chunks, but doesn't add others
+func TestReplaceIfCached(t *testing.T) {
+	metric := test.GetAMKey(1)
+	cc := getConnectedChunks(t, metric)
+
+	replacement := getItgen(t, []uint32{6, 7, 8, 9, 10}, 1005, false)
+	cc.ReplaceIfCached(metric, replacement)
+	cc.ReplaceIfCached(metric, getItgen(t, []uint32{6, 7, 8, 9, 10}, 1025, false))
+	cc.ReplaceIfCached(test.GetAMKey(2), replacement)
+
+	mc := cc.metricCache[metric]
+	if len(mc.chunks) != 5 {
+		t.Fatalf("expected 5 cached chunks, got %d", len(mc.chunks))
+	}
+	chunk := mc.chunks[1005]
+	if !bytes.Equal(chunk.Itgen.B, replacement.B) {
+		t.Fatalf("expected chunk 1005 to be replaced")
+	}
+	if chunk.Prev != 1000 || chunk.Next != 1010 {
+		t.Fatalf("expected the replaced chunk to keep its neighbours, got prev %d, next %d", chunk.Prev, chunk.Next)
+	}
+	if _, ok := cc.metricCache[test.GetAMKey(2)]; ok {
+		t.Fatalf("expected uncached metric not to be added")
+	}
+}
+
 // test AddIfHot method without passing a previous timestamp on a cold metric
 func TestAddIfHotWithoutPrevTsOnColdMetric(t *testing.T) {
 	metric := test.GetAMKey(1)
@@ -19,6 +19,7 @@ type Cache interface {
 
 type CachePusher interface {
 	AddIfHot(metric schema.AMKey, prev uint32, itergen chunk.IterGen)
+	ReplaceIfCached(metric schema.AMKey, itergen chunk.IterGen)
 }
 
 type CCSearchResult struct {
@@ -19,6 +19,7 @@ type Chunk struct {
 	Series    tsz.SeriesLong
 	NumPoints uint32
 	First     bool
+	End       uint32 // if not 0, the chunk was rolled over before the end of its chunkspan: the next chunk starts at End. see mdata.AggMetric
 }
 
 func New(t0 uint32) *Chunk {
@@ -35,7 +36,7 @@ func NewFirst(t0 uint32) *Chunk {
 }
 
 func (c *Chunk) String() string {
-	return fmt.Sprintf("<chunk T0=%d, LastTs=%d, NumPoints=%d, First=%t, Closed=%t>", c.Series.T0, c.Series.T, c.NumPoints, c.First, c.Series.Finished)
+	return fmt.Sprintf("<chunk T0=%d, LastTs=%d, NumPoints=%d, First=%t, Closed=%t, End=%d>", c.Series.T0, c.Series.T, c.NumPoints, c.First, c.Series.Finished, c.End)
 }
 
 func (c *Chunk) Push(t uint32, v float64) error {
@@ -51,10 +52,30 @@ func (c *Chunk) Finish() {
 	c.Series.Finish()
 }
 
-// Encode encodes the chunk
+// Encode encodes the chunk in DefaultFormat, or in FormatGoTszLongWithLengthCRC if the span is not a valid chunkspan,
+// which is the case for chunks that were rolled over before the end of their chunkspan.
 // note: chunks don't know their own span, the caller/owner manages that,
 // so for formats that encode it, it needs to be passed in.
 // the returned value contains no references to the chunk. data is copied.
 func (c *Chunk) Encode(span uint32) []byte {
-	return encode(span, FormatGoTszLongWithSpan, c.Series.Bytes())
+	format := DefaultFormat
+	if _, ok := RevChunkSpans[span]; !ok {
+		format = FormatGoTszLongWithLengthCRC
+	}
+	// these codecs re-use the bytes of our series, which can't fail.
+	buf, _ := codecs[format].Encode(c, span)
+	return buf
+}
+
+// EncodeAs encodes the chunk in the given format, using its registered Codec.
+// This is used to keep writing older formats while a cluster migrates to a new one.
+// for FormatStandardGoTsz and FormatStandardGoTszWithSpan the data is re-encoded,
+// which is more expensive than Encode.
+// formats that encode the span as a span code return an error for spans that are not a valid chunkspan.
+func (c *Chunk) EncodeAs(span uint32, format Format) ([]byte, error) {
+	codec, err := GetCodec(format)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Encode(c, span)
 }
@@ -81,3 +81,184 @@ func equal(exp, got []schema.Point) bool {
 	}
 	return true
 }
+
+func TestEncodeAs(t *testing.T) {
+	t0 := uint32(1541332800)
+	span := uint32(2 * 60 * 60)
+	c := New(t0)
+	for i := uint32(1); i <= 100; i++ {
+		val := float64(i) * 1.5
+		if i == 50 {
+			val = math.NaN()
+		}
+		c.Push(t0+i*60, val)
+	}
+	c.Finish()
+	current, err := NewIterGen(t0, 60, c.Encode(span))
+	if err != nil {
+		t.Fatalf("could not construct itergen: %s", err)
+	}
+
+	for _, format := range []Format{FormatStandardGoTsz, FormatStandardGoTszWithSpan, FormatGoTszLongWithSpan, FormatGoTszLongWithSpanCRC, FormatGoTszLongWithLengthCRC} {
+		data, err := c.EncodeAs(span, format)
+		if err != nil {
+			t.Fatalf("%s: could not encode: %s", format, err)
+		}
+		itgen, err := NewIterGen(t0, 60, data)
+		if err != nil {
+			t.Fatalf("%s: could not construct itergen: %s", format, err)
+		}
+		if itgen.Format() != format {
+			t.Fatalf("%s: encoded as format %s", format, itgen.Format())
+		}
+		if err := Compare(current, itgen); err != nil {
+			t.Fatalf("%s: expected the same points as the current format, got %s", format, err)
+		}
+	}
+
+	other := New(t0)
+	for i := uint32(1); i <= 99; i++ {
+		other.Push(t0+i*60, float64(i)*1.5)
+	}
+	other.Finish()
+	otherItgen, err := NewIterGen(t0, 60, other.Encode(span))
+	if err != nil {
+		t.Fatalf("could not construct itergen: %s", err)
+	}
+	if err := Compare(current, otherItgen); err == nil {
+		t.Fatalf("expected chunks with different points to not match")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	t0 := uint32(1541332800)
+	span := uint32(2 * 60 * 60)
+	c := New(t0)
+	for i := uint32(1); i <= 100; i++ {
+		c.Push(t0+i*60, float64(i)*1.5)
+	}
+	c.Finish()
+	data, err := c.EncodeAs(span, FormatGoTszLongWithSpanCRC)
+	if err != nil {
+		t.Fatalf("could not encode chunk: %s", err)
+	}
+	itgen, err := NewIterGen(t0, 60, data)
+	if err != nil {
+		t.Fatalf("could not construct itergen: %s", err)
+	}
+	if itgen.Format() != FormatGoTszLongWithSpanCRC {
+		t.Fatalf("expected chunks to be encoded as %s, got %s", FormatGoTszLongWithSpanCRC, itgen.Format())
+	}
+	iter, err := itgen.Get()
+	if err != nil {
+		t.Fatalf("could not get iterator: %s", err)
+	}
+	var n int
+	for iter.Next() {
+		n++
+	}
+	if n != 100 || iter.Err() != nil {
+		t.Fatalf("expected 100 points and no error, got %d and %v", n, iter.Err())
+	}
+
+	// flipping any bit of the data or the checksum must be detected
+	mismatches := checksumMismatch.Peek()
+	for _, pos := range []int{2, len(data) / 2, len(data) - 5, len(data) - 1} {
+		corrupt := make([]byte, len(data))
+		copy(corrupt, data)
+		corrupt[pos] ^= 0x10
+		if _, err := NewIterGen(t0, 60, corrupt); err != ErrChecksumMismatch {
+			t.Fatalf("byte %d: expected %q, got %v", pos, ErrChecksumMismatch, err)
+		}
+	}
+	if got := checksumMismatch.Peek() - mismatches; got != 4 {
+		t.Fatalf("expected 4 checksum mismatches to be counted, got %d", got)
+	}
+}
+
+func TestEncodeRolledOver(t *testing.T) {
+	// a chunk that starts within its chunkspan, because the chunk before it was rolled over
+	t0 := uint32(1541332800 + 100*60 + 30)
+	span := uint32(2*60*60 - 100*60 - 30)
+	c := New(t0)
+	for i := uint32(0); i < 20; i++ {
+		c.Push(t0+i*60, float64(i))
+	}
+	c.Finish()
+	itgen, err := NewIterGen(t0, 60, c.Encode(span))
+	if err != nil {
+		t.Fatalf("could not construct itergen: %s", err)
+	}
+	if itgen.Format() != FormatGoTszLongWithLengthCRC {
+		t.Fatalf("expected a chunk that doesn't span a chunkspan to be encoded as %s, got %s", FormatGoTszLongWithLengthCRC, itgen.Format())
+	}
+	if itgen.Span() != span || itgen.EndTs() != 1541332800+2*60*60 {
+		t.Fatalf("expected span %d, got %d", span, itgen.Span())
+	}
+	// formats with a span code can't encode it
+	for _, format := range []Format{FormatStandardGoTszWithSpan, FormatGoTszLongWithSpan, FormatGoTszLongWithSpanCRC} {
+		if _, err := c.EncodeAs(span, format); err == nil {
+			t.Fatalf("%s: expected an error for span %d", format, span)
+		}
+	}
+}
+
+// testCodec stores chunks like FormatGoTszLongWithSpan, under a format of its own
+type testCodec struct {
+	seriesLongCodec
+}
+
+func (t testCodec) Format() Format {
+	return Format(200)
+}
+
+func (t testCodec) Encode(c *Chunk, span uint32) ([]byte, error) {
+	buf, err := t.seriesLongCodec.Encode(c, span)
+	buf[0] = byte(t.Format())
+	return buf, err
+}
+
+func TestRegisterCodec(t *testing.T) {
+	t0 := uint32(1541332800)
+	span := uint32(2 * 60 * 60)
+	c := New(t0)
+	for i := uint32(1); i <= 100; i++ {
+		c.Push(t0+i*60, float64(i)*1.5)
+	}
+	c.Finish()
+	if _, err := c.EncodeAs(span, Format(200)); err != errUnknownChunkFormat {
+		t.Fatalf("expected %q for a format without codec, got %v", errUnknownChunkFormat, err)
+	}
+
+	RegisterCodec(testCodec{seriesLongCodec{format: FormatGoTszLongWithSpan}})
+	defer delete(codecs, Format(200))
+
+	data, err := c.EncodeAs(span, Format(200))
+	if err != nil {
+		t.Fatalf("could not encode: %s", err)
+	}
+	itgen, err := NewIterGen(t0, 60, data)
+	if err != nil {
+		t.Fatalf("could not construct itergen: %s", err)
+	}
+	if itgen.Span() != span {
+		t.Fatalf("expected span %d, got %d", span, itgen.Span())
+	}
+	current, err := NewIterGen(t0, 60, c.Encode(span))
+	if err != nil {
+		t.Fatalf("could not construct itergen: %s", err)
+	}
+	if err := Compare(current, itgen); err != nil {
+		t.Fatalf("expected the same points as the current format, got %s", err)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("FormatStandardGoTszWithSpan")
+	if err != nil || f != FormatStandardGoTszWithSpan {
+		t.Fatalf("expected FormatStandardGoTszWithSpan, got %s, %v", f, err)
+	}
+	if _, err := ParseFormat("FormatUnknown"); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+}
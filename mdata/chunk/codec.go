@@ -0,0 +1,223 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/grafana/metrictank/mdata/chunk/tsz"
+)
+
+// Codec encodes chunks into, and decodes them from, the binary representation of a Format.
+// the encoded data always starts with the format byte, so that chunks of any format can be told apart,
+// and chunks written in older formats remain readable.
+// to introduce a new encoding, add a Format, implement a Codec for it and register it with RegisterCodec.
+type Codec interface {
+	// Format returns the format the codec encodes into
+	Format() Format
+	// Encode encodes the points of the finished chunk, which spans span seconds.
+	// the returned value contains no references to the chunk.
+	Encode(c *Chunk, span uint32) ([]byte, error)
+	// Validate performs crude validation of the encoded data, so that corruption is detected before reading it.
+	Validate(b []byte) error
+	// Span returns the chunkspan encoded in the (validated) data, or 0 if the format doesn't encode it
+	Span(b []byte) uint32
+	// Iter returns an iterator over the points of the (validated) data of the chunk starting at t0.
+	// the iterator may read the data in place, so it must not be modified while the iterator is in use.
+	// intervalHint is a hint wrt the expected alignment of the points, which some formats need to recover from corruption
+	Iter(t0, intervalHint uint32, b []byte) (tsz.Iter, error)
+}
+
+var codecs = make(map[Format]Codec)
+
+// DefaultFormat is the format that Chunk.Encode encodes into. see SetDefaultFormat
+var DefaultFormat = FormatGoTszLongWithSpan
+
+func init() {
+	RegisterCodec(series4hCodec{format: FormatStandardGoTsz})
+	RegisterCodec(series4hCodec{format: FormatStandardGoTszWithSpan, withSpan: true})
+	RegisterCodec(seriesLongCodec{format: FormatGoTszLongWithSpan})
+	RegisterCodec(seriesLongCodec{format: FormatGoTszLongWithSpanCRC, withCRC: true})
+	RegisterCodec(seriesLongCodec{format: FormatGoTszLongWithLengthCRC, withCRC: true, withLength: true})
+}
+
+// RegisterCodec makes the codec available for its format. it must be called at init time.
+func RegisterCodec(c Codec) {
+	if _, ok := codecs[c.Format()]; ok {
+		panic(fmt.Sprintf("codec for chunk format %s registered twice", c.Format()))
+	}
+	codecs[c.Format()] = c
+}
+
+// SetDefaultFormat sets the format that Chunk.Encode encodes into. it must be called before any chunks are encoded.
+// only FormatGoTszLongWithSpan and FormatGoTszLongWithSpanCRC are supported, because the other formats re-encode the data.
+// nodes running versions that don't know a format can't read chunks written in it,
+// so only switch to a newer format once all nodes of the cluster can read it.
+func SetDefaultFormat(format Format) error {
+	if format != FormatGoTszLongWithSpan && format != FormatGoTszLongWithSpanCRC {
+		return fmt.Errorf("chunks can't be written in format %s by default", format)
+	}
+	DefaultFormat = format
+	return nil
+}
+
+// GetCodec returns the codec for the given format
+func GetCodec(format Format) (Codec, error) {
+	c, ok := codecs[format]
+	if !ok {
+		return nil, errUnknownChunkFormat
+	}
+	return c, nil
+}
+
+// header returns the format byte, followed by the span code if withSpan is true
+// it returns an error if the span is not a valid chunk span: that's better than persisting the chunk with a wrong length.
+func header(format Format, span uint32, withSpan bool) ([]byte, error) {
+	if !withSpan {
+		return []byte{byte(format)}, nil
+	}
+	spanCode, ok := RevChunkSpans[span]
+	if !ok {
+		return nil, fmt.Errorf("chunk span %d can't be encoded in format %s", span, format)
+	}
+	return []byte{byte(format), byte(spanCode)}, nil
+}
+
+// validateHeader checks that the data is long enough to hold the header, a body and the given trailer, and that the span code is valid
+func validateHeader(b []byte, withSpan bool, trailerLen int) error {
+	headerLen := 1
+	if withSpan {
+		headerLen = 2
+	}
+	if len(b) <= headerLen+trailerLen {
+		return errShort
+	}
+	if withSpan && int(b[1]) >= len(ChunkSpans) {
+		return errUnknownSpanCode
+	}
+	return nil
+}
+
+// series4hCodec encodes chunks as tsz.Series4h: FormatStandardGoTsz and FormatStandardGoTszWithSpan
+// our chunks hold a tsz.SeriesLong, so encoding re-encodes the points, which is relatively expensive.
+type series4hCodec struct {
+	format   Format
+	withSpan bool
+}
+
+func (s series4hCodec) Format() Format {
+	return s.format
+}
+
+func (s series4hCodec) Encode(c *Chunk, span uint32) ([]byte, error) {
+	it := c.Series.Iter()
+	series := tsz.NewSeries4h(c.Series.T0)
+	for it.Next() {
+		series.Push(it.Values())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	series.Finish()
+	buf, err := header(s.format, span, s.withSpan)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, series.Bytes()...), nil
+}
+
+func (s series4hCodec) Validate(b []byte) error {
+	return validateHeader(b, s.withSpan, 0)
+}
+
+func (s series4hCodec) Span(b []byte) uint32 {
+	if !s.withSpan {
+		return 0 // we don't know what the span is. sorry.
+	}
+	return ChunkSpans[SpanCode(b[1])]
+}
+
+func (s series4hCodec) Iter(t0, intervalHint uint32, b []byte) (tsz.Iter, error) {
+	// note: the tsz iterators read the data in place, without modifying it.
+	if s.withSpan {
+		return tsz.NewIterator4h(b[2:], intervalHint)
+	}
+	return tsz.NewIterator4h(b[1:], intervalHint)
+}
+
+// seriesLongCodec encodes chunks as tsz.SeriesLong, with the span and optionally a checksum:
+// FormatGoTszLongWithSpan, FormatGoTszLongWithSpanCRC and FormatGoTszLongWithLengthCRC
+type seriesLongCodec struct {
+	format     Format
+	withCRC    bool
+	withLength bool // the span is encoded as a number of seconds, rather than as a span code
+}
+
+const (
+	// crcLen is the length of the checksum at the end of chunks in FormatGoTszLongWithSpanCRC and FormatGoTszLongWithLengthCRC
+	crcLen = 4
+	// lengthLen is the length of the span in chunks in FormatGoTszLongWithLengthCRC
+	lengthLen = 4
+)
+
+func (s seriesLongCodec) Format() Format {
+	return s.format
+}
+
+// headerLen returns the length of the format byte and the span
+func (s seriesLongCodec) headerLen() int {
+	if s.withLength {
+		return 1 + lengthLen
+	}
+	return 2
+}
+
+func (s seriesLongCodec) Encode(c *Chunk, span uint32) ([]byte, error) {
+	data := c.Series.Bytes()
+	buf := make([]byte, 0, s.headerLen()+len(data)+crcLen)
+	if s.withLength {
+		buf = append(buf, byte(s.format), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buf[1:], span)
+	} else {
+		hdr, err := header(s.format, span, true)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, hdr...)
+	}
+	buf = append(buf, data...)
+	if s.withCRC {
+		buf = buf[:len(buf)+crcLen]
+		binary.LittleEndian.PutUint32(buf[len(buf)-crcLen:], Checksum(buf[:len(buf)-crcLen]))
+	}
+	return buf, nil
+}
+
+func (s seriesLongCodec) Validate(b []byte) error {
+	if !s.withCRC {
+		return validateHeader(b, true, 0)
+	}
+	if s.withLength {
+		if len(b) <= s.headerLen()+crcLen {
+			return errShort
+		}
+	} else if err := validateHeader(b, true, crcLen); err != nil {
+		return err
+	}
+	data := b[:len(b)-crcLen]
+	return VerifyChecksum(data, binary.LittleEndian.Uint32(b[len(data):]))
+}
+
+func (s seriesLongCodec) Span(b []byte) uint32 {
+	if s.withLength {
+		return binary.LittleEndian.Uint32(b[1:])
+	}
+	return ChunkSpans[SpanCode(b[1])]
+}
+
+func (s seriesLongCodec) Iter(t0, intervalHint uint32, b []byte) (tsz.Iter, error) {
+	// note: the tsz iterators read the data in place, without modifying it.
+	if s.withCRC {
+		return tsz.NewIteratorLong(t0, b[s.headerLen():len(b)-crcLen])
+	}
+	return tsz.NewIteratorLong(t0, b[s.headerLen():])
+}
@@ -1,5 +1,7 @@
 package chunk
 
+import "fmt"
+
 // this exists so that we can later add more formats, perhaps for int/uint/float32/bool specific optimisations, or other encoding/decoding/compression algorithms
 // and have an easy time distinguishing the binary blobs
 
@@ -11,5 +13,17 @@ type Format uint8
 const (
 	FormatStandardGoTsz Format = iota
 	FormatStandardGoTszWithSpan
-	FormatGoTszLongWithSpan // like FormatStandardGoTszWithSpan but using tsz.SeriesLong
+	FormatGoTszLongWithSpan      // like FormatStandardGoTszWithSpan but using tsz.SeriesLong
+	FormatGoTszLongWithSpanCRC   // like FormatGoTszLongWithSpan, followed by a CRC-32 of the preceding bytes
+	FormatGoTszLongWithLengthCRC // like FormatGoTszLongWithSpanCRC, but with the span as a number of seconds, for chunks that don't span a whole chunkspan
 )
+
+// ParseFormat parses the name of a format, as returned by Format.String()
+func ParseFormat(s string) (Format, error) {
+	for f := FormatStandardGoTsz; f <= FormatGoTszLongWithLengthCRC; f++ {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown chunk format %q", s)
+}
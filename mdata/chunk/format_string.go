@@ -4,9 +4,9 @@ package chunk
 
 import "strconv"
 
-const _Format_name = "FormatStandardGoTszFormatStandardGoTszWithSpanFormatGoTszLongWithSpan"
+const _Format_name = "FormatStandardGoTszFormatStandardGoTszWithSpanFormatGoTszLongWithSpanFormatGoTszLongWithSpanCRCFormatGoTszLongWithLengthCRC"
 
-var _Format_index = [...]uint8{0, 19, 46, 69}
+var _Format_index = [...]uint8{0, 19, 46, 69, 95, 123}
 
 func (i Format) String() string {
 	if i >= Format(len(_Format_index)-1) {
@@ -2,16 +2,34 @@ package chunk
 
 import (
 	"errors"
+	"fmt"
+	"math"
 
 	"github.com/grafana/metrictank/mdata/chunk/tsz"
+	"github.com/grafana/metrictank/stats"
 )
 
 var (
 	errUnknownChunkFormat = errors.New("unrecognized chunk format")
 	errUnknownSpanCode    = errors.New("corrupt data, chunk span code is not known")
 	errShort              = errors.New("chunk is too short")
+
+	// ErrChecksumMismatch is returned for chunks of which the data doesn't match their checksum
+	ErrChecksumMismatch = errors.New("corrupt data, chunk checksum does not match")
+
+	// metric chunk.checksum_mismatch is the number of chunks that were found to be corrupt because their data doesn't match their checksum
+	checksumMismatch = stats.NewCounter32("chunk.checksum_mismatch")
 )
 
+// VerifyChecksum returns ErrChecksumMismatch if the data doesn't match the checksum, and counts the mismatch.
+func VerifyChecksum(data []byte, sum uint32) error {
+	if Checksum(data) != sum {
+		checksumMismatch.Inc()
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
 //go:generate msgp
 type IterGen struct {
 	T0           uint32
@@ -23,22 +41,16 @@ type IterGen struct {
 // note: it's ok for intervalHint to be 0 or 1 to mean unknown.
 // it just means that series4h corruptions can't be remediated in single-point-per-chunk scenarios
 func NewIterGen(t0, intervalHint uint32, b []byte) (IterGen, error) {
-	switch Format(b[0]) {
-	case FormatStandardGoTsz:
-		if len(b) == 1 {
-			return IterGen{}, errShort
-		}
-	case FormatStandardGoTszWithSpan, FormatGoTszLongWithSpan:
-		if len(b) <= 2 {
-			return IterGen{}, errShort
-		}
-		if int(b[1]) >= len(ChunkSpans) {
-			return IterGen{}, errUnknownSpanCode
-		}
-	default:
-		return IterGen{}, errUnknownChunkFormat
+	if len(b) == 0 {
+		return IterGen{}, errShort
+	}
+	codec, err := GetCodec(Format(b[0]))
+	if err != nil {
+		return IterGen{}, err
+	}
+	if err := codec.Validate(b); err != nil {
+		return IterGen{}, err
 	}
-
 	return IterGen{t0, intervalHint, b}, nil
 }
 
@@ -46,34 +58,19 @@ func (ig IterGen) Format() Format {
 	return Format(ig.B[0])
 }
 
+// Get returns an iterator over the points of the chunk.
+// the iterator reads the chunk data in place, and may be passed to tsz.ReleaseIter once done with it.
 func (ig *IterGen) Get() (tsz.Iter, error) {
-	// note: the tsz iterators modify the stream as they read it, so we must always give it a copy.
-	switch ig.Format() {
-	case FormatStandardGoTsz:
-		src := ig.B[1:]
-		dest := make([]byte, len(src))
-		copy(dest, src)
-		return tsz.NewIterator4h(dest, ig.IntervalHint)
-	case FormatStandardGoTszWithSpan:
-		src := ig.B[2:]
-		dest := make([]byte, len(src))
-		copy(dest, src)
-		return tsz.NewIterator4h(dest, ig.IntervalHint)
-	case FormatGoTszLongWithSpan:
-		src := ig.B[2:]
-		dest := make([]byte, len(src))
-		copy(dest, src)
-		return tsz.NewIteratorLong(ig.T0, dest)
+	codec, err := GetCodec(ig.Format())
+	if err != nil {
+		return nil, err
 	}
-	return nil, errUnknownChunkFormat
+	return codec.Iter(ig.T0, ig.IntervalHint, ig.B)
 }
 
 func (ig *IterGen) Span() uint32 {
-	if ig.Format() == FormatStandardGoTsz {
-		return 0 // we don't know what the span is. sorry.
-	}
-	// already validated at IterGen creation time
-	return ChunkSpans[SpanCode(ig.B[1])]
+	// the format and the data were already validated at IterGen creation time
+	return codecs[ig.Format()].Span(ig.B)
 }
 
 func (ig *IterGen) Size() uint64 {
@@ -85,6 +82,40 @@ func (ig IterGen) EndTs() uint32 {
 	return ig.T0 + ig.Span()
 }
 
+// Compare decodes both chunks and returns an error describing the first
+// difference between their points, or nil if they contain the same points.
+func Compare(a, b IterGen) error {
+	itA, err := a.Get()
+	if err != nil {
+		return err
+	}
+	defer tsz.ReleaseIter(itA)
+	itB, err := b.Get()
+	if err != nil {
+		return err
+	}
+	defer tsz.ReleaseIter(itB)
+	for i := 0; ; i++ {
+		nextA, nextB := itA.Next(), itB.Next()
+		if nextA != nextB {
+			return fmt.Errorf("point count differs after %d points", i)
+		}
+		if !nextA {
+			break
+		}
+		tsA, valA := itA.Values()
+		tsB, valB := itB.Values()
+		// compare the bits, so that NaN matches NaN
+		if tsA != tsB || math.Float64bits(valA) != math.Float64bits(valB) {
+			return fmt.Errorf("point %d differs: (%d, %f) vs (%d, %f)", i, tsA, valA, tsB, valB)
+		}
+	}
+	if err := itA.Err(); err != nil {
+		return err
+	}
+	return itB.Err()
+}
+
 //msgp:ignore IterGensAsc
 type IterGensAsc []IterGen
 
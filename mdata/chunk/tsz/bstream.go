@@ -7,11 +7,13 @@ import (
 )
 
 // bstream is a stream of bits
+// reading from a bstream doesn't modify the underlying data, so many readers can share it.
 type bstream struct {
 	// the data stream
 	stream []byte
 
 	// how many bits are valid in current byte
+	// when reading: how many bits of the current byte are yet to be read
 	count uint8
 }
 
@@ -85,6 +87,11 @@ func (b *bstream) writeBits(u uint64, nbits int) {
 	}
 }
 
+// cur returns the unread bits of the current byte, shifted to the most significant bits
+func (b *bstream) cur() byte {
+	return b.stream[0] << (8 - b.count)
+}
+
 func (b *bstream) readBit() (bit, error) {
 
 	if len(b.stream) == 0 {
@@ -100,9 +107,8 @@ func (b *bstream) readBit() (bit, error) {
 		b.count = 8
 	}
 
+	d := b.cur() & 0x80
 	b.count--
-	d := b.stream[0] & 0x80
-	b.stream[0] <<= 1
 	return d != 0, nil
 }
 
@@ -127,7 +133,7 @@ func (b *bstream) readByte() (byte, error) {
 		return b.stream[0], nil
 	}
 
-	byt := b.stream[0]
+	byt := b.cur()
 	b.stream = b.stream[1:]
 
 	if len(b.stream) == 0 {
@@ -135,7 +141,6 @@ func (b *bstream) readByte() (byte, error) {
 	}
 
 	byt |= b.stream[0] >> b.count
-	b.stream[0] <<= (8 - b.count)
 
 	return byt, nil
 }
@@ -159,7 +164,7 @@ func (b *bstream) readBits(nbits int) (uint64, error) {
 	}
 
 	if nbits > int(b.count) {
-		u = (u << uint(b.count)) | uint64(b.stream[0]>>(8-b.count))
+		u = (u << uint(b.count)) | uint64(b.cur()>>(8-b.count))
 		nbits -= int(b.count)
 		b.stream = b.stream[1:]
 
@@ -169,8 +174,7 @@ func (b *bstream) readBits(nbits int) (uint64, error) {
 		b.count = 8
 	}
 
-	u = (u << uint(nbits)) | uint64(b.stream[0]>>(8-uint(nbits)))
-	b.stream[0] <<= uint(nbits)
+	u = (u << uint(nbits)) | uint64(b.cur()>>(8-uint(nbits)))
 	b.count -= uint8(nbits)
 	return u, nil
 }
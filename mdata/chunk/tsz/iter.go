@@ -1,7 +1,34 @@
 package tsz
 
+import "sync"
+
 type Iter interface {
 	Next() bool
 	Values() (uint32, float64)
 	Err() error
 }
+
+// iterators are allocated for every chunk that is read, so we reuse them.
+var (
+	iter4hPool = sync.Pool{
+		New: func() interface{} { return &Iter4h{} },
+	}
+	iterLongPool = sync.Pool{
+		New: func() interface{} { return &IterLong{} },
+	}
+)
+
+// ReleaseIter returns the iterator to its pool, so that it can be reused for another chunk.
+// the caller must not use the iterator anymore after releasing it.
+// it is optional: iterators that aren't released are simply garbage collected.
+func ReleaseIter(it Iter) {
+	switch it := it.(type) {
+	case *Iter4h:
+		// drop the reference to the chunk data, so that it can be garbage collected
+		it.br.stream = nil
+		iter4hPool.Put(it)
+	case *IterLong:
+		it.br.stream = nil
+		iterLongPool.Put(it)
+	}
+}
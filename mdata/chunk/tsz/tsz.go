@@ -180,14 +180,18 @@ func bstreamIterator4h(br *bstream, intervalHint uint32) (*Iter4h, error) {
 		return nil, err
 	}
 
-	return &Iter4h{
+	it := iter4hPool.Get().(*Iter4h)
+	*it = Iter4h{
 		T0:           uint32(t0),
 		intervalHint: intervalHint,
 		br:           *br,
-	}, nil
+	}
+	return it, nil
 }
 
 // NewIterator4h creates an Iter4h
+// the iterator reads b in place, so b must not be modified while the iterator is in use.
+// see ReleaseIter to reuse the iterator once done with it.
 func NewIterator4h(b []byte, intervalHint uint32) (*Iter4h, error) {
 	return bstreamIterator4h(newBReader(b), intervalHint)
 }
@@ -294,10 +298,10 @@ func (it *Iter4h) Next() bool {
 		// if delta+dod <0 (aka the upcoming delta < 0),
 		// our current delta overflowed, because points should always be in increasing time order
 		// (have delta's > 0)
-		// we must take a backup of the stream because reading from the stream reader modifies it.
+		// we must take a backup of the reader because reading advances it. the data itself is not modified, so a copy of the reader suffices.
 		// note that potentially we could skip this remediation by using another hint: the chunkspan,
 		// since we know the overflow cannot possibly happen for chunks <=4h in length. perhaps a future optimization.
-		brBackup := it.br.clone()
+		brBackup := it.br
 		dod, ok := it.dod()
 		if !ok {
 			// this case should only happen if we're out of data (only a single point in the chunk)
@@ -307,14 +311,14 @@ func (it *Iter4h) Next() bool {
 			// that have an intervalHint.
 			// and for return value, stick to normal iter semantics:
 			// this read succeeded, though we already know the next one will fail
-			it.br = *brBackup
+			it.br = brBackup
 			return true
 		}
 		if dod+int32(tDelta) < 0 {
 			it.tDelta += 16384
 			it.t += 16384
 		}
-		it.br = *brBackup
+		it.br = brBackup
 		return true
 	}
 
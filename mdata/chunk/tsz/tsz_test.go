@@ -1,6 +1,7 @@
 package tsz
 
 import (
+	"bytes"
 	"math/rand"
 	"testing"
 )
@@ -107,3 +108,65 @@ func BenchmarkIterSeriesLongInterface(b *testing.B) {
 	T = t
 	V = v
 }
+
+func BenchmarkNewIteratorLong(b *testing.B) {
+	s := NewSeriesLong(0)
+	for i := uint32(1); i <= 120; i++ {
+		s.Push(i*60, float64(i)+123.45)
+	}
+	s.Finish()
+	data := s.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter, _ := NewIteratorLong(0, data)
+		for iter.Next() {
+			T, V = iter.Values()
+		}
+		ReleaseIter(iter)
+	}
+}
+
+// iterators read the data in place, so it must remain intact for other iterators, including reused ones.
+func TestIterDataReuse(t *testing.T) {
+	s4h := NewSeries4h(0)
+	sLong := NewSeriesLong(0)
+	for i := uint32(1); i <= 100; i++ {
+		s4h.Push(i*60, float64(i)*1.5)
+		sLong.Push(i*60, float64(i)*1.5)
+	}
+	s4h.Finish()
+	sLong.Finish()
+	data4h := s4h.Bytes()
+	dataLong := sLong.Bytes()
+	orig4h := append([]byte(nil), data4h...)
+	origLong := append([]byte(nil), dataLong...)
+
+	for run := 0; run < 3; run++ {
+		it4h, err := NewIterator4h(data4h, 60)
+		if err != nil {
+			t.Fatalf("run %d: could not create Iter4h: %s", run, err)
+		}
+		itLong, err := NewIteratorLong(0, dataLong)
+		if err != nil {
+			t.Fatalf("run %d: could not create IterLong: %s", run, err)
+		}
+		for _, iter := range []Iter{it4h, itLong} {
+			var n uint32
+			for iter.Next() {
+				n++
+				ts, val := iter.Values()
+				if ts != n*60 || val != float64(n)*1.5 {
+					t.Fatalf("run %d: point %d: expected (%d, %f), got (%d, %f)", run, n, n*60, float64(n)*1.5, ts, val)
+				}
+			}
+			if n != 100 || iter.Err() != nil {
+				t.Fatalf("run %d: expected 100 points and no error, got %d and %v", run, n, iter.Err())
+			}
+			ReleaseIter(iter)
+		}
+	}
+	if !bytes.Equal(data4h, orig4h) || !bytes.Equal(dataLong, origLong) {
+		t.Fatalf("expected iterating to leave the data intact")
+	}
+}
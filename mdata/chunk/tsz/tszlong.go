@@ -171,14 +171,18 @@ func bstreamIteratorLong(t0 uint32, br *bstream) (*IterLong, error) {
 
 	br.count = 8
 
-	return &IterLong{
+	it := iterLongPool.Get().(*IterLong)
+	*it = IterLong{
 		T0:     t0,
 		br:     *br,
 		tDelta: 60,
-	}, nil
+	}
+	return it, nil
 }
 
 // NewIteratorLong for the series
+// the iterator reads b in place, so b must not be modified while the iterator is in use.
+// see ReleaseIter to reuse the iterator once done with it.
 func NewIteratorLong(t0 uint32, b []byte) (*IterLong, error) {
 	return bstreamIteratorLong(t0, newBReader(b))
 }
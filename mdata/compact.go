@@ -0,0 +1,226 @@
+package mdata
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/mdata/chunk/tsz"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCompactUnsupported is returned by stores that can't replace chunks by a compacted one
+var ErrCompactUnsupported = errors.New("the store does not support compacting chunks")
+
+var (
+	// metric tank.chunk_compaction.series is how many series had their old chunks compacted
+	chunkCompactionSeries = stats.NewCounter32("tank.chunk_compaction.series")
+
+	// metric tank.chunk_compaction.chunks_in is how many chunks were replaced by compacted chunks
+	chunkCompactionChunksIn = stats.NewCounter32("tank.chunk_compaction.chunks_in")
+
+	// metric tank.chunk_compaction.chunks_out is how many compacted chunks were saved
+	chunkCompactionChunksOut = stats.NewCounter32("tank.chunk_compaction.chunks_out")
+
+	// metric tank.chunk_compaction.fail is how many series failed to be compacted
+	chunkCompactionFail = stats.NewCounter32("tank.chunk_compaction.fail")
+)
+
+// ChunkCompactionEnabled returns whether old chunks should be compacted in the background
+func ChunkCompactionEnabled() bool {
+	return chunkCompactionSeriesMax > 0
+}
+
+// compactResult is the result of compacting the chunks of a series
+type compactResult struct {
+	in  int // chunks that were replaced
+	out int // compacted chunks that replaced them
+}
+
+// CompactChunks periodically compacts the old chunks of a random sample of the series in memory:
+// the chunks of each span of chunk-compaction.span are merged into one chunk, which replaces them in the store.
+// this reduces the number of chunks - and thus the work - to read long ranges of long-retention series.
+// only primaries compact, as they are the ones that save chunks. it returns when ctx is done.
+func (ms *AggMetrics) CompactChunks(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(chunkCompactionInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !cluster.Manager.IsPrimary() {
+			continue
+		}
+		if err := ms.compactChunksRun(ctx, uint32(time.Now().Unix())); err == ErrCompactUnsupported {
+			log.Errorf("chunk compaction: %s, stopping", err)
+			return
+		}
+	}
+}
+
+// compactChunksRun compacts the old chunks of a random sample of the series
+func (ms *AggMetrics) compactChunksRun(ctx context.Context, now uint32) error {
+	pre := time.Now()
+	sample := ms.sampleSeries(chunkCompactionSeriesMax)
+	var total compactResult
+	var failed int
+	for _, m := range sample {
+		if ctx.Err() != nil {
+			return nil
+		}
+		res, err := ms.compactSeries(ctx, m.Key.MKey, m.schemaId, m.aggId, now)
+		if err == ErrCompactUnsupported {
+			return err
+		}
+		if err != nil {
+			log.Warnf("chunk compaction: failed to compact the chunks of %s: %s", m.Key.MKey, err)
+			chunkCompactionFail.Inc()
+			failed++
+			continue
+		}
+		if res.in > 0 {
+			chunkCompactionSeries.Inc()
+		}
+		chunkCompactionChunksIn.Add(res.in)
+		chunkCompactionChunksOut.Add(res.out)
+		total.in += res.in
+		total.out += res.out
+	}
+	log.Infof("chunk compaction: compacted %d chunks into %d of %d series in %s. %d series failed", total.in, total.out, len(sample), time.Since(pre), failed)
+	return nil
+}
+
+// compactSeries compacts the old chunks of all archives of the series
+func (ms *AggMetrics) compactSeries(ctx context.Context, key schema.MKey, schemaId, aggId uint16, now uint32) (compactResult, error) {
+	var res compactResult
+	// archives are identified by their chunkspan. retentions that share a chunkspan get the largest in-memory window
+	memWindows := make(map[uint32]uint32)
+	for _, ret := range GetSchema(schemaId).Retentions {
+		if w := ret.ChunkSpan * ret.NumChunks; w > memWindows[ret.ChunkSpan] {
+			memWindows[ret.ChunkSpan] = w
+		}
+	}
+	for _, a := range seriesArchives(key, schemaId, aggId) {
+		r, err := ms.compactArchive(ctx, a, memWindows[a.span], now)
+		res.in += r.in
+		res.out += r.out
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// compactArchive merges the chunks of the archive that are older than chunk-compaction.min-age, and older than the
+// chunks that may still be in memory (memWindow), into chunks of chunk-compaction.span. chunks still in memory may be
+// saved again, e.g. by reopen-chunks, and must not overlap with a compacted chunk.
+func (ms *AggMetrics) compactArchive(ctx context.Context, a archiveTTL, memWindow, now uint32) (compactResult, error) {
+	var res compactResult
+	span := chunkCompactionSpan
+	if span <= a.span || span%a.span != 0 {
+		return res, nil
+	}
+	minAge := chunkCompactionMinAge
+	if memWindow > minAge {
+		minAge = memWindow
+	}
+	if now <= minAge {
+		return res, nil
+	}
+	cutoff := now - minAge
+
+	itgens, err := ms.searchTTL(ctx, a, now)
+	if err != nil {
+		return res, err
+	}
+	groups := make(map[uint32][]chunk.IterGen)
+	var starts []uint32
+	for _, itgen := range itgens {
+		itgenSpan := itgen.Span()
+		if itgenSpan == 0 {
+			// the format doesn't record the span
+			itgenSpan = a.span
+		}
+		if itgenSpan >= span {
+			continue
+		}
+		start := itgen.T0 - itgen.T0%span
+		if start+span > cutoff {
+			continue
+		}
+		if _, ok := groups[start]; !ok {
+			starts = append(starts, start)
+		}
+		groups[start] = append(groups[start], itgen)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	for _, start := range starts {
+		group := groups[start]
+		if len(group) < 2 {
+			continue
+		}
+		if ctx.Err() != nil {
+			return res, nil
+		}
+		c, t0s, err := mergeChunks(start, group)
+		if err != nil {
+			return res, err
+		}
+		cwr := NewChunkWriteRequest(nil, a.key, c, a.ttl, span, time.Now())
+		if err := ms.store.CompactChunks(ctx, &cwr, t0s); err != nil {
+			return res, err
+		}
+		res.in += len(t0s)
+		res.out++
+	}
+	return res, nil
+}
+
+// mergeChunks returns a finished chunk with t0 start, holding the points of the chunks, and the t0's of the chunks.
+// the chunks are sorted by t0. where chunks overlap, the points of the earlier chunk take precedence, like when reading them.
+func mergeChunks(start uint32, itgens []chunk.IterGen) (*chunk.Chunk, []uint32, error) {
+	c := chunk.New(start)
+	t0s := make([]uint32, 0, len(itgens))
+	var last uint32
+	for _, itgen := range itgens {
+		t0s = append(t0s, itgen.T0)
+		it, err := itgen.Get()
+		if err != nil {
+			return nil, nil, err
+		}
+		for it.Next() {
+			ts, val := it.Values()
+			if ts <= last {
+				continue
+			}
+			last = ts
+			if err := c.Push(ts, val); err != nil {
+				tsz.ReleaseIter(it)
+				return nil, nil, err
+			}
+		}
+		err = it.Err()
+		tsz.ReleaseIter(it)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	c.Finish()
+	return c, t0s, nil
+}
+
+// validChunkCompactionSpan returns whether compacted chunks can have the given span:
+// chunks must not cross the boundaries of the month rows of the stores.
+func validChunkCompactionSpan(span uint32) bool {
+	_, ok := chunk.RevChunkSpans[span]
+	return ok && conf.Month_sec%span == 0
+}
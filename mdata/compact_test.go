@@ -0,0 +1,93 @@
+package mdata
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestCompactChunks(t *testing.T) {
+	mockstore.Reset()
+	defer mockstore.Reset()
+	SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 5, 0), conf.NewRetentionMT(600, 86400, 3600, 2, 0))
+	SetSingleAgg(conf.Avg, conf.Max)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+
+	defer func(span, minAge uint32) {
+		chunkCompactionSpan, chunkCompactionMinAge = span, minAge
+	}(chunkCompactionSpan, chunkCompactionMinAge)
+	chunkCompactionSpan = 3600
+	chunkCompactionMinAge = 1800
+
+	key := test.GetMKey(1)
+	rawKey := schema.AMKey{MKey: key}
+	maxKey := schema.AMKey{MKey: key, Archive: schema.NewArchive(schema.Max, 600)}
+	save := func(key schema.AMKey, t0, span, step uint32) {
+		c := chunk.New(t0)
+		for ts := t0; ts < t0+span; ts += step {
+			c.Push(ts, float64(ts))
+		}
+		c.Finish()
+		cwr := NewChunkWriteRequest(nil, key, c, 86400, span, time.Now())
+		mockstore.Add(&cwr)
+	}
+	// raw data from 0 to 14390, and a rollup that already has the span of the compacted chunks
+	for t0 := uint32(0); t0 < 14400; t0 += 600 {
+		save(rawKey, t0, 600, 10)
+	}
+	for t0 := uint32(0); t0 < 14400; t0 += 3600 {
+		save(maxKey, t0, 3600, 600)
+	}
+	points := func(key schema.AMKey) []schema.Point {
+		var out []schema.Point
+		for _, itgen := range mockstore.results[key] {
+			it, err := itgen.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for it.Next() {
+				ts, val := it.Values()
+				out = append(out, schema.Point{Val: val, Ts: ts})
+			}
+		}
+		return out
+	}
+	rawPoints := points(rawKey)
+	maxPoints := points(maxKey)
+
+	// the raw chunks within 5*600 - the in-memory window, which is larger than the min-age - of 14400 are not compacted.
+	// the 3 hours before that are
+	res, err := ms.compactSeries(test.NewContext(), key, 0, 0, 14400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (compactResult{in: 18, out: 3}); res != exp {
+		t.Fatalf("expected %+v, got %+v", exp, res)
+	}
+	var t0s []uint32
+	for _, itgen := range mockstore.results[rawKey] {
+		t0s = append(t0s, itgen.T0)
+	}
+	expT0s := []uint32{0, 3600, 7200, 10800, 11400, 12000, 12600, 13200, 13800}
+	if !reflect.DeepEqual(t0s, expT0s) {
+		t.Fatalf("expected chunks with t0's %v, got %v", expT0s, t0s)
+	}
+	if got := points(rawKey); !reflect.DeepEqual(got, rawPoints) {
+		t.Fatalf("expected the raw points to be unchanged, got %v", got)
+	}
+	if got := points(maxKey); !reflect.DeepEqual(got, maxPoints) || len(mockstore.results[maxKey]) != 4 {
+		t.Fatalf("expected the rollup to be unchanged, got %v", got)
+	}
+
+	// the compacted chunks are not compacted again
+	res, err = ms.compactSeries(test.NewContext(), key, 0, 0, 14400)
+	if err != nil || res != (compactResult{}) {
+		t.Fatalf("expected nothing to compact, got %+v, %v", res, err)
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 // ChunkWriteRequest is a request to write a chunk into a store
 type ChunkWriteRequest struct {
-	Metric    *AggMetric
+	Metric    *AggMetric // nil if the chunk doesn't belong to a metric in memory
 	Key       schema.AMKey
 	Chunk     *chunk.Chunk
 	TTL       uint32
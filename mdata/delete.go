@@ -0,0 +1,88 @@
+package mdata
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/schema"
+)
+
+// ErrDeleteUnsupported is returned by stores that don't support deleting data
+var ErrDeleteUnsupported = errors.New("the store does not support deleting data")
+
+// archiveTTL is an archive of a series, along with the ttl and span of its chunks
+type archiveTTL struct {
+	key  schema.AMKey
+	ttl  uint32
+	span uint32
+}
+
+// seriesArchives returns the raw and rollup archives of the series, as per the given
+// storage-schemas and storage-aggregation rules. see NewAggMetric and NewAggregator
+func seriesArchives(key schema.MKey, schemaId, aggId uint16) []archiveTTL {
+	rets := GetSchema(schemaId).Retentions
+	out := []archiveTTL{{key: schema.AMKey{MKey: key}, ttl: uint32(rets[0].MaxRetention()), span: rets[0].ChunkSpan}}
+	methods := make(map[schema.Method]struct{})
+	for _, method := range GetAgg(aggId).AggregationMethod {
+		switch method {
+		case conf.Avg:
+			methods[schema.Sum] = struct{}{}
+			methods[schema.Cnt] = struct{}{}
+		case conf.Sum:
+			methods[schema.Sum] = struct{}{}
+		case conf.Lst:
+			methods[schema.Lst] = struct{}{}
+		case conf.Max:
+			methods[schema.Max] = struct{}{}
+		case conf.Min:
+			methods[schema.Min] = struct{}{}
+		}
+	}
+	for _, ret := range rets[1:] {
+		for _, method := range []schema.Method{schema.Sum, schema.Cnt, schema.Lst, schema.Max, schema.Min} {
+			if _, ok := methods[method]; !ok {
+				continue
+			}
+			out = append(out, archiveTTL{
+				key:  schema.AMKey{MKey: key, Archive: schema.NewArchive(method, uint32(ret.SecondsPerPoint))},
+				ttl:  uint32(ret.MaxRetention()),
+				span: ret.ChunkSpan,
+			})
+		}
+	}
+	return out
+}
+
+// Delete removes the series, including its rollups, from memory. Unlike eviction, its unsaved chunks are discarded.
+// it returns whether the series was in memory.
+func (ms *AggMetrics) Delete(key schema.MKey) bool {
+	sh := ms.shard(key)
+	if _, ok := sh.get(key); !ok {
+		return false
+	}
+	sh.remove(key)
+	return true
+}
+
+// DeleteFromStore deletes the chunks of all archives of the series from the store.
+// it returns ErrDeleteUnsupported if the store can't delete data.
+func DeleteFromStore(ctx context.Context, store Store, key schema.MKey, schemaId, aggId uint16) error {
+	for _, a := range seriesArchives(key, schemaId, aggId) {
+		if err := store.Delete(ctx, a.key, a.ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRangeFromStore deletes the chunks of all archives of the series whose t0 is in the range from (inclusive) - to (exclusive) from the store.
+// it returns ErrDeleteUnsupported if the store can't delete data.
+func DeleteRangeFromStore(ctx context.Context, store Store, key schema.MKey, schemaId, aggId uint16, from, to uint32) error {
+	for _, a := range seriesArchives(key, schemaId, aggId) {
+		if err := store.DeleteRange(ctx, a.key, a.ttl, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestDeleteSeries(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 5, 0), conf.NewRetentionMT(600, 86400, 3600, 2, 0))
+	SetSingleAgg(conf.Avg, conf.Max)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+
+	keep, del := test.GetMKey(1), test.GetMKey(2)
+	for _, key := range []schema.MKey{keep, del} {
+		m := getOrCreate(ms, key)
+		// enough points to complete chunks of the raw series and the rollups
+		for ts := uint32(10); ts <= 7300; ts += 10 {
+			m.Add(ts, 1)
+		}
+	}
+	items := mockstore.Items()
+	if items == 0 {
+		t.Fatalf("expected chunks to be saved")
+	}
+
+	// raw, and sum, cnt and max of the rollup
+	if got := seriesArchives(del, 0, 0); len(got) != 4 {
+		t.Fatalf("expected 4 archives, got %v", got)
+	}
+	if !ms.Delete(del) {
+		t.Fatalf("expected the series to be in memory")
+	}
+	if ms.Delete(del) {
+		t.Fatalf("expected the series to no longer be in memory")
+	}
+	if err := DeleteFromStore(test.NewContext(), mockstore, del, 0, 0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, a := range seriesArchives(del, 0, 0) {
+		if itgens, _ := mockstore.Search(test.NewContext(), a.key, a.ttl, 0, 10000); len(itgens) != 0 {
+			t.Fatalf("expected no chunks of %s to remain, got %d", a.key, len(itgens))
+		}
+	}
+	if mockstore.Items() != items/2 {
+		t.Fatalf("expected %d chunks to remain, got %d", items/2, mockstore.Items())
+	}
+	if _, ok := ms.Get(keep); !ok {
+		t.Fatalf("expected the other series to remain in memory")
+	}
+
+	// deleting a range only removes the chunks that start in it
+	if err := DeleteRangeFromStore(test.NewContext(), mockstore, keep, 0, 0, 1200, 3600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, a := range seriesArchives(keep, 0, 0) {
+		itgens, _ := mockstore.Search(test.NewContext(), a.key, a.ttl, 0, 10000)
+		if len(itgens) == 0 {
+			t.Fatalf("expected chunks of %s outside of the range to remain", a.key)
+		}
+		for _, itgen := range itgens {
+			if itgen.T0 >= 1200 && itgen.T0 < 3600 {
+				t.Fatalf("expected chunk %d of %s to be deleted", itgen.T0, a.key)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package mdata
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// AddResult describes what became of a point that was added to a metric
+type AddResult uint8
+
+const (
+	AddAccepted   AddResult = iota
+	AddTooOld               // older than the data in memory, beyond the reorder window (and reopen-chunks, if enabled)
+	AddChunkSaved           // for a chunk that was closed (and saved, if we're primary) already
+	AddDuplicate            // same timestamp as a point we have. the duplicatePolicy decides which value is kept
+	numAddResults
+)
+
+// AddResults lists all results, in order
+var AddResults = []AddResult{AddAccepted, AddTooOld, AddChunkSaved, AddDuplicate}
+
+func (r AddResult) String() string {
+	switch r {
+	case AddAccepted:
+		return "accepted"
+	case AddTooOld:
+		return "too_old"
+	case AddChunkSaved:
+		return "chunk_saved"
+	case AddDuplicate:
+		return "duplicate"
+	}
+	return "unknown"
+}
+
+// Dropped is whether the point was discarded.
+// note that of duplicates, one of both values is kept
+func (r AddResult) Dropped() bool {
+	return r != AddAccepted && r != AddDuplicate
+}
+
+// OrgDropped describes what became of the points added to the raw series of an org: how many were accepted,
+// and how many were dropped (or were duplicates), by result
+type OrgDropped struct {
+	OrgId  uint32            `json:"orgId"`
+	Points map[string]uint64 `json:"points"`
+}
+
+func (u *usage) added(r AddResult) {
+	atomic.AddUint64(&u.results[r], 1)
+}
+
+// GetDropped returns, for each org that added points to its raw series, how many points had each result, sorted by org.
+// it includes points that were added via the reorder buffer, and that were dropped when they were flushed from it.
+func GetDropped() []OrgDropped {
+	out := []OrgDropped{}
+	accnt.RLock()
+	for org, u := range accnt.orgs {
+		oa := OrgDropped{
+			OrgId:  org,
+			Points: make(map[string]uint64, numAddResults),
+		}
+		var total uint64
+		for _, r := range AddResults {
+			n := atomic.LoadUint64(&u.results[r])
+			oa.Points[r.String()] = n
+			total += n
+		}
+		if total > 0 {
+			out = append(out, oa)
+		}
+	}
+	accnt.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].OrgId < out[j].OrgId
+	})
+	return out
+}
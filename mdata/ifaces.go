@@ -12,18 +12,38 @@ import (
 
 type Metrics interface {
 	Get(key schema.MKey) (Metric, bool)
-	GetOrCreate(key schema.MKey, schemaId, aggId uint16) Metric
+	// GetOrCreate returns the series, creating it if it doesn't exist yet.
+	// it returns an error if the series may not be created because its org reached its series limit
+	GetOrCreate(key schema.MKey, schemaId, aggId uint16) (Metric, error)
 }
 
 type Metric interface {
-	Add(ts uint32, val float64)
+	Add(ts uint32, val float64) AddResult
+	AddMany(points []schema.Point) []AddResult
 	Get(from, to uint32) (Result, error)
 	GetAggregated(consolidator consolidation.Consolidator, aggSpan, from, to uint32) (Result, error)
 }
 
+// Store is a backend store of chunks. see RegisterStore for how backends are made selectable in the config
 type Store interface {
+	// Add queues the chunk for saving
 	Add(cwr *ChunkWriteRequest)
+	// Search returns the chunks of the archive that have data in the range from (inclusive) - to (exclusive),
+	// in chronological order
 	Search(ctx context.Context, key schema.AMKey, ttl, from, to uint32) ([]chunk.IterGen, error)
+	// Delete deletes all chunks of the given archive that were saved with the given ttl.
+	// stores that can't delete data return ErrDeleteUnsupported
+	Delete(ctx context.Context, key schema.AMKey, ttl uint32) error
+	// DeleteRange deletes the chunks of the given archive that were saved with the given ttl,
+	// and whose t0 is in the range from (inclusive) - to (exclusive).
+	// stores that can't delete data return ErrDeleteUnsupported
+	DeleteRange(ctx context.Context, key schema.AMKey, ttl, from, to uint32) error
+	// CompactChunks saves the chunk of the request, and deletes the chunks of its archive with the given t0's,
+	// which it replaces. the chunk holds all their points, and has a larger span.
+	// stores that can't do that return ErrCompactUnsupported
+	CompactChunks(ctx context.Context, cwr *ChunkWriteRequest, t0s []uint32) error
+	// Stats returns the state of the store
+	Stats() StoreStats
 	Stop()
 	SetTracer(t opentracing.Tracer)
 }
@@ -6,12 +6,15 @@ package mdata
 import (
 	"flag"
 	"io/ioutil"
+	"time"
 
 	"github.com/grafana/globalconf"
 	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/chunk"
 	"github.com/grafana/metrictank/stats"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/raintank/dur"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -22,12 +25,23 @@ var (
 	// metric tank.chunk_operations.clear is a counter of how many chunks are cleared (replaced by new chunks)
 	chunkClear = stats.NewCounter32("tank.chunk_operations.clear")
 
+	// metric tank.chunk_operations.reopen is a counter of how many times a chunk was rewritten to add a point that arrived late for it (see reopen-chunks)
+	chunkReopen = stats.NewCounter32("tank.chunk_operations.reopen")
+
+	// metric tank.chunk_operations.rollover is a counter of how many chunks were closed before the end of their span, because they reached max-points-per-chunk.
+	// the next point starts a new chunk. this indicates producers that send points (much) more frequently than the interval of their series.
+	chunkRollover = stats.NewCounter32("tank.chunk_operations.rollover")
+
 	// metric tank.metrics_reordered is the number of points received that are going back in time, but are still
 	// within the reorder window. in such a case they will be inserted in the correct order.
 	// E.g. if the reorder window is 60 (datapoints) then points may be inserted at random order as long as their
 	// ts is not older than the 60th datapoint counting from the newest.
 	metricsReordered = stats.NewCounter32("tank.metrics_reordered")
 
+	// metric tank.metrics_duplicate is the number of points received with the same timestamp as a point in the reorder buffer.
+	// the value that is kept is determined by the duplicatePolicy of the storage schema.
+	metricsDuplicate = stats.NewCounter32("tank.metrics_duplicate")
+
 	// metric tank.metrics_too_old is points that go back in time beyond the scope of the optional reorder window.
 	// these points will end up being dropped and lost.
 	metricsTooOld = stats.NewCounterRate32("tank.metrics_too_old")
@@ -41,6 +55,15 @@ var (
 	// metric tank.total_points is the number of points currently held in the in-memory ringbuffer
 	totalPoints = stats.NewGauge64("tank.total_points")
 
+	// metric tank.total_chunks is the number of chunks currently held in the in-memory ringbuffer
+	totalChunks = stats.NewGauge64("tank.total_chunks")
+
+	// metric tank.total_chunk_bytes is the size of the closed chunks currently held in the in-memory ringbuffer
+	totalChunkBytes = stats.NewGauge64("tank.total_chunk_bytes")
+
+	// accounting of the data held in memory per org. see GetUsage
+	accnt = newAccounting()
+
 	// metric mem.to_iter is how long it takes to transform in-memory chunks to iterators
 	memToIterDuration = stats.NewLatencyHistogram15s32("mem.to_iter")
 
@@ -54,6 +77,27 @@ var (
 	// metric tank.gc_metric is the number of times the metrics GC is about to inspect a metric (series)
 	gcMetric = stats.NewCounter32("tank.gc_metric")
 
+	// metric tank.gc.chunks_persisted is the number of stale chunks the metrics GC closed and persisted
+	gcChunksPersisted = stats.NewCounter32("tank.gc.chunks_persisted")
+
+	// metric tank.gc.series_dropped is the number of stale metrics (series) the metrics GC purged from memory
+	gcSeriesDropped = stats.NewCounter32("tank.gc.series_dropped")
+
+	// metric tank.gc.idle_chunks_dropped is the number of saved raw chunks the metrics GC removed from memory,
+	// because their series were not read in idle-series-max-age
+	gcIdleChunksDropped = stats.NewCounter32("tank.gc.idle_chunks_dropped")
+
+	// metric tank.gc.budget_exhausted is the number of metrics GC runs that stopped before scanning all metrics,
+	// because they reached gc-max-series or gc-max-points
+	gcBudgetExhausted = stats.NewCounter32("tank.gc.budget_exhausted")
+
+	// metric tank.gc.duration is how long a metrics GC run takes
+	gcDuration = stats.NewLatencyHistogram15s32("tank.gc.duration")
+
+	// metric tank.rollups_below_xff is how many points of rollups were left out (nulls), because their window had fewer points
+	// than the xFilesFactor of their storage-aggregation rule requires
+	rollupsBelowXFF = stats.NewCounter32("tank.rollups_below_xff")
+
 	// metric recovered_errors.aggmetric.getaggregated.bad-consolidator is how many times we detected an GetAggregated call
 	// with an incorrect consolidator specified
 	badConsolidator = stats.NewCounter32("recovered_errors.aggmetric.getaggregated.bad-consolidator")
@@ -66,6 +110,40 @@ var (
 	Aggregations conf.Aggregations
 	Schemas      conf.Schemas
 
+	reopenChunks      bool
+	maxPointsPerChunk uint
+	chunkFormatStr    string
+	chainRollups      bool
+	openRollups       bool
+
+	// the start of the data that is replayed after a restart, if any. see SetReplayStart
+	replayStart uint32
+
+	snapshotEnabled bool
+	snapshotDir     string
+
+	warmUpMaxSeries   int
+	warmUpWindowStr   string
+	warmUpWindow      uint32
+	warmUpConcurrency int
+
+	rollupVerifySeriesMax   int
+	rollupVerifyIntervalStr string
+	rollupVerifyInterval    uint32
+
+	chunkCompactionSeriesMax   int
+	chunkCompactionIntervalStr string
+	chunkCompactionInterval    uint32
+	chunkCompactionSpanStr     string
+	chunkCompactionSpan        uint32
+	chunkCompactionMinAgeStr   string
+	chunkCompactionMinAge      uint32
+
+	breakerEnabled      bool
+	breakerFailures     int
+	breakerSlow         time.Duration
+	breakerOpenDuration time.Duration
+
 	schemasFile = "/etc/metrictank/storage-schemas.conf"
 	aggFile     = "/etc/metrictank/storage-aggregation.conf"
 
@@ -80,7 +158,42 @@ func ConfigSetup() {
 	retentionConf := flag.NewFlagSet("retention", flag.ExitOnError)
 	retentionConf.StringVar(&schemasFile, "schemas-file", "/etc/metrictank/storage-schemas.conf", "path to storage-schemas.conf file")
 	retentionConf.StringVar(&aggFile, "aggregations-file", "/etc/metrictank/storage-aggregation.conf", "path to storage-aggregation.conf file")
+	retentionConf.BoolVar(&reopenChunks, "reopen-chunks", false, "add points that arrive late for a chunk that is still in memory, by rewriting the chunk, rather than dropping them. chunks that were saved already are saved again. late points are not included in rollups")
+	retentionConf.UintVar(&maxPointsPerChunk, "max-points-per-chunk", 0, "max number of points per chunk. chunks that reach it are closed and saved early, and the next point starts a new chunk within the same span. this bounds the memory used by producers that send points much more frequently than their interval. such chunks are written in FormatGoTszLongWithLengthCRC, which older versions of metrictank can't read. (0 disables)")
+	retentionConf.StringVar(&chunkFormatStr, "chunk-format", chunk.FormatGoTszLongWithSpan.String(), "format to write chunks in: FormatGoTszLongWithSpan, or FormatGoTszLongWithSpanCRC to add a checksum that is verified on read. older versions of metrictank can't read FormatGoTszLongWithSpanCRC, so only switch to it once all nodes run a version that supports it. see docs/cassandra.md")
+	retentionConf.BoolVar(&chainRollups, "chain-rollups", false, "compute each rollup from the rollup before it, if its interval is a multiple of the interval of that one, rather than from the raw points. this saves cpu for series with many rollups and frequent points")
+	retentionConf.BoolVar(&openRollups, "open-rollups", false, "include the window that is still being aggregated in reads of rollups, computed from the points seen so far, so that rollups don't lag behind by up to their interval. its point may still change until the window is complete")
 	globalconf.Register("retention", retentionConf, flag.ExitOnError)
+
+	snapshotConf := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	snapshotConf.BoolVar(&snapshotEnabled, "enabled", false, "on graceful shutdown, save the chunks that were not saved yet, the reorder buffers and the state of the aggregators to local disk, and restore them at startup")
+	snapshotConf.StringVar(&snapshotDir, "dir", "/var/lib/metrictank/snapshot", "directory to store the snapshot in")
+	globalconf.Register("snapshot", snapshotConf, flag.ExitOnError)
+
+	warmUpConf := flag.NewFlagSet("cache-warm-up", flag.ExitOnError)
+	warmUpConf.IntVar(&warmUpMaxSeries, "series", 0, "at startup, load the recent chunks of the raw archives of up to this many series from the store into the chunk cache, the most recently updated series first. 0 to disable")
+	warmUpConf.StringVar(&warmUpWindowStr, "window", "1h", "how much data to load per series. only series updated within this window are loaded")
+	warmUpConf.IntVar(&warmUpConcurrency, "concurrency", 10, "number of series to load concurrently")
+	globalconf.Register("cache-warm-up", warmUpConf, flag.ExitOnError)
+
+	rollupVerifyConf := flag.NewFlagSet("rollup-verify", flag.ExitOnError)
+	rollupVerifyConf.IntVar(&rollupVerifySeriesMax, "series", 0, "periodically recompute the rollups of this many randomly chosen series from their raw data in the store, and compare them with their rollups in the store, to detect aggregation bugs or missed windows. only primaries verify. 0 to disable")
+	rollupVerifyConf.StringVar(&rollupVerifyIntervalStr, "interval", "1h", "how often to verify the rollups of a new sample of series")
+	globalconf.Register("rollup-verify", rollupVerifyConf, flag.ExitOnError)
+
+	breakerConf := flag.NewFlagSet("store-breaker", flag.ExitOnError)
+	breakerConf.BoolVar(&breakerEnabled, "enabled", false, "stop reading from the store when it keeps failing, so that queries fail fast - serving only the data in memory and in the chunk cache - rather than piling up on it")
+	breakerConf.IntVar(&breakerFailures, "failures", 10, "number of reads in a row that must fail, or be slow, to open the breaker")
+	breakerConf.DurationVar(&breakerSlow, "slow", 0, "reads that take longer than this count as failed. 0 to only count errors")
+	breakerConf.DurationVar(&breakerOpenDuration, "open-duration", 30*time.Second, "how long the breaker stays open, before a read is let through to probe whether the store recovered")
+	globalconf.Register("store-breaker", breakerConf, flag.ExitOnError)
+
+	chunkCompactionConf := flag.NewFlagSet("chunk-compaction", flag.ExitOnError)
+	chunkCompactionConf.IntVar(&chunkCompactionSeriesMax, "series", 0, "periodically merge the old chunks of this many randomly chosen series into chunks of span, replacing them in the store, so that reading long ranges takes fewer chunks. only primaries compact. only supported by the cassandra store. 0 to disable")
+	chunkCompactionConf.StringVar(&chunkCompactionIntervalStr, "interval", "1h", "how often to compact the chunks of a new sample of series")
+	chunkCompactionConf.StringVar(&chunkCompactionSpanStr, "span", "6h", "span of the compacted chunks. must be a valid chunkspan that divides 4 weeks. archives with this chunkspan or a larger one are not compacted")
+	chunkCompactionConf.StringVar(&chunkCompactionMinAgeStr, "min-age", "7d", "only compact chunks that are older than this. chunks that may still be in memory - as per the numchunks of their retention - are never compacted")
+	globalconf.Register("chunk-compaction", chunkCompactionConf, flag.ExitOnError)
 }
 
 func ConfigProcess() {
@@ -104,15 +217,60 @@ func ConfigProcess() {
 	// always add a default rule with xFilesFactor None and aggregationMethod None
 	// (which get interpreted by whisper as 0.5 and avg) at the end.
 
+	Aggregations, err = readAggregations(aggFile)
+	if err != nil {
+		log.Fatalf("can't read storage-aggregation file %q: %s", aggFile, err.Error())
+	}
+
+	chunkFormat, err := chunk.ParseFormat(chunkFormatStr)
+	if err != nil {
+		log.Fatalf("retention: %s", err)
+	}
+	if err := chunk.SetDefaultFormat(chunkFormat); err != nil {
+		log.Fatalf("retention: %s", err)
+	}
+
+	if warmUpMaxSeries < 0 {
+		log.Fatal("cache-warm-up: series must not be negative")
+	}
+	if warmUpConcurrency < 1 {
+		log.Fatal("cache-warm-up: concurrency must be at least 1")
+	}
+	warmUpWindow = dur.MustParseNDuration("window", warmUpWindowStr)
+
+	if rollupVerifySeriesMax < 0 {
+		log.Fatal("rollup-verify: series must not be negative")
+	}
+	rollupVerifyInterval = dur.MustParseNDuration("interval", rollupVerifyIntervalStr)
+
+	if breakerFailures < 1 {
+		log.Fatal("store-breaker: failures must be at least 1")
+	}
+	if breakerOpenDuration <= 0 {
+		log.Fatal("store-breaker: open-duration must be positive")
+	}
+
+	if chunkCompactionSeriesMax < 0 {
+		log.Fatal("chunk-compaction: series must not be negative")
+	}
+	chunkCompactionInterval = dur.MustParseNDuration("interval", chunkCompactionIntervalStr)
+	chunkCompactionSpan = dur.MustParseNDuration("span", chunkCompactionSpanStr)
+	if !validChunkCompactionSpan(chunkCompactionSpan) {
+		log.Fatalf("chunk-compaction: span %q must be a valid chunkspan that divides 4 weeks", chunkCompactionSpanStr)
+	}
+	chunkCompactionMinAge = dur.MustParseNDuration("min-age", chunkCompactionMinAgeStr)
+
+	storeTTLs = Schemas.TTLs()
+	storeMaxChunkSpan = Schemas.MaxChunkSpan()
+}
+
+// readAggregations reads the storage-aggregation file, or returns the default aggregations if it can't be read.
+func readAggregations(file string) (conf.Aggregations, error) {
 	// since we can't distinguish errors reading vs parsing, we'll just try a read separately first
-	_, err = ioutil.ReadFile(aggFile)
-	if err == nil {
-		Aggregations, err = conf.ReadAggregations(aggFile)
-		if err != nil {
-			log.Fatalf("can't read storage-aggregation file %q: %s", aggFile, err.Error())
-		}
-	} else {
-		log.Infof("Could not read %s: %s: using defaults", aggFile, err)
-		Aggregations = conf.NewAggregations()
+	_, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Infof("Could not read %s: %s: using defaults", file, err)
+		return conf.NewAggregations(), nil
 	}
+	return conf.ReadAggregations(file)
 }
@@ -0,0 +1,104 @@
+package mdata
+
+// ChunkInfo describes a chunk held in memory
+type ChunkInfo struct {
+	T0        uint32 `json:"t0"`
+	NumPoints uint32 `json:"numPoints"`
+	First     bool   `json:"first"`    // first chunk of the metric since it was created. typically incomplete
+	Finished  bool   `json:"finished"` // end-of-stream marker was written. no more points can be added
+	Saving    bool   `json:"saving"`   // added to the write queue, but not confirmed to be saved yet
+	Saved     bool   `json:"saved"`    // saved, by us or by another node that notified us about it
+}
+
+// ArchiveInfo describes the in-memory state of the raw series or of a rollup archive of a metric
+type ArchiveInfo struct {
+	Key             string      `json:"key"`
+	ChunkSpan       uint32      `json:"chunkSpan"`
+	NumChunks       uint32      `json:"numChunks"`
+	TTL             uint32      `json:"ttl"`
+	FirstChunkT0    uint32      `json:"firstChunkT0"` // T0 of the oldest chunk in memory. 0 if there are no chunks
+	FirstTs         uint32      `json:"firstTs"`      // timestamp of the first point received
+	LastWrite       uint32      `json:"lastWrite"`    // wall clock time of when the last point was added
+	LastSaveStart   uint32      `json:"lastSaveStart"`
+	LastSaveFinish  uint32      `json:"lastSaveFinish"`
+	CurrentChunkPos int         `json:"currentChunkPos"`
+	Chunks          []ChunkInfo `json:"chunks"` // oldest first
+}
+
+// AggregatorInfo describes the state of an aggregator and its rollup archives
+type AggregatorInfo struct {
+	Span            uint32        `json:"span"`
+	CurrentBoundary uint32        `json:"currentBoundary"` // timestamp of the aggregated point being built
+	Pending         Aggregation   `json:"pending"`         // aggregation of the points received for the current boundary
+	Archives        []ArchiveInfo `json:"archives"`
+}
+
+// MetricInfo describes the in-memory state of a metric, to help debugging
+type MetricInfo struct {
+	ArchiveInfo
+	ReorderBuffer int              `json:"reorderBuffer"` // number of points in the reorder buffer
+	Aggregators   []AggregatorInfo `json:"aggregators"`
+}
+
+// Info returns the in-memory state of the metric and its rollups
+func (a *AggMetric) Info() MetricInfo {
+	var info MetricInfo
+	// the state of the aggregators is updated under our lock
+	a.RLock()
+	if a.rob != nil {
+		info.ReorderBuffer = len(a.rob.Get())
+	}
+	for _, agg := range a.aggregators {
+		info.Aggregators = append(info.Aggregators, AggregatorInfo{
+			Span:            agg.span,
+			CurrentBoundary: agg.currentBoundary,
+			Pending:         *agg.agg,
+		})
+	}
+	a.RUnlock()
+	info.ArchiveInfo = a.archiveInfo()
+	// no lock needed cause aggregators don't change at runtime
+	for i, agg := range a.aggregators {
+		for _, m := range agg.archives() {
+			info.Aggregators[i].Archives = append(info.Aggregators[i].Archives, m.archiveInfo())
+		}
+	}
+	return info
+}
+
+func (a *AggMetric) archiveInfo() ArchiveInfo {
+	a.RLock()
+	defer a.RUnlock()
+	info := ArchiveInfo{
+		Key:             a.Key.String(),
+		ChunkSpan:       a.ChunkSpan,
+		NumChunks:       a.NumChunks,
+		TTL:             a.ttl,
+		FirstTs:         a.firstTs,
+		LastWrite:       a.lastWrite,
+		LastSaveStart:   a.lastSaveStart,
+		LastSaveFinish:  a.lastSaveFinish,
+		CurrentChunkPos: a.CurrentChunkPos,
+		Chunks:          make([]ChunkInfo, 0, len(a.Chunks)),
+	}
+	// walk from the oldest chunk to the current one
+	for i := 1; i <= len(a.Chunks); i++ {
+		c := a.Chunks[(a.CurrentChunkPos+i)%len(a.Chunks)]
+		if c == nil {
+			continue
+		}
+		if info.FirstChunkT0 == 0 {
+			info.FirstChunkT0 = c.Series.T0
+		}
+		saved := c.Series.T0 <= a.lastSaveFinish
+		info.Chunks = append(info.Chunks, ChunkInfo{
+			T0:        c.Series.T0,
+			NumPoints: c.NumPoints,
+			First:     c.First,
+			Finished:  c.Series.Finished,
+			Saving:    !saved && c.Series.T0 <= a.lastSaveStart,
+			Saved:     saved,
+		})
+	}
+	return info
+}
@@ -0,0 +1,51 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+)
+
+func TestAggMetricInfo(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	ret := conf.Retentions{conf.NewRetentionMT(1, 3600, 120, 3, 0), conf.NewRetentionMT(60, 7200, 600, 2, 0)}
+	agg := conf.Aggregation{AggregationMethod: []conf.Method{conf.Min, conf.Max}}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(1), ret, 0, &agg, false)
+
+	// fill 4 chunks, so that the buffer of 3 wraps around
+	for ts := uint32(120); ts < 510; ts += 10 {
+		m.Add(ts, 1)
+	}
+	m.SyncChunkSaveState(240)
+	m.lastSaveStart = 360
+
+	info := m.Info()
+	if info.FirstChunkT0 != 240 || info.TTL != 3600 || info.FirstTs != 120 {
+		t.Fatalf("unexpected archive info %+v", info.ArchiveInfo)
+	}
+	exp := []ChunkInfo{
+		{T0: 240, NumPoints: 12, Finished: true, Saved: true},
+		{T0: 360, NumPoints: 12, Finished: true, Saving: true},
+		{T0: 480, NumPoints: 3},
+	}
+	if len(info.Chunks) != len(exp) {
+		t.Fatalf("expected %d chunks, got %+v", len(exp), info.Chunks)
+	}
+	for i, c := range info.Chunks {
+		if c != exp[i] {
+			t.Fatalf("chunk %d: expected %+v, got %+v", i, exp[i], c)
+		}
+	}
+	if len(info.Aggregators) != 1 || len(info.Aggregators[0].Archives) != 2 {
+		t.Fatalf("expected 1 aggregator with 2 archives, got %+v", info.Aggregators)
+	}
+	a := info.Aggregators[0]
+	if a.Span != 60 || a.CurrentBoundary != 540 || a.Pending.Cnt != 2 {
+		t.Fatalf("unexpected aggregator info %+v", a)
+	}
+}
@@ -2,9 +2,11 @@ package mdata
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/raintank/schema"
 
+	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/stats"
@@ -16,18 +18,32 @@ var (
 
 	// metric cluster.notifier.all.messages-received is a counter of messages received from cluster notifiers
 	messagesReceived = stats.NewCounter32("cluster.notifier.all.messages-received")
+
+	// metric cluster.notifier.all.unsaved-chunks-published is a counter of unsaved chunks published by this node upon demotion from primary
+	unsavedChunksPublished = stats.NewCounter32("cluster.notifier.all.unsaved-chunks-published")
+
+	// metric cluster.notifier.all.unsaved-chunks-saved is a counter of unsaved chunks of a demoted node that this node saved as primary
+	unsavedChunksSaved = stats.NewCounter32("cluster.notifier.all.unsaved-chunks-saved")
+
+	// metric cluster.notifier.all.unsaved-chunks-skipped is a counter of unsaved chunks of a demoted node that this node did not need to save, or could not save
+	unsavedChunksSkipped = stats.NewCounter32("cluster.notifier.all.unsaved-chunks-skipped")
 )
 
 type Notifier interface {
 	Send(SavedChunk)
+	SendUnsaved(UnsavedChunk)
 }
 
 //PersistMessage format version
-const PersistMessageBatchV1 = 1
+const (
+	PersistMessageBatchV1 = 1 // json encoded
+	PersistMessageBatchV2 = 2 // protobuf encoded
+)
 
 type PersistMessageBatch struct {
-	Instance    string       `json:"instance"`
-	SavedChunks []SavedChunk `json:"saved_chunks"`
+	Instance      string         `json:"instance"`
+	SavedChunks   []SavedChunk   `json:"saved_chunks"`
+	UnsavedChunks []UnsavedChunk `json:"unsaved_chunks,omitempty"`
 }
 
 // SavedChunk represents a chunk persisted to the store
@@ -37,6 +53,18 @@ type SavedChunk struct {
 	T0  uint32 `json:"t0"`
 }
 
+// UnsavedChunk represents a finished chunk that a node holds, but which has not been persisted to the store.
+// nodes that get demoted from primary publish these, so that the new primary can save
+// the data it doesn't have itself.
+// Key is a stringified schema.AMKey, Data is the raw tsz.SeriesLong encoded data
+// Span is the span of the chunk, if it is not the chunkspan of the archive (see max-points-per-chunk)
+type UnsavedChunk struct {
+	Key  string `json:"key"`
+	T0   uint32 `json:"t0"`
+	Span uint32 `json:"span,omitempty"`
+	Data []byte `json:"data"`
+}
+
 func SendPersistMessage(key string, t0 uint32) {
 	sc := SavedChunk{Key: key, T0: t0}
 	for _, h := range notifiers {
@@ -44,6 +72,32 @@ func SendPersistMessage(key string, t0 uint32) {
 	}
 }
 
+func SendUnsavedChunk(uc UnsavedChunk) {
+	for _, h := range notifiers {
+		h.SendUnsaved(uc)
+	}
+	unsavedChunksPublished.Inc()
+}
+
+// DecodePersistMessageBatch decodes a message consisting of a version byte
+// followed by the PersistMessageBatch encoded in the format corresponding to the version
+func DecodePersistMessageBatch(data []byte) (PersistMessageBatch, error) {
+	batch := PersistMessageBatch{}
+	if len(data) == 0 {
+		return batch, fmt.Errorf("empty message")
+	}
+	var err error
+	switch version := uint8(data[0]); version {
+	case PersistMessageBatchV1:
+		err = json.Unmarshal(data[1:], &batch)
+	case PersistMessageBatchV2:
+		err = batch.UnmarshalProto(data[1:])
+	default:
+		return batch, fmt.Errorf("unknown version %d", version)
+	}
+	return batch, err
+}
+
 func InitPersistNotifier(not ...Notifier) {
 	notifiers = not
 }
@@ -73,39 +127,82 @@ func (dn DefaultNotifierHandler) PartitionOf(key schema.MKey) (int32, bool) {
 }
 
 func (dn DefaultNotifierHandler) Handle(data []byte) {
-	version := uint8(data[0])
-	if version == uint8(PersistMessageBatchV1) {
-		batch := PersistMessageBatch{}
-		err := json.Unmarshal(data[1:], &batch)
+	batch, err := DecodePersistMessageBatch(data)
+	if err != nil {
+		log.Errorf("notifier: failed to decode batch message: %s -- skipping", err)
+		return
+	}
+	messagesReceived.Add(len(batch.SavedChunks) + len(batch.UnsavedChunks))
+	for _, c := range batch.SavedChunks {
+		amkey, err := schema.AMKeyFromString(c.Key)
+		if err != nil {
+			log.Errorf("notifier: failed to convert %q to AMKey: %s -- skipping", c.Key, err)
+			continue
+		}
+		// we only need to handle saves for series that we know about.
+		// if the series is not in the index, then we dont need to worry about it.
+		def, ok := dn.idx.Get(amkey.MKey)
+		if !ok {
+			log.Debugf("notifier: skipping metric with MKey %s as it is not in the index", amkey.MKey)
+			continue
+		}
+		agg, err := dn.metrics.GetOrCreate(amkey.MKey, def.SchemaId, def.AggId)
 		if err != nil {
-			log.Errorf("failed to unmarsh batch message: %s -- skipping", err)
-			return
+			log.Debugf("notifier: skipping metric with MKey %s: %s", amkey.MKey, err)
+			continue
 		}
-		messagesReceived.Add(len(batch.SavedChunks))
-		for _, c := range batch.SavedChunks {
-			amkey, err := schema.AMKeyFromString(c.Key)
-			if err != nil {
-				log.Errorf("notifier: failed to convert %q to AMKey: %s -- skipping", c.Key, err)
-				continue
-			}
-			// we only need to handle saves for series that we know about.
-			// if the series is not in the index, then we dont need to worry about it.
-			def, ok := dn.idx.Get(amkey.MKey)
-			if !ok {
-				log.Debugf("notifier: skipping metric with MKey %s as it is not in the index", amkey.MKey)
-				continue
-			}
-			agg := dn.metrics.GetOrCreate(amkey.MKey, def.SchemaId, def.AggId)
-			if amkey.Archive != 0 {
-				consolidator := consolidation.FromArchive(amkey.Archive.Method())
-				aggSpan := amkey.Archive.Span()
-				agg.(*AggMetric).SyncAggregatedChunkSaveState(c.T0, consolidator, aggSpan)
-			} else {
-				agg.(*AggMetric).SyncChunkSaveState(c.T0)
-			}
+		if amkey.Archive != 0 {
+			consolidator := consolidation.FromArchive(amkey.Archive.Method())
+			aggSpan := amkey.Archive.Span()
+			agg.(*AggMetric).SyncAggregatedChunkSaveState(c.T0, consolidator, aggSpan)
+		} else {
+			agg.(*AggMetric).SyncChunkSaveState(c.T0)
 		}
-	} else {
-		log.Errorf("notifier: unknown version %d", version)
 	}
-	return
+	for _, c := range batch.UnsavedChunks {
+		dn.handleUnsavedChunk(c)
+	}
+}
+
+// handleUnsavedChunk saves a chunk that was published by a demoted node, if we are primary
+// and don't have the data for it ourselves (see AggMetric.reconcileChunk)
+func (dn DefaultNotifierHandler) handleUnsavedChunk(c UnsavedChunk) {
+	if !cluster.Manager.IsPrimary() {
+		unsavedChunksSkipped.Inc()
+		return
+	}
+	amkey, err := schema.AMKeyFromString(c.Key)
+	if err != nil {
+		log.Errorf("notifier: failed to convert %q to AMKey: %s -- skipping unsaved chunk", c.Key, err)
+		unsavedChunksSkipped.Inc()
+		return
+	}
+	def, ok := dn.idx.Get(amkey.MKey)
+	if !ok {
+		log.Debugf("notifier: skipping unsaved chunk of metric with MKey %s as it is not in the index", amkey.MKey)
+		unsavedChunksSkipped.Inc()
+		return
+	}
+	m, err := dn.metrics.GetOrCreate(amkey.MKey, def.SchemaId, def.AggId)
+	if err != nil {
+		log.Warnf("notifier: skipping unsaved chunk %s:%d: %s", c.Key, c.T0, err)
+		unsavedChunksSkipped.Inc()
+		return
+	}
+	agg := m.(*AggMetric).archiveMetric(amkey.Archive)
+	if agg == nil {
+		log.Warnf("notifier: skipping unsaved chunk %s:%d as we have no such archive", c.Key, c.T0)
+		unsavedChunksSkipped.Inc()
+		return
+	}
+	saved, err := agg.reconcileChunk(c.T0, c.Span, c.Data)
+	if err != nil {
+		log.Errorf("notifier: failed to save unsaved chunk %s:%d: %s", c.Key, c.T0, err)
+	}
+	if !saved {
+		unsavedChunksSkipped.Inc()
+		return
+	}
+	log.Infof("notifier: saving chunk %s:%d on behalf of demoted node", c.Key, c.T0)
+	unsavedChunksSaved.Inc()
 }
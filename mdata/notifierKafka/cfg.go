@@ -9,7 +9,10 @@ import (
 
 	"github.com/Shopify/sarama"
 	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/bus"
+	"github.com/grafana/metrictank/bus/kafkabus"
 	"github.com/grafana/metrictank/kafka"
+	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/stats"
 	log "github.com/sirupsen/logrus"
 )
@@ -21,12 +24,15 @@ var brokers []string
 var topic string
 var offsetStr string
 var config *sarama.Config
-var offsetDuration time.Duration
+var offsetPolicy kafka.OffsetPolicy
 var partitionStr string
 var partitions []int32
 var bootTimeOffsets map[int32]int64
 var backlogProcessTimeout time.Duration
 var backlogProcessTimeoutStr string
+var messageFormat string
+var messageVersion uint8
+var replayStart time.Time
 var partitionOffset map[int32]*stats.Gauge64
 var partitionLogSize map[int32]*stats.Gauge64
 var partitionLag map[int32]*stats.Gauge64
@@ -46,8 +52,9 @@ func init() {
 	FlagSet.StringVar(&kafkaVersionStr, "kafka-version", "0.10.0.0", "Kafka version in semver format. All brokers must be this version or newer.")
 	FlagSet.StringVar(&topic, "topic", "metricpersist", "kafka topic")
 	FlagSet.StringVar(&partitionStr, "partitions", "*", "kafka partitions to consume. use '*' or a comma separated list of id's. This should match the partitions used for kafka-mdm-in")
-	FlagSet.StringVar(&offsetStr, "offset", "newest", "Set the offset to start consuming from. Can be oldest, newest or a time duration")
+	FlagSet.StringVar(&offsetStr, "offset", "newest", "Set the offset to start consuming from. Can be oldest, newest or a duration (e.g. 7h or 2d)")
 	FlagSet.StringVar(&backlogProcessTimeoutStr, "backlog-process-timeout", "60s", "Maximum time backlog processing can block during metrictank startup. Setting to a low value may result in data loss")
+	FlagSet.StringVar(&messageFormat, "message-format", "json", "encoding of published messages: json or protobuf. all formats are always accepted when consuming")
 	globalconf.Register("kafka-cluster", FlagSet, flag.ExitOnError)
 }
 
@@ -61,14 +68,9 @@ func ConfigProcess(instance string) {
 		log.Fatalf("kafka-cluster: invalid kafka-version. %s", err)
 	}
 
-	switch offsetStr {
-	case "oldest":
-	case "newest":
-	default:
-		offsetDuration, err = time.ParseDuration(offsetStr)
-		if err != nil {
-			log.Fatalf("kafka-cluster: invalid offest format. %s", err)
-		}
+	offsetPolicy, err = kafka.ParseOffsetPolicy(offsetStr)
+	if err != nil {
+		log.Fatalf("kafka-cluster: %s", err)
 	}
 	brokers = strings.Split(brokerStr, ",")
 
@@ -85,6 +87,15 @@ func ConfigProcess(instance string) {
 		log.Fatalf("kafka-cluster: invalid consumer config: %s", err)
 	}
 
+	switch messageFormat {
+	case "json":
+		messageVersion = mdata.PersistMessageBatchV1
+	case "protobuf":
+		messageVersion = mdata.PersistMessageBatchV2
+	default:
+		log.Fatalf("kafka-cluster: invalid message-format %q. must be json or protobuf", messageFormat)
+	}
+
 	backlogProcessTimeout, err = time.ParseDuration(backlogProcessTimeoutStr)
 	if err != nil {
 		log.Fatalf("kafka-cluster: unable to parse backlog-process-timeout. %s", err)
@@ -101,15 +112,23 @@ func ConfigProcess(instance string) {
 		}
 	}
 	// validate our partitions
-	client, err := sarama.NewClient(brokers, config)
+	b, err := kafkabus.New(brokers, config)
 	if err != nil {
 		log.Fatalf("kafka-cluster: failed to create client. %s", err)
 	}
-	defer client.Close()
+	defer b.Close()
+	initPartitions(b)
+}
 
-	availParts, err := kafka.GetPartitions(client, []string{topic})
+// initPartitions validates the configured partitions against the ones available on the bus,
+// and records the newest offsets, which are used to determine when the backlog has been processed.
+func initPartitions(b bus.Bus) {
+	availParts, err := b.Partitions(topic)
 	if err != nil {
-		log.Fatalf("kafka-cluster: %s", err.Error())
+		log.Fatalf("kafka-cluster: failed to get partitions for topic %s. %s", topic, err)
+	}
+	if len(availParts) == 0 {
+		log.Fatalf("kafka-cluster: no partitions returned for topic %s", topic)
 	}
 	if partitionStr == "*" {
 		partitions = availParts
@@ -130,7 +149,7 @@ func ConfigProcess(instance string) {
 	// caught up to these offsets.
 	bootTimeOffsets = make(map[int32]int64)
 	for _, part := range partitions {
-		offset, err := client.GetOffset(topic, part, sarama.OffsetNewest)
+		offset, err := b.Offset(topic, part, bus.OffsetNewest)
 		if err != nil {
 			log.Fatalf("kafka-cluster: failed to get newest offset for topic %s part %d: %s", topic, part, err)
 		}
@@ -9,52 +9,58 @@ import (
 
 	"github.com/raintank/schema"
 
-	"github.com/Shopify/sarama"
+	"github.com/grafana/metrictank/bus"
+	"github.com/grafana/metrictank/bus/kafkabus"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/util"
 	log "github.com/sirupsen/logrus"
 )
 
 type NotifierKafka struct {
-	instance string
-	in       chan mdata.SavedChunk
-	buf      []mdata.SavedChunk
-	wg       sync.WaitGroup
-	bPool    *util.BufferPool
-	handler  mdata.NotifierHandler
-	client   sarama.Client
-	consumer sarama.Consumer
-	producer sarama.SyncProducer
-	StopChan chan int
+	instance   string
+	in         chan mdata.SavedChunk
+	buf        []mdata.SavedChunk
+	inUnsaved  chan mdata.UnsavedChunk
+	bufUnsaved []mdata.UnsavedChunk
+	wg         sync.WaitGroup
+	bPool      *util.BufferPool
+	handler    mdata.NotifierHandler
+	bus        bus.Bus
+	StopChan   chan int
 
 	// signal to PartitionConsumers to shutdown
 	stopConsuming chan struct{}
 }
 
-func New(instance string, handler mdata.NotifierHandler) *NotifierKafka {
-	client, err := sarama.NewClient(brokers, config)
-	if err != nil {
-		log.Fatalf("kafka-cluster: failed to start client: %s", err)
-	}
-	consumer, err := sarama.NewConsumerFromClient(client)
-	if err != nil {
-		log.Fatalf("kafka-cluster: failed to initialize consumer: %s", err)
-	}
-	log.Info("kafka-cluster: consumer initialized without error")
+// SetReplayStart makes the notifier consume the persist messages from at least the given time on,
+// because the input replays the data from then on (see mdata.SetReplayStart):
+// the chunks that were saved since must not be saved again.
+// it must be called before New.
+func SetReplayStart(t time.Time) {
+	replayStart = t
+}
 
-	producer, err := sarama.NewSyncProducerFromClient(client)
+func New(instance string, handler mdata.NotifierHandler) *NotifierKafka {
+	b, err := kafkabus.New(brokers, config)
 	if err != nil {
-		log.Fatalf("kafka-cluster: failed to initialize producer: %s", err)
+		log.Fatalf("kafka-cluster: failed to initialize kafka: %s", err)
 	}
+	log.Info("kafka-cluster: kafka initialized without error")
+	return NewWithBus(instance, handler, b)
+}
 
+// NewWithBus creates a notifier that exchanges messages over the given bus,
+// rather than the kafka cluster from the kafka-cluster configuration.
+// the configured partitions are validated against the bus.
+func NewWithBus(instance string, handler mdata.NotifierHandler, b bus.Bus) *NotifierKafka {
+	initPartitions(b)
 	c := NotifierKafka{
-		instance: instance,
-		in:       make(chan mdata.SavedChunk),
-		bPool:    util.NewBufferPool(),
-		handler:  handler,
-		client:   client,
-		consumer: consumer,
-		producer: producer,
+		instance:  instance,
+		in:        make(chan mdata.SavedChunk),
+		inUnsaved: make(chan mdata.UnsavedChunk),
+		bPool:     util.NewBufferPool(),
+		handler:   handler,
+		bus:       b,
 
 		StopChan:      make(chan int),
 		stopConsuming: make(chan struct{}),
@@ -66,23 +72,18 @@ func New(instance string, handler mdata.NotifierHandler) *NotifierKafka {
 }
 
 func (c *NotifierKafka) start() {
-	var err error
 	pre := time.Now()
 	processBacklog := new(sync.WaitGroup)
+	// all partitions start consuming from the same point in time
+	now := time.Now()
 	for _, partition := range partitions {
-		var offset int64
-		switch offsetStr {
-		case "oldest":
-			offset = -2
-		case "newest":
-			offset = -1
-		default:
-			offset, err = c.client.GetOffset(topic, partition, time.Now().Add(-1*offsetDuration).UnixNano()/int64(time.Millisecond))
-			if err != nil {
-				offset = sarama.OffsetOldest
-				log.Warnf("kafka-cluster: failed to get offset %s: %s -> will use oldest instead", offsetDuration, err)
-			}
+		offset, err := offsetPolicy.Offset(now, func(ms int64) (int64, error) {
+			return c.bus.Offset(topic, partition, ms)
+		})
+		if err != nil {
+			log.Warnf("kafka-cluster: failed to get offset %s for partition %d: %s -> will use oldest instead", offsetPolicy, partition, err)
 		}
+		offset = c.replayOffset(partition, offset)
 		partitionLogSize[partition].Set(int(bootTimeOffsets[partition]))
 		if offset >= 0 {
 			partitionOffset[partition].Set(int(offset))
@@ -115,7 +116,7 @@ func (c *NotifierKafka) consumePartition(topic string, partition int32, currentO
 	c.wg.Add(1)
 	defer c.wg.Done()
 
-	pc, err := c.consumer.ConsumePartition(topic, partition, currentOffset)
+	pc, err := c.bus.Consume(topic, partition, currentOffset)
 	if err != nil {
 		log.Fatalf("kafka-cluster: failed to start partitionConsumer for %s:%d. %s", topic, partition, err)
 	}
@@ -141,7 +142,7 @@ func (c *NotifierKafka) consumePartition(topic string, partition int32, currentO
 				processBacklog.Done()
 				startingUp = false
 			}
-			offset, err := c.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			offset, err := c.bus.Offset(topic, partition, bus.OffsetNewest)
 			if err != nil {
 				log.Errorf("kafka-mdm failed to get log-size of partition %s:%d. %s", topic, partition, err)
 			} else {
@@ -163,16 +164,33 @@ func (c *NotifierKafka) consumePartition(topic string, partition int32, currentO
 	}
 }
 
+// replayOffset returns the offset to start consuming the partition from, given the offset as per the offset policy,
+// so that the persist messages of the chunks of which the data is replayed (see SetReplayStart) are consumed.
+func (c *NotifierKafka) replayOffset(partition int32, offset int64) int64 {
+	if replayStart.IsZero() || offset == bus.OffsetOldest {
+		return offset
+	}
+	replayOffset, err := c.bus.Offset(topic, partition, replayStart.UnixNano()/int64(time.Millisecond))
+	if err != nil || replayOffset < 0 {
+		log.Warnf("kafka-cluster: failed to get offset for replay start %s for partition %d: %v -> will use oldest instead", replayStart, partition, err)
+		return bus.OffsetOldest
+	}
+	if offset == bus.OffsetNewest || replayOffset < offset {
+		return replayOffset
+	}
+	return offset
+}
+
 // Stop will initiate a graceful stop of the Consumer (permanent)
 //
 // NOTE: receive on StopChan to block until this process completes
 func (c *NotifierKafka) Stop() {
 	// closes notifications and messages channels, amongst others
 	close(c.stopConsuming)
-	c.producer.Close()
 
 	go func() {
 		c.wg.Wait()
+		c.bus.Close()
 		close(c.StopChan)
 	}()
 }
@@ -181,6 +199,10 @@ func (c *NotifierKafka) Send(sc mdata.SavedChunk) {
 	c.in <- sc
 }
 
+func (c *NotifierKafka) SendUnsaved(uc mdata.UnsavedChunk) {
+	c.inUnsaved <- uc
+}
+
 func (c *NotifierKafka) produce() {
 	ticker := time.NewTicker(time.Second)
 	max := 5000
@@ -191,58 +213,85 @@ func (c *NotifierKafka) produce() {
 			if len(c.buf) == max {
 				c.flush()
 			}
+		case chunk := <-c.inUnsaved:
+			c.bufUnsaved = append(c.bufUnsaved, chunk)
+			if len(c.bufUnsaved) == max {
+				c.flush()
+			}
 		case <-ticker.C:
 			c.flush()
 		}
 	}
 }
 
+// encode encodes the batch with a leading version byte according to the configured message format
+// the returned buffer comes from the buffer pool
+func (c *NotifierKafka) encode(pMsg *mdata.PersistMessageBatch) []byte {
+	switch messageVersion {
+	case mdata.PersistMessageBatchV2:
+		data := append(c.bPool.Get(), messageVersion)
+		return pMsg.MarshalProto(data)
+	default:
+		buf := bytes.NewBuffer(c.bPool.Get())
+		binary.Write(buf, binary.LittleEndian, uint8(mdata.PersistMessageBatchV1))
+		encoder := json.NewEncoder(buf)
+		err := encoder.Encode(pMsg)
+		if err != nil {
+			log.Fatalf("kafka-cluster: failed to marshal persistMessage to json.")
+		}
+		return buf.Bytes()
+	}
+}
+
+// appendMessage encodes the batch, which concerns the chunk with the given key, into a message
+// routed to the partition of the series and appends it to the payload
+func (c *NotifierKafka) appendMessage(payload []*bus.Message, key string, pMsg *mdata.PersistMessageBatch) []*bus.Message {
+	amkey, err := schema.AMKeyFromString(key)
+	if err != nil {
+		log.Errorf("kafka-cluster: failed to parse key %q", key)
+		return payload
+	}
+
+	partition, ok := c.handler.PartitionOf(amkey.MKey)
+	if !ok {
+		log.Errorf("kafka-cluster: failed to lookup metricDef with id %s", key)
+		return payload
+	}
+	data := c.encode(pMsg)
+	messagesSize.Value(len(data))
+	return append(payload, &bus.Message{
+		Topic:     topic,
+		Value:     data,
+		Partition: partition,
+	})
+}
+
 // flush makes sure the batch gets sent, asynchronously.
 func (c *NotifierKafka) flush() {
-	if len(c.buf) == 0 {
+	if len(c.buf) == 0 && len(c.bufUnsaved) == 0 {
 		return
 	}
 
 	// In order to correctly route the saveMessages to the correct partition,
 	// we can't send them in batches anymore.
-	payload := make([]*sarama.ProducerMessage, 0, len(c.buf))
-	var pMsg mdata.PersistMessageBatch
+	payload := make([]*bus.Message, 0, len(c.buf)+len(c.bufUnsaved))
 	for i, msg := range c.buf {
-		amkey, err := schema.AMKeyFromString(msg.Key)
-		if err != nil {
-			log.Errorf("kafka-cluster: failed to parse key %q", msg.Key)
-			continue
-		}
-
-		partition, ok := c.handler.PartitionOf(amkey.MKey)
-		if !ok {
-			log.Errorf("kafka-cluster: failed to lookup metricDef with id %s", msg.Key)
-			continue
-		}
-		buf := bytes.NewBuffer(c.bPool.Get())
-		binary.Write(buf, binary.LittleEndian, uint8(mdata.PersistMessageBatchV1))
-		encoder := json.NewEncoder(buf)
-		pMsg = mdata.PersistMessageBatch{Instance: c.instance, SavedChunks: c.buf[i : i+1]}
-		err = encoder.Encode(&pMsg)
-		if err != nil {
-			log.Fatalf("kafka-cluster: failed to marshal persistMessage to json.")
-		}
-		messagesSize.Value(buf.Len())
-		kafkaMsg := &sarama.ProducerMessage{
-			Topic:     topic,
-			Value:     sarama.ByteEncoder(buf.Bytes()),
-			Partition: partition,
-		}
-		payload = append(payload, kafkaMsg)
+		pMsg := mdata.PersistMessageBatch{Instance: c.instance, SavedChunks: c.buf[i : i+1]}
+		payload = c.appendMessage(payload, msg.Key, &pMsg)
+	}
+	for i, msg := range c.bufUnsaved {
+		pMsg := mdata.PersistMessageBatch{Instance: c.instance, UnsavedChunks: c.bufUnsaved[i : i+1]}
+		payload = c.appendMessage(payload, msg.Key, &pMsg)
 	}
 
 	c.buf = nil
+	c.bufUnsaved = nil
 
 	go func() {
 		log.Debugf("kafka-cluster: sending %d batch metricPersist messages", len(payload))
 		sent := false
 		for !sent {
-			err := c.producer.SendMessages(payload)
+			err := c.bus.Publish(payload)
 			if err != nil {
 				log.Warnf("kafka-cluster: publisher %s", err)
 			} else {
@@ -253,7 +302,7 @@ func (c *NotifierKafka) flush() {
 		messagesPublished.Add(len(payload))
 		// put our buffers back in the bufferPool
 		for _, msg := range payload {
-			c.bPool.Put([]byte(msg.Value.(sarama.ByteEncoder)))
+			c.bPool.Put(msg.Value)
 		}
 	}()
 }
@@ -0,0 +1,58 @@
+package notifierKafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/bus"
+	"github.com/grafana/metrictank/bus/memorybus"
+	"github.com/grafana/metrictank/kafka"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+type mockHandler struct {
+	msgs chan []byte
+}
+
+func (m mockHandler) Handle(data []byte) {
+	m.msgs <- data
+}
+
+func (m mockHandler) PartitionOf(key schema.MKey) (int32, bool) {
+	return 1, true
+}
+
+func TestNotifierOverMemoryBus(t *testing.T) {
+	topic = "metricpersist"
+	offsetPolicy = kafka.OffsetPolicy{Str: "oldest"}
+	messageVersion = mdata.PersistMessageBatchV2
+
+	b := memorybus.New(map[string]int32{topic: 2})
+	handler := mockHandler{msgs: make(chan []byte, 1)}
+	n := NewWithBus("test", handler, b)
+
+	key := schema.AMKey{MKey: test.GetMKey(1)}
+	n.Send(mdata.SavedChunk{Key: key.String(), T0: 1200})
+
+	select {
+	case data := <-handler.msgs:
+		batch, err := mdata.DecodePersistMessageBatch(data)
+		if err != nil {
+			t.Fatalf("failed to decode message: %s", err)
+		}
+		if batch.Instance != "test" || len(batch.SavedChunks) != 1 || batch.SavedChunks[0].T0 != 1200 {
+			t.Fatalf("unexpected message %+v", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	if newest, _ := b.Offset(topic, 1, bus.OffsetNewest); newest != 1 {
+		t.Fatalf("expected message to be published to partition 1")
+	}
+
+	n.Stop()
+	<-n.StopChan
+}
@@ -0,0 +1,129 @@
+package mdata
+
+import (
+	"github.com/grafana/metrictank/protowire"
+)
+
+// this file implements the protocol buffers encoding of PersistMessageBatch, see protowire. the equivalent definition is:
+//
+// message PersistMessageBatch {
+//   string instance = 1;
+//   repeated SavedChunk saved_chunks = 2;
+//   repeated UnsavedChunk unsaved_chunks = 3;
+// }
+//
+// message SavedChunk {
+//   string key = 1;
+//   uint32 t0 = 2;
+// }
+//
+// message UnsavedChunk {
+//   string key = 1;
+//   uint32 t0 = 2;
+//   bytes data = 3;
+//   uint32 span = 4;
+// }
+
+func appendProtoChunkRef(b []byte, key string, t0 uint32) []byte {
+	if key != "" {
+		b = protowire.AppendString(b, 1, key)
+	}
+	if t0 != 0 {
+		b = protowire.AppendVarintField(b, 2, uint64(t0))
+	}
+	return b
+}
+
+// MarshalProto appends the protobuf encoding of the batch to b and returns the extended buffer
+func (m *PersistMessageBatch) MarshalProto(b []byte) []byte {
+	if m.Instance != "" {
+		b = protowire.AppendString(b, 1, m.Instance)
+	}
+	for _, c := range m.SavedChunks {
+		b = protowire.AppendMessage(b, 2, func(b []byte) []byte {
+			return appendProtoChunkRef(b, c.Key, c.T0)
+		})
+	}
+	for _, c := range m.UnsavedChunks {
+		b = protowire.AppendMessage(b, 3, func(b []byte) []byte {
+			b = appendProtoChunkRef(b, c.Key, c.T0)
+			if len(c.Data) != 0 {
+				b = protowire.AppendBytes(b, 3, c.Data)
+			}
+			if c.Span != 0 {
+				b = protowire.AppendVarintField(b, 4, uint64(c.Span))
+			}
+			return b
+		})
+	}
+	return b
+}
+
+// UnmarshalProto decodes the protobuf encoded batch. unknown fields are skipped.
+func (m *PersistMessageBatch) UnmarshalProto(data []byte) error {
+	for len(data) > 0 {
+		field, wireType, val, rest, err := protowire.ReadField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		switch {
+		case field == 1 && wireType == protowire.Bytes:
+			m.Instance = string(val)
+		case field == 2 && wireType == protowire.Bytes:
+			c, err := unmarshalProtoSavedChunk(val)
+			if err != nil {
+				return err
+			}
+			m.SavedChunks = append(m.SavedChunks, c)
+		case field == 3 && wireType == protowire.Bytes:
+			c, err := unmarshalProtoUnsavedChunk(val)
+			if err != nil {
+				return err
+			}
+			m.UnsavedChunks = append(m.UnsavedChunks, c)
+		}
+	}
+	return nil
+}
+
+func unmarshalProtoSavedChunk(data []byte) (SavedChunk, error) {
+	var c SavedChunk
+	for len(data) > 0 {
+		field, wireType, val, rest, err := protowire.ReadField(data)
+		if err != nil {
+			return c, err
+		}
+		data = rest
+		switch {
+		case field == 1 && wireType == protowire.Bytes:
+			c.Key = string(val)
+		case field == 2 && wireType == protowire.Varint:
+			c.T0 = uint32(protowire.Uvarint(val))
+		}
+	}
+	return c, nil
+}
+
+func unmarshalProtoUnsavedChunk(data []byte) (UnsavedChunk, error) {
+	var c UnsavedChunk
+	for len(data) > 0 {
+		field, wireType, val, rest, err := protowire.ReadField(data)
+		if err != nil {
+			return c, err
+		}
+		data = rest
+		switch {
+		case field == 1 && wireType == protowire.Bytes:
+			c.Key = string(val)
+		case field == 2 && wireType == protowire.Varint:
+			c.T0 = uint32(protowire.Uvarint(val))
+		case field == 3 && wireType == protowire.Bytes:
+			// val references the message buffer, which may get reused
+			c.Data = append([]byte(nil), val...)
+		case field == 4 && wireType == protowire.Varint:
+			c.Span = uint32(protowire.Uvarint(val))
+		}
+	}
+	return c, nil
+}
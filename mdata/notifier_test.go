@@ -0,0 +1,101 @@
+package mdata
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/protowire"
+)
+
+func TestPersistMessageBatchEncodings(t *testing.T) {
+	batches := []PersistMessageBatch{
+		{Instance: "mt1"},
+		{Instance: "mt1", SavedChunks: []SavedChunk{{Key: "1.01234567890123456789012345678901", T0: 1520000000}}},
+		{Instance: "some-instance", SavedChunks: []SavedChunk{
+			{Key: "1.01234567890123456789012345678901_sum_600", T0: 1520000000},
+			{Key: "2.01234567890123456789012345678901", T0: 0},
+			{Key: "", T0: 7200},
+		}},
+		{Instance: "mt2", UnsavedChunks: []UnsavedChunk{
+			{Key: "1.01234567890123456789012345678901_max_600", T0: 1520000000, Data: []byte{1, 2, 3}},
+			{Key: "1.01234567890123456789012345678901", T0: 1520000420, Span: 6780, Data: []byte{4, 5}},
+		}},
+	}
+	for i, batch := range batches {
+		jsonData, err := json.Marshal(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		protoData := batch.MarshalProto([]byte{PersistMessageBatchV2})
+		for _, data := range [][]byte{append([]byte{PersistMessageBatchV1}, jsonData...), protoData} {
+			got, err := DecodePersistMessageBatch(data)
+			if err != nil {
+				t.Fatalf("case %d: format %d: unexpected error %s", i, data[0], err)
+			}
+			if got.Instance != batch.Instance || len(got.SavedChunks) != len(batch.SavedChunks) || len(got.UnsavedChunks) != len(batch.UnsavedChunks) {
+				t.Fatalf("case %d: format %d: expected %v, got %v", i, data[0], batch, got)
+			}
+			if len(batch.SavedChunks) > 0 && !reflect.DeepEqual(got.SavedChunks, batch.SavedChunks) {
+				t.Fatalf("case %d: format %d: expected %v, got %v", i, data[0], batch.SavedChunks, got.SavedChunks)
+			}
+			if len(batch.UnsavedChunks) > 0 && !reflect.DeepEqual(got.UnsavedChunks, batch.UnsavedChunks) {
+				t.Fatalf("case %d: format %d: expected %v, got %v", i, data[0], batch.UnsavedChunks, got.UnsavedChunks)
+			}
+		}
+		if len(protoData) >= len(jsonData)+1 {
+			t.Fatalf("case %d: expected protobuf encoding (%d bytes) to be smaller than json (%d bytes)", i, len(protoData), len(jsonData)+1)
+		}
+	}
+}
+
+func TestDecodePersistMessageBatchErrors(t *testing.T) {
+	batch := PersistMessageBatch{Instance: "mt1", SavedChunks: []SavedChunk{{Key: "1.01234567890123456789012345678901", T0: 1520000000}}}
+	protoData := batch.MarshalProto([]byte{PersistMessageBatchV2})
+	cases := [][]byte{
+		nil,
+		{3, 1, 2, 3},
+		protoData[:len(protoData)-3],
+		{PersistMessageBatchV1, '{'},
+	}
+	for i, data := range cases {
+		if _, err := DecodePersistMessageBatch(data); err == nil {
+			t.Fatalf("case %d: expected error, got none", i)
+		}
+	}
+}
+
+// unknown fields must be skipped, so that fields can be added in the future
+func TestPersistMessageBatchProtoUnknownFields(t *testing.T) {
+	data := []byte{PersistMessageBatchV2}
+	data = protowire.AppendVarintField(data, 9, 300)
+	data = protowire.AppendString(data, 1, "mt1")
+	data = protowire.AppendKey(data, 10, protowire.Fixed32)
+	data = append(data, 0, 0, 0, 0)
+	got, err := DecodePersistMessageBatch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Instance != "mt1" {
+		t.Fatalf("expected instance mt1, got %q", got.Instance)
+	}
+}
+
+func BenchmarkDecodePersistMessageBatchJson(b *testing.B) {
+	batch := PersistMessageBatch{Instance: "mt1", SavedChunks: []SavedChunk{{Key: "1.01234567890123456789012345678901", T0: 1520000000}}}
+	jsonData, _ := json.Marshal(batch)
+	data := append([]byte{PersistMessageBatchV1}, jsonData...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodePersistMessageBatch(data)
+	}
+}
+
+func BenchmarkDecodePersistMessageBatchProto(b *testing.B) {
+	batch := PersistMessageBatch{Instance: "mt1", SavedChunks: []SavedChunk{{Key: "1.01234567890123456789012345678901", T0: 1520000000}}}
+	data := batch.MarshalProto([]byte{PersistMessageBatchV2})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodePersistMessageBatch(data)
+	}
+}
@@ -0,0 +1,84 @@
+package mdata
+
+import (
+	"fmt"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/schema"
+)
+
+var (
+	// the ttls and max chunkspan the store was set up with at startup.
+	// the store has tables (or column families) for these ttls only, and reads
+	// chunks from up to a max chunkspan before the requested range.
+	storeTTLs         []uint32
+	storeMaxChunkSpan uint32
+)
+
+// ReloadRetention re-reads the storage-schemas and storage-aggregation files and applies them,
+// see ApplyRetention. it returns the number of series that were updated.
+func ReloadRetention(ms *AggMetrics) (int, error) {
+	schemas, err := conf.ReadSchemas(schemasFile)
+	if err != nil {
+		return 0, fmt.Errorf("can't read schemas file %q: %s", schemasFile, err)
+	}
+	aggs, err := readAggregations(aggFile)
+	if err != nil {
+		return 0, fmt.Errorf("can't read storage-aggregation file %q: %s", aggFile, err)
+	}
+	return ApplyRetention(ms, schemas, aggs)
+}
+
+// ApplyRetention replaces the current schemas and aggregations with the given ones, if they are compatible
+// (see conf.Schemas.CheckReload and conf.Aggregations.CheckReload) and the store supports their ttls and chunkspans.
+// the new number of chunks and ttls are applied to the existing series in ms (which may be nil).
+// other settings, such as the chunkspan and the reorder buffer, only apply to series created afterwards.
+// it returns the number of series that were updated.
+func ApplyRetention(ms *AggMetrics, schemas conf.Schemas, aggs conf.Aggregations) (int, error) {
+	schemasLock.Lock()
+	if err := Schemas.CheckReload(schemas); err != nil {
+		schemasLock.Unlock()
+		return 0, fmt.Errorf("storage-schemas: %s. this requires a restart", err)
+	}
+	if err := Aggregations.CheckReload(aggs); err != nil {
+		schemasLock.Unlock()
+		return 0, fmt.Errorf("storage-aggregation: %s. this requires a restart", err)
+	}
+	if err := checkStoreSupports(schemas); err != nil {
+		schemasLock.Unlock()
+		return 0, fmt.Errorf("storage-schemas: %s. this requires a restart", err)
+	}
+	Schemas = schemas
+	Aggregations = aggs
+	schemasLock.Unlock()
+
+	if ms == nil {
+		return 0, nil
+	}
+	var updated int
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		rets := schemas.Get(m.schemaId).Retentions
+		m.SetRetentions(rets)
+		m.SetXFilesFactor(aggs.Get(m.aggId).XFilesFactor, rets[0].SecondsPerPoint)
+		updated++
+		return true
+	})
+	return updated, nil
+}
+
+// checkStoreSupports returns an error if the store wasn't set up for the ttls or chunkspans of the schemas
+func checkStoreSupports(schemas conf.Schemas) error {
+	known := make(map[uint32]struct{}, len(storeTTLs))
+	for _, ttl := range storeTTLs {
+		known[ttl] = struct{}{}
+	}
+	for _, ttl := range schemas.TTLs() {
+		if _, ok := known[ttl]; !ok {
+			return fmt.Errorf("the store has no table for ttl %d", ttl)
+		}
+	}
+	if max := schemas.MaxChunkSpan(); max > storeMaxChunkSpan {
+		return fmt.Errorf("chunkspan %d exceeds the max chunkspan of %d the store was set up with", max, storeMaxChunkSpan)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestApplyRetention(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+
+	retentions := func(numChunks, ttl uint32) conf.Retentions {
+		return conf.Retentions{
+			conf.NewRetentionMT(10, ttl, 60, numChunks, 0),
+			conf.NewRetentionMT(60, 7200, 600, 2, 0),
+		}
+	}
+	SetSingleSchema(retentions(5, 3600)...)
+	SetSingleAgg(conf.Sum)
+	defer func(ttls []uint32, span uint32) { storeTTLs, storeMaxChunkSpan = ttls, span }(storeTTLs, storeMaxChunkSpan)
+	storeTTLs = []uint32{3600, 7200}
+	storeMaxChunkSpan = 600
+
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+	m := getOrCreate(ms, test.GetMKey(1))
+	// fills chunks 60 through 360, so the buffer of 5 has wrapped around
+	for ts := uint32(60); ts < 420; ts += 10 {
+		m.Add(ts, 1)
+	}
+
+	apply := func(rets conf.Retentions) (int, error) {
+		schemas := conf.NewSchemas(nil)
+		schemas.DefaultSchema.Retentions = rets
+		schemas.BuildIndex()
+		aggs := conf.NewAggregations()
+		aggs.DefaultAggregation.AggregationMethod = []conf.Method{conf.Sum}
+		return ApplyRetention(ms, schemas, aggs)
+	}
+	t0s := func() []uint32 {
+		var out []uint32
+		for i := 1; i <= len(m.Chunks); i++ {
+			out = append(out, m.Chunks[(m.CurrentChunkPos+i)%len(m.Chunks)].Series.T0)
+		}
+		return out
+	}
+
+	// shrinking keeps the most recent chunks
+	updated, err := apply(retentions(2, 7200))
+	if err != nil {
+		t.Fatalf("expected reload to succeed, got %s", err)
+	}
+	if updated != 1 {
+		t.Fatalf("expected 1 series to be updated, got %d", updated)
+	}
+	if m.NumChunks != 2 || m.ttl != 7200 {
+		t.Fatalf("expected 2 chunks and ttl 7200, got %d and %d", m.NumChunks, m.ttl)
+	}
+	if got := t0s(); len(got) != 2 || got[0] != 300 || got[1] != 360 {
+		t.Fatalf("expected chunks 300 and 360 to remain, got %v", got)
+	}
+	if ttl := GetSchema(0).Retentions[0].MaxRetention(); ttl != 7200 {
+		t.Fatalf("expected the new schema to be current, got ttl %d", ttl)
+	}
+
+	// growing adds chunks rather than replacing the oldest
+	if _, err := apply(retentions(3, 7200)); err != nil {
+		t.Fatalf("expected reload to succeed, got %s", err)
+	}
+	m.Add(420, 1)
+	if got := t0s(); len(got) != 3 || got[0] != 300 || got[2] != 420 {
+		t.Fatalf("expected chunks 300 through 420, got %v", got)
+	}
+	m.Add(480, 1)
+	if got := t0s(); len(got) != 3 || got[0] != 360 || got[2] != 480 {
+		t.Fatalf("expected chunks 360 through 480, got %v", got)
+	}
+
+	// the rollups get their own retention
+	sum := m.archiveMetric(schema.NewArchive(schema.Sum, 60))
+	if sum.NumChunks != 2 || sum.ttl != 7200 {
+		t.Fatalf("expected rollup to keep 2 chunks and ttl 7200, got %d and %d", sum.NumChunks, sum.ttl)
+	}
+
+	if _, err := apply(retentions(3, 1800)); err == nil {
+		t.Fatalf("expected reload with a ttl the store doesn't know to be refused")
+	}
+	if _, err := apply(conf.Retentions{conf.NewRetentionMT(10, 7200, 60, 3, 0)}); err == nil {
+		t.Fatalf("expected reload with different retentions to be refused")
+	}
+	if ttl := GetSchema(0).Retentions[0].MaxRetention(); ttl != 7200 {
+		t.Fatalf("expected refused reloads not to change the schema, got ttl %d", ttl)
+	}
+}
@@ -0,0 +1,170 @@
+package mdata
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/mdata/chunk/tsz"
+	"github.com/raintank/schema"
+)
+
+// copyChunk returns a finished chunk with the points of the iterator
+func copyChunk(t0 uint32, it tsz.Iter) (*chunk.Chunk, error) {
+	c := chunk.New(t0)
+	for it.Next() {
+		ts, val := it.Values()
+		if err := c.Push(ts, val); err != nil {
+			return nil, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	c.Finish()
+	return c, nil
+}
+
+// chunkCopy is a copy of a chunk, along with its span
+type chunkCopy struct {
+	c    *chunk.Chunk
+	span uint32
+}
+
+// chunkCopies returns copies of the chunks in memory, by t0
+func (a *AggMetric) chunkCopies() (map[uint32]chunkCopy, error) {
+	a.RLock()
+	defer a.RUnlock()
+	out := make(map[uint32]chunkCopy)
+	for _, c := range a.Chunks {
+		if c == nil {
+			continue
+		}
+		cp, err := copyChunk(c.Series.T0, c.Series.Iter())
+		if err != nil {
+			return nil, err
+		}
+		out[c.Series.T0] = chunkCopy{cp, a.spanOf(c)}
+	}
+	return out, nil
+}
+
+// searchTTL returns the chunks of the archive that have not expired yet
+func (ms *AggMetrics) searchTTL(ctx context.Context, a archiveTTL, now uint32) ([]chunk.IterGen, error) {
+	var start uint32
+	if now > a.ttl {
+		start = now - a.ttl
+	}
+	return ms.store.Search(ctx, a.key, a.ttl, start, now+1)
+}
+
+// chunkT0s returns the t0's of the chunks of the archive, in the store and in memory
+func (ms *AggMetrics) chunkT0s(ctx context.Context, a archiveTTL, now uint32) (map[uint32]struct{}, error) {
+	out := make(map[uint32]struct{})
+	itgens, err := ms.searchTTL(ctx, a, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, itgen := range itgens {
+		out[itgen.T0] = struct{}{}
+	}
+	ms.memChunkT0s(a.key, out)
+	return out, nil
+}
+
+// memChunkT0s adds the t0's of the chunks of the archive in memory to t0s
+func (ms *AggMetrics) memChunkT0s(key schema.AMKey, t0s map[uint32]struct{}) {
+	m, ok := ms.shard(key.MKey).get(key.MKey)
+	if !ok {
+		return
+	}
+	for _, am := range m.archiveMetrics() {
+		if am.Key != key {
+			continue
+		}
+		am.RLock()
+		for _, c := range am.Chunks {
+			if c != nil {
+				t0s[c.Series.T0] = struct{}{}
+			}
+		}
+		am.RUnlock()
+	}
+}
+
+// CopySeries copies the data of series from, with the given storage-schemas and storage-aggregation rules,
+// to series to, with its own rules. for every archive that both have, it saves the chunks in the store
+// and the ones in memory (including the ones that were not saved yet) under the key of the new series.
+// chunks are saved with the full ttl of the archive, so they expire somewhat later than the originals.
+// chunks of which the new series already has a chunk with the same t0 are not copied: its own data takes precedence.
+// it returns the number of copied chunks.
+func (ms *AggMetrics) CopySeries(ctx context.Context, from, to schema.MKey, fromSchemaId, fromAggId, toSchemaId, toAggId uint16) (int, error) {
+	mem := make(map[schema.Archive]map[uint32]chunkCopy)
+	if m, ok := ms.shard(from).get(from); ok {
+		for _, am := range m.archiveMetrics() {
+			chunks, err := am.chunkCopies()
+			if err != nil {
+				return 0, err
+			}
+			mem[am.Key.Archive] = chunks
+		}
+	}
+
+	toArchives := make(map[schema.Archive]archiveTTL)
+	for _, a := range seriesArchives(to, toSchemaId, toAggId) {
+		toArchives[a.key.Archive] = a
+	}
+
+	now := uint32(time.Now().Unix())
+	var copied int
+	for _, src := range seriesArchives(from, fromSchemaId, fromAggId) {
+		dst, ok := toArchives[src.key.Archive]
+		if !ok {
+			continue
+		}
+		existing, err := ms.chunkT0s(ctx, dst, now)
+		if err != nil {
+			return copied, err
+		}
+
+		chunks := mem[src.key.Archive]
+		if chunks == nil {
+			chunks = make(map[uint32]chunkCopy)
+		}
+		itgens, err := ms.searchTTL(ctx, src, now)
+		if err != nil {
+			return copied, err
+		}
+		for _, itgen := range itgens {
+			if _, ok := chunks[itgen.T0]; ok {
+				// the copy in memory is at least as complete
+				continue
+			}
+			it, err := itgen.Get()
+			if err != nil {
+				return copied, err
+			}
+			c, err := copyChunk(itgen.T0, it)
+			tsz.ReleaseIter(it)
+			if err != nil {
+				return copied, err
+			}
+			span := itgen.Span()
+			if span == 0 {
+				// the format doesn't record the span
+				span = src.span
+			}
+			chunks[itgen.T0] = chunkCopy{c, span}
+		}
+
+		for t0, cp := range chunks {
+			if _, ok := existing[t0]; ok {
+				continue
+			}
+			cwr := NewChunkWriteRequest(nil, dst.key, cp.c, dst.ttl, cp.span, time.Now())
+			ms.store.Add(&cwr)
+			copied++
+		}
+	}
+	return copied, nil
+}
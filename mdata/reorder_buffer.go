@@ -1,6 +1,9 @@
 package mdata
 
 import (
+	"math"
+
+	"github.com/grafana/metrictank/conf"
 	"github.com/raintank/schema"
 )
 
@@ -13,9 +16,10 @@ import (
 // in particular newest.Ts == 0 means the buffer is empty
 // the buffer is evenly spaced (points are `interval` apart) and may be sparsely populated
 type ReorderBuffer struct {
-	newest   uint32         // index of newest buffer entry
-	interval uint32         // metric interval
-	buf      []schema.Point // the actual buffer holding the data
+	newest    uint32         // index of newest buffer entry
+	interval  uint32         // metric interval
+	buf       []schema.Point // the actual buffer holding the data
+	dupPolicy conf.DupPolicy // how to resolve points with the same timestamp as a point in the buffer
 }
 
 func NewReorderBuffer(reorderWindow uint32, interval int) *ReorderBuffer {
@@ -28,12 +32,20 @@ func NewReorderBuffer(reorderWindow uint32, interval int) *ReorderBuffer {
 // Add adds the point if it falls within the window.
 // it returns points that have been purged out of the buffer, as well as whether the add succeeded.
 func (rob *ReorderBuffer) Add(ts uint32, val float64) ([]schema.Point, bool) {
+	res, result := rob.add(ts, val)
+	return res, result != AddTooOld
+}
+
+// add is like Add, but returns what became of the point:
+// AddTooOld if it was dropped, AddDuplicate if it was merged with the point we have as per the duplicatePolicy,
+// and AddAccepted otherwise.
+func (rob *ReorderBuffer) add(ts uint32, val float64) ([]schema.Point, AddResult) {
 	ts = AggBoundary(ts, rob.interval)
 
 	// out of order and too old
 	if rob.buf[rob.newest].Ts != 0 && ts <= rob.buf[rob.newest].Ts-(uint32(cap(rob.buf))*rob.interval) {
 		metricsTooOld.Inc()
-		return nil, false
+		return nil, AddTooOld
 	}
 
 	var res []schema.Point
@@ -55,13 +67,17 @@ func (rob *ReorderBuffer) Add(ts uint32, val float64) ([]schema.Point, bool) {
 		rob.buf[index].Ts = ts
 		rob.buf[index].Val = val
 		rob.newest = index
+	} else if rob.buf[index].Ts == ts {
+		metricsDuplicate.Inc()
+		rob.buf[index].Val = resolveDup(rob.dupPolicy, rob.buf[index].Val, val)
+		return res, AddDuplicate
 	} else {
 		metricsReordered.Inc()
 		rob.buf[index].Ts = ts
 		rob.buf[index].Val = val
 	}
 
-	return res, true
+	return res, AddAccepted
 }
 
 // Get returns the points in the buffer
@@ -99,3 +115,24 @@ func (rob *ReorderBuffer) Flush() []schema.Point {
 func (rob *ReorderBuffer) IsEmpty() bool {
 	return rob.buf[rob.newest].Ts == 0
 }
+
+// resolveDup returns the value to keep for a timestamp that received the value old, and then new, as per the policy
+// for keep-max and sum, nulls (NaN) count as no value.
+func resolveDup(policy conf.DupPolicy, old, new float64) float64 {
+	switch policy {
+	case conf.DupKeepFirst:
+		return old
+	case conf.DupKeepMax, conf.DupSum:
+		if math.IsNaN(old) {
+			return new
+		}
+		if math.IsNaN(new) {
+			return old
+		}
+		if policy == conf.DupKeepMax {
+			return math.Max(old, new)
+		}
+		return old + new
+	}
+	return new
+}
@@ -9,4 +9,113 @@ type Result struct {
 	Points []schema.Point
 	Iters  []tsz.Iter
 	Oldest uint32 // timestamp of oldest point we have, to know when and when not we may need to query slower storage
+	// the oldest of the Iters is the first chunk of the series, and possibly incomplete: it only has the data from
+	// Oldest on, because that's when we started receiving data (e.g. after a restart). the data before it may be
+	// in the store, which may also have the complete chunk, in which case its data overlaps with ours.
+	Partial bool
+}
+
+// combineResults returns the result of fn applied to the values of a and b, results of two archives of a series.
+// the values are combined when they are read, and points that only one of both has are left out.
+// e.g. the averages are the sums divided by the counts.
+func combineResults(a, b Result, fn func(a, b float64) float64) Result {
+	res := Result{
+		Oldest:  a.Oldest,
+		Partial: a.Partial || b.Partial,
+	}
+	if b.Oldest > res.Oldest {
+		res.Oldest = b.Oldest
+	}
+	if len(a.Iters) > 0 && len(b.Iters) > 0 {
+		res.Iters = []tsz.Iter{&combineIter{
+			a:  chainIter{iters: a.Iters},
+			b:  chainIter{iters: b.Iters},
+			fn: fn,
+		}}
+	}
+	var j int
+	for _, p := range a.Points {
+		for j < len(b.Points) && b.Points[j].Ts < p.Ts {
+			j++
+		}
+		if j < len(b.Points) && b.Points[j].Ts == p.Ts {
+			res.Points = append(res.Points, schema.Point{Val: fn(p.Val, b.Points[j].Val), Ts: p.Ts})
+		}
+	}
+	return res
+}
+
+// chainIter iterates over the points of several iterators, one after the other
+type chainIter struct {
+	iters []tsz.Iter
+	pos   int
+}
+
+func (c *chainIter) Next() bool {
+	for c.pos < len(c.iters) {
+		it := c.iters[c.pos]
+		if it.Next() {
+			return true
+		}
+		if it.Err() != nil {
+			return false
+		}
+		c.pos++
+	}
+	return false
+}
+
+func (c *chainIter) Values() (uint32, float64) {
+	return c.iters[c.pos].Values()
+}
+
+func (c *chainIter) Err() error {
+	if c.pos < len(c.iters) {
+		return c.iters[c.pos].Err()
+	}
+	return nil
+}
+
+// combineIter iterates over the points that iterators a and b both have,
+// and returns fn applied to their values for each of them
+type combineIter struct {
+	a, b chainIter
+	fn   func(a, b float64) float64
+	ts   uint32
+	val  float64
+}
+
+func (c *combineIter) Next() bool {
+	if !c.a.Next() || !c.b.Next() {
+		return false
+	}
+	for {
+		aTs, aVal := c.a.Values()
+		bTs, bVal := c.b.Values()
+		switch {
+		case aTs < bTs:
+			if !c.a.Next() {
+				return false
+			}
+		case bTs < aTs:
+			if !c.b.Next() {
+				return false
+			}
+		default:
+			c.ts = aTs
+			c.val = c.fn(aVal, bVal)
+			return true
+		}
+	}
+}
+
+func (c *combineIter) Values() (uint32, float64) {
+	return c.ts, c.val
+}
+
+func (c *combineIter) Err() error {
+	if err := c.a.Err(); err != nil {
+		return err
+	}
+	return c.b.Err()
 }
@@ -1,28 +1,55 @@
 package mdata
 
 import (
+	"sync"
+
 	"github.com/grafana/metrictank/conf"
 )
 
+// schemasLock protects Schemas and Aggregations against them being replaced by ReloadRetention
+var schemasLock sync.RWMutex
+
 func MaxChunkSpan() uint32 {
+	schemasLock.RLock()
+	defer schemasLock.RUnlock()
 	return Schemas.MaxChunkSpan()
 }
 
 // TTLs returns the full set of unique TTLs (in seconds) used by the current schema config.
 func TTLs() []uint32 {
+	schemasLock.RLock()
+	defer schemasLock.RUnlock()
 	return Schemas.TTLs()
 }
 
-// MatchAgg returns the aggregation definition for the given metric key, and the index of it (to efficiently reference it)
+// MatchAgg returns the aggregation definition for the given metric key of the given org, and the index of it (to efficiently reference it)
 // it will always find the aggregation definition because Aggregations has a catchall default
-func MatchAgg(key string) (uint16, conf.Aggregation) {
-	return Aggregations.Match(key)
+func MatchAgg(org uint32, key string) (uint16, conf.Aggregation) {
+	schemasLock.RLock()
+	defer schemasLock.RUnlock()
+	return Aggregations.Match(org, key)
 }
 
-// MatchSchema returns the schema for the given metric key, and the index of the schema (to efficiently reference it)
+// MatchSchema returns the schema for the given metric key of the given org, and the index of the schema (to efficiently reference it)
 // it will always find the schema because Schemas has a catchall default
-func MatchSchema(key string, interval int) (uint16, conf.Schema) {
-	return Schemas.Match(key, interval)
+func MatchSchema(org uint32, key string, interval int) (uint16, conf.Schema) {
+	schemasLock.RLock()
+	defer schemasLock.RUnlock()
+	return Schemas.Match(org, key, interval)
+}
+
+// GetAgg returns the aggregation definition with the given index
+func GetAgg(id uint16) conf.Aggregation {
+	schemasLock.RLock()
+	defer schemasLock.RUnlock()
+	return Aggregations.Get(id)
+}
+
+// GetSchema returns the schema with the given index
+func GetSchema(id uint16) conf.Schema {
+	schemasLock.RLock()
+	defer schemasLock.RUnlock()
+	return Schemas.Get(id)
 }
 
 func SetSingleSchema(ret ...conf.Retention) {
@@ -0,0 +1,114 @@
+package mdata
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SeriesLimitError is returned when a series can't be created because its org reached its series limit
+type SeriesLimitError struct {
+	Org   uint32
+	Limit int
+}
+
+func (e SeriesLimitError) Error() string {
+	return fmt.Sprintf("org %d reached its limit of %d series", e.Org, e.Limit)
+}
+
+// OrgSeries describes the number of series of an org and its limit
+type OrgSeries struct {
+	OrgId  uint32 `json:"orgId"`
+	Series int    `json:"series"`
+	Limit  int    `json:"limit"` // 0 means no limit
+}
+
+// seriesLimits tracks the number of live series (AggMetrics) per org, and their limits
+type seriesLimits struct {
+	sync.RWMutex
+	limit     int            // default limit of each org. 0 means no limit
+	overrides map[uint32]int // limits of orgs that don't use the default
+	counts    map[uint32]int
+}
+
+func newSeriesLimits() *seriesLimits {
+	return &seriesLimits{
+		overrides: make(map[uint32]int),
+		counts:    make(map[uint32]int),
+	}
+}
+
+// caller must hold lock
+func (l *seriesLimits) get(org uint32) int {
+	if limit, ok := l.overrides[org]; ok {
+		return limit
+	}
+	return l.limit
+}
+
+// reserve counts a new series of the org, or returns a SeriesLimitError if the org reached its limit
+func (l *seriesLimits) reserve(org uint32) error {
+	l.Lock()
+	defer l.Unlock()
+	limit := l.get(org)
+	if limit != 0 && l.counts[org] >= limit {
+		return SeriesLimitError{Org: org, Limit: limit}
+	}
+	l.counts[org]++
+	return nil
+}
+
+func (l *seriesLimits) add(org uint32, delta int) {
+	l.Lock()
+	l.counts[org] += delta
+	if l.counts[org] <= 0 {
+		delete(l.counts, org)
+	}
+	l.Unlock()
+}
+
+// SetSeriesLimit sets the max number of series each org may have in memory. 0 means no limit.
+func (ms *AggMetrics) SetSeriesLimit(limit int) {
+	ms.limits.Lock()
+	ms.limits.limit = limit
+	ms.limits.Unlock()
+}
+
+// SetOrgSeriesLimit overrides the max number of series the org may have in memory. 0 means no limit.
+// a negative limit removes the override, so that the org is subject to the default limit again.
+// series the org has in excess of its limit are not removed, but no new series are accepted.
+func (ms *AggMetrics) SetOrgSeriesLimit(org uint32, limit int) {
+	ms.limits.Lock()
+	if limit < 0 {
+		delete(ms.limits.overrides, org)
+	} else {
+		ms.limits.overrides[org] = limit
+	}
+	ms.limits.Unlock()
+}
+
+// SeriesLimits returns the number of series and the limit of every org that has series or a limit override,
+// sorted by org.
+func (ms *AggMetrics) SeriesLimits() []OrgSeries {
+	ms.limits.RLock()
+	defer ms.limits.RUnlock()
+	orgs := make(map[uint32]struct{})
+	for org := range ms.limits.counts {
+		orgs[org] = struct{}{}
+	}
+	for org := range ms.limits.overrides {
+		orgs[org] = struct{}{}
+	}
+	out := make([]OrgSeries, 0, len(orgs))
+	for org := range orgs {
+		out = append(out, OrgSeries{
+			OrgId:  org,
+			Series: ms.limits.counts[org],
+			Limit:  ms.limits.get(org),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].OrgId < out[j].OrgId
+	})
+	return out
+}
@@ -0,0 +1,85 @@
+package mdata
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/raintank/schema"
+)
+
+func TestSeriesLimits(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 5, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 0, 0, 0, 0)
+	ms.SetSeriesLimit(2)
+
+	key := func(org uint32, i byte) schema.MKey {
+		return schema.MKey{Key: schema.Key{i}, Org: org}
+	}
+	getOrCreate(ms, key(1, 0))
+	getOrCreate(ms, key(1, 1))
+	getOrCreate(ms, key(2, 0))
+
+	if _, err := ms.GetOrCreate(key(1, 2), 0, 0); err != (SeriesLimitError{Org: 1, Limit: 2}) {
+		t.Fatalf("expected new series of org 1 to be rejected, got %v", err)
+	}
+	if _, ok := ms.Get(key(1, 2)); ok {
+		t.Fatalf("expected the rejected series not to be created")
+	}
+	if _, err := ms.GetOrCreate(key(1, 0), 0, 0); err != nil {
+		t.Fatalf("expected existing series of org 1 to be accepted, got %s", err)
+	}
+
+	ms.SetOrgSeriesLimit(1, 3)
+	ms.SetOrgSeriesLimit(3, 0)
+	exp := []OrgSeries{
+		{OrgId: 1, Series: 2, Limit: 3},
+		{OrgId: 2, Series: 1, Limit: 2},
+		{OrgId: 3, Series: 0, Limit: 0},
+	}
+	if got := ms.SeriesLimits(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	if _, err := ms.GetOrCreate(key(1, 2), 0, 0); err != nil {
+		t.Fatalf("expected new series of org 1 to be accepted after override, got %s", err)
+	}
+
+	// removing the override and a series brings org 1 back to its default limit
+	ms.SetOrgSeriesLimit(1, -1)
+	if _, err := ms.GetOrCreate(key(1, 3), 0, 0); err == nil {
+		t.Fatalf("expected new series of org 1 to be rejected after removing override")
+	}
+	ms.shard(key(1, 0)).remove(key(1, 0))
+	ms.shard(key(1, 1)).remove(key(1, 1))
+	if _, err := ms.GetOrCreate(key(1, 3), 0, 0); err != nil {
+		t.Fatalf("expected new series of org 1 to be accepted after removing series, got %s", err)
+	}
+}
+
+// concurrent creations of new series can't exceed the limit
+func TestSeriesLimitsConcurrent(t *testing.T) {
+	SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 5, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 0, 0, 0, 0)
+	ms.SetSeriesLimit(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i byte) {
+			defer wg.Done()
+			ms.GetOrCreate(schema.MKey{Key: schema.Key{i}, Org: 1}, 0, 0)
+		}(byte(i))
+	}
+	wg.Wait()
+	exp := []OrgSeries{{OrgId: 1, Series: 10, Limit: 10}}
+	if got := ms.SeriesLimits(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+}
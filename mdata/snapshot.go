@@ -0,0 +1,321 @@
+package mdata
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// a snapshot holds the state of the in-memory store that is not in the store yet:
+// the chunks that were not (confirmed to be) saved, the contents of reorder buffers and the state of aggregators.
+// it is written upon graceful shutdown and restored at startup, so that restarts don't lose that data.
+// the file is a stream of gob encoded values: a snapshotHeader, followed by a seriesSnapshot per series.
+
+const (
+	snapshotVersion = 2 // version 2 added the checksums of the chunks. version 1 snapshots are still restored
+	snapshotFile    = "snapshot.gob"
+)
+
+type snapshotHeader struct {
+	Version int
+	Created int64
+}
+
+type seriesSnapshot struct {
+	Key         schema.MKey
+	SchemaId    uint16
+	AggId       uint16
+	Rob         []schema.Point
+	Aggregators []aggregatorSnapshot
+	Archives    []archiveSnapshot // the raw archive, followed by the rollups
+}
+
+type aggregatorSnapshot struct {
+	Span            uint32
+	CurrentBoundary uint32
+	Agg             Aggregation
+}
+
+type archiveSnapshot struct {
+	Archive        schema.Archive
+	ChunkSpan      uint32
+	Chunks         []chunkSnapshot // oldest first. the last one is the current chunk
+	LastSaveFinish uint32
+	LastWrite      uint32
+	FirstTs        uint32
+}
+
+type chunkSnapshot struct {
+	Series    []byte // as per tsz.SeriesLong.MarshalBinary
+	Checksum  uint32 // of Series, see chunk.Checksum
+	NumPoints uint32
+	First     bool
+	Finished  bool
+	End       uint32 // see chunk.Chunk. 0 in snapshots taken before chunks could be rolled over
+}
+
+// SaveSnapshot writes the unsaved state of all series to the snapshot dir, if snapshots are enabled.
+// there must be no writes to the series while it runs, so inputs should be stopped first.
+// it returns the number of series written.
+func (ms *AggMetrics) SaveSnapshot() (int, error) {
+	if !snapshotEnabled {
+		return 0, nil
+	}
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return 0, err
+	}
+	path := filepath.Join(snapshotDir, snapshotFile)
+	// write to a temporary file first, so that we never leave a partial snapshot behind
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	n, err := ms.writeSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	return n, os.Rename(path+".tmp", path)
+}
+
+func (ms *AggMetrics) writeSnapshot(w io.Writer) (int, error) {
+	enc := gob.NewEncoder(w)
+	err := enc.Encode(snapshotHeader{
+		Version: snapshotVersion,
+		Created: time.Now().Unix(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		err = enc.Encode(m.snapshot(key))
+		if err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	return n, err
+}
+
+// LoadSnapshot restores the series from the snapshot in the snapshot dir, if snapshots are enabled and there is one.
+// the snapshot is removed afterwards, so that it can't be restored again after a crash, when it would be outdated.
+// it must be called before any data is added.
+// it returns the number of series restored.
+func (ms *AggMetrics) LoadSnapshot() (int, error) {
+	if !snapshotEnabled {
+		return 0, nil
+	}
+	path := filepath.Join(snapshotDir, snapshotFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := ms.readSnapshot(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return n, err
+	}
+	return n, os.Remove(path)
+}
+
+func (ms *AggMetrics) readSnapshot(r io.Reader) (int, error) {
+	dec := gob.NewDecoder(r)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, err
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	verify := header.Version >= 2
+	var n int
+	for {
+		var s seriesSnapshot
+		err := dec.Decode(&s)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		m, err := ms.GetOrCreate(s.Key, s.SchemaId, s.AggId)
+		if err != nil {
+			log.Warnf("snapshot: not restoring series %s: %s", s.Key, err)
+			continue
+		}
+		m.(*AggMetric).restore(s, verify)
+		n++
+	}
+}
+
+// snapshot returns the unsaved state of the metric and its rollups
+func (a *AggMetric) snapshot(key schema.MKey) seriesSnapshot {
+	s := seriesSnapshot{
+		Key:      key,
+		SchemaId: a.schemaId,
+		AggId:    a.aggId,
+	}
+	// the state of the aggregators is updated under our lock
+	a.RLock()
+	if a.rob != nil {
+		s.Rob = a.rob.Get()
+	}
+	for _, agg := range a.aggregators {
+		s.Aggregators = append(s.Aggregators, aggregatorSnapshot{
+			Span:            agg.span,
+			CurrentBoundary: agg.currentBoundary,
+			Agg:             *agg.agg,
+		})
+	}
+	a.RUnlock()
+	for _, am := range a.archiveMetrics() {
+		s.Archives = append(s.Archives, am.snapshotArchive())
+	}
+	return s
+}
+
+// snapshotArchive returns the chunks that were not confirmed to be saved, oldest first.
+func (a *AggMetric) snapshotArchive() archiveSnapshot {
+	a.RLock()
+	defer a.RUnlock()
+	s := archiveSnapshot{
+		Archive:        a.Key.Archive,
+		ChunkSpan:      a.ChunkSpan,
+		LastSaveFinish: a.lastSaveFinish,
+		LastWrite:      a.lastWrite,
+		FirstTs:        a.firstTs,
+	}
+	if len(a.Chunks) == 0 {
+		return s
+	}
+	// walk from the oldest chunk to the current one
+	for i := 1; i <= len(a.Chunks); i++ {
+		c := a.Chunks[(a.CurrentChunkPos+i)%len(a.Chunks)]
+		if c.Series.T0 <= a.lastSaveFinish {
+			continue
+		}
+		data, err := c.Series.MarshalBinary()
+		if err != nil {
+			// can't happen: we write to a buffer
+			log.Errorf("snapshot: failed to marshal chunk %d of %s: %s", c.Series.T0, a.Key, err)
+			continue
+		}
+		s.Chunks = append(s.Chunks, chunkSnapshot{
+			Series:    data,
+			Checksum:  chunk.Checksum(data),
+			NumPoints: c.NumPoints,
+			First:     c.First,
+			Finished:  c.Series.Finished,
+			End:       c.End,
+		})
+	}
+	return s
+}
+
+// restore restores the state of a newly created metric and its rollups from the snapshot.
+// archives that no longer exist, of which the chunkspan changed, or that have corrupt chunks, are skipped.
+// the checksums of the chunks are only verified if verify is true, because older snapshots don't have them.
+func (a *AggMetric) restore(s seriesSnapshot, verify bool) {
+	for _, as := range s.Archives {
+		am := a.archiveMetric(as.Archive)
+		if am == nil {
+			log.Debugf("snapshot: series %s no longer has archive %s. skipping it", s.Key, as.Archive)
+			continue
+		}
+		if err := am.restoreArchive(as, verify); err != nil {
+			log.Warnf("snapshot: can't restore series %s: %s", s.Key, err)
+		}
+	}
+	a.Lock()
+	defer a.Unlock()
+	for _, as := range s.Aggregators {
+		for _, agg := range a.aggregators {
+			if agg.span == as.Span {
+				agg.currentBoundary = as.CurrentBoundary
+				*agg.agg = as.Agg
+			}
+		}
+	}
+	if a.rob != nil {
+		for _, p := range s.Rob {
+			// the points were in the buffer already, so they should fit in it again,
+			// unless the buffer was made smaller. then add the points that don't fit.
+			if flushed, ok := a.rob.Add(p.Ts, p.Val); ok {
+				for _, fp := range flushed {
+					a.add(fp.Ts, fp.Val)
+				}
+			}
+		}
+	}
+}
+
+func (a *AggMetric) restoreArchive(s archiveSnapshot, verify bool) error {
+	a.Lock()
+	defer a.Unlock()
+	if len(s.Chunks) != 0 && s.ChunkSpan != a.ChunkSpan {
+		return fmt.Errorf("chunkspan of archive %s changed from %d to %d", a.Key.Archive, s.ChunkSpan, a.ChunkSpan)
+	}
+	chunks := s.Chunks
+	if len(chunks) > int(a.NumChunks) {
+		chunks = chunks[len(chunks)-int(a.NumChunks):]
+	}
+	if verify {
+		for _, cs := range chunks {
+			if err := chunk.VerifyChecksum(cs.Series, cs.Checksum); err != nil {
+				return fmt.Errorf("chunk of archive %s: %s", a.Key.Archive, err)
+			}
+		}
+	}
+	a.clearChunks()
+	for _, cs := range chunks {
+		c := &chunk.Chunk{
+			NumPoints: cs.NumPoints,
+			First:     cs.First,
+			End:       cs.End,
+		}
+		if err := c.Series.UnmarshalBinary(cs.Series); err != nil {
+			a.clearChunks()
+			a.CurrentChunkPos = 0
+			a.publish()
+			return fmt.Errorf("failed to unmarshal chunk of archive %s: %s", a.Key.Archive, err)
+		}
+		// Finished is not part of the marshaled state. the end-of-stream marker is.
+		c.Series.Finished = cs.Finished
+		a.Chunks = append(a.Chunks, c)
+		a.usage.addChunk(c)
+	}
+	a.CurrentChunkPos = 0
+	if len(a.Chunks) > 0 {
+		a.CurrentChunkPos = len(a.Chunks) - 1
+	}
+	// the restored chunks were not confirmed to be saved, so save them again if needed.
+	a.lastSaveStart = s.LastSaveFinish
+	a.lastSaveFinish = s.LastSaveFinish
+	a.lastWrite = s.LastWrite
+	a.firstTs = s.FirstTs
+	a.publish()
+	return nil
+}
@@ -0,0 +1,136 @@
+package mdata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(false)
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { snapshotEnabled, snapshotDir = false, "" }()
+	snapshotEnabled, snapshotDir = true, dir
+
+	Schemas = conf.NewSchemas([]conf.Schema{{
+		Name:    "test",
+		Pattern: regexp.MustCompile(".*"),
+		Retentions: conf.Retentions{
+			conf.NewRetentionMT(10, 3600, 60, 5, 0),
+			conf.NewRetentionMT(60, 7200, 600, 2, 0),
+		},
+		ReorderWindow: 3,
+	}})
+	SetSingleAgg(conf.Sum)
+
+	key := test.GetMKey(1)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+	m := getOrCreate(ms, key)
+	for ts := uint32(1000); ts < 1200; ts += 10 {
+		m.Add(ts, float64(ts))
+	}
+	// the first chunk was saved, so it doesn't need to be in the snapshot
+	m.SyncChunkSaveState(960)
+
+	n, err := ms.SaveSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 series in the snapshot, got %d", n)
+	}
+
+	ms2 := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+	n, err = ms2.LoadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 series to be restored, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected the snapshot to be removed after loading it")
+	}
+	m2, _ := ms2.Get(key)
+
+	// adding more data flushes the reorder buffers and the aggregators, which must behave the same.
+	for _, m := range []Metric{m, m2} {
+		for ts := uint32(1200); ts < 1400; ts += 10 {
+			m.Add(ts, float64(ts))
+		}
+	}
+
+	points := func(res Result, err error) []schema.Point {
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := res.Points
+		for _, iter := range res.Iters {
+			for iter.Next() {
+				ts, val := iter.Values()
+				out = append(out, schema.Point{Val: val, Ts: ts})
+			}
+		}
+		return out
+	}
+	exp := points(m.Get(1020, 1400))
+	got := points(m2.Get(1020, 1400))
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected raw data\n%v\ngot\n%v", exp, got)
+	}
+	exp = points(m.GetAggregated(consolidation.Sum, 60, 0, 1400))
+	got = points(m2.GetAggregated(consolidation.Sum, 60, 0, 1400))
+	if len(exp) == 0 || !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected rollup data\n%v\ngot\n%v", exp, got)
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	SetSingleSchema(conf.NewRetentionMT(10, 3600, 60, 5, 0))
+	SetSingleAgg(conf.Sum)
+
+	key := test.GetMKey(1)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+	m := getOrCreate(ms, key)
+	for ts := uint32(1000); ts < 1200; ts += 10 {
+		m.Add(ts, float64(ts))
+	}
+
+	restore := func(s seriesSnapshot, verify bool) int {
+		m := getOrCreate(NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0), key)
+		m.restore(s, verify)
+		return len(m.Chunks)
+	}
+	if n := restore(m.snapshot(key), true); n != 4 {
+		t.Fatalf("expected 4 chunks to be restored, got %d", n)
+	}
+
+	s := m.snapshot(key)
+	s.Archives[0].Chunks[1].Series[3] ^= 0x01
+	if n := restore(s, true); n != 0 {
+		t.Fatalf("expected archive with a corrupt chunk not to be restored, got %d chunks", n)
+	}
+	// snapshots of version 1 have no checksums
+	for i := range s.Archives[0].Chunks {
+		s.Archives[0].Chunks[i].Checksum = 0
+	}
+	if n := restore(s, false); n != 4 {
+		t.Fatalf("expected chunks without checksums to be restored without verification, got %d chunks", n)
+	}
+}
@@ -0,0 +1,102 @@
+package mdata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StoreStats describes the state of a store
+type StoreStats struct {
+	Backend         string `json:"backend"`
+	WriteQueueItems int    `json:"writeQueueItems"`   // chunks waiting to be saved
+	WriteQueueSize  int    `json:"writeQueueSize"`    // max number of chunks that can wait to be saved before adding chunks blocks
+	Breaker         string `json:"breaker,omitempty"` // state of the circuit breaker (closed, open or half-open), if enabled
+}
+
+// StoreBackend is an implementation of Store that can be selected in the config
+type StoreBackend interface {
+	// ConfigSetup registers the config section of the backend
+	ConfigSetup()
+	// ConfigProcess validates the config of the backend. it is only called for the enabled backend
+	ConfigProcess(schemaMaxChunkSpan uint32)
+	// Enabled returns whether the backend is enabled in its config section
+	Enabled() bool
+	// New returns a store, as per the config of the backend
+	New(ttls []uint32, schemaMaxChunkSpan uint32) (Store, error)
+}
+
+type storeBackend struct {
+	name    string
+	backend StoreBackend
+}
+
+// storeBackends are the registered backends, in the order they were registered
+var storeBackends []storeBackend
+
+// RegisterStore makes a store backend selectable in the config. backends register themselves in their init function,
+// so that importing the package of a backend is enough to make it available.
+func RegisterStore(name string, backend StoreBackend) {
+	for _, b := range storeBackends {
+		if b.name == name {
+			panic(fmt.Sprintf("store backend %q registered twice", name))
+		}
+	}
+	storeBackends = append(storeBackends, storeBackend{name, backend})
+}
+
+// ConfigSetupStores registers the config sections of all store backends
+func ConfigSetupStores() {
+	for _, b := range storeBackends {
+		b.backend.ConfigSetup()
+	}
+}
+
+// enabledStore returns the one store backend that is enabled
+func enabledStore() (storeBackend, error) {
+	var enabled []storeBackend
+	for _, b := range storeBackends {
+		if b.backend.Enabled() {
+			enabled = append(enabled, b)
+		}
+	}
+	if len(enabled) == 1 {
+		return enabled[0], nil
+	}
+	var names []string
+	for _, b := range storeBackends {
+		names = append(names, b.name)
+	}
+	if len(enabled) == 0 {
+		return storeBackend{}, fmt.Errorf("at least 1 backend store plugin needs to be enabled. available: %s", strings.Join(names, ", "))
+	}
+	return storeBackend{}, errors.New("only 1 backend store plugin can be enabled at once.")
+}
+
+// ConfigProcessStores validates the config of the enabled store backend.
+// it must be called after ConfigProcess, as it needs the storage-schemas
+func ConfigProcessStores() error {
+	b, err := enabledStore()
+	if err != nil {
+		return err
+	}
+	b.backend.ConfigProcess(MaxChunkSpan())
+	return nil
+}
+
+// NewStore returns a store of the enabled backend, for the ttls and chunkspans of the storage-schemas,
+// wrapped in a circuit breaker if enabled
+func NewStore() (Store, error) {
+	b, err := enabledStore()
+	if err != nil {
+		return nil, err
+	}
+	store, err := b.backend.New(TTLs(), MaxChunkSpan())
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize %s backend store. %s", b.name, err)
+	}
+	if breakerEnabled {
+		store = NewBreakerStore(store, breakerFailures, breakerSlow, breakerOpenDuration)
+	}
+	return store, nil
+}
@@ -2,7 +2,7 @@ package mdata
 
 import (
 	"context"
-	"errors"
+	"sort"
 
 	"github.com/raintank/schema"
 
@@ -51,14 +51,10 @@ func (c *MockStore) Add(cwr *ChunkWriteRequest) {
 
 // searches through the mock results and returns the right ones according to start / end
 func (c *MockStore) Search(ctx context.Context, metric schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
-	var itgens, res []chunk.IterGen
-	var ok bool
+	var res []chunk.IterGen
 
-	if itgens, ok = c.results[metric]; !ok {
-		return res, errors.New("metric not found")
-	}
-
-	for _, itgen := range itgens {
+	// like the real stores, unknown metrics simply have no chunks
+	for _, itgen := range c.results[metric] {
 		// start is inclusive, end is exclusive
 		if itgen.T0 < end && itgen.EndTs() > start && start < end {
 			res = append(res, itgen)
@@ -73,3 +69,53 @@ func (c *MockStore) Stop() {
 
 func (c *MockStore) SetTracer(t opentracing.Tracer) {
 }
+
+// Stats returns the state of the store. the mock store has no write queue
+func (c *MockStore) Stats() StoreStats {
+	return StoreStats{Backend: "mock"}
+}
+
+// Delete deletes all chunks of the given archive
+func (c *MockStore) Delete(ctx context.Context, key schema.AMKey, ttl uint32) error {
+	c.items -= len(c.results[key])
+	delete(c.results, key)
+	return nil
+}
+
+// DeleteRange deletes the chunks of the given archive whose t0 is in the range from (inclusive) - to (exclusive)
+func (c *MockStore) DeleteRange(ctx context.Context, key schema.AMKey, ttl, from, to uint32) error {
+	var kept []chunk.IterGen
+	for _, itgen := range c.results[key] {
+		if itgen.T0 >= from && itgen.T0 < to {
+			c.items--
+			continue
+		}
+		kept = append(kept, itgen)
+	}
+	if kept == nil {
+		delete(c.results, key)
+	} else {
+		c.results[key] = kept
+	}
+	return nil
+}
+
+// CompactChunks replaces the chunks of the archive with the given t0's by the chunk of the request
+func (c *MockStore) CompactChunks(ctx context.Context, cwr *ChunkWriteRequest, t0s []uint32) error {
+	replaced := make(map[uint32]struct{}, len(t0s))
+	for _, t0 := range t0s {
+		replaced[t0] = struct{}{}
+	}
+	var kept []chunk.IterGen
+	for _, itgen := range c.results[cwr.Key] {
+		if _, ok := replaced[itgen.T0]; ok {
+			c.items--
+			continue
+		}
+		kept = append(kept, itgen)
+	}
+	c.results[cwr.Key] = kept
+	c.Add(cwr)
+	sort.Sort(chunk.IterGensAsc(c.results[cwr.Key]))
+	return nil
+}
@@ -0,0 +1,49 @@
+package mdata
+
+import (
+	"testing"
+)
+
+type mockBackend struct {
+	enabled bool
+}
+
+func (b *mockBackend) ConfigSetup() {}
+
+func (b *mockBackend) ConfigProcess(schemaMaxChunkSpan uint32) {}
+
+func (b *mockBackend) Enabled() bool {
+	return b.enabled
+}
+
+func (b *mockBackend) New(ttls []uint32, schemaMaxChunkSpan uint32) (Store, error) {
+	return NewMockStore(), nil
+}
+
+func TestNewStore(t *testing.T) {
+	defer func(backends []storeBackend) {
+		storeBackends = backends
+	}(storeBackends)
+	storeBackends = nil
+
+	a := &mockBackend{}
+	b := &mockBackend{}
+	RegisterStore("a", a)
+	RegisterStore("b", b)
+
+	if _, err := NewStore(); err == nil {
+		t.Fatal("expected an error when no backend is enabled")
+	}
+	b.enabled = true
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store.Stats().Backend; got != "mock" {
+		t.Fatalf("expected a mock store, got %q", got)
+	}
+	a.enabled = true
+	if _, err := NewStore(); err == nil {
+		t.Fatal("expected an error when 2 backends are enabled")
+	}
+}
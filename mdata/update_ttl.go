@@ -0,0 +1,79 @@
+package mdata
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/metrictank/mdata/chunk/tsz"
+	"github.com/raintank/schema"
+)
+
+// CheckUpdateTTL returns an error if the chunks that were saved with the given ttl can't be updated,
+// because the store wasn't set up for that ttl
+func CheckUpdateTTL(fromTTL uint32) error {
+	for _, ttl := range storeTTLs {
+		if ttl == fromTTL {
+			return nil
+		}
+	}
+	return fmt.Errorf("the store has no table for ttl %d", fromTTL)
+}
+
+// UpdateTTL saves the chunks of the archives of the series that were saved with fromTTL again, with the ttl of their
+// archive as per the current storage-schemas, e.g. after the ttl was changed with ReloadRetention. this way, the data
+// from before the change is read, and expires, like the data after it.
+// chunks that are older than the new ttl are left to expire, and chunks that are still in memory are left alone,
+// as the series saves them itself. the chunks are saved with the full ttl, so they expire somewhat later than they
+// would have had they been saved with it right away.
+// before saving each chunk, it waits for a tick of throttle, to bound the load on the store.
+// it returns the number of saved chunks.
+func (ms *AggMetrics) UpdateTTL(ctx context.Context, key schema.MKey, schemaId, aggId uint16, fromTTL uint32, throttle <-chan time.Time) (int, error) {
+	return ms.updateTTL(ctx, key, schemaId, aggId, fromTTL, throttle, uint32(time.Now().Unix()))
+}
+
+func (ms *AggMetrics) updateTTL(ctx context.Context, key schema.MKey, schemaId, aggId uint16, fromTTL uint32, throttle <-chan time.Time, now uint32) (int, error) {
+	var saved int
+	for _, a := range seriesArchives(key, schemaId, aggId) {
+		if a.ttl == fromTTL {
+			continue
+		}
+		itgens, err := ms.searchTTL(ctx, archiveTTL{key: a.key, ttl: fromTTL, span: a.span}, now)
+		if err != nil {
+			return saved, err
+		}
+		mem := make(map[uint32]struct{})
+		ms.memChunkT0s(a.key, mem)
+		for _, itgen := range itgens {
+			if _, ok := mem[itgen.T0]; ok {
+				continue
+			}
+			span := itgen.Span()
+			if span == 0 {
+				// the format doesn't record the span
+				span = a.span
+			}
+			if itgen.T0+span+a.ttl <= now {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return saved, ctx.Err()
+			case <-throttle:
+			}
+			it, err := itgen.Get()
+			if err != nil {
+				return saved, err
+			}
+			c, err := copyChunk(itgen.T0, it)
+			tsz.ReleaseIter(it)
+			if err != nil {
+				return saved, err
+			}
+			cwr := NewChunkWriteRequest(nil, a.key, c, a.ttl, span, time.Now())
+			ms.store.Add(&cwr)
+			saved++
+		}
+	}
+	return saved, nil
+}
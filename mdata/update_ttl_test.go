@@ -0,0 +1,55 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestUpdateTTL(t *testing.T) {
+	mockstore.Reset()
+	defer mockstore.Reset()
+	SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 5, 0))
+	SetSingleAgg(conf.Avg)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+
+	key := test.GetMKey(1)
+	// chunks saved with a ttl of a day, from 0 to 10790
+	for t0 := uint32(0); t0 < 10800; t0 += 600 {
+		c := chunk.New(t0)
+		for ts := t0; ts < t0+600; ts += 10 {
+			c.Push(ts, float64(ts))
+		}
+		c.Finish()
+		cwr := NewChunkWriteRequest(nil, schema.AMKey{MKey: key}, c, 86400, 600, time.Now())
+		mockstore.Add(&cwr)
+	}
+	// the last chunk is still in memory
+	getOrCreate(ms, key).Add(10200, 1)
+
+	throttle := make(chan time.Time)
+	close(throttle)
+
+	// the chunks that end within the new ttl of an hour, except the one in memory
+	saved, err := ms.updateTTL(test.NewContext(), key, 0, 0, 86400, throttle, 10800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 5 {
+		t.Fatalf("expected 5 saved chunks, got %d", saved)
+	}
+	if mockstore.Items() != 23 {
+		t.Fatalf("expected 23 chunks in the store, got %d", mockstore.Items())
+	}
+
+	// chunks that were saved with the ttl of the archive already are left alone
+	saved, err = ms.updateTTL(test.NewContext(), key, 0, 0, 3600, throttle, 10800)
+	if err != nil || saved != 0 {
+		t.Fatalf("expected no saved chunks, got %d, %v", saved, err)
+	}
+}
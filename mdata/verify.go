@@ -0,0 +1,280 @@
+package mdata
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/mdata/chunk/tsz"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// metric tank.rollup_verify.series is how many series had their rollups verified against their raw data
+	rollupVerifySeries = stats.NewCounter32("tank.rollup_verify.series")
+
+	// metric tank.rollup_verify.points is how many rollup points were verified against the raw data
+	rollupVerifyPoints = stats.NewCounter32("tank.rollup_verify.points")
+
+	// metric tank.rollup_verify.missing is how many rollup points were missing from the store, while the raw data has data for their window
+	rollupVerifyMissing = stats.NewCounter32("tank.rollup_verify.missing")
+
+	// metric tank.rollup_verify.diverged is how many rollup points in the store have a different value than the one computed from the raw data
+	rollupVerifyDiverged = stats.NewCounter32("tank.rollup_verify.diverged")
+)
+
+// RollupVerifyEnabled returns whether the rollups should be verified in the background
+func RollupVerifyEnabled() bool {
+	return rollupVerifySeriesMax > 0
+}
+
+// rollupVerifyResult is the result of verifying the rollups of a series
+type rollupVerifyResult struct {
+	points   int // rollup points that were verified
+	missing  int // rollup points that should be in the store, but aren't
+	diverged int // rollup points that have a different value than computed from the raw data
+}
+
+// VerifyRollups periodically verifies the rollups of a random sample of the series in memory: it recomputes them
+// from the raw data in the store, and compares them with the rollups in the store. this detects aggregation bugs
+// and windows that were missed, e.g. after a failover. only primaries verify, as they are the ones that save chunks.
+// it returns when ctx is done.
+func (ms *AggMetrics) VerifyRollups(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(rollupVerifyInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !cluster.Manager.IsPrimary() {
+			continue
+		}
+		ms.verifyRollupsRun(ctx, uint32(time.Now().Unix()))
+	}
+}
+
+// verifyRollupsRun verifies the rollups of a random sample of the series
+func (ms *AggMetrics) verifyRollupsRun(ctx context.Context, now uint32) {
+	pre := time.Now()
+	sample := ms.sampleSeries(rollupVerifySeriesMax)
+	var total rollupVerifyResult
+	var failed int
+	for _, m := range sample {
+		if ctx.Err() != nil {
+			return
+		}
+		res, err := ms.verifyRollups(ctx, m.Key.MKey, m.schemaId, m.aggId, now)
+		if err != nil {
+			log.Warnf("rollup verify: failed to verify the rollups of %s: %s", m.Key.MKey, err)
+			failed++
+			continue
+		}
+		if res.missing > 0 || res.diverged > 0 {
+			log.Warnf("rollup verify: %s has %d missing and %d diverged rollup points out of %d", m.Key.MKey, res.missing, res.diverged, res.points)
+		}
+		rollupVerifySeries.Inc()
+		rollupVerifyPoints.Add(res.points)
+		rollupVerifyMissing.Add(res.missing)
+		rollupVerifyDiverged.Add(res.diverged)
+		total.points += res.points
+		total.missing += res.missing
+		total.diverged += res.diverged
+	}
+	log.Infof("rollup verify: verified %d rollup points of %d series in %s. %d missing, %d diverged. %d series failed", total.points, len(sample), time.Since(pre), total.missing, total.diverged, failed)
+}
+
+// sampleSeries returns up to max randomly chosen series
+func (ms *AggMetrics) sampleSeries(max int) []*AggMetric {
+	var sample []*AggMetric
+	var seen int
+	ms.ForEach(func(key schema.MKey, m *AggMetric) bool {
+		seen++
+		if len(sample) < max {
+			sample = append(sample, m)
+		} else if i := rand.Intn(seen); i < max {
+			sample[i] = m
+		}
+		return true
+	})
+	return sample
+}
+
+// rollupVerify recomputes the rollups of one span from the raw data, and compares them with the stored ones
+type rollupVerify struct {
+	windows  rollupWindows
+	archives []archiveTTL
+	stored   []map[uint32]float64 // per archive: the stored points, by ts
+	from     []uint32             // per archive: the start of the stored data
+	to       []uint32             // per archive: the end of the stored data
+	rawEnd   uint32               // the end of the raw data in the store
+	float32  bool
+	minCnt   float64 // windows with fewer points don't result in rollup points. see Aggregator.setXFilesFactor
+	res      *rollupVerifyResult
+}
+
+// flush compares the aggregation of the window with the stored points of the archives
+func (r *rollupVerify) flush(boundary uint32, agg *Aggregation) error {
+	if agg.Cnt < r.minCnt || boundary >= r.rawEnd {
+		return nil
+	}
+	for i, a := range r.archives {
+		if boundary < r.from[i] || boundary >= r.to[i] {
+			continue
+		}
+		exp := aggValue(agg, a.key.Archive.Method())
+		if r.float32 {
+			exp = float64(float32(exp))
+		}
+		r.res.points++
+		val, ok := r.stored[i][boundary]
+		if !ok {
+			r.res.missing++
+			continue
+		}
+		if !rollupValueEqual(exp, val) {
+			r.res.diverged++
+		}
+	}
+	return nil
+}
+
+// rollupValueEqual returns whether the values are equal, allowing for the rounding errors of
+// aggregating in a different order, like when rollups are chained.
+func rollupValueEqual(a, b float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= 1e-6*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// readPoints returns the points of the chunks, by ts
+func readPoints(itgens []chunk.IterGen) (map[uint32]float64, error) {
+	out := make(map[uint32]float64)
+	for _, itgen := range itgens {
+		it, err := itgen.Get()
+		if err != nil {
+			return nil, err
+		}
+		for it.Next() {
+			ts, val := it.Values()
+			out[ts] = val
+		}
+		err = it.Err()
+		tsz.ReleaseIter(it)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// itgenEnd returns the end of the chunk (exclusive): its t0 plus its span,
+// or plus the chunkspan if its format doesn't encode the span. chunks that were rolled over span less than the chunkspan.
+func itgenEnd(itgen chunk.IterGen, chunkSpan uint32) uint32 {
+	if span := itgen.Span(); span != 0 {
+		return itgen.T0 + span
+	}
+	return itgen.T0 + chunkSpan
+}
+
+// verifyRollups recomputes the rollups of the series from its raw data in the store and compares them with its
+// rollups in the store. only windows for which both the raw data and the rollups are in the store are verified:
+// the data of the most recent chunks may not be saved yet. note that points that were added late, see reopen-chunks,
+// are legitimately missing from the rollups.
+func (ms *AggMetrics) verifyRollups(ctx context.Context, key schema.MKey, schemaId, aggId uint16, now uint32) (rollupVerifyResult, error) {
+	var res rollupVerifyResult
+	archives := seriesArchives(key, schemaId, aggId)
+	raw := archives[0]
+	if len(archives) == 1 {
+		return res, nil
+	}
+
+	rawItgens, err := ms.searchTTL(ctx, raw, now)
+	if err != nil {
+		return res, err
+	}
+	if len(rawItgens) == 0 {
+		return res, nil
+	}
+	start := rawItgens[0].T0
+	rawEnd := itgenEnd(rawItgens[len(rawItgens)-1], raw.span)
+
+	rets := GetSchema(schemaId).Retentions
+	minCnt := GetAgg(aggId).XFilesFactor / float64(rets[0].SecondsPerPoint)
+	var verifies []*rollupVerify
+	bySpan := make(map[uint32]*rollupVerify)
+	for _, a := range archives[1:] {
+		itgens, err := ms.searchTTL(ctx, a, now)
+		if err != nil {
+			return res, err
+		}
+		if len(itgens) == 0 {
+			continue
+		}
+		stored, err := readPoints(itgens)
+		if err != nil {
+			return res, err
+		}
+		span := a.key.Archive.Span()
+		r, ok := bySpan[span]
+		if !ok {
+			r = &rollupVerify{
+				rawEnd:  rawEnd,
+				float32: GetSchema(schemaId).Float32,
+				minCnt:  minCnt * float64(span),
+				res:     &res,
+			}
+			r.windows = rollupWindows{
+				span:  span,
+				agg:   NewAggregation(),
+				flush: r.flush,
+			}
+			bySpan[span] = r
+			verifies = append(verifies, r)
+		}
+		r.archives = append(r.archives, a)
+		r.stored = append(r.stored, stored)
+		from, to := itgens[0].T0, uint32(0)
+		for _, itgen := range itgens {
+			if itgen.T0 < from {
+				from = itgen.T0
+			}
+			if end := itgenEnd(itgen, a.span); end > to {
+				to = end
+			}
+		}
+		r.from = append(r.from, from)
+		r.to = append(r.to, to)
+	}
+
+	var last uint32
+	for _, itgen := range rawItgens {
+		it, err := itgen.Get()
+		if err != nil {
+			return res, err
+		}
+		for it.Next() {
+			ts, val := it.Values()
+			if ts <= last {
+				continue
+			}
+			last = ts
+			for _, r := range verifies {
+				r.windows.add(ts, val, start)
+			}
+		}
+		err = it.Err()
+		tsz.ReleaseIter(it)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
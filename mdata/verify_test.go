@@ -0,0 +1,79 @@
+package mdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestVerifyRollups(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	defer mockstore.Reset()
+	SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 5, 0), conf.NewRetentionMT(600, 86400, 3600, 2, 0))
+	SetSingleAgg(conf.Avg, conf.Max)
+	ms := NewAggMetrics(mockstore, &cache.MockCache{}, false, 1, 0, 0, 0)
+
+	key := test.GetMKey(1)
+	save := func(key schema.AMKey, t0, span, step uint32, val func(ts uint32) float64) {
+		c := chunk.New(t0)
+		for ts := t0; ts < t0+span; ts += step {
+			c.Push(ts, val(ts))
+		}
+		c.Finish()
+		cwr := NewChunkWriteRequest(nil, key, c, 86400, span, time.Now())
+		mockstore.Add(&cwr)
+	}
+	// raw data from 0 to 7190
+	for t0 := uint32(0); t0 < 7200; t0 += 600 {
+		save(schema.AMKey{MKey: key}, t0, 600, 10, func(ts uint32) float64 { return float64(ts) })
+	}
+
+	// no rollups in the store: nothing to verify
+	res, err := ms.verifyRollups(test.NewContext(), key, 0, 0, 7200)
+	if err != nil || res != (rollupVerifyResult{}) {
+		t.Fatalf("expected nothing to verify without rollups, got %+v, %v", res, err)
+	}
+
+	// correct rollups
+	_, err = ms.backfillRollups(test.NewContext(), key, 0, 0, 7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = ms.verifyRollups(test.NewContext(), key, 0, 0, 7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the windows that end at 600 to 6600, for sum, cnt and max
+	exp := rollupVerifyResult{points: 33}
+	if res != exp {
+		t.Fatalf("expected %+v, got %+v", exp, res)
+	}
+
+	// replace the second chunk of max with one that has every other point, with wrong values
+	maxKey := schema.AMKey{MKey: key, Archive: schema.NewArchive(schema.Max, 600)}
+	var chunks []chunk.IterGen
+	for _, itgen := range mockstore.results[maxKey] {
+		if itgen.T0 != 3600 {
+			chunks = append(chunks, itgen)
+		}
+	}
+	mockstore.results[maxKey] = chunks
+	save(maxKey, 3600, 3600, 1200, func(ts uint32) float64 { return -1 })
+
+	res, err = ms.verifyRollups(test.NewContext(), key, 0, 0, 7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = rollupVerifyResult{points: 33, missing: 3, diverged: 3}
+	if res != exp {
+		t.Fatalf("expected %+v, got %+v", exp, res)
+	}
+}
@@ -0,0 +1,45 @@
+package wal
+
+import (
+	"flag"
+	"time"
+
+	"github.com/grafana/globalconf"
+	"github.com/raintank/dur"
+	log "github.com/sirupsen/logrus"
+)
+
+var Enabled bool
+var dir string
+var segmentDurationStr string
+var maxAgeStr string
+var syncIntervalStr string
+
+var segmentDuration time.Duration
+var maxAge time.Duration
+var syncInterval time.Duration
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("wal", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "record points in a local write-ahead log before adding them to the in-memory chunks, and replay it at startup")
+	fs.StringVar(&dir, "dir", "/var/lib/metrictank/wal", "directory to store the write-ahead log in")
+	fs.StringVar(&segmentDurationStr, "segment-duration", "10min", "how long to write to a segment (file) before starting a new one")
+	fs.StringVar(&maxAgeStr, "max-age", "2h", "how long to keep segments after their last write. should be more than the largest chunkspan plus chunk-max-stale, so that points of chunks that may not have been saved yet are kept")
+	fs.StringVar(&syncIntervalStr, "sync-interval", "1s", "how often to flush and fsync the log to disk. points received since the last sync may be lost in a crash")
+	globalconf.Register("wal", fs, flag.ExitOnError)
+}
+
+func ConfigProcess() {
+	if !Enabled {
+		return
+	}
+	if dir == "" {
+		log.Fatal("wal: dir must not be empty")
+	}
+	segmentDuration = time.Duration(dur.MustParseNDuration("segment-duration", segmentDurationStr)) * time.Second
+	maxAge = time.Duration(dur.MustParseNDuration("max-age", maxAgeStr)) * time.Second
+	syncInterval = time.Duration(dur.MustParseNDuration("sync-interval", syncIntervalStr)) * time.Second
+	if maxAge < segmentDuration {
+		log.Fatal("wal: max-age must be at least segment-duration")
+	}
+}
@@ -0,0 +1,412 @@
+// Package wal implements a local write-ahead log of the points added to the in-memory chunks.
+// a crash (or restart) of a node loses the data of the chunks that were not saved yet,
+// which is up to a chunkspan worth of data, plus what's awaiting chunk-max-stale.
+// inputs that can't replay their data (unlike kafka-mdm) can record the points in the log,
+// so that they can be replayed into the in-memory chunks at startup.
+//
+// the log is a directory of segments: files that are written to for segment-duration each.
+// segments are deleted once max-age has passed since their last write.
+// each record in a segment is a point:
+//
+//	crc32 (4 bytes) of the rest of the record
+//	key   (16 bytes)
+//	org   (4 bytes)
+//	schemaId, aggId (2 bytes each)
+//	ts    (4 bytes)
+//	value (8 bytes)
+//
+// all numbers are little endian. the schemaId and aggId are those at the time of writing: replay looks up the series
+// in the index instead, because the ids change when storage-schemas.conf or storage-aggregation.conf change.
+//
+// points are appended to in-memory buffers, one per shard of the series, so that inputs that add points concurrently
+// don't contend on a single lock. the buffers are written to the segment upon every sync.
+// all points of a series go to the same shard, so they are written - and replayed - in order.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	recordSize    = 40
+	segmentSuffix = ".wal"
+	numShards     = 32
+)
+
+var (
+	// metric wal.points_written is how many points were recorded in the write-ahead log
+	pointsWritten = stats.NewCounter32("wal.points_written")
+
+	// metric wal.points_replayed is how many points were replayed from the write-ahead log at startup
+	pointsReplayed = stats.NewCounter32("wal.points_replayed")
+
+	// metric wal.points_skipped is how many points of the write-ahead log were not replayed at startup, because their series is not in the index, or its org reached its series limit
+	pointsSkipped = stats.NewCounter32("wal.points_skipped")
+
+	// metric wal.corrupt_records is how many records of the write-ahead log could not be replayed, typically because the node crashed while writing them
+	corruptRecords = stats.NewCounter32("wal.corrupt_records")
+
+	// metric wal.errors is how many times writing to, syncing or rotating the write-ahead log failed
+	walErrors = stats.NewCounter32("wal.errors")
+
+	// metric wal.segments is the number of segments of the write-ahead log on disk
+	segments = stats.NewGauge32("wal.segments")
+)
+
+// wal is the write-ahead log used by Append. nil if disabled or not started
+var wal *WAL
+
+// WAL is a write-ahead log of points
+type WAL struct {
+	sync.Mutex      // protects the segment
+	dir             string
+	segmentDuration time.Duration
+	maxAge          time.Duration
+
+	shards   [numShards]shard
+	spare    [numShards][]byte // the buffers that were last written, to be reused by the shards
+	f        *os.File
+	segStart time.Time
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// shard buffers the records of the points appended for a subset of the series, until they are written to the segment
+type shard struct {
+	sync.Mutex
+	buf    []byte
+	closed bool
+}
+
+// New creates a write-ahead log in the given directory, opens a new segment to write to,
+// and starts syncing it every syncInterval.
+// the segments that are in the directory already should be replayed before.
+func New(dir string, segmentDuration, maxAge, syncInterval time.Duration) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &WAL{
+		dir:             dir,
+		segmentDuration: segmentDuration,
+		maxAge:          maxAge,
+		shutdown:        make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	if err := l.openSegment(time.Now()); err != nil {
+		return nil, err
+	}
+	go l.run(syncInterval)
+	return l, nil
+}
+
+// Start replays the write-ahead log in the configured directory into metrics,
+// and starts recording the points passed to Append. the index must be loaded already.
+func Start(metrics mdata.Metrics, index idx.MetricIndex) error {
+	pre := time.Now()
+	n, err := Replay(dir, metrics, index)
+	if err != nil {
+		return err
+	}
+	log.Infof("wal: replayed %d points in %s", n, time.Since(pre))
+	l, err := New(dir, segmentDuration, maxAge, syncInterval)
+	if err != nil {
+		return err
+	}
+	wal = l
+	return nil
+}
+
+// Stop flushes and closes the write-ahead log, if it was started.
+func Stop() {
+	if wal != nil {
+		wal.Close()
+	}
+}
+
+// Append records a point in the write-ahead log, if it was started.
+// concurrency-safe.
+func Append(key schema.MKey, schemaId, aggId uint16, ts uint32, val float64) {
+	if wal != nil {
+		wal.Append(key, schemaId, aggId, ts, val)
+	}
+}
+
+// Append records a point. it is written to disk upon the next Sync.
+// concurrency-safe.
+func (l *WAL) Append(key schema.MKey, schemaId, aggId uint16, ts uint32, val float64) {
+	var buf [recordSize]byte
+	copy(buf[4:20], key.Key[:])
+	binary.LittleEndian.PutUint32(buf[20:], key.Org)
+	binary.LittleEndian.PutUint16(buf[24:], schemaId)
+	binary.LittleEndian.PutUint16(buf[26:], aggId)
+	binary.LittleEndian.PutUint32(buf[28:], ts)
+	binary.LittleEndian.PutUint64(buf[32:], math.Float64bits(val))
+	binary.LittleEndian.PutUint32(buf[0:], crc32.ChecksumIEEE(buf[4:]))
+
+	// the key is a hash, so its first byte spreads the series evenly across the shards
+	s := &l.shards[int(key.Key[0])%numShards]
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
+	}
+	s.buf = append(s.buf, buf[:]...)
+	s.Unlock()
+	pointsWritten.Inc()
+}
+
+// Sync writes the recorded points to disk, and starts a new segment if the current one is due.
+// if there is no segment to write to, because opening it failed, the points are dropped.
+func (l *WAL) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.f == nil {
+		// opening the segment failed last time. try again
+		if err := l.openSegment(now); err != nil {
+			l.take()
+			return err
+		}
+	}
+	if err := l.sync(); err != nil {
+		return err
+	}
+	if now.Sub(l.segStart) < l.segmentDuration {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		return err
+	}
+	return l.openSegment(now)
+}
+
+// Close writes the recorded points to disk and closes the log. points appended afterwards are dropped.
+func (l *WAL) Close() error {
+	close(l.shutdown)
+	<-l.done
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.Lock()
+		s.closed = true
+		s.Unlock()
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// take returns the records buffered by the shards, and gives them empty buffers.
+// the returned buffers are only valid until the next call.
+// caller must hold lock
+func (l *WAL) take() [][]byte {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.Lock()
+		s.buf, l.spare[i] = l.spare[i][:0], s.buf
+		s.Unlock()
+	}
+	return l.spare[:]
+}
+
+// sync writes the records buffered by the shards to the segment, and syncs it to disk.
+// records that fail to be written are dropped.
+// caller must hold lock
+func (l *WAL) sync() error {
+	for _, buf := range l.take() {
+		if len(buf) == 0 {
+			continue
+		}
+		if _, err := l.f.Write(buf); err != nil {
+			return err
+		}
+	}
+	return l.f.Sync()
+}
+
+// caller must hold lock
+func (l *WAL) openSegment(now time.Time) error {
+	name := filepath.Join(l.dir, fmt.Sprintf("%020d%s", now.UnixNano(), segmentSuffix))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.segStart = now
+	return nil
+}
+
+// run syncs the log every interval, and deletes the segments that are past max-age.
+func (l *WAL) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(l.done)
+	lastCleanup := time.Now()
+	for {
+		select {
+		case <-l.shutdown:
+			return
+		case now := <-ticker.C:
+			if err := l.Sync(); err != nil {
+				walErrors.Inc()
+				log.Errorf("wal: failed to sync: %s", err)
+			}
+			if now.Sub(lastCleanup) >= time.Minute {
+				l.cleanup(now)
+				lastCleanup = now
+			}
+		}
+	}
+}
+
+// cleanup deletes the segments of which the last write was more than max-age ago
+func (l *WAL) cleanup(now time.Time) {
+	names, err := listSegments(l.dir)
+	if err != nil {
+		walErrors.Inc()
+		log.Errorf("wal: failed to list segments: %s", err)
+		return
+	}
+	var current string
+	l.Lock()
+	if l.f != nil {
+		current = l.f.Name()
+	}
+	l.Unlock()
+	remaining := len(names)
+	for _, name := range names {
+		if name == current {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil || now.Sub(fi.ModTime()) < l.maxAge {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			walErrors.Inc()
+			log.Errorf("wal: failed to delete segment %s: %s", name, err)
+			continue
+		}
+		log.Debugf("wal: deleted segment %s", name)
+		remaining--
+	}
+	segments.Set(remaining)
+}
+
+// listSegments returns the paths of the segments in the directory, oldest first
+func listSegments(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), segmentSuffix) {
+			names = append(names, filepath.Join(dir, fi.Name()))
+		}
+	}
+	// names are zero padded timestamps, so they sort chronologically
+	sort.Strings(names)
+	return names, nil
+}
+
+// Replay adds the points of all segments in the directory to metrics, oldest first.
+// a segment is replayed up to the first record that is incomplete or corrupt, if any:
+// that is where the node crashed while writing.
+// points of series that are not in the index, e.g. because they were deleted since, are skipped,
+// as are the points of new series of orgs that reached their series limit.
+// it returns the number of points replayed.
+func Replay(dir string, metrics mdata.Metrics, index idx.MetricIndex) (int, error) {
+	names, err := listSegments(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, name := range names {
+		n, err := replaySegment(name, metrics, index)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to replay segment %s: %s", name, err)
+		}
+	}
+	segments.Set(len(names))
+	pointsReplayed.Add(total)
+	return total, nil
+}
+
+func replaySegment(name string, metrics mdata.Metrics, index idx.MetricIndex) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64*1024)
+	var buf [recordSize]byte
+	var n int
+	for {
+		_, err := io.ReadFull(r, buf[:])
+		if err == io.EOF {
+			return n, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			corruptRecords.Inc()
+			log.Warnf("wal: segment %s ends with an incomplete record. ignoring it", name)
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if binary.LittleEndian.Uint32(buf[0:]) != crc32.ChecksumIEEE(buf[4:]) {
+			corruptRecords.Inc()
+			log.Warnf("wal: segment %s has a corrupt record after %d points. ignoring the rest of it", name, n)
+			return n, nil
+		}
+		var key schema.MKey
+		copy(key.Key[:], buf[4:20])
+		key.Org = binary.LittleEndian.Uint32(buf[20:])
+		archive, ok := index.Get(key)
+		if !ok {
+			pointsSkipped.Inc()
+			continue
+		}
+		ts := binary.LittleEndian.Uint32(buf[28:])
+		val := math.Float64frombits(binary.LittleEndian.Uint64(buf[32:]))
+		m, err := metrics.GetOrCreate(key, archive.SchemaId, archive.AggId)
+		if err != nil {
+			pointsSkipped.Inc()
+			continue
+		}
+		m.Add(ts, val)
+		n++
+	}
+}
@@ -0,0 +1,166 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx/memory"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := New(dir, time.Hour, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 3600, 600, 2, 0))
+	mdata.SetSingleAgg(conf.Avg)
+	index := memory.New()
+	index.Init()
+	defer index.Stop()
+	md := &schema.MetricData{
+		OrgId:    1,
+		Name:     "some.metric",
+		Interval: 10,
+		Time:     10,
+	}
+	md.SetId()
+	key := test.MustMKeyFromString(md.Id)
+	index.AddOrUpdate(key, md, 0)
+	for ts := uint32(10); ts <= 50; ts += 10 {
+		l.Append(key, 0, 0, ts, float64(ts))
+	}
+	// a series that was deleted from the index since
+	deleted := test.GetMKey(2)
+	l.Append(deleted, 0, 0, 10, 1)
+	name := l.f.Name()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash while writing a record
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	ms := mdata.NewAggMetrics(mdata.NewMockStore(), &cache.MockCache{}, false, 1, 0, 0, 0)
+	n, err := Replay(dir, ms, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("expected 5 points to be replayed, got %d", n)
+	}
+
+	if _, ok := ms.Get(deleted); ok {
+		t.Fatalf("expected the series that is not in the index not to be created")
+	}
+	m, ok := ms.Get(key)
+	if !ok {
+		t.Fatalf("expected the series to be created")
+	}
+	res, err := m.Get(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for _, iter := range res.Iters {
+		for iter.Next() {
+			ts, val := iter.Values()
+			if val != float64(ts) {
+				t.Fatalf("expected value %d at ts %d, got %f", ts, ts, val)
+			}
+			got = append(got, ts)
+		}
+	}
+	if len(got) != 5 || got[0] != 10 || got[4] != 50 {
+		t.Fatalf("expected points 10 through 50, got %v", got)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := New(dir, 0, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	old := l.f.Name()
+	// with a segment duration of 0, every sync starts a new segment
+	if err := l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if l.f.Name() == old {
+		t.Fatalf("expected a new segment")
+	}
+
+	l.cleanup(time.Now())
+	if names, _ := listSegments(dir); len(names) != 2 {
+		t.Fatalf("expected recent segments to be kept, got %v", names)
+	}
+	l.cleanup(time.Now().Add(2 * time.Hour))
+	names, _ := listSegments(dir)
+	if len(names) != 1 || names[0] != l.f.Name() {
+		t.Fatalf("expected only the current segment to be kept, got %v", names)
+	}
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := New(dir, time.Hour, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(key schema.MKey) {
+			defer wg.Done()
+			for ts := uint32(1); ts <= 1000; ts++ {
+				l.Append(key, 0, 0, ts, float64(ts))
+				if ts%100 == 0 {
+					l.Sync()
+				}
+			}
+		}(test.GetMKey(i))
+	}
+	wg.Wait()
+	name := l.f.Name()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 8*1000*recordSize {
+		t.Fatalf("expected %d records, got %d bytes", 8*1000, fi.Size())
+	}
+}
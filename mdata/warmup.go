@@ -0,0 +1,97 @@
+package mdata
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// metric cache.warm_up.series is how many series were loaded into the chunk cache by the warm-up at startup
+	warmUpSeries = stats.NewCounter32("cache.warm_up.series")
+
+	// metric cache.warm_up.chunks is how many chunks were loaded into the chunk cache by the warm-up at startup
+	warmUpChunks = stats.NewCounter32("cache.warm_up.chunks")
+)
+
+// WarmUpEnabled returns whether the cache should be warmed up at startup
+func WarmUpEnabled() bool {
+	return warmUpMaxSeries > 0
+}
+
+// WarmUp loads the recent chunks of the raw archives of the most recently updated series from the store into the cache,
+// so that queries right after a restart, when there is no data in memory yet, don't all have to go to the store.
+// series that were updated within the warm-up window are loaded, the most recently updated first, up to the configured
+// max number of series. it returns when all series are loaded or ctx is done, and returns the number of series loaded.
+func WarmUp(ctx context.Context, store Store, c cache.Cache, metricIndex idx.MetricIndex) int {
+	now := uint32(time.Now().Unix())
+	from := now - warmUpWindow
+	defs := recentlyUpdated(metricIndex.ListAll(), int64(from), warmUpMaxSeries)
+
+	var loaded int
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan idx.Archive)
+	for i := 0; i < warmUpConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for def := range work {
+				key := schema.AMKey{MKey: def.Id}
+				ttl := uint32(GetSchema(def.SchemaId).Retentions[0].MaxRetention())
+				itergens, err := store.Search(ctx, key, ttl, from, now+1)
+				if err != nil {
+					log.Warnf("cache warm-up: failed to load chunks of %s: %s", def.Id, err)
+					continue
+				}
+				if len(itergens) == 0 {
+					continue
+				}
+				// the store returns the chunks in chronological order, as AddRange needs them
+				c.AddRange(key, 0, itergens)
+				warmUpSeries.Inc()
+				warmUpChunks.Add(len(itergens))
+				lock.Lock()
+				loaded++
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, def := range defs {
+		select {
+		case work <- def:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+	return loaded
+}
+
+// recentlyUpdated returns up to max of the given series that were updated at or after from,
+// the most recently updated first.
+func recentlyUpdated(defs []idx.Archive, from int64, max int) []idx.Archive {
+	recent := defs[:0]
+	for _, def := range defs {
+		if def.LastUpdate >= from {
+			recent = append(recent, def)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].LastUpdate > recent[j].LastUpdate
+	})
+	if len(recent) > max {
+		recent = recent[:max]
+	}
+	return recent
+}
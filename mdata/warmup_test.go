@@ -0,0 +1,83 @@
+package mdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+// listIndex is an index that only supports ListAll
+type listIndex struct {
+	idx.MetricIndex
+	defs []idx.Archive
+}
+
+func (l listIndex) ListAll() []idx.Archive {
+	return l.defs
+}
+
+func archive(i int, lastUpdate int64) idx.Archive {
+	return idx.Archive{
+		MetricDefinition: schema.MetricDefinition{
+			Id:         test.GetMKey(i),
+			LastUpdate: lastUpdate,
+		},
+	}
+}
+
+func TestRecentlyUpdated(t *testing.T) {
+	defs := []idx.Archive{
+		archive(1, 100),
+		archive(2, 300),
+		archive(3, 50),
+		archive(4, 200),
+	}
+	got := recentlyUpdated(defs, 100, 2)
+	if len(got) != 2 || got[0].Id != test.GetMKey(2) || got[1].Id != test.GetMKey(4) {
+		t.Fatalf("expected series 2 and 4, got %v", got)
+	}
+	got = recentlyUpdated(defs, 250, 10)
+	if len(got) != 1 || got[0].Id != test.GetMKey(2) {
+		t.Fatalf("expected series 2, got %v", got)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	defer func(series int, window uint32, concurrency int) {
+		warmUpMaxSeries, warmUpWindow, warmUpConcurrency = series, window, concurrency
+	}(warmUpMaxSeries, warmUpWindow, warmUpConcurrency)
+	warmUpMaxSeries, warmUpWindow, warmUpConcurrency = 2, 3600, 2
+	SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 2, 0))
+
+	now := uint32(time.Now().Unix())
+	store := NewMockStore()
+	var defs []idx.Archive
+	for i := 1; i <= 3; i++ {
+		key := schema.AMKey{MKey: test.GetMKey(i)}
+		for t0 := now - now%600 - 7200; t0 <= now; t0 += 600 {
+			c := chunk.New(t0)
+			c.Push(t0, 1)
+			c.Finish()
+			cwr := NewChunkWriteRequest(nil, key, c, 86400, 600, time.Now())
+			store.Add(&cwr)
+		}
+		defs = append(defs, archive(i, int64(now)-int64(i)*1000))
+	}
+
+	c := cache.NewMockCache()
+	n := WarmUp(context.Background(), store, c, listIndex{defs: defs})
+	if n != 2 {
+		t.Fatalf("expected 2 series to be loaded, got %d", n)
+	}
+	// each series has 7 chunks within the last hour (6 full ones and the current one)
+	if c.AddCount != 14 {
+		t.Fatalf("expected 14 chunks to be added to the cache, got %d", c.AddCount)
+	}
+}
@@ -0,0 +1,119 @@
+// Package protowire implements the parts of the protocol buffers wire format that our hand-written
+// message codecs need. those codecs are hand-written, to avoid a protoc dependency for such simple messages.
+package protowire
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// wire types
+const (
+	Varint  = 0
+	Fixed64 = 1
+	Bytes   = 2
+	Fixed32 = 5
+)
+
+var ErrTruncated = errors.New("protobuf: truncated message")
+var ErrWireType = errors.New("protobuf: unsupported wire type")
+
+func AppendUvarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func AppendKey(b []byte, field, wireType uint64) []byte {
+	return AppendUvarint(b, field<<3|wireType)
+}
+
+func AppendVarintField(b []byte, field, x uint64) []byte {
+	b = AppendKey(b, field, Varint)
+	return AppendUvarint(b, x)
+}
+
+func AppendDoubleField(b []byte, field uint64, f float64) []byte {
+	b = AppendKey(b, field, Fixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+	return append(b, buf[:]...)
+}
+
+func AppendString(b []byte, field uint64, s string) []byte {
+	b = AppendKey(b, field, Bytes)
+	b = AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func AppendBytes(b []byte, field uint64, d []byte) []byte {
+	b = AppendKey(b, field, Bytes)
+	b = AppendUvarint(b, uint64(len(d)))
+	return append(b, d...)
+}
+
+// AppendMessage appends an embedded message, whose fields are encoded by enc.
+// we encode the embedded message after reserving room for its length
+// (which we then move into place), so we don't need a temporary buffer
+func AppendMessage(b []byte, field uint64, enc func([]byte) []byte) []byte {
+	b = AppendKey(b, field, Bytes)
+	lenPos := len(b)
+	b = append(b, make([]byte, binary.MaxVarintLen32)...)
+	start := len(b)
+	b = enc(b)
+	size := len(b) - start
+	n := binary.PutUvarint(b[lenPos:], uint64(size))
+	copy(b[lenPos+n:], b[start:])
+	return b[:lenPos+n+size]
+}
+
+// ReadField reads one field from data.
+// val is the raw value: the varint bytes, the fixed size bytes or the length-delimited payload.
+// see Uvarint and Double to interpret it.
+func ReadField(data []byte) (field, wireType uint64, val, rest []byte, err error) {
+	key, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, nil, nil, ErrTruncated
+	}
+	data = data[n:]
+	field, wireType = key>>3, key&7
+	switch wireType {
+	case Varint:
+		_, n = binary.Uvarint(data)
+		if n <= 0 {
+			return 0, 0, nil, nil, ErrTruncated
+		}
+		return field, wireType, data[:n], data[n:], nil
+	case Fixed64:
+		if len(data) < 8 {
+			return 0, 0, nil, nil, ErrTruncated
+		}
+		return field, wireType, data[:8], data[8:], nil
+	case Fixed32:
+		if len(data) < 4 {
+			return 0, 0, nil, nil, ErrTruncated
+		}
+		return field, wireType, data[:4], data[4:], nil
+	case Bytes:
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return 0, 0, nil, nil, ErrTruncated
+		}
+		return field, wireType, data[n : n+int(l)], data[n+int(l):], nil
+	}
+	return 0, 0, nil, nil, ErrWireType
+}
+
+// Uvarint returns the value of a varint field, as read by ReadField
+func Uvarint(val []byte) uint64 {
+	v, _ := binary.Uvarint(val)
+	return v
+}
+
+// Double returns the value of a fixed64 field holding a double, as read by ReadField
+func Double(val []byte) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(val))
+}
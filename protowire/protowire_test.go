@@ -0,0 +1,73 @@
+package protowire
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var b []byte
+	b = AppendVarintField(b, 1, 300)
+	b = AppendString(b, 2, "foo")
+	b = AppendDoubleField(b, 3, -1.5)
+	b = AppendMessage(b, 4, func(b []byte) []byte {
+		return AppendBytes(b, 1, []byte{1, 2})
+	})
+	b = AppendKey(b, 5, Fixed32)
+	b = append(b, 0, 0, 0, 0)
+	b = AppendVarintField(b, 6, math.MaxUint64)
+
+	type fieldVal struct {
+		field, wireType uint64
+	}
+	exp := []fieldVal{{1, Varint}, {2, Bytes}, {3, Fixed64}, {4, Bytes}, {5, Fixed32}, {6, Varint}}
+	for i, e := range exp {
+		field, wireType, val, rest, err := ReadField(b)
+		if err != nil {
+			t.Fatalf("field %d: unexpected error %s", i, err)
+		}
+		if field != e.field || wireType != e.wireType {
+			t.Fatalf("field %d: expected field %d of wire type %d, got %d of %d", i, e.field, e.wireType, field, wireType)
+		}
+		switch field {
+		case 1:
+			if got := Uvarint(val); got != 300 {
+				t.Fatalf("expected 300, got %d", got)
+			}
+		case 2:
+			if string(val) != "foo" {
+				t.Fatalf("expected foo, got %q", val)
+			}
+		case 3:
+			if got := Double(val); got != -1.5 {
+				t.Fatalf("expected -1.5, got %f", got)
+			}
+		case 4:
+			f, _, inner, _, err := ReadField(val)
+			if err != nil || f != 1 || !bytes.Equal(inner, []byte{1, 2}) {
+				t.Fatalf("unexpected embedded message %v: %v, %v", val, inner, err)
+			}
+		case 6:
+			if got := Uvarint(val); got != math.MaxUint64 {
+				t.Fatalf("expected %d, got %d", uint64(math.MaxUint64), got)
+			}
+		}
+		b = rest
+	}
+	if len(b) != 0 {
+		t.Fatalf("expected all data to be read, %d bytes left", len(b))
+	}
+}
+
+func TestReadFieldErrors(t *testing.T) {
+	full := AppendString(nil, 1, "foo")
+	for i := 0; i < len(full); i++ {
+		if _, _, _, _, err := ReadField(full[:i]); err != ErrTruncated {
+			t.Fatalf("%d bytes: expected ErrTruncated, got %v", i, err)
+		}
+	}
+	if _, _, _, _, err := ReadField(AppendKey(nil, 1, 3)); err != ErrWireType {
+		t.Fatalf("expected ErrWireType for a group, got %v", err)
+	}
+}
@@ -327,8 +327,95 @@ func (s *Store) SetTracer(t opentracing.Tracer) {
 	s.tracer = t
 }
 
+// Stats returns the state of the store: how many chunks are waiting to be saved, over all write queues.
+// chunks that were taken off the queues to be written in a batch are not included
+func (s *Store) Stats() mdata.StoreStats {
+	stats := mdata.StoreStats{Backend: "bigtable"}
+	for _, q := range s.writeQueues {
+		stats.WriteQueueItems += len(q)
+		stats.WriteQueueSize += cap(q)
+	}
+	return stats
+}
+
+// CompactChunks is not supported: reads only look back the max chunkspan of the schemas for the first chunk,
+// so they would miss compacted chunks, which have a larger span
+func (s *Store) CompactChunks(ctx context.Context, cwr *mdata.ChunkWriteRequest, t0s []uint32) error {
+	return mdata.ErrCompactUnsupported
+}
+
 // Basic search of bigtable for data chunks
 // start inclusive, end exclusive
+// Delete deletes all chunks of the given archive that were saved with the given ttl.
+// all archives of a series share their rows, so we only delete the cells of the column of the archive.
+// chunks can only be in the rows of the months within the ttl, plus the one before,
+// because a chunk is saved after its t0.
+func (s *Store) Delete(ctx context.Context, key schema.AMKey, ttl uint32) error {
+	family := formatFamily(ttl)
+	column := "raw"
+	if key.Archive > 0 {
+		column = key.Archive.String()
+	}
+	now := uint32(time.Now().Unix())
+	var start uint32
+	if now > ttl+Month_sec {
+		start = now - ttl - Month_sec
+	}
+	var rowKeys []string
+	var muts []*bigtable.Mutation
+	for ts := start - (start % Month_sec); ts <= now; ts += Month_sec {
+		mut := bigtable.NewMutation()
+		mut.DeleteCellsInColumn(family, column)
+		rowKeys = append(rowKeys, formatRowKey(key, ts))
+		muts = append(muts, mut)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.WriteTimeout)
+	defer cancel()
+	errs, err := s.tbl.ApplyBulk(ctx, rowKeys, muts)
+	if err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange deletes the chunks of the given archive that were saved with the given ttl, and whose t0 is in the range
+// from (inclusive) - to (exclusive). the cells of chunks are timestamped with their t0, in the row of the month of their t0.
+func (s *Store) DeleteRange(ctx context.Context, key schema.AMKey, ttl, from, to uint32) error {
+	if from >= to {
+		return nil
+	}
+	family := formatFamily(ttl)
+	column := "raw"
+	if key.Archive > 0 {
+		column = key.Archive.String()
+	}
+	var rowKeys []string
+	var muts []*bigtable.Mutation
+	for ts := from - (from % Month_sec); ts < to; ts += Month_sec {
+		mut := bigtable.NewMutation()
+		mut.DeleteTimestampRange(family, column, bigtable.Timestamp(int64(from)*1e6), bigtable.Timestamp(int64(to)*1e6))
+		rowKeys = append(rowKeys, formatRowKey(key, ts))
+		muts = append(muts, mut)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.WriteTimeout)
+	defer cancel()
+	errs, err := s.tbl.ApplyBulk(ctx, rowKeys, muts)
+	if err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Store) Search(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
 	log.Debugf("btStore: fetching chunks for metric %s in range %d %d", key, start, end)
 	_, span := tracing.NewSpan(ctx, s.tracer, "BigtableStore.Search")
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/mdata"
 )
 
 type StoreConfig struct {
@@ -91,3 +92,30 @@ func ConfigProcess(schemaMaxChunkSpan uint32) {
 		log.Fatalf("bigtable-store: Config validation error. %s", err)
 	}
 }
+
+func init() {
+	mdata.RegisterStore("bigtable", backend{})
+}
+
+// backend makes the bigtable store selectable in the config. see mdata.RegisterStore
+type backend struct{}
+
+func (backend) ConfigSetup() {
+	ConfigSetup()
+}
+
+func (backend) ConfigProcess(schemaMaxChunkSpan uint32) {
+	ConfigProcess(schemaMaxChunkSpan)
+}
+
+func (backend) Enabled() bool {
+	return CliConfig.Enabled
+}
+
+func (backend) New(ttls []uint32, schemaMaxChunkSpan uint32) (mdata.Store, error) {
+	store, err := NewStore(CliConfig, ttls, schemaMaxChunkSpan)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
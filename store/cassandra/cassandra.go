@@ -18,7 +18,6 @@ import (
 	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/tracing"
 	"github.com/grafana/metrictank/util"
-	"github.com/hailocab/go-hostpool"
 	opentracing "github.com/opentracing/opentracing-go"
 	tags "github.com/opentracing/opentracing-go/ext"
 	log "github.com/sirupsen/logrus"
@@ -42,10 +41,21 @@ var (
 	cassGetExecDuration = stats.NewLatencyHistogram15s32("store.cassandra.get.exec")
 	// metric store.cassandra.get.wait is the duration of the get spent in the queue
 	cassGetWaitDuration = stats.NewLatencyHistogram12h32("store.cassandra.get.wait")
+	// metric store.cassandra.get.fallback is counter of reads that were retried with read-fallback-consistency,
+	// because not enough replicas were up for read-consistency
+	cassGetFallback = stats.NewCounter32("store.cassandra.get.fallback")
+	// metric store.cassandra.get.in_flight is how many reads are being executed against cassandra
+	cassGetInFlight = stats.NewGauge32("store.cassandra.get.in_flight")
+	// metric store.cassandra.read_queue.items is how many reads are waiting in the read queue
+	cassReadQueueItems = stats.NewRange32("store.cassandra.read_queue.items")
 	// metric store.cassandra.put.exec is the duration of putting in cassandra store
 	cassPutExecDuration = stats.NewLatencyHistogram15s32("store.cassandra.put.exec")
 	// metric store.cassandra.put.wait is the duration of a put in the wait queue
 	cassPutWaitDuration = stats.NewLatencyHistogram12h32("store.cassandra.put.wait")
+	// metric store.cassandra.put.batch_size is how many chunks are written per put. more than 1 when batching writes
+	cassPutBatchSize = stats.NewMeter32("store.cassandra.put.batch_size", false)
+	// metric store.cassandra.put.in_flight is how many writes - of a chunk or a batch of chunks - are being executed against cassandra
+	cassPutInFlight = stats.NewGauge32("store.cassandra.put.in_flight")
 	// reads that were already too old to be executed
 	cassOmitOldRead = stats.NewCounter32("store.cassandra.omit_read.too_old")
 	// reads that could not be pushed into the queue because it was full
@@ -64,31 +74,84 @@ var (
 	chunkSaveOk = stats.NewCounter32("store.cassandra.chunk_operations.save_ok")
 	// metric store.cassandra.chunk_operations.save_fail is counter of failed saves
 	chunkSaveFail = stats.NewCounter32("store.cassandra.chunk_operations.save_fail")
+	// metric store.cassandra.chunk_operations.save_dropped is counter of chunks that were not saved, because cassandra rejected them as invalid
+	chunkSaveDropped = stats.NewCounter32("store.cassandra.chunk_operations.save_dropped")
 	// metric store.cassandra.chunk_size.at_save is the sizes of chunks seen when saving them
 	chunkSizeAtSave = stats.NewMeter32("store.cassandra.chunk_size.at_save", true)
 	// metric store.cassandra.chunk_size.at_load is the sizes of chunks seen when loading them
 	chunkSizeAtLoad = stats.NewMeter32("store.cassandra.chunk_size.at_load", true)
 
+	// metric store.cassandra.dual_format.save_fail is counter of failed saves of chunks in the dual write format
+	dualSaveFail = stats.NewCounter32("store.cassandra.dual_format.save_fail")
+	// metric store.cassandra.dual_format.verify_ok is counter of chunks read that matched their copy in the dual write format
+	dualVerifyOk = stats.NewCounter32("store.cassandra.dual_format.verify_ok")
+	// metric store.cassandra.dual_format.verify_mismatch is counter of chunks read that didn't match their copy in the dual write format
+	dualVerifyMismatch = stats.NewCounter32("store.cassandra.dual_format.verify_mismatch")
+	// metric store.cassandra.dual_format.verify_missing is counter of chunks read that had no copy in the dual write format
+	dualVerifyMissing = stats.NewCounter32("store.cassandra.dual_format.verify_missing")
+
 	errmetrics = cassandra.NewErrMetrics("store.cassandra")
 )
 
+// metric store.cassandra.table.%s.error.read is counter of failed reads of the given table
+
+// tableReadErrors returns the counter of failed reads of the table.
+// tables are only known at runtime, so the counter is looked up when needed: this is only for the error path
+func tableReadErrors(table string) *stats.Counter32 {
+	return stats.NewCounter32(fmt.Sprintf("store.cassandra.table.%s.error.read", table))
+}
+
+// metric store.cassandra.table.%s.error.write is counter of failed writes to the given table. a chunk write may fail several times before it succeeds
+
+// tableWriteErrors returns the counter of failed writes to the table, see tableReadErrors
+func tableWriteErrors(table string) *stats.Counter32 {
+	return stats.NewCounter32(fmt.Sprintf("store.cassandra.table.%s.error.write", table))
+}
+
 type ChunkReadRequest struct {
 	q         string
 	p         []interface{}
 	timestamp time.Time
 	out       chan readResult
 	ctx       context.Context
+	fallback  bool // read with the fallback consistency
 }
 
 type CassandraStore struct {
 	Session          *gocql.Session
-	writeQueues      []chan *mdata.ChunkWriteRequest
+	writeQueues      []*writeQueue
 	writeQueueMeters []*stats.Range32
 	readQueue        chan *ChunkReadRequest
+	readConsistency  gocql.Consistency
 	TTLTables        TTLTables
 	omitReadTimeout  time.Duration
 	tracer           opentracing.Tracer
 	timeout          time.Duration
+
+	// if readFallback is set, reads that fail because not enough replicas are up for readConsistency are retried with readFallbackConsistency
+	readFallback            bool
+	readFallbackConsistency gocql.Consistency
+
+	// failed writes are retried after a backoff that doubles from retryMinBackoff up to retryMaxBackoff
+	retryMinBackoff time.Duration
+	retryMaxBackoff time.Duration
+
+	// chunks from the write queue for the same partition are written in batches.
+	// a batch holds at most writeBatchSize chunks and writeBatchMaxBytes bytes of chunk data
+	// and we wait at most writeBatchWait for chunks to fill it.
+	writeBatchSize     int
+	writeBatchMaxBytes int
+	writeBatchWait     time.Duration
+
+	// to migrate between chunk formats, chunks can also be written in an older format.
+	// they are stored under their own row keys (see dualRowKey)
+	dualWrite       bool
+	dualWriteFormat chunk.Format
+	dualWriteUntil  int64 // unix timestamp. 0 means no end
+	dualWriteVerify bool
+
+	// chunks that don't fit in the write queues. nil if disabled
+	spill *spillBuffer
 }
 
 // ConvertTimeout provides backwards compatibility for values that used to be specified as integers,
@@ -107,14 +170,26 @@ func ConvertTimeout(timeout string, defaultUnit time.Duration) time.Duration {
 
 // NewCassandraStore creates a new cassandra store, using the provided retention ttl's in seconds
 func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, error) {
+	if config.WriteRetryMinBackoff <= 0 || config.WriteRetryMaxBackoff < config.WriteRetryMinBackoff {
+		return nil, errors.New("write-retry-min-backoff must be positive, and write-retry-max-backoff must not be less than it")
+	}
+	if config.WriteBatchSize < 1 {
+		return nil, errors.New("write-batch-size must be at least 1")
+	}
+
+	var err error
 	stats.NewGauge32("store.cassandra.write_queue.size").Set(config.WriteQueueSize)
 	stats.NewGauge32("store.cassandra.num_writers").Set(config.WriteConcurrency)
+	// metric store.cassandra.read_queue.size is the max number of reads that can wait in the read queue
+	stats.NewGauge32("store.cassandra.read_queue.size").Set(config.ReadQueueSize)
+	// metric store.cassandra.num_readers is the number of workers executing reads
+	stats.NewGauge32("store.cassandra.num_readers").Set(config.ReadConcurrency)
 
 	cluster := gocql.NewCluster(strings.Split(config.Addrs, ",")...)
 	if config.SSL {
-		cluster.SslOpts = &gocql.SslOptions{
-			CaPath:                 config.CaPath,
-			EnableHostVerification: config.HostVerification,
+		cluster.SslOpts, err = cassandra.SslOptions(config.CaPath, config.CertPath, config.KeyPath, config.HostVerification)
+		if err != nil {
+			return nil, err
 		}
 	}
 	if config.Auth {
@@ -126,11 +201,29 @@ func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, err
 
 	cluster.Timeout = ConvertTimeout(config.Timeout, time.Millisecond)
 	cluster.Consistency = gocql.ParseConsistency(config.Consistency)
+	readConsistency := cluster.Consistency
+	if config.ReadConsistency != "" {
+		readConsistency, err = gocql.ParseConsistencyWrapper(config.ReadConsistency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read-consistency. %s", err)
+		}
+	}
+	var readFallback bool
+	var readFallbackConsistency gocql.Consistency
+	if config.ReadFallbackConsistency != "" {
+		readFallback = true
+		readFallbackConsistency, err = gocql.ParseConsistencyWrapper(config.ReadFallbackConsistency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read-fallback-consistency. %s", err)
+		}
+	}
 	cluster.ConnectTimeout = cluster.Timeout
 	cluster.NumConns = config.WriteConcurrency
+	if config.ConnectionsPerHost > 0 {
+		cluster.NumConns = config.ConnectionsPerHost
+	}
 	cluster.ProtoVersion = config.CqlProtocolVersion
 	cluster.DisableInitialHostLookup = config.DisableInitialHostLookup
-	var err error
 	tmpSession, err := cluster.CreateSession()
 	if err != nil {
 		log.Errorf("cassandra_store: failed to create cassandra session. %s", err.Error())
@@ -155,6 +248,10 @@ func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, err
 			if err != nil {
 				return nil, err
 			}
+			err = cassandra.Migrate(tmpSession, config.Keyspace, table.Name, migrations)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		if err != nil {
@@ -192,31 +289,20 @@ func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, err
 	cluster.Keyspace = config.Keyspace
 	cluster.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: config.Retries}
 
-	switch config.HostSelectionPolicy {
-	case "roundrobin":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.RoundRobinHostPolicy()
-	case "hostpool-simple":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.HostPoolHostPolicy(hostpool.New(nil))
-	case "hostpool-epsilon-greedy":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.HostPoolHostPolicy(
-			hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
-		)
-	case "tokenaware,roundrobin":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
-			gocql.RoundRobinHostPolicy(),
-		)
-	case "tokenaware,hostpool-simple":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
-			gocql.HostPoolHostPolicy(hostpool.New(nil)),
-		)
-	case "tokenaware,hostpool-epsilon-greedy":
-		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
-			gocql.HostPoolHostPolicy(
-				hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
-			),
-		)
-	default:
-		return nil, fmt.Errorf("unknown HostSelectionPolicy '%q'", config.HostSelectionPolicy)
+	cluster.PoolConfig.HostSelectionPolicy, err = cassandra.HostSelectionPolicy(config.HostSelectionPolicy, config.LocalDC)
+	if err != nil {
+		return nil, err
+	}
+
+	var dualWriteFormat chunk.Format
+	if config.DualWriteFormat != "" {
+		dualWriteFormat, err = chunk.ParseFormat(config.DualWriteFormat)
+		if err != nil {
+			return nil, err
+		}
+		if dualWriteFormat == chunk.DefaultFormat {
+			return nil, fmt.Errorf("dual-write-format %s is the format chunks are already written in", dualWriteFormat)
+		}
 	}
 
 	session, err := cluster.CreateSession()
@@ -225,18 +311,38 @@ func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, err
 	}
 	log.Debugf("CS: created session with config %+v", config)
 	c := &CassandraStore{
-		Session:          session,
-		writeQueues:      make([]chan *mdata.ChunkWriteRequest, config.WriteConcurrency),
-		writeQueueMeters: make([]*stats.Range32, config.WriteConcurrency),
-		readQueue:        make(chan *ChunkReadRequest, config.ReadQueueSize),
-		omitReadTimeout:  ConvertTimeout(config.OmitReadTimeout, time.Second),
-		TTLTables:        ttlTables,
-		tracer:           opentracing.NoopTracer{},
-		timeout:          cluster.Timeout,
+		Session:                 session,
+		writeQueues:             make([]*writeQueue, config.WriteConcurrency),
+		writeQueueMeters:        make([]*stats.Range32, config.WriteConcurrency),
+		readQueue:               make(chan *ChunkReadRequest, config.ReadQueueSize),
+		readConsistency:         readConsistency,
+		omitReadTimeout:         ConvertTimeout(config.OmitReadTimeout, time.Second),
+		TTLTables:               ttlTables,
+		tracer:                  opentracing.NoopTracer{},
+		timeout:                 cluster.Timeout,
+		readFallback:            readFallback,
+		readFallbackConsistency: readFallbackConsistency,
+		retryMinBackoff:         config.WriteRetryMinBackoff,
+		retryMaxBackoff:         config.WriteRetryMaxBackoff,
+		writeBatchSize:          config.WriteBatchSize,
+		writeBatchMaxBytes:      config.WriteBatchMaxBytes,
+		writeBatchWait:          config.WriteBatchWait,
+		dualWrite:               config.DualWriteFormat != "",
+		dualWriteFormat:         dualWriteFormat,
+		dualWriteUntil:          config.DualWriteUntil,
+		dualWriteVerify:         config.DualWriteVerify,
+	}
+
+	if config.SpillDir != "" {
+		c.spill, err = newSpillBuffer(config.SpillDir, config.SpillMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spill-dir %s. %s", config.SpillDir, err)
+		}
+		go c.drainSpill()
 	}
 
 	for i := 0; i < config.WriteConcurrency; i++ {
-		c.writeQueues[i] = make(chan *mdata.ChunkWriteRequest, config.WriteQueueSize)
+		c.writeQueues[i] = newWriteQueue(config.WriteQueueSize)
 		c.writeQueueMeters[i] = stats.NewRange32(fmt.Sprintf("store.cassandra.write_queue.%d.items", i+1))
 		go c.processWriteQueue(c.writeQueues[i], c.writeQueueMeters[i])
 	}
@@ -279,10 +385,13 @@ func (c *CassandraStore) FindExistingTables(keyspace string) error {
 			return fmt.Errorf("could not parse table %q", table.Name)
 		}
 		c.TTLTables[uint32(ttl)] = Table{
-			Name:       table.Name,
-			QueryRead:  fmt.Sprintf(QueryFmtRead, table.Name),
-			QueryWrite: fmt.Sprintf(QueryFmtWrite, table.Name),
-			TTL:        uint32(ttl),
+			Name:             table.Name,
+			QueryRead:        fmt.Sprintf(QueryFmtRead, table.Name),
+			QueryWrite:       fmt.Sprintf(QueryFmtWrite, table.Name),
+			QueryDelete:      fmt.Sprintf(QueryFmtDelete, table.Name),
+			QueryDeleteChunk: fmt.Sprintf(QueryFmtDeleteChunk, table.Name),
+			QueryDeleteRange: fmt.Sprintf(QueryFmtDeleteRange, table.Name),
+			TTL:              uint32(ttl),
 		}
 	}
 	return nil
@@ -292,59 +401,294 @@ func (c *CassandraStore) SetTracer(t opentracing.Tracer) {
 	c.tracer = t
 }
 
+// Stats returns the state of the store: how many chunks are waiting to be saved, over all write queues.
+// chunks in the spill buffer count as queued items.
+func (c *CassandraStore) Stats() mdata.StoreStats {
+	stats := mdata.StoreStats{Backend: "cassandra"}
+	for _, q := range c.writeQueues {
+		stats.WriteQueueItems += q.len()
+		stats.WriteQueueSize += q.cap()
+	}
+	if c.spill != nil {
+		stats.WriteQueueItems += c.spill.len()
+	}
+	return stats
+}
+
 func (c *CassandraStore) Add(cwr *mdata.ChunkWriteRequest) {
 	sum := int(cwr.Key.MKey.Org)
 	for _, b := range cwr.Key.MKey.Key {
 		sum += int(b)
 	}
 	which := sum % len(c.writeQueues)
-	c.writeQueueMeters[which].Value(len(c.writeQueues[which]))
-	c.writeQueues[which] <- cwr
+	c.writeQueueMeters[which].Value(c.writeQueues[which].len())
+	if c.spill == nil {
+		c.writeQueues[which].add(cwr)
+		return
+	}
+	if c.writeQueues[which].tryAdd(cwr) {
+		return
+	}
+	if c.spillChunk(cwr) {
+		spillAdd.Inc()
+		return
+	}
+	spillFull.Inc()
+	c.writeQueues[which].add(cwr)
+}
+
+// spillChunk adds the chunk to the spill buffer, rather than blocking on a full write queue.
+// it returns false if the spill buffer couldn't take it.
+func (c *CassandraStore) spillChunk(cwr *mdata.ChunkWriteRequest) bool {
+	sc := spilledChunk{
+		key:  cwr.Key.String(),
+		t0:   cwr.Chunk.Series.T0,
+		ttl:  cwr.TTL,
+		data: cwr.Chunk.Encode(cwr.Span),
+	}
+	if c.dualWriting(time.Now()) {
+		dual, err := cwr.Chunk.EncodeAs(cwr.Span, c.dualWriteFormat)
+		if err == nil {
+			sc.dual = dual
+		}
+	}
+	return c.spill.add(sc, cwr.Metric)
+}
+
+// drainSpill saves the chunks from the spill buffer, oldest first.
+func (c *CassandraStore) drainSpill() {
+	for {
+		name, sc, metric, ok := c.spill.next()
+		if !ok {
+			select {
+			case <-c.spill.notify:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		chunkSizeAtSave.Value(len(sc.data))
+		if !c.saveChunk(sc.key, sc.t0, sc.ttl, sc.data) {
+			c.spill.remove(name)
+			continue
+		}
+		metric.SyncChunkSaveState(sc.t0)
+		mdata.SendPersistMessage(sc.key, sc.t0)
+		log.Debugf("CS: save complete of spilled chunk %s:%d", sc.key, sc.t0)
+		if sc.dual != nil {
+			rowKey := c.dualRowKey(fmt.Sprintf("%s_%d", sc.key, sc.t0/Month_sec))
+			if err := c.insertChunkRow(rowKey, sc.t0, sc.ttl, sc.dual); err != nil {
+				dualSaveFail.Inc()
+				log.Warnf("CS: failed to save spilled chunk %s:%d in dual write format %s. %s", sc.key, sc.t0, c.dualWriteFormat, err)
+			}
+		}
+		c.spill.remove(name)
+	}
 }
 
 /* process writeQueue.
  */
-func (c *CassandraStore) processWriteQueue(queue chan *mdata.ChunkWriteRequest, meter *stats.Range32) {
+func (c *CassandraStore) processWriteQueue(queue *writeQueue, meter *stats.Range32) {
 	tick := time.Tick(time.Duration(1) * time.Second)
 	for {
 		select {
 		case <-tick:
-			meter.Value(len(queue))
-		case cwr := <-queue:
-			meter.Value(len(queue))
-			log.Debugf("CS: starting to save %s:%d %v", cwr.Key, cwr.Chunk.Series.T0, cwr.Chunk)
-			//log how long the chunk waited in the queue before we attempted to save to cassandra
-			cassPutWaitDuration.Value(time.Now().Sub(cwr.Timestamp))
-
-			buf := cwr.Chunk.Encode(cwr.Span)
-			chunkSizeAtSave.Value(len(buf))
-			success := false
-			attempts := 0
-			keyStr := cwr.Key.String()
-			for !success {
-				err := c.insertChunk(keyStr, cwr.Chunk.Series.T0, cwr.TTL, buf)
-
-				if err == nil {
-					success = true
-					cwr.Metric.SyncChunkSaveState(cwr.Chunk.Series.T0)
-					mdata.SendPersistMessage(keyStr, cwr.Chunk.Series.T0)
-					log.Debugf("CS: save complete. %s:%d %v", keyStr, cwr.Chunk.Series.T0, cwr.Chunk)
-					chunkSaveOk.Inc()
-				} else {
-					errmetrics.Inc(err)
-					if (attempts % 20) == 0 {
-						log.Warnf("CS: failed to save chunk to cassandra after %d attempts. %v, %s", attempts+1, cwr.Chunk, err)
-					}
-					chunkSaveFail.Inc()
-					sleepTime := 100 * attempts
-					if sleepTime > 2000 {
-						sleepTime = 2000
-					}
-					time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-					attempts++
-				}
+			meter.Value(queue.len())
+		case <-queue.ready():
+			cwrs := c.collectWrites(queue.take(), queue)
+			meter.Value(queue.len())
+			writes := make([]chunkWrite, len(cwrs))
+			for i, cwr := range cwrs {
+				log.Debugf("CS: starting to save %s:%d %v", cwr.Key, cwr.Chunk.Series.T0, cwr.Chunk)
+				//log how long the chunk waited in the queue before we attempted to save to cassandra
+				cassPutWaitDuration.Value(time.Now().Sub(cwr.Timestamp))
+				writes[i] = newChunkWrite(cwr)
+				chunkSizeAtSave.Value(len(writes[i].data))
+			}
+			for _, batch := range c.batchWrites(writes) {
+				c.saveBatch(batch)
+			}
+		}
+	}
+}
+
+// chunkWrite is a chunk from the write queue, encoded for saving
+type chunkWrite struct {
+	cwr    *mdata.ChunkWriteRequest
+	keyStr string
+	rowKey string
+	data   []byte
+}
+
+func newChunkWrite(cwr *mdata.ChunkWriteRequest) chunkWrite {
+	keyStr := cwr.Key.String()
+	return chunkWrite{
+		cwr:    cwr,
+		keyStr: keyStr,
+		rowKey: fmt.Sprintf("%s_%d", keyStr, cwr.Chunk.Series.T0/Month_sec),
+		data:   cwr.Chunk.Encode(cwr.Span),
+	}
+}
+
+// collectWrites returns the given chunk write request followed by the next oldest ones in the queue,
+// up to the write batch size, waiting at most writeBatchWait for them.
+func (c *CassandraStore) collectWrites(cwr *mdata.ChunkWriteRequest, queue *writeQueue) []*mdata.ChunkWriteRequest {
+	cwrs := []*mdata.ChunkWriteRequest{cwr}
+	if c.writeBatchSize <= 1 {
+		return cwrs
+	}
+	var timeout <-chan time.Time
+	for len(cwrs) < c.writeBatchSize {
+		select {
+		case <-queue.ready():
+			cwrs = append(cwrs, queue.take())
+			continue
+		default:
+		}
+		if c.writeBatchWait <= 0 {
+			break
+		}
+		if timeout == nil {
+			timer := time.NewTimer(c.writeBatchWait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-queue.ready():
+			cwrs = append(cwrs, queue.take())
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	return cwrs
+}
+
+// batchWrites groups the writes by partition - the table, determined by the ttl, and the row key - in the order
+// the partitions are first seen, and splits the groups so that they stay within the batch limits.
+func (c *CassandraStore) batchWrites(writes []chunkWrite) [][]chunkWrite {
+	type partition struct {
+		ttl    uint32
+		rowKey string
+	}
+	var order []partition
+	groups := make(map[partition][]chunkWrite)
+	for _, w := range writes {
+		p := partition{w.cwr.TTL, w.rowKey}
+		if _, ok := groups[p]; !ok {
+			order = append(order, p)
+		}
+		groups[p] = append(groups[p], w)
+	}
+	var batches [][]chunkWrite
+	for _, p := range order {
+		var batch []chunkWrite
+		size := 0
+		for _, w := range groups[p] {
+			if len(batch) > 0 && (len(batch) == c.writeBatchSize || size+len(w.data) > c.writeBatchMaxBytes) {
+				batches = append(batches, batch)
+				batch, size = nil, 0
 			}
+			batch = append(batch, w)
+			size += len(w.data)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// saveBatch saves the chunks of a batch - all for the same partition - and marks them as saved once they are.
+func (c *CassandraStore) saveBatch(batch []chunkWrite) {
+	cassPutBatchSize.Value(len(batch))
+	var saved bool
+	if len(batch) == 1 {
+		w := batch[0]
+		saved = c.retryWrite(fmt.Sprintf("chunk %s:%d", w.keyStr, w.cwr.Chunk.Series.T0), 1, func() error {
+			return c.insertChunkRow(w.rowKey, w.cwr.Chunk.Series.T0, w.cwr.TTL, w.data)
+		})
+	} else {
+		saved = c.retryWrite(fmt.Sprintf("batch of %d chunks for %s", len(batch), batch[0].rowKey), len(batch), func() error {
+			return c.insertBatch(batch)
+		})
+	}
+	if !saved {
+		return
+	}
+	for _, w := range batch {
+		w.cwr.Metric.SyncChunkSaveState(w.cwr.Chunk.Series.T0)
+		mdata.SendPersistMessage(w.keyStr, w.cwr.Chunk.Series.T0)
+		log.Debugf("CS: save complete. %s:%d %v", w.keyStr, w.cwr.Chunk.Series.T0, w.cwr.Chunk)
+		if c.dualWriting(time.Now()) {
+			c.insertDualChunk(w.cwr, w.keyStr)
+		}
+	}
+}
+
+// saveChunk saves the chunk, see retryWrite
+func (c *CassandraStore) saveChunk(key string, t0, ttl uint32, data []byte) bool {
+	return c.retryWrite(fmt.Sprintf("chunk %s:%d", key, t0), 1, func() error {
+		return c.insertChunk(key, t0, ttl, data)
+	})
+}
+
+// retryWrite executes a write of the given number of chunks, retrying with exponential backoff
+// for as long as the errors are retryable: transient errors such as timeouts must not lose chunks,
+// and neither must problems with the setup, such as bad credentials or a missing table, which are retried at max backoff.
+// only chunks that cassandra rejects as invalid are dropped.
+// it returns whether the chunks were saved. only then may they be marked as saved.
+func (c *CassandraStore) retryWrite(what string, chunks int, insert func() error) bool {
+	backoff := c.retryMinBackoff
+	for attempts := 1; ; attempts++ {
+		err := insert()
+		if err == nil {
+			chunkSaveOk.Add(chunks)
+			return true
+		}
+		errmetrics.Inc(err)
+		chunkSaveFail.Inc()
+		if !cassandra.Retryable(err) {
+			chunkSaveDropped.Add(chunks)
+			log.Errorf("CS: cassandra rejected %s, dropping it. %s", what, err)
+			return false
+		}
+		if err == errTableNotFound || cassandra.Misconfigured(err) {
+			// no write will succeed until the setup is fixed, but dropping the chunks would lose them for good.
+			// keep trying at the slowest rate, and make noise about it.
+			backoff = c.retryMaxBackoff
+			log.Errorf("CS: failed to save %s to cassandra after %d attempts, because of a problem with the setup that needs fixing. retrying in %s. %s", what, attempts, backoff, err)
+		} else if (attempts % 20) == 1 {
+			log.Warnf("CS: failed to save %s to cassandra after %d attempts, retrying in %s. %s", what, attempts, backoff, err)
 		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > c.retryMaxBackoff {
+			backoff = c.retryMaxBackoff
+		}
+	}
+}
+
+// dualWriting returns whether chunks should also be written in the dual write format
+func (c *CassandraStore) dualWriting(now time.Time) bool {
+	return c.dualWrite && (c.dualWriteUntil == 0 || now.Unix() < c.dualWriteUntil)
+}
+
+// dualRowKey returns the row key under which chunks in the dual write format
+// are stored, for the given row key
+func (c *CassandraStore) dualRowKey(rowKey string) string {
+	return fmt.Sprintf("%s_f%d", rowKey, c.dualWriteFormat)
+}
+
+// insertDualChunk saves the chunk in the dual write format.
+// the chunk in the current format has already been saved, so we don't retry:
+// a missing copy is reported when the chunk is verified.
+func (c *CassandraStore) insertDualChunk(cwr *mdata.ChunkWriteRequest, keyStr string) {
+	buf, err := cwr.Chunk.EncodeAs(cwr.Span, c.dualWriteFormat)
+	if err == nil {
+		rowKey := c.dualRowKey(fmt.Sprintf("%s_%d", keyStr, cwr.Chunk.Series.T0/Month_sec))
+		err = c.insertChunkRow(rowKey, cwr.Chunk.Series.T0, cwr.TTL, buf)
+	}
+	if err != nil {
+		dualSaveFail.Inc()
+		log.Warnf("CS: failed to save chunk in dual write format %s. %v, %s", c.dualWriteFormat, cwr.Chunk, err)
 	}
 }
 
@@ -354,6 +698,11 @@ func (c *CassandraStore) processWriteQueue(queue chan *mdata.ChunkWriteRequest,
 // ts: is the start of the aggregated time range.
 // data: is the payload as bytes.
 func (c *CassandraStore) insertChunk(key string, t0, ttl uint32, data []byte) error {
+	row_key := fmt.Sprintf("%s_%d", key, t0/Month_sec) // "month number" based on unix timestamp (rounded down)
+	return c.insertChunkRow(row_key, t0, ttl, data)
+}
+
+func (c *CassandraStore) insertChunkRow(row_key string, t0, ttl uint32, data []byte) error {
 	// for unit tests
 	if c.Session == nil {
 		return nil
@@ -364,12 +713,46 @@ func (c *CassandraStore) insertChunk(key string, t0, ttl uint32, data []byte) er
 		return errTableNotFound
 	}
 
-	row_key := fmt.Sprintf("%s_%d", key, t0/Month_sec) // "month number" based on unix timestamp (rounded down)
 	pre := time.Now()
 	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	cassPutInFlight.Inc()
 	ret := c.Session.Query(table.QueryWrite, row_key, t0, data, ttl).WithContext(ctx).Exec()
+	cassPutInFlight.Dec()
+	cancel()
+	cassPutExecDuration.Value(time.Now().Sub(pre))
+	if ret != nil {
+		tableWriteErrors(table.Name).Inc()
+	}
+	return ret
+}
+
+// insertBatch writes the chunks, which must be for the same partition, in an unlogged batch
+func (c *CassandraStore) insertBatch(batch []chunkWrite) error {
+	// for unit tests
+	if c.Session == nil {
+		return nil
+	}
+
+	ttl := batch[0].cwr.TTL
+	table, ok := c.TTLTables[ttl]
+	if !ok {
+		return errTableNotFound
+	}
+
+	pre := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	b := c.Session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	for _, w := range batch {
+		b.Query(table.QueryWrite, w.rowKey, w.cwr.Chunk.Series.T0, w.data, ttl)
+	}
+	cassPutInFlight.Inc()
+	ret := c.Session.ExecuteBatch(b)
+	cassPutInFlight.Dec()
 	cancel()
 	cassPutExecDuration.Value(time.Now().Sub(pre))
+	if ret != nil {
+		tableWriteErrors(table.Name).Inc()
+	}
 	return ret
 }
 
@@ -380,6 +763,7 @@ type readResult struct {
 
 func (c *CassandraStore) processReadQueue() {
 	for crr := range c.readQueue {
+		cassReadQueueItems.Value(len(c.readQueue))
 		// check to see if the request has been canceled, if so abort now.
 		select {
 		case <-crr.ctx.Done():
@@ -396,11 +780,17 @@ func (c *CassandraStore) processReadQueue() {
 			continue
 		}
 
+		consistency := c.readConsistency
+		if crr.fallback {
+			consistency = c.readFallbackConsistency
+		}
 		pre := time.Now()
+		cassGetInFlight.Inc()
 		iter := readResult{
-			i:   c.Session.Query(crr.q, crr.p...).WithContext(crr.ctx).Iter(),
+			i:   c.Session.Query(crr.q, crr.p...).Consistency(consistency).WithContext(crr.ctx).Iter(),
 			err: nil,
 		}
+		cassGetInFlight.Dec()
 		cassGetExecDuration.Value(time.Since(pre))
 		crr.out <- iter
 	}
@@ -416,9 +806,147 @@ func (c *CassandraStore) Search(ctx context.Context, key schema.AMKey, ttl, star
 	return c.SearchTable(ctx, key, table, start, end)
 }
 
+// Delete deletes all chunks of the given archive from the table for the given ttl,
+// including the copies in the dual write format.
+// chunks can only be in the rows of the months within the ttl, plus the one before,
+// because a chunk is saved after its t0.
+func (c *CassandraStore) Delete(ctx context.Context, key schema.AMKey, ttl uint32) error {
+	table, ok := c.TTLTables[ttl]
+	if !ok {
+		return errTableNotFound
+	}
+	now := uint32(time.Now().Unix())
+	var startMonthNum uint32
+	if now > ttl+Month_sec {
+		startMonthNum = (now - ttl - Month_sec) / Month_sec
+	}
+	endMonthNum := now / Month_sec
+	keyStr := key.String()
+	var rowKeys []string
+	for num := startMonthNum; num <= endMonthNum; num++ {
+		rowKey := fmt.Sprintf("%s_%d", keyStr, num)
+		rowKeys = append(rowKeys, rowKey)
+		if c.dualWrite {
+			rowKeys = append(rowKeys, c.dualRowKey(rowKey))
+		}
+	}
+
+	// for unit tests
+	if c.Session == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.Session.Query(table.QueryDelete, rowKeys).WithContext(ctx).Exec()
+}
+
+// DeleteRange deletes the chunks of the given archive from the table for the given ttl whose t0 is in the range
+// from (inclusive) - to (exclusive), including the copies in the dual write format.
+// chunks are in the row of the month of their t0, so only the rows of the months of the range are affected.
+func (c *CassandraStore) DeleteRange(ctx context.Context, key schema.AMKey, ttl, from, to uint32) error {
+	table, ok := c.TTLTables[ttl]
+	if !ok {
+		return errTableNotFound
+	}
+	rowKeys := c.rangeRowKeys(key, from, to)
+	// for unit tests
+	if c.Session == nil || len(rowKeys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.Session.Query(table.QueryDeleteRange, rowKeys, from, to).WithContext(ctx).Exec()
+}
+
+// rangeRowKeys returns the keys of the rows that hold the chunks of the archive with a t0 in the range
+// from (inclusive) - to (exclusive), including the ones in the dual write format
+func (c *CassandraStore) rangeRowKeys(key schema.AMKey, from, to uint32) []string {
+	if from >= to {
+		return nil
+	}
+	keyStr := key.String()
+	var rowKeys []string
+	for num := from / Month_sec; num <= (to-1)/Month_sec; num++ {
+		rowKey := fmt.Sprintf("%s_%d", keyStr, num)
+		rowKeys = append(rowKeys, rowKey)
+		if c.dualWrite {
+			rowKeys = append(rowKeys, c.dualRowKey(rowKey))
+		}
+	}
+	return rowKeys
+}
+
+// CompactChunks saves the compacted chunk, and then deletes the chunks it replaces, including the copies in the dual write format.
+// the compacted chunk only lives as long as the newest of its points would have: chunks are saved with the ttl of their
+// table, but the compacted chunk is saved long after its t0.
+// all chunks are in the same row, because chunkspans divide Month_sec.
+func (c *CassandraStore) CompactChunks(ctx context.Context, cwr *mdata.ChunkWriteRequest, t0s []uint32) error {
+	table, ok := c.TTLTables[cwr.TTL]
+	if !ok {
+		return errTableNotFound
+	}
+	t0 := cwr.Chunk.Series.T0
+	now := uint32(time.Now().Unix())
+	if t0+cwr.Span+cwr.TTL <= now {
+		// the chunks are about to expire anyway
+		return nil
+	}
+	ttl := t0 + cwr.Span + cwr.TTL - now
+
+	rowKeys := []string{fmt.Sprintf("%s_%d", cwr.Key.String(), t0/Month_sec)}
+	data := [][]byte{cwr.Chunk.Encode(cwr.Span)}
+	if c.dualWriting(time.Now()) {
+		dual, err := cwr.Chunk.EncodeAs(cwr.Span, c.dualWriteFormat)
+		if err != nil {
+			return err
+		}
+		rowKeys = append(rowKeys, c.dualRowKey(rowKeys[0]))
+		data = append(data, dual)
+	}
+
+	// for unit tests
+	if c.Session == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	for i, rowKey := range rowKeys {
+		if err := c.Session.Query(table.QueryWrite, rowKey, t0, data[i], ttl).WithContext(ctx).Exec(); err != nil {
+			tableWriteErrors(table.Name).Inc()
+			return err
+		}
+	}
+	if c.dualWrite && len(rowKeys) == 1 {
+		rowKeys = append(rowKeys, c.dualRowKey(rowKeys[0]))
+	}
+	b := c.Session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	for _, rowKey := range rowKeys {
+		for _, old := range t0s {
+			// the chunk with the same t0 was overwritten already
+			if old != t0 {
+				b.Query(table.QueryDeleteChunk, rowKey, old)
+			}
+		}
+	}
+	if len(b.Entries) == 0 {
+		return nil
+	}
+	err := c.Session.ExecuteBatch(b)
+	if err != nil {
+		tableWriteErrors(table.Name).Inc()
+	}
+	return err
+}
+
 // Basic search of cassandra in given table
 // start inclusive, end exclusive
 func (c *CassandraStore) SearchTable(ctx context.Context, key schema.AMKey, table Table, start, end uint32) ([]chunk.IterGen, error) {
+	return c.searchTable(ctx, key, table, start, end, false)
+}
+
+// searchTable searches the table, with the fallback read consistency if fallback is set.
+// reads that fail because not enough replicas are up for the read consistency are retried with the fallback consistency, if enabled
+func (c *CassandraStore) searchTable(ctx context.Context, key schema.AMKey, table Table, start, end uint32, fallback bool) ([]chunk.IterGen, error) {
 	_, span := tracing.NewSpan(ctx, c.tracer, "CassandraStore.SearchTable")
 	defer span.Finish()
 	tags.SpanKindRPCClient.Set(span)
@@ -486,6 +1014,7 @@ func (c *CassandraStore) SearchTable(ctx context.Context, key schema.AMKey, tabl
 		timestamp: pre,
 		out:       results,
 		ctx:       ctx,
+		fallback:  fallback,
 	}
 
 	select {
@@ -551,11 +1080,25 @@ func (c *CassandraStore) SearchTable(ctx context.Context, key schema.AMKey, tabl
 		tracing.Failure(span)
 		tracing.Error(span, err)
 		errmetrics.Inc(err)
+		tableReadErrors(table.Name).Inc()
+		if c.readFallback && !fallback && cassandra.Unavailable(err) {
+			cassGetFallback.Inc()
+			return c.searchTable(ctx, key, table, start, end, true)
+		}
 		return nil, err
 	}
 
 	sort.Sort(chunk.IterGensAsc(itgens))
 
+	if c.dualWrite && c.dualWriteVerify && len(itgens) > 0 {
+		dual, err := c.searchDualFormat(ctx, table, rowKeys, end, intervalHint)
+		if err != nil {
+			log.Warnf("CS: failed to read chunks in dual write format for %s: %s", key, err)
+		} else {
+			verifyDualFormat(key, itgens, dual)
+		}
+	}
+
 	cassToIterDuration.Value(time.Now().Sub(pre))
 	cassRowsPerResponse.Value(len(rowKeys))
 	cassChunksPerResponse.Value(len(itgens))
@@ -564,6 +1107,66 @@ func (c *CassandraStore) SearchTable(ctx context.Context, key schema.AMKey, tabl
 	return itgens, nil
 }
 
+// searchDualFormat reads the chunks in the dual write format for the given row keys, keyed by t0
+func (c *CassandraStore) searchDualFormat(ctx context.Context, table Table, rowKeys []string, end, intervalHint uint32) (map[uint32]chunk.IterGen, error) {
+	dualKeys := make([]string, len(rowKeys))
+	for i, rowKey := range rowKeys {
+		dualKeys[i] = c.dualRowKey(rowKey)
+	}
+	results := make(chan readResult, 1)
+	crr := ChunkReadRequest{
+		q:         table.QueryRead,
+		p:         []interface{}{dualKeys, end},
+		timestamp: time.Now(),
+		out:       results,
+		ctx:       ctx,
+	}
+	select {
+	case c.readQueue <- &crr:
+	default:
+		cassReadQueueFull.Inc()
+		return nil, errReadQueueFull
+	}
+	// the read queue always sends exactly one result
+	res := <-results
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	itgens := make(map[uint32]chunk.IterGen)
+	var b []byte
+	var t0 int
+	for res.i.Scan(&t0, &b) {
+		itgen, err := chunk.NewIterGen(uint32(t0), intervalHint, b)
+		if err != nil {
+			res.i.Close()
+			return nil, err
+		}
+		itgens[uint32(t0)] = itgen
+	}
+	return itgens, res.i.Close()
+}
+
+// verifyDualFormat compares the chunks in the current format against their copy in the dual write format.
+// the dual write format is the one we're migrating away from, and known to be good, so if they
+// don't match, the copy replaces the chunk.
+func verifyDualFormat(key schema.AMKey, itgens []chunk.IterGen, dual map[uint32]chunk.IterGen) {
+	for i, itgen := range itgens {
+		dualItgen, ok := dual[itgen.T0]
+		if !ok {
+			dualVerifyMissing.Inc()
+			continue
+		}
+		if err := chunk.Compare(itgen, dualItgen); err != nil {
+			dualVerifyMismatch.Inc()
+			log.Warnf("CS: chunk %s:%d does not match its copy in format %s, serving the copy. %s", key, itgen.T0, dualItgen.Format(), err)
+			itgens[i] = dualItgen
+			continue
+		}
+		dualVerifyOk.Inc()
+	}
+}
+
 func (c *CassandraStore) Stop() {
 	c.Session.Close()
 }
@@ -6,11 +6,16 @@ import (
 	"math"
 	"os"
 	"os/exec"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -116,3 +121,181 @@ func TestBackwardsCompatibleTimeoutFatalIfInvalid(t *testing.T) {
 		t.Fatalf("Process ran with err %v, want exit status 1", err)
 	}
 }
+
+func TestVerifyDualFormat(t *testing.T) {
+	span := uint32(600)
+	encode := func(format chunk.Format, t0 uint32, vals ...float64) chunk.IterGen {
+		c := chunk.New(t0)
+		for i, v := range vals {
+			c.Push(t0+uint32(i+1)*60, v)
+		}
+		c.Finish()
+		data, err := c.EncodeAs(span, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		itgen, err := chunk.NewIterGen(t0, 60, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return itgen
+	}
+	cur, old := chunk.FormatGoTszLongWithSpanCRC, chunk.FormatStandardGoTszWithSpan
+
+	itgens := []chunk.IterGen{
+		encode(cur, 600, 1, 2, 3),
+		encode(cur, 1200, 4, 5, 6),
+		encode(cur, 1800, 7, 8, 9),
+	}
+	dual := map[uint32]chunk.IterGen{
+		600:  encode(old, 600, 1, 2, 3),
+		1200: encode(old, 1200, 4, 5, 7),
+	}
+	ok, mismatch, missing := dualVerifyOk.Peek(), dualVerifyMismatch.Peek(), dualVerifyMissing.Peek()
+	verifyDualFormat(schema.AMKey{}, itgens, dual)
+
+	if dualVerifyOk.Peek()-ok != 1 || dualVerifyMismatch.Peek()-mismatch != 1 || dualVerifyMissing.Peek()-missing != 1 {
+		t.Fatalf("expected 1 ok, 1 mismatch and 1 missing chunk")
+	}
+	expFormats := []chunk.Format{cur, old, cur}
+	for i, exp := range expFormats {
+		if itgens[i].Format() != exp {
+			t.Fatalf("chunk %d: expected format %s, got %s", i, exp, itgens[i].Format())
+		}
+	}
+}
+
+func TestBatchWrites(t *testing.T) {
+	c := &CassandraStore{writeBatchSize: 3, writeBatchMaxBytes: 250}
+	keyA := schema.AMKey{MKey: test.GetMKey(1)}
+	keyB := schema.AMKey{MKey: test.GetMKey(2)}
+	write := func(key schema.AMKey, ttl, t0 uint32) chunkWrite {
+		ch := chunk.New(t0)
+		ch.Push(t0, 1)
+		ch.Finish()
+		cwr := mdata.NewChunkWriteRequest(nil, key, ch, ttl, 600, time.Now())
+		w := newChunkWrite(&cwr)
+		w.data = make([]byte, 100)
+		return w
+	}
+	writes := []chunkWrite{
+		write(keyA, 3600, 600),
+		write(keyB, 3600, 600),
+		write(keyA, 3600, 1200),
+		write(keyA, 7200, 1800), // other table
+		write(keyA, 3600, 1800),
+		write(keyA, 3600, 2400),
+		write(keyA, 3600, Month_sec), // other row key
+	}
+	var got [][]uint32
+	for _, batch := range c.batchWrites(writes) {
+		var t0s []uint32
+		for _, w := range batch {
+			t0s = append(t0s, w.cwr.Chunk.Series.T0)
+		}
+		got = append(got, t0s)
+	}
+	// 3 chunks of 100 bytes are over the limit of 250 bytes
+	exp := [][]uint32{{600, 1200}, {1800, 2400}, {600}, {1800}, {Month_sec}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected batches %v, got %v", exp, got)
+	}
+}
+
+func TestCollectWrites(t *testing.T) {
+	queue := newWriteQueue(10)
+	cwr := func() *mdata.ChunkWriteRequest {
+		return &mdata.ChunkWriteRequest{Chunk: chunk.New(600)}
+	}
+	for i := 0; i < 4; i++ {
+		queue.add(cwr())
+	}
+	c := &CassandraStore{writeBatchSize: 3}
+	if got := c.collectWrites(cwr(), queue); len(got) != 3 || queue.len() != 2 {
+		t.Fatalf("expected a batch of 3 and 2 writes left in the queue, got %d and %d", len(got), queue.len())
+	}
+	// without a wait, we only take what's queued
+	if got := c.collectWrites(cwr(), queue); len(got) != 3 || queue.len() != 0 {
+		t.Fatalf("expected a batch of 3 and an empty queue, got %d and %d", len(got), queue.len())
+	}
+	c.writeBatchWait = 100 * time.Millisecond
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.add(cwr())
+	}()
+	if got := c.collectWrites(cwr(), queue); len(got) != 2 {
+		t.Fatalf("expected a batch of 2, got %d", len(got))
+	}
+	c.writeBatchSize = 1
+	queue.add(cwr())
+	if got := c.collectWrites(cwr(), queue); len(got) != 1 || queue.len() != 1 {
+		t.Fatalf("expected no batching, got a batch of %d", len(got))
+	}
+}
+
+type requestError struct {
+	code int
+}
+
+func (e requestError) Code() int       { return e.code }
+func (e requestError) Message() string { return "test" }
+func (e requestError) Error() string   { return fmt.Sprintf("request error %#x", e.code) }
+
+func TestRetryWrite(t *testing.T) {
+	c := &CassandraStore{retryMinBackoff: time.Millisecond, retryMaxBackoff: 2 * time.Millisecond}
+	cases := []struct {
+		name     string
+		errs     []error
+		saved    bool
+		attempts int
+	}{
+		{"timeouts", []error{requestError{0x1100}, requestError{0x1100}}, true, 3},
+		{"bad credentials", []error{requestError{0x0100}, requestError{0x0100}}, true, 3},
+		{"unauthorized", []error{requestError{0x2100}}, true, 2},
+		{"missing table", []error{errTableNotFound, errTableNotFound}, true, 3},
+		{"invalid", []error{requestError{0x2200}}, false, 1},
+		{"syntax", []error{requestError{0x0100}, requestError{0x2000}}, false, 2},
+	}
+	for _, tc := range cases {
+		var attempts int
+		saved := c.retryWrite(tc.name, 1, func() error {
+			attempts++
+			if attempts <= len(tc.errs) {
+				return tc.errs[attempts-1]
+			}
+			return nil
+		})
+		if saved != tc.saved || attempts != tc.attempts {
+			t.Errorf("%s: expected saved %t after %d attempts, got %t after %d", tc.name, tc.saved, tc.attempts, saved, attempts)
+		}
+	}
+}
+
+func TestRangeRowKeys(t *testing.T) {
+	key := schema.AMKey{MKey: test.GetMKey(1)}
+	row := func(num uint32) string {
+		return fmt.Sprintf("%s_%d", key, num)
+	}
+	c := &CassandraStore{}
+	cases := []struct {
+		from, to uint32
+		exp      []string
+	}{
+		{600, 1200, []string{row(0)}},
+		{600, 600, nil},
+		{Month_sec - 600, Month_sec, []string{row(0)}},
+		{Month_sec - 600, Month_sec + 1, []string{row(0), row(1)}},
+		{Month_sec, 3*Month_sec + 10, []string{row(1), row(2), row(3)}},
+	}
+	for _, tc := range cases {
+		if got := c.rangeRowKeys(key, tc.from, tc.to); !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("range %d-%d: expected row keys %v, got %v", tc.from, tc.to, tc.exp, got)
+		}
+	}
+
+	c = &CassandraStore{dualWrite: true, dualWriteFormat: chunk.FormatStandardGoTszWithSpan}
+	exp := []string{row(0), c.dualRowKey(row(0))}
+	if got := c.rangeRowKeys(key, 600, 1200); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected row keys %v with the dual write format, got %v", exp, got)
+	}
+}
@@ -2,8 +2,11 @@ package cassandra
 
 import (
 	"flag"
+	"time"
 
 	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/cassandra"
+	"github.com/grafana/metrictank/mdata"
 )
 
 type StoreConfig struct {
@@ -11,10 +14,14 @@ type StoreConfig struct {
 	Addrs                    string
 	Keyspace                 string
 	Consistency              string
+	ReadConsistency          string
+	ReadFallbackConsistency  string
 	HostSelectionPolicy      string
+	LocalDC                  string
 	Timeout                  string
 	ReadConcurrency          int
 	WriteConcurrency         int
+	ConnectionsPerHost       int
 	ReadQueueSize            int
 	WriteQueueSize           int
 	Retries                  int
@@ -25,11 +32,23 @@ type StoreConfig struct {
 	DisableInitialHostLookup bool
 	SSL                      bool
 	CaPath                   string
+	CertPath                 string
+	KeyPath                  string
 	HostVerification         bool
 	Auth                     bool
 	Username                 string
 	Password                 string
 	SchemaFile               string
+	DualWriteFormat          string
+	DualWriteUntil           int64
+	DualWriteVerify          bool
+	WriteBatchSize           int
+	WriteBatchMaxBytes       int
+	WriteBatchWait           time.Duration
+	WriteRetryMinBackoff     time.Duration
+	WriteRetryMaxBackoff     time.Duration
+	SpillDir                 string
+	SpillMaxSize             int64
 }
 
 // return StoreConfig with default values set.
@@ -39,10 +58,14 @@ func NewStoreConfig() *StoreConfig {
 		Addrs:                    "localhost",
 		Keyspace:                 "metrictank",
 		Consistency:              "one",
+		ReadConsistency:          "",
+		ReadFallbackConsistency:  "",
 		HostSelectionPolicy:      "tokenaware,hostpool-epsilon-greedy",
+		LocalDC:                  "",
 		Timeout:                  "1s",
 		ReadConcurrency:          20,
 		WriteConcurrency:         10,
+		ConnectionsPerHost:       0,
 		ReadQueueSize:            200000,
 		WriteQueueSize:           100000,
 		Retries:                  0,
@@ -53,11 +76,23 @@ func NewStoreConfig() *StoreConfig {
 		DisableInitialHostLookup: false,
 		SSL:                      false,
 		CaPath:                   "/etc/metrictank/ca.pem",
+		CertPath:                 "",
+		KeyPath:                  "",
 		HostVerification:         true,
 		Auth:                     false,
 		Username:                 "cassandra",
 		Password:                 "cassandra",
 		SchemaFile:               "/etc/metrictank/schema-store-cassandra.toml",
+		DualWriteFormat:          "",
+		DualWriteUntil:           0,
+		DualWriteVerify:          true,
+		WriteBatchSize:           1,
+		WriteBatchMaxBytes:       40960,
+		WriteBatchWait:           0,
+		WriteRetryMinBackoff:     100 * time.Millisecond,
+		WriteRetryMaxBackoff:     5 * time.Second,
+		SpillDir:                 "",
+		SpillMaxSize:             1073741824,
 	}
 }
 
@@ -69,10 +104,14 @@ func ConfigSetup() *flag.FlagSet {
 	cas.StringVar(&CliConfig.Addrs, "addrs", CliConfig.Addrs, "cassandra host (may be given multiple times as comma-separated list)")
 	cas.StringVar(&CliConfig.Keyspace, "keyspace", CliConfig.Keyspace, "cassandra keyspace to use for storing the metric data table")
 	cas.StringVar(&CliConfig.Consistency, "consistency", CliConfig.Consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
-	cas.StringVar(&CliConfig.HostSelectionPolicy, "host-selection-policy", CliConfig.HostSelectionPolicy, "")
+	cas.StringVar(&CliConfig.ReadConsistency, "read-consistency", CliConfig.ReadConsistency, "read consistency (one|two|three|quorum|all|local_quorum|each_quorum|local_one). empty to use the write consistency")
+	cas.StringVar(&CliConfig.ReadFallbackConsistency, "read-fallback-consistency", CliConfig.ReadFallbackConsistency, "consistency to retry reads with when not enough replicas are up for the read consistency, e.g. quorum to read from other datacenters when the local replicas are down. empty to disable")
+	cas.StringVar(&CliConfig.HostSelectionPolicy, "host-selection-policy", CliConfig.HostSelectionPolicy, "how the driver picks the host for each query ("+cassandra.HostSelectionPolicies+")")
+	cas.StringVar(&CliConfig.LocalDC, "local-dc", CliConfig.LocalDC, "datacenter of this node, for the dcaware host selection policies")
 	cas.StringVar(&CliConfig.Timeout, "timeout", CliConfig.Timeout, "cassandra timeout")
 	cas.IntVar(&CliConfig.ReadConcurrency, "read-concurrency", CliConfig.ReadConcurrency, "max number of concurrent reads to cassandra.")
 	cas.IntVar(&CliConfig.WriteConcurrency, "write-concurrency", CliConfig.WriteConcurrency, "max number of concurrent writes to cassandra.")
+	cas.IntVar(&CliConfig.ConnectionsPerHost, "connections-per-host", CliConfig.ConnectionsPerHost, "number of connections to open to each cassandra host. 0 to use write-concurrency")
 	cas.IntVar(&CliConfig.ReadQueueSize, "read-queue-size", CliConfig.ReadQueueSize, "max number of outstanding reads before reads will be dropped. This is important if you run queries that result in many reads in parallel.")
 	cas.IntVar(&CliConfig.WriteQueueSize, "write-queue-size", CliConfig.WriteQueueSize, "write queue size per cassandra worker. should be large engough to hold all at least the total number of series expected, divided by how many workers you have")
 	cas.IntVar(&CliConfig.Retries, "retries", CliConfig.Retries, "how many times to retry a query before failing it")
@@ -83,11 +122,48 @@ func ConfigSetup() *flag.FlagSet {
 	cas.BoolVar(&CliConfig.DisableInitialHostLookup, "disable-initial-host-lookup", CliConfig.DisableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
 	cas.BoolVar(&CliConfig.SSL, "ssl", CliConfig.SSL, "enable SSL connection to cassandra")
 	cas.StringVar(&CliConfig.CaPath, "ca-path", CliConfig.CaPath, "cassandra CA certificate path when using SSL")
+	cas.StringVar(&CliConfig.CertPath, "cert-path", CliConfig.CertPath, "client certificate path when using SSL, for clusters that require client authentication. empty to not use a client certificate")
+	cas.StringVar(&CliConfig.KeyPath, "key-path", CliConfig.KeyPath, "client certificate key path when using SSL")
 	cas.BoolVar(&CliConfig.HostVerification, "host-verification", CliConfig.HostVerification, "host (hostname and server cert) verification when using SSL")
 	cas.BoolVar(&CliConfig.Auth, "auth", CliConfig.Auth, "enable cassandra authentication")
 	cas.StringVar(&CliConfig.Username, "username", CliConfig.Username, "username for authentication")
 	cas.StringVar(&CliConfig.Password, "password", CliConfig.Password, "password for authentication")
 	cas.StringVar(&CliConfig.SchemaFile, "schema-file", CliConfig.SchemaFile, "File containing the needed schemas in case database needs initializing")
+	cas.StringVar(&CliConfig.DualWriteFormat, "dual-write-format", CliConfig.DualWriteFormat, "also write chunks in this (older) chunk format, to safely migrate to a new format. empty to disable. (FormatStandardGoTsz|FormatStandardGoTszWithSpan|FormatGoTszLongWithSpan)")
+	cas.Int64Var(&CliConfig.DualWriteUntil, "dual-write-until", CliConfig.DualWriteUntil, "unix timestamp after which to stop writing chunks in dual-write-format. 0 to keep writing them")
+	cas.BoolVar(&CliConfig.DualWriteVerify, "dual-write-verify", CliConfig.DualWriteVerify, "when dual-write-format is set, verify chunks read against their copy in dual-write-format, and serve the copy if they don't match")
+	cas.IntVar(&CliConfig.WriteBatchSize, "write-batch-size", CliConfig.WriteBatchSize, "max number of chunks for the same partition that a writer saves in one batch. 1 to disable batching")
+	cas.IntVar(&CliConfig.WriteBatchMaxBytes, "write-batch-max-bytes", CliConfig.WriteBatchMaxBytes, "max size in bytes of the chunks in a batch. keep it below cassandra's batch_size_fail_threshold_in_kb")
+	cas.DurationVar(&CliConfig.WriteBatchWait, "write-batch-wait", CliConfig.WriteBatchWait, "max time a writer waits for more chunks to fill a batch. 0 to only batch the chunks that are already queued")
+	cas.DurationVar(&CliConfig.WriteRetryMinBackoff, "write-retry-min-backoff", CliConfig.WriteRetryMinBackoff, "how long to wait before retrying a failed chunk write. the wait doubles with every failed attempt")
+	cas.DurationVar(&CliConfig.WriteRetryMaxBackoff, "write-retry-max-backoff", CliConfig.WriteRetryMaxBackoff, "max time to wait before retrying a failed chunk write. chunk writes are retried until they succeed, unless cassandra rejects them as invalid")
+	cas.StringVar(&CliConfig.SpillDir, "spill-dir", CliConfig.SpillDir, "directory to spill chunks to when their write queue is full, rather than blocking the ingestion until there is room. they are saved from there when cassandra catches up. empty to disable")
+	cas.Int64Var(&CliConfig.SpillMaxSize, "spill-max-size", CliConfig.SpillMaxSize, "max size in bytes of the chunks in spill-dir. when it's full, ingestion blocks on the write queues again")
 	globalconf.Register("cassandra", cas, flag.ExitOnError)
 	return cas
 }
+
+func init() {
+	mdata.RegisterStore("cassandra", backend{})
+}
+
+// backend makes the cassandra store selectable in the config. see mdata.RegisterStore
+type backend struct{}
+
+func (backend) ConfigSetup() {
+	ConfigSetup()
+}
+
+func (backend) ConfigProcess(schemaMaxChunkSpan uint32) {}
+
+func (backend) Enabled() bool {
+	return CliConfig.Enabled
+}
+
+func (backend) New(ttls []uint32, schemaMaxChunkSpan uint32) (mdata.Store, error) {
+	store, err := NewCassandraStore(CliConfig, ttls)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,255 @@
+package cassandra
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errSpillCorrupt = errors.New("corrupt spilled chunk")
+
+	// metric store.cassandra.spill.items is the number of chunks in the spill buffer, waiting to be saved
+	spillItems = stats.NewGauge32("store.cassandra.spill.items")
+	// metric store.cassandra.spill.size is the size in bytes of the chunks in the spill buffer
+	spillSize = stats.NewGauge64("store.cassandra.spill.size")
+	// metric store.cassandra.spill.add is counter of chunks spilled to disk because their write queue was full
+	spillAdd = stats.NewCounter32("store.cassandra.spill.add")
+	// metric store.cassandra.spill.full is counter of chunks that could not be spilled because the spill buffer was full (or could not be written), and that had to wait for the write queue
+	spillFull = stats.NewCounter32("store.cassandra.spill.full")
+)
+
+// spilledChunk is an encoded chunk in the spill buffer, with everything needed to save it
+type spilledChunk struct {
+	key  string
+	t0   uint32
+	ttl  uint32
+	data []byte
+	dual []byte // the chunk in the dual write format. nil if we weren't dual writing
+}
+
+// marshal encodes the chunk as t0, ttl, and the length prefixed key, data and dual data
+func (sc spilledChunk) marshal() []byte {
+	b := make([]byte, 0, 8+3*4+len(sc.key)+len(sc.data)+len(sc.dual))
+	b = appendUint32(b, sc.t0)
+	b = appendUint32(b, sc.ttl)
+	for _, field := range [][]byte{[]byte(sc.key), sc.data, sc.dual} {
+		b = appendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func unmarshalSpilledChunk(b []byte) (spilledChunk, error) {
+	var sc spilledChunk
+	if len(b) < 8 {
+		return sc, errSpillCorrupt
+	}
+	sc.t0 = binary.BigEndian.Uint32(b)
+	sc.ttl = binary.BigEndian.Uint32(b[4:])
+	b = b[8:]
+	var fields [3][]byte
+	for i := range fields {
+		if len(b) < 4 {
+			return sc, errSpillCorrupt
+		}
+		l := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < l {
+			return sc, errSpillCorrupt
+		}
+		fields[i] = b[:l]
+		b = b[l:]
+	}
+	if len(b) != 0 || len(fields[1]) == 0 {
+		return sc, errSpillCorrupt
+	}
+	sc.key = string(fields[0])
+	sc.data = fields[1]
+	if len(fields[2]) > 0 {
+		sc.dual = fields[2]
+	}
+	return sc, nil
+}
+
+// spillBuffer holds the chunks that didn't fit in the write queues, as files in a directory,
+// so that Add doesn't block - stalling the consumption of the input - while cassandra is down
+// or can't keep up. chunks are taken out of it oldest first.
+// the files survive a restart: the chunks spilled by a previous run are saved as well.
+type spillBuffer struct {
+	dir     string
+	maxSize int64
+	notify  chan struct{}
+
+	sync.Mutex
+	names   []string // oldest first
+	sizes   map[string]int64
+	size    int64
+	seq     uint64
+	metrics map[string]*mdata.AggMetric // the metrics of the chunks we spilled ourselves
+}
+
+func newSpillBuffer(dir string, maxSize int64) (*spillBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &spillBuffer{
+		dir:     dir,
+		maxSize: maxSize,
+		notify:  make(chan struct{}, 1),
+		sizes:   make(map[string]int64),
+		metrics: make(map[string]*mdata.AggMetric),
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// the names are zero padded sequence numbers, so ReadDir returns them in order
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || info.IsDir() {
+			log.Warnf("CS: ignoring unexpected file %s in spill dir %s", name, dir)
+			continue
+		}
+		if seq > s.seq {
+			s.seq = seq
+		}
+		s.names = append(s.names, name)
+		s.sizes[name] = info.Size()
+		s.size += info.Size()
+	}
+	sort.Strings(s.names)
+	if len(s.names) > 0 {
+		log.Infof("CS: found %d chunks (%d bytes) spilled by a previous run in %s, they will be saved", len(s.names), s.size, dir)
+	}
+	s.updateStats()
+	return s, nil
+}
+
+// add writes the chunk to the buffer.
+// it returns false if the buffer is full, or the chunk could not be written
+func (s *spillBuffer) add(sc spilledChunk, metric *mdata.AggMetric) bool {
+	buf := sc.marshal()
+	s.Lock()
+	if s.size+int64(len(buf)) > s.maxSize {
+		s.Unlock()
+		return false
+	}
+	s.seq++
+	name := fmt.Sprintf("%020d", s.seq)
+	// reserve the space while we write, so concurrent adds can't go over maxSize
+	s.size += int64(len(buf))
+	s.Unlock()
+
+	path := filepath.Join(s.dir, name)
+	err := ioutil.WriteFile(path+".tmp", buf, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+
+	s.Lock()
+	if err != nil {
+		s.size -= int64(len(buf))
+		s.Unlock()
+		os.Remove(path + ".tmp")
+		log.Errorf("CS: failed to spill chunk %s:%d to %s. %s", sc.key, sc.t0, path, err)
+		return false
+	}
+	// sequence numbers are handed out under the lock, but the writes complete in any order
+	i := sort.SearchStrings(s.names, name)
+	s.names = append(s.names, "")
+	copy(s.names[i+1:], s.names[i:])
+	s.names[i] = name
+	s.sizes[name] = int64(len(buf))
+	if metric != nil {
+		s.metrics[name] = metric
+	}
+	s.updateStats()
+	s.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next returns the oldest chunk in the buffer, and its metric if we know it.
+// ok is false if the buffer is empty.
+// chunks that can't be read are dropped.
+func (s *spillBuffer) next() (name string, sc spilledChunk, metric *mdata.AggMetric, ok bool) {
+	for {
+		s.Lock()
+		if len(s.names) == 0 {
+			s.Unlock()
+			return "", sc, nil, false
+		}
+		name = s.names[0]
+		metric = s.metrics[name]
+		s.Unlock()
+
+		buf, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if err == nil {
+			sc, err = unmarshalSpilledChunk(buf)
+		}
+		if err == nil {
+			return name, sc, metric, true
+		}
+		log.Errorf("CS: dropping spilled chunk %s that can't be read. %s", name, err)
+		s.remove(name)
+	}
+}
+
+// remove removes the given chunk from the buffer
+func (s *spillBuffer) remove(name string) {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("CS: failed to remove spilled chunk %s. %s", name, err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	// it's nearly always the oldest one, which we can take off without moving the others
+	if len(s.names) > 0 && s.names[0] == name {
+		s.names = s.names[1:]
+	} else if i := sort.SearchStrings(s.names, name); i < len(s.names) && s.names[i] == name {
+		s.names = append(s.names[:i], s.names[i+1:]...)
+	}
+	s.size -= s.sizes[name]
+	delete(s.sizes, name)
+	delete(s.metrics, name)
+	s.updateStats()
+}
+
+// len returns the number of chunks in the buffer
+func (s *spillBuffer) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.names)
+}
+
+// updateStats updates the spill metrics. the lock must be held
+func (s *spillBuffer) updateStats() {
+	spillItems.Set(len(s.names))
+	spillSize.SetUint64(uint64(s.size))
+}
@@ -0,0 +1,143 @@
+package cassandra
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestSpilledChunkMarshal(t *testing.T) {
+	cases := []spilledChunk{
+		{key: "1.01234567890123456789012345678901", t0: 600, ttl: 3600, data: []byte{1, 2, 3}},
+		{key: "1.01234567890123456789012345678901_sum_600", t0: 1200, ttl: 7200, data: []byte{4}, dual: []byte{5, 6}},
+	}
+	for _, c := range cases {
+		b := c.marshal()
+		got, err := unmarshalSpilledChunk(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Fatalf("expected %+v, got %+v", c, got)
+		}
+		if _, err := unmarshalSpilledChunk(b[:len(b)-1]); err != errSpillCorrupt {
+			t.Fatalf("expected a truncated chunk to be corrupt, got %v", err)
+		}
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassandra-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sc := func(t0 uint32) spilledChunk {
+		return spilledChunk{key: "1.01234567890123456789012345678901", t0: t0, ttl: 3600, data: make([]byte, 100)}
+	}
+	size := int64(len(sc(0).marshal()))
+
+	s, err := newSpillBuffer(dir, 3*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, t0 := range []uint32{600, 1200, 1800} {
+		if !s.add(sc(t0), nil) {
+			t.Fatalf("expected chunk %d to be spilled", t0)
+		}
+	}
+	if s.add(sc(2400), nil) {
+		t.Fatal("expected the spill buffer to be full")
+	}
+
+	name, got, _, ok := s.next()
+	if !ok || got.t0 != 600 {
+		t.Fatalf("expected the oldest chunk, got %+v, %t", got, ok)
+	}
+	s.remove(name)
+
+	// a restart picks up the remaining chunks, and we add after them
+	s, err = newSpillBuffer(dir, 3*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.size != 2*size {
+		t.Fatalf("expected a size of %d after reopening, got %d", 2*size, s.size)
+	}
+	if !s.add(sc(2400), nil) {
+		t.Fatal("expected chunk 2400 to be spilled")
+	}
+	// corrupt chunks are dropped
+	name, _, _, _ = s.next()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var t0s []uint32
+	for {
+		name, got, _, ok := s.next()
+		if !ok {
+			break
+		}
+		t0s = append(t0s, got.t0)
+		s.remove(name)
+	}
+	if exp := []uint32{1800, 2400}; !reflect.DeepEqual(t0s, exp) {
+		t.Fatalf("expected chunks %v, got %v", exp, t0s)
+	}
+	if s.size != 0 {
+		t.Fatalf("expected an empty spill buffer, got a size of %d", s.size)
+	}
+}
+
+func TestAddSpillsWhenQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassandra-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spill, err := newSpillBuffer(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without a session, inserts succeed without doing anything. there is no writer on the queue,
+	// so after the first chunk, the others can only go to the spill buffer.
+	c := &CassandraStore{
+		writeQueues:      []*writeQueue{newWriteQueue(1)},
+		writeQueueMeters: []*stats.Range32{stats.NewRange32("store.cassandra.write_queue.test.items")},
+		spill:            spill,
+	}
+	key := schema.AMKey{MKey: test.GetMKey(1)}
+	for t0 := uint32(600); t0 <= 1800; t0 += 600 {
+		ch := chunk.New(t0)
+		ch.Push(t0, 1)
+		ch.Finish()
+		cwr := mdata.NewChunkWriteRequest(nil, key, ch, 3600, 600, time.Now())
+		c.Add(&cwr)
+	}
+	if spill.len() != 2 {
+		t.Fatalf("expected 2 spilled chunks, got %d", spill.len())
+	}
+	if stats := c.Stats(); stats.WriteQueueItems != 3 {
+		t.Fatalf("expected 3 queued chunks, got %d", stats.WriteQueueItems)
+	}
+
+	go c.drainSpill()
+	for i := 0; spill.len() > 0; i++ {
+		if i == 100 {
+			t.Fatal("expected the spill buffer to be drained")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -3,20 +3,35 @@ package cassandra
 import (
 	"fmt"
 	"math"
+
+	"github.com/grafana/metrictank/cassandra"
 )
 
 const QueryFmtRead = "SELECT ts, data FROM %s WHERE key IN ? AND ts < ?"
 const QueryFmtWrite = "INSERT INTO %s (key, ts, data) values(?,?,?) USING TTL ?"
+const QueryFmtDelete = "DELETE FROM %s WHERE key IN ?"
+const QueryFmtDeleteChunk = "DELETE FROM %s WHERE key = ? AND ts = ?"
+const QueryFmtDeleteRange = "DELETE FROM %s WHERE key IN ? AND ts >= ? AND ts < ?"
+
+// migrations of the chunk tables, see cassandra.Migrate.
+// tables are created from schema_table in the schema file: when changing it, add a migration
+// that brings existing tables up to date.
+var migrations = []cassandra.Migration{
+	{Version: 1, Description: "initial schema"},
+}
 
 // TTLTables stores table definitions keyed by their TTL
 type TTLTables map[uint32]Table
 
 type Table struct {
-	Name       string
-	QueryRead  string
-	QueryWrite string
-	WindowSize uint32
-	TTL        uint32
+	Name             string
+	QueryRead        string
+	QueryWrite       string
+	QueryDelete      string
+	QueryDeleteChunk string
+	QueryDeleteRange string
+	WindowSize       uint32
+	TTL              uint32
 }
 
 // GetTTLTables returns table definitions for the given specifications (ttls is in seconds)
@@ -71,11 +86,14 @@ func GetTable(ttl uint32, windowFactor int, nameFormat string) Table {
 	tableName := fmt.Sprintf(nameFormat, preFactorWindow)
 	windowSize := preFactorWindow/uint32(windowFactor) + 1
 	return Table{
-		Name:       tableName,
-		QueryRead:  fmt.Sprintf(QueryFmtRead, tableName),
-		QueryWrite: fmt.Sprintf(QueryFmtWrite, tableName),
-		WindowSize: windowSize,
-		TTL:        ttl,
+		Name:             tableName,
+		QueryRead:        fmt.Sprintf(QueryFmtRead, tableName),
+		QueryWrite:       fmt.Sprintf(QueryFmtWrite, tableName),
+		QueryDelete:      fmt.Sprintf(QueryFmtDelete, tableName),
+		QueryDeleteChunk: fmt.Sprintf(QueryFmtDeleteChunk, tableName),
+		QueryDeleteRange: fmt.Sprintf(QueryFmtDeleteRange, tableName),
+		WindowSize:       windowSize,
+		TTL:              ttl,
 	}
 }
 
@@ -0,0 +1,113 @@
+package cassandra
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/grafana/metrictank/mdata"
+)
+
+// writeQueue is a bounded queue of chunks to save, that hands out the oldest chunk first:
+// the one with the lowest T0, and among chunks with the same T0, the one that was queued first.
+// after a backlog, e.g. when cassandra was down or after a failover, this saves the chunks that are most at risk
+// of being lost - the ones that will be dropped from the ring buffers first - before the newer ones.
+// chunks of the same series always go to the same queue, so they are still saved in order.
+//
+// like a channel, adding blocks while the queue is full. taking is done in two steps, so that it can
+// be used in a select: receive from ready(), then call take() to get the chunk.
+type writeQueue struct {
+	slots chan struct{} // has an element for each queued chunk. full when the queue is full
+	items chan struct{} // has an element for each chunk that can be taken
+
+	sync.Mutex
+	heap writeQueueHeap
+	seq  uint64 // sequence number of the next chunk added
+}
+
+func newWriteQueue(size int) *writeQueue {
+	return &writeQueue{
+		slots: make(chan struct{}, size),
+		items: make(chan struct{}, size),
+	}
+}
+
+// add adds the chunk to the queue, blocking while it's full
+func (q *writeQueue) add(cwr *mdata.ChunkWriteRequest) {
+	q.slots <- struct{}{}
+	q.push(cwr)
+}
+
+// tryAdd adds the chunk to the queue if it's not full, and returns whether it did
+func (q *writeQueue) tryAdd(cwr *mdata.ChunkWriteRequest) bool {
+	select {
+	case q.slots <- struct{}{}:
+		q.push(cwr)
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *writeQueue) push(cwr *mdata.ChunkWriteRequest) {
+	q.Lock()
+	heap.Push(&q.heap, queuedWrite{cwr: cwr, seq: q.seq})
+	q.seq++
+	q.Unlock()
+	q.items <- struct{}{}
+}
+
+// ready returns a channel that yields an element for every chunk that can be taken.
+// every element received must be followed by a call to take.
+func (q *writeQueue) ready() <-chan struct{} {
+	return q.items
+}
+
+// take returns the oldest chunk in the queue. it must only be called after receiving from ready()
+func (q *writeQueue) take() *mdata.ChunkWriteRequest {
+	q.Lock()
+	qw := heap.Pop(&q.heap).(queuedWrite)
+	q.Unlock()
+	<-q.slots
+	return qw.cwr
+}
+
+// len returns the number of chunks in the queue
+func (q *writeQueue) len() int {
+	return len(q.slots)
+}
+
+// cap returns the max number of chunks in the queue
+func (q *writeQueue) cap() int {
+	return cap(q.slots)
+}
+
+type queuedWrite struct {
+	cwr *mdata.ChunkWriteRequest
+	seq uint64
+}
+
+// writeQueueHeap implements heap.Interface, with the oldest chunk on top
+type writeQueueHeap []queuedWrite
+
+func (h writeQueueHeap) Len() int { return len(h) }
+func (h writeQueueHeap) Less(i, j int) bool {
+	ti, tj := h[i].cwr.Chunk.Series.T0, h[j].cwr.Chunk.Series.T0
+	if ti != tj {
+		return ti < tj
+	}
+	return h[i].seq < h[j].seq
+}
+func (h writeQueueHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *writeQueueHeap) Push(x interface{}) {
+	*h = append(*h, x.(queuedWrite))
+}
+
+func (h *writeQueueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = queuedWrite{}
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,44 @@
+package cassandra
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	"github.com/raintank/schema"
+)
+
+func TestWriteQueueOldestFirst(t *testing.T) {
+	q := newWriteQueue(5)
+	cwr := func(id int, t0 uint32) *mdata.ChunkWriteRequest {
+		return &mdata.ChunkWriteRequest{Key: schema.AMKey{MKey: test.GetMKey(id)}, Chunk: chunk.New(t0)}
+	}
+	adds := []*mdata.ChunkWriteRequest{cwr(1, 1200), cwr(2, 600), cwr(3, 1800), cwr(4, 600), cwr(5, 0)}
+	for _, c := range adds {
+		q.add(c)
+	}
+	if q.tryAdd(cwr(6, 0)) {
+		t.Fatal("expected the queue to be full")
+	}
+	if q.len() != 5 || q.cap() != 5 {
+		t.Fatalf("expected a full queue of 5, got %d of %d", q.len(), q.cap())
+	}
+
+	var got []*mdata.ChunkWriteRequest
+	for q.len() > 0 {
+		<-q.ready()
+		got = append(got, q.take())
+	}
+	// oldest first, and in the order they were added for the same T0
+	exp := []*mdata.ChunkWriteRequest{adds[4], adds[1], adds[3], adds[0], adds[2]}
+	if !reflect.DeepEqual(got, exp) {
+		for i := range got {
+			t.Errorf("chunk %d: expected %s:%d, got %s:%d", i, exp[i].Key, exp[i].Chunk.Series.T0, got[i].Key, got[i].Chunk.Series.T0)
+		}
+	}
+	if !q.tryAdd(cwr(6, 0)) {
+		t.Fatal("expected the queue to have room again")
+	}
+}
@@ -0,0 +1,92 @@
+package disk
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/mdata"
+)
+
+type StoreConfig struct {
+	Enabled          bool
+	Dir              string
+	WriteQueueSize   int
+	WriteConcurrency int
+	CleanupInterval  time.Duration
+}
+
+func (cfg *StoreConfig) Validate() error {
+	if cfg.Dir == "" {
+		return errors.New("dir must be set")
+	}
+	if cfg.WriteConcurrency < 1 {
+		return errors.New("write-concurrency must be at least 1")
+	}
+	if cfg.WriteQueueSize < 1 {
+		return errors.New("write-queue-size must be at least 1")
+	}
+	if cfg.CleanupInterval <= 0 {
+		return errors.New("cleanup-interval must be positive")
+	}
+	return nil
+}
+
+// return StoreConfig with default values set.
+func NewStoreConfig() *StoreConfig {
+	return &StoreConfig{
+		Enabled:          false,
+		Dir:              "/var/lib/metrictank/chunks",
+		WriteQueueSize:   100000,
+		WriteConcurrency: 4,
+		CleanupInterval:  time.Hour,
+	}
+}
+
+var CliConfig = NewStoreConfig()
+
+func ConfigSetup() {
+	diskStore := flag.NewFlagSet("disk-store", flag.ExitOnError)
+	diskStore.BoolVar(&CliConfig.Enabled, "enabled", CliConfig.Enabled, "enable the disk backend store plugin, which stores chunks as files on local disk. for single node setups without an external database")
+	diskStore.StringVar(&CliConfig.Dir, "dir", CliConfig.Dir, "directory to store the chunks in")
+	diskStore.IntVar(&CliConfig.WriteQueueSize, "write-queue-size", CliConfig.WriteQueueSize, "Max number of chunks, per write thread, allowed to be unwritten to disk")
+	diskStore.IntVar(&CliConfig.WriteConcurrency, "write-concurrency", CliConfig.WriteConcurrency, "Number of writer threads to use")
+	diskStore.DurationVar(&CliConfig.CleanupInterval, "cleanup-interval", CliConfig.CleanupInterval, "how often to remove the chunks that are past their ttl")
+
+	globalconf.Register("disk-store", diskStore, flag.ExitOnError)
+}
+
+func ConfigProcess() {
+	if err := CliConfig.Validate(); err != nil {
+		log.Fatalf("disk-store: Config validation error. %s", err)
+	}
+}
+
+func init() {
+	mdata.RegisterStore("disk", backend{})
+}
+
+// backend makes the disk store selectable in the config. see mdata.RegisterStore
+type backend struct{}
+
+func (backend) ConfigSetup() {
+	ConfigSetup()
+}
+
+func (backend) ConfigProcess(schemaMaxChunkSpan uint32) {
+	ConfigProcess()
+}
+
+func (backend) Enabled() bool {
+	return CliConfig.Enabled
+}
+
+func (backend) New(ttls []uint32, schemaMaxChunkSpan uint32) (mdata.Store, error) {
+	store, err := NewStore(CliConfig, schemaMaxChunkSpan)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,359 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/tracing"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errChunkTooSmall = errors.New("impossibly small chunk on disk")
+	errInvalidRange  = errors.New("diskStore: invalid range: start must be before end")
+
+	// metric store.disk.get.exec is the duration of reading the chunks of a search from disk
+	diskGetExecDuration = stats.NewLatencyHistogram15s32("store.disk.get.exec")
+	// metric store.disk.put.exec is the duration of writing a chunk to disk
+	diskPutExecDuration = stats.NewLatencyHistogram15s32("store.disk.put.exec")
+	// metric store.disk.put.wait is the duration of a put in the wait queue
+	diskPutWaitDuration = stats.NewLatencyHistogram12h32("store.disk.put.wait")
+
+	// metric store.disk.chunks_per_response is how many chunks are retrieved per search
+	diskChunksPerResponse = stats.NewMeter32("store.disk.chunks_per_response", false)
+	// metric store.disk.expired is how many chunks were removed from disk because they were past their ttl
+	diskExpired = stats.NewCounter32("store.disk.expired")
+
+	// metric store.disk.chunk_operations.save_ok is counter of successful saves
+	chunkSaveOk = stats.NewCounter32("store.disk.chunk_operations.save_ok")
+	// metric store.disk.chunk_operations.save_fail is counter of failed saves
+	chunkSaveFail = stats.NewCounter32("store.disk.chunk_operations.save_fail")
+	// metric store.disk.chunk_size.at_save is the sizes of chunks seen when saving them
+	chunkSizeAtSave = stats.NewMeter32("store.disk.chunk_size.at_save", true)
+	// metric store.disk.chunk_size.at_load is the sizes of chunks seen when loading them
+	chunkSizeAtLoad = stats.NewMeter32("store.disk.chunk_size.at_load", true)
+)
+
+// Store saves each chunk as a file on local disk, as <dir>/<ttl>/<archive key>/<t0>, with t0 zero-padded so
+// that the chunks of an archive list in chronological order. chunks are removed once they are past their ttl.
+type Store struct {
+	cfg              *StoreConfig
+	maxChunkSpan     uint32
+	writeQueues      []chan *mdata.ChunkWriteRequest
+	writeQueueMeters []*stats.Range32
+	shutdown         chan struct{}
+	wg               sync.WaitGroup
+	tracer           opentracing.Tracer
+}
+
+func NewStore(cfg *StoreConfig, schemaMaxChunkSpan uint32) (*Store, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("diskStore: failed to create dir %s. %s", cfg.Dir, err)
+	}
+	s := &Store{
+		cfg:              cfg,
+		maxChunkSpan:     schemaMaxChunkSpan,
+		writeQueues:      make([]chan *mdata.ChunkWriteRequest, cfg.WriteConcurrency),
+		writeQueueMeters: make([]*stats.Range32, cfg.WriteConcurrency),
+		shutdown:         make(chan struct{}),
+	}
+	s.wg.Add(cfg.WriteConcurrency + 1)
+	for i := 0; i < cfg.WriteConcurrency; i++ {
+		s.writeQueues[i] = make(chan *mdata.ChunkWriteRequest, cfg.WriteQueueSize)
+		s.writeQueueMeters[i] = stats.NewRange32(fmt.Sprintf("store.disk.write_queue.%d.items", i+1))
+		go s.processWriteQueue(s.writeQueues[i], s.writeQueueMeters[i])
+	}
+	go s.cleanupLoop()
+	return s, nil
+}
+
+// archiveDir returns the directory of the chunk files of the archive
+func (s *Store) archiveDir(key schema.AMKey, ttl uint32) string {
+	return filepath.Join(s.cfg.Dir, strconv.FormatUint(uint64(ttl), 10), key.String())
+}
+
+// chunkFile returns the name of the file of the chunk
+func chunkFile(t0 uint32) string {
+	return fmt.Sprintf("%010d", t0)
+}
+
+// chunkT0s returns the t0's of the chunk files in the directory, in chronological order
+func chunkT0s(dir string) ([]uint32, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var t0s []uint32
+	for _, f := range files {
+		t0, err := strconv.ParseUint(f.Name(), 10, 32)
+		if err != nil {
+			// not a chunk file, e.g. a chunk being written
+			continue
+		}
+		t0s = append(t0s, uint32(t0))
+	}
+	return t0s, nil
+}
+
+func (s *Store) Add(cwr *mdata.ChunkWriteRequest) {
+	sum := int(cwr.Key.MKey.Org)
+	for _, b := range cwr.Key.MKey.Key {
+		sum += int(b)
+	}
+	which := sum % len(s.writeQueues)
+	s.writeQueueMeters[which].Value(len(s.writeQueues[which]))
+	s.writeQueues[which] <- cwr
+}
+
+func (s *Store) processWriteQueue(queue chan *mdata.ChunkWriteRequest, meter *stats.Range32) {
+	defer s.wg.Done()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			meter.Value(len(queue))
+		case cwr := <-queue:
+			meter.Value(len(queue))
+			log.Debugf("diskStore: starting to save %s:%d %v", cwr.Key, cwr.Chunk.Series.T0, cwr.Chunk)
+			diskPutWaitDuration.Value(time.Since(cwr.Timestamp))
+			if !s.put(cwr) {
+				return
+			}
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// put saves the chunk, retrying until it succeeds. it returns false if the store was stopped before it did.
+func (s *Store) put(cwr *mdata.ChunkWriteRequest) bool {
+	buf := cwr.Chunk.Encode(cwr.Span)
+	chunkSizeAtSave.Value(len(buf))
+	dir := s.archiveDir(cwr.Key, cwr.TTL)
+	attempts := 0
+	for {
+		pre := time.Now()
+		err := writeFile(dir, chunkFile(cwr.Chunk.Series.T0), buf)
+		diskPutExecDuration.Value(time.Since(pre))
+		if err == nil {
+			cwr.Metric.SyncChunkSaveState(cwr.Chunk.Series.T0)
+			mdata.SendPersistMessage(cwr.Key.String(), cwr.Chunk.Series.T0)
+			log.Debugf("diskStore: save complete. %s:%d %v", cwr.Key, cwr.Chunk.Series.T0, cwr.Chunk)
+			chunkSaveOk.Inc()
+			return true
+		}
+		if (attempts % 20) == 0 {
+			log.Warnf("diskStore: failed to save chunk to disk after %d attempts. %v, %s", attempts+1, cwr.Chunk, err)
+		}
+		chunkSaveFail.Inc()
+		sleepTime := 100 * attempts
+		if sleepTime > 2000 {
+			sleepTime = 2000
+		}
+		select {
+		case <-time.After(time.Duration(sleepTime) * time.Millisecond):
+		case <-s.shutdown:
+			return false
+		}
+		attempts++
+	}
+}
+
+// writeFile writes the file via a temporary file, so that readers never see a partially written chunk
+func writeFile(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// Search returns the chunks of the archive that have data in the range start (inclusive) - end (exclusive).
+// it reads the chunks that start after start minus the max chunkspan of the storage-schemas, and before end.
+func (s *Store) Search(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
+	_, span := tracing.NewSpan(ctx, s.tracer, "DiskStore.Search")
+	defer span.Finish()
+
+	if start >= end {
+		tracing.Failure(span)
+		tracing.Error(span, errInvalidRange)
+		return nil, errInvalidRange
+	}
+
+	pre := time.Now()
+	dir := s.archiveDir(key, ttl)
+	t0s, err := chunkT0s(dir)
+	if err != nil {
+		tracing.Failure(span)
+		tracing.Error(span, err)
+		return nil, err
+	}
+	var itgens []chunk.IterGen
+	for _, t0 := range t0s {
+		if t0+s.maxChunkSpan <= start || t0 >= end {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, chunkFile(t0)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed since we listed the directory
+				continue
+			}
+			tracing.Failure(span)
+			tracing.Error(span, err)
+			return nil, err
+		}
+		chunkSizeAtLoad.Value(len(b))
+		if len(b) < 2 {
+			tracing.Failure(span)
+			tracing.Error(span, errChunkTooSmall)
+			return nil, errChunkTooSmall
+		}
+		itgen, err := chunk.NewIterGen(t0, key.Archive.Span(), b)
+		if err != nil {
+			tracing.Failure(span)
+			tracing.Error(span, err)
+			return nil, err
+		}
+		itgens = append(itgens, itgen)
+	}
+	diskGetExecDuration.Value(time.Since(pre))
+	diskChunksPerResponse.Value(len(itgens))
+	span.SetTag("chunks", len(itgens))
+	return itgens, nil
+}
+
+// CompactChunks is not supported: reads only look back the max chunkspan of the schemas for the first chunk,
+// so they would miss compacted chunks, which have a larger span
+func (s *Store) CompactChunks(ctx context.Context, cwr *mdata.ChunkWriteRequest, t0s []uint32) error {
+	return mdata.ErrCompactUnsupported
+}
+
+// Delete deletes all chunks of the given archive that were saved with the given ttl
+func (s *Store) Delete(ctx context.Context, key schema.AMKey, ttl uint32) error {
+	return os.RemoveAll(s.archiveDir(key, ttl))
+}
+
+// DeleteRange deletes the chunks of the given archive that were saved with the given ttl,
+// and whose t0 is in the range from (inclusive) - to (exclusive)
+func (s *Store) DeleteRange(ctx context.Context, key schema.AMKey, ttl, from, to uint32) error {
+	dir := s.archiveDir(key, ttl)
+	t0s, err := chunkT0s(dir)
+	if err != nil {
+		return err
+	}
+	for _, t0 := range t0s {
+		if t0 < from || t0 >= to {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, chunkFile(t0))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) cleanupLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pre := time.Now()
+			removed, err := s.cleanup(uint32(time.Now().Unix()))
+			if err != nil {
+				log.Errorf("diskStore: failed to remove expired chunks. %s", err)
+			}
+			log.Infof("diskStore: removed %d expired chunks in %s", removed, time.Since(pre))
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// cleanup removes the chunks whose data is past their ttl, assuming they span the max chunkspan,
+// as well as the directories of archives that have no chunks left. it returns the number of removed chunks.
+func (s *Store) cleanup(now uint32) (int, error) {
+	ttlDirs, err := ioutil.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, ttlDir := range ttlDirs {
+		ttl, err := strconv.ParseUint(ttlDir.Name(), 10, 32)
+		if err != nil || !ttlDir.IsDir() {
+			continue
+		}
+		archiveDirs, err := ioutil.ReadDir(filepath.Join(s.cfg.Dir, ttlDir.Name()))
+		if err != nil {
+			return removed, err
+		}
+		for _, archiveDir := range archiveDirs {
+			dir := filepath.Join(s.cfg.Dir, ttlDir.Name(), archiveDir.Name())
+			t0s, err := chunkT0s(dir)
+			if err != nil {
+				return removed, err
+			}
+			var expired int
+			for _, t0 := range t0s {
+				if uint64(t0)+uint64(s.maxChunkSpan)+ttl >= uint64(now) {
+					// the chunks are in chronological order
+					break
+				}
+				if err := os.Remove(filepath.Join(dir, chunkFile(t0))); err != nil && !os.IsNotExist(err) {
+					return removed, err
+				}
+				expired++
+			}
+			removed += expired
+			diskExpired.Add(expired)
+			if expired == len(t0s) {
+				// fails if a chunk was added in the meantime, which is fine
+				os.Remove(dir)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// Stats returns the state of the store: how many chunks are waiting to be saved, over all write queues
+func (s *Store) Stats() mdata.StoreStats {
+	stats := mdata.StoreStats{Backend: "disk"}
+	for _, q := range s.writeQueues {
+		stats.WriteQueueItems += len(q)
+		stats.WriteQueueSize += cap(q)
+	}
+	return stats
+}
+
+func (s *Store) Stop() {
+	close(s.shutdown)
+	s.wg.Wait()
+}
+
+func (s *Store) SetTracer(t opentracing.Tracer) {
+	s.tracer = t
+}
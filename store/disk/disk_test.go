@@ -0,0 +1,113 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/raintank/schema"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := NewStoreConfig()
+	cfg.Dir = dir
+	cfg.WriteConcurrency = 1
+	store, err := NewStore(cfg, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Stop()
+	store.SetTracer(opentracing.NoopTracer{})
+
+	key := schema.AMKey{MKey: test.GetMKey(1)}
+	for t0 := uint32(600); t0 <= 3000; t0 += 600 {
+		c := chunk.New(t0)
+		c.Push(t0, float64(t0))
+		c.Finish()
+		cwr := mdata.NewChunkWriteRequest(nil, key, c, 3600, 600, time.Now())
+		store.Add(&cwr)
+	}
+	last := filepath.Join(dir, "3600", key.String(), "0000003000")
+	for i := 0; ; i++ {
+		if _, err := os.Stat(last); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected chunk file %s to be written", last)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t0s := func(from, to uint32) []uint32 {
+		itgens, err := store.Search(test.NewContext(), key, 3600, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []uint32
+		for _, itgen := range itgens {
+			it, err := itgen.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !it.Next() {
+				t.Fatalf("expected a point in chunk %d", itgen.T0)
+			}
+			if ts, _ := it.Values(); ts != itgen.T0 {
+				t.Fatalf("expected the point of chunk %d, got %d", itgen.T0, ts)
+			}
+			out = append(out, itgen.T0)
+		}
+		return out
+	}
+	cases := []struct {
+		from, to uint32
+		exp      []uint32
+	}{
+		{0, 4000, []uint32{600, 1200, 1800, 2400, 3000}},
+		// the chunk that has start, and the ones before end
+		{1300, 2400, []uint32{1200, 1800}},
+		{1200, 1201, []uint32{1200}},
+		{4000, 5000, nil},
+	}
+	for _, c := range cases {
+		if got := t0s(c.from, c.to); !reflect.DeepEqual(got, c.exp) {
+			t.Fatalf("search %d-%d: expected %v, got %v", c.from, c.to, c.exp, got)
+		}
+	}
+
+	// the chunks of 600 and 1200 end by 1800, so with the ttl of 3600, they expire after 5400
+	removed, err := store.cleanup(5401)
+	if err != nil || removed != 2 {
+		t.Fatalf("expected 2 chunks to be removed, got %d, %v", removed, err)
+	}
+	if got := t0s(0, 4000); !reflect.DeepEqual(got, []uint32{1800, 2400, 3000}) {
+		t.Fatalf("expected the chunks from 1800 to remain, got %v", got)
+	}
+
+	if err := store.DeleteRange(test.NewContext(), key, 3600, 2000, 3000); err != nil {
+		t.Fatal(err)
+	}
+	if got := t0s(0, 4000); !reflect.DeepEqual(got, []uint32{1800, 3000}) {
+		t.Fatalf("expected the chunks outside of 2000-3000 to remain, got %v", got)
+	}
+
+	if err := store.Delete(test.NewContext(), key, 3600); err != nil {
+		t.Fatal(err)
+	}
+	if got := t0s(0, 4000); got != nil {
+		t.Fatalf("expected no chunks after delete, got %v", got)
+	}
+}
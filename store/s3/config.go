@@ -0,0 +1,119 @@
+package s3
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/grafana/globalconf"
+	"github.com/grafana/metrictank/mdata"
+)
+
+type StoreConfig struct {
+	Enabled          bool
+	Endpoint         string
+	Bucket           string
+	Region           string
+	Prefix           string
+	PathStyle        bool
+	AccessKey        string
+	SecretKey        string
+	WriteQueueSize   int
+	WriteConcurrency int
+	ReadConcurrency  int
+	Timeout          time.Duration
+}
+
+func (cfg *StoreConfig) Validate() error {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint. %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("endpoint must be a http or https url")
+	}
+	if cfg.Bucket == "" {
+		return errors.New("bucket must be set")
+	}
+	if cfg.WriteConcurrency < 1 || cfg.ReadConcurrency < 1 {
+		return errors.New("write-concurrency and read-concurrency must be at least 1")
+	}
+	if cfg.WriteQueueSize < 1 {
+		return errors.New("write-queue-size must be at least 1")
+	}
+	return nil
+}
+
+// return StoreConfig with default values set.
+func NewStoreConfig() *StoreConfig {
+	return &StoreConfig{
+		Enabled:          false,
+		Endpoint:         "https://s3.amazonaws.com",
+		Bucket:           "metrictank",
+		Region:           "us-east-1",
+		Prefix:           "chunks/",
+		PathStyle:        false,
+		AccessKey:        "",
+		SecretKey:        "",
+		WriteQueueSize:   100000,
+		WriteConcurrency: 10,
+		ReadConcurrency:  20,
+		Timeout:          time.Second * 10,
+	}
+}
+
+var CliConfig = NewStoreConfig()
+
+func ConfigSetup() {
+	s3Store := flag.NewFlagSet("s3-store", flag.ExitOnError)
+	s3Store.BoolVar(&CliConfig.Enabled, "enabled", CliConfig.Enabled, "enable the s3 backend store plugin. see docs/s3.md")
+	s3Store.StringVar(&CliConfig.Endpoint, "endpoint", CliConfig.Endpoint, "url of the S3 compatible object storage")
+	s3Store.StringVar(&CliConfig.Bucket, "bucket", CliConfig.Bucket, "Name of the bucket to store chunks in. it must exist already")
+	s3Store.StringVar(&CliConfig.Region, "region", CliConfig.Region, "region of the bucket, used to sign requests")
+	s3Store.StringVar(&CliConfig.Prefix, "prefix", CliConfig.Prefix, "prefix of the keys of the chunk objects")
+	s3Store.BoolVar(&CliConfig.PathStyle, "path-style", CliConfig.PathStyle, "put the bucket in the path of urls, rather than in the host name. most S3 compatible storage other than AWS needs this")
+	s3Store.StringVar(&CliConfig.AccessKey, "access-key", CliConfig.AccessKey, "access key to sign requests with. empty to send unsigned requests")
+	s3Store.StringVar(&CliConfig.SecretKey, "secret-key", CliConfig.SecretKey, "secret key to sign requests with")
+	s3Store.IntVar(&CliConfig.WriteQueueSize, "write-queue-size", CliConfig.WriteQueueSize, "Max number of chunks, per write thread, allowed to be unwritten to s3")
+	s3Store.IntVar(&CliConfig.WriteConcurrency, "write-concurrency", CliConfig.WriteConcurrency, "Number of writer threads to use")
+	s3Store.IntVar(&CliConfig.ReadConcurrency, "read-concurrency", CliConfig.ReadConcurrency, "Number of concurrent requests to read chunks")
+	s3Store.DurationVar(&CliConfig.Timeout, "timeout", CliConfig.Timeout, "timeout of requests")
+
+	globalconf.Register("s3-store", s3Store, flag.ExitOnError)
+}
+
+func ConfigProcess() {
+	if err := CliConfig.Validate(); err != nil {
+		log.Fatalf("s3-store: Config validation error. %s", err)
+	}
+}
+
+func init() {
+	mdata.RegisterStore("s3", backend{})
+}
+
+// backend makes the s3 store selectable in the config. see mdata.RegisterStore
+type backend struct{}
+
+func (backend) ConfigSetup() {
+	ConfigSetup()
+}
+
+func (backend) ConfigProcess(schemaMaxChunkSpan uint32) {
+	ConfigProcess()
+}
+
+func (backend) Enabled() bool {
+	return CliConfig.Enabled
+}
+
+func (backend) New(ttls []uint32, schemaMaxChunkSpan uint32) (mdata.Store, error) {
+	store, err := NewStore(CliConfig, schemaMaxChunkSpan)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
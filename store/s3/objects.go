@@ -0,0 +1,108 @@
+package s3
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/raintank/schema"
+)
+
+// the functions in this file give tools, such as mt-backup, access to the chunk objects as they are stored,
+// and to objects of their own, under the prefix of the store.
+
+// PutChunk saves the encoded chunk as is, with the same key as chunks saved via Add
+func (s *Store) PutChunk(ctx context.Context, key schema.AMKey, ttl, t0 uint32, data []byte) error {
+	return s.putObject(ctx, s.objectKey(key, ttl, t0), data)
+}
+
+// GetChunk returns the chunk of the archive with the given t0
+func (s *Store) GetChunk(ctx context.Context, key schema.AMKey, ttl, t0 uint32) (chunk.IterGen, error) {
+	return s.get(ctx, s.objectKey(key, ttl, t0), t0, key.Archive.Span())
+}
+
+// ChunkT0s returns the t0's of the chunks of the archive from start (inclusive) to end (exclusive), in chronological order
+func (s *Store) ChunkT0s(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]uint32, error) {
+	prefix := s.archivePrefix(key, ttl)
+	var startAfter string
+	if start > 0 {
+		startAfter = s.objectKey(key, ttl, start-1)
+	}
+	var t0s []uint32
+	err := s.list(ctx, prefix, startAfter, func(objKey string) bool {
+		t0, err := strconv.ParseUint(strings.TrimPrefix(objKey, prefix), 10, 32)
+		if err != nil {
+			// not a chunk object
+			return true
+		}
+		if uint32(t0) >= end {
+			return false
+		}
+		t0s = append(t0s, uint32(t0))
+		return true
+	})
+	return t0s, err
+}
+
+// Chunks calls fn for the archive and the t0 of every chunk saved with the given ttl, ordered by archive,
+// and chronologically within each archive. if fn returns false, the listing stops.
+func (s *Store) Chunks(ctx context.Context, ttl uint32, fn func(key schema.AMKey, t0 uint32) bool) error {
+	prefix := s.cfg.Prefix + strconv.FormatUint(uint64(ttl), 10) + "/"
+	return s.list(ctx, prefix, "", func(objKey string) bool {
+		parts := strings.Split(strings.TrimPrefix(objKey, prefix), "/")
+		if len(parts) != 2 {
+			return true
+		}
+		key, err := schema.AMKeyFromString(parts[0])
+		if err != nil {
+			return true
+		}
+		t0, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return true
+		}
+		return fn(key, uint32(t0))
+	})
+}
+
+// PutObject saves data as the object with the given name, relative to the prefix of the store
+func (s *Store) PutObject(ctx context.Context, name string, data []byte) error {
+	return s.putObject(ctx, s.cfg.Prefix+name, data)
+}
+
+// GetObject returns the data of the object with the given name, relative to the prefix of the store
+func (s *Store) GetObject(ctx context.Context, name string) ([]byte, error) {
+	req, err := s.request(ctx, "GET", s.cfg.Prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ListObjects calls fn for the names of the objects, relative to the prefix of the store, that start with
+// the given prefix, in lexicographical order. if fn returns false, the listing stops.
+func (s *Store) ListObjects(ctx context.Context, prefix string, fn func(name string) bool) error {
+	return s.list(ctx, s.cfg.Prefix+prefix, "", func(objKey string) bool {
+		return fn(strings.TrimPrefix(objKey, s.cfg.Prefix))
+	})
+}
+
+func (s *Store) putObject(ctx context.Context, objKey string, data []byte) error {
+	req, err := s.request(ctx, "PUT", objKey, nil, data)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
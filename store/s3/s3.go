@@ -0,0 +1,464 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/tracing"
+	"github.com/grafana/metrictank/util"
+	opentracing "github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errChunkTooSmall = errors.New("impossibly small chunk in s3")
+	errInvalidRange  = errors.New("s3Store: invalid range: start must be before end")
+	errCtxCanceled   = errors.New("context canceled")
+
+	// metric store.s3.get.exec is the duration of getting a chunk object from s3
+	s3GetExecDuration = stats.NewLatencyHistogram15s32("store.s3.get.exec")
+	// metric store.s3.list.exec is the duration of listing the chunk objects of an archive in s3
+	s3ListExecDuration = stats.NewLatencyHistogram15s32("store.s3.list.exec")
+	// metric store.s3.put.exec is the duration of putting a chunk object in s3
+	s3PutExecDuration = stats.NewLatencyHistogram15s32("store.s3.put.exec")
+	// metric store.s3.put.wait is the duration of a put in the wait queue
+	s3PutWaitDuration = stats.NewLatencyHistogram12h32("store.s3.put.wait")
+	// metric store.s3.get.error is the count of reads that failed
+	s3ReadError = stats.NewCounter32("store.s3.get.error")
+
+	// metric store.s3.chunks_per_response is how many chunks are retrieved per search
+	s3ChunksPerResponse = stats.NewMeter32("store.s3.chunks_per_response", false)
+
+	// metric store.s3.chunk_operations.save_ok is counter of successful saves
+	chunkSaveOk = stats.NewCounter32("store.s3.chunk_operations.save_ok")
+	// metric store.s3.chunk_operations.save_fail is counter of failed saves
+	chunkSaveFail = stats.NewCounter32("store.s3.chunk_operations.save_fail")
+	// metric store.s3.chunk_size.at_save is the sizes of chunks seen when saving them
+	chunkSizeAtSave = stats.NewMeter32("store.s3.chunk_size.at_save", true)
+	// metric store.s3.chunk_size.at_load is the sizes of chunks seen when loading them
+	chunkSizeAtLoad = stats.NewMeter32("store.s3.chunk_size.at_load", true)
+)
+
+// Store saves each chunk as an object in S3 compatible object storage, under the key
+// <prefix><ttl>/<archive key>/<t0>, with t0 zero-padded so that the objects of an archive list in chronological order.
+// objects don't expire by themselves: expire them with lifecycle rules on the <prefix><ttl>/ prefixes.
+type Store struct {
+	cfg              *StoreConfig
+	endpoint         *url.URL
+	client           *http.Client
+	maxChunkSpan     uint32
+	writeQueues      []chan *mdata.ChunkWriteRequest
+	writeQueueMeters []*stats.Range32
+	readLimiter      util.Limiter
+	shutdown         chan struct{}
+	wg               sync.WaitGroup
+	tracer           opentracing.Tracer
+}
+
+func NewStore(cfg *StoreConfig, schemaMaxChunkSpan uint32) (*Store, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	endpoint, _ := url.Parse(cfg.Endpoint)
+	s := &Store{
+		cfg:              cfg,
+		endpoint:         endpoint,
+		client:           &http.Client{Timeout: cfg.Timeout},
+		maxChunkSpan:     schemaMaxChunkSpan,
+		writeQueues:      make([]chan *mdata.ChunkWriteRequest, cfg.WriteConcurrency),
+		writeQueueMeters: make([]*stats.Range32, cfg.WriteConcurrency),
+		readLimiter:      util.NewLimiter(cfg.ReadConcurrency),
+		shutdown:         make(chan struct{}),
+	}
+
+	// make sure we can access the bucket
+	err := s.list(context.Background(), cfg.Prefix, "", func(key string) bool { return false })
+	if err != nil {
+		return nil, fmt.Errorf("s3Store: failed to access bucket %s. %s", cfg.Bucket, err)
+	}
+
+	s.wg.Add(cfg.WriteConcurrency)
+	for i := 0; i < cfg.WriteConcurrency; i++ {
+		s.writeQueues[i] = make(chan *mdata.ChunkWriteRequest, cfg.WriteQueueSize)
+		s.writeQueueMeters[i] = stats.NewRange32(fmt.Sprintf("store.s3.write_queue.%d.items", i+1))
+		go s.processWriteQueue(s.writeQueues[i], s.writeQueueMeters[i])
+	}
+	return s, nil
+}
+
+// archivePrefix returns the prefix of the keys of the chunk objects of the archive
+func (s *Store) archivePrefix(key schema.AMKey, ttl uint32) string {
+	return fmt.Sprintf("%s%d/%s/", s.cfg.Prefix, ttl, key)
+}
+
+// objectKey returns the key of the object of the chunk
+func (s *Store) objectKey(key schema.AMKey, ttl, t0 uint32) string {
+	return fmt.Sprintf("%s%010d", s.archivePrefix(key, ttl), t0)
+}
+
+// request returns a request for the object with the given key, or for the bucket if the key is empty
+func (s *Store) request(ctx context.Context, method, key string, params map[string]string, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	path := "/" + key
+	if s.cfg.PathStyle {
+		path = "/" + s.cfg.Bucket + path
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	u.RawQuery = canonicalQuery(params)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if s.cfg.AccessKey != "" {
+		hash := emptyPayloadHash
+		if len(body) > 0 {
+			hash = payloadHash(body)
+		}
+		sign(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, hash, time.Now())
+	}
+	return req, nil
+}
+
+// do executes the request, and returns the response if it was successful. the caller must close its body.
+func (s *Store) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list calls fn for the keys of the objects with the given prefix, that come after startAfter, in lexicographical order.
+// if fn returns false, the listing stops.
+func (s *Store) list(ctx context.Context, prefix, startAfter string, fn func(key string) bool) error {
+	params := map[string]string{
+		"list-type": "2",
+		"prefix":    prefix,
+	}
+	if startAfter != "" {
+		params["start-after"] = startAfter
+	}
+	for {
+		req, err := s.request(ctx, "GET", "", params, nil)
+		if err != nil {
+			return err
+		}
+		pre := time.Now()
+		resp, err := s.do(req)
+		if err != nil {
+			return err
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		s3ListExecDuration.Value(time.Since(pre))
+		if err != nil {
+			return err
+		}
+		for _, c := range res.Contents {
+			if !fn(c.Key) {
+				return nil
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		params["continuation-token"] = res.NextContinuationToken
+	}
+}
+
+func (s *Store) Add(cwr *mdata.ChunkWriteRequest) {
+	sum := int(cwr.Key.MKey.Org)
+	for _, b := range cwr.Key.MKey.Key {
+		sum += int(b)
+	}
+	which := sum % len(s.writeQueues)
+	s.writeQueueMeters[which].Value(len(s.writeQueues[which]))
+	s.writeQueues[which] <- cwr
+}
+
+func (s *Store) processWriteQueue(queue chan *mdata.ChunkWriteRequest, meter *stats.Range32) {
+	defer s.wg.Done()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			meter.Value(len(queue))
+		case cwr := <-queue:
+			meter.Value(len(queue))
+			log.Debugf("s3Store: starting to save %s:%d %v", cwr.Key, cwr.Chunk.Series.T0, cwr.Chunk)
+			s3PutWaitDuration.Value(time.Since(cwr.Timestamp))
+			if !s.put(cwr) {
+				return
+			}
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// put saves the chunk, retrying until it succeeds. it returns false if the store was stopped before it did.
+func (s *Store) put(cwr *mdata.ChunkWriteRequest) bool {
+	buf := cwr.Chunk.Encode(cwr.Span)
+	chunkSizeAtSave.Value(len(buf))
+	objKey := s.objectKey(cwr.Key, cwr.TTL, cwr.Chunk.Series.T0)
+	attempts := 0
+	for {
+		pre := time.Now()
+		req, err := s.request(context.Background(), "PUT", objKey, nil, buf)
+		var resp *http.Response
+		if err == nil {
+			resp, err = s.do(req)
+		}
+		s3PutExecDuration.Value(time.Since(pre))
+		if err == nil {
+			resp.Body.Close()
+			cwr.Metric.SyncChunkSaveState(cwr.Chunk.Series.T0)
+			mdata.SendPersistMessage(cwr.Key.String(), cwr.Chunk.Series.T0)
+			log.Debugf("s3Store: save complete. %s:%d %v", cwr.Key, cwr.Chunk.Series.T0, cwr.Chunk)
+			chunkSaveOk.Inc()
+			return true
+		}
+		if (attempts % 20) == 0 {
+			log.Warnf("s3Store: failed to save chunk to s3 after %d attempts. %v, %s", attempts+1, cwr.Chunk, err)
+		}
+		chunkSaveFail.Inc()
+		sleepTime := 100 * attempts
+		if sleepTime > 2000 {
+			sleepTime = 2000
+		}
+		select {
+		case <-time.After(time.Duration(sleepTime) * time.Millisecond):
+		case <-s.shutdown:
+			return false
+		}
+		attempts++
+	}
+}
+
+// Search returns the chunks of the archive that have data in the range start (inclusive) - end (exclusive).
+// only the objects of the chunks that may have data in the range are read: as object keys sort chronologically,
+// the listing starts after the t0's of chunks that end before start, given the max chunkspan of the storage-schemas,
+// and stops at the first chunk that starts at or after end.
+func (s *Store) Search(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
+	_, span := tracing.NewSpan(ctx, s.tracer, "S3Store.Search")
+	defer span.Finish()
+	tags.SpanKindRPCClient.Set(span)
+	tags.PeerService.Set(span, "s3")
+
+	if start >= end {
+		tracing.Failure(span)
+		tracing.Error(span, errInvalidRange)
+		return nil, errInvalidRange
+	}
+
+	prefix := s.archivePrefix(key, ttl)
+	var startAfter string
+	if start > s.maxChunkSpan {
+		startAfter = s.objectKey(key, ttl, start-s.maxChunkSpan)
+	}
+	var t0s []uint32
+	var objKeys []string
+	if !s.readLimiter.Acquire(ctx) {
+		return nil, errCtxCanceled
+	}
+	err := s.list(ctx, prefix, startAfter, func(objKey string) bool {
+		t0, err := strconv.ParseUint(strings.TrimPrefix(objKey, prefix), 10, 32)
+		if err != nil {
+			// not a chunk object
+			return true
+		}
+		if uint32(t0) >= end {
+			return false
+		}
+		t0s = append(t0s, uint32(t0))
+		objKeys = append(objKeys, objKey)
+		return true
+	})
+	s.readLimiter.Release()
+	if err != nil {
+		if ctx.Err() != nil {
+			// query was aborted.
+			return nil, nil
+		}
+		s3ReadError.Inc()
+		tracing.Failure(span)
+		tracing.Error(span, err)
+		return nil, err
+	}
+
+	itgens := make([]chunk.IterGen, len(objKeys))
+	errs := make([]error, len(objKeys))
+	var wg sync.WaitGroup
+	for i := range objKeys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if !s.readLimiter.Acquire(ctx) {
+				errs[i] = errCtxCanceled
+				return
+			}
+			defer s.readLimiter.Release()
+			itgens[i], errs[i] = s.get(ctx, objKeys[i], t0s[i], key.Archive.Span())
+		}(i)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		// query was aborted.
+		return nil, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			s3ReadError.Inc()
+			tracing.Failure(span)
+			tracing.Error(span, err)
+			return nil, err
+		}
+	}
+	s3ChunksPerResponse.Value(len(itgens))
+	span.SetTag("chunks", len(itgens))
+	return itgens, nil
+}
+
+// get reads the chunk object with the given key
+func (s *Store) get(ctx context.Context, objKey string, t0, intervalHint uint32) (chunk.IterGen, error) {
+	pre := time.Now()
+	req, err := s.request(ctx, "GET", objKey, nil, nil)
+	if err != nil {
+		return chunk.IterGen{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return chunk.IterGen{}, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	s3GetExecDuration.Value(time.Since(pre))
+	if err != nil {
+		return chunk.IterGen{}, err
+	}
+	chunkSizeAtLoad.Value(len(b))
+	if len(b) < 2 {
+		return chunk.IterGen{}, errChunkTooSmall
+	}
+	return chunk.NewIterGen(t0, intervalHint, b)
+}
+
+// CompactChunks is not supported: reads only look back the max chunkspan of the schemas for the first chunk,
+// so they would miss compacted chunks, which have a larger span
+func (s *Store) CompactChunks(ctx context.Context, cwr *mdata.ChunkWriteRequest, t0s []uint32) error {
+	return mdata.ErrCompactUnsupported
+}
+
+// Delete deletes all chunk objects of the given archive that were saved with the given ttl
+func (s *Store) Delete(ctx context.Context, key schema.AMKey, ttl uint32) error {
+	var objKeys []string
+	err := s.list(ctx, s.archivePrefix(key, ttl), "", func(objKey string) bool {
+		objKeys = append(objKeys, objKey)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return s.deleteObjects(ctx, objKeys)
+}
+
+// DeleteRange deletes the chunk objects of the given archive that were saved with the given ttl,
+// and whose t0 is in the range from (inclusive) - to (exclusive)
+func (s *Store) DeleteRange(ctx context.Context, key schema.AMKey, ttl, from, to uint32) error {
+	if from >= to {
+		return nil
+	}
+	prefix := s.archivePrefix(key, ttl)
+	var startAfter string
+	if from > 0 {
+		startAfter = s.objectKey(key, ttl, from-1)
+	}
+	var objKeys []string
+	err := s.list(ctx, prefix, startAfter, func(objKey string) bool {
+		t0, err := strconv.ParseUint(strings.TrimPrefix(objKey, prefix), 10, 32)
+		if err != nil {
+			// not a chunk object
+			return true
+		}
+		if uint32(t0) >= to {
+			return false
+		}
+		objKeys = append(objKeys, objKey)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return s.deleteObjects(ctx, objKeys)
+}
+
+// deleteObjects deletes the objects with the given keys
+func (s *Store) deleteObjects(ctx context.Context, objKeys []string) error {
+	for _, objKey := range objKeys {
+		req, err := s.request(ctx, "DELETE", objKey, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Stats returns the state of the store: how many chunks are waiting to be saved, over all write queues
+func (s *Store) Stats() mdata.StoreStats {
+	stats := mdata.StoreStats{Backend: "s3"}
+	for _, q := range s.writeQueues {
+		stats.WriteQueueItems += len(q)
+		stats.WriteQueueSize += cap(q)
+	}
+	return stats
+}
+
+func (s *Store) Stop() {
+	close(s.shutdown)
+	s.wg.Wait()
+}
+
+func (s *Store) SetTracer(t opentracing.Tracer) {
+	s.tracer = t
+}
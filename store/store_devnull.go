@@ -31,8 +31,24 @@ func (c *devnullStore) Search(ctx context.Context, key schema.AMKey, ttl, start,
 	return nil, nil
 }
 
+func (c *devnullStore) Stats() mdata.StoreStats {
+	return mdata.StoreStats{Backend: "devnull"}
+}
+
 func (c *devnullStore) Stop() {
 }
 
 func (c *devnullStore) SetTracer(t opentracing.Tracer) {
 }
+
+func (c *devnullStore) Delete(ctx context.Context, key schema.AMKey, ttl uint32) error {
+	return nil
+}
+
+func (c *devnullStore) DeleteRange(ctx context.Context, key schema.AMKey, ttl, from, to uint32) error {
+	return nil
+}
+
+func (c *devnullStore) CompactChunks(ctx context.Context, cwr *mdata.ChunkWriteRequest, t0s []uint32) error {
+	return nil
+}